@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"github.com/aakso/ssh-inscribe/pkg/client"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var approvalStatus string
+
+var ApprovalCmd = &cobra.Command{
+	Use:   "approval",
+	Short: "Approval requests for sensitive principals",
+	Long: `Certificates with principals configured as sensitive on the server are
+only signed once another user has approved the request. Requesters wait for
+the decision when requesting the certificate. Deciding on requests requires
+approver or admin privileges on the server. An approval covers the
+certificate lifetime shown in the list, certificates expiring later need a
+new approval.`,
+}
+
+var ListApprovalCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List approval requests",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := &client.Client{
+			Config: ClientConfig,
+		}
+		defer c.Close()
+		return c.ListApprovals(approvalStatus)
+	},
+	ValidArgsFunction: noCompletion,
+}
+
+var ApproveCmd = &cobra.Command{
+	Use:   "approve <id>",
+	Short: "Approve a pending request",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return decideApproval(args, true)
+	},
+	ValidArgsFunction: noCompletion,
+}
+
+var DenyCmd = &cobra.Command{
+	Use:   "deny <id>",
+	Short: "Deny a pending request",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return decideApproval(args, false)
+	},
+	ValidArgsFunction: noCompletion,
+}
+
+func decideApproval(args []string, approve bool) error {
+	if len(args) != 1 {
+		return errors.New("specify approval request id")
+	}
+	c := &client.Client{
+		Config: ClientConfig,
+	}
+	defer c.Close()
+	return c.DecideApproval(args[0], approve)
+}
+
+func init() {
+	RootCmd.AddCommand(ApprovalCmd)
+	ApprovalCmd.AddCommand(ListApprovalCmd)
+	ApprovalCmd.AddCommand(ApproveCmd)
+	ApprovalCmd.AddCommand(DenyCmd)
+	ListApprovalCmd.Flags().StringVar(
+		&approvalStatus,
+		"status",
+		"",
+		"Only list requests with the status: pending, approved or denied",
+	)
+	_ = ListApprovalCmd.RegisterFlagCompletionFunc("status", noCompletion)
+	for _, cmd := range []*cobra.Command{ApproveCmd, DenyCmd} {
+		cmd.Flags().StringVar(
+			&ClientConfig.ApprovalComment,
+			"comment",
+			"",
+			"Comment to record with the decision",
+		)
+		_ = cmd.RegisterFlagCompletionFunc("comment", noCompletion)
+	}
+}
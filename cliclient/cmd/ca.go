@@ -58,6 +58,72 @@ var AddCaCmd = &cobra.Command{
 	},
 }
 
+var CaRotationCmd = &cobra.Command{
+	Use:   "rotation",
+	Short: "CA key rotation",
+	Long: `Rotate the default CA key. Starting a rotation adds the next key and
+schedules the cutover time after which it signs all certificates. Both keys
+are served in the trust bundle until the previous key is retired. Requires
+admin privileges on the server.`,
+}
+
+var ShowCaRotationCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Show CA key rotation status",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := &client.Client{
+			Config: ClientConfig,
+		}
+		defer c.Close()
+		return c.CARotationStatus()
+	},
+	ValidArgsFunction: noCompletion,
+}
+
+var StartCaRotationCmd = &cobra.Command{
+	Use:   "start [keyfile]",
+	Short: "Start rotating to the CA private key from file, or a key generated on the server",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) > 1 {
+			return errors.New("specify at most one ca key file")
+		}
+		if len(args) == 1 {
+			ClientConfig.CAKeyFile = args[0]
+		}
+		c := &client.Client{
+			Config: ClientConfig,
+		}
+		defer c.Close()
+		return c.StartCARotation()
+	},
+}
+
+var CancelCaRotationCmd = &cobra.Command{
+	Use:   "cancel",
+	Short: "Cancel a pending CA key rotation",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := &client.Client{
+			Config: ClientConfig,
+		}
+		defer c.Close()
+		return c.CancelCARotation()
+	},
+	ValidArgsFunction: noCompletion,
+}
+
+var RetireCaKeyCmd = &cobra.Command{
+	Use:   "retire",
+	Short: "Retire the previous CA key after the cutover",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := &client.Client{
+			Config: ClientConfig,
+		}
+		defer c.Close()
+		return c.RetireCAKey()
+	},
+	ValidArgsFunction: noCompletion,
+}
+
 func init() {
 	RootCmd.AddCommand(CaCmd)
 	CaCmd.AddCommand(ShowCaCmd)
@@ -70,4 +136,17 @@ func init() {
 	)
 	_ = ShowCaCmd.RegisterFlagCompletionFunc("principals", noCompletion)
 	CaCmd.AddCommand(AddCaCmd)
+
+	CaCmd.AddCommand(CaRotationCmd)
+	CaRotationCmd.AddCommand(ShowCaRotationCmd)
+	CaRotationCmd.AddCommand(StartCaRotationCmd)
+	CaRotationCmd.AddCommand(CancelCaRotationCmd)
+	CaRotationCmd.AddCommand(RetireCaKeyCmd)
+	StartCaRotationCmd.Flags().DurationVar(
+		&ClientConfig.CARotationCutover,
+		"cutover",
+		0,
+		"Time from now until the next key takes over signing, immediately if not set",
+	)
+	_ = StartCaRotationCmd.RegisterFlagCompletionFunc("cutover", noCompletion)
 }
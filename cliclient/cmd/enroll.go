@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/aakso/ssh-inscribe/pkg/client"
+	"github.com/skip2/go-qrcode"
+	"github.com/spf13/cobra"
+)
+
+var EnrollCmd = &cobra.Command{
+	Use:   "enroll <authenticator>",
+	Short: "Enroll to an authenticator such as TOTP or WebAuthn",
+	Long: "Enroll to an authenticator such as TOTP. Login with the --login endpoints first, " +
+		"e.g. sshi enroll totp --login ldap. Scan the QR code with an authenticator app " +
+		"and confirm the enrollment by logging in with a code. WebAuthn enrollments are " +
+		"completed in the browser.",
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := &client.Client{
+			Config: ClientConfig,
+		}
+		defer c.Close()
+		result, err := c.Enroll(args[0])
+		if err != nil {
+			return err
+		}
+		// Browser based enrollments, like WebAuthn, have no secret
+		if result.Secret == "" {
+			fmt.Printf("Open the following URL in a browser to complete the enrollment:\n%s\n", result.URI)
+			return nil
+		}
+		if code, err := qrcode.New(result.URI, qrcode.Medium); err == nil {
+			// Dark modules as spaces so the code reads on dark backgrounds
+			fmt.Print(code.ToSmallString(false))
+		}
+		fmt.Printf("secret: %s\n", result.Secret)
+		fmt.Printf("uri: %s\n", result.URI)
+		return nil
+	},
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) > 0 {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		c := &client.Client{
+			Config: ClientConfig,
+		}
+		defer c.Close()
+		discoverResult, err := c.GetAuthenticators()
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveError
+		}
+		names := make([]string, len(discoverResult))
+		for i, v := range discoverResult {
+			names[i] = v.AuthenticatorName
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(EnrollCmd)
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/aakso/ssh-inscribe/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var HostCmd = &cobra.Command{
+	Use:   "host",
+	Short: "Host certificate management",
+}
+
+var HostSignCmd = &cobra.Command{
+	Use:   "sign",
+	Short: "Request a host certificate for a host public key",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := &client.Client{
+			Config: ClientConfig,
+		}
+		defer c.Close()
+		return c.SignHost()
+	},
+	ValidArgsFunction: noCompletion,
+}
+
+var HostTokenCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Create a bootstrap token for unattended host enrollment",
+	Long: `Create a bootstrap token for unattended host enrollment. The token lets a
+host request its host certificate with "sshi host sign --bootstrap-token"
+without authenticating. The token is printed to stdout. Requires admin
+privileges on the server.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := &client.Client{
+			Config: ClientConfig,
+		}
+		defer c.Close()
+		return c.CreateBootstrapToken()
+	},
+	ValidArgsFunction: noCompletion,
+}
+
+func init() {
+	RootCmd.AddCommand(HostCmd)
+	HostCmd.AddCommand(HostSignCmd)
+	HostCmd.AddCommand(HostTokenCmd)
+
+	defHostKey := os.Getenv("SSH_INSCRIBE_HOST_KEY")
+	if defHostKey == "" {
+		defHostKey = "/etc/ssh/ssh_host_ed25519_key.pub"
+	}
+	HostSignCmd.Flags().StringVarP(
+		&ClientConfig.HostKeyFile,
+		"key",
+		"k",
+		defHostKey,
+		"Host public key file ($SSH_INSCRIBE_HOST_KEY)",
+	)
+	HostSignCmd.Flags().StringSliceVar(
+		&ClientConfig.Hostnames,
+		"hostnames",
+		nil,
+		"Hostnames to include in the certificate. Can be repeated or comma separated",
+	)
+	_ = HostSignCmd.RegisterFlagCompletionFunc("hostnames", noCompletion)
+	HostSignCmd.Flags().BoolVarP(
+		&ClientConfig.WriteCert,
+		"write",
+		"w",
+		false,
+		"Write certificate to <key without .pub>-cert.pub",
+	)
+	HostSignCmd.Flags().StringVar(
+		&ClientConfig.BootstrapToken,
+		"bootstrap-token",
+		os.Getenv("SSH_INSCRIBE_BOOTSTRAP_TOKEN"),
+		"Use a bootstrap token instead of authenticating ($SSH_INSCRIBE_BOOTSTRAP_TOKEN)",
+	)
+	_ = HostSignCmd.RegisterFlagCompletionFunc("bootstrap-token", noCompletion)
+
+	HostTokenCmd.Flags().StringSliceVar(
+		&ClientConfig.Hostnames,
+		"hostnames",
+		nil,
+		"Hostname patterns the token is valid for. Can be repeated or comma separated",
+	)
+	_ = HostTokenCmd.RegisterFlagCompletionFunc("hostnames", noCompletion)
+	HostTokenCmd.Flags().DurationVar(
+		&ClientConfig.BootstrapTokenTTL,
+		"ttl",
+		0,
+		"Token lifetime, server default if not set",
+	)
+	HostTokenCmd.Flags().IntVar(
+		&ClientConfig.BootstrapTokenUses,
+		"uses",
+		1,
+		"Number of times the token can be used",
+	)
+}
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aakso/ssh-inscribe/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var RevokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke the current certificate and remove it from the ssh-agent",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := &client.Client{
+			Config: ClientConfig,
+		}
+		defer c.Close()
+		if err := c.Revoke(); err != nil {
+			return err
+		}
+		if !ClientConfig.Quiet {
+			fmt.Println("certificate revoked")
+		}
+		return nil
+	},
+	ValidArgsFunction: noCompletion,
+}
+
+func init() {
+	RootCmd.AddCommand(RevokeCmd)
+	RevokeCmd.Flags().StringVarP(
+		&ClientConfig.IdentityFile,
+		"identity",
+		"i",
+		os.Getenv("SSH_INSCRIBE_IDENTITY"),
+		"Identity (private key) file location. Certificate is read from <identity>-cert.pub ($SSH_INSCRIBE_IDENTITY)",
+	)
+	RevokeCmd.Flags().StringVar(
+		&ClientConfig.RevokeReason,
+		"reason",
+		"",
+		"Reason for the revocation",
+	)
+	_ = RevokeCmd.RegisterFlagCompletionFunc("reason", noCompletion)
+}
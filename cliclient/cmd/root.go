@@ -96,6 +96,29 @@ func init() {
 	)
 	_ = RootCmd.RegisterFlagCompletionFunc("retries", noCompletion)
 
+	RootCmd.PersistentFlags().StringVar(
+		&ClientConfig.CorrelationID,
+		"correlation-id",
+		os.Getenv("SSH_INSCRIBE_CORRELATION_ID"),
+		"Correlation id sent with every request, generated if not set ($SSH_INSCRIBE_CORRELATION_ID)",
+	)
+	_ = RootCmd.RegisterFlagCompletionFunc("correlation-id", noCompletion)
+
+	RootCmd.PersistentFlags().StringVar(
+		&ClientConfig.Audience,
+		"audience",
+		os.Getenv("SSH_INSCRIBE_AUDIENCE"),
+		"Audience, e.g. the tenant, of the auth endpoints to use ($SSH_INSCRIBE_AUDIENCE)",
+	)
+	_ = RootCmd.RegisterFlagCompletionFunc("audience", noCompletion)
+	RootCmd.PersistentFlags().StringVar(
+		&ClientConfig.Realm,
+		"realm",
+		os.Getenv("SSH_INSCRIBE_REALM"),
+		"Realm of the auth endpoints to use ($SSH_INSCRIBE_REALM)",
+	)
+	_ = RootCmd.RegisterFlagCompletionFunc("realm", noCompletion)
+
 	if os.Getenv("SSH_INSCRIBE_DEBUG") != "" {
 		ClientConfig.Debug = true
 	}
@@ -116,6 +139,26 @@ func init() {
 		"Disable TLS validation for the server connection (not recommended) ($SSH_INSCRIBE_INSECURE)",
 	)
 
+	RootCmd.PersistentFlags().StringVar(
+		&ClientConfig.ClientCertFile,
+		"client-cert",
+		os.Getenv("SSH_INSCRIBE_CLIENT_CERT"),
+		"TLS client certificate file for client certificate auth ($SSH_INSCRIBE_CLIENT_CERT)",
+	)
+	RootCmd.PersistentFlags().StringVar(
+		&ClientConfig.ClientKeyFile,
+		"client-key",
+		os.Getenv("SSH_INSCRIBE_CLIENT_KEY"),
+		"TLS client key file, the certificate file if empty ($SSH_INSCRIBE_CLIENT_KEY)",
+	)
+
+	RootCmd.PersistentFlags().StringVar(
+		&ClientConfig.TokenFile,
+		"token-file",
+		os.Getenv("SSH_INSCRIBE_TOKEN_FILE"),
+		"File with the token for bearer token auth, e.g. a workload identity token ($SSH_INSCRIBE_TOKEN_FILE)",
+	)
+
 	if os.Getenv("SSH_INSCRIBE_LOGLEVEL") != "" {
 		logLevel = os.Getenv("SSH_INSCRIBE_LOGLEVEL")
 	}
@@ -201,6 +244,14 @@ func init() {
 	)
 	_ = RootCmd.RegisterFlagCompletionFunc("exclude", noCompletion)
 
+	RootCmd.PersistentFlags().StringVar(
+		&ClientConfig.CA,
+		"ca",
+		os.Getenv("SSH_INSCRIBE_CA"),
+		"Name of the CA key to sign with ($SSH_INSCRIBE_CA)",
+	)
+	_ = RootCmd.RegisterFlagCompletionFunc("ca", noCompletion)
+
 	var defExpire time.Duration
 	if expire := os.Getenv("SSH_INSCRIBE_EXPIRE"); expire != "" {
 		defExpire, _ = time.ParseDuration(expire)
@@ -0,0 +1,23 @@
+package cmd
+
+import (
+	"github.com/aakso/ssh-inscribe/pkg/client"
+	"github.com/spf13/cobra"
+)
+
+var StatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Login to server and show the principals and lifetime you are entitled to",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c := &client.Client{
+			Config: ClientConfig,
+		}
+		defer c.Close()
+		return c.Status()
+	},
+	ValidArgsFunction: noCompletion,
+}
+
+func init() {
+	RootCmd.AddCommand(StatusCmd)
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+var auditVerifyKeys []string
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Audit log tools",
+	Long:  "Audit log tools",
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify <file>",
+	Short: "Verify a hash chained audit file",
+	Long: `Verify the hash chain of an audit file written with chain enabled and the
+checkpoint signatures made with the given public keys. Events after the last
+signed checkpoint are not protected against truncation`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var keys []ssh.PublicKey
+		for _, fn := range auditVerifyKeys {
+			data, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return errors.Wrap(err, "cannot read public key")
+			}
+			for len(data) > 0 {
+				key, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+				if err != nil {
+					break
+				}
+				keys = append(keys, key)
+				data = rest
+			}
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		st, err := audit.VerifyChain(f, keys)
+		if err != nil {
+			return errors.Wrap(err, "verification failed")
+		}
+		fmt.Printf("lines: %d\nlast sequence: %d\nsigned up to: %d\n", st.Lines, st.LastSeq, st.SignedSeq)
+		if st.Unverified > 0 {
+			fmt.Printf("checkpoints with unknown keys: %d\n", st.Unverified)
+		}
+		if len(keys) > 0 && st.SignedSeq == 0 {
+			return errors.New("no checkpoint signed with the given keys")
+		}
+		return nil
+	},
+}
+
+func init() {
+	auditVerifyCmd.Flags().StringSliceVar(&auditVerifyKeys, "key", nil, "Public key file of the checkpoint signing key, may be repeated")
+	auditCmd.AddCommand(auditVerifyCmd)
+	RootCmd.AddCommand(auditCmd)
+}
@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/certdb"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var (
+	certsFilter        certdb.Filter
+	certsValid         bool
+	certsIssuedAfter   string
+	certsIssuedBefore  string
+	certsExpiresAfter  string
+	certsExpiresBefore string
+	certsJSON          bool
+)
+
+var certsCmd = &cobra.Command{
+	Use:   "certs",
+	Short: "Query the issued certificate database",
+	Long:  "Query the issued certificate database",
+}
+
+var certsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List issued certificates",
+	Long:  "List issued certificates, newest first",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		times := []struct {
+			flag string
+			val  string
+			dst  *time.Time
+		}{
+			{"issued-after", certsIssuedAfter, &certsFilter.IssuedAfter},
+			{"issued-before", certsIssuedBefore, &certsFilter.IssuedBefore},
+			{"expires-after", certsExpiresAfter, &certsFilter.ExpiresAfter},
+			{"expires-before", certsExpiresBefore, &certsFilter.ExpiresBefore},
+		}
+		for _, t := range times {
+			if t.val == "" {
+				continue
+			}
+			ts, err := parseTimeArg(t.val)
+			if err != nil {
+				return errors.Wrapf(err, "invalid --%s", t.flag)
+			}
+			*t.dst = ts
+		}
+		if certsValid {
+			certsFilter.ValidAt = time.Now()
+		}
+
+		store, err := openCertDB()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		records, err := store.List(certsFilter)
+		if err != nil {
+			return err
+		}
+		if certsJSON {
+			return printJSON(records)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SERIAL\tSUBJECT\tPRINCIPALS\tISSUED\tEXPIRES\tFINGERPRINT")
+		for _, r := range records {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n",
+				r.Serial,
+				r.Subject,
+				strings.Join(r.Principals, ","),
+				r.IssuedAt.Local().Format(time.RFC3339),
+				r.ValidBefore.Local().Format(time.RFC3339),
+				r.PublicKeyFingerprint,
+			)
+		}
+		return w.Flush()
+	},
+}
+
+var certsShowCmd = &cobra.Command{
+	Use:   "show <serial>",
+	Short: "Show an issued certificate",
+	Long:  "Show an issued certificate",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("specify certificate serial")
+		}
+		serial, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil {
+			return errors.New("invalid serial")
+		}
+		store, err := openCertDB()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		r, err := store.Get(serial)
+		if err != nil {
+			return err
+		}
+		return printJSON(r)
+	},
+}
+
+func openCertDB() (certdb.Store, error) {
+	store, _, err := certdb.Open()
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, errors.New("certificate database is not enabled")
+	}
+	return store, nil
+}
+
+func printJSON(v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// Accept either RFC3339 timestamp or a duration relative to now, e.g. -24h
+func parseTimeArg(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func init() {
+	RootCmd.AddCommand(certsCmd)
+	certsCmd.AddCommand(certsListCmd)
+	certsCmd.AddCommand(certsShowCmd)
+
+	f := certsListCmd.Flags()
+	f.StringVar(&certsFilter.Subject, "user", "", "Only certificates issued to this subject")
+	f.StringVar(&certsFilter.Principal, "principal", "", "Only certificates with this principal")
+	f.StringVar(&certsFilter.KeyID, "key-id", "", "Only certificates with this key id")
+	f.BoolVar(&certsValid, "valid", false, "Only currently valid certificates")
+	f.StringVar(&certsIssuedAfter, "issued-after", "", "Issued after time (RFC3339 or relative duration like -24h)")
+	f.StringVar(&certsIssuedBefore, "issued-before", "", "Issued before time (RFC3339 or relative duration like -24h)")
+	f.StringVar(&certsExpiresAfter, "expires-after", "", "Expires after time (RFC3339 or relative duration like 1h)")
+	f.StringVar(&certsExpiresBefore, "expires-before", "", "Expires before time (RFC3339 or relative duration like 1h)")
+	f.IntVar(&certsFilter.Limit, "limit", 0, "Maximum number of certificates to list")
+	f.BoolVar(&certsJSON, "json", false, "Output as JSON")
+}
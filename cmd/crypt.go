@@ -3,25 +3,52 @@ package cmd
 import (
 	"fmt"
 
+	"github.com/aakso/ssh-inscribe/pkg/auth/backend/authfile"
 	"github.com/bgentry/speakeasy"
 	"github.com/spf13/cobra"
-	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v2"
 )
 
+var cryptOpts struct {
+	Algorithm  string
+	User       string
+	Principals []string
+}
+
 // serverCmd represents the server command
 var cryptCmd = &cobra.Command{
 	Use:   "crypt",
 	Short: "Make password hash for the authfile backend",
-	Long:  "Make password hash for the authfile backend",
+	Long: `Make password hash for the authfile backend. With --user the output is
+a complete entry for the users list of the file`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		prompt := "Password to be hashed: "
 		ret, _ := speakeasy.Ask(prompt)
-		hash, _ := bcrypt.GenerateFromPassword([]byte(ret), bcrypt.DefaultCost)
-		fmt.Printf("%s\n", hash)
+		hash, err := authfile.HashPassword([]byte(ret), cryptOpts.Algorithm)
+		if err != nil {
+			return err
+		}
+		if cryptOpts.User == "" {
+			fmt.Printf("%s\n", hash)
+			return nil
+		}
+		entry := []struct {
+			Name       string
+			Password   string
+			Principals []string `yaml:",omitempty"`
+		}{{cryptOpts.User, hash, cryptOpts.Principals}}
+		out, err := yaml.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s", out)
 		return nil
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(cryptCmd)
+	cryptCmd.Flags().StringVar(&cryptOpts.Algorithm, "algorithm", authfile.HashBcrypt, "Hash algorithm, bcrypt or argon2id")
+	cryptCmd.Flags().StringVar(&cryptOpts.User, "user", "", "Print a users file entry for this user")
+	cryptCmd.Flags().StringSliceVar(&cryptOpts.Principals, "principals", nil, "Principals of the user entry")
 }
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aakso/ssh-inscribe/pkg/server"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+var devOpts = server.DevOptions{
+	Listen: "127.0.0.1:8540",
+	User:   os.Getenv("USER"),
+}
+
+var devCmd = &cobra.Command{
+	Use:   "dev",
+	Short: "Start a development server with an ephemeral CA",
+	Long: `Start the server with an in-memory CA key, a single static test user and
+plain HTTP or a self-signed certificate. The configuration file is ignored
+and all state is discarded on exit. Not for production use`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if devOpts.User == "" {
+			devOpts.User = "dev"
+		}
+		env, err := server.NewDevEnv(devOpts)
+		if err != nil {
+			return err
+		}
+		defer env.Close()
+		srv, err := server.Build()
+		if err != nil {
+			return err
+		}
+		fmt.Println("# ssh-inscribe development server, state is discarded on exit")
+		fmt.Printf("# user: %s password: %s\n", env.User, env.Password)
+		fmt.Printf("# CA: %s", ssh.MarshalAuthorizedKey(env.CA))
+		fmt.Println(strings.Join(env.ClientEnv(), "\n"))
+		return srv.Start()
+	},
+}
+
+func init() {
+	devCmd.Flags().StringVar(&devOpts.Listen, "listen", devOpts.Listen, "Listen address, use port 0 to pick a free port")
+	devCmd.Flags().StringVar(&devOpts.User, "user", devOpts.User, "Name of the test user")
+	devCmd.Flags().StringVar(&devOpts.Password, "password", "", "Password of the test user, generated if empty")
+	devCmd.Flags().StringSliceVar(&devOpts.Principals, "principals", nil, "Additional principals of the test user")
+	devCmd.Flags().BoolVar(&devOpts.TLS, "tls", false, "Serve with a self-signed certificate")
+	RootCmd.AddCommand(devCmd)
+}
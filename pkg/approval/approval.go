@@ -0,0 +1,282 @@
+package approval
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+var Log = logging.GetLogger("approval").WithField("pkg", "approval")
+
+var (
+	ErrNotFound     = errors.New("approval request not found")
+	ErrNotPending   = errors.New("approval request is not pending")
+	ErrPending      = errors.New("approval request is still pending")
+	ErrDenied       = errors.New("approval request was denied")
+	ErrSelfApproval = errors.New("requesters cannot decide on their own requests")
+	ErrMismatch     = errors.New("approval does not match the certificate request")
+)
+
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusDenied   = "denied"
+)
+
+// Request for a certificate with principals that require approval from
+// another user. An approved request can be used once to sign the same
+// public key for the same principals, valid until ValidBefore at most
+type Request struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Requester string `json:"requester"`
+	// All principals of the certificate and the ones requiring approval
+	Principals           []string   `json:"principals"`
+	SensitivePrincipals  []string   `json:"sensitive_principals"`
+	PublicKeyFingerprint string     `json:"pubkey_fp"`
+	CA                   string     `json:"ca,omitempty"`
+	ValidBefore          time.Time  `json:"valid_before"`
+	CreatedAt            time.Time  `json:"created_at"`
+	Expires              time.Time  `json:"expires"`
+	DecidedBy            string     `json:"decided_by,omitempty"`
+	DecidedAt            *time.Time `json:"decided_at,omitempty"`
+	Comment              string     `json:"comment,omitempty"`
+}
+
+func (r *Request) copy() Request {
+	c := *r
+	c.Principals = append([]string(nil), r.Principals...)
+	c.SensitivePrincipals = append([]string(nil), r.SensitivePrincipals...)
+	return c
+}
+
+// Whether the request is for the same certificate. The certificate may
+// expire earlier than requested
+func (r *Request) matches(requester, fingerprint, ca string, principals []string, validBefore time.Time) bool {
+	if r.Requester != requester || r.PublicKeyFingerprint != fingerprint || r.CA != ca {
+		return false
+	}
+	if validBefore.After(r.ValidBefore) {
+		return false
+	}
+	return equalSet(r.Principals, principals)
+}
+
+func equalSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	x := append([]string(nil), a...)
+	y := append([]string(nil), b...)
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Store keeps the approval requests and persists them into a JSON file.
+// With an empty path the store is kept in memory only
+type Store struct {
+	sync.Mutex
+	path     string
+	ttl      time.Duration
+	requests map[string]*Request
+}
+
+// Requests expire if not decided on within ttl and approvals if not used
+// within ttl of the decision
+func NewStore(path string, ttl time.Duration) (*Store, error) {
+	if ttl <= 0 {
+		return nil, errors.New("approval ttl must be positive")
+	}
+	s := &Store{path: path, ttl: ttl, requests: make(map[string]*Request)}
+	if path == "" {
+		return s, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "cannot read approval store")
+	}
+	var requests []*Request
+	if err := json.Unmarshal(raw, &requests); err != nil {
+		return nil, errors.Wrap(err, "cannot parse approval store")
+	}
+	for _, r := range requests {
+		s.requests[r.ID] = r
+	}
+	Log.WithField("path", path).WithField("requests", len(requests)).Debug("loaded approval store")
+	return s, nil
+}
+
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	raw, err := json.MarshalIndent(s.list(""), "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "cannot encode approval store")
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return errors.Wrap(err, "cannot write approval store")
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return errors.Wrap(err, "cannot write approval store")
+	}
+	return nil
+}
+
+// Drop expired requests. Must be called with the lock held
+func (s *Store) prune(now time.Time) bool {
+	changed := false
+	for id, r := range s.requests {
+		if !now.Before(r.Expires) {
+			delete(s.requests, id)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (s *Store) list(status string) []Request {
+	ret := make([]Request, 0, len(s.requests))
+	for _, r := range s.requests {
+		if status == "" || r.Status == status {
+			ret = append(ret, r.copy())
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+	return ret
+}
+
+// Create a pending request. An undecided or approved request for the same
+// certificate is returned instead of creating a duplicate. The bool is true
+// if the request was created
+func (s *Store) Create(r Request) (*Request, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now().UTC()
+	s.prune(now)
+	for _, existing := range s.requests {
+		if existing.Status != StatusDenied &&
+			existing.matches(r.Requester, r.PublicKeyFingerprint, r.CA, r.Principals, r.ValidBefore) {
+			ret := existing.copy()
+			return &ret, false, nil
+		}
+	}
+	var idb [8]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return nil, false, errors.Wrap(err, "cannot generate approval request id")
+	}
+	n := r.copy()
+	n.ID = hex.EncodeToString(idb[:])
+	n.Status = StatusPending
+	n.CreatedAt = now
+	n.Expires = now.Add(s.ttl)
+	n.DecidedBy, n.DecidedAt, n.Comment = "", nil, ""
+	s.requests[n.ID] = &n
+	if err := s.save(); err != nil {
+		delete(s.requests, n.ID)
+		return nil, false, err
+	}
+	ret := n.copy()
+	return &ret, true, nil
+}
+
+func (s *Store) Get(id string) (*Request, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.requests[id]
+	if !ok || !time.Now().Before(r.Expires) {
+		return nil, ErrNotFound
+	}
+	ret := r.copy()
+	return &ret, nil
+}
+
+// List the requests having the status or all if empty
+func (s *Store) List(status string) []Request {
+	s.Lock()
+	defer s.Unlock()
+	if s.prune(time.Now()) {
+		if err := s.save(); err != nil {
+			Log.WithError(err).Error("cannot prune approval requests")
+		}
+	}
+	return s.list(status)
+}
+
+// Approve or deny a pending request. Approved requests can be used within
+// the ttl from the decision
+func (s *Store) Decide(id, approver string, approve bool, comment string) (*Request, error) {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now().UTC()
+	r, ok := s.requests[id]
+	if !ok || !now.Before(r.Expires) {
+		return nil, ErrNotFound
+	}
+	if r.Status != StatusPending {
+		return nil, ErrNotPending
+	}
+	if approver == "" || approver == r.Requester {
+		return nil, ErrSelfApproval
+	}
+	old := *r
+	r.Status = StatusDenied
+	if approve {
+		r.Status = StatusApproved
+	}
+	r.DecidedBy = approver
+	r.DecidedAt = &now
+	r.Comment = comment
+	r.Expires = now.Add(s.ttl)
+	if err := s.save(); err != nil {
+		*r = old
+		return nil, err
+	}
+	ret := r.copy()
+	return &ret, nil
+}
+
+// Use an approved request to sign the certificate it was made for. The
+// request is removed once used
+func (s *Store) Consume(id, requester, fingerprint, ca string, principals []string, validBefore time.Time) (*Request, error) {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.requests[id]
+	if !ok || !time.Now().Before(r.Expires) {
+		return nil, ErrNotFound
+	}
+	if !r.matches(requester, fingerprint, ca, principals, validBefore) {
+		return nil, ErrMismatch
+	}
+	switch r.Status {
+	case StatusPending:
+		return nil, ErrPending
+	case StatusDenied:
+		return nil, ErrDenied
+	}
+	delete(s.requests, id)
+	if err := s.save(); err != nil {
+		// Fail closed: keep the approval used in memory
+		return nil, err
+	}
+	ret := r.copy()
+	return &ret, nil
+}
@@ -0,0 +1,125 @@
+package approval
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "approvaltest")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "approvals.json")
+
+	_, err = NewStore(fn, 0)
+	assert.Error(err)
+	s, err := NewStore(fn, time.Hour)
+	if !assert.NoError(err) {
+		return
+	}
+	validBefore := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	req := Request{
+		Requester:            "alice",
+		Principals:           []string{"alice", "root@prod1"},
+		SensitivePrincipals:  []string{"root@prod1"},
+		PublicKeyFingerprint: "SHA256:abc",
+		ValidBefore:          validBefore,
+	}
+	r, created, err := s.Create(req)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(created)
+	assert.Equal(StatusPending, r.Status)
+
+	// Same certificate requested again
+	req.Principals = []string{"root@prod1", "alice"}
+	again, created, err := s.Create(req)
+	assert.NoError(err)
+	assert.False(created)
+	assert.Equal(r.ID, again.ID)
+	// Longer lived certificate
+	req.ValidBefore = validBefore.Add(time.Second)
+	longer, created, err := s.Create(req)
+	assert.NoError(err)
+	assert.True(created)
+	assert.NotEqual(r.ID, longer.ID)
+	req.ValidBefore = validBefore
+
+	_, err = s.Consume(r.ID, "alice", "SHA256:abc", "", req.Principals, validBefore)
+	assert.Equal(ErrPending, err)
+	_, err = s.Decide(r.ID, "alice", true, "")
+	assert.Equal(ErrSelfApproval, err)
+	_, err = s.Decide("nope", "bob", true, "")
+	assert.Equal(ErrNotFound, err)
+
+	// Persisted
+	s, err = NewStore(fn, time.Hour)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(s.List(StatusPending), 2)
+	if r, err := s.Get(r.ID); assert.NoError(err) {
+		assert.True(validBefore.Equal(r.ValidBefore))
+	}
+
+	d, err := s.Decide(r.ID, "bob", true, "change 123")
+	if assert.NoError(err) {
+		assert.Equal(StatusApproved, d.Status)
+		assert.Equal("bob", d.DecidedBy)
+		assert.NotNil(d.DecidedAt)
+	}
+	_, err = s.Decide(r.ID, "carol", false, "")
+	assert.Equal(ErrNotPending, err)
+
+	// Only for the same certificate and only once
+	_, err = s.Consume(r.ID, "alice", "SHA256:other", "", req.Principals, validBefore)
+	assert.Equal(ErrMismatch, err)
+	_, err = s.Consume(r.ID, "alice", "SHA256:abc", "", []string{"alice"}, validBefore)
+	assert.Equal(ErrMismatch, err)
+	_, err = s.Consume(r.ID, "mallory", "SHA256:abc", "", req.Principals, validBefore)
+	assert.Equal(ErrMismatch, err)
+	_, err = s.Consume(r.ID, "alice", "SHA256:abc", "", req.Principals, validBefore.Add(time.Second))
+	assert.Equal(ErrMismatch, err)
+	// Shorter lived certificate
+	_, err = s.Consume(r.ID, "alice", "SHA256:abc", "", req.Principals, validBefore.Add(-time.Minute))
+	assert.NoError(err)
+	_, err = s.Consume(r.ID, "alice", "SHA256:abc", "", req.Principals, validBefore)
+	assert.Equal(ErrNotFound, err)
+	assert.Len(s.List(""), 1)
+	_, err = s.Decide(longer.ID, "bob", false, "")
+	assert.NoError(err)
+
+	// Denied requests are not reused
+	r, _, _ = s.Create(req)
+	_, err = s.Decide(r.ID, "bob", false, "no")
+	assert.NoError(err)
+	_, err = s.Consume(r.ID, "alice", "SHA256:abc", "", req.Principals, validBefore)
+	assert.Equal(ErrDenied, err)
+	n, created, _ := s.Create(req)
+	assert.True(created)
+	assert.NotEqual(r.ID, n.ID)
+}
+
+func TestExpiry(t *testing.T) {
+	assert := assert.New(t)
+	s, _ := NewStore("", 10*time.Millisecond)
+	r, _, err := s.Create(Request{Requester: "alice", Principals: []string{"root"}})
+	if !assert.NoError(err) {
+		return
+	}
+	time.Sleep(20 * time.Millisecond)
+	_, err = s.Get(r.ID)
+	assert.Equal(ErrNotFound, err)
+	_, err = s.Decide(r.ID, "bob", true, "")
+	assert.Equal(ErrNotFound, err)
+	assert.Empty(s.List(""))
+}
@@ -0,0 +1,181 @@
+package audit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	EventAuthentication         = "authentication"
+	EventCertificateIssued      = "certificate_issued"
+	EventCertificateDenied      = "certificate_denied"
+	EventCertificateRevoked     = "certificate_revoked"
+	EventBootstrapTokenCreated  = "bootstrap_token_created"
+	EventBootstrapTokenDeleted  = "bootstrap_token_deleted"
+	EventBootstrapTokenRejected = "bootstrap_token_rejected"
+	EventBackendDisabled        = "backend_disabled"
+	EventBackendEnabled         = "backend_enabled"
+	EventConfigReloaded         = "config_reloaded"
+	EventCARotationStarted      = "ca_rotation_started"
+	EventCARotationCancelled    = "ca_rotation_cancelled"
+	EventCAKeyRetired           = "ca_key_retired"
+	EventApprovalRequested      = "approval_requested"
+	EventApprovalApproved       = "approval_approved"
+	EventApprovalDenied         = "approval_denied"
+	EventMaintenanceEnabled     = "maintenance_enabled"
+	EventMaintenanceDisabled    = "maintenance_disabled"
+	EventAuditCheckpoint        = "audit_checkpoint"
+	EventLockout                = "lockout"
+	EventLockoutCleared         = "lockout_cleared"
+)
+
+// Event is a single audit record. Events are written by the sinks as JSON
+type Event struct {
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	AuditID string    `json:"audit_id,omitempty"`
+	Success bool      `json:"success"`
+	Reason  string    `json:"reason,omitempty"`
+	// Id of the API request and the correlation id sent by the client
+	RequestID     string `json:"request_id,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	// Who and from where
+	UserIdentifier string   `json:"user_identifier,omitempty"`
+	Subject        string   `json:"subject,omitempty"`
+	RemoteAddress  string   `json:"remote_address,omitempty"`
+	Authenticator  string   `json:"authenticator,omitempty"`
+	Authenticators []string `json:"authenticators,omitempty"`
+
+	// Certificate details
+	CertType             string            `json:"cert_type,omitempty"`
+	Serial               uint64            `json:"serial,omitempty"`
+	KeyID                string            `json:"key_id,omitempty"`
+	Principals           []string          `json:"principals,omitempty"`
+	CriticalOptions      map[string]string `json:"critical_options,omitempty"`
+	Extensions           map[string]string `json:"extensions,omitempty"`
+	ValidAfter           *time.Time        `json:"valid_after,omitempty"`
+	ValidBefore          *time.Time        `json:"valid_before,omitempty"`
+	PublicKeyFingerprint string            `json:"pubkey_fp,omitempty"`
+	// Name of the CA key the certificate was signed with
+	CA string `json:"ca,omitempty"`
+	// Time the next CA key takes over signing in a rotation
+	Cutover *time.Time `json:"cutover,omitempty"`
+	// Policy template applied when signing and the command it forced
+	Policy       string `json:"policy,omitempty"`
+	ForceCommand string `json:"force_command,omitempty"`
+	// Approval request for sensitive principals and who decided on it
+	ApprovalID string `json:"approval_id,omitempty"`
+	Approver   string `json:"approver,omitempty"`
+
+	// Hash chain of the file sink. Checkpoints sign the hash of the previous
+	// line with the key of the fingerprint
+	Seq        uint64 `json:"seq,omitempty"`
+	PrevHash   string `json:"prev_hash,omitempty"`
+	Signature  string `json:"signature,omitempty"`
+	SigningKey string `json:"signing_key,omitempty"`
+}
+
+type Sink interface {
+	Write(e *Event) error
+	Close() error
+}
+
+type SinkFactory func(configsection string) (Sink, error)
+
+var (
+	sinkFactories = make(map[string]SinkFactory)
+
+	mu    sync.RWMutex
+	sinks []Sink
+)
+
+func RegisterSink(typ string, factory SinkFactory) {
+	sinkFactories[typ] = factory
+}
+
+func GetSink(typ string, configsection string) (Sink, error) {
+	if factory, ok := sinkFactories[typ]; ok {
+		return factory(configsection)
+	}
+	return nil, errors.Errorf("unknown audit sink %s", typ)
+}
+
+func getSinkConfig(configsection string, def string) (interface{}, error) {
+	if configsection == "" {
+		configsection = def
+	}
+	tmp, err := config.Get(configsection)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get audit sink configuration")
+	}
+	return tmp, nil
+}
+
+// Initialize audit sinks from the configuration
+func Setup() error {
+	tmp, err := config.Get("audit")
+	if err != nil {
+		return errors.Wrap(err, "cannot initialize audit")
+	}
+	conf, _ := tmp.(*Config)
+	if conf == nil {
+		return errors.New("cannot initialize audit")
+	}
+	if !conf.Enabled {
+		SetSinks()
+		return nil
+	}
+	var configured []Sink
+	for _, sc := range conf.Sinks {
+		sink, err := GetSink(sc.Type, sc.Config)
+		if err != nil {
+			for _, s := range configured {
+				s.Close()
+			}
+			return errors.Wrap(err, "cannot initialize audit")
+		}
+		configured = append(configured, sink)
+	}
+	SetSinks(configured...)
+	Log.WithField("sinks", len(configured)).Info("audit enabled")
+	return nil
+}
+
+// Replace active sinks, previous sinks are closed
+func SetSinks(s ...Sink) {
+	mu.Lock()
+	old := sinks
+	sinks = s
+	mu.Unlock()
+	for _, v := range old {
+		if err := v.Close(); err != nil {
+			Log.WithError(err).Error("cannot close audit sink")
+		}
+	}
+}
+
+// Record an event to all configured sinks
+func Record(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, s := range sinks {
+		if err := s.Write(e); err != nil {
+			Log.WithError(err).
+				WithField("type", e.Type).
+				WithField("audit_id", e.AuditID).
+				Error("cannot write audit event")
+		}
+	}
+}
+
+// Close all sinks
+func Close() {
+	SetSinks()
+}
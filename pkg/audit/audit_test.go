@@ -0,0 +1,60 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+type failSink struct {
+	closed bool
+}
+
+func (f *failSink) Write(e *Event) error {
+	return errors.New("fail")
+}
+
+func (f *failSink) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestRecord(t *testing.T) {
+	assert := assert.New(t)
+	buf := new(bytes.Buffer)
+	fs := &failSink{}
+	SetSinks(fs, NewWriterSink(buf))
+	Record(&Event{Type: EventAuthentication, UserIdentifier: "test", Success: true})
+
+	var ev Event
+	if assert.NoError(json.Unmarshal(buf.Bytes(), &ev)) {
+		assert.Equal(EventAuthentication, ev.Type)
+		assert.Equal("test", ev.UserIdentifier)
+		assert.True(ev.Success)
+		assert.False(ev.Time.IsZero())
+	}
+	Close()
+	assert.True(fs.closed)
+}
+
+func TestSetup(t *testing.T) {
+	assert := assert.New(t)
+	config.LoadBytes([]byte("audit:\n  enabled: true\n  sinks:\n  - type: stdout\n"))
+	assert.NoError(Setup())
+	mu.RLock()
+	assert.Len(sinks, 1)
+	mu.RUnlock()
+
+	config.LoadBytes([]byte("audit:\n  enabled: true\n  sinks:\n  - type: nonexistent\n"))
+	assert.Error(Setup())
+
+	config.LoadBytes([]byte("audit:\n  enabled: false\n"))
+	assert.NoError(Setup())
+	mu.RLock()
+	assert.Len(sinks, 0)
+	mu.RUnlock()
+}
@@ -0,0 +1,292 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Use the default CA key for signing checkpoints
+const SigningKeyCA = "ca"
+
+// Signs checkpoint data, returning the signature and the key used
+type CheckpointSigner func(data []byte) (*ssh.Signature, ssh.PublicKey, error)
+
+var (
+	caSignerMu sync.RWMutex
+	caSigner   CheckpointSigner
+)
+
+// Set the signer used for checkpoints when the signing key is "ca"
+func SetCASigner(s CheckpointSigner) {
+	caSignerMu.Lock()
+	defer caSignerMu.Unlock()
+	caSigner = s
+}
+
+func getCASigner() CheckpointSigner {
+	caSignerMu.RLock()
+	defer caSignerMu.RUnlock()
+	return caSigner
+}
+
+// Appends events as JSON lines to a file, each including the sequence number
+// and the SHA-256 hash of the previous line. With a signer, a checkpoint event
+// signing the hash of the previous line is appended every interval events and
+// on close, so that truncation and alteration of the file can be detected
+type ChainSink struct {
+	sync.Mutex
+	f        *os.File
+	seq      uint64
+	prev     string
+	signer   CheckpointSigner
+	interval int
+	unsigned int
+}
+
+func NewChainSink(path string, signer CheckpointSigner, interval int) (*ChainSink, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open audit file")
+	}
+	cs := &ChainSink{f: f, signer: signer, interval: interval}
+	last, err := lastLine(f)
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "cannot read audit file")
+	}
+	if last != nil {
+		var ev Event
+		if err := json.Unmarshal(last, &ev); err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "cannot continue the audit chain, the last line is invalid")
+		}
+		cs.seq = ev.Seq
+		cs.prev = lineHash(last)
+	}
+	return cs, nil
+}
+
+func (cs *ChainSink) Write(e *Event) error {
+	cs.Lock()
+	defer cs.Unlock()
+	// Events are shared with the other sinks
+	ev := *e
+	if err := cs.append(&ev); err != nil {
+		return err
+	}
+	cs.unsigned++
+	if cs.signer != nil && cs.interval > 0 && cs.unsigned >= cs.interval {
+		return cs.checkpoint()
+	}
+	return nil
+}
+
+func (cs *ChainSink) append(ev *Event) error {
+	ev.Seq = cs.seq + 1
+	ev.PrevHash = cs.prev
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode audit event")
+	}
+	if _, err := cs.f.Write(append(line, '\n')); err != nil {
+		return errors.Wrap(err, "cannot write audit event")
+	}
+	cs.seq = ev.Seq
+	cs.prev = lineHash(line)
+	return nil
+}
+
+func (cs *ChainSink) checkpoint() error {
+	seq := cs.seq + 1
+	sig, key, err := cs.signer(checkpointData(seq, cs.prev))
+	if err != nil {
+		return errors.Wrap(err, "cannot sign audit checkpoint")
+	}
+	ev := &Event{
+		Type:       EventAuditCheckpoint,
+		Time:       time.Now().UTC(),
+		Success:    true,
+		Signature:  base64.StdEncoding.EncodeToString(ssh.Marshal(sig)),
+		SigningKey: ssh.FingerprintSHA256(key),
+	}
+	if err := cs.append(ev); err != nil {
+		return err
+	}
+	cs.unsigned = 0
+	return nil
+}
+
+func (cs *ChainSink) Close() error {
+	cs.Lock()
+	defer cs.Unlock()
+	var err error
+	if cs.signer != nil && cs.unsigned > 0 {
+		err = cs.checkpoint()
+	}
+	if cerr := cs.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Data signed by a checkpoint with the given sequence number, committing to
+// all lines before it
+func checkpointData(seq uint64, prev string) []byte {
+	return []byte(fmt.Sprintf("ssh-inscribe-audit-checkpoint\n%d\n%s", seq, prev))
+}
+
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// Return the last non-empty line of the file without reading all of it
+func lastLine(f *os.File) ([]byte, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	for chunk := int64(4096); ; chunk *= 2 {
+		off := size - chunk
+		if off < 0 {
+			off = 0
+		}
+		buf := make([]byte, size-off)
+		if _, err := f.ReadAt(buf, off); err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = bytes.TrimRight(buf, "\n")
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			return buf[i+1:], nil
+		}
+		if off == 0 {
+			if len(buf) == 0 {
+				return nil, nil
+			}
+			return buf, nil
+		}
+	}
+}
+
+type ChainStatus struct {
+	Lines int
+	// Sequence number of the last event and of the last checkpoint with a
+	// valid signature
+	LastSeq   uint64
+	SignedSeq uint64
+	// Checkpoints signed with keys not given for verification
+	Unverified int
+}
+
+// Verify the hash chain of an audit file written by ChainSink. Checkpoint
+// signatures are verified with the keys, checkpoints by other keys are
+// counted as unverified. Lines after the last checkpoint can be removed
+// without detection, compare LastSeq and SignedSeq
+func VerifyChain(r io.Reader, keys []ssh.PublicKey) (*ChainStatus, error) {
+	byFingerprint := make(map[string]ssh.PublicKey, len(keys))
+	for _, k := range keys {
+		byFingerprint[ssh.FingerprintSHA256(k)] = k
+	}
+	st := &ChainStatus{}
+	br := bufio.NewReader(r)
+	var prev string
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return st, err
+		}
+		line = bytes.TrimRight(line, "\n")
+		if len(line) > 0 {
+			st.Lines++
+			var ev Event
+			if err := json.Unmarshal(line, &ev); err != nil {
+				return st, errors.Errorf("line %d: invalid event: %s", st.Lines, err)
+			}
+			switch {
+			case ev.Seq == 0 && st.LastSeq == 0:
+				// Written before chaining was enabled
+			case ev.Seq != st.LastSeq+1:
+				return st, errors.Errorf("line %d: expected sequence %d, got %d", st.Lines, st.LastSeq+1, ev.Seq)
+			case ev.PrevHash != prev:
+				return st, errors.Errorf("line %d: previous line hash mismatch", st.Lines)
+			}
+			if ev.Type == EventAuditCheckpoint && ev.Seq > 0 {
+				if err := verifyCheckpoint(&ev, byFingerprint); err == errUnknownKey {
+					st.Unverified++
+				} else if err != nil {
+					return st, errors.Errorf("line %d: %s", st.Lines, err)
+				} else {
+					st.SignedSeq = ev.Seq
+				}
+			}
+			st.LastSeq = ev.Seq
+			prev = lineHash(line)
+		}
+		if err == io.EOF {
+			return st, nil
+		}
+	}
+}
+
+var errUnknownKey = errors.New("checkpoint signed with an unknown key")
+
+func verifyCheckpoint(ev *Event, keys map[string]ssh.PublicKey) error {
+	key, ok := keys[ev.SigningKey]
+	if !ok {
+		return errUnknownKey
+	}
+	raw, err := base64.StdEncoding.DecodeString(ev.Signature)
+	if err != nil {
+		return errors.Wrap(err, "invalid checkpoint signature")
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(raw, &sig); err != nil {
+		return errors.Wrap(err, "invalid checkpoint signature")
+	}
+	if err := key.Verify(checkpointData(ev.Seq, ev.PrevHash), &sig); err != nil {
+		return errors.Wrap(err, "checkpoint signature verification failed")
+	}
+	return nil
+}
+
+// Load the checkpoint signing key given in the file sink configuration
+func loadCheckpointSigner(key string) (CheckpointSigner, error) {
+	if key == SigningKeyCA {
+		s := getCASigner()
+		if s == nil {
+			return nil, errors.New("CA signer is not available")
+		}
+		return s, nil
+	}
+	pem, err := ioutil.ReadFile(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read checkpoint signing key")
+	}
+	s, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid checkpoint signing key")
+	}
+	return KeySigner(s), nil
+}
+
+// Sign checkpoints with a key
+func KeySigner(s ssh.Signer) CheckpointSigner {
+	return func(data []byte) (*ssh.Signature, ssh.PublicKey, error) {
+		sig, err := s.Sign(rand.Reader, data)
+		return sig, s.PublicKey(), err
+	}
+}
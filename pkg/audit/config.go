@@ -0,0 +1,150 @@
+package audit
+
+type SinkConfig struct {
+	Type string
+	// Sink specific configuration section, defaults to the sink type
+	Config string
+}
+
+type Config struct {
+	Enabled bool         `yaml:"enabled"`
+	Sinks   []SinkConfig `yaml:"sinks"`
+}
+
+var Defaults = &Config{
+	Enabled: false,
+	Sinks: []SinkConfig{
+		SinkConfig{
+			Type:   "stdout",
+			Config: "",
+		},
+	},
+}
+
+type FileConfig struct {
+	Path string `yaml:"path"`
+	// Chain the events with hashes to make the file tamper-evident
+	Chain bool `yaml:"chain"`
+	// Private key file for signing chain checkpoints, or "ca" to sign with
+	// the default CA key. Checkpoints are written every checkpointInterval
+	// events and on close
+	SigningKey         string `yaml:"signingKey"`
+	CheckpointInterval int    `yaml:"checkpointInterval"`
+}
+
+var FileDefaults = &FileConfig{
+	Path:               "",
+	Chain:              false,
+	SigningKey:         "",
+	CheckpointInterval: 100,
+}
+
+type SyslogConfig struct {
+	// udp://host:514, tcp://host:601, tls://host:6514 or unix:///dev/log
+	URL      string `yaml:"url"`
+	Facility string `yaml:"facility"`
+	AppName  string `yaml:"appName"`
+	// Defaults to os.Hostname()
+	Hostname string `yaml:"hostname"`
+	// Skip certificate validation with tls
+	Insecure bool `yaml:"insecure"`
+}
+
+var SyslogDefaults = &SyslogConfig{
+	URL:      "udp://localhost:514",
+	Facility: "authpriv",
+	AppName:  "ssh-inscribe",
+	Hostname: "",
+	Insecure: false,
+}
+
+type WebhookConfig struct {
+	URL string `yaml:"url"`
+	// HMAC-SHA256 key for signing the request body
+	Secret  string            `yaml:"secret"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout string            `yaml:"timeout"`
+	// Event types to deliver, all events if empty
+	Events []string `yaml:"events"`
+	// Number of events to buffer before dropping
+	QueueSize int `yaml:"queueSize"`
+	// Number of retries before giving up on an event
+	MaxRetries    int    `yaml:"maxRetries"`
+	RetryInterval string `yaml:"retryInterval"`
+	Insecure      bool   `yaml:"insecure"`
+}
+
+var WebhookDefaults = &WebhookConfig{
+	URL:           "",
+	Secret:        "",
+	Headers:       map[string]string{},
+	Timeout:       "5s",
+	Events:        []string{},
+	QueueSize:     1000,
+	MaxRetries:    5,
+	RetryInterval: "1s",
+	Insecure:      false,
+}
+
+type NATSConfig struct {
+	// nats://host:4222 or tls://host:4222
+	URL string `yaml:"url"`
+	// Subject to publish to. {type} is replaced with the event type
+	Subject string `yaml:"subject"`
+	// Wait for the JetStream acknowledgement of each event. Requires a
+	// stream capturing the subjects. Otherwise events are only flushed to
+	// the server
+	JetStream bool   `yaml:"jetStream"`
+	Token     string `yaml:"token"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+	Insecure  bool   `yaml:"insecure"`
+	Timeout   string `yaml:"timeout"`
+	// Event types to deliver, all events if empty
+	Events        []string `yaml:"events"`
+	QueueSize     int      `yaml:"queueSize"`
+	MaxRetries    int      `yaml:"maxRetries"`
+	RetryInterval string   `yaml:"retryInterval"`
+}
+
+var NATSDefaults = &NATSConfig{
+	URL:           "nats://localhost:4222",
+	Subject:       "ssh-inscribe.audit.{type}",
+	JetStream:     true,
+	Timeout:       "5s",
+	Events:        []string{},
+	QueueSize:     1000,
+	MaxRetries:    5,
+	RetryInterval: "1s",
+}
+
+type KafkaConfig struct {
+	// Bootstrap brokers as host:port
+	Brokers []string `yaml:"brokers"`
+	// Topic to produce to. {type} is replaced with the event type. Events
+	// are keyed by the audit id
+	Topic    string `yaml:"topic"`
+	ClientID string `yaml:"clientID"`
+	TLS      bool   `yaml:"tls"`
+	Insecure bool   `yaml:"insecure"`
+	// SASL PLAIN credentials
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Timeout  string `yaml:"timeout"`
+	// Event types to deliver, all events if empty
+	Events        []string `yaml:"events"`
+	QueueSize     int      `yaml:"queueSize"`
+	MaxRetries    int      `yaml:"maxRetries"`
+	RetryInterval string   `yaml:"retryInterval"`
+}
+
+var KafkaDefaults = &KafkaConfig{
+	Brokers:       []string{"localhost:9092"},
+	Topic:         "ssh-inscribe-audit",
+	ClientID:      "ssh-inscribe",
+	Timeout:       "10s",
+	Events:        []string{},
+	QueueSize:     1000,
+	MaxRetries:    5,
+	RetryInterval: "1s",
+}
@@ -0,0 +1,33 @@
+package audit
+
+import (
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var Log *logrus.Entry = logging.GetLogger("audit").WithField("pkg", "audit")
+
+const (
+	SinkStdout  = "stdout"
+	SinkFile    = "file"
+	SinkSyslog  = "syslog"
+	SinkWebhook = "webhook"
+	SinkNATS    = "nats"
+	SinkKafka   = "kafka"
+)
+
+func init() {
+	config.SetDefault("audit", Defaults)
+	config.SetDefault("auditfile", FileDefaults)
+	config.SetDefault("auditsyslog", SyslogDefaults)
+	config.SetDefault("auditwebhook", WebhookDefaults)
+	config.SetDefault("auditnats", NATSDefaults)
+	config.SetDefault("auditkafka", KafkaDefaults)
+	RegisterSink(SinkStdout, stdoutFactory)
+	RegisterSink(SinkFile, fileFactory)
+	RegisterSink(SinkSyslog, syslogFactory)
+	RegisterSink(SinkWebhook, webhookFactory)
+	RegisterSink(SinkNATS, natsFactory)
+	RegisterSink(SinkKafka, kafkaFactory)
+}
@@ -0,0 +1,14 @@
+package audit
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricAuditDropped = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ssh_inscribe_audit_events_dropped_total",
+		Help: "Audit events that could not be delivered.",
+	},
+	[]string{"sink"},
+)
@@ -0,0 +1,155 @@
+package audit
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	queueMaxBackoff   = time.Minute
+	queueCloseTimeout = 10 * time.Second
+)
+
+type queuedEvent struct {
+	typ  string
+	id   string
+	data []byte
+}
+
+// Delivers events in the background with retries for the network sinks.
+// An event is removed from the queue once the receiver has acknowledged it
+// or the retries are exhausted
+type deliveryQueue struct {
+	sink          string
+	target        string
+	events        map[string]bool
+	maxRetries    int
+	retryInterval time.Duration
+	send          func(ev queuedEvent) (retry bool, err error)
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan queuedEvent
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// Options common to the queued sinks
+type queueOptions struct {
+	// Event types to deliver, all events if empty
+	events        []string
+	queueSize     int
+	maxRetries    int
+	retryInterval string
+}
+
+func newDeliveryQueue(sink, target string, opts queueOptions, send func(queuedEvent) (bool, error)) (*deliveryQueue, error) {
+	retryInterval, err := time.ParseDuration(opts.retryInterval)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s retryInterval", sink)
+	}
+	if opts.queueSize < 1 {
+		return nil, errors.Errorf("%s queueSize must be positive", sink)
+	}
+	q := &deliveryQueue{
+		sink:          sink,
+		target:        target,
+		maxRetries:    opts.maxRetries,
+		retryInterval: retryInterval,
+		send:          send,
+		queue:         make(chan queuedEvent, opts.queueSize),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	if len(opts.events) > 0 {
+		q.events = make(map[string]bool)
+		for _, ev := range opts.events {
+			q.events[ev] = true
+		}
+	}
+	go q.worker()
+	return q, nil
+}
+
+func (q *deliveryQueue) Write(e *Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode event")
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return errors.Errorf("%s sink is closed", q.sink)
+	}
+	if q.events != nil && !q.events[e.Type] {
+		return nil
+	}
+	select {
+	case q.queue <- queuedEvent{typ: e.Type, id: e.AuditID, data: data}:
+		return nil
+	default:
+		metricAuditDropped.WithLabelValues(q.sink).Inc()
+		return errors.Errorf("%s queue is full, dropping event", q.sink)
+	}
+}
+
+// Close stops accepting new events and waits for the queue to drain
+func (q *deliveryQueue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.queue)
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		return nil
+	case <-time.After(queueCloseTimeout):
+		close(q.stop)
+		<-q.done
+		return errors.Errorf("timeout while draining %s queue", q.sink)
+	}
+}
+
+func (q *deliveryQueue) worker() {
+	defer close(q.done)
+	for ev := range q.queue {
+		if err := q.deliver(ev); err != nil {
+			metricAuditDropped.WithLabelValues(q.sink).Inc()
+			Log.WithError(err).WithField("sink", q.sink).WithField("target", q.target).Error("cannot deliver audit event")
+		}
+	}
+}
+
+func (q *deliveryQueue) deliver(ev queuedEvent) error {
+	var err error
+	backoff := q.retryInterval
+	for attempt := 0; attempt <= q.maxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-q.stop:
+				return errors.Wrap(err, "delivery aborted")
+			}
+			if backoff *= 2; backoff > queueMaxBackoff {
+				backoff = queueMaxBackoff
+			}
+		}
+		var retry bool
+		retry, err = q.send(ev)
+		if err == nil {
+			return nil
+		}
+		if !retry {
+			break
+		}
+		Log.WithError(err).WithField("sink", q.sink).WithField("attempt", attempt+1).Debug("audit event delivery failed")
+	}
+	return err
+}
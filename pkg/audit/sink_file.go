@@ -0,0 +1,51 @@
+package audit
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Appends events as JSON lines to a file
+type FileSink struct {
+	*WriterSink
+	f *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open audit file")
+	}
+	return &FileSink{WriterSink: NewWriterSink(f), f: f}, nil
+}
+
+func (fs *FileSink) Close() error {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.f.Close()
+}
+
+func fileFactory(configsection string) (Sink, error) {
+	tmp, err := getSinkConfig(configsection, "auditfile")
+	if err != nil {
+		return nil, err
+	}
+	conf, _ := tmp.(*FileConfig)
+	if conf == nil {
+		return nil, errors.New("invalid audit file configuration")
+	}
+	if conf.Path == "" {
+		return nil, errors.New("audit file path is not set")
+	}
+	if !conf.Chain {
+		return NewFileSink(conf.Path)
+	}
+	var signer CheckpointSigner
+	if conf.SigningKey != "" {
+		if signer, err = loadCheckpointSigner(conf.SigningKey); err != nil {
+			return nil, err
+		}
+	}
+	return NewChainSink(conf.Path, signer, conf.CheckpointInterval)
+}
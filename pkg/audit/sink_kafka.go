@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/pkg/errors"
+)
+
+// Kafka errors not worth retrying
+var kafkaFatalErrors = map[sarama.KError]bool{
+	sarama.ErrMessageSizeTooLarge:        true,
+	sarama.ErrInvalidTopic:               true,
+	sarama.ErrTopicAuthorizationFailed:   true,
+	sarama.ErrClusterAuthorizationFailed: true,
+	sarama.ErrSASLAuthenticationFailed:   true,
+}
+
+// Produces events as JSON to Kafka, keyed by the audit id. Each event is
+// removed from the queue once all in-sync replicas have acknowledged it,
+// giving at-least-once delivery
+type KafkaSink struct {
+	*deliveryQueue
+	conf   *KafkaConfig
+	config *sarama.Config
+
+	producer sarama.SyncProducer
+}
+
+func NewKafkaSink(conf *KafkaConfig) (*KafkaSink, error) {
+	if len(conf.Brokers) == 0 {
+		return nil, errors.New("kafka brokers are not set")
+	}
+	if conf.Topic == "" {
+		return nil, errors.New("kafka topic is not set")
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid kafka timeout")
+	}
+	sc := sarama.NewConfig()
+	if conf.ClientID != "" {
+		sc.ClientID = conf.ClientID
+	}
+	sc.Net.DialTimeout = timeout
+	sc.Net.ReadTimeout = timeout
+	sc.Net.WriteTimeout = timeout
+	if conf.TLS {
+		sc.Net.TLS.Enable = true
+		sc.Net.TLS.Config = &tls.Config{InsecureSkipVerify: conf.Insecure}
+	}
+	if conf.Username != "" {
+		sc.Net.SASL.Enable = true
+		sc.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+		sc.Net.SASL.User = conf.Username
+		sc.Net.SASL.Password = conf.Password
+	}
+	sc.Producer.RequiredAcks = sarama.WaitForAll
+	sc.Producer.Timeout = timeout
+	sc.Producer.Return.Successes = true
+	// The delivery queue retries
+	sc.Producer.Retry.Max = 0
+	if err := sc.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid kafka configuration")
+	}
+	ks := &KafkaSink{
+		conf:   conf,
+		config: sc,
+	}
+	ks.deliveryQueue, err = newDeliveryQueue(SinkKafka, strings.Join(conf.Brokers, ","), queueOptions{
+		events:        conf.Events,
+		queueSize:     conf.QueueSize,
+		maxRetries:    conf.MaxRetries,
+		retryInterval: conf.RetryInterval,
+	}, ks.produce)
+	if err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Close drains the queue and closes the producer
+func (ks *KafkaSink) Close() error {
+	err := ks.deliveryQueue.Close()
+	// The worker has exited
+	if ks.producer != nil {
+		ks.producer.Close()
+		ks.producer = nil
+	}
+	return err
+}
+
+func (ks *KafkaSink) produce(ev queuedEvent) (retry bool, err error) {
+	if ks.producer == nil {
+		// Connected on the first event so that the sink can start before
+		// the brokers
+		p, err := sarama.NewSyncProducer(ks.conf.Brokers, ks.config)
+		if err != nil {
+			return true, errors.Wrap(err, "cannot connect to kafka")
+		}
+		ks.producer = p
+	}
+	topic := strings.Replace(ks.conf.Topic, "{type}", ev.typ, -1)
+	msg := &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(ev.data),
+	}
+	// Without a key the partition is random
+	if ev.id != "" {
+		msg.Key = sarama.StringEncoder(ev.id)
+	}
+	if _, _, err := ks.producer.SendMessage(msg); err != nil {
+		var kerr sarama.KError
+		if errors.As(err, &kerr) && kafkaFatalErrors[kerr] {
+			return false, errors.Wrapf(err, "produce to %s failed", topic)
+		}
+		return true, errors.Wrapf(err, "produce to %s failed", topic)
+	}
+	return false, nil
+}
+
+func kafkaFactory(configsection string) (Sink, error) {
+	tmp, err := getSinkConfig(configsection, "auditkafka")
+	if err != nil {
+		return nil, err
+	}
+	conf, _ := tmp.(*KafkaConfig)
+	if conf == nil {
+		return nil, errors.New("invalid audit kafka configuration")
+	}
+	return NewKafkaSink(conf)
+}
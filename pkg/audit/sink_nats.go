@@ -0,0 +1,139 @@
+package audit
+
+import (
+	"crypto/tls"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/globals"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+)
+
+// Publishes events as JSON to NATS. With JetStream each event is removed
+// from the queue only once the stream has acknowledged it, giving
+// at-least-once delivery
+type NATSSink struct {
+	*deliveryQueue
+	url     string
+	subject string
+	conf    *NATSConfig
+	timeout time.Duration
+
+	conn *nats.Conn
+	js   nats.JetStreamContext
+}
+
+func NewNATSSink(conf *NATSConfig) (*NATSSink, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("invalid nats url: %s", conf.URL)
+	}
+	switch u.Scheme {
+	case "nats", "tls":
+	default:
+		return nil, errors.Errorf("unsupported nats url scheme: %s", u.Scheme)
+	}
+	if conf.Subject == "" {
+		return nil, errors.New("nats subject is not set")
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid nats timeout")
+	}
+	ns := &NATSSink{
+		url:     conf.URL,
+		subject: conf.Subject,
+		conf:    conf,
+		timeout: timeout,
+	}
+	ns.deliveryQueue, err = newDeliveryQueue(SinkNATS, u.Host, queueOptions{
+		events:        conf.Events,
+		queueSize:     conf.QueueSize,
+		maxRetries:    conf.MaxRetries,
+		retryInterval: conf.RetryInterval,
+	}, ns.publish)
+	if err != nil {
+		return nil, err
+	}
+	return ns, nil
+}
+
+// Close drains the queue and closes the connection
+func (ns *NATSSink) Close() error {
+	err := ns.deliveryQueue.Close()
+	// The worker has exited
+	if ns.conn != nil {
+		ns.conn.Close()
+		ns.conn = nil
+	}
+	return err
+}
+
+func (ns *NATSSink) connect() error {
+	opts := []nats.Option{
+		nats.Name(globals.ClientUserAgent),
+		nats.Timeout(ns.timeout),
+		nats.NoEcho(),
+		// Reconnects are left to the delivery queue
+		nats.NoReconnect(),
+	}
+	if ns.conf.Token != "" {
+		opts = append(opts, nats.Token(ns.conf.Token))
+	}
+	if ns.conf.Username != "" {
+		opts = append(opts, nats.UserInfo(ns.conf.Username, ns.conf.Password))
+	}
+	if ns.conf.Insecure {
+		opts = append(opts, nats.Secure(&tls.Config{InsecureSkipVerify: true}))
+	}
+	conn, err := nats.Connect(ns.url, opts...)
+	if err != nil {
+		return err
+	}
+	if ns.conf.JetStream {
+		js, err := conn.JetStream(nats.MaxWait(ns.timeout))
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		ns.js = js
+	}
+	ns.conn = conn
+	return nil
+}
+
+func (ns *NATSSink) publish(ev queuedEvent) (retry bool, err error) {
+	if ns.conn == nil || ns.conn.IsClosed() {
+		if err := ns.connect(); err != nil {
+			return true, errors.Wrap(err, "cannot connect to nats")
+		}
+	}
+	subject := strings.Replace(ns.subject, "{type}", ev.typ, -1)
+	if ns.conf.JetStream {
+		if _, err := ns.js.Publish(subject, ev.data); err != nil {
+			return true, errors.Wrap(err, "jetstream publish failed")
+		}
+		return false, nil
+	}
+	if err := ns.conn.Publish(subject, ev.data); err != nil {
+		return true, errors.Wrap(err, "publish failed")
+	}
+	if err := ns.conn.FlushTimeout(ns.timeout); err != nil {
+		return true, errors.Wrap(err, "publish failed")
+	}
+	return false, nil
+}
+
+func natsFactory(configsection string) (Sink, error) {
+	tmp, err := getSinkConfig(configsection, "auditnats")
+	if err != nil {
+		return nil, err
+	}
+	conf, _ := tmp.(*NATSConfig)
+	if conf == nil {
+		return nil, errors.New("invalid audit nats configuration")
+	}
+	return NewNATSSink(conf)
+}
@@ -0,0 +1,33 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+)
+
+// Writes events as JSON lines to any writer
+type WriterSink struct {
+	sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w, enc: json.NewEncoder(w)}
+}
+
+func (ws *WriterSink) Write(e *Event) error {
+	ws.Lock()
+	defer ws.Unlock()
+	return ws.enc.Encode(e)
+}
+
+func (ws *WriterSink) Close() error {
+	return nil
+}
+
+func stdoutFactory(configsection string) (Sink, error) {
+	return NewWriterSink(os.Stdout), nil
+}
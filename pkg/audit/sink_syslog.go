@@ -0,0 +1,196 @@
+package audit
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	severityWarning = 4
+	severityInfo    = 6
+)
+
+var facilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// Sends events as RFC5424 formatted messages. Stream transports use octet
+// counting framing (RFC6587)
+type SyslogSink struct {
+	sync.Mutex
+	network  string
+	addr     string
+	tls      *tls.Config
+	facility int
+	appName  string
+	hostname string
+	conn     net.Conn
+}
+
+func NewSyslogSink(conf *SyslogConfig) (*SyslogSink, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse syslog url")
+	}
+	facility, ok := facilities[strings.ToLower(conf.Facility)]
+	if !ok {
+		return nil, errors.Errorf("unknown syslog facility: %s", conf.Facility)
+	}
+	ss := &SyslogSink{
+		facility: facility,
+		appName:  nilValue(conf.AppName),
+		hostname: conf.Hostname,
+	}
+	if ss.hostname == "" {
+		ss.hostname, _ = os.Hostname()
+	}
+	ss.hostname = nilValue(ss.hostname)
+	switch u.Scheme {
+	case "udp", "tcp":
+		ss.network = u.Scheme
+		ss.addr = u.Host
+	case "tls":
+		ss.network = "tcp"
+		ss.addr = u.Host
+		ss.tls = &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: conf.Insecure,
+		}
+	case "unix":
+		ss.network = "unixgram"
+		ss.addr = u.Path
+	default:
+		return nil, errors.Errorf("unsupported syslog scheme: %s", u.Scheme)
+	}
+	return ss, nil
+}
+
+func (ss *SyslogSink) stream() bool {
+	return ss.network == "tcp"
+}
+
+func (ss *SyslogSink) connect() error {
+	var err error
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if ss.tls != nil {
+		ss.conn, err = tls.DialWithDialer(dialer, ss.network, ss.addr, ss.tls)
+	} else {
+		ss.conn, err = dialer.Dial(ss.network, ss.addr)
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to syslog")
+	}
+	return nil
+}
+
+func (ss *SyslogSink) format(e *Event) ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot encode event")
+	}
+	severity := severityInfo
+	if !e.Success {
+		severity = severityWarning
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		ss.facility*8+severity,
+		e.Time.Format(time.RFC3339Nano),
+		ss.hostname,
+		ss.appName,
+		os.Getpid(),
+		nilValue(e.Type),
+		data,
+	)
+	if ss.stream() {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	return []byte(msg), nil
+}
+
+func (ss *SyslogSink) Write(e *Event) error {
+	msg, err := ss.format(e)
+	if err != nil {
+		return err
+	}
+	ss.Lock()
+	defer ss.Unlock()
+	// Reconnect once on failure
+	for i := 0; i < 2; i++ {
+		if ss.conn == nil {
+			if err = ss.connect(); err != nil {
+				continue
+			}
+		}
+		if _, err = ss.conn.Write(msg); err == nil {
+			return nil
+		}
+		ss.conn.Close()
+		ss.conn = nil
+	}
+	return errors.Wrap(err, "cannot write to syslog")
+}
+
+func (ss *SyslogSink) Close() error {
+	ss.Lock()
+	defer ss.Unlock()
+	if ss.conn == nil {
+		return nil
+	}
+	err := ss.conn.Close()
+	ss.conn = nil
+	return err
+}
+
+// RFC5424 header fields use "-" for empty values and may not contain spaces
+func nilValue(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= 32 || r >= 127 {
+			return -1
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func syslogFactory(configsection string) (Sink, error) {
+	tmp, err := getSinkConfig(configsection, "auditsyslog")
+	if err != nil {
+		return nil, err
+	}
+	conf, _ := tmp.(*SyslogConfig)
+	if conf == nil {
+		return nil, errors.New("invalid audit syslog configuration")
+	}
+	return NewSyslogSink(conf)
+}
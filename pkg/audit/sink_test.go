@@ -0,0 +1,366 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestFileSink(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "audittest")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "audit.log")
+
+	for i := 0; i < 2; i++ {
+		fs, err := NewFileSink(fn)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.NoError(fs.Write(&Event{Type: EventCertificateIssued, KeyID: "test"}))
+		assert.NoError(fs.Close())
+	}
+	data, _ := ioutil.ReadFile(fn)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(lines, 2)
+	var ev Event
+	if assert.NoError(json.Unmarshal([]byte(lines[1]), &ev)) {
+		assert.Equal("test", ev.KeyID)
+	}
+}
+
+func TestSyslogSink(t *testing.T) {
+	assert := assert.New(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(err) {
+		return
+	}
+	defer pc.Close()
+
+	ss, err := NewSyslogSink(&SyslogConfig{
+		URL:      "udp://" + pc.LocalAddr().String(),
+		Facility: "authpriv",
+		AppName:  "ssh-inscribe",
+		Hostname: "test host",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	defer ss.Close()
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(ss.Write(&Event{Type: EventAuthentication, Time: ts, Success: false}))
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if assert.NoError(err) {
+		msg := string(buf[:n])
+		// authpriv(10) * 8 + warning(4)
+		assert.True(strings.HasPrefix(msg, "<84>1 2020-01-02T03:04:05Z testhost ssh-inscribe "), msg)
+		assert.Contains(msg, " authentication - {")
+	}
+
+	_, err = NewSyslogSink(&SyslogConfig{URL: "udp://localhost:514", Facility: "nonexistent"})
+	assert.Error(err)
+	_, err = NewSyslogSink(&SyslogConfig{URL: "http://localhost", Facility: "auth"})
+	assert.Error(err)
+}
+
+func TestSyslogSinkStream(t *testing.T) {
+	assert := assert.New(t)
+	ss := &SyslogSink{network: "tcp", facility: 4, appName: "app", hostname: "host"}
+	msg, err := ss.format(&Event{Type: EventAuthentication, Success: true})
+	if assert.NoError(err) {
+		parts := strings.SplitN(string(msg), " ", 2)
+		assert.Equal(parts[0], strconv.Itoa(len(parts[1])))
+		assert.True(strings.HasPrefix(parts[1], "<38>1 "))
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	assert := assert.New(t)
+	secret := []byte("secret")
+	var (
+		mu       sync.Mutex
+		attempts int
+		received []Event
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		// Fail the first attempt to test retries
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		sig := WebhookSignature(secret, r.Header.Get(WebhookTimestampHeader), body)
+		assert.Equal("sha256="+sig, r.Header.Get(WebhookSignatureHeader))
+		assert.Equal("value", r.Header.Get("X-Custom"))
+		var ev Event
+		assert.NoError(json.Unmarshal(body, &ev))
+		received = append(received, ev)
+	}))
+	defer ts.Close()
+
+	ws, err := NewWebhookSink(&WebhookConfig{
+		URL:           ts.URL,
+		Secret:        string(secret),
+		Headers:       map[string]string{"X-Custom": "value"},
+		Timeout:       "1s",
+		Events:        []string{EventCertificateIssued, EventCertificateDenied},
+		QueueSize:     10,
+		MaxRetries:    3,
+		RetryInterval: "10ms",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(ws.Write(&Event{Type: EventCertificateIssued, KeyID: "one"}))
+	assert.NoError(ws.Write(&Event{Type: EventAuthentication, KeyID: "skipped"}))
+	assert.NoError(ws.Write(&Event{Type: EventCertificateDenied, KeyID: "two"}))
+	assert.NoError(ws.Close())
+	assert.Error(ws.Write(&Event{}))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(3, attempts)
+	if assert.Len(received, 2) {
+		assert.Equal("one", received[0].KeyID)
+		assert.Equal("two", received[1].KeyID)
+	}
+}
+
+func TestChainSink(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "audittest")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "audit.log")
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(priv)
+	pub := signer.PublicKey()
+
+	// Unchained events before enabling the chain
+	fs, err := NewFileSink(fn)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(fs.Write(&Event{Type: EventCertificateIssued, KeyID: "plain"}))
+	assert.NoError(fs.Close())
+	// Continued across reopens
+	for i := 0; i < 2; i++ {
+		cs, err := NewChainSink(fn, KeySigner(signer), 2)
+		if !assert.NoError(err) {
+			return
+		}
+		for _, id := range []string{"a", "b", "c"} {
+			ev := &Event{Type: EventCertificateIssued, KeyID: id}
+			assert.NoError(cs.Write(ev))
+			assert.Zero(ev.Seq)
+		}
+		assert.NoError(cs.Close())
+	}
+	verify := func(keys ...ssh.PublicKey) (*ChainStatus, error) {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return VerifyChain(f, keys)
+	}
+	// 3 events and 2 checkpoints per open
+	st, err := verify(pub)
+	if assert.NoError(err) {
+		assert.Equal(11, st.Lines)
+		assert.Equal(uint64(10), st.LastSeq)
+		assert.Equal(uint64(10), st.SignedSeq)
+	}
+	st, err = verify()
+	if assert.NoError(err) {
+		assert.Equal(uint64(0), st.SignedSeq)
+		assert.Equal(4, st.Unverified)
+	}
+
+	data, _ := ioutil.ReadFile(fn)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	tamper := func(lines []string) error {
+		assert.NoError(ioutil.WriteFile(fn, []byte(strings.Join(lines, "\n")+"\n"), 0600))
+		_, err := verify(pub)
+		return err
+	}
+	// Altered, removed and reordered lines
+	altered := append([]string{}, lines...)
+	altered[2] = strings.Replace(altered[2], `"key_id":"b"`, `"key_id":"x"`, 1)
+	assert.Error(tamper(altered))
+	assert.Error(tamper(append(append([]string{}, lines[:3]...), lines[4:]...)))
+	assert.Error(tamper(append([]string{lines[0], lines[2], lines[1]}, lines[3:]...)))
+	// Forged checkpoint
+	var ev Event
+	json.Unmarshal([]byte(lines[10]), &ev)
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	otherSigner, _ := ssh.NewSignerFromKey(other)
+	sig, _ := otherSigner.Sign(rand.Reader, checkpointData(ev.Seq, ev.PrevHash))
+	ev.Signature = base64.StdEncoding.EncodeToString(ssh.Marshal(sig))
+	forged, _ := json.Marshal(ev)
+	assert.Error(tamper(append(append([]string{}, lines[:10]...), string(forged))))
+}
+
+func TestNATSSink(t *testing.T) {
+	assert := assert.New(t)
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := natsserver.RunServer(&opts)
+	defer srv.Shutdown()
+
+	nc, err := nats.Connect(srv.ClientURL())
+	if !assert.NoError(err) {
+		return
+	}
+	defer nc.Close()
+	js, _ := nc.JetStream()
+
+	ns, err := NewNATSSink(&NATSConfig{
+		URL:           srv.ClientURL(),
+		Subject:       "audit.{type}",
+		JetStream:     true,
+		Timeout:       "1s",
+		QueueSize:     10,
+		MaxRetries:    5,
+		RetryInterval: "50ms",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	// Retried until a stream captures the subject
+	assert.NoError(ns.Write(&Event{Type: EventCertificateIssued, KeyID: "one"}))
+	_, err = js.AddStream(&nats.StreamConfig{Name: "AUDIT", Subjects: []string{"audit.>"}})
+	assert.NoError(err)
+	assert.NoError(ns.Write(&Event{Type: EventCertificateDenied, KeyID: "two"}))
+	assert.NoError(ns.Close())
+
+	sub, err := js.SubscribeSync("audit.>", nats.DeliverAll())
+	if !assert.NoError(err) {
+		return
+	}
+	var (
+		subjects []string
+		received []Event
+	)
+	for i := 0; i < 2; i++ {
+		msg, err := sub.NextMsg(time.Second)
+		if !assert.NoError(err) {
+			break
+		}
+		var ev Event
+		assert.NoError(json.Unmarshal(msg.Data, &ev))
+		subjects = append(subjects, msg.Subject)
+		received = append(received, ev)
+	}
+	assert.Equal([]string{"audit." + EventCertificateIssued, "audit." + EventCertificateDenied}, subjects)
+	if assert.Len(received, 2) {
+		assert.Equal("one", received[0].KeyID)
+		assert.Equal("two", received[1].KeyID)
+	}
+
+	// Without JetStream the events are flushed to the server
+	core, _ := nc.SubscribeSync("plain.>")
+	nc.Flush()
+	ns, err = NewNATSSink(&NATSConfig{
+		URL:           srv.ClientURL(),
+		Subject:       "plain.{type}",
+		Timeout:       "1s",
+		QueueSize:     10,
+		RetryInterval: "10ms",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(ns.Write(&Event{Type: EventCertificateIssued, KeyID: "three"}))
+	assert.NoError(ns.Close())
+	if msg, err := core.NextMsg(time.Second); assert.NoError(err) {
+		assert.Equal("plain."+EventCertificateIssued, msg.Subject)
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	assert := assert.New(t)
+	ks, err := NewKafkaSink(&KafkaConfig{
+		Brokers:       []string{"localhost:9092"},
+		Topic:         "audit-{type}",
+		ClientID:      "ssh-inscribe",
+		Timeout:       "1s",
+		QueueSize:     10,
+		MaxRetries:    3,
+		RetryInterval: "10ms",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(sarama.WaitForAll, ks.config.Producer.RequiredAcks)
+
+	var (
+		topics   []string
+		keys     []string
+		received []Event
+	)
+	record := func(msg *sarama.ProducerMessage) error {
+		var ev Event
+		value, _ := msg.Value.Encode()
+		assert.NoError(json.Unmarshal(value, &ev))
+		var key []byte
+		if msg.Key != nil {
+			key, _ = msg.Key.Encode()
+		}
+		topics = append(topics, msg.Topic)
+		keys = append(keys, string(key))
+		received = append(received, ev)
+		return nil
+	}
+	producer := mocks.NewSyncProducer(t, nil)
+	// Fail the first attempt to test retries, the second one is not retried
+	producer.ExpectSendMessageAndFail(sarama.ErrNotEnoughReplicas)
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(record)
+	producer.ExpectSendMessageAndFail(sarama.ErrTopicAuthorizationFailed)
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(record)
+	ks.producer = producer
+
+	assert.NoError(ks.Write(&Event{Type: EventCertificateIssued, AuditID: "id1", KeyID: "one"}))
+	assert.NoError(ks.Write(&Event{Type: EventCertificateDenied, KeyID: "dropped"}))
+	assert.NoError(ks.Write(&Event{Type: EventCertificateDenied, KeyID: "two"}))
+	assert.NoError(ks.Close())
+
+	assert.Equal([]string{"audit-" + EventCertificateIssued, "audit-" + EventCertificateDenied}, topics)
+	assert.Equal([]string{"id1", ""}, keys)
+	if assert.Len(received, 2) {
+		assert.Equal("one", received[0].KeyID)
+		assert.Equal("two", received[1].KeyID)
+	}
+}
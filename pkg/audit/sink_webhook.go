@@ -0,0 +1,111 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	WebhookTimestampHeader = "X-Inscribe-Timestamp"
+	WebhookSignatureHeader = "X-Inscribe-Signature"
+)
+
+// Delivers events as JSON POST requests. Events are queued and delivered in
+// the background with retries. If a secret is set, each request is signed
+// with HMAC-SHA256 over "<timestamp>.<body>"
+type WebhookSink struct {
+	*deliveryQueue
+	url     string
+	secret  []byte
+	headers map[string]string
+	client  *http.Client
+}
+
+func NewWebhookSink(conf *WebhookConfig) (*WebhookSink, error) {
+	if conf.URL == "" {
+		return nil, errors.New("audit webhook url is not set")
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid webhook timeout")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	ws := &WebhookSink{
+		url:     conf.URL,
+		secret:  []byte(conf.Secret),
+		headers: conf.Headers,
+		client:  &http.Client{Timeout: timeout, Transport: transport},
+	}
+	ws.deliveryQueue, err = newDeliveryQueue(SinkWebhook, conf.URL, queueOptions{
+		events:        conf.Events,
+		queueSize:     conf.QueueSize,
+		maxRetries:    conf.MaxRetries,
+		retryInterval: conf.RetryInterval,
+	}, ws.post)
+	if err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+func (ws *WebhookSink) post(ev queuedEvent) (retry bool, err error) {
+	data := ev.data
+	req, err := http.NewRequest(http.MethodPost, ws.url, bytes.NewReader(data))
+	if err != nil {
+		return false, errors.Wrap(err, "cannot create request")
+	}
+	for k, v := range ws.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(ws.secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(WebhookTimestampHeader, ts)
+		req.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(ws.secret, ts, data))
+	}
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "request failed")
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, errors.Errorf("unexpected status: %s", resp.Status)
+	}
+	return false, errors.Errorf("unexpected status: %s", resp.Status)
+}
+
+// Compute the hex encoded signature of a webhook request. Receivers should
+// compare this against the signature header and check the timestamp is recent
+func WebhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s.", timestamp)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func webhookFactory(configsection string) (Sink, error) {
+	tmp, err := getSinkConfig(configsection, "auditwebhook")
+	if err != nil {
+		return nil, err
+	}
+	conf, _ := tmp.(*WebhookConfig)
+	if conf == nil {
+		return nil, errors.New("invalid audit webhook configuration")
+	}
+	return NewWebhookSink(conf)
+}
@@ -1,12 +1,69 @@
 package auth
 
+import (
+	"errors"
+	"time"
+)
+
 const (
 	CredentialUserPassword = "user_password"
 	CredentialPin          = "pin"
 	CredentialFederated    = "federated"
+	// SPNEGO token from the Authorization header
+	CredentialNegotiate = "negotiate"
+	// TLS client certificate chain of the connection as concatenated DER
+	CredentialClientCert = "client_cert"
+	// Token from an "Authorization: Bearer" header
+	CredentialBearerToken = "bearer_token"
+	// Signatures of the challenge with the SSH keys in the agent, see
+	// SSHKeySignedData
+	CredentialSSHKey = "ssh_key"
 
 	MetaAuditID           = "audit_id"
 	MetaFederationAuthURL = "federation_auth_url"
+	// Code the user enters at the auth URL in device flows
+	MetaFederationUserCode = "federation_user_code"
+	// Prompt for the response to the challenge of a pending auth context
+	MetaChallenge = "challenge"
+	// Group memberships resolved by the backend as a string slice
+	MetaGroups = "groups"
+	// Raw identity claims from federated backends
+	MetaClaims = "claims"
+	// Attributes of the user entry from the LDAP backend
+	MetaLDAPUserEntry = "authLDAPUserEntry"
+	// Maximum certificate lifetime for the user set by the backend, as a
+	// duration string
+	MetaMaxLifetime = "max_lifetime"
+	// Why a login with the right password was refused, one of the Password
+	// values. Set by the backend in the meta of the credentials
+	MetaPasswordFailure = "password_failure"
+	// The login failed because the backend could not be reached or
+	// errored, not because of the credentials. Set by the backend with
+	// SetBackendError
+	MetaBackendError = "backend_error"
+	// Time the password expires when it expires soon, as RFC 3339
+	MetaPasswordExpires = "password_expires"
+	// Identity attributes the backend contributes for the key id and the
+	// certificate extensions, keyed by the Identity names. Set with
+	// AuthContext.AddIdentity
+	MetaIdentity = "identity"
+)
+
+// Well-known keys of MetaIdentity. Backends may add others
+const (
+	IdentityEmployeeID = "employee_id"
+	IdentityDeviceID   = "device_id"
+	// Authentication methods used, as in the amr claim of RFC 8176: pwd,
+	// otp, hwk, swk and so on
+	IdentityMFA = "mfa"
+)
+
+// Values of MetaPasswordFailure
+const (
+	PasswordExpired    = "expired"
+	PasswordMustChange = "must_change"
+	// The user has no second factor enrolled
+	MFAEnrollRequired = "mfa_enroll_required"
 )
 
 type Authenticator interface {
@@ -23,6 +80,36 @@ type FederatedAuthenticator interface {
 	FederationCallback(data interface{}) error
 }
 
+// Federated authenticators running the login in the browser on a page
+// served by us, like WebAuthn
+type PageAuthenticator interface {
+	FederatedAuthenticator
+	// HTML of the page for the pending request in the parameters
+	Page(data interface{}) (string, error)
+}
+
+// Authenticators that provision a credential for an authenticated user,
+// like an OTP seed
+type EnrollableAuthenticator interface {
+	Authenticator
+	Enroll(actx *AuthContext) (*Enrollment, error)
+}
+
+// Returned by Enroll when the user already has a credential
+var ErrAlreadyEnrolled = errors.New("user is already enrolled")
+
+// Result of an enrollment
+type Enrollment struct {
+	Secret string
+	// Provisioning URI, e.g. otpauth://
+	URI string
+}
+
+// Authenticators able to check connectivity to their backing service
+type Prober interface {
+	Probe() error
+}
+
 type Authorizer interface {
 	Authorize(parentctx *AuthContext) (newctx *AuthContext, success bool)
 	Name() string
@@ -121,7 +208,7 @@ func (ac *AuthContext) GetAuthenticators() []string {
 	if ac.Parent != nil {
 		return filterEmptyValues(append([]string{ac.Authenticator}, ac.Parent.GetAuthenticators()...))
 	}
-	return filterEmptyValues(append([]string{ac.Authenticator}))
+	return filterEmptyValues([]string{ac.Authenticator})
 }
 
 func (ac *AuthContext) GetAuthMeta() map[string]interface{} {
@@ -137,11 +224,131 @@ func (ac *AuthContext) GetAuthMeta() map[string]interface{} {
 	return r
 }
 
+// Groups resolved by all the backends in the chain
+func (ac *AuthContext) GetGroups() []string {
+	var r []string
+	if ac.Parent != nil {
+		r = ac.Parent.GetGroups()
+	}
+	// After a round trip through the token the slice is []interface{}
+	switch v := ac.AuthMeta[MetaGroups].(type) {
+	case []string:
+		r = append(r, v...)
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				r = append(r, s)
+			}
+		}
+	}
+	return r
+}
+
+// Identity attributes contributed by all the backends in the chain. Later
+// backends override the values of earlier ones, except for IdentityMFA
+// which lists the methods of every backend once
+func (ac *AuthContext) GetIdentity() map[string]interface{} {
+	r := map[string]interface{}{}
+	if ac.Parent != nil {
+		r = ac.Parent.GetIdentity()
+	}
+	// After a round trip through the token the lists are []interface{}
+	id, _ := ac.AuthMeta[MetaIdentity].(map[string]interface{})
+	for k, v := range id {
+		if k != IdentityMFA {
+			r[k] = v
+			continue
+		}
+		methods := toStrings(r[IdentityMFA])
+		for _, m := range toStrings(v) {
+			if !containsString(methods, m) {
+				methods = append(methods, m)
+			}
+		}
+		r[k] = methods
+	}
+	return r
+}
+
+// Add identity attributes to the auth meta. Empty values are ignored, a
+// single value is stored as a string. Values of IdentityMFA are appended to
+// the methods already there
+func (ac *AuthContext) AddIdentity(key string, values ...string) {
+	values = filterEmptyValues(append([]string(nil), values...))
+	if len(values) == 0 {
+		return
+	}
+	if ac.AuthMeta == nil {
+		ac.AuthMeta = map[string]interface{}{}
+	}
+	id, _ := ac.AuthMeta[MetaIdentity].(map[string]interface{})
+	if id == nil {
+		id = map[string]interface{}{}
+		ac.AuthMeta[MetaIdentity] = id
+	}
+	switch {
+	case key == IdentityMFA:
+		methods := toStrings(id[key])
+		for _, m := range values {
+			if !containsString(methods, m) {
+				methods = append(methods, m)
+			}
+		}
+		id[key] = methods
+	case len(values) == 1:
+		id[key] = values[0]
+	default:
+		id[key] = values
+	}
+}
+
+func toStrings(v interface{}) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return append([]string(nil), v...)
+	case []interface{}:
+		var r []string
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				r = append(r, s)
+			}
+		}
+		return r
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// The shortest maximum lifetime set by the backends in the chain, zero if
+// none is set
+func (ac *AuthContext) GetMaxLifetime() time.Duration {
+	var r time.Duration
+	if ac.Parent != nil {
+		r = ac.Parent.GetMaxLifetime()
+	}
+	if s, ok := ac.AuthMeta[MetaMaxLifetime].(string); ok {
+		if v, err := time.ParseDuration(s); err == nil && v > 0 && (r == 0 || v < r) {
+			r = v
+		}
+	}
+	return r
+}
+
 func (ac *AuthContext) GetAuthorizers() []string {
 	if ac.Parent != nil {
 		return filterEmptyValues(append([]string{ac.Authorizer}, ac.Parent.GetAuthorizers()...))
 	}
-	return filterEmptyValues(append([]string{ac.Authorizer}))
+	return filterEmptyValues([]string{ac.Authorizer})
 }
 
 // Verify the whole auth context chain
@@ -175,6 +382,29 @@ type Credentials struct {
 	Meta           map[string]interface{}
 }
 
+// Tell the caller why the login with the right password was refused
+func (c *Credentials) SetPasswordFailure(reason string) {
+	if c.Meta == nil {
+		c.Meta = map[string]interface{}{}
+	}
+	c.Meta[MetaPasswordFailure] = reason
+}
+
+// Tell the caller the login failed because of the backend, not the
+// credentials
+func (c *Credentials) SetBackendError(err error) {
+	if c.Meta == nil {
+		c.Meta = map[string]interface{}{}
+	}
+	c.Meta[MetaBackendError] = err.Error()
+}
+
+// Whether the backend reported its own failure with SetBackendError
+func (c *Credentials) BackendError() bool {
+	_, ok := c.Meta[MetaBackendError]
+	return ok
+}
+
 func filterEmptyValues(sl []string) []string {
 	r := sl[:0]
 	for _, v := range sl {
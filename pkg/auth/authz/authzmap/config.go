@@ -0,0 +1,35 @@
+package authzmap
+
+type RuleConfig struct {
+	Name string `yaml:"name"`
+	// Authenticator name patterns the rule applies to. Empty matches all
+	Backends []string `yaml:"backends"`
+	// Template condition, the rule applies if it renders to "true"
+	If string `yaml:"if"`
+	// Evaluate the rule for each value of: groups, principals or
+	// claims.<name>. The value is available as {{.Value}}
+	ForEach string `yaml:"forEach"`
+	// Glob pattern the ForEach value must match
+	Match string `yaml:"match"`
+	// Principal templates. Empty results are skipped. Defaults to
+	// {{.Value}} with ForEach
+	Principals []string `yaml:"principals"`
+	Prefix     string   `yaml:"prefix"`
+	Suffix     string   `yaml:"suffix"`
+	// Do not evaluate further rules if this rule produced principals
+	Stop bool `yaml:"stop"`
+}
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// Keep the principals set by the auth backends in addition to the
+	// mapped ones
+	KeepBackendPrincipals bool         `yaml:"keepBackendPrincipals"`
+	Rules                 []RuleConfig `yaml:"rules"`
+}
+
+var Defaults = &Config{
+	Enabled:               false,
+	KeepBackendPrincipals: false,
+	Rules:                 []RuleConfig{},
+}
@@ -0,0 +1,21 @@
+package authzmap
+
+import (
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var Log *logrus.Entry = logging.GetLogger("authzmap").WithField("pkg", "auth/authz/authzmap")
+
+const (
+	Name = "principalmapping"
+
+	ForEachGroups      = "groups"
+	ForEachPrincipals  = "principals"
+	ForEachClaimPrefix = "claims."
+)
+
+func init() {
+	config.SetDefault("principalmapping", Defaults)
+}
@@ -0,0 +1,403 @@
+package authzmap
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Data available to the rule templates
+type TemplateData struct {
+	Subject    string
+	Groups     []string
+	Principals []string
+	Claims     map[string]interface{}
+	Backends   []string
+	Meta       map[string]interface{}
+	// Current value with ForEach
+	Value string
+}
+
+type rule struct {
+	name       string
+	backends   []glob.Glob
+	cond       *template.Template
+	forEach    string
+	match      glob.Glob
+	principals []*template.Template
+	prefix     string
+	suffix     string
+	stop       bool
+	// Principal templates, prefix or suffix use identity variables
+	expand bool
+}
+
+// PrincipalMapper is an authorizer replacing the backend principals with
+// the ones produced by the mapping rules
+type PrincipalMapper struct {
+	rules []*rule
+	keep  bool
+	log   *logrus.Entry
+}
+
+func parseTpl(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(util.TemplateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+func newRule(i int, conf RuleConfig) (*rule, error) {
+	r := &rule{
+		name:    conf.Name,
+		forEach: conf.ForEach,
+		prefix:  conf.Prefix,
+		suffix:  conf.Suffix,
+		stop:    conf.Stop,
+	}
+	if r.name == "" {
+		r.name = fmt.Sprintf("rule%d", i)
+	}
+	switch {
+	case r.forEach == "", r.forEach == ForEachGroups, r.forEach == ForEachPrincipals:
+	case strings.HasPrefix(r.forEach, ForEachClaimPrefix) && len(r.forEach) > len(ForEachClaimPrefix):
+	default:
+		return nil, errors.Errorf("invalid forEach %q", r.forEach)
+	}
+	for _, p := range conf.Backends {
+		g, err := glob.Compile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid backend pattern %q", p)
+		}
+		r.backends = append(r.backends, g)
+	}
+	if conf.Match != "" {
+		if r.forEach == "" {
+			return nil, errors.New("match requires forEach")
+		}
+		g, err := glob.Compile(conf.Match)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid match pattern %q", conf.Match)
+		}
+		r.match = g
+	}
+	var err error
+	if conf.If != "" {
+		if r.cond, err = parseTpl("if", conf.If); err != nil {
+			return nil, errors.Wrap(err, "cannot parse if")
+		}
+	}
+	principals := conf.Principals
+	if len(principals) == 0 {
+		if r.forEach == "" {
+			return nil, errors.New("no principals")
+		}
+		principals = []string{"{{.Value}}"}
+	}
+	r.expand = auth.HasVariables(r.prefix) || auth.HasVariables(r.suffix)
+	for _, p := range principals {
+		if auth.HasVariables(p) {
+			r.expand = true
+		}
+		t, err := parseTpl("principal", p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot parse principal %q", p)
+		}
+		r.principals = append(r.principals, t)
+	}
+	if r.expand {
+		if err := auth.CheckVariables(r.prefix + r.suffix); err != nil {
+			return nil, errors.Wrap(err, "invalid prefix or suffix")
+		}
+	}
+	return r, nil
+}
+
+func New(conf *Config) (*PrincipalMapper, error) {
+	pm := &PrincipalMapper{
+		keep: conf.KeepBackendPrincipals,
+		log:  Log.WithField("name", Name),
+	}
+	for i, rc := range conf.Rules {
+		r, err := newRule(i, rc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "principal mapping rule %d", i)
+		}
+		pm.rules = append(pm.rules, r)
+	}
+	return pm, nil
+}
+
+// Setup the principal mapper from the configuration. Returns nil if the
+// mapping is not enabled
+func Setup() (auth.Authorizer, error) {
+	tmp, err := config.Get("principalmapping")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot initialize principal mapping")
+	}
+	conf, _ := tmp.(*Config)
+	if conf == nil {
+		return nil, errors.New("cannot initialize principal mapping. Invalid configuration")
+	}
+	if !conf.Enabled {
+		return nil, nil
+	}
+	pm, err := New(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot initialize principal mapping")
+	}
+	Log.WithField("rules", len(pm.rules)).Info("principal mapping enabled")
+	return pm, nil
+}
+
+func render(t *template.Template, data *TemplateData) (string, error) {
+	buf := &bytes.Buffer{}
+	if err := t.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+func claimValues(claims map[string]interface{}, k string) []string {
+	switch v := claims[k].(type) {
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []interface{}:
+		var r []string
+		for _, e := range v {
+			r = append(r, fmt.Sprint(e))
+		}
+		return r
+	case nil:
+		return nil
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+func (r *rule) values(data *TemplateData) []string {
+	switch {
+	case r.forEach == ForEachGroups:
+		return data.Groups
+	case r.forEach == ForEachPrincipals:
+		return data.Principals
+	case strings.HasPrefix(r.forEach, ForEachClaimPrefix):
+		return claimValues(data.Claims, strings.TrimPrefix(r.forEach, ForEachClaimPrefix))
+	}
+	return []string{""}
+}
+
+func (r *rule) appliesTo(backends []string) bool {
+	if len(r.backends) == 0 {
+		return true
+	}
+	for _, g := range r.backends {
+		for _, b := range backends {
+			if g.Match(b) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Escape the identity variables of the values from the backends so that
+// only the ones of the rule are expanded
+func escapeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return strings.ReplaceAll(v, "%", "%%")
+	case []string:
+		return escapeStrings(v)
+	case []interface{}:
+		r := make([]interface{}, len(v))
+		for i, e := range v {
+			r[i] = escapeValue(e)
+		}
+		return r
+	case map[string]interface{}:
+		return escapeMap(v)
+	}
+	return v
+}
+
+func escapeStrings(v []string) []string {
+	r := make([]string, len(v))
+	for i, e := range v {
+		r[i] = strings.ReplaceAll(e, "%", "%%")
+	}
+	return r
+}
+
+func escapeMap(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	r := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		r[k] = escapeValue(v)
+	}
+	return r
+}
+
+func escapeData(data TemplateData) TemplateData {
+	return TemplateData{
+		Subject:    strings.ReplaceAll(data.Subject, "%", "%%"),
+		Groups:     escapeStrings(data.Groups),
+		Principals: escapeStrings(data.Principals),
+		Claims:     escapeMap(data.Claims),
+		Backends:   escapeStrings(data.Backends),
+		Meta:       escapeMap(data.Meta),
+	}
+}
+
+// Evaluate the rule and return the produced principals. Identity variables
+// of the principal templates are expanded from the auth context
+func (r *rule) eval(data TemplateData, actx *auth.AuthContext) ([]string, error) {
+	var ret []string
+	var escaped TemplateData
+	if r.expand {
+		escaped = escapeData(data)
+	}
+	for _, v := range r.values(&data) {
+		if r.match != nil && !r.match.Match(v) {
+			continue
+		}
+		data.Value = v
+		if r.cond != nil {
+			res, err := render(r.cond, &data)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot render if")
+			}
+			if ok, _ := strconv.ParseBool(res); !ok {
+				continue
+			}
+		}
+		tplData := &data
+		if r.expand {
+			escaped.Value = strings.ReplaceAll(v, "%", "%%")
+			tplData = &escaped
+		}
+		for _, t := range r.principals {
+			p, err := render(t, tplData)
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot render principal")
+			}
+			if p == "" {
+				continue
+			}
+			p = r.prefix + p + r.suffix
+			if r.expand {
+				if p, err = auth.Expand(p, actx); err != nil {
+					return nil, errors.Wrap(err, "cannot expand principal")
+				}
+			}
+			if p != "" {
+				ret = append(ret, p)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// Map the principals according to the rules
+func (pm *PrincipalMapper) Map(actx *auth.AuthContext) ([]string, error) {
+	meta := actx.GetAuthMeta()
+	claims, _ := meta[auth.MetaClaims].(map[string]interface{})
+	data := TemplateData{
+		Subject:    actx.GetSubjectName(),
+		Groups:     actx.GetGroups(),
+		Principals: actx.GetPrincipals(),
+		Claims:     claims,
+		Backends:   actx.GetAuthenticators(),
+		Meta:       meta,
+	}
+	var ret []string
+	seen := map[string]bool{}
+	if pm.keep {
+		for _, p := range data.Principals {
+			if !seen[p] {
+				seen[p] = true
+				ret = append(ret, p)
+			}
+		}
+	}
+	for _, r := range pm.rules {
+		if !r.appliesTo(data.Backends) {
+			continue
+		}
+		principals, err := r.eval(data, actx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "rule %s", r.name)
+		}
+		for _, p := range principals {
+			if !seen[p] {
+				seen[p] = true
+				ret = append(ret, p)
+			}
+		}
+		if r.stop && len(principals) > 0 {
+			break
+		}
+	}
+	return ret, nil
+}
+
+func (pm *PrincipalMapper) Authorize(actx *auth.AuthContext) (*auth.AuthContext, bool) {
+	if actx == nil {
+		return nil, false
+	}
+	log := pm.log.WithField("action", "authorize").WithField("subject", actx.GetSubjectName())
+	principals, err := pm.Map(actx)
+	if err != nil {
+		log.WithError(err).Error("principal mapping failed")
+		return nil, false
+	}
+	if len(principals) == 0 {
+		log.Warn("no principals mapped")
+		return nil, false
+	}
+	// Remove the backend principals not produced by the mapping. The mapped
+	// ones are added again on this level
+	mapped := map[string]bool{}
+	for _, p := range principals {
+		mapped[p] = true
+	}
+	var remove, add []string
+	for _, p := range actx.GetPrincipals() {
+		if !mapped[p] {
+			remove = append(remove, p)
+		} else {
+			delete(mapped, p)
+		}
+	}
+	for _, p := range principals {
+		if mapped[p] {
+			add = append(add, p)
+		}
+	}
+	log.WithField("principals", principals).Debug("mapped principals")
+	return &auth.AuthContext{
+		Status:           auth.StatusCompleted,
+		Parent:           actx,
+		Principals:       add,
+		RemovePrincipals: remove,
+		Authorizer:       pm.Name(),
+	}, true
+}
+
+func (pm *PrincipalMapper) Name() string {
+	return Name
+}
+
+func (pm *PrincipalMapper) Description() string {
+	return "Map auth context attributes to certificate principals"
+}
@@ -0,0 +1,142 @@
+package authzmap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+)
+
+func authContext() *auth.AuthContext {
+	first := &auth.AuthContext{
+		Status:        auth.StatusCompleted,
+		SubjectName:   "Alice.Smith",
+		Authenticator: "ldap",
+		Principals:    []string{"alice", "ssh-admins"},
+		AuthMeta: map[string]interface{}{
+			auth.MetaGroups: []string{"ssh-admins", "dev-web", "dev-db"},
+		},
+	}
+	return &auth.AuthContext{
+		Status:        auth.StatusCompleted,
+		Parent:        first,
+		Authenticator: "oidc",
+		AuthMeta: map[string]interface{}{
+			auth.MetaGroups: []interface{}{"contractors"},
+			auth.MetaClaims: map[string]interface{}{
+				"email": "alice@example.com",
+				"roles": []interface{}{"deploy", "audit"},
+			},
+		},
+	}
+}
+
+func TestMap(t *testing.T) {
+	assert := assert.New(t)
+	pm, err := New(&Config{
+		Rules: []RuleConfig{
+			{Principals: []string{`{{.Subject | lower | replace "." "_"}}`}},
+			{ForEach: ForEachGroups, Match: "dev-*", Prefix: "grp-", Principals: []string{`{{trimPrefix "dev-" .Value}}`}},
+			{If: `{{has .Groups "ssh-admins"}}`, Principals: []string{"root"}},
+			{If: `{{has .Groups "nonexistent"}}`, Principals: []string{"nope"}},
+			{ForEach: "claims.roles", Suffix: "-role"},
+			{Backends: []string{"ldap"}, Principals: []string{`{{index .Claims "email"}}`}},
+			{Backends: []string{"other"}, Principals: []string{"other"}},
+		},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	principals, err := pm.Map(authContext())
+	assert.NoError(err)
+	assert.Equal([]string{
+		"alice_smith",
+		"grp-web", "grp-db",
+		"root",
+		"deploy-role", "audit-role",
+		"alice@example.com",
+	}, principals)
+}
+
+func TestMapStop(t *testing.T) {
+	assert := assert.New(t)
+	pm, err := New(&Config{
+		KeepBackendPrincipals: true,
+		Rules: []RuleConfig{
+			{ForEach: ForEachGroups, Match: "nomatch", Stop: true},
+			{ForEach: ForEachGroups, Match: "contractors", Principals: []string{"contractor"}, Stop: true},
+			{Principals: []string{"root"}},
+		},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	principals, err := pm.Map(authContext())
+	assert.NoError(err)
+	assert.Equal([]string{"alice", "ssh-admins", "contractor"}, principals)
+}
+
+func TestMapIdentityVariables(t *testing.T) {
+	assert := assert.New(t)
+	pm, err := New(&Config{
+		Rules: []RuleConfig{
+			{Principals: []string{"%u", "via-%{backend}"}},
+			{ForEach: ForEachGroups, Prefix: "%{claims.email}:"},
+			{ForEach: ForEachPrincipals, Principals: []string{"{{.Value}}"}},
+		},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	actx := authContext()
+	actx.Parent.Principals = append(actx.Parent.Principals, "100%-remote")
+	actx.AuthMeta[auth.MetaGroups] = []interface{}{"%u"}
+	principals, err := pm.Map(actx)
+	assert.NoError(err)
+	// Values from the backends are not expanded
+	assert.Equal([]string{
+		"Alice.Smith", "via-oidc",
+		"alice@example.com:ssh-admins", "alice@example.com:dev-web", "alice@example.com:dev-db", "alice@example.com:%u",
+		"alice", "ssh-admins", "100%-remote",
+	}, principals)
+}
+
+func TestAuthorize(t *testing.T) {
+	assert := assert.New(t)
+	pm, _ := New(&Config{
+		Rules: []RuleConfig{
+			{ForEach: ForEachPrincipals, Match: "alice"},
+			{Principals: []string{"extra"}},
+		},
+	})
+	actx, ok := pm.Authorize(authContext())
+	if assert.True(ok) {
+		assert.Equal([]string{"alice", "extra"}, actx.GetPrincipals())
+		assert.Equal([]string{Name}, actx.GetAuthorizers())
+		assert.True(actx.IsValid())
+	}
+
+	// No principals is a failure
+	pm, _ = New(&Config{Rules: []RuleConfig{{If: "false", Principals: []string{"x"}}}})
+	_, ok = pm.Authorize(authContext())
+	assert.False(ok)
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+	for _, rc := range []RuleConfig{
+		{},
+		{ForEach: "invalid"},
+		{ForEach: "claims."},
+		{Match: "a", Principals: []string{"x"}},
+		{ForEach: ForEachGroups, Match: "[a"},
+		{Principals: []string{"{{"}},
+		{If: "{{", Principals: []string{"x"}},
+		{Backends: []string{"[a"}, Principals: []string{"x"}},
+		{Prefix: "%{bad}", Principals: []string{"x"}},
+	} {
+		_, err := New(&Config{Rules: []RuleConfig{rc}})
+		assert.Error(err, "%+v", rc)
+	}
+}
@@ -1,7 +1,26 @@
 package all
 
 import (
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authazure"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authclientcert"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authduo"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authexec"
 	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authfile"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authgithub"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authgitlab"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authgoogle"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authjwt"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authkrb5"
 	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authldap"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authoauth2"
 	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authoidc"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authokta"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authpam"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authplugin"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authradius"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authsaml"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authsshkey"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authtotp"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authvault"
+	_ "github.com/aakso/ssh-inscribe/pkg/auth/backend/authwebauthn"
 )
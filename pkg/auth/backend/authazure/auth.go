@@ -0,0 +1,215 @@
+package authazure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth/backend/authoidc"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Limit for a single API response
+	maxResponseSize = 4 << 20
+	// Limit for the pages of the group list
+	maxPages = 10
+)
+
+type group struct {
+	ID   string `json:"id"`
+	Name string `json:"displayName"`
+}
+
+// AuthAzure is an OpenID Connect login with the Microsoft identity
+// platform. The groups of the user from the token or from Microsoft Graph
+// decide who can log in and with which principals
+type AuthAzure struct {
+	*authoidc.AuthOIDC
+	config   *Config
+	graphURL string
+	groupTpl *template.Template
+}
+
+// Whether the groups in the token were left out because the user has too
+// many. The token then has a reference to Graph in _claim_names, or
+// hasgroups in the implicit flow
+func groupsOverage(claims map[string]interface{}) bool {
+	if names, ok := claims["_claim_names"].(map[string]interface{}); ok {
+		if _, found := names["groups"]; found {
+			return true
+		}
+	}
+	has, _ := claims["hasgroups"].(bool)
+	return has
+}
+
+// The transitive group memberships of the user from Graph
+func (aa *AuthAzure) graphGroups(ctx context.Context, client *http.Client) ([]group, error) {
+	var r []group
+	u := aa.graphURL + "/v1.0/me/transitiveMemberOf/microsoft.graph.group?$select=id,displayName&$top=999"
+	for i := 0; u != "" && i < maxPages; i++ {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot list groups")
+		}
+		var page struct {
+			Value    []group `json:"value"`
+			NextLink string  `json:"@odata.nextLink"`
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("cannot list groups: graph returned %s", resp.Status)
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid response from graph")
+		}
+		r = append(r, page.Value...)
+		u = page.NextLink
+	}
+	return r, nil
+}
+
+// Resolve the groups and add the principals and groups to the claims
+func (aa *AuthAzure) amendClaims(ctx context.Context, client *http.Client, claims map[string]interface{}) (map[string]interface{}, error) {
+	if tid, _ := claims["tid"].(string); !strings.EqualFold(tid, aa.config.Tenant) {
+		return nil, errors.Errorf("token is from tenant %q", tid)
+	}
+	username, _ := claims["preferred_username"].(string)
+	if username == "" {
+		return nil, errors.New("no preferred_username in the id token")
+	}
+
+	var groups []group
+	if aa.config.ResolveGroupNames || groupsOverage(claims) {
+		var err error
+		if groups, err = aa.graphGroups(ctx, client); err != nil {
+			return nil, err
+		}
+	} else if ids, ok := claims["groups"].([]interface{}); ok {
+		for _, id := range ids {
+			if s, ok := id.(string); ok {
+				groups = append(groups, group{ID: s})
+			}
+		}
+	}
+
+	if len(aa.config.Groups) > 0 {
+		allowed := false
+		for _, g := range groups {
+			allowed = allowed || containsFold(aa.config.Groups, g.ID) ||
+				(g.Name != "" && containsFold(aa.config.Groups, g.Name))
+		}
+		if !allowed {
+			return nil, errors.Errorf("%s is not a member of the allowed groups", username)
+		}
+	}
+
+	var groupNames, principals []interface{}
+	if aa.config.UsernamePrincipal {
+		principals = append(principals, localPart(username))
+	}
+	for _, g := range groups {
+		if g.Name != "" {
+			groupNames = append(groupNames, g.Name)
+		} else {
+			groupNames = append(groupNames, g.ID)
+		}
+		for k, v := range aa.config.GroupPrincipals {
+			if strings.EqualFold(k, g.ID) || (g.Name != "" && strings.EqualFold(k, g.Name)) {
+				for _, p := range v {
+					principals = append(principals, p)
+				}
+			}
+		}
+		if aa.groupTpl == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := aa.groupTpl.Execute(&buf, g); err != nil {
+			return nil, errors.Wrap(err, "cannot render group principal")
+		}
+		if buf.Len() > 0 {
+			principals = append(principals, buf.String())
+		}
+	}
+	claims["principals"] = principals
+	claims["groups"] = groupNames
+	return claims, nil
+}
+
+func localPart(s string) string {
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (aa *AuthAzure) Type() string {
+	return Type
+}
+
+func New(config *Config) (*AuthAzure, error) {
+	if config.Tenant == "" || config.ClientId == "" || config.ClientSecret == "" {
+		return nil, errors.Errorf("%s: required config items: tenant, clientID, clientSecret", config.Name)
+	}
+	graphURL := strings.TrimSuffix(config.GraphURL, "/")
+	aa := &AuthAzure{
+		config:   config,
+		graphURL: graphURL,
+	}
+	if config.GroupPrincipalTemplate != "" {
+		tpl, err := template.New("group").Parse(config.GroupPrincipalTemplate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: cannot parse groupPrincipalTemplate", config.Name)
+		}
+		aa.groupTpl = tpl
+	}
+
+	oidcConfig := &authoidc.Config{
+		Name:         config.Name,
+		Realm:        config.Realm,
+		Timeout:      config.Timeout,
+		ClientId:     config.ClientId,
+		ClientSecret: config.ClientSecret,
+		// The access token is for Graph
+		Scopes:                 []string{"openid", "profile", "email", graphURL + "/GroupMember.Read.All"},
+		AuthFlowTimeout:        config.AuthFlowTimeout,
+		MaxPendingAuthAttempts: config.MaxPendingAuthAttempts,
+		RedirectURL:            config.RedirectURL,
+		ProviderURL:            strings.TrimSuffix(config.AuthorityURL, "/") + "/" + config.Tenant + "/v2.0",
+		ValueMappings: authoidc.TokenValueMapping{
+			SubjectNameField:    "preferred_username",
+			SubjectNameTemplate: "{{.}}",
+			PrincipalsField:     "principals",
+			PrincipalTemplate:   "{{.}}",
+			GroupsField:         "groups",
+		},
+		Principals:      config.Principals,
+		CriticalOptions: config.CriticalOptions,
+		Extensions:      config.Extensions,
+	}
+	var err error
+	if aa.AuthOIDC, err = authoidc.NewWithClaims(oidcConfig, aa.amendClaims); err != nil {
+		return nil, err
+	}
+	return aa, nil
+}
@@ -0,0 +1,215 @@
+package authazure
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+const tenant = "9188040d-6c67-4c5b-b112-36a304b66dad"
+
+var (
+	idpKey *rsa.PrivateKey
+	srv    *httptest.Server
+	// ID token claims returned for each code
+	users = map[string]map[string]interface{}{
+		"the code": {"preferred_username": "jdoe@example.com", "tid": tenant, "groups": []string{"id-admins", "id-other"}},
+		"overage": {"preferred_username": "jdoe@example.com", "tid": tenant,
+			"_claim_names":   map[string]string{"groups": "src1"},
+			"_claim_sources": map[string]interface{}{"src1": map[string]string{"endpoint": "https://graph.windows.net/..."}}},
+		"other tenant": {"preferred_username": "jdoe@example.org", "tid": "other", "groups": []string{"id-admins"}},
+		"no groups":    {"preferred_username": "nobody@example.com", "tid": tenant},
+	}
+	graphGroups = []group{
+		{"id-admins", "SSH Admins"},
+		{"id-ops", "SSH Ops"},
+		{"id-other", "Other"},
+	}
+	graphCalls int
+)
+
+func serverProvider() *httptest.Server {
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, status int, v interface{}) {
+		out, _ := json.Marshal(v)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(out)
+	}
+	mux.HandleFunc("/"+tenant+"/v2.0/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                 srv.URL + "/" + tenant + "/v2.0",
+			"jwks_uri":               srv.URL + "/keys",
+			"authorization_endpoint": srv.URL + "/" + tenant + "/oauth2/v2.0/authorize",
+			"token_endpoint":         srv.URL + "/" + tenant + "/oauth2/v2.0/token",
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &idpKey.PublicKey, KeyID: "idp", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/"+tenant+"/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		claims, ok := users[r.Form.Get("code")]
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		c := jwt.MapClaims{"iss": srv.URL + "/" + tenant + "/v2.0", "aud": "clientid", "exp": time.Now().Add(time.Hour).Unix()}
+		for k, v := range claims {
+			c[k] = v
+		}
+		ss, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, c).SignedString(idpKey)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id_token":     ss,
+			"token_type":   "Bearer",
+			"access_token": "graph token",
+		})
+	})
+	mux.HandleFunc("/v1.0/me/transitiveMemberOf/microsoft.graph.group", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer graph token" {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{})
+			return
+		}
+		graphCalls++
+		// Two pages
+		if r.URL.Query().Get("$skiptoken") == "" {
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"value":           graphGroups[:2],
+				"@odata.nextLink": "http://" + r.Host + r.URL.Path + "?$skiptoken=next",
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"value": graphGroups[2:]})
+	})
+	return httptest.NewServer(mux)
+}
+
+func getConfig() *Config {
+	conf := *Defaults
+	conf.Tenant = tenant
+	conf.ClientId = "clientid"
+	conf.ClientSecret = "clientsecret"
+	conf.RedirectURL = "https://localhost:12900/v1/auth_callback/azure"
+	conf.AuthorityURL = srv.URL
+	conf.GraphURL = srv.URL
+	conf.Groups = []string{"id-admins", "SSH Ops"}
+	conf.GroupPrincipals = map[string][]string{
+		"id-admins": {"root"},
+		"ssh ops":   {"ops"},
+	}
+	return &conf
+}
+
+func login(t *testing.T, aa *AuthAzure, code string) (*auth.AuthContext, error) {
+	actx, ok := aa.Authenticate(nil, &auth.Credentials{})
+	if !ok {
+		t.Fatal("cannot start flow")
+	}
+	u, _ := url.Parse(actx.GetMetaString(auth.MetaFederationAuthURL))
+	if err := aa.FederationCallback(url.Values{"state": {u.Query().Get("state")}, "code": {code}}); err != nil {
+		return nil, err
+	}
+	actx, ok = aa.Authenticate(actx, &auth.Credentials{})
+	if !ok {
+		t.Fatal("cannot complete flow")
+	}
+	return actx, nil
+}
+
+func TestMain(m *testing.M) {
+	var err error
+	if idpKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	srv = serverProvider()
+	r := m.Run()
+	srv.Close()
+	os.Exit(r)
+}
+
+func TestNew(t *testing.T) {
+	conf := getConfig()
+	conf.Tenant = ""
+	_, err := New(conf)
+	assert.Error(t, err, "tenant required")
+
+	conf = getConfig()
+	aa, err := New(conf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Type, aa.Type())
+		actx, _ := aa.Authenticate(nil, &auth.Credentials{})
+		u, _ := url.Parse(actx.GetMetaString(auth.MetaFederationAuthURL))
+		assert.Equal(t, "/"+tenant+"/oauth2/v2.0/authorize", u.Path)
+		assert.Equal(t, "openid profile email "+srv.URL+"/GroupMember.Read.All", u.Query().Get("scope"))
+	}
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	aa, err := New(getConfig())
+	if !assert.NoError(err) {
+		return
+	}
+
+	// Groups from the token, matched by object ID
+	graphCalls = 0
+	actx, err := login(t, aa, "the code")
+	if assert.NoError(err) {
+		assert.Equal(auth.StatusCompleted, actx.Status)
+		assert.Equal("jdoe@example.com", actx.GetSubjectName())
+		assert.Equal([]string{"jdoe", "root"}, actx.GetPrincipals())
+		assert.Equal([]string{"id-admins", "id-other"}, actx.GetGroups())
+	}
+	assert.Equal(0, graphCalls)
+
+	// Groups overage, read from Graph
+	aa.config.GroupPrincipalTemplate = ""
+	actx, err = login(t, aa, "overage")
+	if assert.NoError(err) {
+		assert.Equal([]string{"jdoe", "root", "ops"}, actx.GetPrincipals())
+		assert.Equal([]string{"SSH Admins", "SSH Ops", "Other"}, actx.GetGroups())
+	}
+	assert.Equal(2, graphCalls)
+
+	_, err = login(t, aa, "other tenant")
+	assert.Error(err, "wrong tenant")
+	_, err = login(t, aa, "no groups")
+	assert.Error(err, "not a member")
+}
+
+func TestGroupNames(t *testing.T) {
+	assert := assert.New(t)
+	conf := getConfig()
+	conf.Groups = nil
+	conf.GroupPrincipals = nil
+	conf.ResolveGroupNames = true
+	conf.UsernamePrincipal = false
+	conf.GroupPrincipalTemplate = `{{if eq .Name "Other"}}{{else}}{{.ID}}:{{.Name}}{{end}}`
+	aa, err := New(conf)
+	if !assert.NoError(err) {
+		return
+	}
+	actx, err := login(t, aa, "the code")
+	if assert.NoError(err) {
+		assert.Equal([]string{"id-admins:SSH Admins", "id-ops:SSH Ops"}, actx.GetPrincipals())
+	}
+	// Any user of the tenant
+	aa.config.ResolveGroupNames = false
+	actx, err = login(t, aa, "no groups")
+	if assert.NoError(err) {
+		assert.Empty(actx.GetPrincipals())
+	}
+}
@@ -0,0 +1,49 @@
+package authazure
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// Directory (tenant) ID
+	Tenant       string
+	ClientId     string `yaml:"clientID"`
+	ClientSecret string `yaml:"clientSecret"`
+	RedirectURL  string `yaml:"redirectURL"`
+	AuthorityURL string `yaml:"authorityURL"`
+	GraphURL     string `yaml:"graphURL"`
+
+	// Members of any of these groups are allowed, as object IDs or display
+	// names. Empty allows every user of the tenant
+	Groups []string
+	// Principals for the members of a group, keyed by object ID or display
+	// name
+	GroupPrincipals map[string][]string `yaml:"groupPrincipals"`
+	// Principal for each group of the user, with {{.ID}} and {{.Name}}.
+	// Empty disables it
+	GroupPrincipalTemplate string `yaml:"groupPrincipalTemplate"`
+	// Always read the groups from Graph to know the display names. The
+	// groups claim only has object IDs and Graph is otherwise used only
+	// when the user has too many groups for the token
+	ResolveGroupNames bool `yaml:"resolveGroupNames"`
+	// Add the local part of the preferred_username as a principal
+	UsernamePrincipal bool `yaml:"usernamePrincipal"`
+
+	Timeout                int `yaml:"timeout"`
+	AuthFlowTimeout        int `yaml:"authFlowTimeout"`
+	MaxPendingAuthAttempts int `yaml:"maxPendingAuthAttempts"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:                   DefaultName,
+	Realm:                  DefaultRealm,
+	AuthorityURL:           "https://login.microsoftonline.com",
+	GraphURL:               "https://graph.microsoft.com",
+	UsernamePrincipal:      true,
+	Timeout:                15,
+	AuthFlowTimeout:        240,
+	MaxPendingAuthAttempts: 1000,
+}
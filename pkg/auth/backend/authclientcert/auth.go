@@ -0,0 +1,232 @@
+package authclientcert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	subjectName = "subjectName"
+	deviceID    = "deviceID"
+)
+
+// Template context with the fields of the client certificate
+type certData struct {
+	CommonName         string
+	Organization       []string
+	OrganizationalUnit []string
+	DNSNames           []string
+	EmailAddresses     []string
+	URIs               []string
+	SerialNumber       string
+	Issuer             string
+}
+
+func newCertData(cert *x509.Certificate) certData {
+	d := certData{
+		CommonName:         cert.Subject.CommonName,
+		Organization:       cert.Subject.Organization,
+		OrganizationalUnit: cert.Subject.OrganizationalUnit,
+		DNSNames:           cert.DNSNames,
+		EmailAddresses:     cert.EmailAddresses,
+		SerialNumber:       cert.SerialNumber.String(),
+		Issuer:             cert.Issuer.String(),
+	}
+	for _, u := range cert.URIs {
+		d.URIs = append(d.URIs, u.String())
+	}
+	return d
+}
+
+// Names matched against AllowedNames
+func (d certData) names() []string {
+	r := []string{d.CommonName}
+	r = append(r, d.DNSNames...)
+	r = append(r, d.EmailAddresses...)
+	return append(r, d.URIs...)
+}
+
+// AuthClientCert authenticates with the TLS client certificate of the
+// connection, verified against the configured CAs
+type AuthClientCert struct {
+	config  *Config
+	log     *logrus.Entry
+	roots   *x509.CertPool
+	cas     []*x509.Certificate
+	allowed []glob.Glob
+	tpls    *template.Template
+	crl     *crlFile
+}
+
+func (ac *AuthClientCert) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	log := ac.log.WithField("action", "authenticate")
+	if v, ok := creds.Meta[auth.MetaAuditID]; ok {
+		log = log.WithField(auth.MetaAuditID, v)
+	}
+
+	certs, err := x509.ParseCertificates(creds.Secret)
+	if err != nil || len(certs) == 0 {
+		log.WithError(err).Info("no client certificate")
+		return nil, false
+	}
+	leaf := certs[0]
+	data := newCertData(leaf)
+	log = log.WithField("subject", leaf.Subject.String()).WithField("serial", data.SerialNumber)
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	chains, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         ac.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		log.WithError(err).Info("client certificate verification failed")
+		return nil, false
+	}
+	if ac.crl != nil {
+		if err := ac.crl.check(chains[0]); err != nil {
+			log.WithError(err).Info("client certificate rejected")
+			return nil, false
+		}
+	}
+	if len(ac.allowed) > 0 && !ac.nameAllowed(data) {
+		log.Info("client certificate name is not allowed")
+		return nil, false
+	}
+	log.Debug("client certificate auth successful")
+
+	actx := &auth.AuthContext{
+		Status:          auth.StatusCompleted,
+		Parent:          pctx,
+		SubjectName:     ac.renderTpl(subjectName, data),
+		CriticalOptions: ac.config.CriticalOptions,
+		Extensions:      ac.config.Extensions,
+		Authenticator:   ac.Name(),
+		AuthMeta:        creds.Meta,
+	}
+	for i := range ac.config.PrincipalTemplates {
+		actx.Principals = append(actx.Principals, ac.renderPrincipals(principalTpl(i), data)...)
+	}
+	actx.Principals = append(actx.Principals, ac.config.Principals...)
+	if ac.config.DeviceIDTemplate != "" {
+		actx.AddIdentity(auth.IdentityDeviceID, strings.TrimSpace(ac.renderTpl(deviceID, data)))
+	}
+	return actx, true
+}
+
+func (ac *AuthClientCert) nameAllowed(data certData) bool {
+	for _, name := range data.names() {
+		for _, g := range ac.allowed {
+			if g.Match(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ac *AuthClientCert) renderPrincipals(name string, data interface{}) []string {
+	var r []string
+	for _, line := range strings.Split(ac.renderTpl(name, data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line != "<no value>" {
+			r = append(r, line)
+		}
+	}
+	return r
+}
+
+func (ac *AuthClientCert) renderTpl(name string, data interface{}) string {
+	buf := bytes.NewBuffer([]byte{})
+	err := ac.tpls.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		ac.log.WithError(err).Errorf("template render error: %s", name)
+	}
+	return buf.String()
+}
+
+func principalTpl(i int) string {
+	return fmt.Sprintf("principal%d", i)
+}
+
+func (ac *AuthClientCert) Type() string {
+	return Type
+}
+
+func (ac *AuthClientCert) Name() string {
+	return ac.config.Name
+}
+
+func (ac *AuthClientCert) Realm() string {
+	return ac.config.Realm
+}
+
+func (ac *AuthClientCert) CredentialType() string {
+	return auth.CredentialClientCert
+}
+
+func New(config *Config) (*AuthClientCert, error) {
+	if config.CAFile == "" {
+		return nil, errors.Errorf("%s: required config items: caFile", config.Name)
+	}
+	ac := &AuthClientCert{
+		config: config,
+		roots:  x509.NewCertPool(),
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}
+	pem, err := ioutil.ReadFile(config.CAFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: cannot read caFile", config.Name)
+	}
+	if ac.cas, err = parseCertificates(pem); err != nil || len(ac.cas) == 0 {
+		return nil, errors.Errorf("%s: no certificates in caFile", config.Name)
+	}
+	for _, c := range ac.cas {
+		ac.roots.AddCert(c)
+	}
+	for _, p := range config.AllowedNames {
+		g, err := glob.Compile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: invalid allowedNames pattern %q", config.Name, p)
+		}
+		ac.allowed = append(ac.allowed, g)
+	}
+	ac.tpls = template.New("").Funcs(util.TemplateFuncs)
+	if _, err := ac.tpls.New(subjectName).Parse(config.SubjectNameTemplate); err != nil {
+		return nil, errors.Wrapf(err, "%s: cannot parse subjectNameTemplate", config.Name)
+	}
+	if _, err := ac.tpls.New(deviceID).Parse(config.DeviceIDTemplate); err != nil {
+		return nil, errors.Wrapf(err, "%s: cannot parse deviceIDTemplate", config.Name)
+	}
+	for i, t := range config.PrincipalTemplates {
+		if _, err := ac.tpls.New(principalTpl(i)).Parse(t); err != nil {
+			return nil, errors.Wrapf(err, "%s: cannot parse principalTemplates", config.Name)
+		}
+	}
+	if config.CRLFile != "" {
+		ac.crl = &crlFile{path: config.CRLFile, cas: ac.cas, log: ac.log, now: time.Now}
+		if err := ac.crl.load(); err != nil {
+			return nil, errors.Wrapf(err, "%s: cannot load crlFile", config.Name)
+		}
+	}
+	return ac, nil
+}
@@ -0,0 +1,146 @@
+package authclientcert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert, key}
+}
+
+// Client certificate chain as the login handler passes it
+func (ca *testCA) issue(t *testing.T, serial int64, cn string, usage x509.ExtKeyUsage) []byte {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	u, _ := url.Parse("spiffe://example.com/ci/" + cn)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn, OrganizationalUnit: []string{"automation"}},
+		DNSNames:     []string{cn + ".example.com"},
+		URIs:         []*url.URL{u},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func (ca *testCA) crl(t *testing.T, serials ...int64) []byte {
+	var revoked []pkix.RevokedCertificate
+	for _, s := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: big.NewInt(s), RevocationTime: time.Now()})
+	}
+	der, err := ca.cert.CreateCRL(rand.Reader, ca.key, revoked, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestClientCertAuth(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "authclientcert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, "Test CA")
+	other := newTestCA(t, "Other CA")
+	caFile := filepath.Join(dir, "ca.pem")
+	crlFile := filepath.Join(dir, "ca.crl")
+	assert.NoError(ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600))
+	assert.NoError(ioutil.WriteFile(crlFile, ca.crl(t, 2), 0600))
+
+	conf := *Defaults
+	conf.CAFile = caFile
+	conf.CRLFile = crlFile
+	conf.AllowedNames = []string{"*.example.com"}
+	conf.PrincipalTemplates = []string{"{{.CommonName}}", "{{range .OrganizationalUnit}}ou-{{.}}\n{{end}}"}
+	conf.Principals = []string{"extra"}
+	conf.DeviceIDTemplate = "device-{{.SerialNumber}}"
+	ac, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	login := func(chain []byte) (*auth.AuthContext, bool) {
+		return ac.Authenticate(nil, &auth.Credentials{Secret: chain})
+	}
+
+	actx, ok := login(ca.issue(t, 1, "builder", x509.ExtKeyUsageClientAuth))
+	if assert.True(ok) {
+		assert.Equal("builder", actx.GetSubjectName())
+		assert.Equal([]string{"builder", "ou-automation", "extra"}, actx.GetPrincipals())
+		assert.Equal(auth.CredentialClientCert, ac.CredentialType())
+		assert.Equal("device-1", actx.GetIdentity()[auth.IdentityDeviceID])
+	}
+	_, ok = login(nil)
+	assert.False(ok, "no certificate")
+	_, ok = login(other.issue(t, 1, "builder", x509.ExtKeyUsageClientAuth))
+	assert.False(ok, "unknown issuer")
+	_, ok = login(ca.issue(t, 3, "builder", x509.ExtKeyUsageServerAuth))
+	assert.False(ok, "not for client auth")
+	_, ok = login(ca.issue(t, 2, "builder", x509.ExtKeyUsageClientAuth))
+	assert.False(ok, "revoked")
+
+	// Updated CRL is picked up
+	assert.NoError(ioutil.WriteFile(crlFile, ca.crl(t, 1, 2), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(os.Chtimes(crlFile, later, later))
+	_, ok = login(ca.issue(t, 1, "builder", x509.ExtKeyUsageClientAuth))
+	assert.False(ok, "revoked after reload")
+
+	// Name not allowed
+	conf.AllowedNames = []string{"spiffe://example.com/deploy/*"}
+	conf.CRLFile = ""
+	ac, err = New(&conf)
+	if assert.NoError(err) {
+		_, ok = login(ca.issue(t, 4, "builder", x509.ExtKeyUsageClientAuth))
+		assert.False(ok)
+	}
+
+	// CRL of another CA
+	assert.NoError(ioutil.WriteFile(crlFile, other.crl(t), 0600))
+	conf.CRLFile = crlFile
+	_, err = New(&conf)
+	assert.Error(err)
+	_, err = New(&Config{Name: "test"})
+	assert.Error(err)
+}
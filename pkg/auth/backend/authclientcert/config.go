@@ -0,0 +1,35 @@
+package authclientcert
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// CA certificates issuing the accepted client certificates
+	CAFile string `yaml:"caFile"`
+	// CRL of one of the CAs, re-read when the file changes
+	CRLFile string `yaml:"crlFile"`
+	// Accept only certificates with the common name or a SAN matching one
+	// of these glob patterns. Empty accepts all certificates of the CAs
+	AllowedNames []string `yaml:"allowedNames"`
+
+	// Templates with the certificate fields: .CommonName, .Organization,
+	// .OrganizationalUnit, .DNSNames, .EmailAddresses, .URIs, .SerialNumber
+	// and .Issuer. Each line of the principal template output is a principal
+	SubjectNameTemplate string   `yaml:"subjectNameTemplate"`
+	PrincipalTemplates  []string `yaml:"principalTemplates"`
+	// Device id identity attribute for the key id and the certificate
+	// extensions, e.g. {{.SerialNumber}} with device certificates. Empty
+	// disables
+	DeviceIDTemplate string `yaml:"deviceIDTemplate"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:                DefaultName,
+	Realm:               DefaultRealm,
+	SubjectNameTemplate: "{{.CommonName}}",
+	PrincipalTemplates:  []string{"{{.CommonName}}"},
+}
@@ -0,0 +1,123 @@
+package authclientcert
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Certificates of the PEM blocks of type CERTIFICATE
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var r []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return r, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, c)
+	}
+}
+
+// CRL from a PEM or DER file signed by one of the CAs. The file is re-read
+// when it changes and the previous list is kept if the new one is invalid
+type crlFile struct {
+	path string
+	cas  []*x509.Certificate
+	log  *logrus.Entry
+	now  func() time.Time
+
+	mu      sync.Mutex
+	modTime time.Time
+	issuer  *x509.Certificate
+	next    time.Time
+	revoked map[string]bool
+}
+
+func (cf *crlFile) load() error {
+	fi, err := os.Stat(cf.path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(cf.path)
+	if err != nil {
+		return err
+	}
+	crl, err := x509.ParseCRL(data)
+	if err != nil {
+		return errors.Wrap(err, "cannot parse CRL")
+	}
+	var issuer *x509.Certificate
+	for _, ca := range cf.cas {
+		if ca.CheckCRLSignature(crl) == nil {
+			issuer = ca
+			break
+		}
+	}
+	if issuer == nil {
+		return errors.New("CRL is not signed by any of the CAs")
+	}
+	revoked := make(map[string]bool, len(crl.TBSCertList.RevokedCertificates))
+	for _, rc := range crl.TBSCertList.RevokedCertificates {
+		revoked[rc.SerialNumber.String()] = true
+	}
+	cf.mu.Lock()
+	cf.modTime = fi.ModTime()
+	cf.issuer = issuer
+	cf.next = crl.TBSCertList.NextUpdate
+	cf.revoked = revoked
+	cf.mu.Unlock()
+	cf.log.WithField("count_revoked", len(revoked)).Info("loaded CRL")
+	return nil
+}
+
+func (cf *crlFile) reloadIfChanged() {
+	fi, err := os.Stat(cf.path)
+	if err != nil {
+		cf.log.WithError(err).Warn("cannot check CRL for changes")
+		return
+	}
+	cf.mu.Lock()
+	changed := !fi.ModTime().Equal(cf.modTime)
+	if changed {
+		// Do not retry an invalid file until it changes again
+		cf.modTime = fi.ModTime()
+	}
+	cf.mu.Unlock()
+	if !changed {
+		return
+	}
+	if err := cf.load(); err != nil {
+		cf.log.WithError(err).Error("CRL reload failed, keeping the previous CRL")
+	}
+}
+
+// Check the certificates issued by the CRL issuer in the verified chain
+func (cf *crlFile) check(chain []*x509.Certificate) error {
+	cf.reloadIfChanged()
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if !cf.next.IsZero() && cf.now().After(cf.next) {
+		cf.log.WithField("next_update", cf.next).Warn("CRL is out of date")
+	}
+	for _, c := range chain {
+		if bytes.Equal(c.RawIssuer, cf.issuer.RawSubject) && cf.revoked[c.SerialNumber.String()] {
+			return errors.Errorf("certificate %s of %s is revoked", c.SerialNumber, c.Subject.String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package authduo
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	factorPush  = "push"
+	factorPhone = "phone"
+)
+
+// Pause between status requests of an asynchronous authentication
+var pollInterval = time.Second
+
+type usernameData struct {
+	User string
+}
+
+type AuthDuo struct {
+	config   *Config
+	log      *logrus.Entry
+	client   *duoClient
+	username *template.Template
+}
+
+func (ad *AuthDuo) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	log := ad.log.WithField("action", "authenticate")
+	if v, ok := creds.Meta[auth.MetaAuditID]; ok {
+		log = log.WithField(auth.MetaAuditID, v)
+	}
+
+	subject := creds.UserIdentifier
+	switch {
+	case pctx != nil:
+		if !pctx.IsValid() {
+			log.Info("parent auth context is not completed")
+			return nil, false
+		}
+		subject = pctx.GetSubjectName()
+	case ad.config.RequireParent:
+		log.Info("no authenticated parent context")
+		return nil, false
+	}
+	if subject == "" {
+		log.Info("no user")
+		return nil, false
+	}
+	var buf bytes.Buffer
+	if err := ad.username.Execute(&buf, usernameData{User: subject}); err != nil {
+		log.WithError(err).Error("cannot render username")
+		return nil, false
+	}
+	user := buf.String()
+	log = log.WithField("user", user)
+
+	err := ad.verify(user, strings.TrimSpace(string(creds.Secret)), log)
+	if err != nil {
+		_, rejected := err.(*rejectedError)
+		if rejected || !ad.config.FailOpen {
+			if !rejected {
+				creds.SetBackendError(err)
+			}
+			log.WithError(err).Info("Duo auth failed")
+			return nil, false
+		}
+		log.WithError(err).Warn("Duo is not available, allowing the login")
+	}
+	log.Debug("Duo auth successful")
+
+	actx := &auth.AuthContext{
+		Status:          auth.StatusCompleted,
+		Parent:          pctx,
+		Principals:      append([]string{}, ad.config.Principals...),
+		CriticalOptions: ad.config.CriticalOptions,
+		Extensions:      ad.config.Extensions,
+		Authenticator:   ad.Name(),
+		AuthMeta:        creds.Meta,
+	}
+	if pctx == nil {
+		actx.SubjectName = subject
+	}
+	actx.AddIdentity(auth.IdentityMFA, "duo")
+	return actx, true
+}
+
+// Denied by Duo, as opposed to a failure to reach it
+type rejectedError struct {
+	msg string
+}
+
+func (e *rejectedError) Error() string {
+	return e.msg
+}
+
+// Verify the user with a passcode, or with a push or a phone call. Returns a
+// rejectedError when Duo denies the login
+func (ad *AuthDuo) verify(user, secret string, log *logrus.Entry) error {
+	pre, err := ad.client.preauth(user)
+	if err != nil {
+		// Request errors, unlike unavailability, must not fail open
+		if apiErr, ok := err.(*apiError); ok && apiErr.Code/1000 == 40 {
+			return &rejectedError{msg: apiErr.Error()}
+		}
+		return err
+	}
+	switch pre.Result {
+	case "allow":
+		log.Info("Duo allows the user without a second factor")
+		return nil
+	case "auth":
+	default:
+		return &rejectedError{msg: "preauth: " + pre.Result + ": " + pre.StatusMsg}
+	}
+
+	params := url.Values{"username": {user}}
+	switch strings.ToLower(secret) {
+	case "", factorPush:
+		params.Set("factor", factorPush)
+		params.Set("device", "auto")
+		params.Set("type", "SSH certificate")
+		params.Set("pushinfo", url.Values{"realm": {ad.Realm()}}.Encode())
+		params.Set("async", "1")
+	case factorPhone:
+		params.Set("factor", factorPhone)
+		params.Set("device", "auto")
+		params.Set("async", "1")
+	default:
+		params.Set("factor", "passcode")
+		params.Set("passcode", secret)
+	}
+	log = log.WithField("factor", params.Get("factor"))
+	res, err := ad.client.auth(params)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(time.Duration(ad.config.Timeout) * time.Second)
+	for (res.TxID != "" && res.Result == "") || res.Result == "waiting" {
+		if time.Now().After(deadline) {
+			return &rejectedError{msg: "timed out waiting for the user"}
+		}
+		log.WithField("status", res.Status).Debug("waiting for the user")
+		txid := res.TxID
+		if res, err = ad.client.authStatus(txid); err != nil {
+			return err
+		}
+		res.TxID = txid
+		if res.Result == "waiting" {
+			time.Sleep(pollInterval)
+		}
+	}
+	if res.Result != "allow" {
+		return &rejectedError{msg: res.Result + ": " + res.StatusMsg}
+	}
+	return nil
+}
+
+func (ad *AuthDuo) Type() string {
+	return Type
+}
+
+func (ad *AuthDuo) Name() string {
+	return ad.config.Name
+}
+
+func (ad *AuthDuo) Realm() string {
+	return ad.config.Realm
+}
+
+func (ad *AuthDuo) CredentialType() string {
+	if ad.config.RequireParent {
+		return auth.CredentialPin
+	}
+	return auth.CredentialUserPassword
+}
+
+// Check the credentials with the Duo check endpoint
+func (ad *AuthDuo) Probe() error {
+	var r interface{}
+	return ad.client.call(http.MethodGet, "/auth/v2/check", url.Values{}, &r)
+}
+
+func New(config *Config) (*AuthDuo, error) {
+	if config.APIHost == "" || config.IntegrationKey == "" || config.SecretKey == "" {
+		return nil, errors.Errorf("%s: required config items: apiHost, integrationKey, secretKey", config.Name)
+	}
+	tpl, err := template.New("username").Parse(config.UsernameTemplate)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: cannot parse usernameTemplate", config.Name)
+	}
+	// Leave time for the user on top of the request itself
+	timeout := time.Duration(config.Timeout+10) * time.Second
+	return &AuthDuo{
+		config:   config,
+		client:   newDuoClient(config.APIHost, config.IntegrationKey, config.SecretKey, timeout),
+		username: tpl,
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}, nil
+}
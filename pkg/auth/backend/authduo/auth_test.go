@@ -0,0 +1,203 @@
+package authduo
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testIKey = "DIWJ8X6AEYOR5OMC6TQ1"
+	testSKey = "Zh5eGmUq9zpfQnyUIu5OL9iWoMMv5ZNmk3zLJ4Ep"
+)
+
+// Fake Duo API. Users named deny, enroll and allow get that preauth
+// result, the passcode 123456 is valid and pushes are approved after two
+// status polls
+type fakeDuo struct {
+	sync.Mutex
+	t     *testing.T
+	host  string
+	polls int
+	calls []url.Values
+}
+
+func (fd *fakeDuo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fd.Lock()
+	defer fd.Unlock()
+	r.ParseForm()
+	params := r.Form
+	fd.calls = append(fd.calls, params)
+	ikey, sig, _ := r.BasicAuth()
+	dc := &duoClient{host: fd.host, skey: testSKey}
+	if ikey != testIKey || sig != dc.sign(r.Header.Get("Date"), r.Method, r.URL.Path, params) {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]interface{}{"stat": "FAIL", "code": 40103, "message": "Invalid signature in request credentials"})
+		return
+	}
+	var resp interface{}
+	switch r.URL.Path {
+	case "/auth/v2/check":
+		resp = map[string]interface{}{"time": 1357020061}
+	case "/auth/v2/preauth":
+		result := "auth"
+		switch params.Get("username") {
+		case "deny", "enroll", "allow":
+			result = params.Get("username")
+		}
+		resp = map[string]interface{}{"result": result, "status_msg": "Account is " + result}
+	case "/auth/v2/auth":
+		switch params.Get("factor") {
+		case "passcode":
+			result := "deny"
+			if params.Get("passcode") == "123456" {
+				result = "allow"
+			}
+			resp = map[string]interface{}{"result": result, "status": result, "status_msg": "Passcode " + result}
+		case "push", "phone":
+			if params.Get("async") != "1" {
+				fd.t.Error("push without async")
+			}
+			fd.polls = 0
+			resp = map[string]interface{}{"txid": "tx-" + params.Get("username")}
+		}
+	case "/auth/v2/auth_status":
+		fd.polls++
+		result := "waiting"
+		if fd.polls > 2 {
+			result = "allow"
+			if params.Get("txid") == "tx-rejector" {
+				result = "deny"
+			}
+		}
+		resp = map[string]interface{}{"result": result, "status": "pushed", "status_msg": "Pushed a login request"}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"stat": "OK", "response": resp})
+}
+
+func newTestAuth(t *testing.T) (*AuthDuo, *fakeDuo) {
+	pollInterval = 10 * time.Millisecond
+	fd := &fakeDuo{t: t}
+	srv := httptest.NewServer(fd)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	fd.host = u.Host
+
+	config := *Defaults
+	config.Name = "duo"
+	config.APIHost = u.Host
+	config.IntegrationKey = testIKey
+	config.SecretKey = testSKey
+	config.UsernameTemplate = `{{index (split .User "@") 0}}`
+	config.Principals = []string{"mfa"}
+	_, err := New(&config)
+	assert.Error(t, err, "unknown template function")
+	config.UsernameTemplate = "{{.User}}"
+	ad, err := New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ad.client.baseURL = srv.URL
+	return ad, fd
+}
+
+func TestSign(t *testing.T) {
+	// Example of the Duo API documentation
+	dc := newDuoClient("api-XXXXXXXX.duosecurity.com", testIKey, testSKey, 0)
+	params := url.Values{
+		"realname": {"First Last"},
+		"username": {"root"},
+	}
+	assert.Equal(t, "realname=First%20Last&username=root", canonParams(params))
+	sig := dc.sign("Tue, 21 Aug 2012 17:29:18 -0000", "post", "/accounts/v1/account/list", params)
+	assert.Equal(t, "2d97d6166319781b5a3a07af39d366f491234edc", sig)
+}
+
+func TestAuthenticate(t *testing.T) {
+	assert := assert.New(t)
+	ad, fd := newTestAuth(t)
+	assert.Equal(auth.CredentialPin, ad.CredentialType())
+	assert.NoError(ad.Probe())
+	parent := func(user string) *auth.AuthContext {
+		return &auth.AuthContext{Status: auth.StatusCompleted, SubjectName: user, Authenticator: "ldap"}
+	}
+
+	_, ok := ad.Authenticate(nil, &auth.Credentials{UserIdentifier: "user", Secret: []byte("123456")})
+	assert.False(ok, "parent required")
+	_, ok = ad.Authenticate(&auth.AuthContext{Status: auth.StatusPending, SubjectName: "user"}, &auth.Credentials{Secret: []byte("123456")})
+	assert.False(ok, "pending parent")
+
+	actx, ok := ad.Authenticate(parent("user"), &auth.Credentials{Secret: []byte("123456")})
+	if assert.True(ok) {
+		assert.Equal("user", actx.GetSubjectName())
+		assert.Equal([]string{"mfa"}, actx.GetPrincipals())
+		assert.Equal([]string{"duo", "ldap"}, actx.GetAuthenticators())
+	}
+	_, ok = ad.Authenticate(parent("user"), &auth.Credentials{Secret: []byte("654321")})
+	assert.False(ok)
+
+	// Push with polling
+	fd.calls = nil
+	_, ok = ad.Authenticate(parent("user"), &auth.Credentials{})
+	assert.True(ok)
+	assert.Equal(3, fd.polls)
+	last := fd.calls[1]
+	assert.Equal("push", last.Get("factor"))
+	assert.Equal("realm=default+realm", last.Get("pushinfo"))
+	_, ok = ad.Authenticate(parent("rejector"), &auth.Credentials{Secret: []byte("push")})
+	assert.False(ok)
+	_, ok = ad.Authenticate(parent("user"), &auth.Credentials{Secret: []byte("phone")})
+	assert.True(ok)
+
+	// Preauth results
+	_, ok = ad.Authenticate(parent("allow"), &auth.Credentials{})
+	assert.True(ok)
+	_, ok = ad.Authenticate(parent("deny"), &auth.Credentials{})
+	assert.False(ok)
+	_, ok = ad.Authenticate(parent("enroll"), &auth.Credentials{})
+	assert.False(ok)
+}
+
+func TestFailures(t *testing.T) {
+	assert := assert.New(t)
+	ad, _ := newTestAuth(t)
+	parent := &auth.AuthContext{Status: auth.StatusCompleted, SubjectName: "user"}
+
+	// Bad credentials never fail open
+	ad.config.FailOpen = true
+	ad.client.skey = "wrong"
+	creds := &auth.Credentials{Secret: []byte("123456")}
+	_, ok := ad.Authenticate(parent, creds)
+	assert.False(ok)
+	assert.False(creds.BackendError())
+	err := ad.Probe()
+	if assert.Error(err) {
+		assert.True(strings.Contains(err.Error(), "40103"))
+	}
+
+	ad.client.skey = testSKey
+	ad.client.baseURL = "http://127.0.0.1:1"
+	_, ok = ad.Authenticate(parent, &auth.Credentials{Secret: []byte("123456")})
+	assert.True(ok, "fail open")
+	ad.config.FailOpen = false
+	creds = &auth.Credentials{Secret: []byte("123456")}
+	_, ok = ad.Authenticate(parent, creds)
+	assert.False(ok)
+	assert.True(creds.BackendError())
+
+	// Standalone use
+	ad.client.baseURL = ""
+	ad.config.RequireParent = false
+	assert.Equal(auth.CredentialUserPassword, ad.CredentialType())
+}
@@ -0,0 +1,32 @@
+package authduo
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// API hostname of the Duo application, e.g. api-xxxxxxxx.duosecurity.com
+	APIHost        string `yaml:"apiHost"`
+	IntegrationKey string `yaml:"integrationKey"`
+	SecretKey      string `yaml:"secretKey"`
+	// Seconds to wait for the user to approve a push or a phone call
+	Timeout int
+	// Duo username of the user, the subject name of the parent context is
+	// available as {{.User}}
+	UsernameTemplate string `yaml:"usernameTemplate"`
+	// Allow the login when Duo cannot be reached
+	FailOpen bool `yaml:"failOpen"`
+	// Only allow logins on top of another backend, which identifies the user
+	RequireParent bool `yaml:"requireParent"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:             DefaultName,
+	Realm:            DefaultRealm,
+	Timeout:          60,
+	UsernameTemplate: "{{.User}}",
+	RequireParent:    true,
+}
@@ -0,0 +1,152 @@
+package authduo
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Limit for the API responses
+const maxResponseSize = 1 << 20
+
+// Client of the Duo Auth API v2
+type duoClient struct {
+	host    string
+	ikey    string
+	skey    string
+	baseURL string
+	http    *http.Client
+	now     func() time.Time
+}
+
+type apiError struct {
+	Code          int    `json:"code"`
+	Message       string `json:"message"`
+	MessageDetail string `json:"message_detail"`
+}
+
+func (e *apiError) Error() string {
+	if e.MessageDetail != "" {
+		return fmt.Sprintf("duo: %d %s: %s", e.Code, e.Message, e.MessageDetail)
+	}
+	return fmt.Sprintf("duo: %d %s", e.Code, e.Message)
+}
+
+type preauthResponse struct {
+	// auth, allow, deny or enroll
+	Result    string `json:"result"`
+	StatusMsg string `json:"status_msg"`
+}
+
+type authResponse struct {
+	// allow, deny or waiting
+	Result    string `json:"result"`
+	Status    string `json:"status"`
+	StatusMsg string `json:"status_msg"`
+	TxID      string `json:"txid"`
+}
+
+func newDuoClient(host, ikey, skey string, timeout time.Duration) *duoClient {
+	return &duoClient{
+		host:    strings.ToLower(host),
+		ikey:    ikey,
+		skey:    skey,
+		baseURL: "https://" + host,
+		http:    &http.Client{Timeout: timeout},
+		now:     time.Now,
+	}
+}
+
+// Parameters in the canonical form, sorted and with spaces as %20
+func canonParams(params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range params[k] {
+			parts = append(parts, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// HMAC-SHA1 signature of the request, version 2 of the Duo scheme
+func (dc *duoClient) sign(date, method, path string, params url.Values) string {
+	canon := strings.Join([]string{date, strings.ToUpper(method), dc.host, path, canonParams(params)}, "\n")
+	mac := hmac.New(sha1.New, []byte(dc.skey))
+	mac.Write([]byte(canon))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (dc *duoClient) call(method, path string, params url.Values, result interface{}) error {
+	var (
+		req *http.Request
+		err error
+	)
+	body := canonParams(params)
+	if method == http.MethodGet {
+		req, err = http.NewRequest(method, dc.baseURL+path+"?"+body, nil)
+	} else {
+		req, err = http.NewRequest(method, dc.baseURL+path, strings.NewReader(body))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	date := dc.now().UTC().Format("Mon, 02 Jan 2006 15:04:05 -0700")
+	req.Header.Set("Date", date)
+	req.SetBasicAuth(dc.ikey, dc.sign(date, method, path, params))
+	resp, err := dc.http.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "duo request failed")
+	}
+	defer resp.Body.Close()
+	var r struct {
+		Stat     string          `json:"stat"`
+		Response json.RawMessage `json:"response"`
+		apiError
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&r); err != nil {
+		return errors.Wrapf(err, "invalid duo response with status %s", resp.Status)
+	}
+	if r.Stat != "OK" {
+		return &r.apiError
+	}
+	return errors.Wrap(json.Unmarshal(r.Response, result), "invalid duo response")
+}
+
+func (dc *duoClient) preauth(user string) (*preauthResponse, error) {
+	var r preauthResponse
+	return &r, dc.call(http.MethodPost, "/auth/v2/preauth", url.Values{"username": {user}}, &r)
+}
+
+// Start an authentication and return the transaction id. Passcodes are
+// verified right away
+func (dc *duoClient) auth(params url.Values) (*authResponse, error) {
+	var r authResponse
+	return &r, dc.call(http.MethodPost, "/auth/v2/auth", params, &r)
+}
+
+func (dc *duoClient) authStatus(txid string) (*authResponse, error) {
+	var r authResponse
+	return &r, dc.call(http.MethodGet, "/auth/v2/auth_status", url.Values{"txid": {txid}}, &r)
+}
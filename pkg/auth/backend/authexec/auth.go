@@ -0,0 +1,247 @@
+package authexec
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Limits for the output of the program
+const (
+	maxStdout = 1 << 20
+	maxStderr = 4096
+)
+
+var errOutputTooLarge = errors.New("output too large")
+
+// Written to the standard input of the program
+type Request struct {
+	Name    string `json:"name"`
+	Realm   string `json:"realm"`
+	User    string `json:"user"`
+	Secret  string `json:"secret"`
+	AuditID string `json:"audit_id,omitempty"`
+	// Result of the preceding backends in the chain
+	Parent *Parent `json:"parent,omitempty"`
+}
+
+type Parent struct {
+	Subject        string   `json:"subject"`
+	Principals     []string `json:"principals"`
+	Groups         []string `json:"groups,omitempty"`
+	Authenticators []string `json:"authenticators"`
+}
+
+// Expected on the standard output of the program. The authentication fails
+// unless success is set and the program exits with zero status
+type Response struct {
+	Success         bool              `json:"success"`
+	SubjectName     string            `json:"subject_name"`
+	Principals      []string          `json:"principals"`
+	Groups          []string          `json:"groups"`
+	CriticalOptions map[string]string `json:"critical_options"`
+	Extensions      map[string]string `json:"extensions"`
+	// Duration string like 8h
+	MaxLifetime string `json:"max_lifetime"`
+	// Logged when the authentication fails
+	Message string `json:"message"`
+}
+
+// AuthExec delegates the authentication to an external program
+type AuthExec struct {
+	config *Config
+	log    *logrus.Entry
+	env    []string
+}
+
+func (ae *AuthExec) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	log := ae.log.WithField("action", "authenticate").WithField("user", creds.UserIdentifier)
+	req := &Request{
+		Name:   ae.config.Name,
+		Realm:  ae.config.Realm,
+		User:   creds.UserIdentifier,
+		Secret: string(creds.Secret),
+	}
+	if v, ok := creds.Meta[auth.MetaAuditID]; ok {
+		log = log.WithField(auth.MetaAuditID, v)
+		req.AuditID, _ = v.(string)
+	}
+	if pctx != nil {
+		req.Parent = &Parent{
+			Subject:        pctx.GetSubjectName(),
+			Principals:     pctx.GetPrincipals(),
+			Groups:         pctx.GetGroups(),
+			Authenticators: pctx.GetAuthenticators(),
+		}
+	}
+
+	res, err := ae.run(req)
+	if err != nil {
+		log.WithError(err).Error("auth program failed")
+		return nil, false
+	}
+	if !res.Success {
+		log.WithField("message", res.Message).Info("auth program rejected the user")
+		return nil, false
+	}
+	if res.MaxLifetime != "" {
+		if _, err := time.ParseDuration(res.MaxLifetime); err != nil {
+			log.WithError(err).Error("auth program returned invalid max_lifetime")
+			return nil, false
+		}
+	}
+	log.Debug("auth program accepted the user")
+
+	actx := &auth.AuthContext{
+		Status:          auth.StatusCompleted,
+		Parent:          pctx,
+		SubjectName:     res.SubjectName,
+		Principals:      append(res.Principals, ae.config.Principals...),
+		CriticalOptions: merge(ae.config.CriticalOptions, res.CriticalOptions),
+		Extensions:      merge(ae.config.Extensions, res.Extensions),
+		Authenticator:   ae.Name(),
+		AuthMeta:        creds.Meta,
+	}
+	if len(res.Groups) > 0 || res.MaxLifetime != "" {
+		actx.AuthMeta = make(map[string]interface{}, len(creds.Meta)+2)
+		for k, v := range creds.Meta {
+			actx.AuthMeta[k] = v
+		}
+		if len(res.Groups) > 0 {
+			actx.AuthMeta[auth.MetaGroups] = res.Groups
+		}
+		if res.MaxLifetime != "" {
+			actx.AuthMeta[auth.MetaMaxLifetime] = res.MaxLifetime
+		}
+	}
+	return actx, true
+}
+
+// Run the program with the request and decode its response
+func (ae *AuthExec) run(req *Request) (*Response, error) {
+	in, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(ae.config.Timeout)*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ae.config.Command[0], ae.config.Command[1:]...)
+	cmd.Env = ae.env
+	cmd.Stdin = bytes.NewReader(in)
+	stdout := &limitedBuffer{max: maxStdout}
+	stderr := &limitedBuffer{max: maxStderr, truncate: true}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return nil, errors.New("timed out")
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.Wrapf(err, "stderr: %s", msg)
+		}
+		return nil, err
+	}
+	res := &Response{}
+	if err := json.Unmarshal(stdout.Bytes(), res); err != nil {
+		return nil, errors.Wrap(err, "cannot parse the output")
+	}
+	return res, nil
+}
+
+// Buffer failing or silently discarding writes over the limit
+type limitedBuffer struct {
+	bytes.Buffer
+	max      int
+	truncate bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); len(p) > room {
+		if !b.truncate {
+			return 0, errOutputTooLarge
+		}
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// Copy of a with the values of b on top
+func merge(a, b map[string]string) map[string]string {
+	if len(b) == 0 {
+		return a
+	}
+	r := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		r[k] = v
+	}
+	for k, v := range b {
+		r[k] = v
+	}
+	return r
+}
+
+// Check that the program is still there
+func (ae *AuthExec) Probe() error {
+	if _, err := exec.LookPath(ae.config.Command[0]); err != nil {
+		return errors.Wrap(err, "invalid command")
+	}
+	return nil
+}
+
+func (ae *AuthExec) Type() string {
+	return Type
+}
+
+func (ae *AuthExec) Name() string {
+	return ae.config.Name
+}
+
+func (ae *AuthExec) Realm() string {
+	return ae.config.Realm
+}
+
+func (ae *AuthExec) CredentialType() string {
+	return auth.CredentialUserPassword
+}
+
+func New(config *Config) (*AuthExec, error) {
+	if len(config.Command) == 0 || config.Command[0] == "" {
+		return nil, errors.Errorf("%s: required config items: command", config.Name)
+	}
+	if _, err := exec.LookPath(config.Command[0]); err != nil {
+		return nil, errors.Wrapf(err, "%s: invalid command", config.Name)
+	}
+	if config.Timeout <= 0 {
+		return nil, errors.Errorf("%s: timeout must be positive", config.Name)
+	}
+	ae := &AuthExec{
+		config: config,
+		env:    []string{"PATH=" + os.Getenv("PATH")},
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}
+	for k, v := range config.Env {
+		ae.env = append(ae.env, k+"="+v)
+	}
+	sort.Strings(ae.env[1:])
+	return ae, nil
+}
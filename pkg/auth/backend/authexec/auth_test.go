@@ -0,0 +1,139 @@
+package authexec
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+// Run as the auth program by the tests
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("AUTHEXEC_HELPER") != "1" {
+		return
+	}
+	req := &Request{}
+	if err := json.NewDecoder(os.Stdin).Decode(req); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	res := &Response{}
+	switch {
+	case req.User == "alice" && req.Secret == "secret":
+		res.Success = true
+		res.SubjectName = "Alice"
+		res.Principals = []string{"alice"}
+		res.Groups = []string{"ops"}
+		res.Extensions = map[string]string{"permit-pty": ""}
+		res.MaxLifetime = "1h"
+		if req.Parent != nil {
+			res.Principals = append(res.Principals, "parent-"+req.Parent.Subject)
+		}
+	case req.User == "crash":
+		fmt.Fprintln(os.Stderr, "something broke")
+		os.Exit(1)
+	case req.User == "slow":
+		time.Sleep(5 * time.Second)
+	case req.User == "garbage":
+		fmt.Print("not json")
+		os.Exit(0)
+	case req.User == "huge":
+		fmt.Print(strings.Repeat(" ", maxStdout+1))
+		os.Exit(0)
+	default:
+		res.Message = "invalid credentials for " + req.User + " in " + os.Getenv("AUTHEXEC_REALM")
+	}
+	json.NewEncoder(os.Stdout).Encode(res)
+	os.Exit(0)
+}
+
+func newTestAuthExec(t *testing.T) *AuthExec {
+	ae, err := New(&Config{
+		Name:    "exec",
+		Realm:   "test",
+		Command: []string{os.Args[0], "-test.run=TestHelperProcess"},
+		Env: map[string]string{
+			"AUTHEXEC_HELPER": "1",
+			"AUTHEXEC_REALM":  "test",
+		},
+		Timeout:         1,
+		Principals:      []string{"static"},
+		CriticalOptions: map[string]string{"source-address": "10.0.0.0/8"},
+		Extensions:      map[string]string{"permit-agent-forwarding": ""},
+	})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return ae
+}
+
+func TestAuth(t *testing.T) {
+	assert := assert.New(t)
+	ae := newTestAuthExec(t)
+
+	actx, ok := ae.Authenticate(nil, &auth.Credentials{
+		UserIdentifier: "alice",
+		Secret:         []byte("secret"),
+		Meta:           map[string]interface{}{auth.MetaAuditID: "id"},
+	})
+	if assert.True(ok) {
+		assert.Equal("Alice", actx.GetSubjectName())
+		assert.Equal([]string{"alice", "static"}, actx.GetPrincipals())
+		assert.Equal([]string{"ops"}, actx.GetGroups())
+		assert.Equal(time.Hour, actx.GetMaxLifetime())
+		assert.Equal(map[string]string{"source-address": "10.0.0.0/8"}, actx.GetCriticalOptions())
+		assert.Equal(map[string]string{"permit-pty": "", "permit-agent-forwarding": ""}, actx.GetExtensions())
+		assert.Equal("id", actx.AuthMeta[auth.MetaAuditID])
+	}
+
+	parent := &auth.AuthContext{
+		Status:        auth.StatusCompleted,
+		SubjectName:   "first",
+		Principals:    []string{"p"},
+		Authenticator: "file",
+	}
+	actx, ok = ae.Authenticate(parent, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("secret")})
+	if assert.True(ok) {
+		assert.Equal([]string{"p", "alice", "parent-first", "static"}, actx.GetPrincipals())
+		assert.Equal("Alice", actx.GetSubjectName())
+	}
+
+	for _, user := range []string{"alice-wrong", "crash", "slow", "garbage", "huge"} {
+		_, ok = ae.Authenticate(nil, &auth.Credentials{UserIdentifier: user, Secret: []byte("wrong")})
+		assert.False(ok, user)
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	assert := assert.New(t)
+	ae := newTestAuthExec(t)
+
+	res, err := ae.run(&Request{User: "nobody"})
+	if assert.NoError(err) {
+		assert.False(res.Success)
+		assert.Equal("invalid credentials for nobody in test", res.Message)
+	}
+	_, err = ae.run(&Request{User: "crash"})
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "something broke")
+	}
+	_, err = ae.run(&Request{User: "slow"})
+	assert.EqualError(err, "timed out")
+	_, err = ae.run(&Request{User: "huge"})
+	assert.Error(err)
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+	_, err := New(&Config{Name: "exec", Timeout: 1})
+	assert.EqualError(err, "exec: required config items: command")
+	_, err = New(&Config{Name: "exec", Timeout: 1, Command: []string{"/nonexistent/program"}})
+	assert.Error(err)
+	_, err = New(&Config{Name: "exec", Command: []string{os.Args[0]}})
+	assert.EqualError(err, "exec: timeout must be positive")
+}
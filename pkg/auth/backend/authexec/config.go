@@ -0,0 +1,29 @@
+package authexec
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// Program and its arguments. The request is written to the standard
+	// input as JSON and the result is read from the standard output
+	Command []string
+	// Environment of the program in addition to PATH. The environment of
+	// the server is not passed on
+	Env map[string]string
+	// Seconds to wait for the program before killing it
+	Timeout int
+
+	// Added to the principals returned by the program
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:            DefaultName,
+	Realm:           DefaultRealm,
+	Timeout:         10,
+	Principals:      []string{},
+	CriticalOptions: map[string]string{},
+	Extensions:      map[string]string{},
+}
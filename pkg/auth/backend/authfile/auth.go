@@ -3,6 +3,9 @@ package authfile
 import (
 	"bytes"
 	"io/ioutil"
+	"os"
+	"sync"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 
@@ -15,12 +18,24 @@ import (
 
 type AuthFile struct {
 	config *Config
-	users  map[string]UserEntry
 	log    *logrus.Entry
+
+	mu    sync.RWMutex
+	users map[string]UserEntry
+	// Users file as of the last reload and the last check for changes
+	modTime time.Time
+	size    int64
+	checked time.Time
 }
 
+// Re-read the users file. The users are replaced all at once and kept as is
+// if the file cannot be parsed
 func (fa *AuthFile) Reload() error {
 	var tmp struct{ Users []UserEntry }
+	fi, err := os.Stat(fa.config.Path)
+	if err != nil {
+		return errors.Wrap(err, "cannot parse users file")
+	}
 	data, err := ioutil.ReadFile(fa.config.Path)
 	if err != nil {
 		return errors.Wrap(err, "cannot parse users file")
@@ -29,13 +44,66 @@ func (fa *AuthFile) Reload() error {
 	if err != nil {
 		return errors.Wrap(err, "cannot parse users file")
 	}
+	users := make(map[string]UserEntry, len(tmp.Users))
 	for _, e := range tmp.Users {
-		fa.users[e.Name] = e
+		if e.MaxLifetime != "" {
+			if v, err := time.ParseDuration(e.MaxLifetime); err != nil || v <= 0 {
+				return errors.Errorf("invalid maxLifetime %q for user %s", e.MaxLifetime, e.Name)
+			}
+		}
+		users[e.Name] = e
 	}
-	fa.log.WithField("count_users", len(fa.users)).Info("reloaded users")
+	fa.mu.Lock()
+	fa.users = users
+	fa.modTime = fi.ModTime()
+	fa.size = fi.Size()
+	fa.mu.Unlock()
+	fa.log.WithField("count_users", len(users)).Info("reloaded users")
 	return nil
 }
 
+// Reload the users file if it has changed since the last reload, checking
+// at most once in ReloadInterval
+func (fa *AuthFile) reloadIfChanged() {
+	interval := time.Duration(fa.config.ReloadInterval) * time.Second
+	if interval <= 0 {
+		return
+	}
+	fa.mu.Lock()
+	if time.Since(fa.checked) < interval {
+		fa.mu.Unlock()
+		return
+	}
+	fa.checked = time.Now()
+	modTime, size := fa.modTime, fa.size
+	fa.mu.Unlock()
+
+	fi, err := os.Stat(fa.config.Path)
+	if err != nil {
+		fa.log.WithError(err).Warn("cannot check users file for changes")
+		return
+	}
+	if fi.ModTime().Equal(modTime) && fi.Size() == size {
+		return
+	}
+	if err := fa.Reload(); err != nil {
+		fa.log.WithError(err).Error("users file reload failed, keeping the previous users")
+		// Do not retry until the file changes again
+		fa.mu.Lock()
+		fa.modTime = fi.ModTime()
+		fa.size = fi.Size()
+		fa.mu.Unlock()
+	}
+}
+
+func (fa *AuthFile) lookup(name string) (UserEntry, bool) {
+	fa.reloadIfChanged()
+	fa.mu.RLock()
+	defer fa.mu.RUnlock()
+	entry, ok := fa.users[name]
+	return entry, ok
+}
+
 func (fa *AuthFile) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
 	if creds == nil {
 		return nil, false
@@ -46,20 +114,28 @@ func (fa *AuthFile) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials
 		log = log.WithField(auth.MetaAuditID, v)
 	}
 
-	entry, ok := fa.users[creds.UserIdentifier]
+	entry, ok := fa.lookup(creds.UserIdentifier)
 	if !ok {
 		log.WithField("user", creds.UserIdentifier).Info("user not found")
 		return nil, false
 	}
 
-	if n, _ := bcrypt.Cost([]byte(entry.Password)); n > 0 {
+	switch hashScheme(entry.Password) {
+	case HashBcrypt:
 		log.WithField("user", creds.UserIdentifier).Debug("brypt auth")
 		if err := bcrypt.CompareHashAndPassword([]byte(entry.Password), []byte(creds.Secret)); err != nil {
 			log.WithField("user", creds.UserIdentifier).Debug("brypt auth fail")
 			return nil, false
 		}
 		log.WithField("user", creds.UserIdentifier).Debug("brypt auth successful")
-	} else {
+	case HashArgon2id:
+		log.WithField("user", creds.UserIdentifier).Debug("argon2id auth")
+		if err := compareArgon2id(entry.Password, creds.Secret); err != nil {
+			log.WithError(err).WithField("user", creds.UserIdentifier).Debug("argon2id auth fail")
+			return nil, false
+		}
+		log.WithField("user", creds.UserIdentifier).Debug("argon2id auth successful")
+	default:
 		log.WithField("user", creds.UserIdentifier).Warn("plain password auth")
 		if !bytes.Equal([]byte(entry.Password), creds.Secret) {
 			log.WithField("user", creds.UserIdentifier).Warn("plain password auth fail")
@@ -67,6 +143,19 @@ func (fa *AuthFile) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials
 		}
 		log.WithField("user", creds.UserIdentifier).Debug("plain password auth successful")
 	}
+	meta := creds.Meta
+	if len(entry.Groups) > 0 || entry.MaxLifetime != "" {
+		meta = make(map[string]interface{}, len(creds.Meta)+2)
+		for k, v := range creds.Meta {
+			meta[k] = v
+		}
+		if len(entry.Groups) > 0 {
+			meta[auth.MetaGroups] = entry.Groups
+		}
+		if entry.MaxLifetime != "" {
+			meta[auth.MetaMaxLifetime] = entry.MaxLifetime
+		}
+	}
 	return &auth.AuthContext{
 		Status:          auth.StatusCompleted,
 		Parent:          pctx,
@@ -75,7 +164,7 @@ func (fa *AuthFile) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials
 		CriticalOptions: entry.CriticalOptions,
 		Extensions:      entry.Extensions,
 		Authenticator:   fa.Name(),
-		AuthMeta:        creds.Meta,
+		AuthMeta:        meta,
 	}, true
 }
 
@@ -114,6 +203,11 @@ type UserEntry struct {
 	Name            string
 	Password        string
 	Principals      []string
+	// Groups are not principals by themselves but can be mapped to
+	// principals with the principal mapping rules
+	Groups          []string
 	CriticalOptions map[string]string
 	Extensions      map[string]string
+	// Maximum lifetime of the certificates of the user, e.g. 8h
+	MaxLifetime string `yaml:"maxLifetime"`
 }
@@ -5,7 +5,9 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/aakso/ssh-inscribe/pkg/auth"
@@ -63,6 +65,10 @@ users:
   password: $2a$11$aaTtm52uHC5dzqf1CEMzqOQ9Fj1sM5QzliEwmqmcON5XnuCnVUWMi # foo
   principals:
   - p1
+- name: user3
+  password: $argon2id$v=19$m=65536,t=3,p=4$nNqvXFJwe0FxDsWbpwiy8g$/Ao+hJzPyippZi5UMjkgp/PjlxGkHRQQico5w95P4NI # foo
+  principals:
+  - p1
 `
 	loc := makeFile(data, "yaml")
 	auth, err := New(&Config{
@@ -104,3 +110,101 @@ func TestAuthUnknownUser(t *testing.T) {
 	_, ok := testAuth.Authenticate(nil, &auth.Credentials{UserIdentifier: "nonexistent", Secret: []byte("notcorrect")})
 	assert.False(ok)
 }
+
+func TestAuthArgon2idSuccess(t *testing.T) {
+	assert := assert.New(t)
+	ctx, ok := testAuth.Authenticate(nil, &auth.Credentials{UserIdentifier: "user3", Secret: []byte("foo")})
+	if assert.True(ok) {
+		assert.Equal("user3", ctx.GetSubjectName())
+	}
+}
+
+func TestAuthArgon2idFail(t *testing.T) {
+	assert := assert.New(t)
+	_, ok := testAuth.Authenticate(nil, &auth.Credentials{UserIdentifier: "user3", Secret: []byte("notcorrect")})
+	assert.False(ok)
+}
+
+func TestHashPassword(t *testing.T) {
+	assert := assert.New(t)
+	for _, alg := range []string{HashBcrypt, HashArgon2id} {
+		hash, err := HashPassword([]byte("foo"), alg)
+		assert.NoError(err)
+		assert.Equal(alg, hashScheme(hash))
+	}
+	hash, err := HashPassword([]byte("foo"), HashArgon2id)
+	assert.NoError(err)
+	assert.NoError(compareArgon2id(hash, []byte("foo")))
+	assert.Error(compareArgon2id(hash, []byte("bar")))
+	for _, params := range []string{"m=65536,t=0,p=4", "m=65536,t=3,p=0"} {
+		invalid := strings.Replace(hash, "m=65536,t=3,p=4", params, 1)
+		assert.EqualError(compareArgon2id(invalid, []byte("foo")), "invalid argon2id parameters")
+	}
+	_, err = HashPassword([]byte("foo"), "md5")
+	assert.Error(err)
+}
+
+func TestAuthReload(t *testing.T) {
+	assert := assert.New(t)
+	loc := makeFile(`
+users:
+- name: user1
+  password: foo
+`, "yaml")
+	fa, err := New(&Config{
+		Path:           loc,
+		Realm:          "test",
+		ReloadInterval: 1,
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	reload := func(data string) {
+		assert.NoError(ioutil.WriteFile(loc, []byte(data), 0600))
+		later := time.Now().Add(time.Minute)
+		assert.NoError(os.Chtimes(loc, later, later))
+		fa.checked = time.Time{}
+	}
+
+	reload(`
+users:
+- name: user2
+  password: bar
+`)
+	_, ok := fa.Authenticate(nil, &auth.Credentials{UserIdentifier: "user2", Secret: []byte("bar")})
+	assert.True(ok)
+	_, ok = fa.Authenticate(nil, &auth.Credentials{UserIdentifier: "user1", Secret: []byte("foo")})
+	assert.False(ok, "removed user")
+
+	// Invalid file keeps the previous users
+	reload("users: [")
+	_, ok = fa.Authenticate(nil, &auth.Credentials{UserIdentifier: "user2", Secret: []byte("bar")})
+	assert.True(ok)
+}
+
+func TestAuthMaxLifetime(t *testing.T) {
+	assert := assert.New(t)
+	loc := makeFile(`
+users:
+- name: user1
+  password: foo
+  maxLifetime: 8h
+  principals:
+  - p1
+`, "yaml")
+	fa, err := New(&Config{Path: loc, Realm: "test"})
+	if !assert.NoError(err) {
+		return
+	}
+	actx, ok := fa.Authenticate(nil, &auth.Credentials{UserIdentifier: "user1", Secret: []byte("foo")})
+	if assert.True(ok) {
+		assert.Equal(8*time.Hour, actx.GetMaxLifetime())
+		assert.Equal([]string{"p1"}, actx.GetPrincipals())
+	}
+	// The shortest lifetime in the chain applies
+	child := &auth.AuthContext{Parent: actx, AuthMeta: map[string]interface{}{auth.MetaMaxLifetime: "1h"}}
+	assert.Equal(time.Hour, child.GetMaxLifetime())
+
+	_, err = New(&Config{Path: makeFile("users: [{name: user1, maxLifetime: forever}]", "yaml"), Realm: "test"})
+	assert.Error(err)
+}
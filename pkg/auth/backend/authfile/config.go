@@ -10,10 +10,15 @@ type Config struct {
 	Name  string
 	Realm string
 	Path  string
+	// Seconds between checks for changes to the users file. Zero disables
+	// reloading, which then needs a restart or a configuration reload
+	ReloadInterval int `yaml:"reloadInterval"`
 }
 
 var Defaults *Config = &Config{
 	Name:  DefaultName,
 	Realm: DefaultRealm,
 	Path:  path.Join(globals.ConfDir(), "auth_users.yaml"),
+
+	ReloadInterval: 5,
 }
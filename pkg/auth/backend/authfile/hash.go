@@ -0,0 +1,93 @@
+package authfile
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+
+	// Argon2id parameters for new hashes, as recommended in RFC 9106 for
+	// memory constrained environments
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+var b64 = base64.RawStdEncoding
+
+// Hash the password for a user entry with bcrypt or argon2id
+func HashPassword(password []byte, algorithm string) (string, error) {
+	switch algorithm {
+	case HashBcrypt:
+		hash, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+		return string(hash), err
+	case HashArgon2id:
+		salt := util.RandBytes(argon2SaltLen)
+		key := argon2.IDKey(password, salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+	}
+	return "", errors.Errorf("unsupported hash algorithm: %s", algorithm)
+}
+
+// Scheme of the stored password, plain for anything not recognized
+func hashScheme(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return HashArgon2id
+	case strings.HasPrefix(hash, "$2"):
+		if n, _ := bcrypt.Cost([]byte(hash)); n > 0 {
+			return HashBcrypt
+		}
+	}
+	return "plain"
+}
+
+func compareArgon2id(hash string, password []byte) error {
+	// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return errors.New("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return errors.New("unsupported argon2id version")
+	}
+	var (
+		memory, time uint32
+		threads      uint8
+	)
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return errors.Wrap(err, "invalid argon2id parameters")
+	}
+	// argon2.IDKey panics on these
+	if time == 0 || threads == 0 {
+		return errors.New("invalid argon2id parameters")
+	}
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return errors.Wrap(err, "invalid argon2id salt")
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return errors.New("invalid argon2id key")
+	}
+	derived := argon2.IDKey(password, salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(derived, key) != 1 {
+		return errors.New("password mismatch")
+	}
+	return nil
+}
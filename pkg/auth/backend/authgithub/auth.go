@@ -0,0 +1,241 @@
+package authgithub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth/backend/authoauth2"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Limit for a single API response
+	maxResponseSize = 1 << 20
+	// Limit for the pages of a list
+	maxPages = 10
+)
+
+var linkNext = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+type teamData struct {
+	Org  string
+	Team string
+}
+
+// AuthGitHub is an OAuth2 login with GitHub. The organizations and teams of
+// the user decide who can log in and with which principals
+type AuthGitHub struct {
+	*authoauth2.AuthOAuth2
+	config  *Config
+	apiURL  string
+	teamTpl *template.Template
+	// Organizations whose teams are accepted, lower case
+	orgs map[string]bool
+}
+
+type githubUser struct {
+	Login string `json:"login"`
+	Name  string `json:"name"`
+}
+
+type githubOrg struct {
+	Login string `json:"login"`
+}
+
+type githubTeam struct {
+	Slug         string    `json:"slug"`
+	Organization githubOrg `json:"organization"`
+}
+
+// GET a JSON list following the pagination links
+func getList(ctx context.Context, client *http.Client, u string, page func(*json.Decoder) error) error {
+	for i := 0; u != "" && i < maxPages; i++ {
+		next, err := getJSON(ctx, client, u, page)
+		if err != nil {
+			return err
+		}
+		u = next
+	}
+	return nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, u string, decode func(*json.Decoder) error) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("%s returned %s", u, resp.Status)
+	}
+	if err := decode(json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize))); err != nil {
+		return "", errors.Wrapf(err, "invalid response from %s", u)
+	}
+	var next string
+	if m := linkNext.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+		next = m[1]
+	}
+	return next, nil
+}
+
+// Fetch the user with the organizations and teams and check the membership.
+// The login is the subject, the principals and groups are computed here
+func (ag *AuthGitHub) userInfo(ctx context.Context, client *http.Client) (map[string]interface{}, error) {
+	var user githubUser
+	if _, err := getJSON(ctx, client, ag.apiURL+"/user", func(d *json.Decoder) error { return d.Decode(&user) }); err != nil {
+		return nil, err
+	}
+	if user.Login == "" {
+		return nil, errors.New("no login in the user response")
+	}
+	var orgs []githubOrg
+	err := getList(ctx, client, ag.apiURL+"/user/orgs?per_page=100", func(d *json.Decoder) error {
+		var page []githubOrg
+		err := d.Decode(&page)
+		orgs = append(orgs, page...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var teams []githubTeam
+	err = getList(ctx, client, ag.apiURL+"/user/teams?per_page=100", func(d *json.Decoder) error {
+		var page []githubTeam
+		err := d.Decode(&page)
+		teams = append(teams, page...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := false
+	var groups, principals []interface{}
+	if ag.config.LoginPrincipal {
+		principals = append(principals, user.Login)
+	}
+	for _, o := range orgs {
+		if ag.orgs[strings.ToLower(o.Login)] {
+			allowed = allowed || containsFold(ag.config.Organizations, o.Login)
+			groups = append(groups, o.Login)
+		}
+	}
+	for _, t := range teams {
+		org := t.Organization.Login
+		if !ag.orgs[strings.ToLower(org)] {
+			continue
+		}
+		name := org + "/" + t.Slug
+		allowed = allowed || containsFold(ag.config.Teams, name)
+		groups = append(groups, name)
+		if ag.teamTpl != nil {
+			var buf bytes.Buffer
+			if err := ag.teamTpl.Execute(&buf, teamData{Org: org, Team: t.Slug}); err != nil {
+				return nil, errors.Wrap(err, "cannot render team principal")
+			}
+			if buf.Len() > 0 {
+				principals = append(principals, buf.String())
+			}
+		}
+	}
+	if !allowed {
+		return nil, errors.Errorf("%s is not a member of the allowed organizations or teams", user.Login)
+	}
+	return map[string]interface{}{
+		"login":      user.Login,
+		"name":       user.Name,
+		"principals": principals,
+		"groups":     groups,
+	}, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ag *AuthGitHub) Type() string {
+	return Type
+}
+
+func New(config *Config) (*AuthGitHub, error) {
+	if config.ClientId == "" || config.ClientSecret == "" ||
+		(len(config.Organizations) == 0 && len(config.Teams) == 0) {
+		return nil, errors.Errorf("%s: required config items: clientID, clientSecret, organizations or teams", config.Name)
+	}
+	base := strings.TrimSuffix(config.URL, "/")
+	apiURL := strings.TrimSuffix(config.APIURL, "/")
+	if apiURL == "" {
+		apiURL = "https://api.github.com"
+		if base != "https://github.com" {
+			apiURL = base + "/api/v3"
+		}
+	}
+	ag := &AuthGitHub{
+		config: config,
+		apiURL: apiURL,
+		orgs:   map[string]bool{},
+	}
+	for _, o := range config.Organizations {
+		ag.orgs[strings.ToLower(o)] = true
+	}
+	for _, t := range config.Teams {
+		parts := strings.SplitN(t, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("%s: team %q is not in the org/team format", config.Name, t)
+		}
+		ag.orgs[strings.ToLower(parts[0])] = true
+	}
+	if config.TeamPrincipalTemplate != "" {
+		tpl, err := template.New("team").Parse(config.TeamPrincipalTemplate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: cannot parse teamPrincipalTemplate", config.Name)
+		}
+		ag.teamTpl = tpl
+	}
+
+	oauthConfig := &authoauth2.Config{
+		Name:                   config.Name,
+		Realm:                  config.Realm,
+		Timeout:                config.Timeout,
+		ClientId:               config.ClientId,
+		ClientSecret:           config.ClientSecret,
+		Scopes:                 []string{"read:user", "read:org"},
+		AuthFlowTimeout:        config.AuthFlowTimeout,
+		MaxPendingAuthAttempts: config.MaxPendingAuthAttempts,
+		RedirectURL:            config.RedirectURL,
+		AuthURL:                base + "/login/oauth/authorize",
+		TokenURL:               base + "/login/oauth/access_token",
+		UserInfoURL:            apiURL + "/user",
+		ValueMappings: authoauth2.UserInfoMapping{
+			SubjectNameField:    "login",
+			SubjectNameTemplate: "{{.}}",
+			PrincipalsField:     "principals",
+			PrincipalTemplate:   "{{.}}",
+			GroupsField:         "groups",
+		},
+		Principals:      config.Principals,
+		CriticalOptions: config.CriticalOptions,
+		Extensions:      config.Extensions,
+	}
+	var err error
+	if ag.AuthOAuth2, err = authoauth2.NewWithUserInfo(oauthConfig, ag.userInfo); err != nil {
+		return nil, err
+	}
+	return ag, nil
+}
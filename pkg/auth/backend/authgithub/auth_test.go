@@ -0,0 +1,152 @@
+package authgithub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func serverProvider() *httptest.Server {
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		out, _ := json.Marshal(v)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	}
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		token := map[string]string{"the code": "token", "other code": "other"}[r.Form.Get("code")]
+		if token == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "bad_verification_code"})
+			return
+		}
+		writeJSON(w, map[string]interface{}{"access_token": token, "token_type": "bearer"})
+	})
+	user := func(r *http.Request) string {
+		return map[string]string{"Bearer token": "jdoe", "Bearer other": "mallory"}[r.Header.Get("Authorization")]
+	}
+	authorized := func(h func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			login := user(r)
+			if login == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			h(w, r, login)
+		}
+	}
+	mux.HandleFunc("/api/v3/user", authorized(func(w http.ResponseWriter, r *http.Request, login string) {
+		writeJSON(w, map[string]interface{}{"login": login, "name": "John Doe"})
+	}))
+	mux.HandleFunc("/api/v3/user/orgs", authorized(func(w http.ResponseWriter, r *http.Request, login string) {
+		if login != "jdoe" {
+			writeJSON(w, []interface{}{map[string]interface{}{"login": "evil"}})
+			return
+		}
+		// Two pages
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", `<http://`+r.Host+`/api/v3/user/orgs?per_page=100&page=2>; rel="next", <http://`+r.Host+`/api/v3/user/orgs?per_page=100&page=2>; rel="last"`)
+			writeJSON(w, []interface{}{map[string]interface{}{"login": "other"}})
+			return
+		}
+		writeJSON(w, []interface{}{map[string]interface{}{"login": "Acme"}})
+	}))
+	mux.HandleFunc("/api/v3/user/teams", authorized(func(w http.ResponseWriter, r *http.Request, login string) {
+		if login != "jdoe" {
+			writeJSON(w, []interface{}{map[string]interface{}{"slug": "admins", "organization": map[string]interface{}{"login": "evil"}}})
+			return
+		}
+		writeJSON(w, []interface{}{
+			map[string]interface{}{"slug": "admins", "organization": map[string]interface{}{"login": "acme"}},
+			map[string]interface{}{"slug": "ops", "organization": map[string]interface{}{"login": "acme"}},
+			map[string]interface{}{"slug": "root", "organization": map[string]interface{}{"login": "other"}},
+		})
+	}))
+	return httptest.NewServer(mux)
+}
+
+func getAuthenticator(t *testing.T, srvURL string) *AuthGitHub {
+	conf := *Defaults
+	conf.ClientId = "clientid"
+	conf.ClientSecret = "clientsecret"
+	conf.RedirectURL = "https://localhost:12900/v1/auth_callback/github"
+	conf.URL = srvURL
+	conf.Organizations = []string{"acme"}
+	conf.TeamPrincipalTemplate = "{{.Org}}-{{.Team}}"
+	ag, err := New(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ag
+}
+
+func login(t *testing.T, ag *AuthGitHub, code string) (*auth.AuthContext, error) {
+	actx, ok := ag.Authenticate(nil, &auth.Credentials{})
+	if !ok {
+		t.Fatal("cannot start flow")
+	}
+	u, _ := url.Parse(actx.GetMetaString(auth.MetaFederationAuthURL))
+	if err := ag.FederationCallback(url.Values{"state": {u.Query().Get("state")}, "code": {code}}); err != nil {
+		return nil, err
+	}
+	actx, ok = ag.Authenticate(actx, &auth.Credentials{})
+	if !ok {
+		t.Fatal("cannot complete flow")
+	}
+	return actx, nil
+}
+
+func TestNew(t *testing.T) {
+	conf := *Defaults
+	conf.ClientId = "clientid"
+	conf.ClientSecret = "clientsecret"
+	_, err := New(&conf)
+	assert.Error(t, err, "organizations or teams required")
+	conf.Teams = []string{"acme"}
+	_, err = New(&conf)
+	assert.Error(t, err, "invalid team")
+	conf.Teams = []string{"acme/ops"}
+	ag, err := New(&conf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Type, ag.Type())
+		assert.Equal(t, auth.CredentialFederated, ag.CredentialType())
+		assert.Equal(t, "https://api.github.com", ag.apiURL)
+		actx, _ := ag.Authenticate(nil, &auth.Credentials{})
+		u, _ := url.Parse(actx.GetMetaString(auth.MetaFederationAuthURL))
+		assert.Equal(t, "github.com", u.Host)
+		assert.Equal(t, "read:user read:org", u.Query().Get("scope"))
+	}
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	srv := serverProvider()
+	defer srv.Close()
+	ag := getAuthenticator(t, srv.URL)
+
+	actx, err := login(t, ag, "the code")
+	if assert.NoError(err) {
+		assert.Equal(auth.StatusCompleted, actx.Status)
+		assert.Equal("jdoe", actx.GetSubjectName())
+		// Teams of other organizations are ignored
+		assert.Equal([]string{"jdoe", "acme-admins", "acme-ops"}, actx.GetPrincipals())
+		assert.Equal([]string{"Acme", "acme/admins", "acme/ops"}, actx.GetGroups())
+	}
+	_, err = login(t, ag, "other code")
+	assert.Error(err, "not a member")
+
+	// Team membership
+	ag.config.Organizations = nil
+	ag.config.Teams = []string{"acme/ops"}
+	_, err = login(t, ag, "the code")
+	assert.NoError(err)
+	ag.config.Teams = []string{"acme/devs"}
+	_, err = login(t, ag, "the code")
+	assert.Error(err)
+}
@@ -0,0 +1,43 @@
+package authgithub
+
+type Config struct {
+	Name  string
+	Realm string
+
+	ClientId     string `yaml:"clientID"`
+	ClientSecret string `yaml:"clientSecret"`
+	RedirectURL  string `yaml:"redirectURL"`
+	// GitHub Enterprise Server URL, e.g. https://github.example.com
+	URL string
+	// API URL, defaults to https://api.github.com or <url>/api/v3
+	APIURL string `yaml:"apiURL"`
+
+	// Members of any of these organizations are allowed
+	Organizations []string
+	// Members of any of these teams are allowed, as org/team-slug
+	Teams []string
+	// Principal for each team of the user in the allowed organizations,
+	// with {{.Org}} and {{.Team}}. Empty disables team principals
+	TeamPrincipalTemplate string `yaml:"teamPrincipalTemplate"`
+	// Add the GitHub login as a principal
+	LoginPrincipal bool `yaml:"loginPrincipal"`
+
+	Timeout                int `yaml:"timeout"`
+	AuthFlowTimeout        int `yaml:"authFlowTimeout"`
+	MaxPendingAuthAttempts int `yaml:"maxPendingAuthAttempts"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:                   DefaultName,
+	Realm:                  DefaultRealm,
+	URL:                    "https://github.com",
+	TeamPrincipalTemplate:  "{{.Team}}",
+	LoginPrincipal:         true,
+	Timeout:                15,
+	AuthFlowTimeout:        240,
+	MaxPendingAuthAttempts: 1000,
+}
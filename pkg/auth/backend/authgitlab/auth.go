@@ -0,0 +1,233 @@
+package authgitlab
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth/backend/authoauth2"
+	"github.com/pkg/errors"
+)
+
+const (
+	// Limit for a single API response
+	maxResponseSize = 1 << 20
+	// Limit for the pages of a list
+	maxPages = 10
+)
+
+var linkNext = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// GitLab access levels in ascending order
+var accessLevels = []struct {
+	Name  string
+	Value int
+}{
+	{"guest", 10},
+	{"reporter", 20},
+	{"developer", 30},
+	{"maintainer", 40},
+	{"owner", 50},
+}
+
+type groupData struct {
+	Group       string
+	Name        string
+	AccessLevel string
+}
+
+// AuthGitLab is an OAuth2 login with GitLab. The group memberships of the
+// user decide who can log in and with which principals
+type AuthGitLab struct {
+	*authoauth2.AuthOAuth2
+	config   *Config
+	apiURL   string
+	minLevel int
+	groupTpl *template.Template
+}
+
+type gitlabUser struct {
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+type gitlabGroup struct {
+	FullPath string `json:"full_path"`
+	Path     string `json:"path"`
+}
+
+func getList(ctx context.Context, client *http.Client, u string, page func(*json.Decoder) error) error {
+	for i := 0; u != "" && i < maxPages; i++ {
+		next, err := getJSON(ctx, client, u, page)
+		if err != nil {
+			return err
+		}
+		u = next
+	}
+	return nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, u string, decode func(*json.Decoder) error) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("%s returned %s", u, resp.Status)
+	}
+	if err := decode(json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize))); err != nil {
+		return "", errors.Wrapf(err, "invalid response from %s", u)
+	}
+	var next string
+	if m := linkNext.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+		next = m[1]
+	}
+	return next, nil
+}
+
+// Whether the group is one of the configured groups or below one
+func (ag *AuthGitLab) inGroups(path string) bool {
+	for _, g := range ag.config.Groups {
+		if strings.EqualFold(path, g) || strings.HasPrefix(strings.ToLower(path), strings.ToLower(g)+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch the user and the group memberships and check them. The groups API
+// does not return the access level so the groups are listed once per level,
+// the highest level listing a group is the access level of the user
+func (ag *AuthGitLab) userInfo(ctx context.Context, client *http.Client) (map[string]interface{}, error) {
+	var user gitlabUser
+	if _, err := getJSON(ctx, client, ag.apiURL+"/user", func(d *json.Decoder) error { return d.Decode(&user) }); err != nil {
+		return nil, err
+	}
+	if user.Username == "" {
+		return nil, errors.New("no username in the user response")
+	}
+	levels := map[string]string{}
+	var groups []gitlabGroup
+	for _, level := range accessLevels {
+		if level.Value < ag.minLevel {
+			continue
+		}
+		u := fmt.Sprintf("%s/groups?min_access_level=%d&per_page=100", ag.apiURL, level.Value)
+		err := getList(ctx, client, u, func(d *json.Decoder) error {
+			var page []gitlabGroup
+			err := d.Decode(&page)
+			for _, g := range page {
+				if !ag.inGroups(g.FullPath) {
+					continue
+				}
+				if _, found := levels[g.FullPath]; !found {
+					groups = append(groups, g)
+				}
+				levels[g.FullPath] = level.Name
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(groups) == 0 {
+		return nil, errors.Errorf("%s is not a member of the allowed groups", user.Username)
+	}
+
+	var groupNames, principals []interface{}
+	if ag.config.UsernamePrincipal {
+		principals = append(principals, user.Username)
+	}
+	for _, g := range groups {
+		groupNames = append(groupNames, g.FullPath)
+		if ag.groupTpl == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		data := groupData{Group: g.FullPath, Name: g.Path, AccessLevel: levels[g.FullPath]}
+		if err := ag.groupTpl.Execute(&buf, data); err != nil {
+			return nil, errors.Wrap(err, "cannot render group principal")
+		}
+		if buf.Len() > 0 {
+			principals = append(principals, buf.String())
+		}
+	}
+	return map[string]interface{}{
+		"username":   user.Username,
+		"name":       user.Name,
+		"principals": principals,
+		"groups":     groupNames,
+	}, nil
+}
+
+func (ag *AuthGitLab) Type() string {
+	return Type
+}
+
+func New(config *Config) (*AuthGitLab, error) {
+	if config.ClientId == "" || config.ClientSecret == "" || len(config.Groups) == 0 {
+		return nil, errors.Errorf("%s: required config items: clientID, clientSecret, groups", config.Name)
+	}
+	base := strings.TrimSuffix(config.URL, "/")
+	ag := &AuthGitLab{
+		config: config,
+		apiURL: base + "/api/v4",
+	}
+	for _, level := range accessLevels {
+		if strings.EqualFold(level.Name, config.MinAccessLevel) {
+			ag.minLevel = level.Value
+		}
+	}
+	if ag.minLevel == 0 {
+		return nil, errors.Errorf("%s: invalid minAccessLevel %q", config.Name, config.MinAccessLevel)
+	}
+	if config.GroupPrincipalTemplate != "" {
+		tpl, err := template.New("group").Parse(config.GroupPrincipalTemplate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: cannot parse groupPrincipalTemplate", config.Name)
+		}
+		ag.groupTpl = tpl
+	}
+
+	oauthConfig := &authoauth2.Config{
+		Name:                   config.Name,
+		Realm:                  config.Realm,
+		Timeout:                config.Timeout,
+		ClientId:               config.ClientId,
+		ClientSecret:           config.ClientSecret,
+		Scopes:                 []string{"read_api"},
+		AuthFlowTimeout:        config.AuthFlowTimeout,
+		MaxPendingAuthAttempts: config.MaxPendingAuthAttempts,
+		RedirectURL:            config.RedirectURL,
+		AuthURL:                base + "/oauth/authorize",
+		TokenURL:               base + "/oauth/token",
+		UserInfoURL:            ag.apiURL + "/user",
+		ValueMappings: authoauth2.UserInfoMapping{
+			SubjectNameField:    "username",
+			SubjectNameTemplate: "{{.}}",
+			PrincipalsField:     "principals",
+			PrincipalTemplate:   "{{.}}",
+			GroupsField:         "groups",
+		},
+		Principals:      config.Principals,
+		CriticalOptions: config.CriticalOptions,
+		Extensions:      config.Extensions,
+	}
+	var err error
+	if ag.AuthOAuth2, err = authoauth2.NewWithUserInfo(oauthConfig, ag.userInfo); err != nil {
+		return nil, err
+	}
+	return ag, nil
+}
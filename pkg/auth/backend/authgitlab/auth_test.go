@@ -0,0 +1,177 @@
+package authgitlab
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+type membership struct {
+	path  string
+	level int
+}
+
+var memberships = map[string][]membership{
+	"jdoe": {
+		{"acme", 10},
+		{"acme/infra", 40},
+		{"acme/infra/db", 30},
+		{"other", 50},
+	},
+	"mallory": {
+		{"other", 50},
+	},
+}
+
+func serverProvider() *httptest.Server {
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		out, _ := json.Marshal(v)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	}
+	mux.HandleFunc("/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		token := map[string]string{"the code": "token", "other code": "other"}[r.Form.Get("code")]
+		if token == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, map[string]interface{}{"access_token": token, "token_type": "bearer"})
+	})
+	user := func(r *http.Request) string {
+		return map[string]string{"Bearer token": "jdoe", "Bearer other": "mallory"}[r.Header.Get("Authorization")]
+	}
+	mux.HandleFunc("/api/v4/user", func(w http.ResponseWriter, r *http.Request) {
+		login := user(r)
+		if login == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"username": login, "name": "John Doe"})
+	})
+	mux.HandleFunc("/api/v4/groups", func(w http.ResponseWriter, r *http.Request) {
+		login := user(r)
+		if login == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		min, _ := strconv.Atoi(r.URL.Query().Get("min_access_level"))
+		var groups []interface{}
+		for _, m := range memberships[login] {
+			if m.level >= min {
+				groups = append(groups, map[string]interface{}{"full_path": m.path, "path": lastPath(m.path)})
+			}
+		}
+		// One group per page
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page+1 < len(groups) {
+			q := r.URL.Query()
+			q.Set("page", strconv.Itoa(page+1))
+			w.Header().Set("Link", `<http://`+r.Host+r.URL.Path+"?"+q.Encode()+`>; rel="next"`)
+		}
+		if page < len(groups) {
+			groups = groups[page : page+1]
+		} else {
+			groups = []interface{}{}
+		}
+		writeJSON(w, groups)
+	})
+	return httptest.NewServer(mux)
+}
+
+func lastPath(p string) string {
+	return p[strings.LastIndex(p, "/")+1:]
+}
+
+func getAuthenticator(t *testing.T, srvURL string) *AuthGitLab {
+	conf := *Defaults
+	conf.ClientId = "clientid"
+	conf.ClientSecret = "clientsecret"
+	conf.RedirectURL = "https://localhost:12900/v1/auth_callback/gitlab"
+	conf.URL = srvURL
+	conf.Groups = []string{"Acme"}
+	conf.GroupPrincipalTemplate = "{{.Name}}-{{.AccessLevel}}"
+	ag, err := New(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ag
+}
+
+func login(t *testing.T, ag *AuthGitLab, code string) (*auth.AuthContext, error) {
+	actx, ok := ag.Authenticate(nil, &auth.Credentials{})
+	if !ok {
+		t.Fatal("cannot start flow")
+	}
+	u, _ := url.Parse(actx.GetMetaString(auth.MetaFederationAuthURL))
+	if err := ag.FederationCallback(url.Values{"state": {u.Query().Get("state")}, "code": {code}}); err != nil {
+		return nil, err
+	}
+	actx, ok = ag.Authenticate(actx, &auth.Credentials{})
+	if !ok {
+		t.Fatal("cannot complete flow")
+	}
+	return actx, nil
+}
+
+func TestNew(t *testing.T) {
+	conf := *Defaults
+	conf.ClientId = "clientid"
+	conf.ClientSecret = "clientsecret"
+	_, err := New(&conf)
+	assert.Error(t, err, "groups required")
+	conf.Groups = []string{"acme"}
+	conf.MinAccessLevel = "admin"
+	_, err = New(&conf)
+	assert.Error(t, err, "invalid access level")
+	conf.MinAccessLevel = "Developer"
+	ag, err := New(&conf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Type, ag.Type())
+		assert.Equal(t, 30, ag.minLevel)
+		assert.Equal(t, "https://gitlab.com/api/v4", ag.apiURL)
+		actx, _ := ag.Authenticate(nil, &auth.Credentials{})
+		u, _ := url.Parse(actx.GetMetaString(auth.MetaFederationAuthURL))
+		assert.Equal(t, "gitlab.com", u.Host)
+		assert.Equal(t, "/oauth/authorize", u.Path)
+		assert.Equal(t, "read_api", u.Query().Get("scope"))
+	}
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	srv := serverProvider()
+	defer srv.Close()
+	ag := getAuthenticator(t, srv.URL)
+
+	actx, err := login(t, ag, "the code")
+	if assert.NoError(err) {
+		assert.Equal(auth.StatusCompleted, actx.Status)
+		assert.Equal("jdoe", actx.GetSubjectName())
+		// Groups outside the allowed groups are ignored
+		assert.Equal([]string{"jdoe", "acme-guest", "infra-maintainer", "db-developer"}, actx.GetPrincipals())
+		assert.Equal([]string{"acme", "acme/infra", "acme/infra/db"}, actx.GetGroups())
+	}
+	_, err = login(t, ag, "other code")
+	assert.Error(err, "not a member")
+
+	// Memberships below the minimum access level are ignored
+	ag.minLevel = 30
+	actx, err = login(t, ag, "the code")
+	if assert.NoError(err) {
+		assert.Equal([]string{"jdoe", "infra-maintainer", "db-developer"}, actx.GetPrincipals())
+	}
+	ag.config.Groups = []string{"acme/infra/db"}
+	ag.minLevel = 40
+	_, err = login(t, ag, "the code")
+	assert.Error(err)
+}
@@ -0,0 +1,45 @@
+package authgitlab
+
+type Config struct {
+	Name  string
+	Realm string
+
+	ClientId     string `yaml:"clientID"`
+	ClientSecret string `yaml:"clientSecret"`
+	RedirectURL  string `yaml:"redirectURL"`
+	// GitLab URL, e.g. https://gitlab.example.com for self-hosted
+	URL string
+
+	// Members of any of these groups or their subgroups are allowed, as
+	// full paths
+	Groups []string
+	// Lowest access level counted as a membership: guest, reporter,
+	// developer, maintainer or owner
+	MinAccessLevel string `yaml:"minAccessLevel"`
+	// Principal for each group of the user under the allowed groups, with
+	// {{.Group}} (full path), {{.Name}} (last path component) and
+	// {{.AccessLevel}}. Empty disables group principals
+	GroupPrincipalTemplate string `yaml:"groupPrincipalTemplate"`
+	// Add the GitLab username as a principal
+	UsernamePrincipal bool `yaml:"usernamePrincipal"`
+
+	Timeout                int `yaml:"timeout"`
+	AuthFlowTimeout        int `yaml:"authFlowTimeout"`
+	MaxPendingAuthAttempts int `yaml:"maxPendingAuthAttempts"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:                   DefaultName,
+	Realm:                  DefaultRealm,
+	URL:                    "https://gitlab.com",
+	MinAccessLevel:         "guest",
+	GroupPrincipalTemplate: "{{.Group}}",
+	UsernamePrincipal:      true,
+	Timeout:                15,
+	AuthFlowTimeout:        240,
+	MaxPendingAuthAttempts: 1000,
+}
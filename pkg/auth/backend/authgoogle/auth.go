@@ -0,0 +1,158 @@
+package authgoogle
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth/backend/authoidc"
+	"github.com/pkg/errors"
+)
+
+type groupData struct {
+	Group string
+	Name  string
+}
+
+// AuthGoogle is an OpenID Connect login with Google. The Workspace domain
+// and the groups of the user from the Directory API decide who can log in
+// and with which principals
+type AuthGoogle struct {
+	*authoidc.AuthOIDC
+	config    *Config
+	directory *directory
+	groupTpl  *template.Template
+}
+
+// Check the domain and add the principals and groups to the claims
+func (ag *AuthGoogle) amendClaims(ctx context.Context, _ *http.Client, claims map[string]interface{}) (map[string]interface{}, error) {
+	email, _ := claims["email"].(string)
+	if email == "" {
+		return nil, errors.New("no email in the id token")
+	}
+	if verified, _ := claims["email_verified"].(bool); !verified {
+		return nil, errors.Errorf("email of %s is not verified", email)
+	}
+	if len(ag.config.Domains) > 0 {
+		hd, _ := claims["hd"].(string)
+		if !containsFold(ag.config.Domains, hd) {
+			return nil, errors.Errorf("%s is not in the allowed domains", email)
+		}
+	}
+
+	var groups []string
+	if ag.directory != nil {
+		var err error
+		if groups, err = ag.directory.groups(ctx, email); err != nil {
+			return nil, err
+		}
+	}
+	if len(ag.config.Groups) > 0 {
+		allowed := false
+		for _, g := range groups {
+			allowed = allowed || containsFold(ag.config.Groups, g)
+		}
+		if !allowed {
+			return nil, errors.Errorf("%s is not a member of the allowed groups", email)
+		}
+	}
+
+	var groupNames, principals []interface{}
+	if ag.config.UsernamePrincipal {
+		principals = append(principals, localPart(email))
+	}
+	for _, g := range groups {
+		groupNames = append(groupNames, g)
+		if ag.groupTpl == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := ag.groupTpl.Execute(&buf, groupData{Group: g, Name: localPart(g)}); err != nil {
+			return nil, errors.Wrap(err, "cannot render group principal")
+		}
+		if buf.Len() > 0 {
+			principals = append(principals, buf.String())
+		}
+	}
+	claims["principals"] = principals
+	claims["groups"] = groupNames
+	return claims, nil
+}
+
+func localPart(email string) string {
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		return email[:i]
+	}
+	return email
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ag *AuthGoogle) Type() string {
+	return Type
+}
+
+func New(config *Config) (*AuthGoogle, error) {
+	if config.ClientId == "" || config.ClientSecret == "" || len(config.Domains) == 0 {
+		return nil, errors.Errorf("%s: required config items: clientID, clientSecret, domains", config.Name)
+	}
+	// Without a service account the groups are not resolved
+	if (len(config.Groups) > 0 || config.ServiceAccountKeyFile != "" || config.AdminEmail != "") &&
+		(config.ServiceAccountKeyFile == "" || config.AdminEmail == "") {
+		return nil, errors.Errorf("%s: groups require serviceAccountKeyFile and adminEmail", config.Name)
+	}
+	ag := &AuthGoogle{config: config}
+	if config.ServiceAccountKeyFile != "" {
+		client := &http.Client{Timeout: time.Duration(config.Timeout) * time.Second}
+		d, err := newDirectory(config.ServiceAccountKeyFile, config.AdminEmail, config.DirectoryURL, client)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s", config.Name)
+		}
+		ag.directory = d
+	}
+	if config.GroupPrincipalTemplate != "" {
+		tpl, err := template.New("group").Parse(config.GroupPrincipalTemplate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: cannot parse groupPrincipalTemplate", config.Name)
+		}
+		ag.groupTpl = tpl
+	}
+
+	oidcConfig := &authoidc.Config{
+		Name:                   config.Name,
+		Realm:                  config.Realm,
+		Timeout:                config.Timeout,
+		ClientId:               config.ClientId,
+		ClientSecret:           config.ClientSecret,
+		Scopes:                 []string{"openid", "email", "profile"},
+		AuthFlowTimeout:        config.AuthFlowTimeout,
+		MaxPendingAuthAttempts: config.MaxPendingAuthAttempts,
+		RedirectURL:            config.RedirectURL,
+		ProviderURL:            config.ProviderURL,
+		ValueMappings: authoidc.TokenValueMapping{
+			SubjectNameField:    "email",
+			SubjectNameTemplate: "{{.}}",
+			PrincipalsField:     "principals",
+			PrincipalTemplate:   "{{.}}",
+			GroupsField:         "groups",
+		},
+		Principals:      config.Principals,
+		CriticalOptions: config.CriticalOptions,
+		Extensions:      config.Extensions,
+	}
+	var err error
+	if ag.AuthOIDC, err = authoidc.NewWithClaims(oidcConfig, ag.amendClaims); err != nil {
+		return nil, err
+	}
+	return ag, nil
+}
@@ -0,0 +1,258 @@
+package authgoogle
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	idpKey     *rsa.PrivateKey
+	accountKey *rsa.PrivateKey
+	srv        *httptest.Server
+	tokenCalls int
+	// ID token claims returned for each code
+	users = map[string]map[string]interface{}{
+		"the code":     {"email": "jdoe@example.com", "email_verified": true, "hd": "example.com"},
+		"other domain": {"email": "jdoe@example.org", "email_verified": true, "hd": "example.org"},
+		"unverified":   {"email": "mallory@example.com", "email_verified": false, "hd": "example.com"},
+		"no groups":    {"email": "nobody@example.com", "email_verified": true, "hd": "example.com"},
+	}
+	memberships = map[string][]string{
+		"jdoe@example.com": {"admins@example.com", "ops@example.com", "all@example.com"},
+	}
+)
+
+func serverProvider() *httptest.Server {
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, status int, v interface{}) {
+		out, _ := json.Marshal(v)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(out)
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                 srv.URL,
+			"jwks_uri":               srv.URL + "/certs",
+			"authorization_endpoint": srv.URL + "/auth",
+			"token_endpoint":         srv.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/certs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+			{Key: &idpKey.PublicKey, KeyID: "idp", Use: "sig"},
+		}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		claims, ok := users[r.Form.Get("code")]
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		c := jwt.MapClaims{"iss": srv.URL, "aud": "clientid", "exp": time.Now().Add(time.Hour).Unix()}
+		for k, v := range claims {
+			c[k] = v
+		}
+		ss, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, c).SignedString(idpKey)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id_token":     ss,
+			"token_type":   "Bearer",
+			"access_token": "token",
+		})
+	})
+	// Service account token endpoint
+	mux.HandleFunc("/sa/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		tokenCalls++
+		token, err := jwt.Parse(r.Form.Get("assertion"), func(*jwt.Token) (interface{}, error) {
+			return &accountKey.PublicKey, nil
+		})
+		if err != nil || r.Form.Get("grant_type") != jwtBearerGrant {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "bad assertion"})
+			return
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		if claims["sub"] != "admin@example.com" || claims["scope"] != directoryScope ||
+			claims["iss"] != "sa@project.iam.gserviceaccount.com" || token.Header["kid"] != "keyid" {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized_client"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"access_token": "directory token", "expires_in": 3600})
+	})
+	mux.HandleFunc("/admin/directory/v1/groups", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer directory token" {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{})
+			return
+		}
+		// One group per page
+		groups := memberships[r.URL.Query().Get("userKey")]
+		resp := map[string]interface{}{"kind": "admin#directory#groups"}
+		i := 0
+		if p := r.URL.Query().Get("pageToken"); p != "" {
+			i = int(p[0] - '0')
+		}
+		if i < len(groups) {
+			resp["groups"] = []interface{}{map[string]string{"email": groups[i]}}
+		}
+		if i+1 < len(groups) {
+			resp["nextPageToken"] = string(rune('0' + i + 1))
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+	return httptest.NewServer(mux)
+}
+
+func writeAccountKey(t *testing.T, dir string) string {
+	der, _ := x509.MarshalPKCS8PrivateKey(accountKey)
+	key := map[string]string{
+		"type":           "service_account",
+		"client_email":   "sa@project.iam.gserviceaccount.com",
+		"private_key_id": "keyid",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      srv.URL + "/sa/token",
+	}
+	out, _ := json.Marshal(key)
+	p := filepath.Join(dir, "key.json")
+	if err := ioutil.WriteFile(p, out, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func getConfig(t *testing.T, dir string) *Config {
+	conf := *Defaults
+	conf.ClientId = "clientid"
+	conf.ClientSecret = "clientsecret"
+	conf.RedirectURL = "https://localhost:12900/v1/auth_callback/google"
+	conf.ProviderURL = srv.URL
+	conf.DirectoryURL = srv.URL
+	conf.Domains = []string{"example.com"}
+	conf.Groups = []string{"admins@example.com", "ops@example.com"}
+	conf.ServiceAccountKeyFile = writeAccountKey(t, dir)
+	conf.AdminEmail = "admin@example.com"
+	return &conf
+}
+
+func login(t *testing.T, ag *AuthGoogle, code string) (*auth.AuthContext, error) {
+	actx, ok := ag.Authenticate(nil, &auth.Credentials{})
+	if !ok {
+		t.Fatal("cannot start flow")
+	}
+	u, _ := url.Parse(actx.GetMetaString(auth.MetaFederationAuthURL))
+	if err := ag.FederationCallback(url.Values{"state": {u.Query().Get("state")}, "code": {code}}); err != nil {
+		return nil, err
+	}
+	actx, ok = ag.Authenticate(actx, &auth.Credentials{})
+	if !ok {
+		t.Fatal("cannot complete flow")
+	}
+	return actx, nil
+}
+
+func TestMain(m *testing.M) {
+	var err error
+	if idpKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	if accountKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	srv = serverProvider()
+	r := m.Run()
+	srv.Close()
+	os.Exit(r)
+}
+
+func TestNew(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "authgoogle")
+	defer os.RemoveAll(dir)
+	conf := getConfig(t, dir)
+	conf.Domains = nil
+	_, err := New(conf)
+	assert.Error(t, err, "domains required")
+
+	conf = getConfig(t, dir)
+	conf.AdminEmail = ""
+	_, err = New(conf)
+	assert.Error(t, err, "groups require the admin")
+
+	conf = getConfig(t, dir)
+	conf.ServiceAccountKeyFile = filepath.Join(dir, "nonexistent")
+	_, err = New(conf)
+	assert.Error(t, err, "missing key file")
+
+	// Domain only
+	conf = getConfig(t, dir)
+	conf.Groups = nil
+	conf.ServiceAccountKeyFile = ""
+	conf.AdminEmail = ""
+	ag, err := New(conf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, Type, ag.Type())
+		assert.Nil(t, ag.directory)
+		actx, err := login(t, ag, "the code")
+		if assert.NoError(t, err) {
+			assert.Equal(t, "jdoe@example.com", actx.GetSubjectName())
+			assert.Equal(t, []string{"jdoe"}, actx.GetPrincipals())
+		}
+		_, err = login(t, ag, "other domain")
+		assert.Error(t, err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "authgoogle")
+	defer os.RemoveAll(dir)
+	conf := getConfig(t, dir)
+	conf.GroupPrincipalTemplate = "g-{{.Name}}"
+	ag, err := New(conf)
+	if !assert.NoError(err) {
+		return
+	}
+
+	tokenCalls = 0
+	actx, err := login(t, ag, "the code")
+	if assert.NoError(err) {
+		assert.Equal(auth.StatusCompleted, actx.Status)
+		assert.Equal("jdoe@example.com", actx.GetSubjectName())
+		assert.Equal([]string{"jdoe", "g-admins", "g-ops", "g-all"}, actx.GetPrincipals())
+		assert.Equal([]string{"admins@example.com", "ops@example.com", "all@example.com"}, actx.GetGroups())
+	}
+	// The directory token is cached
+	_, err = login(t, ag, "the code")
+	assert.NoError(err)
+	assert.Equal(1, tokenCalls)
+
+	_, err = login(t, ag, "other domain")
+	assert.Error(err, "wrong domain")
+	_, err = login(t, ag, "unverified")
+	assert.Error(err, "unverified email")
+	_, err = login(t, ag, "no groups")
+	assert.Error(err, "not a member")
+
+	// Rejected delegation
+	conf.AdminEmail = "someone@example.com"
+	ag, err = New(conf)
+	if assert.NoError(err) {
+		_, err = login(t, ag, "the code")
+		assert.Error(err)
+	}
+}
@@ -0,0 +1,50 @@
+package authgoogle
+
+type Config struct {
+	Name  string
+	Realm string
+
+	ClientId     string `yaml:"clientID"`
+	ClientSecret string `yaml:"clientSecret"`
+	RedirectURL  string `yaml:"redirectURL"`
+	ProviderURL  string `yaml:"providerURL"`
+
+	// Workspace domains (the hd claim) allowed to log in
+	Domains []string
+	// Members of any of these groups are allowed, as group emails. Empty
+	// allows every user of the domains
+	Groups []string
+	// Principal for each group of the user, with {{.Group}} (group email)
+	// and {{.Name}} (local part of the email). Empty disables group
+	// principals
+	GroupPrincipalTemplate string `yaml:"groupPrincipalTemplate"`
+	// Add the local part of the user email as a principal
+	UsernamePrincipal bool `yaml:"usernamePrincipal"`
+
+	// Service account JSON key with domain-wide delegation for the
+	// Directory API
+	ServiceAccountKeyFile string `yaml:"serviceAccountKeyFile"`
+	// Workspace administrator impersonated by the service account
+	AdminEmail   string `yaml:"adminEmail"`
+	DirectoryURL string `yaml:"directoryURL"`
+
+	Timeout                int `yaml:"timeout"`
+	AuthFlowTimeout        int `yaml:"authFlowTimeout"`
+	MaxPendingAuthAttempts int `yaml:"maxPendingAuthAttempts"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:                   DefaultName,
+	Realm:                  DefaultRealm,
+	ProviderURL:            "https://accounts.google.com",
+	GroupPrincipalTemplate: "{{.Name}}",
+	UsernamePrincipal:      true,
+	DirectoryURL:           "https://admin.googleapis.com",
+	Timeout:                15,
+	AuthFlowTimeout:        240,
+	MaxPendingAuthAttempts: 1000,
+}
@@ -0,0 +1,184 @@
+package authgoogle
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	directoryScope = "https://www.googleapis.com/auth/admin.directory.group.readonly"
+	jwtBearerGrant = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	// Limit for a single API response
+	maxResponseSize = 1 << 20
+	// Limit for the pages of the group list
+	maxPages = 10
+)
+
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// Directory API client authorized with a service account impersonating a
+// Workspace administrator (domain-wide delegation)
+type directory struct {
+	url      string
+	email    string
+	keyID    string
+	key      *rsa.PrivateKey
+	tokenURI string
+	subject  string
+	client   *http.Client
+
+	sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newDirectory(keyFile, subject, directoryURL string, client *http.Client) (*directory, error) {
+	raw, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read service account key")
+	}
+	var sa serviceAccountKey
+	if err := json.Unmarshal(raw, &sa); err != nil {
+		return nil, errors.Wrap(err, "cannot parse service account key")
+	}
+	if sa.Type != "service_account" || sa.ClientEmail == "" || sa.TokenURI == "" {
+		return nil, errors.New("not a service account key")
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(sa.PrivateKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse service account private key")
+	}
+	return &directory{
+		url:      strings.TrimSuffix(directoryURL, "/"),
+		email:    sa.ClientEmail,
+		keyID:    sa.PrivateKeyID,
+		key:      key,
+		tokenURI: sa.TokenURI,
+		subject:  subject,
+		client:   client,
+	}, nil
+}
+
+// Return a cached access token or request a new one with a signed assertion
+func (d *directory) accessToken(ctx context.Context) (string, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.token != "" && time.Now().Before(d.expires) {
+		return d.token, nil
+	}
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   d.email,
+		"sub":   d.subject,
+		"scope": directoryScope,
+		"aud":   d.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	assertion := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	if d.keyID != "" {
+		assertion.Header["kid"] = d.keyID
+	}
+	signed, err := assertion.SignedString(d.key)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot sign assertion")
+	}
+	form := url.Values{}
+	form.Set("grant_type", jwtBearerGrant)
+	form.Set("assertion", signed)
+	req, err := http.NewRequest(http.MethodPost, d.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var r struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := d.do(ctx, req, &r); err != nil {
+		if r.Error != "" {
+			return "", errors.Errorf("token request failed: %s: %s", r.Error, r.ErrorDescription)
+		}
+		return "", errors.Wrap(err, "token request failed")
+	}
+	if r.AccessToken == "" {
+		return "", errors.New("no access token in the token response")
+	}
+	d.token = r.AccessToken
+	// Renew a minute early
+	d.expires = now.Add(time.Duration(r.ExpiresIn)*time.Second - time.Minute)
+	return d.token, nil
+}
+
+// Groups the user is a direct member of, as group emails
+func (d *directory) groups(ctx context.Context, userKey string) ([]string, error) {
+	token, err := d.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var r []string
+	pageToken := ""
+	for i := 0; i < maxPages; i++ {
+		q := url.Values{}
+		q.Set("userKey", userKey)
+		q.Set("maxResults", "200")
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequest(http.MethodGet, d.url+"/admin/directory/v1/groups?"+q.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		var page struct {
+			Groups []struct {
+				Email string `json:"email"`
+			} `json:"groups"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := d.do(ctx, req, &page); err != nil {
+			return nil, errors.Wrap(err, "cannot list groups")
+		}
+		for _, g := range page.Groups {
+			r = append(r, g.Email)
+		}
+		if page.NextPageToken == "" {
+			break
+		}
+		pageToken = page.NextPageToken
+	}
+	return r, nil
+}
+
+// Send the request and decode the JSON response to v, also on errors
+func (d *directory) do(ctx context.Context, req *http.Request, v interface{}) error {
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s returned %s", req.URL.Path, resp.Status)
+	}
+	return errors.Wrap(decodeErr, "invalid response")
+}
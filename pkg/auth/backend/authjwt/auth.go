@@ -0,0 +1,297 @@
+package authjwt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/coreos/go-oidc"
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const subjectName = "subjectName"
+
+// Algorithms accepted for the token signatures
+var signingAlgs = []string{
+	oidc.RS256, oidc.RS384, oidc.RS512,
+	oidc.ES256, oidc.ES384, oidc.ES512,
+	oidc.PS256, oidc.PS384, oidc.PS512,
+}
+
+type issuer struct {
+	verifier  *oidc.IDTokenVerifier
+	audiences []string
+}
+
+// AuthJWT exchanges JWTs of trusted external issuers, like workload identity
+// tokens, for certificates
+type AuthJWT struct {
+	config   *Config
+	log      *logrus.Entry
+	issuers  map[string]issuer
+	required map[string][]glob.Glob
+	tpls     *template.Template
+}
+
+// Issuer of the token before it is verified, to pick the keys
+func unverifiedIssuer(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, "malformed token")
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", errors.Wrap(err, "malformed token")
+	}
+	return claims.Issuer, nil
+}
+
+func (aj *AuthJWT) verify(token string) (map[string]interface{}, error) {
+	iss, err := unverifiedIssuer(token)
+	if err != nil {
+		return nil, err
+	}
+	is, ok := aj.issuers[iss]
+	if !ok {
+		return nil, errors.Errorf("untrusted issuer %q", iss)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(aj.config.Timeout)*time.Second)
+	defer cancel()
+	idToken, err := is.verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !containsAny(idToken.Audience, is.audiences) {
+		return nil, errors.Errorf("unexpected audience %q", idToken.Audience)
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, errors.Wrap(err, "cannot parse claims")
+	}
+	for name, globs := range aj.required {
+		if !claimMatches(claims[name], globs) {
+			return nil, errors.Errorf("claim %s does not match", name)
+		}
+	}
+	return claims, nil
+}
+
+func containsAny(list, values []string) bool {
+	for _, v := range values {
+		for _, s := range list {
+			if s == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func claimMatches(value interface{}, globs []glob.Glob) bool {
+	switch v := value.(type) {
+	case string:
+		for _, g := range globs {
+			if g.Match(v) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if claimMatches(item, globs) {
+				return true
+			}
+		}
+	case bool, float64:
+		return claimMatches(fmt.Sprint(v), globs)
+	}
+	return false
+}
+
+func (aj *AuthJWT) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil || len(creds.Secret) == 0 {
+		return nil, false
+	}
+	log := aj.log.WithField("action", "authenticate")
+	if v, ok := creds.Meta[auth.MetaAuditID]; ok {
+		log = log.WithField(auth.MetaAuditID, v)
+	}
+
+	claims, err := aj.verify(string(creds.Secret))
+	if err != nil {
+		log.WithError(err).Info("token rejected")
+		return nil, false
+	}
+	log = log.WithField("iss", claims["iss"]).WithField("sub", claims["sub"])
+	log.Debug("token auth successful")
+
+	meta := make(map[string]interface{}, len(creds.Meta)+2)
+	for k, v := range creds.Meta {
+		meta[k] = v
+	}
+	meta[auth.MetaClaims] = claims
+	if aj.config.GroupsClaim != "" {
+		var groups []string
+		switch v := claims[aj.config.GroupsClaim].(type) {
+		case string:
+			groups = append(groups, v)
+		case []interface{}:
+			for _, g := range v {
+				if s, ok := g.(string); ok {
+					groups = append(groups, s)
+				}
+			}
+		}
+		if len(groups) > 0 {
+			meta[auth.MetaGroups] = groups
+		}
+	}
+	actx := &auth.AuthContext{
+		Status:          auth.StatusCompleted,
+		Parent:          pctx,
+		SubjectName:     aj.renderTpl(subjectName, claims),
+		CriticalOptions: aj.config.CriticalOptions,
+		Extensions:      aj.config.Extensions,
+		Authenticator:   aj.Name(),
+		AuthMeta:        meta,
+	}
+	for i := range aj.config.PrincipalTemplates {
+		actx.Principals = append(actx.Principals, aj.renderPrincipals(principalTpl(i), claims)...)
+	}
+	actx.Principals = append(actx.Principals, aj.config.Principals...)
+	return actx, true
+}
+
+func (aj *AuthJWT) renderPrincipals(name string, data interface{}) []string {
+	var r []string
+	for _, line := range strings.Split(aj.renderTpl(name, data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line != "<no value>" {
+			r = append(r, line)
+		}
+	}
+	return r
+}
+
+func (aj *AuthJWT) renderTpl(name string, data interface{}) string {
+	buf := bytes.NewBuffer([]byte{})
+	err := aj.tpls.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		aj.log.WithError(err).Errorf("template render error: %s", name)
+	}
+	return buf.String()
+}
+
+func principalTpl(i int) string {
+	return fmt.Sprintf("principal%d", i)
+}
+
+// Check that the keys or the discovery document of each issuer can be
+// fetched
+func (aj *AuthJWT) Probe() error {
+	client := &http.Client{Timeout: time.Duration(aj.config.Timeout) * time.Second}
+	for _, is := range aj.config.Issuers {
+		url := is.JWKSURL
+		if url == "" {
+			url = strings.TrimSuffix(is.Issuer, "/") + "/.well-known/openid-configuration"
+		}
+		res, err := client.Get(url)
+		if err != nil {
+			return errors.Wrapf(err, "cannot fetch keys of issuer %s", is.Issuer)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return errors.Errorf("cannot fetch keys of issuer %s: %s", is.Issuer, res.Status)
+		}
+	}
+	return nil
+}
+
+func (aj *AuthJWT) Type() string {
+	return Type
+}
+
+func (aj *AuthJWT) Name() string {
+	return aj.config.Name
+}
+
+func (aj *AuthJWT) Realm() string {
+	return aj.config.Realm
+}
+
+func (aj *AuthJWT) CredentialType() string {
+	return auth.CredentialBearerToken
+}
+
+func New(config *Config) (*AuthJWT, error) {
+	if len(config.Issuers) == 0 {
+		return nil, errors.Errorf("%s: required config items: issuers", config.Name)
+	}
+	aj := &AuthJWT{
+		config:   config,
+		issuers:  make(map[string]issuer),
+		required: make(map[string][]glob.Glob),
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}
+	// The key sets fetch the keys with this context for their lifetime
+	ctx := oidc.ClientContext(context.Background(), &http.Client{
+		Timeout: time.Duration(config.Timeout) * time.Second,
+	})
+	oidcConfig := &oidc.Config{
+		SkipClientIDCheck:    true,
+		SupportedSigningAlgs: signingAlgs,
+	}
+	for _, is := range config.Issuers {
+		if is.Issuer == "" || len(is.Audiences) == 0 {
+			return nil, errors.Errorf("%s: required issuer config items: issuer, audiences", config.Name)
+		}
+		var verifier *oidc.IDTokenVerifier
+		if is.JWKSURL != "" {
+			verifier = oidc.NewVerifier(is.Issuer, oidc.NewRemoteKeySet(ctx, is.JWKSURL), oidcConfig)
+		} else {
+			provider, err := oidc.NewProvider(ctx, is.Issuer)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s: cannot discover issuer %s", config.Name, is.Issuer)
+			}
+			verifier = provider.Verifier(oidcConfig)
+		}
+		aj.issuers[is.Issuer] = issuer{verifier: verifier, audiences: is.Audiences}
+	}
+	for name, patterns := range config.RequiredClaims {
+		for _, p := range patterns {
+			g, err := glob.Compile(p)
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s: invalid requiredClaims pattern %q", config.Name, p)
+			}
+			aj.required[name] = append(aj.required[name], g)
+		}
+	}
+	aj.tpls = template.New("").Funcs(util.TemplateFuncs)
+	if _, err := aj.tpls.New(subjectName).Parse(config.SubjectNameTemplate); err != nil {
+		return nil, errors.Wrapf(err, "%s: cannot parse subjectNameTemplate", config.Name)
+	}
+	for i, t := range config.PrincipalTemplates {
+		if _, err := aj.tpls.New(principalTpl(i)).Parse(t); err != nil {
+			return nil, errors.Wrapf(err, "%s: cannot parse principalTemplates", config.Name)
+		}
+	}
+	return aj, nil
+}
@@ -0,0 +1,119 @@
+package authjwt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// Issuer serving the discovery document and the keys
+func testIssuer(t *testing.T, key *rsa.PrivateKey) *httptest.Server {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"issuer":   srv.URL,
+				"jwks_uri": srv.URL + "/keys",
+			})
+		case "/keys":
+			json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &key.PublicKey, KeyID: "test", Use: "sig"},
+			}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	srv.Start()
+	return srv
+}
+
+func TestAuthJWT(t *testing.T) {
+	assert := assert.New(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := testIssuer(t, key)
+	defer srv.Close()
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	sign := func(k *rsa.PrivateKey, claims jwt.MapClaims) []byte {
+		base := jwt.MapClaims{
+			"iss":        srv.URL,
+			"aud":        "ssh-inscribe",
+			"sub":        "repo:example/app:ref:refs/heads/main",
+			"repository": "example/app",
+			"ref":        "refs/heads/main",
+			"teams":      []string{"deploy", "ops"},
+			"exp":        time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range claims {
+			base[k] = v
+		}
+		s, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, base).SignedString(k)
+		return []byte(s)
+	}
+
+	conf := *Defaults
+	conf.Issuers = []Issuer{{Issuer: srv.URL, Audiences: []string{"other", "ssh-inscribe"}}}
+	conf.RequiredClaims = map[string][]string{
+		"repository": {"example/*"},
+		"ref":        {"refs/heads/main", "refs/tags/*"},
+	}
+	conf.SubjectNameTemplate = "{{.repository}}"
+	conf.PrincipalTemplates = []string{`deploy-{{index (split "/" .repository) 1}}`}
+	conf.GroupsClaim = "teams"
+	aj, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(aj.Probe())
+	login := func(token []byte) (*auth.AuthContext, bool) {
+		return aj.Authenticate(nil, &auth.Credentials{Secret: token})
+	}
+
+	actx, ok := login(sign(key, nil))
+	if assert.True(ok) {
+		assert.Equal("example/app", actx.GetSubjectName())
+		assert.Equal([]string{"deploy-app"}, actx.GetPrincipals())
+		assert.Equal([]string{"deploy", "ops"}, actx.GetGroups())
+		assert.Equal(auth.CredentialBearerToken, aj.CredentialType())
+	}
+	_, ok = login(sign(otherKey, nil))
+	assert.False(ok, "wrong key")
+	_, ok = login(sign(key, jwt.MapClaims{"aud": "someone-else"}))
+	assert.False(ok, "wrong audience")
+	_, ok = login(sign(key, jwt.MapClaims{"iss": "https://untrusted.example.com"}))
+	assert.False(ok, "untrusted issuer")
+	_, ok = login(sign(key, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}))
+	assert.False(ok, "expired")
+	_, ok = login(sign(key, jwt.MapClaims{"ref": "refs/heads/feature"}))
+	assert.False(ok, "required claim")
+	_, ok = login(sign(key, jwt.MapClaims{"ref": "refs/tags/v1.0.0"}))
+	assert.True(ok)
+	_, ok = login([]byte("not a token"))
+	assert.False(ok)
+
+	// Keys without discovery
+	conf.Issuers = []Issuer{{Issuer: srv.URL, JWKSURL: srv.URL + "/keys", Audiences: []string{"ssh-inscribe"}}}
+	aj, err = New(&conf)
+	if assert.NoError(err) {
+		_, ok = login(sign(key, nil))
+		assert.True(ok)
+	}
+
+	conf.Issuers = []Issuer{{Issuer: srv.URL}}
+	_, err = New(&conf)
+	assert.Error(err, "audiences are required")
+}
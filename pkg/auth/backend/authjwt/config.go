@@ -0,0 +1,41 @@
+package authjwt
+
+type Issuer struct {
+	// Value of the iss claim
+	Issuer string
+	// Keys of the issuer. Discovered from
+	// <issuer>/.well-known/openid-configuration if empty
+	JWKSURL string `yaml:"jwksURL"`
+	// The token needs to be for one of these audiences
+	Audiences []string
+}
+
+type Config struct {
+	Name  string
+	Realm string
+
+	Issuers []Issuer
+	// The claims need to match one of the glob patterns. Claims with a list
+	// of values match if any of the values do
+	RequiredClaims map[string][]string `yaml:"requiredClaims"`
+	// Templates with the claims, e.g. {{.sub}}. Each line of the principal
+	// template output is a principal
+	SubjectNameTemplate string   `yaml:"subjectNameTemplate"`
+	PrincipalTemplates  []string `yaml:"principalTemplates"`
+	// Claim holding the groups of the workload
+	GroupsClaim string `yaml:"groupsClaim"`
+	// Timeout in seconds for the discovery and key requests
+	Timeout int
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:                DefaultName,
+	Realm:               DefaultRealm,
+	SubjectNameTemplate: "{{.sub}}",
+	PrincipalTemplates:  []string{"{{.sub}}"},
+	Timeout:             15,
+}
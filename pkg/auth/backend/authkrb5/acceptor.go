@@ -0,0 +1,83 @@
+package authkrb5
+
+import (
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/pkg/errors"
+)
+
+// Validates SPNEGO and raw Kerberos tokens against the service keys in a
+// keytab. Replayed authenticators are rejected
+type keytabAcceptor struct {
+	settings *service.Settings
+	// Only accept tickets for this service when set
+	service      *types.PrincipalName
+	serviceRealm string
+}
+
+func newKeytabAcceptor(kt *keytab.Keytab, servicePrincipal string, skew time.Duration) *keytabAcceptor {
+	a := &keytabAcceptor{}
+	opts := []func(*service.Settings){
+		service.MaxClockSkew(skew),
+		service.DecodePAC(false),
+	}
+	if servicePrincipal != "" {
+		name, realm := types.ParseSPNString(servicePrincipal)
+		a.service, a.serviceRealm = &name, realm
+		opts = append(opts, service.KeytabPrincipal(name.PrincipalNameString()))
+	}
+	a.settings = service.NewSettings(kt, opts...)
+	return a
+}
+
+// Accept the token and return the authenticated user and realm
+func (a *keytabAcceptor) Accept(token []byte) (string, string, error) {
+	mech, err := mechToken(token)
+	if err != nil {
+		return "", "", err
+	}
+	var kt spnego.KRB5Token
+	if err := kt.Unmarshal(mech); err != nil {
+		return "", "", errors.Wrap(err, "invalid Kerberos token")
+	}
+	if !kt.IsAPReq() {
+		return "", "", errors.New("Kerberos token is not an AP-REQ")
+	}
+	tkt := kt.APReq.Ticket
+	if a.service != nil {
+		if !tkt.SName.Equal(*a.service) || (a.serviceRealm != "" && tkt.Realm != a.serviceRealm) {
+			return "", "", errors.Errorf("ticket is for %s@%s", tkt.SName.PrincipalNameString(), tkt.Realm)
+		}
+	}
+	ok, creds, err := service.VerifyAPREQ(&kt.APReq, a.settings)
+	if err != nil {
+		return "", "", err
+	}
+	if !ok {
+		return "", "", errors.New("ticket is not valid")
+	}
+	return creds.UserName(), creds.Domain(), nil
+}
+
+// The Kerberos mechanism token of a SPNEGO token. Other tokens are
+// returned as is
+func mechToken(token []byte) ([]byte, error) {
+	var st spnego.SPNEGOToken
+	if err := st.Unmarshal(token); err != nil {
+		return token, nil
+	}
+	if !st.Init {
+		return nil, errors.New("SPNEGO token is not a NegTokenInit")
+	}
+	for _, oid := range st.NegTokenInit.MechTypes {
+		if oid.Equal(gssapi.OIDKRB5.OID()) || oid.Equal(gssapi.OIDMSLegacyKRB5.OID()) {
+			return st.NegTokenInit.MechTokenBytes, nil
+		}
+	}
+	return nil, errors.New("SPNEGO token does not offer Kerberos")
+}
@@ -0,0 +1,147 @@
+package authkrb5
+
+import (
+	"bytes"
+	"text/template"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	subjectName = "subjectName"
+	principal   = "principal"
+)
+
+type acceptor interface {
+	Accept(token []byte) (user string, realm string, err error)
+}
+
+type AuthKrb5 struct {
+	config   *Config
+	log      *logrus.Entry
+	tpls     *template.Template
+	acceptor acceptor
+}
+
+// Template context for the subject name and principal templates
+type templateContext struct {
+	User      string
+	Realm     string
+	Principal string
+}
+
+func (ak *AuthKrb5) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	log := ak.log.WithField("action", "authenticate")
+	if v, ok := creds.Meta[auth.MetaAuditID]; ok {
+		log = log.WithField(auth.MetaAuditID, v)
+	}
+
+	user, realm, err := ak.acceptor.Accept(creds.Secret)
+	if err != nil {
+		log.WithError(err).Info("cannot accept negotiate token")
+		return nil, false
+	}
+	data := templateContext{
+		User:      user,
+		Realm:     realm,
+		Principal: user + "@" + realm,
+	}
+	log = log.WithField("principal", data.Principal)
+	if !ak.realmAllowed(realm) {
+		log.Info("realm is not allowed")
+		return nil, false
+	}
+	log.Debug("negotiate auth successful")
+
+	actx := &auth.AuthContext{
+		Status:          auth.StatusCompleted,
+		Parent:          pctx,
+		SubjectName:     ak.renderTpl(subjectName, data),
+		Principals:      []string{ak.renderTpl(principal, data)},
+		CriticalOptions: ak.config.CriticalOptions,
+		Extensions:      ak.config.Extensions,
+		Authenticator:   ak.Name(),
+		AuthMeta:        creds.Meta,
+	}
+	actx.Principals = append(actx.Principals, ak.config.Principals...)
+	return actx, true
+}
+
+func (ak *AuthKrb5) realmAllowed(realm string) bool {
+	if len(ak.config.AllowedRealms) == 0 {
+		return true
+	}
+	for _, r := range ak.config.AllowedRealms {
+		if r == realm {
+			return true
+		}
+	}
+	return false
+}
+
+func (ak *AuthKrb5) renderTpl(name string, data interface{}) string {
+	buf := bytes.NewBuffer([]byte{})
+	err := ak.tpls.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		ak.log.WithError(err).Errorf("template render error: %s", name)
+	}
+	return buf.String()
+}
+
+func (ak *AuthKrb5) Type() string {
+	return Type
+}
+
+func (ak *AuthKrb5) Name() string {
+	return ak.config.Name
+}
+
+func (ak *AuthKrb5) Realm() string {
+	return ak.config.Realm
+}
+
+func (ak *AuthKrb5) CredentialType() string {
+	return auth.CredentialNegotiate
+}
+
+func New(config *Config) (*AuthKrb5, error) {
+	kt, err := keytab.Load(config.Keytab)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: cannot load keytab", config.Name)
+	}
+	skew := time.Duration(config.ClockSkew) * time.Second
+	return newAuthKrb5(config, newKeytabAcceptor(kt, config.ServicePrincipal, skew))
+}
+
+func newAuthKrb5(config *Config, acc acceptor) (*AuthKrb5, error) {
+	var tplError error
+	rootTpl := template.New("root")
+	parseTpl := func(name, tpl string) {
+		_, err := rootTpl.New(name).Parse(tpl)
+		if err != nil {
+			tplError = errors.Wrapf(err, "cannot parse %s", name)
+		}
+	}
+	parseTpl(subjectName, config.SubjectNameTemplate)
+	parseTpl(principal, config.PrincipalTemplate)
+	if tplError != nil {
+		return nil, tplError
+	}
+
+	return &AuthKrb5{
+		config:   config,
+		tpls:     rootTpl,
+		acceptor: acc,
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}, nil
+}
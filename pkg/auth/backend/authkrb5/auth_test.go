@@ -0,0 +1,176 @@
+package authkrb5
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// Accepts the token "valid" as the principal in it
+type mockAcceptor struct {
+	principal string
+}
+
+func (m mockAcceptor) Accept(token []byte) (string, string, error) {
+	if string(token) != "valid" {
+		return "", "", errors.New("invalid token")
+	}
+	i := strings.LastIndex(m.principal, "@")
+	return m.principal[:i], m.principal[i+1:], nil
+}
+
+func testConfig() *Config {
+	conf := *Defaults
+	conf.Principals = []string{"common"}
+	return &conf
+}
+
+func TestAuthenticate(t *testing.T) {
+	ak, err := newAuthKrb5(testConfig(), mockAcceptor{"user@EXAMPLE.COM"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, auth.CredentialNegotiate, ak.CredentialType())
+
+	actx, ok := ak.Authenticate(nil, &auth.Credentials{Secret: []byte("valid")})
+	if assert.True(t, ok) {
+		assert.Equal(t, auth.StatusCompleted, actx.Status)
+		assert.Equal(t, "user@EXAMPLE.COM", actx.SubjectName)
+		assert.Equal(t, []string{"user", "common"}, actx.Principals)
+	}
+
+	_, ok = ak.Authenticate(nil, &auth.Credentials{Secret: []byte("invalid")})
+	assert.False(t, ok)
+	_, ok = ak.Authenticate(nil, nil)
+	assert.False(t, ok)
+}
+
+func TestAllowedRealms(t *testing.T) {
+	conf := testConfig()
+	conf.AllowedRealms = []string{"EXAMPLE.COM"}
+	conf.PrincipalTemplate = "{{.User}}.{{.Realm}}"
+
+	ak, _ := newAuthKrb5(conf, mockAcceptor{"user@EXAMPLE.COM"})
+	actx, ok := ak.Authenticate(nil, &auth.Credentials{Secret: []byte("valid")})
+	if assert.True(t, ok) {
+		assert.Equal(t, "user.EXAMPLE.COM", actx.Principals[0])
+	}
+
+	ak, _ = newAuthKrb5(conf, mockAcceptor{"user@OTHER.COM"})
+	_, ok = ak.Authenticate(nil, &auth.Credentials{Secret: []byte("valid")})
+	assert.False(t, ok)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	conf := testConfig()
+	conf.Keytab = "/nonexistent"
+	_, err := New(conf)
+	assert.Error(t, err)
+
+	conf = testConfig()
+	conf.SubjectNameTemplate = "{{"
+	_, err = newAuthKrb5(conf, mockAcceptor{})
+	assert.Error(t, err)
+}
+
+// Keytab with the keys of the given services
+func testKeytab(t *testing.T, services ...string) *keytab.Keytab {
+	kt := keytab.New()
+	for _, v := range services {
+		if err := kt.AddEntry(v, "EXAMPLE.COM", "secret-"+v, time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kt
+}
+
+// SPNEGO and raw Kerberos tokens of user@EXAMPLE.COM for the service,
+// encrypted with the key in the keytab
+func testTokens(t *testing.T, kt *keytab.Keytab, service string) ([]byte, []byte) {
+	cl := client.NewWithPassword("user", "EXAMPLE.COM", "password", config.New())
+	now := time.Now().UTC()
+	tkt, key, err := messages.NewTicket(
+		cl.Credentials.CName(), "EXAMPLE.COM",
+		types.NewPrincipalName(nametype.KRB_NT_SRV_INST, service), "EXAMPLE.COM",
+		asn1.BitString{Bytes: make([]byte, 4), BitLength: 32}, kt, etypeID.AES256_CTS_HMAC_SHA1_96, 1,
+		now, now, now.Add(time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	init, err := spnego.NewNegTokenInitKRB5(cl, tkt, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := (&spnego.SPNEGOToken{Init: true, NegTokenInit: init}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := spnego.NewKRB5TokenAPREQ(cl, tkt, key, []int{gssapi.ContextFlagInteg}, []int{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := raw.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st, rt
+}
+
+func TestKeytabAcceptor(t *testing.T) {
+	assert := assert.New(t)
+	kt := testKeytab(t, "HTTP/sshi.example.com", "HTTP/other.example.com")
+	b, _ := kt.Marshal()
+	conf := testConfig()
+	conf.Keytab = filepath.Join(t.TempDir(), "krb5.keytab")
+	conf.ServicePrincipal = "HTTP/sshi.example.com@EXAMPLE.COM"
+	if err := ioutil.WriteFile(conf.Keytab, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ak, err := New(conf)
+	if !assert.NoError(err) {
+		return
+	}
+
+	spnegoToken, rawToken := testTokens(t, kt, "HTTP/sshi.example.com")
+	for _, token := range [][]byte{spnegoToken, rawToken} {
+		actx, ok := ak.Authenticate(nil, &auth.Credentials{Secret: token})
+		if assert.True(ok) {
+			assert.Equal("user@EXAMPLE.COM", actx.SubjectName)
+			assert.Equal([]string{"user", "common"}, actx.Principals)
+		}
+		// Replayed
+		_, ok = ak.Authenticate(nil, &auth.Credentials{Secret: token})
+		assert.False(ok)
+	}
+
+	// Another service in the keytab
+	token, _ := testTokens(t, kt, "HTTP/other.example.com")
+	_, ok := ak.Authenticate(nil, &auth.Credentials{Secret: token})
+	assert.False(ok)
+
+	// Key not in the keytab
+	other := keytab.New()
+	other.AddEntry("HTTP/sshi.example.com", "EXAMPLE.COM", "other", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96)
+	token, _ = testTokens(t, other, "HTTP/sshi.example.com")
+	_, ok = ak.Authenticate(nil, &auth.Credentials{Secret: token})
+	assert.False(ok)
+
+	_, ok = ak.Authenticate(nil, &auth.Credentials{Secret: []byte("garbage")})
+	assert.False(ok)
+}
@@ -0,0 +1,42 @@
+package authkrb5
+
+import (
+	"path"
+
+	"github.com/aakso/ssh-inscribe/pkg/globals"
+)
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// Keytab holding the keys of the HTTP service principal
+	Keytab string
+	// Only accept tickets for this principal, e.g. HTTP/sshi.example.com@EXAMPLE.COM.
+	// Any principal in the keytab is accepted when empty
+	ServicePrincipal string `yaml:"servicePrincipal"`
+	// Kerberos realms of the users allowed to log in. All realms are
+	// allowed when empty
+	AllowedRealms []string `yaml:"allowedRealms"`
+	// Allowed clock difference to the clients in seconds
+	ClockSkew int `yaml:"clockSkew"`
+
+	// Templates get the user name without the realm as .User, the realm as
+	// .Realm and the full principal name as .Principal
+	SubjectNameTemplate string `yaml:"subjectNameTemplate"`
+	PrincipalTemplate   string `yaml:"principalTemplate"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:      DefaultName,
+	Realm:     DefaultRealm,
+	Keytab:    path.Join(globals.ConfDir(), "krb5.keytab"),
+	ClockSkew: 300,
+
+	SubjectNameTemplate: "{{.Principal}}",
+	PrincipalTemplate:   "{{.User}}",
+}
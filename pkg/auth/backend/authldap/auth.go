@@ -3,8 +3,11 @@ package authldap
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	"net/url"
+	"io/ioutil"
+	"net"
+	"strings"
 	"text/template"
 	"time"
 
@@ -12,6 +15,7 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/util"
 	"github.com/pkg/errors"
 )
 
@@ -23,17 +27,30 @@ const (
 	UserBindDN        = "UserBindDN"
 	UserSearchFilter  = "UserSearchFilter"
 	GroupSearchFilter = "GroupSearchFilter"
-	SubjectName       = "SubjectName"
-	Principal         = "Principal"
-
-	AuthLDAPUsertEntry = "authLDAPUserEntry"
+	// Name of the nested group search filter template
+	NestedGroupSearchFilter = "NestedGroupSearchFilter"
+	SubjectName             = "SubjectName"
+	Principal               = "Principal"
+	// Prefix of the user principal template names
+	UserPrincipal = "UserPrincipal"
+
+	AuthLDAPUsertEntry = auth.MetaLDAPUserEntry
 )
 
 type AuthLDAP struct {
-	log         *logrus.Entry
-	config      *Config
-	url         *url.URL
-	connectMode int
+	log       *logrus.Entry
+	config    *Config
+	servers   []*server
+	health    *serverHealth
+	tlsConfig *tls.Config
+	// Attributes of the user search
+	userAttrs []string
+	// With a service account
+	pool *connPool
+	// With GroupCacheTTL
+	groupCache *groupCache
+	// With AllowedGroups or AllowedGroupBases
+	groupFilter *groupFilter
 
 	tpls *template.Template
 }
@@ -73,50 +90,39 @@ func (al *AuthLDAP) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials
 		"UserName": creds.UserIdentifier,
 	}
 
-	// Set ldap package level dial timeout as it doesn't offer any other way
-	ldap.DefaultTimeout = time.Second * time.Duration(al.config.Timeout)
-	var conn *ldap.Conn
-	host := fmt.Sprintf("%s:%s", al.url.Hostname(), al.url.Port())
-	switch al.connectMode {
-	case ConnectModeLDAPS:
-		conn, err = ldap.DialTLS("tcp", host, &tls.Config{
-			InsecureSkipVerify: al.config.Insecure,
-			ServerName:         al.url.Hostname(),
-		})
-		if err != nil {
-			log.WithError(err).Error("cannot connect to directory server")
-			return nil, false
-		}
-	case ConnectModePlain, ConnectModeStartTLS:
-		conn, err = ldap.Dial("tcp", host)
-		if err != nil {
-			log.WithError(err).Error("cannot connect to directory server")
-			return nil, false
-		}
+	conn, err := al.acquire()
+	if err != nil {
+		log.WithError(err).Error("cannot connect to directory server")
+		creds.SetBackendError(err)
+		return nil, false
 	}
-	defer conn.Close()
-	conn.SetTimeout(time.Second * time.Duration(al.config.Timeout))
-	if al.connectMode == ConnectModeStartTLS {
-		if err := conn.StartTLS(&tls.Config{
-			InsecureSkipVerify: al.config.Insecure,
-			ServerName:         al.url.Hostname(),
-		}); err != nil {
-			log.WithError(err).Error("cannot connect to directory server")
+	// Pooled connections are closed unless the authentication gets through
+	// the directory operations
+	broken := true
+	defer func() { al.release(conn, broken) }()
+
+	// Without a service account the user binds first and searches with
+	// their own rights
+	if al.pool == nil {
+		binddn := al.RenderTpl(UserBindDN, tplCtx)
+		if failure, err := bindUser(conn, binddn, string(creds.Secret)); err != nil {
+			if failure != "" {
+				creds.SetPasswordFailure(failure)
+			}
+			if serverError(err) {
+				creds.SetBackendError(err)
+			}
+			log.WithError(err).Error("cannot bind")
 			return nil, false
 		}
 	}
 
-	binddn := al.RenderTpl(UserBindDN, tplCtx)
-	if err := conn.Bind(binddn, string(creds.Secret)); err != nil {
-		log.WithError(err).Error("cannot bind")
-		return nil, false
-	}
-
 	// Find user entry, require a single match
 	filter := al.RenderTpl(UserSearchFilter, tplCtx)
-	res, err := al.search(conn, al.config.UserSearchBase, filter, al.config.UserSearchGetAttributes)
+	res, err := al.search(conn, al.config.UserSearchBase, filter, al.userAttrs)
 	if err != nil {
 		log.WithError(err).Error("search failure")
+		creds.SetBackendError(err)
 		return nil, false
 	}
 	if len(res.Entries) != 1 {
@@ -126,30 +132,273 @@ func (al *AuthLDAP) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials
 	user := entryToMap(res.Entries[0])
 	tplCtx["User"] = user
 	newctx.SubjectName = al.RenderTpl(SubjectName, tplCtx)
-	newctx.AuthMeta[AuthLDAPUsertEntry] = user
+	newctx.AuthMeta[AuthLDAPUsertEntry] = map[string]interface{}(user)
 	log.WithField("user", user["cn"]).Debug("user search ok")
+	passwordExpires, err := parseExpiryTime(user.Get(al.config.PasswordExpiryAttribute))
+	if err != nil {
+		log.WithError(err).Warn("cannot check password expiry")
+	}
+	for i := range al.config.UserPrincipalTemplates {
+		newctx.Principals = append(newctx.Principals, al.renderPrincipals(userPrincipalTpl(i), tplCtx)...)
+	}
 
 	// Find groups
 	if al.config.AddPrincipalsFromGroups {
-		filter = al.RenderTpl(GroupSearchFilter, tplCtx)
-		res, err = al.search(conn, al.config.GroupSearchBase, filter, al.config.GroupSearchGetAttributes)
+		entries, err := al.cachedGroups(conn, tplCtx)
 		if err != nil {
 			log.WithError(err).Error("search failure")
+			creds.SetBackendError(err)
 			return nil, false
 		}
-		for _, entry := range res.Entries {
-			group := entryToMap(entry)
+		var groups []string
+		for _, group := range entries {
+			if al.groupFilter != nil && !al.groupFilter.allows(group.Get(al.groupNameAttribute()), group.DN()) {
+				log.WithField("group", group.DN()).Debug("group not allowed")
+				continue
+			}
 			log.WithField("group", group["cn"]).Debug("searched group")
 			tplCtx["Group"] = group
-			if principal := al.RenderTpl(Principal, tplCtx); principal != "" {
-				newctx.Principals = append(newctx.Principals, principal)
+			newctx.Principals = append(newctx.Principals, al.renderPrincipals(Principal, tplCtx)...)
+			if name := group.Get(al.groupNameAttribute()); name != "" {
+				groups = append(groups, name)
+			}
+		}
+		newctx.AuthMeta[auth.MetaGroups] = groups
+	}
+
+	// With a service account the password is verified after the searches
+	// by binding as the found user
+	if al.pool != nil {
+		// An empty password would be an unauthenticated bind
+		if len(creds.Secret) == 0 {
+			broken = false
+			log.Error("empty password")
+			return nil, false
+		}
+		binddn := al.RenderTpl(UserBindDN, tplCtx)
+		if failure, err := bindUser(conn, binddn, string(creds.Secret)); err != nil {
+			broken = !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials)
+			if failure != "" {
+				creds.SetPasswordFailure(failure)
+			}
+			if serverError(err) {
+				creds.SetBackendError(err)
 			}
+			log.WithError(err).Error("cannot bind")
+			return nil, false
 		}
 	}
 
+	broken = false
+	warning := time.Duration(al.config.PasswordExpiryWarning) * time.Second
+	if !passwordExpires.IsZero() && time.Until(passwordExpires) < warning {
+		log.WithField("expires", passwordExpires).Info("password expires soon")
+		newctx.AuthMeta[auth.MetaPasswordExpires] = passwordExpires.UTC().Format(time.RFC3339)
+	}
+	newctx.AddIdentity(auth.IdentityMFA, "pwd")
+	for key, attr := range al.config.IdentityAttributes {
+		newctx.AddIdentity(key, user.Values(attr)...)
+	}
 	return newctx, true
 }
 
+// A connection from the pool with a service account, a new one otherwise
+func (al *AuthLDAP) acquire() (*ldap.Conn, error) {
+	if al.pool != nil {
+		return al.pool.get()
+	}
+	return al.connect()
+}
+
+func (al *AuthLDAP) release(conn *ldap.Conn, broken bool) {
+	if al.pool != nil {
+		al.pool.put(conn, broken)
+		return
+	}
+	conn.Close()
+}
+
+func (al *AuthLDAP) serviceBind(conn *ldap.Conn) error {
+	return conn.Bind(al.config.ServiceBindDN, al.config.ServiceBindPassword)
+}
+
+// Connect and bind with the service account
+func (al *AuthLDAP) dialService() (*ldap.Conn, error) {
+	conn, err := al.connect()
+	if err != nil {
+		return nil, err
+	}
+	if err := al.serviceBind(conn); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "cannot bind with the service account")
+	}
+	return conn, nil
+}
+
+// Groups of the user from the cache or the directory
+func (al *AuthLDAP) cachedGroups(conn *ldap.Conn, tplCtx map[string]interface{}) ([]EntryMap, error) {
+	if al.groupCache == nil {
+		return al.searchGroups(conn, tplCtx)
+	}
+	user := tplCtx["User"].(EntryMap).DN()
+	if groups, ok := al.groupCache.get(user); ok {
+		return groups, nil
+	}
+	groups, err := al.searchGroups(conn, tplCtx)
+	if err != nil {
+		return nil, err
+	}
+	al.groupCache.set(user, groups)
+	return groups, nil
+}
+
+// Search the groups of the user. With NestedGroupDepth the groups of the
+// found groups are searched level by level, each group is returned once
+func (al *AuthLDAP) searchGroups(conn *ldap.Conn, tplCtx map[string]interface{}) ([]EntryMap, error) {
+	filter := al.RenderTpl(GroupSearchFilter, tplCtx)
+	res, err := al.search(conn, al.config.GroupSearchBase, filter, al.config.GroupSearchGetAttributes)
+	if err != nil {
+		return nil, err
+	}
+	var groups []EntryMap
+	seen := map[string]bool{}
+	add := func(entries []*ldap.Entry) []EntryMap {
+		var added []EntryMap
+		for _, entry := range entries {
+			if seen[entry.DN] {
+				continue
+			}
+			seen[entry.DN] = true
+			added = append(added, entryToMap(entry))
+		}
+		groups = append(groups, added...)
+		return added
+	}
+	level := add(res.Entries)
+	for depth := 0; depth < al.config.NestedGroupDepth && len(level) > 0; depth++ {
+		var next []EntryMap
+		for _, group := range level {
+			filter := al.RenderTpl(NestedGroupSearchFilter, map[string]interface{}{
+				"UserName": tplCtx["UserName"],
+				"User":     tplCtx["User"],
+				"Group":    group,
+			})
+			res, err := al.search(conn, al.config.GroupSearchBase, filter, al.config.GroupSearchGetAttributes)
+			if err != nil {
+				return nil, errors.Wrapf(err, "cannot search the groups of %s", group.DN())
+			}
+			next = append(next, add(res.Entries)...)
+		}
+		level = next
+	}
+	return groups, nil
+}
+
+// Connect to the first available directory server, with TLS if configured
+func (al *AuthLDAP) connect() (*ldap.Conn, error) {
+	var lastErr error
+	for _, s := range al.serverList() {
+		conn, err := al.connectServer(s)
+		if err != nil {
+			al.log.WithError(err).WithField("server", s.String()).Warn("cannot connect to directory server")
+			al.health.markDown(s.host(), time.Duration(al.config.FailoverBackoff)*time.Second)
+			lastErr = err
+			continue
+		}
+		al.health.markUp(s.host())
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+func (al *AuthLDAP) connectServer(s *server) (*ldap.Conn, error) {
+	// Set ldap package level dial timeout as it doesn't offer any other way
+	ldap.DefaultTimeout = time.Second * time.Duration(al.config.Timeout)
+	tlsConfig := al.tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = s.url.Hostname()
+	}
+	var (
+		conn *ldap.Conn
+		err  error
+	)
+	switch s.connectMode {
+	case ConnectModeLDAPS:
+		conn, err = al.dialTLS(s.host(), tlsConfig)
+	default:
+		conn, err = ldap.Dial("tcp", s.host())
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(time.Second * time.Duration(al.config.Timeout))
+	if s.connectMode == ConnectModeStartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Like ldap.DialTLS but with the timeout also for the TLS handshake
+func (al *AuthLDAP) dialTLS(host string, tlsConfig *tls.Config) (*ldap.Conn, error) {
+	timeout := time.Second * time.Duration(al.config.Timeout)
+	dc, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(dc, tlsConfig)
+	tc.SetDeadline(time.Now().Add(timeout))
+	if err := tc.Handshake(); err != nil {
+		dc.Close()
+		return nil, errors.Wrap(err, "TLS handshake failed")
+	}
+	tc.SetDeadline(time.Time{})
+	conn := ldap.NewConn(tc, true)
+	conn.Start()
+	return conn, nil
+}
+
+// Check that the directory server is reachable and the TLS handshake
+// succeeds. Binding requires user credentials so it is not attempted
+func (al *AuthLDAP) Probe() error {
+	conn, err := al.connect()
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to directory server")
+	}
+	conn.Close()
+	return nil
+}
+
+// Values of an attribute of the user entry, for backends looking up users
+// without their password, like the SSH public keys for authsshkey. Requires
+// a service account
+func (al *AuthLDAP) UserAttribute(username, attribute string) ([]string, error) {
+	if al.pool == nil {
+		return nil, errors.New("serviceBindDN is required for user lookups")
+	}
+	conn, err := al.acquire()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to directory server")
+	}
+	broken := true
+	defer func() { al.release(conn, broken) }()
+	// Nothing has verified the user name
+	filter := al.RenderTpl(UserSearchFilter, map[string]interface{}{
+		"UserName": ldap.EscapeFilter(username),
+	})
+	res, err := al.search(conn, al.config.UserSearchBase, filter, []string{attribute})
+	if err != nil {
+		return nil, errors.Wrap(err, "search failure")
+	}
+	broken = false
+	if len(res.Entries) != 1 {
+		return nil, errors.Errorf("not a single match for %s: %d", username, len(res.Entries))
+	}
+	return res.Entries[0].GetAttributeValues(attribute), nil
+}
+
 func (al *AuthLDAP) search(conn *ldap.Conn, base, filter string, attrs []string) (*ldap.SearchResult, error) {
 	al.log.WithFields(logrus.Fields{
 		"base":   base,
@@ -168,6 +417,32 @@ func (al *AuthLDAP) search(conn *ldap.Conn, base, filter string, attrs []string)
 	return conn.Search(sr)
 }
 
+// Group names exposed to the principal mapping are taken from the first
+// fetched group attribute
+func (al *AuthLDAP) groupNameAttribute() string {
+	if len(al.config.GroupSearchGetAttributes) > 0 {
+		return al.config.GroupSearchGetAttributes[0]
+	}
+	return "cn"
+}
+
+// Each line of the output is a principal. Missing attributes render as
+// <no value> and are skipped
+func (al *AuthLDAP) renderPrincipals(name string, data interface{}) []string {
+	var r []string
+	for _, line := range strings.Split(al.RenderTpl(name, data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line != "<no value>" {
+			r = append(r, line)
+		}
+	}
+	return r
+}
+
+func userPrincipalTpl(i int) string {
+	return fmt.Sprintf("%s%d", UserPrincipal, i)
+}
+
 func (al *AuthLDAP) RenderTpl(name string, data interface{}) string {
 	buf := bytes.NewBuffer([]byte{})
 	err := al.tpls.ExecuteTemplate(buf, name, data)
@@ -199,7 +474,10 @@ func New(conf *Config) (*AuthLDAP, error) {
 	}
 
 	var tplError error
-	rootTpl := template.New("root")
+	rootTpl := template.New("root").Funcs(util.TemplateFuncs).Funcs(template.FuncMap{
+		// Attribute values as a list, single values are strings
+		"values": values,
+	})
 	parseTpl := func(name, tpl string) {
 		_, err := rootTpl.New(name).Parse(tpl)
 		if err != nil {
@@ -209,41 +487,107 @@ func New(conf *Config) (*AuthLDAP, error) {
 	parseTpl(UserBindDN, conf.UserBindDN)
 	parseTpl(UserSearchFilter, conf.UserSearchFilter)
 	parseTpl(GroupSearchFilter, conf.GroupSearchFilter)
+	parseTpl(NestedGroupSearchFilter, conf.NestedGroupSearchFilter)
 	parseTpl(SubjectName, conf.SubjectNameTemplate)
 	parseTpl(Principal, conf.PrincipalTemplate)
+	for i, tpl := range conf.UserPrincipalTemplates {
+		parseTpl(userPrincipalTpl(i), tpl)
+	}
 	if tplError != nil {
 		return nil, tplError
 	}
 
-	url, err := url.Parse(conf.ServerURL)
+	var servers []*server
+	for _, u := range append([]string{conf.ServerURL}, conf.ServerURLs...) {
+		s, err := parseServerURL(u, conf.StartTLS)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, s)
+	}
+	tlsConfig, err := newTLSConfig(conf)
 	if err != nil {
-		return nil, errors.Wrap(err, "cannot parse ServerURL")
+		return nil, err
 	}
-	connectMode := ConnectModePlain
-	switch url.Scheme {
-	case "ldap":
-		if url.Query().Get("startTLS") != "" {
-			connectMode = ConnectModeStartTLS
+	for _, s := range servers {
+		if tlsConfig.Certificates != nil && s.connectMode == ConnectModePlain {
+			return nil, errors.New("client certificate requires ldaps or StartTLS")
 		}
-	case "ldaps":
-		connectMode = ConnectModeLDAPS
-	default:
-		return nil, errors.Errorf("unsupported scheme: %s", url.Scheme)
-	}
-	if url.Port() == "" {
-		return nil, errors.New("missing port for the ServerURL")
 	}
 
-	return &AuthLDAP{
+	al := &AuthLDAP{
 		log: Log.WithFields(logrus.Fields{
 			"realm": conf.Realm,
 			"name":  conf.Name,
 		}),
-		config:      conf,
-		url:         url,
-		connectMode: connectMode,
-		tpls:        rootTpl,
-	}, nil
+		config:    conf,
+		servers:   servers,
+		health:    &serverHealth{downUntil: map[string]time.Time{}},
+		tlsConfig: tlsConfig,
+		userAttrs: conf.UserSearchGetAttributes,
+		tpls:      rootTpl,
+	}
+	if attr := conf.PasswordExpiryAttribute; attr != "" && !hasAttribute(al.userAttrs, attr) {
+		al.userAttrs = append(append([]string(nil), al.userAttrs...), attr)
+	}
+	for _, attr := range conf.IdentityAttributes {
+		if !hasAttribute(al.userAttrs, attr) {
+			al.userAttrs = append(append([]string(nil), al.userAttrs...), attr)
+		}
+	}
+	if conf.GroupCacheTTL > 0 || conf.GroupCacheNegativeTTL > 0 {
+		if conf.GroupCacheSize < 1 {
+			return nil, errors.New("groupCacheSize must be positive")
+		}
+		al.groupCache = newGroupCache(
+			conf.Name,
+			time.Duration(conf.GroupCacheTTL)*time.Second,
+			time.Duration(conf.GroupCacheNegativeTTL)*time.Second,
+			conf.GroupCacheSize,
+		)
+	}
+	if al.groupFilter, err = newGroupFilter(conf.AllowedGroups, conf.AllowedGroupBases); err != nil {
+		return nil, err
+	}
+	if conf.ServiceBindDN != "" {
+		if conf.MaxConnections < 1 {
+			return nil, errors.New("maxConnections must be positive")
+		}
+		al.pool = newConnPool(
+			conf.MaxConnections,
+			time.Duration(conf.IdleTimeout)*time.Second,
+			time.Duration(conf.Timeout)*time.Second,
+			al.dialService,
+			al.serviceBind,
+		)
+	}
+	return al, nil
+}
+
+// Without ServerName the name of each server is verified
+func newTLSConfig(conf *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: conf.Insecure,
+		ServerName:         conf.ServerName,
+	}
+	if conf.CAFile != "" {
+		pem, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read caFile")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in caFile")
+		}
+	}
+	if conf.ClientCertFile != "" || conf.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.ClientCertFile, conf.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
 }
 
 type EntryMap map[string]interface{}
@@ -264,6 +608,26 @@ func (em EntryMap) Get(k string) string {
 	return ""
 }
 
+// Values of the attribute, whose name is case insensitive
+func (em EntryMap) Values(attr string) []string {
+	for k, v := range em {
+		if strings.EqualFold(k, attr) {
+			return values(v)
+		}
+	}
+	return nil
+}
+
+func values(v interface{}) []string {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case string:
+		return []string{v}
+	}
+	return nil
+}
+
 func entryToMap(entry *ldap.Entry) EntryMap {
 	ret := make(map[string]interface{})
 	ret["dn"] = []string{entry.DN}
@@ -3,16 +3,30 @@
 package authldap
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strconv"
 	"io/ioutil"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/aakso/ssh-inscribe/pkg/auth"
 	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/vjeantet/ldapserver"
 )
@@ -89,6 +103,348 @@ func TestAuthenticateNoUserNamePrincipal(t *testing.T) {
 	assert.NotContains(actx.Principals, TestUser)
 }
 
+func TestNestedGroups(t *testing.T) {
+	assert := assert.New(t)
+	conf := testConf
+	conf.NestedGroupSearchFilter = "(&(objectClass=group)(member={{.Group.DN}}))"
+	conf.NestedGroupDepth = 1
+	inst, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	creds := &auth.Credentials{
+		UserIdentifier: TestUser,
+		Secret:         []byte(TestPassword),
+	}
+	actx, ok := inst.Authenticate(nil, creds)
+	assert.True(ok)
+	if assert.NotNil(actx) {
+		assert.Equal([]string{TestGroupCN1, TestGroupCN2, TestParentGroupCN}, actx.GetGroups())
+	}
+
+	// Test Group 1 is found again through the grandparent
+	conf.NestedGroupDepth = 5
+	actx, ok = inst.Authenticate(nil, creds)
+	assert.True(ok)
+	if assert.NotNil(actx) {
+		assert.Equal([]string{TestGroupCN1, TestGroupCN2, TestParentGroupCN, TestGrandparentGroupCN}, actx.GetGroups())
+		assert.Contains(actx.Principals, TestGrandparentGroupCN)
+	}
+}
+
+func TestAllowedGroups(t *testing.T) {
+	assert := assert.New(t)
+	conf := testConf
+	conf.NestedGroupSearchFilter = "(&(objectClass=group)(member={{.Group.DN}}))"
+	conf.NestedGroupDepth = 5
+	creds := &auth.Credentials{
+		UserIdentifier: TestUser,
+		Secret:         []byte(TestPassword),
+	}
+	groups := func() []string {
+		inst, err := New(&conf)
+		if !assert.NoError(err) {
+			return nil
+		}
+		actx, ok := inst.Authenticate(nil, creds)
+		if !assert.True(ok) {
+			return nil
+		}
+		for _, g := range actx.GetGroups() {
+			assert.Contains(actx.Principals, g)
+		}
+		return actx.GetGroups()
+	}
+
+	// Nested groups are found through the groups left out
+	conf.AllowedGroups = []string{"test group 1", "*PARENT*"}
+	assert.Equal([]string{TestGroupCN1, TestParentGroupCN, TestGrandparentGroupCN}, groups())
+	conf.AllowedGroups = []string{"cn=test group 2,cn=groups,*"}
+	assert.Equal([]string{TestGroupCN2}, groups())
+
+	conf.AllowedGroups = nil
+	conf.AllowedGroupBases = []string{"CN=Groups,DC=example,DC=com"}
+	assert.Equal([]string{TestGroupCN1, TestGroupCN2, TestParentGroupCN, TestGrandparentGroupCN}, groups())
+	conf.AllowedGroupBases = []string{"ou=ssh,cn=groups,dc=example,dc=com", "dc=example,dc=org"}
+	assert.Empty(groups())
+
+	conf.AllowedGroupBases = []string{"not a dn"}
+	_, err := New(&conf)
+	assert.Error(err)
+}
+
+func TestFailover(t *testing.T) {
+	assert := assert.New(t)
+	conf := testConf
+	conf.UserNamePrincipal = true
+	conf.Timeout = 1
+	conf.ServerURL = "ldap://127.0.0.1:1"
+	conf.ServerURLs = []string{testConf.ServerURL}
+	inst, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	creds := &auth.Credentials{
+		UserIdentifier: TestUser,
+		Secret:         []byte(TestPassword),
+	}
+	actx, ok := inst.Authenticate(nil, creds)
+	assert.True(ok)
+	assert.NotNil(actx)
+	// The failed server is tried last
+	if assert.Len(inst.serverList(), 2) {
+		assert.Equal(testConf.ServerURL, inst.serverList()[0].String())
+		assert.True(inst.health.isDown("127.0.0.1:1"))
+	}
+	assert.NoError(inst.Probe())
+
+	// All down
+	conf.ServerURLs = []string{"ldap://127.0.0.1:2"}
+	inst, err = New(&conf)
+	if assert.NoError(err) {
+		_, ok = inst.Authenticate(nil, creds)
+		assert.False(ok)
+		assert.Error(inst.Probe())
+	}
+}
+
+func TestSRVDiscovery(t *testing.T) {
+	assert := assert.New(t)
+	defer func() { lookupSRV = net.LookupSRV }()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(testConf.ServerURL, "ldap://"))
+	p, _ := strconv.Atoi(port)
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_ldap._tcp.example.com" {
+			return "", nil, errors.New("no such host")
+		}
+		return "", []*net.SRV{
+			{Target: "127.0.0.1.", Port: 1, Priority: 0},
+			{Target: host + ".", Port: uint16(p), Priority: 10},
+		}, nil
+	}
+	conf := testConf
+	conf.Timeout = 1
+	conf.ServerURL = "ldap://ldap.example.com:389"
+	conf.SRVName = "_ldap._tcp.example.com"
+	inst, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	actx, ok := inst.Authenticate(nil, &auth.Credentials{
+		UserIdentifier: TestUser,
+		Secret:         []byte(TestPassword),
+	})
+	assert.True(ok)
+	assert.NotNil(actx)
+
+	// Falls back to the configured servers
+	conf.SRVName = "_ldap._tcp.example.org"
+	inst, err = New(&conf)
+	if assert.NoError(err) {
+		if assert.Len(inst.serverList(), 1) {
+			assert.Equal("ldap://ldap.example.com:389", inst.serverList()[0].String())
+		}
+	}
+}
+
+func TestServiceAccountPool(t *testing.T) {
+	assert := assert.New(t)
+	conf := testConf
+	conf.Timeout = 1
+	conf.ServiceBindDN = TestService
+	conf.ServiceBindPassword = TestServicePassword
+	conf.MaxConnections = 1
+	inst, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	creds := &auth.Credentials{
+		UserIdentifier: TestUser,
+		Secret:         []byte(TestPassword),
+	}
+	actx, ok := inst.Authenticate(nil, creds)
+	assert.True(ok)
+	if assert.NotNil(actx) {
+		assert.Equal(TestUserCN, actx.SubjectName)
+		assert.Contains(actx.Principals, TestGroupCN1)
+	}
+	if !assert.Len(inst.pool.idle, 1) {
+		return
+	}
+	conn := inst.pool.idle[0].conn
+
+	// The connection is reused also after a failed login
+	_, ok = inst.Authenticate(nil, &auth.Credentials{UserIdentifier: TestUser, Secret: []byte("invalid")})
+	assert.False(ok)
+	_, ok = inst.Authenticate(nil, &auth.Credentials{UserIdentifier: TestUser})
+	assert.False(ok, "empty password")
+	actx, ok = inst.Authenticate(nil, creds)
+	assert.True(ok)
+	if assert.Len(inst.pool.idle, 1) {
+		assert.True(conn == inst.pool.idle[0].conn)
+	}
+
+	// Bounded by the pool size
+	c, err := inst.pool.get()
+	if assert.NoError(err) {
+		_, ok = inst.Authenticate(nil, creds)
+		assert.False(ok)
+		inst.pool.put(c, false)
+	}
+
+	// Expired idle connections are closed
+	inst.pool.idle[0].ts = time.Now().Add(-time.Hour)
+	_, ok = inst.Authenticate(nil, creds)
+	assert.True(ok)
+	if assert.Len(inst.pool.idle, 1) {
+		assert.False(conn == inst.pool.idle[0].conn)
+	}
+
+	conf.ServiceBindPassword = "invalid"
+	inst, err = New(&conf)
+	if assert.NoError(err) {
+		_, ok = inst.Authenticate(nil, creds)
+		assert.False(ok)
+		assert.Empty(inst.pool.idle)
+	}
+}
+
+func TestIdentityAttributes(t *testing.T) {
+	assert := assert.New(t)
+	conf := testConf
+	conf.IdentityAttributes = map[string]string{
+		auth.IdentityEmployeeID: "EmployeeID",
+		"email":                 "mail",
+		"none":                  "missing",
+	}
+	inst, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Contains(inst.userAttrs, "mail")
+	actx, ok := inst.Authenticate(nil, &auth.Credentials{
+		UserIdentifier: TestUser,
+		Secret:         []byte(TestPassword),
+	})
+	if assert.True(ok) {
+		assert.Equal(map[string]interface{}{
+			auth.IdentityEmployeeID: "1234",
+			auth.IdentityMFA:        []string{"pwd"},
+			"email":                 []string{"test@example.com", "test.user@example.com"},
+		}, actx.GetIdentity())
+	}
+}
+
+func TestUserAttribute(t *testing.T) {
+	assert := assert.New(t)
+	conf := testConf
+	conf.Timeout = 1
+	inst, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = inst.UserAttribute(TestUser, "mail")
+	assert.Error(err, "no service account")
+
+	conf.ServiceBindDN = TestService
+	conf.ServiceBindPassword = TestServicePassword
+	conf.MaxConnections = 1
+	inst, err = New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	mail, err := inst.UserAttribute(TestUser, "mail")
+	if assert.NoError(err) {
+		assert.Equal([]string{"test@example.com", "test.user@example.com"}, mail)
+	}
+	_, err = inst.UserAttribute("nobody", "mail")
+	assert.Error(err)
+}
+
+func TestPrincipalTemplates(t *testing.T) {
+	assert := assert.New(t)
+	conf := testConf
+	conf.UserNamePrincipal = false
+	conf.UserPrincipalTemplates = []string{
+		"emp-{{.User.employeeID}}",
+		"{{range values .User.mail}}{{.}}\n{{end}}",
+		"{{.User.nonexistent}}",
+	}
+	conf.PrincipalTemplate = `{{if hasPrefix "Test Group" .Group.cn}}{{trimPrefix "Test " .Group.cn | lower | replace " " "-"}}{{end}}`
+	conf.NestedGroupDepth = 1
+	inst, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	actx, ok := inst.Authenticate(nil, &auth.Credentials{
+		UserIdentifier: TestUser,
+		Secret:         []byte(TestPassword),
+	})
+	assert.True(ok)
+	if assert.NotNil(actx) {
+		assert.Equal([]string{"emp-1234", "test@example.com", "test.user@example.com", "group-1", "group-2"}, actx.Principals)
+	}
+
+	conf.UserPrincipalTemplates = []string{"{{.User.uid"}
+	_, err = New(&conf)
+	assert.Error(err)
+}
+
+func TestGroupCache(t *testing.T) {
+	assert := assert.New(t)
+	conf := testConf
+	conf.Name = "cached"
+	conf.GroupCacheTTL = 60
+	inst, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	creds := &auth.Credentials{
+		UserIdentifier: TestUser,
+		Secret:         []byte(TestPassword),
+	}
+	atomic.StoreInt32(&groupSearches, 0)
+	for i := 0; i < 3; i++ {
+		actx, ok := inst.Authenticate(nil, creds)
+		assert.True(ok)
+		if assert.NotNil(actx) {
+			assert.Equal([]string{TestGroupCN1, TestGroupCN2}, actx.GetGroups())
+		}
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&groupSearches))
+	assert.Equal(float64(1), testutil.ToFloat64(metricGroupCache.WithLabelValues("cached", "miss")))
+	assert.Equal(float64(2), testutil.ToFloat64(metricGroupCache.WithLabelValues("cached", "hit")))
+
+	// The password is still verified
+	_, ok := inst.Authenticate(nil, &auth.Credentials{UserIdentifier: TestUser, Secret: []byte("invalid")})
+	assert.False(ok)
+
+	// Expired
+	for k, e := range inst.groupCache.entries {
+		e.expires = time.Now().Add(-time.Second)
+		inst.groupCache.entries[k] = e
+	}
+	_, ok = inst.Authenticate(nil, creds)
+	assert.True(ok)
+	assert.Equal(int32(2), atomic.LoadInt32(&groupSearches))
+
+	// Users without groups are cached only with the negative TTL
+	inst.groupCache.set("nogroups", nil)
+	_, ok = inst.groupCache.get("nogroups")
+	assert.False(ok)
+	inst.groupCache.negativeTTL = time.Minute
+	inst.groupCache.set("nogroups", nil)
+	_, ok = inst.groupCache.get("NoGroups")
+	assert.True(ok)
+	assert.Equal(float64(1), testutil.ToFloat64(metricGroupCache.WithLabelValues("cached", "negative_hit")))
+
+	// Full
+	inst.groupCache.size = 2
+	inst.groupCache.set("another", []EntryMap{{}})
+	_, ok = inst.groupCache.get("another")
+	assert.False(ok)
+}
+
 func TestAuthFail(t *testing.T) {
 	assert := assert.New(t)
 	actx, ok := testInst.Authenticate(nil, &auth.Credentials{
@@ -98,3 +454,176 @@ func TestAuthFail(t *testing.T) {
 	assert.False(ok)
 	assert.Nil(actx)
 }
+
+func TestPasswordExpiry(t *testing.T) {
+	assert := assert.New(t)
+	creds := &auth.Credentials{
+		UserIdentifier: TestExpiredUser,
+		Secret:         []byte(TestPassword),
+	}
+	_, ok := testInst.Authenticate(nil, creds)
+	assert.False(ok)
+	assert.Equal(auth.PasswordExpired, creds.Meta[auth.MetaPasswordFailure])
+
+	// Wrong passwords are not detailed
+	creds = &auth.Credentials{UserIdentifier: TestExpiredUser, Secret: []byte("invalid")}
+	_, ok = testInst.Authenticate(nil, creds)
+	assert.False(ok)
+	assert.Nil(creds.Meta[auth.MetaPasswordFailure])
+
+	conf := testConf
+	conf.PasswordExpiryAttribute = "msDS-UserPasswordExpiryTimeComputed"
+	inst, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	actx, ok := inst.Authenticate(nil, &auth.Credentials{UserIdentifier: TestUser, Secret: []byte(TestPassword)})
+	if assert.True(ok) {
+		expires, err := time.Parse(time.RFC3339, actx.GetMetaString(auth.MetaPasswordExpires))
+		assert.NoError(err)
+		assert.WithinDuration(time.Now().Add(72*time.Hour), expires, time.Minute)
+	}
+	conf.PasswordExpiryWarning = 3600
+	inst, _ = New(&conf)
+	actx, ok = inst.Authenticate(nil, &auth.Credentials{UserIdentifier: TestUser, Secret: []byte(TestPassword)})
+	if assert.True(ok) {
+		assert.Empty(actx.GetMetaString(auth.MetaPasswordExpires))
+	}
+
+	for v, want := range map[string]time.Time{
+		"":                    {},
+		"0":                   {},
+		"9223372036854775807": {},
+		"133000000000000000":  time.Date(2022, 6, 18, 4, 26, 40, 0, time.UTC),
+		"20261015120000Z":     time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC),
+	} {
+		got, err := parseExpiryTime(v)
+		assert.NoError(err)
+		assert.True(want.Equal(got), v)
+	}
+	_, err = parseExpiryTime("soon")
+	assert.Error(err)
+}
+
+func TestProbe(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(testInst.Probe())
+
+	conf := testConf
+	conf.ServerURL = "ldap://127.0.0.1:1"
+	conf.Timeout = 1
+	inst, err := New(&conf)
+	if assert.NoError(err) {
+		assert.Error(inst.Probe())
+		// Not counted as wrong credentials
+		creds := &auth.Credentials{UserIdentifier: TestUser, Secret: []byte(TestPassword)}
+		_, ok := inst.Authenticate(nil, creds)
+		assert.False(ok)
+		assert.True(creds.BackendError())
+	}
+}
+
+// Write a certificate signed by the parent, self-signed without one
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "authldap")
+	defer os.RemoveAll(dir)
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	clients := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tc := conn.(*tls.Conn)
+			if err := tc.Handshake(); err == nil {
+				clients <- tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			conn.Close()
+		}
+	}()
+
+	conf := testConf
+	conf.ServerURL = "ldaps://" + l.Addr().String()
+	conf.CAFile = filepath.Join(dir, "ca.crt")
+	conf.ClientCertFile = filepath.Join(dir, "client.crt")
+	conf.ClientKeyFile = filepath.Join(dir, "client.key")
+	inst, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(inst.Probe())
+	select {
+	case cn := <-clients:
+		assert.Equal("client", cn)
+	case <-time.After(5 * time.Second):
+		t.Error("no connection")
+	}
+
+	// The CA must match the server
+	conf.CAFile = filepath.Join(dir, "client.crt")
+	inst, err = New(&conf)
+	if assert.NoError(err) {
+		assert.Error(inst.Probe())
+	}
+
+	conf.CAFile = filepath.Join(dir, "nonexistent")
+	_, err = New(&conf)
+	assert.Error(err, "missing caFile")
+
+	conf.CAFile = ""
+	conf.ServerURL = "ldap://127.0.0.1:389"
+	_, err = New(&conf)
+	assert.Error(err, "client certificate without TLS")
+	conf.StartTLS = true
+	inst, err = New(&conf)
+	if assert.NoError(err) {
+		assert.Equal(ConnectModeStartTLS, inst.servers[0].connectMode)
+	}
+}
@@ -0,0 +1,86 @@
+package authldap
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricGroupCache = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ssh_inscribe_ldap_group_cache_total",
+		Help: "LDAP group membership cache lookups by auth backend and result",
+	},
+	[]string{"backend", "result"},
+)
+
+type groupCacheEntry struct {
+	groups  []EntryMap
+	expires time.Time
+}
+
+// Group memberships by user. Users without groups are cached with their own
+// TTL so that a new membership is picked up sooner
+type groupCache struct {
+	name        string
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+
+	sync.Mutex
+	entries map[string]groupCacheEntry
+}
+
+func newGroupCache(name string, ttl, negativeTTL time.Duration, size int) *groupCache {
+	return &groupCache{
+		name:        name,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		size:        size,
+		entries:     map[string]groupCacheEntry{},
+	}
+}
+
+func (c *groupCache) get(user string) ([]EntryMap, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[strings.ToLower(user)]
+	if !ok || time.Now().After(e.expires) {
+		metricGroupCache.WithLabelValues(c.name, "miss").Inc()
+		return nil, false
+	}
+	if len(e.groups) == 0 {
+		metricGroupCache.WithLabelValues(c.name, "negative_hit").Inc()
+	} else {
+		metricGroupCache.WithLabelValues(c.name, "hit").Inc()
+	}
+	return e.groups, true
+}
+
+func (c *groupCache) set(user string, groups []EntryMap) {
+	ttl := c.ttl
+	if len(groups) == 0 {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	if len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Still full, the entries expire eventually
+		if len(c.entries) >= c.size {
+			return
+		}
+	}
+	c.entries[strings.ToLower(user)] = groupCacheEntry{groups: groups, expires: now.Add(ttl)}
+}
@@ -1,12 +1,38 @@
 package authldap
 
 type Config struct {
-	Name                     string
-	Realm                    string
-	ServerURL                string `yaml:"serverURL"`
-	Timeout                  int
-	Insecure                 bool
-	UserBindDN               string   `yaml:"userBindDN"`
+	Name      string
+	Realm     string
+	ServerURL string `yaml:"serverURL"`
+	// Failover servers tried in order when the previous ones are down
+	ServerURLs []string `yaml:"serverURLs"`
+	// Discover the servers from this SRV record, e.g.
+	// _ldap._tcp.example.com. The scheme of ServerURL applies to them
+	SRVName string `yaml:"srvName"`
+	// Seconds to prefer the other servers after a connection failure
+	FailoverBackoff int `yaml:"failoverBackoff"`
+	Timeout         int
+	Insecure        bool
+	// Upgrade ldap:// connections with StartTLS, like ?startTLS=true in
+	// the URL
+	StartTLS bool `yaml:"startTLS"`
+	// CA certificates to verify the server certificate
+	CAFile string `yaml:"caFile"`
+	// Name to verify the server certificate against, defaults to the host
+	ServerName string `yaml:"serverName"`
+	// Client certificate for servers requiring mutual TLS
+	ClientCertFile string `yaml:"clientCertFile"`
+	ClientKeyFile  string `yaml:"clientKeyFile"`
+	UserBindDN     string `yaml:"userBindDN"`
+	// Service account for the searches. The connections bound with it are
+	// pooled and the users are verified by binding with UserBindDN after
+	// the searches, which can then refer to {{.User.DN}}
+	ServiceBindDN       string `yaml:"serviceBindDN"`
+	ServiceBindPassword string `yaml:"serviceBindPassword"`
+	// Size of the connection pool with a service account
+	MaxConnections int `yaml:"maxConnections"`
+	// Seconds to keep idle pooled connections
+	IdleTimeout              int      `yaml:"idleTimeout"`
 	UserSearchBase           string   `yaml:"userSearchBase"`
 	UserSearchFilter         string   `yaml:"userSearchFilter"`
 	UserSearchGetAttributes  []string `yaml:"userSearchGetAttributes"`
@@ -14,8 +40,41 @@ type Config struct {
 	GroupSearchBase          string   `yaml:"groupSearchBase"`
 	GroupSearchFilter        string   `yaml:"groupSearchFilter"`
 	GroupSearchGetAttributes []string `yaml:"groupSearchGetAttributes"`
-	SubjectNameTemplate      string   `yaml:"subjectNameTemplate"`
-	PrincipalTemplate        string   `yaml:"principalTemplate"`
+	// Only these groups become principals and are passed on as the groups
+	// of the user, as names or DNs or glob patterns of them. Compared case
+	// insensitively. Empty allows every group found
+	AllowedGroups []string `yaml:"allowedGroups"`
+	// Only the groups at or under these DNs, so that groups created or
+	// moved elsewhere in the directory are ignored
+	AllowedGroupBases []string `yaml:"allowedGroupBases"`
+	// Resolve nested groups by searching the groups of the found groups
+	// with NestedGroupSearchFilter, up to this many levels. Not needed with
+	// the AD LDAP_MATCHING_RULE_IN_CHAIN in GroupSearchFilter
+	NestedGroupDepth        int    `yaml:"nestedGroupDepth"`
+	NestedGroupSearchFilter string `yaml:"nestedGroupSearchFilter"`
+	// Seconds to cache the groups of a user, and of a user without groups.
+	// Zero disables
+	GroupCacheTTL         int `yaml:"groupCacheTTL"`
+	GroupCacheNegativeTTL int `yaml:"groupCacheNegativeTTL"`
+	// Maximum number of cached users
+	GroupCacheSize int `yaml:"groupCacheSize"`
+	// Attribute of the user entry with the password expiry time, an AD
+	// FILETIME like msDS-UserPasswordExpiryTimeComputed or a generalized
+	// time like krbPasswordExpiration
+	PasswordExpiryAttribute string `yaml:"passwordExpiryAttribute"`
+	// Seconds before the password expires to warn the user at login
+	PasswordExpiryWarning int `yaml:"passwordExpiryWarning"`
+	// Identity attributes for the key id and the certificate extensions
+	// from the attributes of the user entry, e.g. employee_id:
+	// employeeNumber. The attributes are fetched in the user search
+	IdentityAttributes map[string]string `yaml:"identityAttributes"`
+
+	SubjectNameTemplate string `yaml:"subjectNameTemplate"`
+	PrincipalTemplate   string `yaml:"principalTemplate"`
+	// Principals from the attributes of the user entry, e.g.
+	// {{.User.uid}}. The attributes need to be in UserSearchGetAttributes.
+	// Each line of the output is a principal
+	UserPrincipalTemplates []string `yaml:"userPrincipalTemplates"`
 
 	UserNamePrincipal bool `yaml:"userNamePrincipal"`
 	Principals        []string
@@ -28,8 +87,11 @@ var Defaults *Config = &Config{
 	Realm:                    DefaultRealm,
 	ServerURL:                "ldaps://127.0.0.1:636",
 	Timeout:                  5,
+	FailoverBackoff:          30,
 	Insecure:                 false,
 	UserBindDN:               "cn={{.UserName}},dc=example,dc=com",
+	MaxConnections:           10,
+	IdleTimeout:              60,
 	UserSearchBase:           "dc=example,dc=com",
 	UserSearchFilter:         "(&(objectClass=user)(sAMAccountName={{.UserName}}))",
 	UserSearchGetAttributes:  []string{"cn", "displayName"},
@@ -37,6 +99,10 @@ var Defaults *Config = &Config{
 	GroupSearchBase:          "dc=example,dc=com",
 	GroupSearchFilter:        "(&(objectClass=group)(member:1.2.840.113556.1.4.1941:={{.User.DN}}))",
 	GroupSearchGetAttributes: []string{"cn"},
+	NestedGroupDepth:         0,
+	NestedGroupSearchFilter:  "(&(objectClass=group)(member={{.Group.DN}}))",
+	GroupCacheSize:           10000,
+	PasswordExpiryWarning:    14 * 24 * 3600,
 	SubjectNameTemplate:      "{{.User.displayName}}",
 	PrincipalTemplate:        "{{.Group.cn}}",
 
@@ -0,0 +1,96 @@
+package authldap
+
+import (
+	"strings"
+
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// Groups that may become principals, by name or DN and by the subtree they
+// are in
+type groupFilter struct {
+	patterns []glob.Glob
+	bases    []*ldap.DN
+}
+
+func newGroupFilter(patterns, bases []string) (*groupFilter, error) {
+	if len(patterns) == 0 && len(bases) == 0 {
+		return nil, nil
+	}
+	gf := &groupFilter{}
+	for _, p := range patterns {
+		g, err := glob.Compile(strings.ToLower(p))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid allowedGroups pattern %s", p)
+		}
+		gf.patterns = append(gf.patterns, g)
+	}
+	for _, b := range bases {
+		dn, err := ldap.ParseDN(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid allowedGroupBases DN %s", b)
+		}
+		gf.bases = append(gf.bases, dn)
+	}
+	return gf, nil
+}
+
+// Whether the group with the name and DN passes both the patterns and the
+// bases. Names and DNs are compared case insensitively like directories do
+func (gf *groupFilter) allows(name, dn string) bool {
+	if len(gf.bases) > 0 {
+		parsed, err := ldap.ParseDN(dn)
+		if err != nil {
+			return false
+		}
+		under := false
+		for _, b := range gf.bases {
+			under = under || dnUnder(parsed, b)
+		}
+		if !under {
+			return false
+		}
+	}
+	if len(gf.patterns) == 0 {
+		return true
+	}
+	name, dn = strings.ToLower(name), strings.ToLower(dn)
+	for _, p := range gf.patterns {
+		if (name != "" && p.Match(name)) || p.Match(dn) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the DN is the base or in the subtree below it
+func dnUnder(dn, base *ldap.DN) bool {
+	if len(base.RDNs) > len(dn.RDNs) {
+		return false
+	}
+	tail := dn.RDNs[len(dn.RDNs)-len(base.RDNs):]
+	for i, rdn := range base.RDNs {
+		if !rdnEqualFold(rdn, tail[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func rdnEqualFold(a, b *ldap.RelativeDN) bool {
+	if len(a.Attributes) != len(b.Attributes) {
+		return false
+	}
+	for _, x := range a.Attributes {
+		found := false
+		for _, y := range b.Attributes {
+			found = found || (strings.EqualFold(x.Type, y.Type) && strings.EqualFold(x.Value, y.Value))
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -18,6 +18,16 @@ const (
 )
 
 func factory(configsection string) (auth.Authenticator, error) {
+	al, err := FromConfig(configsection)
+	if err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// Backend from the configuration section, also for other backends looking
+// up users in the directory
+func FromConfig(configsection string) (*AuthLDAP, error) {
 	config.SetDefault(configsection, Defaults)
 	tmpconf, err := config.Get(configsection)
 	if err != nil {
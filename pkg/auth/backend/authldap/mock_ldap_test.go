@@ -4,18 +4,29 @@ package authldap
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/lor00x/goldap/message"
 	"github.com/sirupsen/logrus"
 	"github.com/vjeantet/ldapserver"
 )
 
 const (
-	TestUser     = "testuser"
-	TestUserCN   = "Test User"
-	TestPassword = "testpassword"
-	TestGroupCN1 = "Test Group 1"
-	TestGroupCN2 = "Test Group 2"
+	TestUser            = "testuser"
+	TestUserCN          = "Test User"
+	TestPassword        = "testpassword"
+	TestExpiredUser     = "expireduser"
+	TestService         = "service"
+	TestServicePassword = "servicepassword"
+	TestGroupCN1        = "Test Group 1"
+	TestGroupCN2        = "Test Group 2"
+	// Test Group 2 is a member of the parent which is a member of the
+	// grandparent which is a member of Test Group 1
+	TestParentGroupCN      = "Test Parent Group"
+	TestGrandparentGroupCN = "Test Grandparent Group"
 )
 
 func newTestServer(logger logrus.StdLogger) *ldapserver.Server {
@@ -42,13 +53,18 @@ func handleBind(w ldapserver.ResponseWriter, m *ldapserver.Message) {
 	r := m.GetBindRequest()
 	res := ldapserver.NewBindResponse(ldapserver.LDAPResultSuccess)
 
-	if string(r.Name()) == TestUser && string(r.AuthenticationSimple()) == TestPassword {
+	if string(r.Name()) == TestUser && string(r.AuthenticationSimple()) == TestPassword ||
+		string(r.Name()) == TestService && string(r.AuthenticationSimple()) == TestServicePassword {
 		w.Write(res)
 		return
 	}
 
 	res.SetResultCode(ldapserver.LDAPResultInvalidCredentials)
 	res.SetDiagnosticMessage("auth failed")
+	// Like AD with an expired password
+	if string(r.Name()) == TestExpiredUser && string(r.AuthenticationSimple()) == TestPassword {
+		res.SetDiagnosticMessage("80090308: LdapErr: DSID-0C09042A, comment: AcceptSecurityContext error, data 532, v3839")
+	}
 	w.Write(res)
 }
 
@@ -64,17 +80,46 @@ func handleUserSearch(w ldapserver.ResponseWriter, m *ldapserver.Message) {
 
 	e := ldapserver.NewSearchResultEntry("cn=" + TestUserCN + "," + string(r.BaseObject()))
 	e.AddAttribute("displayName", "Test User")
+	e.AddAttribute("employeeID", "1234")
+	e.AddAttribute("mail", "test@example.com", "test.user@example.com")
 	e.AddAttribute("cn", TestUserCN)
 	e.AddAttribute("objectClass", "user")
+	// AD FILETIME three days from now
+	expires := (time.Now().Add(72*time.Hour).Unix() + 11644473600) * 1e7
+	e.AddAttribute("msDS-UserPasswordExpiryTimeComputed", message.AttributeValue(strconv.FormatInt(expires, 10)))
 	w.Write(e)
 	w.Write(res)
 }
 
+// Number of group searches
+var groupSearches int32
+
 func handleGroupSearch(w ldapserver.ResponseWriter, m *ldapserver.Message) {
+	atomic.AddInt32(&groupSearches, 1)
 	r := m.GetSearchRequest()
 	res := ldapserver.NewSearchResultDoneResponse(ldapserver.LDAPResultSuccess)
 
+	// Nested groups
+	for member, group := range map[string]string{
+		TestGroupCN2:           TestParentGroupCN,
+		TestParentGroupCN:      TestGrandparentGroupCN,
+		TestGrandparentGroupCN: TestGroupCN1,
+	} {
+		if strings.Contains(r.FilterString(), "cn="+member+",") {
+			e := ldapserver.NewSearchResultEntry("cn=" + group + "," + string(r.BaseObject()))
+			e.AddAttribute("cn", message.AttributeValue(group))
+			e.AddAttribute("objectClass", "group")
+			w.Write(e)
+			w.Write(res)
+			return
+		}
+	}
 	if !strings.Contains(r.FilterString(), TestUserCN) {
+		// No memberships
+		if strings.Contains(r.FilterString(), "cn="+TestGroupCN1+",") {
+			w.Write(res)
+			return
+		}
 		res.SetResultCode(ldapserver.LDAPResultNoSuchObject)
 		w.Write(res)
 		return
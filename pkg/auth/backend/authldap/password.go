@@ -0,0 +1,77 @@
+package authldap
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/pkg/errors"
+)
+
+// AD reports why a bind failed as "data 532" in the diagnostic message. Only
+// the codes returned with the right password are passed on
+var adBindErrors = map[string]string{
+	"532": auth.PasswordExpired,
+	"773": auth.PasswordMustChange,
+}
+
+var adDataCode = regexp.MustCompile(`\bdata ([0-9a-f]+)\b`)
+
+// Bind as the user. Returns the reason a bind with the right password was
+// refused if the server tells it
+func bindUser(conn *ldap.Conn, binddn, password string) (failure string, err error) {
+	err = conn.Bind(binddn, password)
+	if le, ok := err.(*ldap.Error); ok && le.ResultCode == ldap.LDAPResultInvalidCredentials {
+		if m := adDataCode.FindStringSubmatch(le.Err.Error()); m != nil {
+			failure = adBindErrors[m[1]]
+		}
+	}
+	return failure, err
+}
+
+// Whether the bind failed because of the directory server rather than
+// the credentials
+func serverError(err error) bool {
+	for _, code := range []uint8{ldap.ErrorNetwork, ldap.LDAPResultBusy, ldap.LDAPResultUnavailable} {
+		if ldap.IsErrorWithCode(err, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expiry time from an attribute, either an AD FILETIME like
+// msDS-UserPasswordExpiryTimeComputed or a generalized time like
+// krbPasswordExpiration. Zero if the password does not expire
+func parseExpiryTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if n <= 0 || n == math.MaxInt64 {
+			return time.Time{}, nil
+		}
+		// 100 ns intervals since 1601
+		return time.Unix(n/1e7-11644473600, n%1e7*100), nil
+	}
+	t, err := time.Parse("20060102150405Z0700", v)
+	if err != nil {
+		return time.Time{}, errors.Errorf("cannot parse password expiry time %s", v)
+	}
+	return t, nil
+}
+
+// Attribute names are case insensitive
+func hasAttribute(attrs []string, name string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a, name) {
+			return true
+		}
+	}
+	return false
+}
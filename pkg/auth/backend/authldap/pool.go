@@ -0,0 +1,95 @@
+package authldap
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	ldap "gopkg.in/ldap.v2"
+)
+
+type idleConn struct {
+	conn *ldap.Conn
+	ts   time.Time
+}
+
+// Pool of connections bound with the service account. The number of
+// connections in use and idle is bounded by the size of the pool
+type connPool struct {
+	slots       chan struct{}
+	idleTimeout time.Duration
+	waitTimeout time.Duration
+	// Connect and bind a new connection
+	dial func() (*ldap.Conn, error)
+	// Bind a reused connection with the service account
+	bind func(*ldap.Conn) error
+
+	sync.Mutex
+	idle []idleConn
+}
+
+func newConnPool(size int, idleTimeout, waitTimeout time.Duration, dial func() (*ldap.Conn, error), bind func(*ldap.Conn) error) *connPool {
+	return &connPool{
+		slots:       make(chan struct{}, size),
+		idleTimeout: idleTimeout,
+		waitTimeout: waitTimeout,
+		dial:        dial,
+		bind:        bind,
+	}
+}
+
+// Take an idle connection or dial a new one. Idle connections are bound
+// again with the service account as the previous user may have bound as
+// themselves, which also checks the connection is still alive
+func (p *connPool) get() (*ldap.Conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-time.After(p.waitTimeout):
+		return nil, errors.New("no free connections in the pool")
+	}
+	for {
+		ic, ok := p.popIdle()
+		if !ok {
+			break
+		}
+		if time.Since(ic.ts) > p.idleTimeout {
+			ic.conn.Close()
+			continue
+		}
+		if err := p.bind(ic.conn); err != nil {
+			ic.conn.Close()
+			continue
+		}
+		return ic.conn, nil
+	}
+	conn, err := p.dial()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (p *connPool) popIdle() (idleConn, bool) {
+	p.Lock()
+	defer p.Unlock()
+	if len(p.idle) == 0 {
+		return idleConn{}, false
+	}
+	// Most recently used first, the others may expire
+	ic := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return ic, true
+}
+
+// Return the connection to the pool, or close it if it may be broken
+func (p *connPool) put(conn *ldap.Conn, broken bool) {
+	defer func() { <-p.slots }()
+	if broken {
+		conn.Close()
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.idle = append(p.idle, idleConn{conn: conn, ts: time.Now()})
+}
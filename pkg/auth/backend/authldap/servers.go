@@ -0,0 +1,117 @@
+package authldap
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// For tests
+var lookupSRV = net.LookupSRV
+
+type server struct {
+	url         *url.URL
+	connectMode int
+}
+
+func (s *server) host() string {
+	return net.JoinHostPort(s.url.Hostname(), s.url.Port())
+}
+
+func (s *server) String() string {
+	return fmt.Sprintf("%s://%s", s.url.Scheme, s.host())
+}
+
+func parseServerURL(s string, startTLS bool) (*server, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse server URL %s", s)
+	}
+	connectMode := ConnectModePlain
+	switch u.Scheme {
+	case "ldap":
+		if u.Query().Get("startTLS") != "" || startTLS {
+			connectMode = ConnectModeStartTLS
+		}
+	case "ldaps":
+		connectMode = ConnectModeLDAPS
+	default:
+		return nil, errors.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+	if u.Port() == "" {
+		return nil, errors.Errorf("missing port for the server URL %s", s)
+	}
+	return &server{url: u, connectMode: connectMode}, nil
+}
+
+// Servers that failed to connect are skipped until the backoff has passed
+type serverHealth struct {
+	sync.Mutex
+	downUntil map[string]time.Time
+}
+
+func (h *serverHealth) markDown(host string, backoff time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+	h.downUntil[host] = time.Now().Add(backoff)
+}
+
+func (h *serverHealth) markUp(host string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.downUntil, host)
+}
+
+func (h *serverHealth) isDown(host string) bool {
+	h.Lock()
+	defer h.Unlock()
+	return time.Now().Before(h.downUntil[host])
+}
+
+// The servers in the order to try: the configured or discovered servers
+// that are up, then the ones that are down as the last resort
+func (al *AuthLDAP) serverList() []*server {
+	servers := al.servers
+	if al.config.SRVName != "" {
+		if discovered, err := al.discoverServers(); err != nil {
+			al.log.WithError(err).Warn("SRV discovery failed, using the configured servers")
+		} else {
+			servers = discovered
+		}
+	}
+	var up, down []*server
+	for _, s := range servers {
+		if al.health.isDown(s.host()) {
+			down = append(down, s)
+		} else {
+			up = append(up, s)
+		}
+	}
+	return append(up, down...)
+}
+
+// Servers from the SRV record in priority order. The scheme and the query
+// of the first configured server URL apply to them all
+func (al *AuthLDAP) discoverServers() ([]*server, error) {
+	_, addrs, err := lookupSRV("", "", al.config.SRVName)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, errors.Errorf("no records for %s", al.config.SRVName)
+	}
+	base := al.servers[0]
+	var r []*server
+	for _, addr := range addrs {
+		u := *base.url
+		u.Host = net.JoinHostPort(strings.TrimSuffix(addr.Target, "."), strconv.Itoa(int(addr.Port)))
+		r = append(r, &server{url: &u, connectMode: base.connectMode})
+	}
+	return r, nil
+}
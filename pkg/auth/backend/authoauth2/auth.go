@@ -0,0 +1,470 @@
+package authoauth2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+)
+
+const (
+	stateKey = "state"
+	codeKey  = "code"
+
+	subjectName = "subjectName"
+	principal   = "principal"
+
+	// Limit for the userinfo and groups responses
+	maxResponseSize = 1 << 20
+)
+
+type entryState struct {
+	userInfo map[string]interface{}
+	ts       time.Time
+}
+
+// Fetches the userinfo with the authorized client. Backends built on this
+// one use it instead of the userinfo and groups URLs
+type UserInfoFunc func(ctx context.Context, client *http.Client) (map[string]interface{}, error)
+
+type AuthOAuth2 struct {
+	config       *Config
+	log          *logrus.Entry
+	tpls         *template.Template
+	oauthConfig  *oauth2.Config
+	userInfoFunc UserInfoFunc
+
+	sync.RWMutex
+	pendingRequests map[string]entryState
+	nextEvict       *time.Timer
+}
+
+func (ao *AuthOAuth2) authFlowTimeout() time.Duration {
+	return time.Duration(ao.config.AuthFlowTimeout) * time.Second
+}
+
+// Pending auth request in the shared state store
+type sharedEntryState struct {
+	UserInfo map[string]interface{} `json:"userinfo"`
+	TS       time.Time              `json:"ts"`
+}
+
+func sharedStateKey(state string) string {
+	return "oauth2:state:" + state
+}
+
+// Save pending auth request with state key and schedule an evict task. With
+// a shared state store the request is saved there for the callback to be
+// handled by any replica and expires with the auth flow timeout
+func (ao *AuthOAuth2) saveState(state string, userInfo map[string]interface{}) error {
+	if sharedstate.IsShared() {
+		raw, err := json.Marshal(sharedEntryState{UserInfo: userInfo, TS: time.Now()})
+		if err != nil {
+			return errors.Wrap(err, "cannot encode state")
+		}
+		return sharedstate.Get().Set(sharedStateKey(state), raw, ao.authFlowTimeout())
+	}
+	ao.Lock()
+	defer ao.Unlock()
+	if _, found := ao.pendingRequests[state]; !found && len(ao.pendingRequests) >= ao.config.MaxPendingAuthAttempts {
+		return errors.New("maximum number of pending requests reached")
+	}
+
+	ao.pendingRequests[state] = entryState{userInfo: userInfo, ts: time.Now()}
+	if ao.nextEvict != nil {
+		ao.nextEvict.Reset(ao.authFlowTimeout())
+	} else {
+		ao.nextEvict = time.AfterFunc(ao.authFlowTimeout(), func() {
+			ao.evictStateEntries()
+		})
+	}
+	return nil
+}
+
+func (ao *AuthOAuth2) deleteState(state string) {
+	if sharedstate.IsShared() {
+		if err := sharedstate.Get().Delete(sharedStateKey(state)); err != nil {
+			ao.log.WithError(err).WithField("state", state).Error("cannot delete state")
+		}
+		return
+	}
+	ao.Lock()
+	defer ao.Unlock()
+	delete(ao.pendingRequests, state)
+}
+
+// Return auth request if state key matches and the request hasn't expired
+func (ao *AuthOAuth2) getState(state string) (entryState, bool) {
+	if sharedstate.IsShared() {
+		raw, err := sharedstate.Get().Get(sharedStateKey(state))
+		if err != nil {
+			return entryState{}, false
+		}
+		var v sharedEntryState
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return entryState{}, false
+		}
+		if v.TS.Add(ao.authFlowTimeout()).After(time.Now()) {
+			return entryState{userInfo: v.UserInfo, ts: v.TS}, true
+		}
+		return entryState{}, false
+	}
+	ao.RLock()
+	defer ao.RUnlock()
+	if v, ok := ao.pendingRequests[state]; ok {
+		if v.ts.Add(ao.authFlowTimeout()).After(time.Now()) {
+			return v, true
+		}
+	}
+	return entryState{}, false
+}
+
+// Evict expired auth requests
+func (ao *AuthOAuth2) evictStateEntries() {
+	ao.Lock()
+	defer ao.Unlock()
+	for k, v := range ao.pendingRequests {
+		if v.ts.Add(ao.authFlowTimeout()).Before(time.Now()) {
+			delete(ao.pendingRequests, k)
+			ao.log.WithField("state", k).Info("evicted")
+		}
+	}
+}
+
+func (ao *AuthOAuth2) startFlow(pctx *auth.AuthContext, meta map[string]interface{}) (*auth.AuthContext, bool) {
+	log := ao.log.WithField("action", "startFlow")
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+	// State will be used as a key to the cache containing the pending actx
+	state := newRandomState()
+	log = log.WithField("state", state).WithField("audit_id", meta[auth.MetaAuditID])
+	meta[stateKey] = state
+	meta[auth.MetaFederationAuthURL] = ao.oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOnline)
+	newctx := &auth.AuthContext{
+		Status:        auth.StatusPending,
+		Parent:        pctx,
+		Authenticator: ao.Name(),
+		AuthMeta:      meta,
+	}
+	if err := ao.saveState(state, nil); err != nil {
+		log.WithError(err).Error("cannot save state")
+		return nil, false
+	}
+	log.Info("waiting for auth callback")
+	return newctx, true
+}
+
+func (ao *AuthOAuth2) completeFlow(pctx *auth.AuthContext) (*auth.AuthContext, bool) {
+	log := ao.log.WithField("action", "completeFlow")
+	state := pctx.GetMetaString(stateKey)
+	log = log.WithField("audit_id", pctx.GetMetaString(auth.MetaAuditID)).
+		WithField("state", state)
+	entry, ok := ao.getState(state)
+	if !ok {
+		log.Warning("unknown pending auth request")
+		return nil, false
+	}
+	if entry.userInfo == nil {
+		log.Info("auth flow is incomplete")
+		return pctx, true
+	}
+	ao.fillAuthContext(pctx, entry.userInfo)
+	ao.deleteState(state)
+	log.Info("completed authentication")
+	return pctx, true
+}
+
+func (ao *AuthOAuth2) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	if pctx == nil {
+		ao.log.Debug("no actx, start new flow")
+		return ao.startFlow(nil, creds.Meta)
+	}
+
+	if pctx.Authenticator == ao.Name() {
+		ao.log.Debug("completing flow")
+		return ao.completeFlow(pctx)
+	}
+
+	ao.log.Debug("mfa, starting new flow")
+	return ao.startFlow(pctx, creds.Meta)
+}
+
+func (ao *AuthOAuth2) Type() string {
+	return Type
+}
+
+func (ao *AuthOAuth2) Name() string {
+	return ao.config.Name
+}
+
+func (ao *AuthOAuth2) Realm() string {
+	return ao.config.Realm
+}
+
+func (ao *AuthOAuth2) CredentialType() string {
+	return auth.CredentialFederated
+}
+
+func (ao *AuthOAuth2) FederationCallback(data interface{}) error {
+	log := ao.log.WithField("action", "callback")
+	resp, ok := data.(url.Values)
+	if !ok {
+		log.Info("decoding error")
+		return errors.New("decoding error")
+	}
+	state := resp.Get(stateKey)
+	if state == "" {
+		log.Info("no state")
+		return errors.New("no state")
+	}
+	log = log.WithField("state", state)
+	code := resp.Get(codeKey)
+	if code == "" {
+		log.Info("no auth code")
+		return errors.New("no auth code")
+	}
+	if entry, ok := ao.getState(state); !ok || entry.userInfo != nil {
+		log.Info("unknown state")
+		return errors.New("no matching state found")
+	}
+
+	tctx, cancel := context.WithTimeout(context.Background(), time.Duration(ao.config.Timeout)*time.Second)
+	defer cancel()
+	log.Debug("exchanging the code for a token")
+	token, err := ao.oauthConfig.Exchange(tctx, code)
+	if err != nil {
+		log.WithError(err).Error("cannot exchange auth code")
+		return errors.Wrap(err, "cannot exchange auth code")
+	}
+	userInfo, err := ao.fetchUserInfo(tctx, token)
+	if err != nil {
+		log.WithError(err).Error("cannot fetch userinfo")
+		return errors.Wrap(err, "cannot fetch userinfo")
+	}
+	if err := ao.saveState(state, userInfo); err != nil {
+		return err
+	}
+	log.Info("callback succeeded")
+	return nil
+}
+
+func (ao *AuthOAuth2) getJSON(ctx context.Context, client *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s returned %s", u, resp.Status)
+	}
+	dec := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize))
+	dec.UseNumber()
+	return errors.Wrapf(dec.Decode(v), "invalid response from %s", u)
+}
+
+// Fetch the userinfo and the groups with the access token. The groups are
+// stored in the userinfo under the groups field
+func (ao *AuthOAuth2) fetchUserInfo(ctx context.Context, token *oauth2.Token) (map[string]interface{}, error) {
+	log := ao.log.WithField("action", "fetchUserInfo")
+	client := ao.oauthConfig.Client(ctx, token)
+	if ao.userInfoFunc != nil {
+		userInfo, err := ao.userInfoFunc(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		log.WithField("userinfo", userInfo).Debug("got userinfo")
+		return userInfo, nil
+	}
+	userInfo := map[string]interface{}{}
+	if err := ao.getJSON(ctx, client, ao.config.UserInfoURL, &userInfo); err != nil {
+		return nil, err
+	}
+	if ao.config.GroupsURL != "" {
+		var raw []interface{}
+		if err := ao.getJSON(ctx, client, ao.config.GroupsURL, &raw); err != nil {
+			return nil, err
+		}
+		var groups []interface{}
+		for _, g := range raw {
+			if ao.config.GroupsURLField != "" {
+				g = selectValue(g, ao.config.GroupsURLField)
+			}
+			if s := toString(g); s != "" {
+				groups = append(groups, s)
+			}
+		}
+		userInfo[ao.groupsField()] = groups
+	}
+	log.WithField("userinfo", userInfo).Debug("got userinfo")
+	return userInfo, nil
+}
+
+func (ao *AuthOAuth2) groupsField() string {
+	if ao.config.ValueMappings.GroupsField != "" {
+		return ao.config.ValueMappings.GroupsField
+	}
+	return "groups"
+}
+
+func (ao *AuthOAuth2) fillAuthContext(actx *auth.AuthContext, userInfo map[string]interface{}) {
+	mappings := ao.config.ValueMappings
+	// Map user defined fields and run them thru the template
+	actx.SubjectName = ao.renderTpl(subjectName, toString(selectValue(userInfo, mappings.SubjectNameField)))
+	for _, v := range selectStringSlice(userInfo, mappings.PrincipalsField) {
+		actx.Principals = append(actx.Principals, ao.renderTpl(principal, v))
+	}
+	// From configuration
+	actx.Principals = append(actx.Principals, ao.config.Principals...)
+	actx.CriticalOptions = ao.config.CriticalOptions
+	actx.Extensions = ao.config.Extensions
+
+	// Expose the userinfo and groups to the principal mapping
+	if actx.AuthMeta == nil {
+		actx.AuthMeta = map[string]interface{}{}
+	}
+	actx.AuthMeta[auth.MetaClaims] = userInfo
+	if groups := selectStringSlice(userInfo, ao.groupsField()); groups != nil {
+		actx.AuthMeta[auth.MetaGroups] = groups
+	}
+
+	actx.Status = auth.StatusCompleted
+}
+
+func (ao *AuthOAuth2) renderTpl(name string, data interface{}) string {
+	buf := bytes.NewBuffer([]byte{})
+	err := ao.tpls.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		ao.log.WithError(err).Errorf("template render error: %s", name)
+	}
+	return buf.String()
+}
+
+// Select a nested value with a dotted path
+func selectValue(v interface{}, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+	for _, k := range strings.Split(path, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+func toString(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case json.Number, float64, bool:
+		return fmt.Sprint(val)
+	}
+	return ""
+}
+
+// A list of values or a single value as a list
+func selectStringSlice(m map[string]interface{}, path string) []string {
+	var r []string
+	switch v := selectValue(m, path).(type) {
+	case []interface{}:
+		for _, e := range v {
+			if s := toString(e); s != "" {
+				r = append(r, s)
+			}
+		}
+	case []string:
+		r = append(r, v...)
+	default:
+		if s := toString(v); s != "" {
+			r = append(r, s)
+		}
+	}
+	return r
+}
+
+func New(config *Config) (*AuthOAuth2, error) {
+	if config.ClientId == "" ||
+		config.ClientSecret == "" ||
+		config.AuthURL == "" ||
+		config.TokenURL == "" ||
+		config.UserInfoURL == "" {
+
+		return nil, errors.Errorf("%s: required config items: clientID, clientSecret, authURL, tokenURL, userInfoURL", config.Name)
+	}
+
+	var tplError error
+	rootTpl := template.New("root")
+	parseTpl := func(name, tpl string) {
+		_, err := rootTpl.New(name).Parse(tpl)
+		if err != nil {
+			tplError = errors.Wrapf(err, "cannot parse %s", name)
+		}
+	}
+	parseTpl(subjectName, config.ValueMappings.SubjectNameTemplate)
+	parseTpl(principal, config.ValueMappings.PrincipalTemplate)
+	if tplError != nil {
+		return nil, tplError
+	}
+
+	return &AuthOAuth2{
+		config:          config,
+		tpls:            rootTpl,
+		pendingRequests: map[string]entryState{},
+		oauthConfig: &oauth2.Config{
+			RedirectURL: config.RedirectURL,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  config.AuthURL,
+				TokenURL: config.TokenURL,
+			},
+			ClientID:     config.ClientId,
+			ClientSecret: config.ClientSecret,
+			Scopes:       config.Scopes,
+		},
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}, nil
+}
+
+// New backend fetching the userinfo with fn
+func NewWithUserInfo(config *Config, fn UserInfoFunc) (*AuthOAuth2, error) {
+	ao, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	ao.userInfoFunc = fn
+	return ao, nil
+}
+
+func newRandomState() string {
+	state := util.RandB64(32)
+	state = strings.Replace(state, "+", "-", -1)
+	state = strings.Replace(state, "/", "-", -1)
+	return state
+}
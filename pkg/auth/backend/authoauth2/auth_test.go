@@ -0,0 +1,167 @@
+package authoauth2
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func serverProvider() *httptest.Server {
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		out, _ := json.Marshal(v)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(out)
+	}
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != "the code" {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]string{"error": "invalid_grant"})
+			return
+		}
+		writeJSON(w, map[string]interface{}{
+			"access_token": "token",
+			"token_type":   "bearer",
+		})
+	})
+	authorized := func(h http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			h(w, r)
+		}
+	}
+	mux.HandleFunc("/user", authorized(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"id":    1234,
+			"login": "jdoe",
+			"profile": map[string]interface{}{
+				"name": "John Doe",
+			},
+		})
+	}))
+	mux.HandleFunc("/user/teams", authorized(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, []interface{}{
+			map[string]interface{}{"slug": "admins"},
+			map[string]interface{}{"slug": "users"},
+			map[string]interface{}{"id": 1},
+		})
+	}))
+	return httptest.NewServer(mux)
+}
+
+func getAuthenticator(srvURL string) *AuthOAuth2 {
+	conf := *Defaults
+	conf.ClientId = "clientid"
+	conf.ClientSecret = "clientsecret"
+	conf.RedirectURL = "https://localhost:12900/some/path"
+	conf.AuthURL = srvURL + "/authorize"
+	conf.TokenURL = srvURL + "/token"
+	conf.UserInfoURL = srvURL + "/user"
+	conf.GroupsURL = srvURL + "/user/teams"
+	conf.GroupsURLField = "slug"
+	conf.ValueMappings.SubjectNameField = "profile.name"
+	conf.ValueMappings.PrincipalsField = "login"
+	conf.ValueMappings.PrincipalTemplate = "{{.}}-gh"
+	ab, err := New(&conf)
+	if err != nil {
+		panic(err)
+	}
+	return ab
+}
+
+func TestNewRequiresEndpoints(t *testing.T) {
+	conf := *Defaults
+	conf.ClientId = "clientid"
+	conf.ClientSecret = "clientsecret"
+	_, err := New(&conf)
+	assert.Error(t, err)
+}
+
+func TestStartAuth(t *testing.T) {
+	srv := serverProvider()
+	defer srv.Close()
+	ab := getAuthenticator(srv.URL)
+	assert := assert.New(t)
+	newctx, ok := ab.Authenticate(nil, &auth.Credentials{})
+	assert.True(ok)
+	if !assert.NotNil(newctx) {
+		return
+	}
+	u, err := url.Parse(newctx.GetMetaString(auth.MetaFederationAuthURL))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("/authorize", u.Path)
+	assert.Equal(newctx.GetMetaString(stateKey), u.Query().Get("state"))
+	assert.Equal("clientid", u.Query().Get("client_id"))
+
+	newctx, ok = ab.Authenticate(newctx, &auth.Credentials{})
+	assert.True(ok)
+	assert.Equal(auth.StatusPending, newctx.Status)
+}
+
+func TestFederationCallback(t *testing.T) {
+	srv := serverProvider()
+	defer srv.Close()
+	ab := getAuthenticator(srv.URL)
+	assert := assert.New(t)
+	newctx, ok := ab.Authenticate(nil, &auth.Credentials{})
+	assert.True(ok)
+	if !assert.NotNil(newctx) {
+		return
+	}
+
+	params := url.Values{}
+	assert.Error(ab.FederationCallback(nil), "should error with nil params")
+	assert.Error(ab.FederationCallback(params), "should error without state param")
+	params.Set(stateKey, "invalid")
+	assert.Error(ab.FederationCallback(params), "should error without code param")
+	params.Set(codeKey, "the code")
+	assert.Error(ab.FederationCallback(params), "should error with invalid state param")
+	params.Set(stateKey, newctx.GetMetaString(stateKey))
+	params.Set(codeKey, "wrong code")
+	assert.Error(ab.FederationCallback(params), "should error with invalid code")
+	params.Set(codeKey, "the code")
+	if !assert.NoError(ab.FederationCallback(params)) {
+		return
+	}
+	assert.Error(ab.FederationCallback(params), "should error when repeated")
+
+	newctx, ok = ab.Authenticate(newctx, &auth.Credentials{})
+	assert.True(ok)
+	if !assert.NotNil(newctx) {
+		return
+	}
+	assert.Equal(auth.StatusCompleted, newctx.Status)
+	assert.Equal("John Doe", newctx.SubjectName)
+	assert.Equal([]string{"jdoe-gh"}, newctx.Principals)
+	assert.Equal([]string{"admins", "users"}, newctx.GetGroups())
+
+	newctx, ok = ab.Authenticate(newctx, &auth.Credentials{})
+	assert.False(ok, "repeating completed flow should return auth failure")
+	assert.Nil(newctx)
+}
+
+func TestSelectValue(t *testing.T) {
+	m := map[string]interface{}{
+		"a": map[string]interface{}{"b": "c"},
+		"n": json.Number("42"),
+		"l": []interface{}{"x", json.Number("1")},
+	}
+	assert := assert.New(t)
+	assert.Equal("c", toString(selectValue(m, "a.b")))
+	assert.Nil(selectValue(m, "a.b.c"))
+	assert.Nil(selectValue(m, ""))
+	assert.Equal("42", toString(selectValue(m, "n")))
+	assert.Equal([]string{"x", "1"}, selectStringSlice(m, "l"))
+	assert.Equal([]string{"c"}, selectStringSlice(m, "a.b"))
+}
@@ -0,0 +1,55 @@
+package authoauth2
+
+type UserInfoMapping struct {
+	// Fields of the userinfo response. Nested fields are referred with
+	// dots, e.g. "data.attributes.email"
+	SubjectNameField    string `yaml:"subjectNameField"`
+	SubjectNameTemplate string `yaml:"subjectNameTemplate"`
+	PrincipalsField     string `yaml:"principalsField"`
+	PrincipalTemplate   string `yaml:"principalTemplate"`
+	// Field holding the group memberships
+	GroupsField string `yaml:"groupsField"`
+}
+
+type Config struct {
+	Name  string
+	Realm string
+
+	Timeout                int      `yaml:"timeout"`
+	ClientId               string   `yaml:"clientID"`
+	ClientSecret           string   `yaml:"clientSecret"`
+	Scopes                 []string `yaml:"scopes"`
+	AuthFlowTimeout        int      `yaml:"authFlowTimeout"`
+	MaxPendingAuthAttempts int      `yaml:"maxPendingAuthAttempts"`
+	RedirectURL            string   `yaml:"redirectURL"`
+	AuthURL                string   `yaml:"authURL"`
+	TokenURL               string   `yaml:"tokenURL"`
+	// Fetched with the access token after the code exchange
+	UserInfoURL string `yaml:"userInfoURL"`
+	// Optional endpoint returning the groups of the user as a list of
+	// strings or objects. GroupsURLField selects the group name from objects
+	GroupsURL      string `yaml:"groupsURL"`
+	GroupsURLField string `yaml:"groupsURLField"`
+
+	ValueMappings UserInfoMapping `yaml:"valueMappings"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:                   DefaultName,
+	Realm:                  DefaultRealm,
+	AuthFlowTimeout:        240,
+	MaxPendingAuthAttempts: 1000,
+
+	ValueMappings: UserInfoMapping{
+		SubjectNameField:    "name",
+		SubjectNameTemplate: "{{.}}",
+		PrincipalsField:     "email",
+		PrincipalTemplate:   "{{.}}",
+	},
+
+	Timeout: 15,
+}
@@ -3,14 +3,18 @@ package authoidc
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
 	"time"
 
 	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
 	"github.com/aakso/ssh-inscribe/pkg/util"
 	"github.com/coreos/go-oidc"
 	"github.com/pkg/errors"
@@ -28,16 +32,25 @@ const (
 
 type entryState struct {
 	claims map[string]interface{}
+	device *deviceState
 	ts     time.Time
 }
 
+// Amends the verified ID token claims, e.g. with group memberships from
+// another API. The client is authorized with the access token of the user.
+// Backends built on this one use it to compute the principals
+type ClaimsFunc func(ctx context.Context, client *http.Client, claims map[string]interface{}) (map[string]interface{}, error)
+
 type AuthOIDC struct {
 	config      *Config
 	log         *logrus.Entry
 	tpls        *template.Template
 	oauthConfig *oauth2.Config
+	claimsFunc  ClaimsFunc
 	provider    *oidc.Provider
 	verifier    *oidc.IDTokenVerifier
+	// Discovered device_authorization_endpoint
+	deviceAuthURL string
 
 	sync.RWMutex
 	pendingRequests map[string]entryState
@@ -48,15 +61,38 @@ func (ao *AuthOIDC) authFlowTimeout() time.Duration {
 	return time.Duration(ao.config.AuthFlowTimeout) * time.Second
 }
 
-// Save pending auth request with state key and schedule an evict task
-func (ao *AuthOIDC) saveState(state string, claims map[string]interface{}) error {
+// Pending auth request in the shared state store
+type sharedEntryState struct {
+	Claims map[string]interface{} `json:"claims"`
+	Device *deviceState           `json:"device,omitempty"`
+	TS     time.Time              `json:"ts"`
+}
+
+func sharedStateKey(state string) string {
+	return "oidc:state:" + state
+}
+
+// Save pending auth request with state key and schedule an evict task. With
+// a shared state store the request is saved there for the callback to be
+// handled by any replica and expires with the auth flow timeout
+func (ao *AuthOIDC) saveState(state string, e entryState) error {
+	if e.ts.IsZero() {
+		e.ts = time.Now()
+	}
+	if sharedstate.IsShared() {
+		raw, err := json.Marshal(sharedEntryState{Claims: e.claims, Device: e.device, TS: e.ts})
+		if err != nil {
+			return errors.Wrap(err, "cannot encode state")
+		}
+		return sharedstate.Get().Set(sharedStateKey(state), raw, ao.authFlowTimeout())
+	}
 	ao.Lock()
 	defer ao.Unlock()
-	if len(ao.pendingRequests) >= ao.config.MaxPendingAuthAttempts {
+	if _, found := ao.pendingRequests[state]; !found && len(ao.pendingRequests) >= ao.config.MaxPendingAuthAttempts {
 		return errors.New("maximum number of pending requests reached")
 	}
 
-	ao.pendingRequests[state] = entryState{claims: claims, ts: time.Now()}
+	ao.pendingRequests[state] = e
 	if ao.nextEvict != nil {
 		ao.nextEvict.Reset(ao.authFlowTimeout())
 	} else {
@@ -68,6 +104,12 @@ func (ao *AuthOIDC) saveState(state string, claims map[string]interface{}) error
 }
 
 func (ao *AuthOIDC) deleteState(state string) {
+	if sharedstate.IsShared() {
+		if err := sharedstate.Get().Delete(sharedStateKey(state)); err != nil {
+			ao.log.WithError(err).WithField("state", state).Error("cannot delete state")
+		}
+		return
+	}
 	ao.Lock()
 	defer ao.Unlock()
 	delete(ao.pendingRequests, state)
@@ -75,6 +117,20 @@ func (ao *AuthOIDC) deleteState(state string) {
 
 // Return auth request if sate key matches and the request hasn't expired
 func (ao *AuthOIDC) getState(state string) (entryState, bool) {
+	if sharedstate.IsShared() {
+		raw, err := sharedstate.Get().Get(sharedStateKey(state))
+		if err != nil {
+			return entryState{}, false
+		}
+		var v sharedEntryState
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return entryState{}, false
+		}
+		if v.TS.Add(ao.authFlowTimeout()).After(time.Now()) {
+			return entryState{claims: v.Claims, device: v.Device, ts: v.TS}, true
+		}
+		return entryState{}, false
+	}
 	ao.RLock()
 	defer ao.RUnlock()
 	if v, ok := ao.pendingRequests[state]; ok {
@@ -104,14 +160,37 @@ func (ao *AuthOIDC) startFlow(pctx *auth.AuthContext, meta map[string]interface{
 	state := newRandomState()
 	log = log.WithField("state", state).WithField("audit_id", meta[auth.MetaAuditID])
 	meta[stateKey] = state
-	meta[auth.MetaFederationAuthURL] = ao.oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOnline)
+	var entry entryState
+	if ao.config.DeviceFlow {
+		da, err := ao.startDeviceAuthorization()
+		if err != nil {
+			log.WithError(err).Error("cannot start device authorization")
+			return nil, false
+		}
+		interval := time.Duration(da.Interval) * time.Second
+		if interval <= 0 {
+			interval = defaultDevicePollInterval
+		}
+		entry.device = &deviceState{
+			Code:     da.DeviceCode,
+			Interval: interval,
+			NextPoll: time.Now().Add(interval),
+		}
+		meta[auth.MetaFederationAuthURL] = da.VerificationURI
+		if da.VerificationURIComplete != "" {
+			meta[auth.MetaFederationAuthURL] = da.VerificationURIComplete
+		}
+		meta[auth.MetaFederationUserCode] = da.UserCode
+	} else {
+		meta[auth.MetaFederationAuthURL] = ao.oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOnline)
+	}
 	newctx := &auth.AuthContext{
 		Status:        auth.StatusPending,
 		Parent:        pctx,
 		Authenticator: ao.Name(),
 		AuthMeta:      meta,
 	}
-	if err := ao.saveState(state, nil); err != nil {
+	if err := ao.saveState(state, entry); err != nil {
 		log.WithError(err).Error("cannot save state")
 		return nil, false
 	}
@@ -127,6 +206,22 @@ func (ao *AuthOIDC) completeFlow(pctx *auth.AuthContext) (*auth.AuthContext, boo
 		WithField("state", state)
 	// Check whether this is a started authorization
 	if entry, ok := ao.getState(state); ok != false {
+		// Device flows are completed by polling the provider when the
+		// client polls
+		if entry.claims == nil && entry.device != nil && time.Now().After(entry.device.NextPoll) {
+			claims, err := ao.pollDevice(entry.device)
+			if err != nil {
+				log.WithError(err).Warn("device authorization failed")
+				ao.deleteState(state)
+				return nil, false
+			}
+			if claims == nil {
+				if err := ao.saveState(state, entry); err != nil {
+					log.WithError(err).Error("cannot save state")
+				}
+			}
+			entry.claims = claims
+		}
 		if entry.claims != nil {
 			ao.fillAuthContext(pctx, entry.claims)
 			ao.deleteState(state)
@@ -159,6 +254,16 @@ func (ao *AuthOIDC) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials
 	return ao.startFlow(pctx, creds.Meta)
 }
 
+// Check that the provider discovery document can be fetched
+func (ao *AuthOIDC) Probe() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := oidc.NewProvider(ctx, ao.config.ProviderURL); err != nil {
+		return errors.Wrap(err, "cannot discover auth provider")
+	}
+	return nil
+}
+
 func (ao *AuthOIDC) Type() string {
 	return Type
 }
@@ -211,7 +316,7 @@ func (ao *AuthOIDC) FederationCallback(data interface{}) error {
 	if err != nil {
 		return errors.Wrap(err, "cannot validate token")
 	}
-	if err := ao.saveState(state, claims); err != nil {
+	if err := ao.saveState(state, entryState{claims: claims}); err != nil {
 		return err
 	}
 	log.Info("callback succeeded")
@@ -235,6 +340,25 @@ func (ao *AuthOIDC) fillAuthContext(actx *auth.AuthContext, claims map[string]in
 	actx.CriticalOptions = ao.config.CriticalOptions
 	actx.Extensions = ao.config.Extensions
 
+	// Expose the claims and groups to the principal mapping
+	if actx.AuthMeta == nil {
+		actx.AuthMeta = map[string]interface{}{}
+	}
+	actx.AuthMeta[auth.MetaClaims] = claims
+	if ao.config.ValueMappings.GroupsField != "" {
+		if groups := selectStringSlice(claims, ao.config.ValueMappings.GroupsField); groups != nil {
+			actx.AuthMeta[auth.MetaGroups] = groups
+		}
+	}
+	actx.AddIdentity(auth.IdentityMFA, selectStringSlice(claims, "amr")...)
+	for key, field := range ao.config.ValueMappings.IdentityFields {
+		if values := selectStringSlice(claims, field); values != nil {
+			actx.AddIdentity(key, values...)
+		} else {
+			actx.AddIdentity(key, claimString(claims[field]))
+		}
+	}
+
 	actx.Status = auth.StatusCompleted
 }
 
@@ -255,6 +379,9 @@ func (ao *AuthOIDC) validateToken(token *oauth2.Token) (map[string]interface{},
 	IDToken.Claims(&claims)
 	log.WithField("claims", claims).Debug("got claims")
 
+	if ao.claimsFunc != nil {
+		return ao.claimsFunc(tctx, ao.oauthConfig.Client(tctx, token), claims)
+	}
 	return claims, nil
 }
 
@@ -279,6 +406,18 @@ func selectStringSlice(m map[string]interface{}, k string) []string {
 	return r
 }
 
+// Claim value as a string. JSON numbers are formatted without exponents so
+// that numeric ids stay intact
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
 func selectString(m map[string]interface{}, k string) string {
 	if v, ok := m[k]; ok {
 		if s, ok := v.(string); ok {
@@ -289,8 +428,9 @@ func selectString(m map[string]interface{}, k string) string {
 }
 
 func New(config *Config) (*AuthOIDC, error) {
+	// Device flow clients may be public clients without a secret
 	if config.ClientId == "" ||
-		config.ClientSecret == "" ||
+		(config.ClientSecret == "" && !config.DeviceFlow) ||
 		config.ProviderURL == "" {
 
 		return nil, errors.Errorf("%s: required config items: clientId, clientSecret, authURL, tokenURL", config.Name)
@@ -318,9 +458,19 @@ func New(config *Config) (*AuthOIDC, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "%s: cannot instantiate auth provider", config.Name)
 	}
+	var discovered struct {
+		DeviceAuthURL string `json:"device_authorization_endpoint"`
+	}
+	if err := provider.Claims(&discovered); err != nil {
+		return nil, errors.Wrapf(err, "%s: cannot parse provider metadata", config.Name)
+	}
+	if config.DeviceFlow && discovered.DeviceAuthURL == "" {
+		return nil, errors.Errorf("%s: provider does not support the device flow", config.Name)
+	}
 	log.WithFields(logrus.Fields{
-		"auth_url":  provider.Endpoint().AuthURL,
-		"token_url": provider.Endpoint().TokenURL,
+		"auth_url":   provider.Endpoint().AuthURL,
+		"token_url":  provider.Endpoint().TokenURL,
+		"device_url": discovered.DeviceAuthURL,
 	}).Info("auth provider discovered")
 
 	r := &AuthOIDC{
@@ -334,7 +484,8 @@ func New(config *Config) (*AuthOIDC, error) {
 			ClientSecret: config.ClientSecret,
 			Scopes:       config.Scopes,
 		},
-		provider: provider,
+		provider:      provider,
+		deviceAuthURL: discovered.DeviceAuthURL,
 		verifier: provider.Verifier(&oidc.Config{
 			ClientID: config.ClientId,
 		}),
@@ -346,6 +497,16 @@ func New(config *Config) (*AuthOIDC, error) {
 	return r, nil
 }
 
+// New backend amending the claims with fn
+func NewWithClaims(config *Config, fn ClaimsFunc) (*AuthOIDC, error) {
+	ao, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+	ao.claimsFunc = fn
+	return ao, nil
+}
+
 func newRandomState() string {
 	state := util.RandB64(32)
 	state = strings.Replace(state, "+", "-", -1)
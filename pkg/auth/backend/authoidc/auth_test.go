@@ -138,18 +138,23 @@ func TestFederationCallback(t *testing.T) {
 	)
 	groups := []string{"group1", "group2"}
 	ab := getAuthenticator()
+	ab.config.ValueMappings.IdentityFields = map[string]string{auth.IdentityEmployeeID: "employee_number"}
 	tsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		claims := &struct {
 			Email         string   `json:"email"`
 			EmailVerified bool     `json:"email_verified"`
 			Name          string   `json:"name"`
 			Groups        []string `json:"groups"`
+			Amr           []string `json:"amr"`
+			EmployeeID    int      `json:"employee_number"`
 			jwt.StandardClaims
 		}{
 			Email:         email,
 			EmailVerified: true,
 			Name:          userName,
 			Groups:        groups,
+			Amr:           []string{"pwd", "otp"},
+			EmployeeID:    12345678,
 			StandardClaims: jwt.StandardClaims{
 				Issuer:    srvOIDC.URL,
 				Audience:  ab.config.ClientId,
@@ -215,8 +220,118 @@ func TestFederationCallback(t *testing.T) {
 	assert.Equal(userName, newctx.SubjectName)
 	assert.Equal(groups, newctx.Principals)
 	assert.Equal(2, newctx.Len())
+	assert.Equal(map[string]interface{}{
+		auth.IdentityEmployeeID: "12345678",
+		auth.IdentityMFA:        []string{"pwd", "otp"},
+	}, newctx.GetIdentity())
 
 	newctx, ok = ab.Authenticate(newctx, &auth.Credentials{})
 	assert.False(ok, "repeating completed flow should return auth failure")
 	assert.Nil(newctx, "repeating completed flow should return auth failure")
 }
+
+func TestDeviceFlow(t *testing.T) {
+	const userName = "Test User"
+	var (
+		srv   *httptest.Server
+		polls int
+	)
+	mux := http.NewServeMux()
+	writeJSON := func(w http.ResponseWriter, status int, v interface{}) {
+		out, _ := json.Marshal(v)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(out)
+	}
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"issuer":                        srv.URL,
+			"jwks_uri":                      srvJWKS.URL,
+			"token_endpoint":                srv.URL + "/token",
+			"device_authorization_endpoint": srv.URL + "/device",
+		})
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"device_code":      "devicecode",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": srv.URL + "/verify",
+			"expires_in":       600,
+			"interval":         5,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != deviceGrantType || r.Form.Get("device_code") != "devicecode" {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_grant"})
+			return
+		}
+		polls++
+		if polls == 1 {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": deviceAuthorizationPending})
+			return
+		}
+		claims := &struct {
+			Name string `json:"name"`
+			jwt.StandardClaims
+		}{
+			Name: userName,
+			StandardClaims: jwt.StandardClaims{
+				Issuer:    srv.URL,
+				Audience:  "clientid",
+				ExpiresAt: time.Now().Add(time.Hour).Unix(),
+			},
+		}
+		ss, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(privateKey)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id_token":     ss,
+			"token_type":   "Bearer",
+			"access_token": "token",
+		})
+	})
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	assert := assert.New(t)
+	conf := *Defaults
+	conf.ClientId = "clientid"
+	conf.ProviderURL = srv.URL
+	conf.DeviceFlow = true
+	ab, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	newctx, ok := ab.Authenticate(nil, &auth.Credentials{})
+	assert.True(ok)
+	if !assert.NotNil(newctx) {
+		return
+	}
+	assert.Equal(srv.URL+"/verify", newctx.GetMetaString(auth.MetaFederationAuthURL))
+	assert.Equal("ABCD-EFGH", newctx.GetMetaString(auth.MetaFederationUserCode))
+
+	// Not polled before the interval has passed
+	newctx, ok = ab.Authenticate(newctx, &auth.Credentials{})
+	assert.True(ok)
+	assert.Equal(auth.StatusPending, newctx.Status)
+	assert.Equal(0, polls)
+
+	skipInterval := func() {
+		state := newctx.GetMetaString(stateKey)
+		ab.pendingRequests[state].device.NextPoll = time.Time{}
+	}
+	skipInterval()
+	newctx, ok = ab.Authenticate(newctx, &auth.Credentials{})
+	assert.True(ok)
+	assert.Equal(auth.StatusPending, newctx.Status)
+	assert.Equal(1, polls)
+
+	skipInterval()
+	newctx, ok = ab.Authenticate(newctx, &auth.Credentials{})
+	assert.True(ok)
+	if !assert.NotNil(newctx) {
+		return
+	}
+	assert.Equal(auth.StatusCompleted, newctx.Status)
+	assert.Equal(userName, newctx.SubjectName)
+	assert.Equal(2, polls)
+}
@@ -5,6 +5,12 @@ type TokenValueMapping struct {
 	SubjectNameTemplate string `yaml:"subjectNameTemplate"`
 	PrincipalsField     string `yaml:"principalsField"`
 	PrincipalTemplate   string `yaml:"principalTemplate"`
+	// Claim holding the group memberships
+	GroupsField string `yaml:"groupsField"`
+	// Identity attributes for the key id and the certificate extensions
+	// from the claims, e.g. employee_id: employeeNumber. The methods in
+	// the amr claim are added to the mfa identity attribute
+	IdentityFields map[string]string `yaml:"identityFields"`
 }
 
 type Config struct {
@@ -19,6 +25,10 @@ type Config struct {
 	MaxPendingAuthAttempts int      `yaml:"maxPendingAuthAttempts"`
 	RedirectURL            string   `yaml:"redirectURL"`
 	ProviderURL            string   `yaml:"providerURL"`
+	// Use the device authorization grant instead of the authorization code
+	// flow. The user enters the code shown by the client on any device and
+	// no redirect URL is needed
+	DeviceFlow bool `yaml:"deviceFlow"`
 
 	ValueMappings TokenValueMapping `yaml:"valueMappings"`
 
@@ -39,6 +49,7 @@ var Defaults *Config = &Config{
 		SubjectNameTemplate: "{{.}}",
 		PrincipalsField:     "email",
 		PrincipalTemplate:   "{{.}}",
+		GroupsField:         "groups",
 	},
 
 	Timeout: 15,
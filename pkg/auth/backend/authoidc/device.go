@@ -0,0 +1,128 @@
+package authoidc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// OAuth 2.0 Device Authorization Grant (RFC 8628)
+const (
+	deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+	deviceAuthorizationPending = "authorization_pending"
+	deviceSlowDown             = "slow_down"
+
+	defaultDevicePollInterval = 5 * time.Second
+)
+
+// Pending device authorization. The device code is kept on the server
+type deviceState struct {
+	Code     string        `json:"code"`
+	Interval time.Duration `json:"interval"`
+	NextPoll time.Time     `json:"next_poll"`
+}
+
+type deviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	// Some providers use the name of the draft
+	VerificationURL string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (ao *AuthOIDC) httpClient() *http.Client {
+	return &http.Client{Timeout: time.Duration(ao.config.Timeout) * time.Second}
+}
+
+func (ao *AuthOIDC) postForm(endpoint string, form url.Values, v interface{}) (int, error) {
+	form.Set("client_id", ao.config.ClientId)
+	if ao.config.ClientSecret != "" {
+		form.Set("client_secret", ao.config.ClientSecret)
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := ao.httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return resp.StatusCode, errors.Wrapf(err, "invalid response with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Request a device and user code from the provider
+func (ao *AuthOIDC) startDeviceAuthorization() (*deviceAuthResponse, error) {
+	form := url.Values{}
+	form.Set("scope", strings.Join(ao.config.Scopes, " "))
+	var r deviceAuthResponse
+	status, err := ao.postForm(ao.deviceAuthURL, form, &r)
+	if err != nil {
+		return nil, errors.Wrap(err, "device authorization request failed")
+	}
+	if status != http.StatusOK || r.DeviceCode == "" {
+		return nil, errors.Errorf("device authorization request failed with status %d", status)
+	}
+	if r.VerificationURI == "" {
+		r.VerificationURI = r.VerificationURL
+	}
+	return &r, nil
+}
+
+// Poll the token endpoint for the device code. Returns nil claims while the
+// user has not yet completed the authorization
+func (ao *AuthOIDC) pollDevice(ds *deviceState) (map[string]interface{}, error) {
+	form := url.Values{}
+	form.Set("grant_type", deviceGrantType)
+	form.Set("device_code", ds.Code)
+	var r deviceTokenResponse
+	if _, err := ao.postForm(ao.oauthConfig.Endpoint.TokenURL, form, &r); err != nil {
+		return nil, errors.Wrap(err, "device token request failed")
+	}
+	switch r.Error {
+	case "":
+	case deviceSlowDown:
+		ds.Interval += 5 * time.Second
+		fallthrough
+	case deviceAuthorizationPending:
+		ds.NextPoll = time.Now().Add(ds.Interval)
+		return nil, nil
+	default:
+		if r.ErrorDescription != "" {
+			return nil, errors.Errorf("%s: %s", r.Error, r.ErrorDescription)
+		}
+		return nil, errors.New(r.Error)
+	}
+	token := (&oauth2.Token{
+		AccessToken: r.AccessToken,
+		TokenType:   r.TokenType,
+	}).WithExtra(map[string]interface{}{"id_token": r.IDToken})
+	return ao.validateToken(token)
+}
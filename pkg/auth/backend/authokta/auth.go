@@ -0,0 +1,352 @@
+package authokta
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Pending MFA challenges carry the state token, the user, the enrolled
+	// factors and the factor awaiting a sent code in the auth context meta
+	stateKey   = "okta_state"
+	userKey    = "okta_user"
+	factorsKey = "okta_factors"
+	pendingKey = "okta_factor"
+
+	factorPush = "push"
+)
+
+// Factor types verified with a code from a device, in order of preference
+var passCodeFactors = []string{"token:software:totp", "token:hardware", "token"}
+
+// Factor types sending the code to the user when asked
+var sentFactors = []string{"sms", "call", "email"}
+
+// Pause between polls of a push verification
+var pollInterval = 2 * time.Second
+
+type groupData struct {
+	ID   string
+	Name string
+}
+
+type AuthOkta struct {
+	config   *Config
+	log      *logrus.Entry
+	client   *oktaClient
+	groupTpl *template.Template
+}
+
+func (ao *AuthOkta) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	log := ao.log.WithField("action", "authenticate")
+	if v, ok := creds.Meta[auth.MetaAuditID]; ok {
+		log = log.WithField(auth.MetaAuditID, v)
+	}
+
+	var (
+		tx        *transaction
+		pending   string
+		responded bool
+		err       error
+	)
+	parent := pctx
+	user := creds.UserIdentifier
+	factors := url.Values{}
+	// Response to an MFA challenge of a previous request
+	if pctx != nil && pctx.Status == auth.StatusPending && pctx.Authenticator == ao.Name() {
+		parent = pctx.Parent
+		user = pctx.GetMetaString(userKey)
+		if factors, err = url.ParseQuery(pctx.GetMetaString(factorsKey)); err != nil {
+			log.Info("invalid pending challenge")
+			return nil, false
+		}
+		log = log.WithField("user", user)
+		responded = true
+		tx, pending, err = ao.respond(pctx, factors, strings.TrimSpace(string(creds.Secret)), log)
+	} else {
+		log = log.WithField("user", user)
+		tx, err = ao.client.authn(user, string(creds.Secret))
+	}
+	if err != nil {
+		log.WithError(err).Info("Okta auth failed")
+		if unavailable(err) {
+			creds.SetBackendError(err)
+		}
+		return nil, false
+	}
+
+	switch tx.Status {
+	case statusSuccess:
+		log.Debug("Okta auth successful")
+	case statusMFARequired:
+		for _, f := range tx.Embedded.Factors {
+			if f.FactorType == factorPush && f.Provider != "OKTA" {
+				continue
+			}
+			if factors.Get(f.FactorType) == "" {
+				factors.Set(f.FactorType, f.ID)
+			}
+		}
+		return ao.challenge(parent, creds, user, tx.StateToken, factors, "", log)
+	case statusMFAChallenge:
+		// A code was sent to the user
+		return ao.challenge(parent, creds, user, tx.StateToken, factors, pending, log)
+	case statusMFAEnroll:
+		log.Info("Okta requires the user to enroll a factor")
+		creds.SetPasswordFailure(auth.MFAEnrollRequired)
+		return nil, false
+	case statusPasswordExpired:
+		log.Info("Okta password has expired")
+		creds.SetPasswordFailure(auth.PasswordExpired)
+		return nil, false
+	default:
+		log.WithField("status", tx.Status).Info("Okta auth not completed")
+		return nil, false
+	}
+
+	actx, err := ao.complete(parent, creds, tx)
+	if err != nil {
+		log.WithError(err).Info("Okta auth rejected")
+		if unavailable(err) {
+			creds.SetBackendError(err)
+		}
+		return nil, false
+	}
+	actx.AddIdentity(auth.IdentityMFA, "pwd")
+	if responded {
+		actx.AddIdentity(auth.IdentityMFA, "mfa")
+	}
+	return actx, true
+}
+
+// Verify the factor chosen with the response: a code, the name of a factor
+// sending one, or nothing for a push. Returns the factor awaiting a sent
+// code
+func (ao *AuthOkta) respond(pctx *auth.AuthContext, factors url.Values, response string, log *logrus.Entry) (*transaction, string, error) {
+	state := pctx.GetMetaString(stateKey)
+	if state == "" {
+		return nil, "", errors.New("invalid pending challenge")
+	}
+	if id := pctx.GetMetaString(pendingKey); id != "" {
+		tx, err := ao.client.verify(id, state, response)
+		return tx, "", err
+	}
+	choice := strings.ToLower(response)
+	if choice == "" || choice == factorPush {
+		id := factors.Get(factorPush)
+		if id == "" {
+			return nil, "", errors.New("no push factor enrolled")
+		}
+		tx, err := ao.push(id, state, log)
+		return tx, "", err
+	}
+	for _, t := range sentFactors {
+		if choice == t && factors.Get(t) != "" {
+			log.WithField("factor", t).Debug("sending the code")
+			tx, err := ao.client.verify(factors.Get(t), state, "")
+			return tx, factors.Get(t), err
+		}
+	}
+	for _, t := range passCodeFactors {
+		if id := factors.Get(t); id != "" {
+			tx, err := ao.client.verify(id, state, response)
+			return tx, "", err
+		}
+	}
+	return nil, "", errors.New("no factor accepting codes enrolled")
+}
+
+// Send an Okta Verify push and poll until the user answers it
+func (ao *AuthOkta) push(id, state string, log *logrus.Entry) (*transaction, error) {
+	deadline := time.Now().Add(time.Duration(ao.config.PushTimeout) * time.Second)
+	tx, err := ao.client.verify(id, state, "")
+	for err == nil && tx.Status == statusMFAChallenge && tx.FactorResult == factorWaiting {
+		if time.Now().After(deadline) {
+			return nil, errors.New("timed out waiting for the user")
+		}
+		log.Debug("waiting for the user")
+		time.Sleep(pollInterval)
+		tx, err = ao.client.verify(id, state, "")
+	}
+	if err == nil && tx.Status != statusSuccess {
+		err = errors.Errorf("push %s", strings.ToLower(tx.FactorResult))
+	}
+	return tx, err
+}
+
+// Pending context asking the client for the factor or the code
+func (ao *AuthOkta) challenge(parent *auth.AuthContext, creds *auth.Credentials, user, state string, factors url.Values, pending string, log *logrus.Entry) (*auth.AuthContext, bool) {
+	var prompt string
+	if pending != "" {
+		prompt = "Okta: enter the code sent to you"
+	} else {
+		var options, sent []string
+		for _, t := range passCodeFactors {
+			if factors.Get(t) != "" {
+				options = append(options, "enter a code")
+				break
+			}
+		}
+		for _, t := range sentFactors {
+			if factors.Get(t) != "" {
+				sent = append(sent, t)
+			}
+		}
+		if len(sent) > 0 {
+			options = append(options, strings.Join(sent, ", ")+" to receive one")
+		}
+		if factors.Get(factorPush) != "" {
+			options = append(options, "nothing for an Okta Verify push")
+		}
+		if len(options) == 0 {
+			log.Info("Okta requires a factor not supported here")
+			return nil, false
+		}
+		prompt = "Okta: " + strings.Join(options, ", or ")
+	}
+	meta := make(map[string]interface{}, len(creds.Meta)+5)
+	for k, v := range creds.Meta {
+		meta[k] = v
+	}
+	meta[stateKey] = state
+	meta[userKey] = user
+	meta[factorsKey] = factors.Encode()
+	meta[pendingKey] = pending
+	meta[auth.MetaChallenge] = prompt
+	log.Debug("Okta MFA challenge")
+	return &auth.AuthContext{
+		Status:        auth.StatusPending,
+		Parent:        parent,
+		Authenticator: ao.Name(),
+		AuthMeta:      meta,
+	}, true
+}
+
+// Completed context with the principals from the groups of the user
+func (ao *AuthOkta) complete(parent *auth.AuthContext, creds *auth.Credentials, tx *transaction) (*auth.AuthContext, error) {
+	login := tx.Embedded.User.Profile.Login
+	if login == "" {
+		return nil, errors.New("no user in the transaction")
+	}
+	actx := &auth.AuthContext{
+		Status:          auth.StatusCompleted,
+		Parent:          parent,
+		SubjectName:     login,
+		Principals:      append([]string{}, ao.config.Principals...),
+		CriticalOptions: ao.config.CriticalOptions,
+		Extensions:      ao.config.Extensions,
+		Authenticator:   ao.Name(),
+		AuthMeta:        make(map[string]interface{}, len(creds.Meta)+1),
+	}
+	for k, v := range creds.Meta {
+		actx.AuthMeta[k] = v
+	}
+	if ao.config.UsernamePrincipal {
+		actx.Principals = append(actx.Principals, strings.SplitN(login, "@", 2)[0])
+	}
+	if ao.client.apiToken == "" {
+		return actx, nil
+	}
+
+	groups, err := ao.client.groups(tx.Embedded.User.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(ao.config.Groups) > 0 {
+		allowed := false
+		for _, g := range groups {
+			allowed = allowed || containsFold(ao.config.Groups, g.ID) || containsFold(ao.config.Groups, g.Profile.Name)
+		}
+		if !allowed {
+			return nil, errors.Errorf("%s is not a member of the allowed groups", login)
+		}
+	}
+	var names []string
+	for _, g := range groups {
+		names = append(names, g.Profile.Name)
+		for k, v := range ao.config.GroupPrincipals {
+			if strings.EqualFold(k, g.ID) || strings.EqualFold(k, g.Profile.Name) {
+				actx.Principals = append(actx.Principals, v...)
+			}
+		}
+		if ao.groupTpl == nil {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := ao.groupTpl.Execute(&buf, groupData{ID: g.ID, Name: g.Profile.Name}); err != nil {
+			return nil, errors.Wrap(err, "cannot render group principal")
+		}
+		if p := strings.TrimSpace(buf.String()); p != "" {
+			actx.Principals = append(actx.Principals, p)
+		}
+	}
+	actx.AuthMeta[auth.MetaGroups] = names
+	return actx, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ao *AuthOkta) Type() string {
+	return Type
+}
+
+func (ao *AuthOkta) Name() string {
+	return ao.config.Name
+}
+
+func (ao *AuthOkta) Realm() string {
+	return ao.config.Realm
+}
+
+func (ao *AuthOkta) CredentialType() string {
+	return auth.CredentialUserPassword
+}
+
+// Check that the org answers with its OpenID configuration
+func (ao *AuthOkta) Probe() error {
+	var r interface{}
+	return ao.client.call(http.MethodGet, "/.well-known/openid-configuration", nil, &r)
+}
+
+func New(config *Config) (*AuthOkta, error) {
+	if config.OrgURL == "" {
+		return nil, errors.Errorf("%s: required config items: orgURL", config.Name)
+	}
+	if config.APIToken == "" && (len(config.Groups) > 0 || len(config.GroupPrincipals) > 0 || config.GroupPrincipalTemplate != "") {
+		return nil, errors.Errorf("%s: apiToken is required to read the groups", config.Name)
+	}
+	ao := &AuthOkta{
+		config: config,
+		client: newOktaClient(config.OrgURL, config.APIToken, time.Duration(config.Timeout)*time.Second),
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}
+	if config.GroupPrincipalTemplate != "" {
+		tpl, err := template.New("group").Parse(config.GroupPrincipalTemplate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: cannot parse groupPrincipalTemplate", config.Name)
+		}
+		ao.groupTpl = tpl
+	}
+	return ao, nil
+}
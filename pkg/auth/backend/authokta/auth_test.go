@@ -0,0 +1,293 @@
+package authokta
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+const testToken = "00abcdefghijklmnop"
+
+// Fake Okta org. alice logs in with the password only, bob has push, TOTP
+// and SMS factors, carol has none enrolled and dave has an expired password.
+// Pushes are approved after two polls
+type fakeOkta struct {
+	sync.Mutex
+	t     *testing.T
+	url   string
+	polls int
+}
+
+func (fo *fakeOkta) tx(status, login string) map[string]interface{} {
+	r := map[string]interface{}{"status": status, "stateToken": "state-" + login}
+	if status == statusSuccess {
+		r["sessionToken"] = "session"
+		delete(r, "stateToken")
+	}
+	r["_embedded"] = map[string]interface{}{
+		"user": map[string]interface{}{"id": "id-" + login, "profile": map[string]string{"login": login + "@example.com"}},
+	}
+	return r
+}
+
+func (fo *fakeOkta) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fo.Lock()
+	defer fo.Unlock()
+	var body map[string]string
+	if r.Method == http.MethodPost {
+		json.NewDecoder(r.Body).Decode(&body)
+	}
+	fail := func(status int, code, summary string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"errorCode": code, "errorSummary": summary})
+	}
+	var resp interface{}
+	switch {
+	case r.URL.Path == "/.well-known/openid-configuration":
+		resp = map[string]string{"issuer": fo.url}
+	case r.URL.Path == "/api/v1/authn":
+		assert.Empty(fo.t, r.Header.Get("Authorization"))
+		if body["password"] != "secret" {
+			fail(http.StatusUnauthorized, "E0000004", "Authentication failed")
+			return
+		}
+		switch body["username"] {
+		case "alice":
+			resp = fo.tx(statusSuccess, "alice")
+		case "bob":
+			tx := fo.tx(statusMFARequired, "bob")
+			tx["_embedded"].(map[string]interface{})["factors"] = []factor{
+				{ID: "webauthn1", FactorType: "webauthn", Provider: "FIDO"},
+				{ID: "push1", FactorType: "push", Provider: "OKTA"},
+				{ID: "totp1", FactorType: "token:software:totp", Provider: "GOOGLE"},
+				{ID: "sms1", FactorType: "sms", Provider: "OKTA"},
+			}
+			resp = tx
+		case "carol":
+			resp = fo.tx(statusMFAEnroll, "carol")
+		case "dave":
+			resp = fo.tx(statusPasswordExpired, "dave")
+		default:
+			fail(http.StatusUnauthorized, "E0000004", "Authentication failed")
+			return
+		}
+	case strings.HasPrefix(r.URL.Path, "/api/v1/authn/factors/"):
+		if body["stateToken"] != "state-bob" {
+			fail(http.StatusForbidden, "E0000011", "Invalid token provided")
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/authn/factors/push1/verify":
+			fo.polls++
+			resp = fo.tx(statusSuccess, "bob")
+			if fo.polls <= 2 {
+				tx := fo.tx(statusMFAChallenge, "bob")
+				tx["factorResult"] = factorWaiting
+				resp = tx
+			}
+		case "/api/v1/authn/factors/totp1/verify":
+			if body["passCode"] != "123456" {
+				fail(http.StatusForbidden, "E0000068", "Invalid Passcode/Answer")
+				return
+			}
+			resp = fo.tx(statusSuccess, "bob")
+		case "/api/v1/authn/factors/sms1/verify":
+			switch body["passCode"] {
+			case "":
+				resp = fo.tx(statusMFAChallenge, "bob")
+			case "654321":
+				resp = fo.tx(statusSuccess, "bob")
+			default:
+				fail(http.StatusForbidden, "E0000068", "Invalid Passcode/Answer")
+				return
+			}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+	case strings.HasPrefix(r.URL.Path, "/api/v1/users/"):
+		if r.Header.Get("Authorization") != "SSWS "+testToken {
+			fail(http.StatusUnauthorized, "E0000011", "Invalid token provided")
+			return
+		}
+		// Two pages of groups
+		if r.URL.Query().Get("after") == "" {
+			w.Header().Add("Link", `<`+fo.url+r.URL.Path+`?limit=200>; rel="self"`)
+			w.Header().Add("Link", `<`+fo.url+r.URL.Path+`?after=1&limit=200>; rel="next"`)
+			resp = []map[string]interface{}{{"id": "00g1", "profile": map[string]string{"name": "Everyone"}}}
+		} else {
+			resp = []map[string]interface{}{{"id": "00g2", "profile": map[string]string{"name": "Admins"}}}
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func testAuth(t *testing.T, apiToken string) (*AuthOkta, *fakeOkta, func()) {
+	fo := &fakeOkta{t: t}
+	srv := httptest.NewServer(fo)
+	fo.url = srv.URL
+	conf := *Defaults
+	conf.OrgURL = srv.URL
+	conf.APIToken = apiToken
+	conf.Principals = []string{"common"}
+	if apiToken != "" {
+		conf.GroupPrincipals = map[string][]string{"admins": {"root"}}
+		conf.GroupPrincipalTemplate = "okta-{{.Name}}"
+	}
+	ao, err := New(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ao, fo, srv.Close
+}
+
+func TestAuthenticate(t *testing.T) {
+	ao, _, done := testAuth(t, testToken)
+	defer done()
+	assert.NoError(t, ao.Probe())
+
+	actx, ok := ao.Authenticate(nil, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("secret")})
+	if assert.True(t, ok) {
+		assert.Equal(t, auth.StatusCompleted, actx.Status)
+		assert.Equal(t, "alice@example.com", actx.SubjectName)
+		assert.Equal(t, []string{"common", "alice", "okta-Everyone", "root", "okta-Admins"}, actx.Principals)
+		assert.Equal(t, []string{"Everyone", "Admins"}, actx.GetGroups())
+	}
+
+	creds := &auth.Credentials{UserIdentifier: "alice", Secret: []byte("wrong")}
+	_, ok = ao.Authenticate(nil, creds)
+	assert.False(t, ok)
+	assert.False(t, creds.BackendError())
+
+	// Without an API token the groups are not read
+	ao, _, done = testAuth(t, "")
+	defer done()
+	actx, ok = ao.Authenticate(nil, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("secret")})
+	if assert.True(t, ok) {
+		assert.Equal(t, []string{"common", "alice"}, actx.Principals)
+		assert.Empty(t, actx.GetGroups())
+	}
+
+	// Unreachable Okta is reported as the failure of the backend
+	done()
+	creds = &auth.Credentials{UserIdentifier: "alice", Secret: []byte("secret")}
+	_, ok = ao.Authenticate(nil, creds)
+	assert.False(t, ok)
+	assert.True(t, creds.BackendError())
+}
+
+func TestAllowedGroups(t *testing.T) {
+	ao, _, done := testAuth(t, testToken)
+	defer done()
+	ao.config.Groups = []string{"00g2"}
+	_, ok := ao.Authenticate(nil, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("secret")})
+	assert.True(t, ok)
+	ao.config.Groups = []string{"Contractors"}
+	_, ok = ao.Authenticate(nil, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("secret")})
+	assert.False(t, ok)
+}
+
+func TestFactors(t *testing.T) {
+	ao, fo, done := testAuth(t, "")
+	defer done()
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+
+	login := func() *auth.AuthContext {
+		pending, ok := ao.Authenticate(nil, &auth.Credentials{UserIdentifier: "bob", Secret: []byte("secret")})
+		if !assert.True(t, ok) || !assert.Equal(t, auth.StatusPending, pending.Status) {
+			t.FailNow()
+		}
+		return pending
+	}
+
+	// The challenge lists the supported factors
+	pending := login()
+	assert.Equal(t, "Okta: enter a code, or sms to receive one, or nothing for an Okta Verify push",
+		pending.GetMetaString(auth.MetaChallenge))
+
+	// TOTP code, the user name comes from the pending context
+	actx, ok := ao.Authenticate(pending, &auth.Credentials{UserIdentifier: "mallory", Secret: []byte("123456")})
+	if assert.True(t, ok) {
+		assert.Equal(t, auth.StatusCompleted, actx.Status)
+		assert.Equal(t, "bob@example.com", actx.SubjectName)
+		assert.Nil(t, actx.Parent)
+	}
+	_, ok = ao.Authenticate(pending, &auth.Credentials{Secret: []byte("000000")})
+	assert.False(t, ok)
+
+	// Push approved after polling
+	actx, ok = ao.Authenticate(login(), &auth.Credentials{})
+	if assert.True(t, ok) {
+		assert.Equal(t, "bob@example.com", actx.SubjectName)
+		assert.Equal(t, 3, fo.polls)
+	}
+
+	// SMS code sent on request
+	sms, ok := ao.Authenticate(login(), &auth.Credentials{Secret: []byte("SMS")})
+	if assert.True(t, ok) && assert.Equal(t, auth.StatusPending, sms.Status) {
+		assert.Equal(t, "Okta: enter the code sent to you", sms.GetMetaString(auth.MetaChallenge))
+		actx, ok = ao.Authenticate(sms, &auth.Credentials{Secret: []byte("654321")})
+		if assert.True(t, ok) {
+			assert.Equal(t, auth.StatusCompleted, actx.Status)
+		}
+	}
+
+	// The parent of the challenge is kept
+	parent := &auth.AuthContext{Status: auth.StatusCompleted, SubjectName: "bob"}
+	pending, ok = ao.Authenticate(parent, &auth.Credentials{UserIdentifier: "bob", Secret: []byte("secret")})
+	if assert.True(t, ok) {
+		actx, ok = ao.Authenticate(pending, &auth.Credentials{Secret: []byte("123456")})
+		if assert.True(t, ok) {
+			assert.Equal(t, parent, actx.Parent)
+		}
+	}
+}
+
+func TestPushTimeout(t *testing.T) {
+	ao, fo, done := testAuth(t, "")
+	defer done()
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = 10 * time.Millisecond
+	ao.config.PushTimeout = 0
+	fo.polls = -100
+
+	pending, ok := ao.Authenticate(nil, &auth.Credentials{UserIdentifier: "bob", Secret: []byte("secret")})
+	if assert.True(t, ok) {
+		_, ok = ao.Authenticate(pending, &auth.Credentials{Secret: []byte("push")})
+		assert.False(t, ok)
+	}
+}
+
+func TestPasswordFailures(t *testing.T) {
+	ao, _, done := testAuth(t, "")
+	defer done()
+
+	creds := &auth.Credentials{UserIdentifier: "carol", Secret: []byte("secret")}
+	_, ok := ao.Authenticate(nil, creds)
+	assert.False(t, ok)
+	assert.Equal(t, auth.MFAEnrollRequired, creds.Meta[auth.MetaPasswordFailure])
+
+	creds = &auth.Credentials{UserIdentifier: "dave", Secret: []byte("secret")}
+	_, ok = ao.Authenticate(nil, creds)
+	assert.False(t, ok)
+	assert.Equal(t, auth.PasswordExpired, creds.Meta[auth.MetaPasswordFailure])
+}
+
+func TestNextLink(t *testing.T) {
+	h := http.Header{}
+	h.Add("Link", `<https://example.okta.com/api/v1/users/1/groups?limit=2>; rel="self"`)
+	h.Add("Link", `<https://example.okta.com/api/v1/users/1/groups?after=2&limit=2>; rel="next"`)
+	assert.Equal(t, "https://example.okta.com/api/v1/users/1/groups?after=2&limit=2", nextLink(h))
+	assert.Empty(t, nextLink(http.Header{}))
+}
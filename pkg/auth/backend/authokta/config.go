@@ -0,0 +1,39 @@
+package authokta
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// Okta org URL, e.g. https://example.okta.com
+	OrgURL string `yaml:"orgURL"`
+	// API token with read access to the users and groups. The groups are
+	// not read without one
+	APIToken string `yaml:"apiToken"`
+	// Seconds for the API requests
+	Timeout int
+	// Seconds to wait for the user to approve an Okta Verify push
+	PushTimeout int `yaml:"pushTimeout"`
+
+	// Members of any of these groups are allowed, as IDs or names. Empty
+	// allows every user of the org
+	Groups []string
+	// Principals for the members of a group, keyed by ID or name
+	GroupPrincipals map[string][]string `yaml:"groupPrincipals"`
+	// Principal for each group of the user, with {{.ID}} and {{.Name}}.
+	// Empty disables it
+	GroupPrincipalTemplate string `yaml:"groupPrincipalTemplate"`
+	// Add the local part of the Okta login as a principal
+	UsernamePrincipal bool `yaml:"usernamePrincipal"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:              DefaultName,
+	Realm:             DefaultRealm,
+	Timeout:           15,
+	PushTimeout:       60,
+	UsernamePrincipal: true,
+}
@@ -0,0 +1,206 @@
+package authokta
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Limit for the API responses
+const maxResponseSize = 1 << 20
+
+// Transaction states of the Authn API
+const (
+	statusSuccess         = "SUCCESS"
+	statusMFARequired     = "MFA_REQUIRED"
+	statusMFAChallenge    = "MFA_CHALLENGE"
+	statusMFAEnroll       = "MFA_ENROLL"
+	statusPasswordExpired = "PASSWORD_EXPIRED"
+	statusLockedOut       = "LOCKED_OUT"
+
+	factorWaiting = "WAITING"
+)
+
+// Client of the Okta Authn API and the Users API for the groups
+type oktaClient struct {
+	baseURL  string
+	apiToken string
+	http     *http.Client
+}
+
+type apiError struct {
+	ErrorCode    string `json:"errorCode"`
+	ErrorSummary string `json:"errorSummary"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("okta: %s %s", e.ErrorCode, e.ErrorSummary)
+}
+
+// Okta could not be reached or failed, as opposed to refusing the request
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func unavailable(err error) bool {
+	_, ok := errors.Cause(err).(*unavailableError)
+	return ok
+}
+
+type factor struct {
+	ID         string `json:"id"`
+	FactorType string `json:"factorType"`
+	Provider   string `json:"provider"`
+}
+
+type user struct {
+	ID      string `json:"id"`
+	Profile struct {
+		Login string `json:"login"`
+	} `json:"profile"`
+}
+
+// Transaction of the Authn API
+type transaction struct {
+	Status       string `json:"status"`
+	StateToken   string `json:"stateToken"`
+	SessionToken string `json:"sessionToken"`
+	// Of push verifications: WAITING, REJECTED or TIMEOUT
+	FactorResult string `json:"factorResult"`
+	Embedded     struct {
+		User    user     `json:"user"`
+		Factors []factor `json:"factors"`
+	} `json:"_embedded"`
+}
+
+type group struct {
+	ID      string `json:"id"`
+	Profile struct {
+		Name string `json:"name"`
+	} `json:"profile"`
+}
+
+func newOktaClient(orgURL, apiToken string, timeout time.Duration) *oktaClient {
+	return &oktaClient{
+		baseURL:  strings.TrimSuffix(orgURL, "/"),
+		apiToken: apiToken,
+		http:     &http.Client{Timeout: timeout},
+	}
+}
+
+func (oc *oktaClient) call(method, path string, body, result interface{}) error {
+	_, err := oc.do(method, oc.baseURL+path, body, result)
+	return err
+}
+
+// Returns the URL of the next page from the Link header if any
+func (oc *oktaClient) do(method, u string, body, result interface{}) (string, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return "", err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// The Authn API is public, the token is needed for the Users API
+	if oc.apiToken != "" && strings.HasPrefix(u, oc.baseURL+"/api/v1/users/") {
+		req.Header.Set("Authorization", "SSWS "+oc.apiToken)
+	}
+	resp, err := oc.http.Do(req)
+	if err != nil {
+		return "", &unavailableError{err: errors.Wrap(err, "okta request failed")}
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize))
+	if resp.StatusCode >= 500 {
+		return "", &unavailableError{err: errors.Errorf("okta returned %s", resp.Status)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e apiError
+		if err := dec.Decode(&e); err != nil || e.ErrorCode == "" {
+			return "", errors.Errorf("okta returned %s", resp.Status)
+		}
+		return "", &e
+	}
+	if err := dec.Decode(result); err != nil {
+		return "", errors.Wrap(err, "invalid okta response")
+	}
+	return nextLink(resp.Header), nil
+}
+
+// Primary authentication with the password
+func (oc *oktaClient) authn(username, password string) (*transaction, error) {
+	var r transaction
+	return &r, oc.call(http.MethodPost, "/api/v1/authn", map[string]string{
+		"username": username,
+		"password": password,
+	}, &r)
+}
+
+// Verify a factor of the transaction. Without a passcode, push factors are
+// sent or polled and sms, call and email factors send the code
+func (oc *oktaClient) verify(factorID, stateToken, passCode string) (*transaction, error) {
+	body := map[string]string{"stateToken": stateToken}
+	if passCode != "" {
+		body["passCode"] = passCode
+	}
+	var r transaction
+	return &r, oc.call(http.MethodPost, "/api/v1/authn/factors/"+url.PathEscape(factorID)+"/verify", body, &r)
+}
+
+// Groups of the user, following the pages within the org
+func (oc *oktaClient) groups(userID string) ([]group, error) {
+	var r []group
+	u := oc.baseURL + "/api/v1/users/" + url.PathEscape(userID) + "/groups?limit=200"
+	for u != "" {
+		var page []group
+		next, err := oc.do(http.MethodGet, u, nil, &page)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot list groups")
+		}
+		r = append(r, page...)
+		if next != "" && !strings.HasPrefix(next, oc.baseURL+"/") {
+			return nil, errors.Errorf("cannot list groups: next page outside the org: %s", next)
+		}
+		u = next
+	}
+	return r, nil
+}
+
+// Target of the Link header with rel="next"
+func nextLink(h http.Header) string {
+	for _, v := range h.Values("Link") {
+		for _, link := range strings.Split(v, ",") {
+			parts := strings.Split(link, ";")
+			if len(parts) < 2 {
+				continue
+			}
+			for _, p := range parts[1:] {
+				if strings.TrimSpace(p) == `rel="next"` {
+					return strings.Trim(strings.TrimSpace(parts[0]), "<>")
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package authpam
+
+import (
+	"os/user"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Group names of the user from the system
+var lookupGroups = func(name string) ([]string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	var groups []string
+	for _, id := range ids {
+		g, err := user.LookupGroupId(id)
+		if err != nil {
+			// Groups without a name are skipped like id(1) shows them
+			continue
+		}
+		groups = append(groups, g.Name)
+	}
+	return groups, nil
+}
+
+// AuthPAM authenticates users with the PAM stack of the host. Every prompt
+// for a secret is answered with the password of the user
+type AuthPAM struct {
+	config *Config
+	log    *logrus.Entry
+}
+
+func (ap *AuthPAM) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil || creds.UserIdentifier == "" || len(creds.Secret) == 0 {
+		return nil, false
+	}
+	log := ap.log.WithField("action", "authenticate")
+	if v, ok := creds.Meta[auth.MetaAuditID]; ok {
+		log = log.WithField(auth.MetaAuditID, v)
+	}
+	log = log.WithField("user", creds.UserIdentifier)
+
+	// Modules may map the user to another name, e.g. to the canonical one
+	user, err := pamAuthenticate(ap.config.Service, creds.UserIdentifier, creds.Secret, ap.config.CheckAccount)
+	if err != nil {
+		log.WithError(err).Info("PAM auth failed")
+		return nil, false
+	}
+	log.WithField("pam_user", user).Debug("PAM auth successful")
+
+	actx := &auth.AuthContext{
+		Status:          auth.StatusCompleted,
+		Parent:          pctx,
+		SubjectName:     user,
+		Principals:      append([]string{}, ap.config.Principals...),
+		CriticalOptions: ap.config.CriticalOptions,
+		Extensions:      ap.config.Extensions,
+		Authenticator:   ap.Name(),
+		AuthMeta:        creds.Meta,
+	}
+	if ap.config.UserNamePrincipal {
+		actx.Principals = append([]string{user}, actx.Principals...)
+	}
+	if ap.config.LookupGroups {
+		groups, err := lookupGroups(user)
+		if err != nil {
+			log.WithError(err).Error("cannot look up the groups of the user")
+			return nil, false
+		}
+		if len(groups) > 0 {
+			actx.AuthMeta = make(map[string]interface{}, len(creds.Meta)+1)
+			for k, v := range creds.Meta {
+				actx.AuthMeta[k] = v
+			}
+			actx.AuthMeta[auth.MetaGroups] = groups
+		}
+	}
+	return actx, true
+}
+
+func (ap *AuthPAM) Type() string {
+	return Type
+}
+
+func (ap *AuthPAM) Name() string {
+	return ap.config.Name
+}
+
+func (ap *AuthPAM) Realm() string {
+	return ap.config.Realm
+}
+
+func (ap *AuthPAM) CredentialType() string {
+	return auth.CredentialUserPassword
+}
+
+func New(config *Config) (*AuthPAM, error) {
+	if !pamSupported {
+		return nil, errors.Errorf("%s: built without PAM support, build with the pam tag", config.Name)
+	}
+	if config.Service == "" {
+		return nil, errors.Errorf("%s: required config items: service", config.Name)
+	}
+	return &AuthPAM{
+		config: config,
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}, nil
+}
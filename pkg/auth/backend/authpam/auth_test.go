@@ -0,0 +1,68 @@
+package authpam
+
+import (
+	"testing"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// Fake PAM stack accepting alice, known as Alice to the system, and bob
+// whose account is expired
+func fakePAM(service, user string, secret []byte, checkAccount bool) (string, error) {
+	if service != "test" {
+		return "", errors.New("unknown service")
+	}
+	switch {
+	case user == "alice" && string(secret) == "secret":
+		return "Alice", nil
+	case user == "bob" && string(secret) == "secret":
+		if checkAccount {
+			return "", errors.New("user account has expired")
+		}
+		return user, nil
+	}
+	return "", errors.New("authentication failure")
+}
+
+func TestAuthPAM(t *testing.T) {
+	assert := assert.New(t)
+	pamSupported = true
+	pamAuthenticate = fakePAM
+	lookupGroups = func(name string) ([]string, error) {
+		if name != "Alice" {
+			return nil, errors.New("unknown user")
+		}
+		return []string{"Alice", "wheel"}, nil
+	}
+
+	_, err := New(&Config{Name: "pam"})
+	assert.Error(err)
+
+	conf := *Defaults
+	conf.Service = "test"
+	conf.Principals = []string{"extra"}
+	ap, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	actx, ok := ap.Authenticate(nil, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("secret")})
+	if assert.True(ok) {
+		assert.Equal("Alice", actx.GetSubjectName())
+		assert.Equal([]string{"Alice", "extra"}, actx.GetPrincipals())
+		assert.Equal([]string{"Alice", "wheel"}, actx.GetGroups())
+		assert.Equal([]string{"authpam"}, actx.GetAuthenticators())
+	}
+	_, ok = ap.Authenticate(nil, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("wrong")})
+	assert.False(ok)
+	_, ok = ap.Authenticate(nil, &auth.Credentials{UserIdentifier: "alice"})
+	assert.False(ok, "empty password")
+	_, ok = ap.Authenticate(nil, &auth.Credentials{UserIdentifier: "bob", Secret: []byte("secret")})
+	assert.False(ok, "expired account")
+
+	conf.CheckAccount = false
+	conf.LookupGroups = false
+	_, ok = ap.Authenticate(nil, &auth.Credentials{UserIdentifier: "bob", Secret: []byte("secret")})
+	assert.True(ok)
+}
@@ -0,0 +1,30 @@
+package authpam
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// PAM service, i.e. the stack in /etc/pam.d/<service>
+	Service string
+	// Check the account with pam_acct_mgmt after authentication, e.g. for
+	// expired or locked accounts
+	CheckAccount bool `yaml:"checkAccount"`
+	// Use the groups of the user from the system, e.g. local or SSSD, as the
+	// groups of the auth context
+	LookupGroups bool `yaml:"lookupGroups"`
+
+	UserNamePrincipal bool `yaml:"userNamePrincipal"`
+	Principals        []string
+	CriticalOptions   map[string]string `yaml:"criticalOptions"`
+	Extensions        map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:         DefaultName,
+	Realm:        DefaultRealm,
+	Service:      "ssh-inscribe",
+	CheckAccount: true,
+	LookupGroups: true,
+
+	UserNamePrincipal: true,
+}
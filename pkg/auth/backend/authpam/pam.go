@@ -0,0 +1,124 @@
+// +build pam,cgo
+
+package authpam
+
+/*
+#cgo LDFLAGS: -lpam
+#include <security/pam_appl.h>
+#include <stdlib.h>
+#include <string.h>
+
+// Answer the prompts for a secret with the secret in appdata. Prompts with
+// echo are not answered as the user is already set
+static int conv(int n, const struct pam_message **msg, struct pam_response **resp, void *appdata) {
+	struct pam_response *r;
+	int i;
+
+	if (n <= 0 || n > PAM_MAX_NUM_MSG) {
+		return PAM_CONV_ERR;
+	}
+	r = calloc(n, sizeof(struct pam_response));
+	if (r == NULL) {
+		return PAM_BUF_ERR;
+	}
+	for (i = 0; i < n; i++) {
+		switch (msg[i]->msg_style) {
+		case PAM_PROMPT_ECHO_OFF:
+			r[i].resp = strdup((const char *)appdata);
+			if (r[i].resp == NULL) {
+				goto fail;
+			}
+			break;
+		case PAM_ERROR_MSG:
+		case PAM_TEXT_INFO:
+			break;
+		default:
+			goto fail;
+		}
+	}
+	*resp = r;
+	return PAM_SUCCESS;
+fail:
+	for (i = 0; i < n; i++) {
+		if (r[i].resp != NULL) {
+			memset(r[i].resp, 0, strlen(r[i].resp));
+			free(r[i].resp);
+		}
+	}
+	free(r);
+	return PAM_CONV_ERR;
+}
+
+// Run the auth and optionally the account management of the service. On
+// success the user as set by the modules is returned in final_user, on
+// failure the error in errmsg. Both are to be freed by the caller
+static int authenticate(const char *service, const char *user, const char *secret, int check_account,
+		char **final_user, char **errmsg) {
+	struct pam_conv c = { conv, (void *)secret };
+	pam_handle_t *h = NULL;
+	const void *item = NULL;
+	int rc;
+
+	rc = pam_start(service, user, &c, &h);
+	if (rc != PAM_SUCCESS) {
+		*errmsg = strdup(pam_strerror(h, rc));
+		return rc;
+	}
+	rc = pam_authenticate(h, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	if (rc == PAM_SUCCESS && check_account) {
+		rc = pam_acct_mgmt(h, PAM_SILENT | PAM_DISALLOW_NULL_AUTHTOK);
+	}
+	if (rc == PAM_SUCCESS) {
+		if (pam_get_item(h, PAM_USER, &item) == PAM_SUCCESS && item != NULL) {
+			*final_user = strdup((const char *)item);
+		}
+	} else {
+		*errmsg = strdup(pam_strerror(h, rc));
+	}
+	pam_end(h, rc);
+	return rc;
+}
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+var pamSupported = true
+
+var pamAuthenticate = func(service, user string, secret []byte, checkAccount bool) (string, error) {
+	cService := C.CString(service)
+	defer C.free(unsafe.Pointer(cService))
+	cUser := C.CString(user)
+	defer C.free(unsafe.Pointer(cUser))
+	cSecret := C.malloc(C.size_t(len(secret) + 1))
+	defer C.free(cSecret)
+	defer C.memset(cSecret, 0, C.size_t(len(secret)+1))
+	buf := (*[1 << 30]byte)(cSecret)[: len(secret)+1 : len(secret)+1]
+	copy(buf, secret)
+	buf[len(secret)] = 0
+
+	var check C.int
+	if checkAccount {
+		check = 1
+	}
+	var finalUser, errmsg *C.char
+	rc := C.authenticate(cService, cUser, (*C.char)(cSecret), check, &finalUser, &errmsg)
+	if errmsg != nil {
+		defer C.free(unsafe.Pointer(errmsg))
+	}
+	if rc != C.PAM_SUCCESS {
+		if errmsg == nil {
+			return "", errors.Errorf("PAM error %d", int(rc))
+		}
+		return "", errors.New(C.GoString(errmsg))
+	}
+	if finalUser == nil {
+		return user, nil
+	}
+	defer C.free(unsafe.Pointer(finalUser))
+	return C.GoString(finalUser), nil
+}
@@ -0,0 +1,149 @@
+package authplugin
+
+import (
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/auth/plugin"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// AuthPlugin authenticates with an out-of-tree backend running as a plugin
+// program. See the plugin package for the protocol
+type AuthPlugin struct {
+	config         *Config
+	log            *logrus.Entry
+	client         *plugin.Client
+	credentialType string
+}
+
+func (ap *AuthPlugin) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	log := ap.log.WithField("action", "authenticate").WithField("user", creds.UserIdentifier)
+	req := &plugin.AuthRequest{
+		User:   creds.UserIdentifier,
+		Secret: creds.Secret,
+	}
+	if v, ok := creds.Meta[auth.MetaAuditID]; ok {
+		log = log.WithField(auth.MetaAuditID, v)
+		req.AuditID, _ = v.(string)
+	}
+	if pctx != nil {
+		req.Parent = &plugin.Parent{
+			Subject:        pctx.GetSubjectName(),
+			Principals:     pctx.GetPrincipals(),
+			Groups:         pctx.GetGroups(),
+			Authenticators: pctx.GetAuthenticators(),
+		}
+	}
+
+	res, err := ap.client.Authenticate(req)
+	if err != nil {
+		log.WithError(err).Error("plugin auth failed")
+		return nil, false
+	}
+	if !res.Success {
+		log.WithField("message", res.Message).Info("plugin rejected the user")
+		return nil, false
+	}
+	if res.MaxLifetime != "" {
+		if _, err := time.ParseDuration(res.MaxLifetime); err != nil {
+			log.WithError(err).Error("plugin returned invalid max_lifetime")
+			return nil, false
+		}
+	}
+	log.Debug("plugin accepted the user")
+
+	actx := &auth.AuthContext{
+		Status:          auth.StatusCompleted,
+		Parent:          pctx,
+		SubjectName:     res.SubjectName,
+		Principals:      res.Principals,
+		CriticalOptions: res.CriticalOptions,
+		Extensions:      res.Extensions,
+		Authenticator:   ap.Name(),
+		AuthMeta:        creds.Meta,
+	}
+	if len(res.Groups) > 0 || res.MaxLifetime != "" {
+		actx.AuthMeta = make(map[string]interface{}, len(creds.Meta)+2)
+		for k, v := range creds.Meta {
+			actx.AuthMeta[k] = v
+		}
+		if len(res.Groups) > 0 {
+			actx.AuthMeta[auth.MetaGroups] = res.Groups
+		}
+		if res.MaxLifetime != "" {
+			actx.AuthMeta[auth.MetaMaxLifetime] = res.MaxLifetime
+		}
+	}
+	return actx, true
+}
+
+func (ap *AuthPlugin) Probe() error {
+	return ap.client.Probe()
+}
+
+// Stop the plugin program
+func (ap *AuthPlugin) Close() error {
+	return ap.client.Close()
+}
+
+func (ap *AuthPlugin) Type() string {
+	return Type
+}
+
+func (ap *AuthPlugin) Name() string {
+	return ap.config.Name
+}
+
+func (ap *AuthPlugin) Realm() string {
+	return ap.config.Realm
+}
+
+func (ap *AuthPlugin) CredentialType() string {
+	return ap.credentialType
+}
+
+func New(config *Config) (*AuthPlugin, error) {
+	if len(config.Command) == 0 || config.Command[0] == "" {
+		return nil, errors.Errorf("%s: required config items: command", config.Name)
+	}
+	if config.Timeout <= 0 {
+		return nil, errors.Errorf("%s: timeout must be positive", config.Name)
+	}
+	ap := &AuthPlugin{
+		config: config,
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}
+	client, err := plugin.NewClient(plugin.ClientConfig{
+		Command: config.Command,
+		Env:     config.Env,
+		Timeout: time.Duration(config.Timeout) * time.Second,
+		Config: &plugin.Config{
+			Name:     config.Name,
+			Realm:    config.Realm,
+			Settings: config.Settings,
+		},
+		Log: ap.log.WithField("plugin", config.Command[0]),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: cannot load plugin", config.Name)
+	}
+	ap.client = client
+	switch t := client.Info().CredentialType; t {
+	case "":
+		ap.credentialType = auth.CredentialUserPassword
+	case auth.CredentialUserPassword, auth.CredentialPin, auth.CredentialBearerToken, auth.CredentialClientCert:
+		ap.credentialType = t
+	default:
+		client.Close()
+		return nil, errors.Errorf("%s: plugin has unsupported credential type %q", config.Name, t)
+	}
+	return ap, nil
+}
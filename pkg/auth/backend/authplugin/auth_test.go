@@ -0,0 +1,163 @@
+package authplugin
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/auth/plugin"
+	"github.com/stretchr/testify/assert"
+)
+
+type testBackend struct {
+	subject string
+}
+
+func (b *testBackend) Configure(config *plugin.Config) (*plugin.Info, error) {
+	b.subject, _ = config.Settings["subject"].(string)
+	return &plugin.Info{Version: "1.0", CredentialType: os.Getenv("AUTHPLUGIN_CREDENTIAL_TYPE")}, nil
+}
+
+func (b *testBackend) Authenticate(req *plugin.AuthRequest) (*plugin.AuthResponse, error) {
+	switch req.User {
+	case "panic":
+		panic("boom")
+	case "exit":
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+	case "error":
+		return nil, fmt.Errorf("backend unavailable")
+	}
+	res := &plugin.AuthResponse{Message: "invalid password"}
+	if req.User == "alice" && string(req.Secret) == "secret" {
+		res = &plugin.AuthResponse{
+			Success:     true,
+			SubjectName: b.subject,
+			Principals:  []string{"alice"},
+			Groups:      []string{"ops"},
+			MaxLifetime: "2h",
+		}
+		if req.Parent != nil {
+			res.Principals = append(res.Principals, "parent-"+req.Parent.Subject)
+		}
+	}
+	return res, nil
+}
+
+// Run as the plugin by the tests
+func TestHelperProcess(t *testing.T) {
+	switch os.Getenv("AUTHPLUGIN_HELPER") {
+	case "":
+		return
+	case "badversion":
+		fmt.Println("ssh-inscribe-plugin|99|unix|/nonexistent")
+		os.Exit(0)
+	}
+	plugin.Serve(&testBackend{})
+	os.Exit(0)
+}
+
+func testConfig(mode string) *Config {
+	return &Config{
+		Name:    "plugin",
+		Realm:   "test",
+		Command: []string{os.Args[0], "-test.run=TestHelperProcess"},
+		Env:     map[string]string{"AUTHPLUGIN_HELPER": mode},
+		Timeout: 1,
+		Settings: map[string]interface{}{
+			"subject": "Alice",
+		},
+	}
+}
+
+func TestAuth(t *testing.T) {
+	assert := assert.New(t)
+	ap, err := New(testConfig("serve"))
+	if !assert.NoError(err) {
+		return
+	}
+	defer ap.Close()
+	assert.Equal(auth.CredentialUserPassword, ap.CredentialType())
+	assert.NoError(ap.Probe())
+
+	actx, ok := ap.Authenticate(nil, &auth.Credentials{
+		UserIdentifier: "alice",
+		Secret:         []byte("secret"),
+		Meta:           map[string]interface{}{auth.MetaAuditID: "id"},
+	})
+	if assert.True(ok) {
+		assert.Equal("Alice", actx.GetSubjectName())
+		assert.Equal([]string{"alice"}, actx.GetPrincipals())
+		assert.Equal([]string{"ops"}, actx.GetGroups())
+		assert.Equal(2*time.Hour, actx.GetMaxLifetime())
+		assert.Equal("plugin", actx.Authenticator)
+	}
+
+	parent := &auth.AuthContext{Status: auth.StatusCompleted, SubjectName: "first", Authenticator: "file"}
+	actx, ok = ap.Authenticate(parent, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("secret")})
+	if assert.True(ok) {
+		assert.Equal([]string{"alice", "parent-first"}, actx.GetPrincipals())
+	}
+
+	for _, user := range []string{"bob", "panic", "error"} {
+		_, ok = ap.Authenticate(nil, &auth.Credentials{UserIdentifier: user, Secret: []byte("secret")})
+		assert.False(ok, user)
+	}
+	// A panic does not take the plugin down
+	_, ok = ap.Authenticate(nil, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("secret")})
+	assert.True(ok)
+}
+
+func TestCrash(t *testing.T) {
+	assert := assert.New(t)
+	ap, err := New(testConfig("serve"))
+	if !assert.NoError(err) {
+		return
+	}
+	defer ap.Close()
+
+	for _, user := range []string{"exit", "hang"} {
+		_, ok := ap.Authenticate(nil, &auth.Credentials{UserIdentifier: user})
+		assert.False(ok, user)
+		time.Sleep(1100 * time.Millisecond)
+		// Restarted
+		_, ok = ap.Authenticate(nil, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("secret")})
+		assert.True(ok, user)
+	}
+
+	_, err = ap.client.Authenticate(&plugin.AuthRequest{User: "exit"})
+	assert.Error(err)
+	_, err = ap.client.Authenticate(&plugin.AuthRequest{User: "alice"})
+	assert.Equal(plugin.ErrRestarting, err)
+
+	assert.NoError(ap.Close())
+	_, err = ap.client.Authenticate(&plugin.AuthRequest{User: "alice"})
+	assert.Equal(plugin.ErrClosed, err)
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := New(&Config{Name: "plugin", Timeout: 1})
+	assert.EqualError(err, "plugin: required config items: command")
+
+	_, err = New(testConfig("badversion"))
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "unsupported plugin protocol version 99")
+	}
+
+	conf := testConfig("serve")
+	conf.Env["AUTHPLUGIN_CREDENTIAL_TYPE"] = "federated"
+	_, err = New(conf)
+	assert.EqualError(err, `plugin: plugin has unsupported credential type "federated"`)
+
+	conf.Env["AUTHPLUGIN_CREDENTIAL_TYPE"] = "bearer_token"
+	ap, err := New(conf)
+	if assert.NoError(err) {
+		assert.Equal(auth.CredentialBearerToken, ap.CredentialType())
+		ap.Close()
+	}
+}
@@ -0,0 +1,22 @@
+package authplugin
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// Plugin program and its arguments
+	Command []string
+	// Environment of the plugin in addition to PATH. The environment of the
+	// server is not passed on
+	Env map[string]string
+	// Seconds to wait for the plugin to start and for each call
+	Timeout int
+	// Passed to the plugin as is
+	Settings map[string]interface{}
+}
+
+var Defaults *Config = &Config{
+	Name:    DefaultName,
+	Realm:   DefaultRealm,
+	Timeout: 10,
+}
@@ -0,0 +1,178 @@
+package authradius
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Pending challenges carry the RADIUS state and the user in the auth
+	// context meta
+	stateKey = "radius_state"
+	userKey  = "radius_user"
+)
+
+type AuthRADIUS struct {
+	config *Config
+	log    *logrus.Entry
+}
+
+func (ar *AuthRADIUS) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	log := ar.log.WithField("action", "authenticate")
+	if v, ok := creds.Meta[auth.MetaAuditID]; ok {
+		log = log.WithField(auth.MetaAuditID, v)
+	}
+
+	user := creds.UserIdentifier
+	var state []byte
+	// Response to a challenge of a previous request
+	if pctx != nil && pctx.Status == auth.StatusPending && pctx.Authenticator == ar.Name() {
+		var err error
+		if state, err = base64.StdEncoding.DecodeString(pctx.GetMetaString(stateKey)); err != nil || len(state) == 0 {
+			log.Info("invalid pending challenge")
+			return nil, false
+		}
+		user = pctx.GetMetaString(userKey)
+	}
+	log = log.WithField("user", user)
+
+	reply, err := ar.request(user, creds.Secret, state)
+	if err != nil {
+		log.WithError(err).Error("RADIUS request failed")
+		creds.SetBackendError(err)
+		return nil, false
+	}
+	switch reply.Code {
+	case codeAccessAccept:
+		log.Debug("RADIUS auth successful")
+	case codeAccessChallenge:
+		log.Debug("RADIUS challenge")
+		return ar.challenge(pctx, creds, user, reply)
+	default:
+		log.WithField("reply_message", replyMessage(reply)).Info("RADIUS auth rejected")
+		return nil, false
+	}
+
+	actx := &auth.AuthContext{
+		Status:          auth.StatusCompleted,
+		Parent:          pctx,
+		SubjectName:     user,
+		Principals:      append([]string{}, ar.config.Principals...),
+		CriticalOptions: ar.config.CriticalOptions,
+		Extensions:      ar.config.Extensions,
+		Authenticator:   ar.Name(),
+		AuthMeta:        creds.Meta,
+	}
+	// The pending context is replaced by the completed one
+	if state != nil {
+		actx.Parent = pctx.Parent
+	}
+	if ar.config.UserNamePrincipal {
+		actx.Principals = append([]string{user}, actx.Principals...)
+	}
+	if ar.config.GroupsAttribute > 0 {
+		var groups []string
+		for _, v := range reply.getAll(byte(ar.config.GroupsAttribute)) {
+			groups = append(groups, string(v))
+		}
+		if len(groups) > 0 {
+			actx.AuthMeta = make(map[string]interface{}, len(creds.Meta)+1)
+			for k, v := range creds.Meta {
+				actx.AuthMeta[k] = v
+			}
+			actx.AuthMeta[auth.MetaGroups] = groups
+		}
+	}
+	return actx, true
+}
+
+// Pending context asking the client for the response to the challenge
+func (ar *AuthRADIUS) challenge(pctx *auth.AuthContext, creds *auth.Credentials, user string, reply *packet) (*auth.AuthContext, bool) {
+	state := reply.get(attrState)
+	if len(state) == 0 {
+		ar.log.Error("RADIUS challenge without state")
+		return nil, false
+	}
+	prompt := replyMessage(reply)
+	if prompt == "" {
+		prompt = "Response"
+	}
+	meta := make(map[string]interface{}, len(creds.Meta)+3)
+	for k, v := range creds.Meta {
+		meta[k] = v
+	}
+	meta[stateKey] = base64.StdEncoding.EncodeToString(state)
+	meta[userKey] = user
+	meta[auth.MetaChallenge] = prompt
+	parent := pctx
+	if pctx != nil && pctx.Status == auth.StatusPending && pctx.Authenticator == ar.Name() {
+		parent = pctx.Parent
+	}
+	return &auth.AuthContext{
+		Status:        auth.StatusPending,
+		Parent:        parent,
+		Authenticator: ar.Name(),
+		AuthMeta:      meta,
+	}, true
+}
+
+func (ar *AuthRADIUS) request(user string, password, state []byte) (*packet, error) {
+	attrs := []attribute{{Type: attrUserName, Value: []byte(user)}}
+	if ar.config.NASIdentifier != "" {
+		attrs = append(attrs, attribute{Type: attrNASIdentifier, Value: []byte(ar.config.NASIdentifier)})
+	}
+	if state != nil {
+		attrs = append(attrs, attribute{Type: attrState, Value: state})
+	}
+	secret := []byte(ar.config.Secret)
+	req, reqp, err := accessRequest(secret, attrs, password)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(ar.config.Timeout) * time.Second
+	for _, server := range ar.config.Servers {
+		var reply *packet
+		reply, err = exchange(server, req, reqp, secret, timeout, ar.config.Retries, ar.config.RequireMessageAuthenticator)
+		if err == nil {
+			return reply, nil
+		}
+		ar.log.WithError(err).WithField("server", server).Warn("RADIUS server failed")
+	}
+	return nil, err
+}
+
+func (ar *AuthRADIUS) Type() string {
+	return Type
+}
+
+func (ar *AuthRADIUS) Name() string {
+	return ar.config.Name
+}
+
+func (ar *AuthRADIUS) Realm() string {
+	return ar.config.Realm
+}
+
+func (ar *AuthRADIUS) CredentialType() string {
+	return auth.CredentialUserPassword
+}
+
+func New(config *Config) (*AuthRADIUS, error) {
+	if len(config.Servers) == 0 || config.Secret == "" {
+		return nil, errors.Errorf("%s: required config items: servers, secret", config.Name)
+	}
+	return &AuthRADIUS{
+		config: config,
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}, nil
+}
@@ -0,0 +1,189 @@
+package authradius
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSecret = "testing123"
+
+func revealPassword(hidden, secret []byte, authenticator [16]byte) []byte {
+	plain := make([]byte, len(hidden))
+	prev := authenticator[:]
+	for i := 0; i < len(hidden); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		sum := h.Sum(nil)
+		for j := range sum {
+			plain[i+j] = hidden[i+j] ^ sum[j]
+		}
+		prev = hidden[i : i+16]
+	}
+	for len(plain) > 0 && plain[len(plain)-1] == 0 {
+		plain = plain[:len(plain)-1]
+	}
+	return plain
+}
+
+// Reply signed with the Message-Authenticator and the Response Authenticator
+func reply(req *packet, code byte, secret []byte, attrs ...attribute) []byte {
+	p := &packet{Code: code, Identifier: req.Identifier, Authenticator: req.Authenticator}
+	p.Attributes = append(attrs, attribute{Type: attrMessageAuthenticator, Value: make([]byte, md5.Size)})
+	b, _ := p.encode()
+	mac := hmac.New(md5.New, secret)
+	mac.Write(b)
+	copy(b[len(b)-md5.Size:], mac.Sum(nil))
+	h := md5.New()
+	h.Write(b)
+	h.Write(secret)
+	copy(b[4:20], h.Sum(nil))
+	return b
+}
+
+// Server accepting alice directly and bob after an OTP challenge. Replies
+// are signed with replySecret
+func testServer(t *testing.T, secret, replySecret []byte) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxPacketSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req, err := decodePacket(buf[:n])
+			if !assert.NoError(t, err) || !assert.Equal(t, byte(codeAccessRequest), req.Code) {
+				continue
+			}
+			// Request Message-Authenticator
+			b := append([]byte{}, buf[:n]...)
+			ma := append([]byte{}, req.get(attrMessageAuthenticator)...)
+			copy(b[len(b)-md5.Size:], make([]byte, md5.Size))
+			mac := hmac.New(md5.New, secret)
+			mac.Write(b)
+			assert.Equal(t, mac.Sum(nil), ma)
+			assert.Equal(t, "sshi", string(req.get(attrNASIdentifier)))
+
+			user := string(req.get(attrUserName))
+			password := string(revealPassword(req.get(attrUserPassword), secret, req.Authenticator))
+			state := string(req.get(attrState))
+			var resp []byte
+			switch {
+			case user == "alice" && password == "secret":
+				resp = reply(req, codeAccessAccept, replySecret,
+					attribute{Type: 25, Value: []byte("admins")},
+					attribute{Type: 25, Value: []byte("users")},
+				)
+			case user == "bob" && state == "" && password == "secret":
+				resp = reply(req, codeAccessChallenge, replySecret,
+					attribute{Type: attrState, Value: []byte("otp-state")},
+					attribute{Type: attrReplyMessage, Value: []byte("Enter OTP")},
+				)
+			case user == "bob" && state == "otp-state" && password == "123456":
+				resp = reply(req, codeAccessAccept, replySecret)
+			default:
+				resp = reply(req, codeAccessReject, replySecret)
+			}
+			conn.WriteTo(resp, addr)
+		}
+	}()
+	return conn
+}
+
+func testAuth(t *testing.T, server string) *AuthRADIUS {
+	conf := *Defaults
+	conf.Servers = []string{server}
+	conf.Secret = testSecret
+	conf.Timeout = 1
+	conf.Retries = 0
+	conf.NASIdentifier = "sshi"
+	conf.RequireMessageAuthenticator = true
+	conf.GroupsAttribute = 25
+	conf.Principals = []string{"common"}
+	ar, err := New(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ar
+}
+
+func TestHidePassword(t *testing.T) {
+	var ra [16]byte
+	copy(ra[:], "0123456789abcdef")
+	for _, pw := range []string{"", "short", "exactly16bytes!!", "a longer password over 16 bytes"} {
+		hidden, err := hidePassword([]byte(pw), []byte(testSecret), ra)
+		if assert.NoError(t, err) {
+			assert.Equal(t, 0, len(hidden)%16)
+			assert.Equal(t, pw, string(revealPassword(hidden, []byte(testSecret), ra)))
+		}
+	}
+	_, err := hidePassword(make([]byte, 129), []byte(testSecret), ra)
+	assert.Error(t, err)
+}
+
+func TestAuthenticate(t *testing.T) {
+	srv := testServer(t, []byte(testSecret), []byte(testSecret))
+	defer srv.Close()
+	ar := testAuth(t, srv.LocalAddr().String())
+
+	actx, ok := ar.Authenticate(nil, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("secret")})
+	if assert.True(t, ok) {
+		assert.Equal(t, auth.StatusCompleted, actx.Status)
+		assert.Equal(t, "alice", actx.SubjectName)
+		assert.Equal(t, []string{"alice", "common"}, actx.Principals)
+		assert.Equal(t, []string{"admins", "users"}, actx.GetGroups())
+	}
+
+	_, ok = ar.Authenticate(nil, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("wrong")})
+	assert.False(t, ok)
+}
+
+func TestChallenge(t *testing.T) {
+	srv := testServer(t, []byte(testSecret), []byte(testSecret))
+	defer srv.Close()
+	ar := testAuth(t, srv.LocalAddr().String())
+
+	pending, ok := ar.Authenticate(nil, &auth.Credentials{UserIdentifier: "bob", Secret: []byte("secret")})
+	if !assert.True(t, ok) {
+		return
+	}
+	assert.Equal(t, auth.StatusPending, pending.Status)
+	assert.Equal(t, "Enter OTP", pending.GetMetaString(auth.MetaChallenge))
+
+	// The user name comes from the pending context
+	actx, ok := ar.Authenticate(pending, &auth.Credentials{UserIdentifier: "mallory", Secret: []byte("123456")})
+	if assert.True(t, ok) {
+		assert.Equal(t, auth.StatusCompleted, actx.Status)
+		assert.Equal(t, "bob", actx.SubjectName)
+		assert.Nil(t, actx.Parent)
+	}
+
+	_, ok = ar.Authenticate(pending, &auth.Credentials{Secret: []byte("000000")})
+	assert.False(t, ok)
+}
+
+func TestInvalidReplies(t *testing.T) {
+	// Replies signed with another secret are ignored
+	srv := testServer(t, []byte(testSecret), []byte("other secret"))
+	defer srv.Close()
+	ar := testAuth(t, srv.LocalAddr().String())
+	_, ok := ar.Authenticate(nil, &auth.Credentials{UserIdentifier: "alice", Secret: []byte("secret")})
+	assert.False(t, ok)
+
+	_, err := decodePacket([]byte{2, 1, 0, 22, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 5})
+	assert.Error(t, err)
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint16(b[2:], 30)
+	_, err = decodePacket(b)
+	assert.Error(t, err)
+}
@@ -0,0 +1,35 @@
+package authradius
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// RADIUS servers as host:port, tried in order
+	Servers []string
+	Secret  string
+	// Timeout in seconds for a single attempt
+	Timeout int
+	Retries int
+	// Sent as the NAS-Identifier attribute when set
+	NASIdentifier string `yaml:"nasIdentifier"`
+	// Reject replies without the Message-Authenticator attribute
+	RequireMessageAuthenticator bool `yaml:"requireMessageAuthenticator"`
+	// Values of this attribute in the Access-Accept are used as the groups
+	// of the user, e.g. 25 for Class or 11 for Filter-Id
+	GroupsAttribute int `yaml:"groupsAttribute"`
+
+	UserNamePrincipal bool `yaml:"userNamePrincipal"`
+	Principals        []string
+	CriticalOptions   map[string]string `yaml:"criticalOptions"`
+	Extensions        map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:    DefaultName,
+	Realm:   DefaultRealm,
+	Servers: []string{"127.0.0.1:1812"},
+	Timeout: 5,
+	Retries: 2,
+
+	UserNamePrincipal: true,
+}
@@ -0,0 +1,240 @@
+package authradius
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/binary"
+	"net"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// Packet codes and attribute types of RFC 2865 and RFC 3579
+const (
+	codeAccessRequest   = 1
+	codeAccessAccept    = 2
+	codeAccessReject    = 3
+	codeAccessChallenge = 11
+
+	attrUserName             = 1
+	attrUserPassword         = 2
+	attrReplyMessage         = 18
+	attrState                = 24
+	attrNASIdentifier        = 32
+	attrMessageAuthenticator = 80
+
+	headerSize      = 20
+	maxPacketSize   = 4096
+	maxPasswordSize = 128
+)
+
+type attribute struct {
+	Type  byte
+	Value []byte
+}
+
+type packet struct {
+	Code          byte
+	Identifier    byte
+	Authenticator [16]byte
+	Attributes    []attribute
+}
+
+func (p *packet) add(typ byte, value []byte) {
+	p.Attributes = append(p.Attributes, attribute{Type: typ, Value: value})
+}
+
+func (p *packet) get(typ byte) []byte {
+	for _, a := range p.Attributes {
+		if a.Type == typ {
+			return a.Value
+		}
+	}
+	return nil
+}
+
+func (p *packet) getAll(typ byte) [][]byte {
+	var r [][]byte
+	for _, a := range p.Attributes {
+		if a.Type == typ {
+			r = append(r, a.Value)
+		}
+	}
+	return r
+}
+
+func (p *packet) encode() ([]byte, error) {
+	b := make([]byte, headerSize, maxPacketSize)
+	b[0] = p.Code
+	b[1] = p.Identifier
+	copy(b[4:], p.Authenticator[:])
+	for _, a := range p.Attributes {
+		if len(a.Value) > 253 {
+			return nil, errors.Errorf("attribute %d too long", a.Type)
+		}
+		b = append(b, a.Type, byte(len(a.Value)+2))
+		b = append(b, a.Value...)
+	}
+	if len(b) > maxPacketSize {
+		return nil, errors.New("packet too long")
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	return b, nil
+}
+
+func decodePacket(b []byte) (*packet, error) {
+	if len(b) < headerSize {
+		return nil, errors.New("packet too short")
+	}
+	size := int(binary.BigEndian.Uint16(b[2:]))
+	if size < headerSize || size > len(b) {
+		return nil, errors.New("invalid packet length")
+	}
+	p := &packet{Code: b[0], Identifier: b[1]}
+	copy(p.Authenticator[:], b[4:headerSize])
+	for rest := b[headerSize:size]; len(rest) > 0; {
+		if len(rest) < 2 || rest[1] < 2 || int(rest[1]) > len(rest) {
+			return nil, errors.New("invalid attribute")
+		}
+		p.add(rest[0], rest[2:rest[1]])
+		rest = rest[rest[1]:]
+	}
+	return p, nil
+}
+
+// Hide the User-Password attribute (RFC 2865 section 5.2)
+func hidePassword(password, secret []byte, authenticator [16]byte) ([]byte, error) {
+	if len(password) > maxPasswordSize {
+		return nil, errors.New("password too long")
+	}
+	padded := make([]byte, (len(password)+15)/16*16)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	copy(padded, password)
+	prev := authenticator[:]
+	for i := 0; i < len(padded); i += 16 {
+		h := md5.New()
+		h.Write(secret)
+		h.Write(prev)
+		sum := h.Sum(nil)
+		for j := range sum {
+			padded[i+j] ^= sum[j]
+		}
+		prev = padded[i : i+16]
+	}
+	return padded, nil
+}
+
+// Build an Access-Request signed with the Message-Authenticator attribute
+func accessRequest(secret []byte, attrs []attribute, password []byte) ([]byte, *packet, error) {
+	p := &packet{Code: codeAccessRequest, Identifier: util.RandBytes(1)[0]}
+	copy(p.Authenticator[:], util.RandBytes(16))
+	p.Attributes = append(p.Attributes, attrs...)
+	hidden, err := hidePassword(password, secret, p.Authenticator)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.add(attrUserPassword, hidden)
+	p.add(attrMessageAuthenticator, make([]byte, md5.Size))
+	b, err := p.encode()
+	if err != nil {
+		return nil, nil, err
+	}
+	mac := hmac.New(md5.New, secret)
+	mac.Write(b)
+	copy(b[len(b)-md5.Size:], mac.Sum(nil))
+	return b, p, nil
+}
+
+// Check the Response Authenticator and the Message-Authenticator of a reply
+func verifyResponse(b []byte, req *packet, secret []byte, requireMessageAuth bool) (*packet, error) {
+	p, err := decodePacket(b)
+	if err != nil {
+		return nil, err
+	}
+	if p.Identifier != req.Identifier {
+		return nil, errors.New("identifier mismatch")
+	}
+	b = b[:binary.BigEndian.Uint16(b[2:])]
+	h := md5.New()
+	h.Write(b[:4])
+	h.Write(req.Authenticator[:])
+	h.Write(b[headerSize:])
+	h.Write(secret)
+	if subtle.ConstantTimeCompare(h.Sum(nil), p.Authenticator[:]) != 1 {
+		return nil, errors.New("invalid response authenticator")
+	}
+
+	ma := p.get(attrMessageAuthenticator)
+	if ma == nil {
+		if requireMessageAuth {
+			return nil, errors.New("missing Message-Authenticator")
+		}
+		return p, nil
+	}
+	if len(ma) != md5.Size {
+		return nil, errors.New("invalid Message-Authenticator")
+	}
+	// Computed with the request authenticator and the attribute zeroed
+	zeroed := append([]byte{}, b...)
+	copy(zeroed[4:headerSize], req.Authenticator[:])
+	off := headerSize
+	for off < len(zeroed) {
+		if zeroed[off] == attrMessageAuthenticator {
+			copy(zeroed[off+2:off+2+md5.Size], make([]byte, md5.Size))
+			break
+		}
+		off += int(zeroed[off+1])
+	}
+	mac := hmac.New(md5.New, secret)
+	mac.Write(zeroed)
+	if !hmac.Equal(mac.Sum(nil), ma) {
+		return nil, errors.New("invalid Message-Authenticator")
+	}
+	return p, nil
+}
+
+// Send the request to the server and wait for a valid reply, retransmitting
+// on timeout
+func exchange(server string, req []byte, reqp *packet, secret []byte, timeout time.Duration, retries int, requireMessageAuth bool) (*packet, error) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, maxPacketSize)
+	for i := 0; i <= retries; i++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			// Ignore packets that do not belong to this request
+			if p, err := verifyResponse(buf[:n], reqp, secret, requireMessageAuth); err == nil {
+				return p, nil
+			}
+		}
+	}
+	return nil, errors.Errorf("no reply from %s", server)
+}
+
+// Reply-Message attributes joined to a single line
+func replyMessage(p *packet) string {
+	var lines [][]byte
+	for _, v := range p.getAll(attrReplyMessage) {
+		lines = append(lines, bytes.TrimSpace(v))
+	}
+	return string(bytes.Join(lines, []byte(" ")))
+}
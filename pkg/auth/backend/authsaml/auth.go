@@ -0,0 +1,365 @@
+package authsaml
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stateKey = "state"
+
+	relayStateParam   = "RelayState"
+	samlResponseParam = "SAMLResponse"
+
+	subjectName = "subjectName"
+	principal   = "principal"
+)
+
+type entryState struct {
+	requestID string
+	assertion *assertionInfo
+	ts        time.Time
+}
+
+type AuthSAML struct {
+	config *Config
+	log    *logrus.Entry
+	tpls   *template.Template
+	certs  []*x509.Certificate
+
+	sync.RWMutex
+	pendingRequests map[string]entryState
+	nextEvict       *time.Timer
+}
+
+func (as *AuthSAML) authFlowTimeout() time.Duration {
+	return time.Duration(as.config.AuthFlowTimeout) * time.Second
+}
+
+// Pending auth request in the shared state store
+type sharedEntryState struct {
+	RequestID string         `json:"request_id"`
+	Assertion *assertionInfo `json:"assertion,omitempty"`
+	TS        time.Time      `json:"ts"`
+}
+
+func sharedStateKey(state string) string {
+	return "saml:state:" + state
+}
+
+// Save pending auth request with the relay state as the key and schedule an
+// evict task. With a shared state store the request is saved there for the
+// IdP response to be handled by any replica
+func (as *AuthSAML) saveState(state string, e entryState) error {
+	if e.ts.IsZero() {
+		e.ts = time.Now()
+	}
+	if sharedstate.IsShared() {
+		raw, err := json.Marshal(sharedEntryState{RequestID: e.requestID, Assertion: e.assertion, TS: e.ts})
+		if err != nil {
+			return errors.Wrap(err, "cannot encode state")
+		}
+		return sharedstate.Get().Set(sharedStateKey(state), raw, as.authFlowTimeout())
+	}
+	as.Lock()
+	defer as.Unlock()
+	if _, found := as.pendingRequests[state]; !found && len(as.pendingRequests) >= as.config.MaxPendingAuthAttempts {
+		return errors.New("maximum number of pending requests reached")
+	}
+
+	as.pendingRequests[state] = e
+	if as.nextEvict != nil {
+		as.nextEvict.Reset(as.authFlowTimeout())
+	} else {
+		as.nextEvict = time.AfterFunc(as.authFlowTimeout(), func() {
+			as.evictStateEntries()
+		})
+	}
+	return nil
+}
+
+func (as *AuthSAML) deleteState(state string) {
+	if sharedstate.IsShared() {
+		if err := sharedstate.Get().Delete(sharedStateKey(state)); err != nil {
+			as.log.WithError(err).WithField("state", state).Error("cannot delete state")
+		}
+		return
+	}
+	as.Lock()
+	defer as.Unlock()
+	delete(as.pendingRequests, state)
+}
+
+// Return auth request if the state matches and the request hasn't expired
+func (as *AuthSAML) getState(state string) (entryState, bool) {
+	if sharedstate.IsShared() {
+		raw, err := sharedstate.Get().Get(sharedStateKey(state))
+		if err != nil {
+			return entryState{}, false
+		}
+		var v sharedEntryState
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return entryState{}, false
+		}
+		if v.TS.Add(as.authFlowTimeout()).After(time.Now()) {
+			return entryState{requestID: v.RequestID, assertion: v.Assertion, ts: v.TS}, true
+		}
+		return entryState{}, false
+	}
+	as.RLock()
+	defer as.RUnlock()
+	if v, ok := as.pendingRequests[state]; ok {
+		if v.ts.Add(as.authFlowTimeout()).After(time.Now()) {
+			return v, true
+		}
+	}
+	return entryState{}, false
+}
+
+// Evict expired auth requests
+func (as *AuthSAML) evictStateEntries() {
+	as.Lock()
+	defer as.Unlock()
+	for k, v := range as.pendingRequests {
+		if v.ts.Add(as.authFlowTimeout()).Before(time.Now()) {
+			delete(as.pendingRequests, k)
+			as.log.WithField("state", k).Info("evicted")
+		}
+	}
+}
+
+func (as *AuthSAML) startFlow(pctx *auth.AuthContext, meta map[string]interface{}) (*auth.AuthContext, bool) {
+	log := as.log.WithField("action", "startFlow")
+	if meta == nil {
+		meta = map[string]interface{}{}
+	}
+	// The relay state is the key to the pending request. The request id
+	// is checked against the assertion
+	state := newRandomID()
+	requestID := "_" + newRandomID()
+	log = log.WithField("state", state).WithField("audit_id", meta[auth.MetaAuditID])
+	authURL, err := as.authnRequestURL(requestID, state, time.Now())
+	if err != nil {
+		log.WithError(err).Error("cannot create authentication request")
+		return nil, false
+	}
+	meta[stateKey] = state
+	meta[auth.MetaFederationAuthURL] = authURL
+	newctx := &auth.AuthContext{
+		Status:        auth.StatusPending,
+		Parent:        pctx,
+		Authenticator: as.Name(),
+		AuthMeta:      meta,
+	}
+	if err := as.saveState(state, entryState{requestID: requestID}); err != nil {
+		log.WithError(err).Error("cannot save state")
+		return nil, false
+	}
+	log.Info("waiting for the IdP response")
+	return newctx, true
+}
+
+func (as *AuthSAML) completeFlow(pctx *auth.AuthContext) (*auth.AuthContext, bool) {
+	log := as.log.WithField("action", "completeFlow")
+	state := pctx.GetMetaString(stateKey)
+	log = log.WithField("audit_id", pctx.GetMetaString(auth.MetaAuditID)).
+		WithField("state", state)
+	entry, ok := as.getState(state)
+	if !ok {
+		log.Warning("unknown pending auth request")
+		return nil, false
+	}
+	if entry.assertion == nil {
+		log.Info("auth flow is incomplete")
+		return pctx, true
+	}
+	as.fillAuthContext(pctx, entry.assertion)
+	as.deleteState(state)
+	log.Info("completed authentication")
+	return pctx, true
+}
+
+func (as *AuthSAML) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	if pctx == nil {
+		as.log.Debug("no actx, start new flow")
+		return as.startFlow(nil, creds.Meta)
+	}
+
+	if pctx.Authenticator == as.Name() {
+		as.log.Debug("completing flow")
+		return as.completeFlow(pctx)
+	}
+
+	as.log.Debug("mfa, starting new flow")
+	return as.startFlow(pctx, creds.Meta)
+}
+
+func (as *AuthSAML) Type() string {
+	return Type
+}
+
+func (as *AuthSAML) Name() string {
+	return as.config.Name
+}
+
+func (as *AuthSAML) Realm() string {
+	return as.config.Realm
+}
+
+func (as *AuthSAML) CredentialType() string {
+	return auth.CredentialFederated
+}
+
+// Handle the response posted by the IdP to the assertion consumer service
+func (as *AuthSAML) FederationCallback(data interface{}) error {
+	log := as.log.WithField("action", "callback")
+	params, ok := data.(url.Values)
+	if !ok {
+		log.Info("decoding error")
+		return errors.New("decoding error")
+	}
+	state := params.Get(relayStateParam)
+	if state == "" {
+		log.Info("no relay state")
+		return errors.New("no relay state")
+	}
+	log = log.WithField("state", state)
+	encoded := params.Get(samlResponseParam)
+	if encoded == "" {
+		log.Info("no SAML response")
+		return errors.New("no SAML response")
+	}
+	entry, ok := as.getState(state)
+	if !ok || entry.assertion != nil {
+		log.Info("unknown state")
+		return errors.New("no matching state found")
+	}
+	assertion, err := as.parseResponse(encoded, entry.requestID, time.Now())
+	if err != nil {
+		log.WithError(err).Warn("invalid SAML response")
+		return errors.Wrap(err, "invalid SAML response")
+	}
+	log.WithField("name_id", assertion.NameID).Debug("got assertion")
+	entry.assertion = assertion
+	if err := as.saveState(state, entry); err != nil {
+		return err
+	}
+	log.Info("callback succeeded")
+	return nil
+}
+
+// Values of the attribute or the NameID when no attribute is configured
+func (as *AuthSAML) selectValues(a *assertionInfo, attr string) []string {
+	if attr == "" {
+		if a.NameID == "" {
+			return nil
+		}
+		return []string{a.NameID}
+	}
+	return a.Attributes[attr]
+}
+
+func (as *AuthSAML) fillAuthContext(actx *auth.AuthContext, a *assertionInfo) {
+	mappings := as.config.AttributeMappings
+	if v := as.selectValues(a, mappings.SubjectNameAttribute); len(v) > 0 {
+		actx.SubjectName = as.renderTpl(subjectName, v[0])
+	}
+	for _, v := range as.selectValues(a, mappings.PrincipalsAttribute) {
+		actx.Principals = append(actx.Principals, as.renderTpl(principal, v))
+	}
+	// From configuration
+	actx.Principals = append(actx.Principals, as.config.Principals...)
+	actx.CriticalOptions = as.config.CriticalOptions
+	actx.Extensions = as.config.Extensions
+
+	// Expose the attributes and groups to the principal mapping
+	if actx.AuthMeta == nil {
+		actx.AuthMeta = map[string]interface{}{}
+	}
+	claims := map[string]interface{}{"name_id": a.NameID}
+	for k, v := range a.Attributes {
+		claims[k] = v
+	}
+	actx.AuthMeta[auth.MetaClaims] = claims
+	if mappings.GroupsAttribute != "" {
+		if groups := a.Attributes[mappings.GroupsAttribute]; groups != nil {
+			actx.AuthMeta[auth.MetaGroups] = groups
+		}
+	}
+
+	actx.Status = auth.StatusCompleted
+}
+
+func (as *AuthSAML) renderTpl(name string, data interface{}) string {
+	buf := bytes.NewBuffer([]byte{})
+	err := as.tpls.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		as.log.WithError(err).Errorf("template render error: %s", name)
+	}
+	return buf.String()
+}
+
+func New(config *Config) (*AuthSAML, error) {
+	if config.EntityID == "" ||
+		config.ACSURL == "" ||
+		config.IdPSSOURL == "" ||
+		len(config.IdPCertificates) == 0 {
+
+		return nil, errors.Errorf("%s: required config items: entityID, acsURL, idpSSOURL, idpCertificates", config.Name)
+	}
+	certs, err := parseCertificates(config.IdPCertificates)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s", config.Name)
+	}
+	if len(certs) == 0 {
+		return nil, errors.Errorf("%s: no IdP certificates found", config.Name)
+	}
+
+	var tplError error
+	rootTpl := template.New("root")
+	parseTpl := func(name, tpl string) {
+		_, err := rootTpl.New(name).Parse(tpl)
+		if err != nil {
+			tplError = errors.Wrapf(err, "cannot parse %s", name)
+		}
+	}
+	parseTpl(subjectName, config.AttributeMappings.SubjectNameTemplate)
+	parseTpl(principal, config.AttributeMappings.PrincipalTemplate)
+	if tplError != nil {
+		return nil, tplError
+	}
+
+	return &AuthSAML{
+		config:          config,
+		tpls:            rootTpl,
+		certs:           certs,
+		pendingRequests: map[string]entryState{},
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}, nil
+}
+
+// Random identifier safe for URLs and XML IDs
+func newRandomID() string {
+	id := util.RandB64(32)
+	id = strings.Replace(id, "+", "-", -1)
+	id = strings.Replace(id, "/", "-", -1)
+	return strings.TrimRight(id, "=")
+}
@@ -0,0 +1,350 @@
+package authsaml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testEntityID    = "https://ca.example.com"
+	testACSURL      = "https://ca.example.com/v1/auth_callback/authsaml"
+	testIdPEntityID = "https://idp.example.com"
+	testIdPSSOURL   = "https://idp.example.com/sso?tenant=1"
+)
+
+var (
+	idpKey, otherKey *rsa.PrivateKey
+	// DER of the IdP certificate
+	idpCert []byte
+)
+
+func init() {
+	var err error
+	if idpKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	if otherKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if idpCert, err = x509.CreateCertificate(rand.Reader, tpl, tpl, &idpKey.PublicKey, idpKey); err != nil {
+		panic(err)
+	}
+}
+
+func idpCertificate() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: idpCert}))
+}
+
+func getAuthenticator() *AuthSAML {
+	conf := *Defaults
+	conf.EntityID = testEntityID
+	conf.ACSURL = testACSURL
+	conf.IdPEntityID = testIdPEntityID
+	conf.IdPSSOURL = testIdPSSOURL
+	conf.IdPCertificates = []string{idpCertificate()}
+	conf.AttributeMappings.SubjectNameAttribute = "displayName"
+	conf.AttributeMappings.PrincipalsAttribute = "uid"
+	conf.AttributeMappings.GroupsAttribute = "groups"
+	ab, err := New(&conf)
+	if err != nil {
+		panic(err)
+	}
+	return ab
+}
+
+type testAssertion struct {
+	requestID string
+	audience  string
+	notAfter  time.Time
+	// The response is signed in addition to or instead of the assertion
+	signResponse bool
+	onlyResponse bool
+	// Applied to the signed XML
+	tamper func(string) string
+	key    *rsa.PrivateKey
+}
+
+// Enveloped signature over the root element with the IdP certificate in
+// KeyInfo. The signature replaces the <!--sig--> placeholder, which is not
+// part of the digest
+func sign(t *testing.T, doc string, key *rsa.PrivateKey) string {
+	d := etree.NewDocument()
+	if err := d.ReadFromString(doc); err != nil {
+		t.Fatal(err)
+	}
+	ctx := dsig.NewDefaultSigningContext(dsig.TLSCertKeyStore(tls.Certificate{
+		Certificate: [][]byte{idpCert},
+		PrivateKey:  key,
+	}))
+	ctx.Canonicalizer = dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	signed, err := ctx.SignEnveloped(d.Root())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Appended as the last child
+	sig := etree.NewDocument()
+	sig.SetRoot(signed.Child[len(signed.Child)-1].(*etree.Element))
+	r, err := sig.WriteToString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(doc, "<!--sig-->", r, 1)
+}
+
+func (ta testAssertion) response(t *testing.T) string {
+	now := time.Now().UTC()
+	if ta.audience == "" {
+		ta.audience = testEntityID
+	}
+	if ta.notAfter.IsZero() {
+		ta.notAfter = now.Add(5 * time.Minute)
+	}
+	if ta.key == nil {
+		ta.key = idpKey
+	}
+	assertion := fmt.Sprintf(`<saml:Assertion xmlns:saml="%s" ID="_assertion" Version="2.0" IssueInstant="%s">`+
+		`<saml:Issuer>%s</saml:Issuer><!--sig-->`+
+		`<saml:Subject><saml:NameID>jdoe@example.com</saml:NameID>`+
+		`<saml:SubjectConfirmation Method="%s"><saml:SubjectConfirmationData InResponseTo="%s" Recipient="%s" NotOnOrAfter="%s"/></saml:SubjectConfirmation></saml:Subject>`+
+		`<saml:Conditions NotBefore="%s" NotOnOrAfter="%s"><saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction></saml:Conditions>`+
+		`<saml:AttributeStatement>`+
+		`<saml:Attribute Name="urn:oid:2.16.840.1.113730.3.1.241" FriendlyName="displayName"><saml:AttributeValue>John &amp; Doe</saml:AttributeValue></saml:Attribute>`+
+		`<saml:Attribute Name="uid"><saml:AttributeValue>jdoe</saml:AttributeValue></saml:Attribute>`+
+		`<saml:Attribute Name="groups"><saml:AttributeValue>admins</saml:AttributeValue><saml:AttributeValue>users</saml:AttributeValue></saml:Attribute>`+
+		`</saml:AttributeStatement></saml:Assertion>`,
+		nsAssertion, now.Format(samlTimeFormat), testIdPEntityID,
+		cmBearer, ta.requestID, testACSURL, ta.notAfter.Format(samlTimeFormat),
+		now.Add(-time.Minute).Format(samlTimeFormat), ta.notAfter.Format(samlTimeFormat), ta.audience)
+	if !ta.onlyResponse {
+		assertion = sign(t, assertion, ta.key)
+	}
+	resp := fmt.Sprintf(`<samlp:Response xmlns:samlp="%s" xmlns:saml="%s" ID="_response" Version="2.0" Destination="%s" InResponseTo="%s">`+
+		`<saml:Issuer>%s</saml:Issuer><!--sig--><samlp:Status><samlp:StatusCode Value="%s"/></samlp:Status>%s</samlp:Response>`,
+		nsProtocol, nsAssertion, testACSURL, ta.requestID, testIdPEntityID, statusSuccess,
+		strings.Replace(assertion, ` xmlns:saml="`+nsAssertion+`"`, "", 1))
+	if ta.signResponse || ta.onlyResponse {
+		resp = sign(t, resp, ta.key)
+	} else {
+		resp = strings.Replace(resp, "<!--sig-->", "", 1)
+	}
+	if ta.tamper != nil {
+		resp = ta.tamper(resp)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(resp))
+}
+
+// Start a flow and return the relay state and the request id from the URL
+func startFlow(t *testing.T, ab *AuthSAML) (*auth.AuthContext, string, string) {
+	actx, ok := ab.Authenticate(nil, &auth.Credentials{})
+	if !ok || actx == nil {
+		t.Fatal("cannot start flow")
+	}
+	u, err := url.Parse(actx.GetMetaString(auth.MetaFederationAuthURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "1", u.Query().Get("tenant"))
+	raw, err := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := parseXML(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, req.is(nsProtocol, "AuthnRequest"))
+	assert.Equal(t, testACSURL, req.attr("AssertionConsumerServiceURL"))
+	assert.Equal(t, testEntityID, req.child(nsAssertion, "Issuer").text())
+	return actx, u.Query().Get("RelayState"), req.attr("ID")
+}
+
+func TestParseXML(t *testing.T) {
+	assert := assert.New(t)
+	root, err := parseXML([]byte(`<?xml version="1.0"?>` + "\n" +
+		`<a:root xmlns:a="urn:a" z="1"><a:child>x &amp;<!-- comment --> y</a:child><c xmlns="urn:c"/></a:root>`))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(root.is("urn:a", "root"))
+	assert.Equal("1", root.attr("z"))
+	assert.Equal("x & y", root.child("urn:a", "child").text())
+	assert.NotNil(root.child("urn:c", "c"))
+	assert.Nil(root.child("urn:a", "c"))
+
+	_, err = parseXML([]byte(`<!DOCTYPE foo [<!ENTITY x "y">]><foo>&x;</foo>`))
+	assert.Error(err)
+	_, err = parseXML([]byte(`<!DOCTYPE foo><foo/>`))
+	assert.Error(err)
+}
+
+func TestSAMLFlow(t *testing.T) {
+	assert := assert.New(t)
+	ab := getAuthenticator()
+	actx, state, requestID := startFlow(t, ab)
+
+	actx, ok := ab.Authenticate(actx, &auth.Credentials{})
+	assert.True(ok)
+	assert.Equal(auth.StatusPending, actx.Status)
+
+	params := url.Values{}
+	params.Set(relayStateParam, state)
+	params.Set(samlResponseParam, testAssertion{requestID: requestID}.response(t))
+	if !assert.NoError(ab.FederationCallback(params)) {
+		return
+	}
+	assert.Error(ab.FederationCallback(params), "responses cannot be replayed")
+
+	actx, ok = ab.Authenticate(actx, &auth.Credentials{})
+	assert.True(ok)
+	if !assert.NotNil(actx) {
+		return
+	}
+	assert.Equal(auth.StatusCompleted, actx.Status)
+	assert.Equal("John & Doe", actx.SubjectName)
+	assert.Equal([]string{"jdoe"}, actx.Principals)
+	assert.Equal([]string{"admins", "users"}, actx.GetGroups())
+
+	actx, ok = ab.Authenticate(actx, &auth.Credentials{})
+	assert.False(ok, "repeating completed flow should return auth failure")
+	assert.Nil(actx)
+}
+
+func TestSAMLSignedResponses(t *testing.T) {
+	ab := getAuthenticator()
+	cases := map[string]testAssertion{
+		"response": {onlyResponse: true},
+		"both":     {signResponse: true},
+		// Comments are not part of the signed content and must not
+		// truncate the values
+		"comment injection": {tamper: func(s string) string {
+			s = strings.Replace(s, "jdoe@example.com</saml:NameID>", "jdoe<!---->@example.com</saml:NameID>", 1)
+			return strings.Replace(s, "<saml:AttributeValue>jdoe<", "<saml:AttributeValue>jd<!-- x -->oe<", 1)
+		}},
+	}
+	for name, ta := range cases {
+		t.Run(name, func(t *testing.T) {
+			ta.requestID = "_request"
+			a, err := ab.parseResponse(ta.response(t), ta.requestID, time.Now())
+			if assert.NoError(t, err) {
+				assert.Equal(t, "jdoe@example.com", a.NameID)
+				assert.Equal(t, []string{"jdoe"}, a.Attributes["uid"])
+			}
+		})
+	}
+}
+
+func TestSAMLInvalidResponses(t *testing.T) {
+	ab := getAuthenticator()
+	cases := map[string]func(requestID string) testAssertion{
+		"tampered": func(id string) testAssertion {
+			return testAssertion{requestID: id, tamper: func(s string) string {
+				return strings.Replace(s, "<saml:AttributeValue>admins", "<saml:AttributeValue>root", 1)
+			}}
+		},
+		"wrapped": func(id string) testAssertion {
+			// Signed assertion moved away and replaced with an unsigned one
+			return testAssertion{requestID: id, tamper: func(s string) string {
+				i := strings.Index(s, "<saml:Assertion")
+				j := strings.Index(s, "</saml:Assertion>") + len("</saml:Assertion>")
+				forged := strings.Replace(s[i:j], "jdoe", "root", -1)
+				return s[:i] + `<samlp:Extensions>` + s[i:j] + `</samlp:Extensions>` + forged + s[j:]
+			}}
+		},
+		"wrapped with same id": func(id string) testAssertion {
+			// Forged copy of the signed assertion with the original moved away
+			return testAssertion{requestID: id, tamper: func(s string) string {
+				i := strings.Index(s, "<saml:Assertion")
+				j := strings.Index(s, "</saml:Assertion>") + len("</saml:Assertion>")
+				forged := strings.Replace(s[i:j], "jdoe", "root", -1)
+				return s[:i] + forged + `<samlp:Extensions>` + s[i:j] + `</samlp:Extensions>` + s[j:]
+			}}
+		},
+		"wrapped in signature": func(id string) testAssertion {
+			// Signed assertion inside the signature of a forged one
+			return testAssertion{requestID: id, tamper: func(s string) string {
+				i := strings.Index(s, "<saml:Assertion")
+				j := strings.Index(s, "</saml:Assertion>") + len("</saml:Assertion>")
+				forged := strings.Replace(s[i:j], "jdoe", "root", -1)
+				forged = strings.Replace(forged, "</ds:Signature>", "<ds:Object>"+s[i:j]+"</ds:Object></ds:Signature>", 1)
+				return s[:i] + forged + s[j:]
+			}}
+		},
+		"tampered signed response": func(id string) testAssertion {
+			return testAssertion{requestID: id, onlyResponse: true, tamper: func(s string) string {
+				return strings.Replace(s, "<saml:AttributeValue>admins", "<saml:AttributeValue>root", 1)
+			}}
+		},
+		"wrapped signed response": func(id string) testAssertion {
+			// Signed response moved under a forged one
+			return testAssertion{requestID: id, onlyResponse: true, tamper: func(s string) string {
+				i := strings.Index(s, "<samlp:Response")
+				j := strings.Index(s, "<saml:Assertion")
+				forged := s[i:j] + strings.Replace(s[j:], "jdoe", "root", -1)
+				forged = strings.Replace(forged, "<ds:Signature", "<samlp:Extensions>"+s[i:]+"</samlp:Extensions><ds:Signature", 1)
+				return s[:i] + forged
+			}}
+		},
+		"unsigned": func(id string) testAssertion {
+			return testAssertion{requestID: id, tamper: func(s string) string {
+				i := strings.Index(s, "<ds:Signature")
+				j := strings.Index(s, "</ds:Signature>") + len("</ds:Signature>")
+				return s[:i] + s[j:]
+			}}
+		},
+		"wrong key": func(id string) testAssertion {
+			return testAssertion{requestID: id, key: otherKey}
+		},
+		"wrong audience": func(id string) testAssertion {
+			return testAssertion{requestID: id, audience: "https://other.example.com"}
+		},
+		"wrong request": func(id string) testAssertion {
+			return testAssertion{requestID: "_other"}
+		},
+		"expired": func(id string) testAssertion {
+			return testAssertion{requestID: id, notAfter: time.Now().Add(-time.Hour)}
+		},
+	}
+	for name, mk := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, state, requestID := startFlow(t, ab)
+			params := url.Values{}
+			params.Set(relayStateParam, state)
+			params.Set(samlResponseParam, mk(requestID).response(t))
+			assert.Error(t, ab.FederationCallback(params))
+		})
+	}
+
+	params := url.Values{}
+	params.Set(relayStateParam, "unknown")
+	params.Set(samlResponseParam, testAssertion{requestID: "_x"}.response(t))
+	assert.Error(t, ab.FederationCallback(params), "should error with unknown relay state")
+}
@@ -0,0 +1,58 @@
+package authsaml
+
+type AttributeMapping struct {
+	// Attribute holding the subject name, the NameID when empty
+	SubjectNameAttribute string `yaml:"subjectNameAttribute"`
+	SubjectNameTemplate  string `yaml:"subjectNameTemplate"`
+	// Attribute holding the principals, the NameID when empty
+	PrincipalsAttribute string `yaml:"principalsAttribute"`
+	PrincipalTemplate   string `yaml:"principalTemplate"`
+	// Attribute holding the group memberships
+	GroupsAttribute string `yaml:"groupsAttribute"`
+}
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// Entity ID of this service provider, the audience of the assertions
+	EntityID string `yaml:"entityID"`
+	// Assertion consumer service URL. This is the auth callback endpoint of
+	// the server, e.g. https://ca.example.com/v1/auth_callback/<name>
+	ACSURL string `yaml:"acsURL"`
+	// Single sign-on URL of the IdP supporting the HTTP-Redirect binding
+	IdPSSOURL string `yaml:"idpSSOURL"`
+	// Entity ID of the IdP. The issuer of the assertions is not checked
+	// when empty
+	IdPEntityID string `yaml:"idpEntityID"`
+	// PEM encoded signing certificates of the IdP. Expired certificates are
+	// not accepted
+	IdPCertificates []string `yaml:"idpCertificates"`
+	// Requested NameID format
+	NameIDFormat string `yaml:"nameIDFormat"`
+	// Allowed clock difference to the IdP in seconds
+	ClockSkew int `yaml:"clockSkew"`
+
+	AuthFlowTimeout        int `yaml:"authFlowTimeout"`
+	MaxPendingAuthAttempts int `yaml:"maxPendingAuthAttempts"`
+
+	AttributeMappings AttributeMapping `yaml:"attributeMappings"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:                   DefaultName,
+	Realm:                  DefaultRealm,
+	NameIDFormat:           "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
+	ClockSkew:              60,
+	AuthFlowTimeout:        240,
+	MaxPendingAuthAttempts: 1000,
+
+	AttributeMappings: AttributeMapping{
+		SubjectNameTemplate: "{{.}}",
+		PrincipalTemplate:   "{{.}}",
+	},
+}
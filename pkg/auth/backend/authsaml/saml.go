@@ -0,0 +1,283 @@
+package authsaml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+
+	bindingHTTPPost = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	statusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	cmBearer        = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	// Precision of the SAML timestamps
+	samlTimeFormat = "2006-01-02T15:04:05Z"
+)
+
+// Verified contents of an assertion
+type assertionInfo struct {
+	NameID     string              `json:"name_id"`
+	Attributes map[string][]string `json:"attributes"`
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// URL redirecting the browser to the IdP with an AuthnRequest using the
+// HTTP-Redirect binding. The response is posted to the ACS URL
+func (as *AuthSAML) authnRequestURL(id, relayState string, now time.Time) (string, error) {
+	req := fmt.Sprintf(`<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s">`+
+		`<saml:Issuer>%s</saml:Issuer>`+
+		`<samlp:NameIDPolicy Format="%s" AllowCreate="true"/>`+
+		`</samlp:AuthnRequest>`,
+		nsProtocol, nsAssertion,
+		xmlEscape(id),
+		now.UTC().Format(samlTimeFormat),
+		xmlEscape(as.config.IdPSSOURL),
+		xmlEscape(as.config.ACSURL),
+		bindingHTTPPost,
+		xmlEscape(as.config.EntityID),
+		xmlEscape(as.config.NameIDFormat),
+	)
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	w.Write([]byte(req))
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	u, err := url.Parse(as.config.IdPSSOURL)
+	if err != nil {
+		return "", errors.Wrap(err, "invalid idpSSOURL")
+	}
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	q.Set("RelayState", relayState)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Parse and validate a base64 encoded Response posted by the IdP to the ACS
+// URL. The response must be for the request with the given id and either the
+// response or the assertion must be signed by the IdP
+func (as *AuthSAML) parseResponse(encoded, requestID string, now time.Time) (*assertionInfo, error) {
+	raw, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid SAMLResponse encoding")
+	}
+	resp, err := parseXML(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.is(nsProtocol, "Response") {
+		return nil, errors.New("not a SAML response")
+	}
+
+	// Only the verified copies are used below so that content outside of the
+	// signed elements is ignored
+	signed := false
+	if resp.child(nsDSig, "Signature") != nil {
+		if resp, err = verifySignature(resp, as.certs, now); err != nil {
+			return nil, errors.Wrap(err, "invalid signature in Response")
+		}
+		signed = true
+	}
+	if v := resp.attr("Destination"); v != "" && v != as.config.ACSURL {
+		return nil, errors.Errorf("wrong destination %s", v)
+	}
+	if v := resp.attr("InResponseTo"); v != requestID {
+		return nil, errors.New("response is not for the pending request")
+	}
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+	if len(resp.childrenNamed(nsAssertion, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("encrypted assertions are not supported")
+	}
+	assertions := resp.childrenNamed(nsAssertion, "Assertion")
+	if len(assertions) != 1 {
+		return nil, errors.New("response must contain exactly one assertion")
+	}
+	assertion := assertions[0]
+	if assertion.child(nsDSig, "Signature") != nil {
+		if assertion, err = verifySignature(assertion, as.certs, now); err != nil {
+			return nil, errors.Wrap(err, "invalid signature in Assertion")
+		}
+		signed = true
+	}
+	if !signed {
+		return nil, errors.New("neither the response nor the assertion is signed")
+	}
+	return as.checkAssertion(assertion, requestID, now)
+}
+
+func checkStatus(resp *element) error {
+	status := resp.child(nsProtocol, "Status")
+	if status == nil {
+		return errors.New("no status in response")
+	}
+	code := status.child(nsProtocol, "StatusCode")
+	if code == nil {
+		return errors.New("no status code in response")
+	}
+	if v := code.attr("Value"); v != statusSuccess {
+		if msg := status.child(nsProtocol, "StatusMessage"); msg != nil {
+			return errors.Errorf("authentication failed: %s: %s", v, strings.TrimSpace(msg.text()))
+		}
+		return errors.Errorf("authentication failed: %s", v)
+	}
+	return nil
+}
+
+func parseSAMLTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func (as *AuthSAML) checkAssertion(a *element, requestID string, now time.Time) (*assertionInfo, error) {
+	skew := time.Duration(as.config.ClockSkew) * time.Second
+	if as.config.IdPEntityID != "" {
+		issuer := a.child(nsAssertion, "Issuer")
+		if issuer == nil || strings.TrimSpace(issuer.text()) != as.config.IdPEntityID {
+			return nil, errors.New("assertion is not issued by the IdP")
+		}
+	}
+
+	conditions := a.child(nsAssertion, "Conditions")
+	if conditions == nil {
+		return nil, errors.New("no conditions in assertion")
+	}
+	if v := conditions.attr("NotBefore"); v != "" {
+		t, err := parseSAMLTime(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid NotBefore")
+		}
+		if now.Add(skew).Before(t) {
+			return nil, errors.New("assertion is not yet valid")
+		}
+	}
+	if v := conditions.attr("NotOnOrAfter"); v != "" {
+		t, err := parseSAMLTime(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid NotOnOrAfter")
+		}
+		if !now.Add(-skew).Before(t) {
+			return nil, errors.New("assertion has expired")
+		}
+	}
+	// Every audience restriction must include this service provider
+	for _, ar := range conditions.childrenNamed(nsAssertion, "AudienceRestriction") {
+		found := false
+		for _, aud := range ar.childrenNamed(nsAssertion, "Audience") {
+			if strings.TrimSpace(aud.text()) == as.config.EntityID {
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New("assertion is not intended for this service provider")
+		}
+	}
+
+	subject := a.child(nsAssertion, "Subject")
+	if subject == nil {
+		return nil, errors.New("no subject in assertion")
+	}
+	if err := as.checkSubjectConfirmation(subject, requestID, now, skew); err != nil {
+		return nil, err
+	}
+	r := &assertionInfo{Attributes: map[string][]string{}}
+	if nameID := subject.child(nsAssertion, "NameID"); nameID != nil {
+		r.NameID = strings.TrimSpace(nameID.text())
+	}
+	for _, stmt := range a.childrenNamed(nsAssertion, "AttributeStatement") {
+		for _, attr := range stmt.childrenNamed(nsAssertion, "Attribute") {
+			var values []string
+			for _, v := range attr.childrenNamed(nsAssertion, "AttributeValue") {
+				values = append(values, strings.TrimSpace(v.text()))
+			}
+			// Attributes can be referred with both names
+			for _, name := range []string{attr.attr("Name"), attr.attr("FriendlyName")} {
+				if name != "" {
+					r.Attributes[name] = append(r.Attributes[name], values...)
+				}
+			}
+		}
+	}
+	return r, nil
+}
+
+// A bearer confirmation for this request and ACS URL is required
+func (as *AuthSAML) checkSubjectConfirmation(subject *element, requestID string, now time.Time, skew time.Duration) error {
+	for _, sc := range subject.childrenNamed(nsAssertion, "SubjectConfirmation") {
+		if sc.attr("Method") != cmBearer {
+			continue
+		}
+		data := sc.child(nsAssertion, "SubjectConfirmationData")
+		if data == nil {
+			continue
+		}
+		if data.attr("InResponseTo") != requestID || data.attr("Recipient") != as.config.ACSURL {
+			continue
+		}
+		t, err := parseSAMLTime(data.attr("NotOnOrAfter"))
+		if err != nil || !now.Add(-skew).Before(t) {
+			continue
+		}
+		return nil
+	}
+	return errors.New("no valid bearer subject confirmation in assertion")
+}
+
+// PEM encoded certificates or the base64 DER found in IdP metadata
+func parseCertificates(certs []string) ([]*x509.Certificate, error) {
+	var r []*x509.Certificate
+	for _, c := range certs {
+		var ders [][]byte
+		rest := []byte(c)
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			ders = append(ders, block.Bytes)
+		}
+		if ders == nil {
+			der, err := decodeBase64(c)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid IdP certificate")
+			}
+			ders = append(ders, der)
+		}
+		for _, der := range ders {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid IdP certificate")
+			}
+			r = append(r, cert)
+		}
+	}
+	return r, nil
+}
+
+// Base64 in XML may be wrapped on multiple lines
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
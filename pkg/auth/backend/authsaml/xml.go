@@ -0,0 +1,84 @@
+package authsaml
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/beevik/etree"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+	"github.com/pkg/errors"
+)
+
+// Element with namespace aware lookups
+type element struct {
+	*etree.Element
+}
+
+// Parse the document, rejecting DTDs and markup that does not survive an
+// encoding/xml round trip
+func parseXML(data []byte) (*element, error) {
+	if err := xrv.Validate(bytes.NewReader(data)); err != nil {
+		return nil, errors.Wrap(err, "invalid XML")
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return nil, errors.Wrap(err, "invalid XML")
+	}
+	for _, t := range doc.Child {
+		if _, ok := t.(*etree.Directive); ok {
+			return nil, errors.New("DTDs are not allowed")
+		}
+	}
+	if doc.Root() == nil {
+		return nil, errors.New("no root element")
+	}
+	return &element{doc.Root()}, nil
+}
+
+func (e *element) is(ns, local string) bool {
+	return e.Tag == local && e.NamespaceURI() == ns
+}
+
+// Value of an unprefixed attribute
+func (e *element) attr(name string) string {
+	for _, a := range e.Attr {
+		if a.Space == "" && a.Key == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (e *element) childrenNamed(ns, local string) []*element {
+	var r []*element
+	for _, c := range e.ChildElements() {
+		el := &element{c}
+		if el.is(ns, local) {
+			r = append(r, el)
+		}
+	}
+	return r
+}
+
+func (e *element) child(ns, local string) *element {
+	if r := e.childrenNamed(ns, local); len(r) > 0 {
+		return r[0]
+	}
+	return nil
+}
+
+// Character data of the element and its descendants. Comments split the
+// text into several nodes, which are all included so that a comment cannot
+// truncate a signed value
+func (e *element) text() string {
+	var b strings.Builder
+	for _, t := range e.Child {
+		switch v := t.(type) {
+		case *etree.CharData:
+			b.WriteString(v.Data)
+		case *etree.Element:
+			b.WriteString((&element{v}).text())
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,284 @@
+package authsshkey
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/auth/backend/authldap"
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// Pending challenges carry the user, the challenge and the time it was
+	// issued in the auth context meta
+	userKey      = "sshkey_user"
+	challengeKey = "sshkey_challenge"
+	issuedKey    = "sshkey_issued"
+	// SHA256 fingerprint of the key the user logged in with
+	MetaKeyFingerprint = "ssh_key_fingerprint"
+
+	// Signatures checked from a response
+	maxResponseKeys = 16
+)
+
+type AuthSSHKey struct {
+	config *Config
+	log    *logrus.Entry
+	dir    *authldap.AuthLDAP
+
+	// Answered challenges against replaying a response, until they expire.
+	// Only within this instance
+	answered map[string]time.Time
+	mu       sync.Mutex
+}
+
+func (ak *AuthSSHKey) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	log := ak.log.WithField("action", "authenticate")
+	if v, ok := creds.Meta[auth.MetaAuditID]; ok {
+		log = log.WithField(auth.MetaAuditID, v)
+	}
+	if pctx != nil && pctx.Status == auth.StatusPending && pctx.Authenticator == ak.Name() {
+		return ak.verify(pctx, creds, log)
+	}
+
+	if creds.UserIdentifier == "" {
+		log.Info("no user name")
+		return nil, false
+	}
+	challenge := util.RandB64(32)
+	meta := make(map[string]interface{}, len(creds.Meta)+4)
+	for k, v := range creds.Meta {
+		meta[k] = v
+	}
+	meta[userKey] = creds.UserIdentifier
+	meta[challengeKey] = challenge
+	meta[issuedKey] = time.Now().UTC().Format(time.RFC3339)
+	meta[auth.MetaChallenge] = challenge
+	log.WithField("user", creds.UserIdentifier).Debug("ssh key challenge")
+	return &auth.AuthContext{
+		Status:        auth.StatusPending,
+		Parent:        pctx,
+		Authenticator: ak.Name(),
+		AuthMeta:      meta,
+	}, true
+}
+
+// Check the response to the challenge of the pending context
+func (ak *AuthSSHKey) verify(pctx *auth.AuthContext, creds *auth.Credentials, log *logrus.Entry) (*auth.AuthContext, bool) {
+	user := pctx.GetMetaString(userKey)
+	challenge := pctx.GetMetaString(challengeKey)
+	log = log.WithField("user", user)
+	issued, err := time.Parse(time.RFC3339, pctx.GetMetaString(issuedKey))
+	if err != nil || user == "" || challenge == "" {
+		log.Info("invalid pending challenge")
+		return nil, false
+	}
+	timeout := time.Duration(ak.config.ChallengeTimeout) * time.Second
+	if time.Since(issued) > timeout {
+		log.Info("challenge expired")
+		return nil, false
+	}
+	if !ak.answer(challenge, issued.Add(timeout)) {
+		log.Warn("challenge already answered")
+		return nil, false
+	}
+
+	signers, err := ak.signers(user)
+	if err != nil {
+		log.WithError(err).Error("cannot look up the keys")
+		return nil, false
+	}
+	key := verifyResponse(signers, user, challenge, string(creds.Secret))
+	if key == nil {
+		log.Info("no valid signature with a key of the user")
+		return nil, false
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	log.WithField("key", fingerprint).Debug("ssh key auth successful")
+
+	actx := &auth.AuthContext{
+		Status:          auth.StatusCompleted,
+		Parent:          pctx.Parent,
+		SubjectName:     user,
+		Principals:      append([]string{}, ak.config.Principals...),
+		CriticalOptions: ak.config.CriticalOptions,
+		Extensions:      ak.config.Extensions,
+		Authenticator:   ak.Name(),
+		AuthMeta:        make(map[string]interface{}, len(creds.Meta)+1),
+	}
+	for k, v := range creds.Meta {
+		actx.AuthMeta[k] = v
+	}
+	actx.AuthMeta[MetaKeyFingerprint] = fingerprint
+	actx.AddIdentity(auth.IdentityMFA, "swk")
+	if ak.config.UserNamePrincipal {
+		actx.Principals = append(actx.Principals, user)
+	}
+	return actx, true
+}
+
+// Mark the challenge answered. False if it already was
+func (ak *AuthSSHKey) answer(challenge string, expires time.Time) bool {
+	ak.mu.Lock()
+	defer ak.mu.Unlock()
+	now := time.Now()
+	for k, v := range ak.answered {
+		if now.After(v) {
+			delete(ak.answered, k)
+		}
+	}
+	if _, ok := ak.answered[challenge]; ok {
+		return false
+	}
+	ak.answered[challenge] = expires
+	return true
+}
+
+// Keys of the user from the allowed signers and the directory
+func (ak *AuthSSHKey) signers(user string) ([]signer, error) {
+	var r []signer
+	if ak.config.AllowedSigners != "" {
+		signers, err := ak.readAllowedSigners()
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, signers...)
+	}
+	if ak.dir != nil {
+		values, err := ak.dir.UserAttribute(user, ak.config.KeyAttribute)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			key, ok, err := parseKey(v)
+			if err != nil || !ok {
+				ak.log.WithField("user", user).Warn("skipping unsupported key from the directory")
+				continue
+			}
+			r = append(r, signer{owner: user, key: key})
+		}
+	}
+	return r, nil
+}
+
+func (ak *AuthSSHKey) readAllowedSigners() ([]signer, error) {
+	f, err := os.Open(ak.config.AllowedSigners)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open allowed signers")
+	}
+	defer f.Close()
+	signers, skipped, err := parseAllowedSigners(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot parse %s", ak.config.AllowedSigners)
+	}
+	if skipped > 0 {
+		ak.log.WithField("skipped", skipped).Debug("skipped keys with unsupported options")
+	}
+	return signers, nil
+}
+
+// The key of the user with a valid signature of the challenge in the
+// response. The response has a line for each signature with the public key
+// and the signature, both in SSH wire format and base64 encoded
+func verifyResponse(signers []signer, user, challenge, response string) ssh.PublicKey {
+	data := auth.SSHKeySignedData(challenge)
+	for i, line := range strings.Split(strings.TrimSpace(response), "\n") {
+		if i >= maxResponseKeys {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		kb, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			continue
+		}
+		sb, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			continue
+		}
+		var sig ssh.Signature
+		if err := ssh.Unmarshal(sb, &sig); err != nil || sig.Format == ssh.SigAlgoRSA {
+			// No SHA-1 RSA signatures
+			continue
+		}
+		for _, s := range signers {
+			if !bytes.Equal(s.key.Marshal(), kb) || !s.allows(user) {
+				continue
+			}
+			if s.key.Verify(data, &sig) == nil {
+				return s.key
+			}
+		}
+	}
+	return nil
+}
+
+func (ak *AuthSSHKey) Type() string {
+	return Type
+}
+
+func (ak *AuthSSHKey) Name() string {
+	return ak.config.Name
+}
+
+func (ak *AuthSSHKey) Realm() string {
+	return ak.config.Realm
+}
+
+func (ak *AuthSSHKey) CredentialType() string {
+	return auth.CredentialSSHKey
+}
+
+// Check that the allowed signers can be read and the directory server is
+// reachable
+func (ak *AuthSSHKey) Probe() error {
+	if ak.config.AllowedSigners != "" {
+		if _, err := ak.readAllowedSigners(); err != nil {
+			return err
+		}
+	}
+	if ak.dir != nil {
+		return ak.dir.Probe()
+	}
+	return nil
+}
+
+func New(config *Config) (*AuthSSHKey, error) {
+	if config.AllowedSigners == "" && config.LDAP == "" {
+		return nil, errors.Errorf("%s: required config items: allowedSigners or ldap", config.Name)
+	}
+	ak := &AuthSSHKey{
+		config:   config,
+		answered: map[string]time.Time{},
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}
+	if config.AllowedSigners != "" {
+		if _, err := ak.readAllowedSigners(); err != nil {
+			return nil, errors.Wrap(err, config.Name)
+		}
+	}
+	if config.LDAP != "" {
+		dir, err := authldap.FromConfig(config.LDAP)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: cannot initialize the directory", config.Name)
+		}
+		ak.dir = dir
+	}
+	return ak, nil
+}
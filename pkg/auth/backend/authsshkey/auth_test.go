@@ -0,0 +1,179 @@
+package authsshkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Agent holding the key and its line for allowed_signers
+func newTestKey(t *testing.T, rsaKey bool) (agent.ExtendedAgent, string) {
+	var (
+		priv interface{}
+		err  error
+	)
+	if rsaKey {
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring().(agent.ExtendedAgent)
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := keyring.List()
+	return keyring, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(keys[0])))
+}
+
+// Response like the client makes
+func respond(t *testing.T, a agent.ExtendedAgent, challenge string, flags agent.SignatureFlags) []byte {
+	keys, _ := a.List()
+	sig, err := a.SignWithFlags(keys[0], auth.SSHKeySignedData(challenge), flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(base64.StdEncoding.EncodeToString(keys[0].Marshal()) + " " +
+		base64.StdEncoding.EncodeToString(ssh.Marshal(sig)))
+}
+
+func testAuth(t *testing.T, signers string) *AuthSSHKey {
+	dir, err := ioutil.TempDir("", "authsshkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	conf := *Defaults
+	conf.AllowedSigners = filepath.Join(dir, "allowed_signers")
+	conf.Principals = []string{"common"}
+	if err := ioutil.WriteFile(conf.AllowedSigners, []byte(signers), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ak, err := New(&conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ak
+}
+
+func challenge(t *testing.T, ak *AuthSSHKey, user string) *auth.AuthContext {
+	pending, ok := ak.Authenticate(nil, &auth.Credentials{UserIdentifier: user})
+	if !assert.True(t, ok) || !assert.Equal(t, auth.StatusPending, pending.Status) {
+		t.FailNow()
+	}
+	return pending
+}
+
+func TestAuthenticate(t *testing.T) {
+	alice, aliceLine := newTestKey(t, false)
+	bob, bobLine := newTestKey(t, true)
+	ak := testAuth(t, "# comment\nalice,admin-* "+aliceLine+"\n\"bob\" "+bobLine+" bob@example.com\n")
+	assert.NoError(t, ak.Probe())
+
+	pending := challenge(t, ak, "alice")
+	nonce := pending.GetMetaString(auth.MetaChallenge)
+	assert.NotEmpty(t, nonce)
+	// The user name comes from the pending context
+	actx, ok := ak.Authenticate(pending, &auth.Credentials{UserIdentifier: "bob", Secret: respond(t, alice, nonce, 0)})
+	if assert.True(t, ok) {
+		assert.Equal(t, auth.StatusCompleted, actx.Status)
+		assert.Equal(t, "alice", actx.SubjectName)
+		assert.Equal(t, []string{"common", "alice"}, actx.Principals)
+		assert.NotEmpty(t, actx.GetMetaString(MetaKeyFingerprint))
+		assert.Nil(t, actx.Parent)
+	}
+	// Not again
+	_, ok = ak.Authenticate(pending, &auth.Credentials{Secret: respond(t, alice, nonce, 0)})
+	assert.False(t, ok)
+
+	// Principal patterns
+	pending = challenge(t, ak, "admin-alice")
+	_, ok = ak.Authenticate(pending, &auth.Credentials{Secret: respond(t, alice, pending.GetMetaString(auth.MetaChallenge), 0)})
+	assert.True(t, ok)
+
+	// Key of another user
+	pending = challenge(t, ak, "bob")
+	_, ok = ak.Authenticate(pending, &auth.Credentials{Secret: respond(t, alice, pending.GetMetaString(auth.MetaChallenge), 0)})
+	assert.False(t, ok)
+
+	// Signature of another challenge
+	pending = challenge(t, ak, "alice")
+	_, ok = ak.Authenticate(pending, &auth.Credentials{Secret: respond(t, alice, "other", 0)})
+	assert.False(t, ok)
+
+	// RSA with SHA-2 only
+	pending = challenge(t, ak, "bob")
+	_, ok = ak.Authenticate(pending, &auth.Credentials{Secret: respond(t, bob, pending.GetMetaString(auth.MetaChallenge), 0)})
+	assert.False(t, ok)
+	pending = challenge(t, ak, "bob")
+	_, ok = ak.Authenticate(pending, &auth.Credentials{Secret: respond(t, bob, pending.GetMetaString(auth.MetaChallenge), agent.SignatureFlagRsaSha512)})
+	assert.True(t, ok)
+
+	// The first of the signatures made with a key of the user
+	pending = challenge(t, ak, "bob")
+	nonce = pending.GetMetaString(auth.MetaChallenge)
+	response := append(append(respond(t, alice, nonce, 0), '\n'), respond(t, bob, nonce, agent.SignatureFlagRsaSha256)...)
+	actx, ok = ak.Authenticate(pending, &auth.Credentials{Secret: response})
+	if assert.True(t, ok) {
+		assert.Equal(t, "bob", actx.SubjectName)
+	}
+
+	// The parent of the challenge is kept
+	parent := &auth.AuthContext{Status: auth.StatusCompleted, SubjectName: "alice"}
+	pending, ok = ak.Authenticate(parent, &auth.Credentials{UserIdentifier: "alice"})
+	if assert.True(t, ok) {
+		actx, ok = ak.Authenticate(pending, &auth.Credentials{Secret: respond(t, alice, pending.GetMetaString(auth.MetaChallenge), 0)})
+		if assert.True(t, ok) {
+			assert.Equal(t, parent, actx.Parent)
+		}
+	}
+}
+
+func TestChallengeTimeout(t *testing.T) {
+	alice, aliceLine := newTestKey(t, false)
+	ak := testAuth(t, "alice "+aliceLine+"\n")
+	pending := challenge(t, ak, "alice")
+	pending.AuthMeta[issuedKey] = time.Now().Add(-2 * time.Minute).UTC().Format(time.RFC3339)
+	_, ok := ak.Authenticate(pending, &auth.Credentials{Secret: respond(t, alice, pending.GetMetaString(auth.MetaChallenge), 0)})
+	assert.False(t, ok)
+}
+
+func TestAllowedSigners(t *testing.T) {
+	_, line := newTestKey(t, false)
+	signers, skipped, err := parseAllowedSigners(strings.NewReader(strings.Join([]string{
+		"*,!root " + line,
+		`alice namespaces="file,ssh-inscribe-login" ` + line,
+		`alice namespaces="git" ` + line,
+		"alice cert-authority " + line,
+		`alice valid-before="20300101" ` + line,
+	}, "\n")))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 3, skipped)
+		if assert.Len(t, signers, 2) {
+			assert.True(t, signers[0].allows("alice"))
+			assert.False(t, signers[0].allows("root"))
+			assert.True(t, signers[1].allows("alice"))
+		}
+	}
+	_, _, err = parseAllowedSigners(strings.NewReader("alice"))
+	assert.Error(t, err)
+	_, _, err = parseAllowedSigners(strings.NewReader("alice ssh-ed25519 invalid"))
+	assert.Error(t, err)
+
+	_, err = New(&Config{Name: "sshkey"})
+	assert.Error(t, err)
+}
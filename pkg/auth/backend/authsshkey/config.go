@@ -0,0 +1,31 @@
+package authsshkey
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// File of the keys in the allowed_signers format of ssh-keygen: the
+	// principals, matched against the user name, optional namespaces and
+	// the key. Read at each login
+	AllowedSigners string `yaml:"allowedSigners"`
+	// Config section of an authldap backend with a service account to look
+	// up the keys of the user from KeyAttribute
+	LDAP string `yaml:"ldap"`
+	// Attribute of the user entry with the keys in authorized_keys format
+	KeyAttribute string `yaml:"keyAttribute"`
+	// Seconds the client has to answer a challenge
+	ChallengeTimeout int `yaml:"challengeTimeout"`
+
+	UserNamePrincipal bool `yaml:"userNamePrincipal"`
+	Principals        []string
+	CriticalOptions   map[string]string `yaml:"criticalOptions"`
+	Extensions        map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:              DefaultName,
+	Realm:             DefaultRealm,
+	KeyAttribute:      "sshPublicKey",
+	ChallengeTimeout:  60,
+	UserNamePrincipal: true,
+}
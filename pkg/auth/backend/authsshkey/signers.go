@@ -0,0 +1,106 @@
+package authsshkey
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Key registered for the users matching the principals
+type signer struct {
+	principals []glob.Glob
+	// Negated with ! in allowed_signers
+	excluded []glob.Glob
+	// Of this user only, for the keys from the directory
+	owner string
+	key   ssh.PublicKey
+}
+
+func (s *signer) allows(user string) bool {
+	if s.owner != "" {
+		return s.owner == user
+	}
+	for _, g := range s.excluded {
+		if g.Match(user) {
+			return false
+		}
+	}
+	for _, g := range s.principals {
+		if g.Match(user) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a key in authorized_keys format. Keys restricted with options other
+// than namespaces including ours, like valid-before or cert-authority, are
+// not supported and skipped
+func parseKey(line string) (ssh.PublicKey, bool, error) {
+	key, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	if err != nil {
+		return nil, false, err
+	}
+	for _, o := range options {
+		v := strings.TrimPrefix(o, "namespaces=")
+		if v == o {
+			return key, false, nil
+		}
+		allowed := false
+		for _, ns := range strings.Split(strings.Trim(v, `"`), ",") {
+			allowed = allowed || ns == auth.SSHKeyNamespace
+		}
+		if !allowed {
+			return key, false, nil
+		}
+	}
+	return key, true, nil
+}
+
+// Parse the allowed_signers file. Returns the supported keys and the number
+// of skipped ones
+func parseAllowedSigners(r io.Reader) ([]signer, int, error) {
+	var (
+		signers []signer
+		skipped int
+	)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, 0, errors.Errorf("line %d: no key", n)
+		}
+		key, ok, err := parseKey(fields[1])
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "line %d", n)
+		}
+		if !ok {
+			skipped++
+			continue
+		}
+		s := signer{key: key}
+		for _, p := range strings.Split(strings.Trim(fields[0], `"`), ",") {
+			negated := strings.HasPrefix(p, "!")
+			g, err := glob.Compile(strings.TrimPrefix(p, "!"))
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "line %d: invalid principal %q", n, p)
+			}
+			if negated {
+				s.excluded = append(s.excluded, g)
+			} else {
+				s.principals = append(s.principals, g)
+			}
+		}
+		signers = append(signers, s)
+	}
+	return signers, skipped, scanner.Err()
+}
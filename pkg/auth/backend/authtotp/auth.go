@@ -0,0 +1,204 @@
+package authtotp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var ErrEnrollmentDisabled = errors.New("enrollment is disabled")
+
+type AuthTOTP struct {
+	config *Config
+	params params
+	store  SeedStore
+	log    *logrus.Entry
+	now    func() time.Time
+}
+
+func (at *AuthTOTP) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	log := at.log.WithField("action", "authenticate")
+	if v, ok := creds.Meta[auth.MetaAuditID]; ok {
+		log = log.WithField(auth.MetaAuditID, v)
+	}
+
+	user, ok := at.user(pctx, creds)
+	if !ok {
+		log.Info("no authenticated parent context")
+		return nil, false
+	}
+	log = log.WithField("user", user)
+
+	seed, err := at.store.Get(user)
+	if err == ErrNotFound {
+		log.Info("user is not enrolled")
+		return nil, false
+	}
+	if err != nil {
+		log.WithError(err).Error("cannot get seed")
+		return nil, false
+	}
+	secret, err := decodeSecret(seed.Secret)
+	if err != nil {
+		log.WithError(err).Error("invalid seed")
+		return nil, false
+	}
+	code := strings.TrimSpace(string(creds.Secret))
+	counter, ok := at.params.validate(secret, code, at.now())
+	if !ok {
+		log.Info("invalid code")
+		return nil, false
+	}
+	// Each code is only accepted once while it is within the window
+	ttl := time.Duration(at.params.Period*(2*at.params.Window+1)) * time.Second
+	key := fmt.Sprintf("totp:%s:%s:%d", at.Name(), user, counter)
+	fresh, err := sharedstate.Get().SetNX(key, []byte{1}, ttl)
+	if err != nil {
+		log.WithError(err).Error("cannot record used code")
+		return nil, false
+	}
+	if !fresh {
+		log.Info("code already used")
+		return nil, false
+	}
+	if !seed.Confirmed {
+		seed.Confirmed = true
+		if err := at.store.Put(user, seed); err != nil {
+			log.WithError(err).Error("cannot confirm seed")
+			return nil, false
+		}
+		log.Info("enrollment confirmed")
+	}
+	log.Debug("TOTP auth successful")
+
+	actx := &auth.AuthContext{
+		Status:          auth.StatusCompleted,
+		Parent:          pctx,
+		Principals:      append([]string{}, at.config.Principals...),
+		CriticalOptions: at.config.CriticalOptions,
+		Extensions:      at.config.Extensions,
+		Authenticator:   at.Name(),
+		AuthMeta:        creds.Meta,
+	}
+	if pctx == nil {
+		actx.SubjectName = user
+	}
+	actx.AddIdentity(auth.IdentityMFA, "otp")
+	return actx, true
+}
+
+// User the code is checked for. The subject of the parent context when
+// there is one
+func (at *AuthTOTP) user(pctx *auth.AuthContext, creds *auth.Credentials) (string, bool) {
+	if pctx != nil {
+		if pctx.Status != auth.StatusCompleted {
+			return "", false
+		}
+		user := pctx.GetSubjectName()
+		return user, user != ""
+	}
+	if at.config.RequireParent || creds.UserIdentifier == "" {
+		return "", false
+	}
+	return creds.UserIdentifier, true
+}
+
+// Create a new seed for the user of the auth context. An unconfirmed seed
+// is replaced, a confirmed one has to be removed by an administrator
+func (at *AuthTOTP) Enroll(actx *auth.AuthContext) (*auth.Enrollment, error) {
+	if !at.config.AllowEnrollment {
+		return nil, ErrEnrollmentDisabled
+	}
+	if actx == nil || actx.Status != auth.StatusCompleted || actx.GetSubjectName() == "" {
+		return nil, errors.New("authenticated user required")
+	}
+	user := actx.GetSubjectName()
+	seed, err := at.store.Get(user)
+	switch {
+	case err == ErrNotFound:
+	case err != nil:
+		return nil, errors.Wrap(err, "cannot get seed")
+	case seed.Confirmed:
+		return nil, auth.ErrAlreadyEnrolled
+	}
+	seed = &Seed{Secret: newSecret(), Created: at.now()}
+	if err := at.store.Put(user, seed); err != nil {
+		return nil, err
+	}
+	at.log.WithField("user", user).Info("user enrolled")
+	return &auth.Enrollment{
+		Secret: seed.Secret,
+		URI:    at.params.uri(at.config.Issuer, user, seed.Secret),
+	}, nil
+}
+
+func (at *AuthTOTP) Type() string {
+	return Type
+}
+
+func (at *AuthTOTP) Name() string {
+	return at.config.Name
+}
+
+func (at *AuthTOTP) Realm() string {
+	return at.config.Realm
+}
+
+func (at *AuthTOTP) CredentialType() string {
+	if at.config.RequireParent {
+		return auth.CredentialPin
+	}
+	return auth.CredentialUserPassword
+}
+
+func New(config *Config) (*AuthTOTP, error) {
+	var (
+		store SeedStore
+		err   error
+	)
+	switch config.Store.Type {
+	case StoreFile, "":
+		store, err = NewFileStore(config.Store.Path)
+	case StoreSQL:
+		store, err = NewSQLStore(config.Store.Driver, config.Store.DSN, config.Name)
+	default:
+		err = errors.Errorf("unknown store type %s", config.Store.Type)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: cannot open seed store", config.Name)
+	}
+	return newAuthTOTP(config, store)
+}
+
+func newAuthTOTP(config *Config, store SeedStore) (*AuthTOTP, error) {
+	p := params{
+		Algorithm: config.Algorithm,
+		Digits:    config.Digits,
+		Period:    config.Period,
+		Window:    config.Window,
+	}
+	if _, err := p.hash(); err != nil {
+		return nil, errors.Wrapf(err, "%s", config.Name)
+	}
+	if p.Digits < 6 || p.Digits > 8 || p.Period <= 0 || p.Window < 0 {
+		return nil, errors.Errorf("%s: digits must be 6-8, period positive and window not negative", config.Name)
+	}
+	return &AuthTOTP{
+		config: config,
+		params: p,
+		store:  store,
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+		now: time.Now,
+	}, nil
+}
@@ -0,0 +1,249 @@
+package authtotp
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCode(t *testing.T) {
+	// RFC 6238 appendix B
+	vectors := []struct {
+		alg    string
+		secret string
+		time   int64
+		code   string
+	}{
+		{"SHA1", "12345678901234567890", 59, "94287082"},
+		{"SHA1", "12345678901234567890", 1111111109, "07081804"},
+		{"SHA1", "12345678901234567890", 20000000000, "65353130"},
+		{"SHA256", "12345678901234567890123456789012", 59, "46119246"},
+		{"SHA256", "12345678901234567890123456789012", 1234567890, "91819424"},
+		{"SHA512", "1234567890123456789012345678901234567890123456789012345678901234", 59, "90693936"},
+		{"SHA512", "1234567890123456789012345678901234567890123456789012345678901234", 2000000000, "38618901"},
+	}
+	for _, v := range vectors {
+		p := params{Algorithm: v.alg, Digits: 8, Period: 30}
+		code, err := p.code([]byte(v.secret), uint64(v.time/30))
+		if assert.NoError(t, err) {
+			assert.Equal(t, v.code, code, "%s at %d", v.alg, v.time)
+		}
+	}
+	_, err := params{Algorithm: "MD5", Digits: 6}.code(nil, 0)
+	assert.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	p := params{Algorithm: "SHA1", Digits: 6, Period: 30, Window: 1}
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111109, 0)
+	current := uint64(now.Unix() / 30)
+	for _, d := range []int{-1, 0, 1} {
+		code, _ := p.code(secret, uint64(int(current)+d))
+		counter, ok := p.validate(secret, code, now)
+		assert.True(ok)
+		assert.Equal(uint64(int(current)+d), counter)
+	}
+	code, _ := p.code(secret, current+2)
+	_, ok := p.validate(secret, code, now)
+	assert.False(ok)
+	_, ok = p.validate(secret, "12345", now)
+	assert.False(ok)
+}
+
+func TestURI(t *testing.T) {
+	p := params{Algorithm: "SHA1", Digits: 6, Period: 30}
+	u, err := url.Parse(p.uri("ssh inscribe", "user@example.com", "JBSWY3DPEHPK3PXP"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "otpauth", u.Scheme)
+		assert.Equal(t, "totp", u.Host)
+		assert.Equal(t, "/ssh inscribe:user@example.com", u.Path)
+		assert.Equal(t, "JBSWY3DPEHPK3PXP", u.Query().Get("secret"))
+		assert.Equal(t, "ssh inscribe", u.Query().Get("issuer"))
+		assert.Equal(t, "6", u.Query().Get("digits"))
+	}
+	secret, err := decodeSecret(strings.ToLower(newSecret()))
+	assert.NoError(t, err)
+	assert.Len(t, secret, secretSize)
+}
+
+func TestFileStore(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "seeds.json")
+	fs, err := NewFileStore(path)
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = fs.Get("user")
+	assert.Equal(ErrNotFound, err)
+	created := time.Unix(1600000000, 0)
+	assert.NoError(fs.Put("user", &Seed{Secret: "ABC", Created: created}))
+
+	fs, err = NewFileStore(path)
+	if !assert.NoError(err) {
+		return
+	}
+	seed, err := fs.Get("user")
+	if assert.NoError(err) {
+		assert.Equal("ABC", seed.Secret)
+		assert.False(seed.Confirmed)
+		assert.True(created.Equal(seed.Created))
+	}
+	assert.NoError(fs.Delete("user"))
+	_, err = fs.Get("user")
+	assert.Equal(ErrNotFound, err)
+
+	_, err = NewSQLStore("nosuchdriver", "", "totp")
+	assert.Error(err)
+}
+
+func TestSQLStore(t *testing.T) {
+	assert := assert.New(t)
+	dsn := filepath.Join(t.TempDir(), "seeds.db")
+	s, err := NewSQLStore("sqlite", dsn, "totp")
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = s.Get("user")
+	assert.Equal(ErrNotFound, err)
+	created := time.Unix(1600000000, 0)
+	assert.NoError(s.Put("user", &Seed{Secret: "ABC", Created: created}))
+	assert.NoError(s.Put("user", &Seed{Secret: "ABC", Confirmed: true, Created: created}))
+	seed, err := s.Get("user")
+	if assert.NoError(err) {
+		assert.Equal("ABC", seed.Secret)
+		assert.True(seed.Confirmed)
+		assert.True(created.Equal(seed.Created))
+	}
+
+	// Backends sharing the database have their own seeds
+	other, err := NewSQLStore("sqlite", dsn, "totp2")
+	if !assert.NoError(err) {
+		return
+	}
+	_, err = other.Get("user")
+	assert.Equal(ErrNotFound, err)
+
+	assert.NoError(s.Delete("user"))
+	_, err = s.Get("user")
+	assert.Equal(ErrNotFound, err)
+}
+
+func newTestAuth(t *testing.T, requireParent bool) (*AuthTOTP, *time.Time) {
+	config := *Defaults
+	config.Name = "totp"
+	config.Principals = []string{"mfa"}
+	config.RequireParent = requireParent
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "seeds.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	at, err := newAuthTOTP(&config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	at.now = func() time.Time { return now }
+	return at, &now
+}
+
+func currentCode(t *testing.T, at *AuthTOTP, secret string, now time.Time) string {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := at.params.code(key, uint64(now.Unix())/uint64(at.params.Period))
+	return code
+}
+
+func TestAuthenticate(t *testing.T) {
+	assert := assert.New(t)
+	at, now := newTestAuth(t, true)
+	assert.Equal(auth.CredentialPin, at.CredentialType())
+	parent := &auth.AuthContext{Status: auth.StatusCompleted, SubjectName: "user", Authenticator: "ldap"}
+
+	// Enrollment needs a completed context
+	_, err := at.Enroll(&auth.AuthContext{Status: auth.StatusPending, SubjectName: "user"})
+	assert.Error(err)
+	enrollment, err := at.Enroll(parent)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.True(strings.HasPrefix(enrollment.URI, "otpauth://totp/ssh-inscribe:user?"))
+	// Unconfirmed seeds can be replaced
+	enrollment, err = at.Enroll(parent)
+	if !assert.NoError(err) {
+		return
+	}
+
+	code := currentCode(t, at, enrollment.Secret, *now)
+	_, ok := at.Authenticate(nil, &auth.Credentials{UserIdentifier: "user", Secret: []byte(code)})
+	assert.False(ok, "parent required")
+	_, ok = at.Authenticate(parent, &auth.Credentials{Secret: []byte("000000")})
+	assert.False(ok)
+
+	actx, ok := at.Authenticate(parent, &auth.Credentials{Secret: []byte(code)})
+	if assert.True(ok) {
+		assert.Equal("user", actx.GetSubjectName())
+		assert.Equal([]string{"mfa"}, actx.GetPrincipals())
+		assert.Equal([]string{"totp", "ldap"}, actx.GetAuthenticators())
+	}
+	// Codes cannot be reused
+	_, ok = at.Authenticate(parent, &auth.Credentials{Secret: []byte(code)})
+	assert.False(ok)
+
+	// The drift window accepts the previous code
+	*now = now.Add(30 * time.Second)
+	_, ok = at.Authenticate(parent, &auth.Credentials{Secret: []byte(code)})
+	assert.False(ok)
+	*now = now.Add(30 * time.Second)
+	code = currentCode(t, at, enrollment.Secret, now.Add(-30*time.Second))
+	_, ok = at.Authenticate(parent, &auth.Credentials{Secret: []byte(code)})
+	assert.True(ok)
+
+	// Confirmed by the successful login
+	_, err = at.Enroll(parent)
+	assert.Equal(auth.ErrAlreadyEnrolled, err)
+
+	_, ok = at.Authenticate(&auth.AuthContext{Status: auth.StatusCompleted, SubjectName: "other"}, &auth.Credentials{Secret: []byte(code)})
+	assert.False(ok, "not enrolled")
+}
+
+func TestStandalone(t *testing.T) {
+	assert := assert.New(t)
+	at, now := newTestAuth(t, false)
+	assert.Equal(auth.CredentialUserPassword, at.CredentialType())
+	enrollment, err := at.Enroll(&auth.AuthContext{Status: auth.StatusCompleted, SubjectName: "standalone"})
+	if !assert.NoError(err) {
+		return
+	}
+	actx, ok := at.Authenticate(nil, &auth.Credentials{UserIdentifier: "standalone", Secret: []byte(currentCode(t, at, enrollment.Secret, *now))})
+	if assert.True(ok) {
+		assert.Equal("standalone", actx.GetSubjectName())
+	}
+
+	at.config.AllowEnrollment = false
+	_, err = at.Enroll(actx)
+	assert.Equal(ErrEnrollmentDisabled, err)
+}
+
+func TestConfig(t *testing.T) {
+	config := *Defaults
+	config.Algorithm = "MD5"
+	_, err := newAuthTOTP(&config, nil)
+	assert.Error(t, err)
+	config = *Defaults
+	config.Digits = 4
+	_, err = newAuthTOTP(&config, nil)
+	assert.Error(t, err)
+	config = *Defaults
+	config.Store.Type = "ldap"
+	_, err = New(&config)
+	assert.Error(t, err)
+}
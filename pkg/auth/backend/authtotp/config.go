@@ -0,0 +1,65 @@
+package authtotp
+
+import (
+	"path"
+
+	"github.com/aakso/ssh-inscribe/pkg/globals"
+)
+
+const (
+	StoreFile = "file"
+	StoreSQL  = "sql"
+)
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// Shown as the account issuer in authenticator apps
+	Issuer string
+	Digits int
+	// Time step in seconds
+	Period int
+	// Number of time steps accepted before and after the current one to
+	// allow for clock drift
+	Window int
+	// SHA1, SHA256 or SHA512
+	Algorithm string
+
+	Store StoreConfig
+
+	// Only allow logins on top of another backend, which identifies the user
+	RequireParent bool `yaml:"requireParent"`
+	// Allow users to enroll through the enroll endpoint
+	AllowEnrollment bool `yaml:"allowEnrollment"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+type StoreConfig struct {
+	// file or sql
+	Type string
+	// Seed file of the file store
+	Path string
+	// Driver and DSN of the sql store
+	Driver string
+	DSN    string `yaml:"dsn"`
+}
+
+var Defaults *Config = &Config{
+	Name:      DefaultName,
+	Realm:     DefaultRealm,
+	Issuer:    "ssh-inscribe",
+	Digits:    6,
+	Period:    30,
+	Window:    1,
+	Algorithm: "SHA1",
+	Store: StoreConfig{
+		Type: StoreFile,
+		Path: path.Join(globals.VarDir(), "ssh_inscribe_totp_seeds.json"),
+	},
+	RequireParent:   true,
+	AllowEnrollment: true,
+}
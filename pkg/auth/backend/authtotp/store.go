@@ -0,0 +1,202 @@
+package authtotp
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/storage/sqlutil"
+	"github.com/pkg/errors"
+)
+
+var ErrNotFound = errors.New("seed not found")
+
+// Seed of a user
+type Seed struct {
+	// Base32 encoded secret
+	Secret string `json:"secret"`
+	// Set on the first successful login. Unconfirmed seeds can be replaced
+	// by enrolling again
+	Confirmed bool      `json:"confirmed"`
+	Created   time.Time `json:"created"`
+}
+
+// SeedStore stores the seeds of the users
+type SeedStore interface {
+	Get(user string) (*Seed, error)
+	Put(user string, seed *Seed) error
+	Delete(user string) error
+}
+
+// FileStore keeps the seeds in a JSON file which is rewritten on changes
+type FileStore struct {
+	sync.RWMutex
+	path  string
+	seeds map[string]*Seed
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	if path == "" {
+		return nil, errors.New("seed store path is not set")
+	}
+	fs := &FileStore{path: path, seeds: make(map[string]*Seed)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read seed file")
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &fs.seeds); err != nil {
+			return nil, errors.Wrap(err, "cannot parse seed file")
+		}
+	}
+	return fs, nil
+}
+
+func (fs *FileStore) Get(user string) (*Seed, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+	s, ok := fs.seeds[user]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	cp := *s
+	return &cp, nil
+}
+
+func (fs *FileStore) Put(user string, seed *Seed) error {
+	fs.Lock()
+	defer fs.Unlock()
+	old, existed := fs.seeds[user]
+	cp := *seed
+	fs.seeds[user] = &cp
+	if err := fs.save(); err != nil {
+		if existed {
+			fs.seeds[user] = old
+		} else {
+			delete(fs.seeds, user)
+		}
+		return err
+	}
+	return nil
+}
+
+func (fs *FileStore) Delete(user string) error {
+	fs.Lock()
+	defer fs.Unlock()
+	old, ok := fs.seeds[user]
+	if !ok {
+		return nil
+	}
+	delete(fs.seeds, user)
+	if err := fs.save(); err != nil {
+		fs.seeds[user] = old
+		return err
+	}
+	return nil
+}
+
+// Write to a temporary file and rename so readers never see a partial file
+func (fs *FileStore) save() error {
+	data, err := json.MarshalIndent(fs.seeds, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), ".totp-seeds")
+	if err != nil {
+		return errors.Wrap(err, "cannot write seed file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "cannot write seed file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "cannot write seed file")
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return errors.Wrap(err, "cannot write seed file")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), fs.path), "cannot write seed file")
+}
+
+const sqlSchema = `CREATE TABLE IF NOT EXISTS totp_seeds (
+	backend TEXT NOT NULL,
+	username TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	confirmed BOOLEAN NOT NULL,
+	created BIGINT NOT NULL,
+	PRIMARY KEY (backend, username)
+)`
+
+// SQLStore stores the seeds using database/sql with SQLite or PostgreSQL
+// dialect. Backends sharing the database are told apart by name
+type SQLStore struct {
+	db       *sql.DB
+	postgres bool
+	backend  string
+}
+
+func NewSQLStore(driver, dsn, backend string) (*SQLStore, error) {
+	db, err := sqlutil.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqlSchema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "cannot create schema")
+	}
+	return &SQLStore{
+		db:       db,
+		postgres: sqlutil.IsPostgres(driver),
+		backend:  backend,
+	}, nil
+}
+
+func (s *SQLStore) query(q string) string {
+	return sqlutil.Rebind(s.postgres, q)
+}
+
+func (s *SQLStore) Get(user string) (*Seed, error) {
+	var (
+		seed    Seed
+		created int64
+	)
+	err := s.db.QueryRow(s.query(`SELECT secret, confirmed, created FROM totp_seeds WHERE backend = ? AND username = ?`),
+		s.backend, user).Scan(&seed.Secret, &seed.Confirmed, &created)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query seed")
+	}
+	seed.Created = time.Unix(created, 0)
+	return &seed, nil
+}
+
+func (s *SQLStore) Put(user string, seed *Seed) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "cannot store seed")
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(s.query(`DELETE FROM totp_seeds WHERE backend = ? AND username = ?`), s.backend, user); err != nil {
+		return errors.Wrap(err, "cannot store seed")
+	}
+	if _, err := tx.Exec(s.query(`INSERT INTO totp_seeds (backend, username, secret, confirmed, created) VALUES (?, ?, ?, ?, ?)`),
+		s.backend, user, seed.Secret, seed.Confirmed, seed.Created.Unix()); err != nil {
+		return errors.Wrap(err, "cannot store seed")
+	}
+	return errors.Wrap(tx.Commit(), "cannot store seed")
+}
+
+func (s *SQLStore) Delete(user string) error {
+	_, err := s.db.Exec(s.query(`DELETE FROM totp_seeds WHERE backend = ? AND username = ?`), s.backend, user)
+	return errors.Wrap(err, "cannot delete seed")
+}
@@ -0,0 +1,111 @@
+package authtotp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// Size of generated secrets, the size of a SHA-1 output as recommended by
+// RFC 4226
+const secretSize = 20
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTP parameters of RFC 6238
+type params struct {
+	Algorithm string
+	Digits    int
+	Period    int
+	// Accepted steps before and after the current one
+	Window int
+}
+
+func (p params) hash() (func() hash.Hash, error) {
+	switch strings.ToUpper(p.Algorithm) {
+	case "", "SHA1":
+		return sha1.New, nil
+	case "SHA256":
+		return sha256.New, nil
+	case "SHA512":
+		return sha512.New, nil
+	}
+	return nil, errors.Errorf("unsupported algorithm %s", p.Algorithm)
+}
+
+func newSecret() string {
+	return b32.EncodeToString(util.RandBytes(secretSize))
+}
+
+func decodeSecret(s string) ([]byte, error) {
+	return b32.DecodeString(strings.ToUpper(strings.TrimRight(s, "=")))
+}
+
+// HOTP value of RFC 4226
+func (p params) code(secret []byte, counter uint64) (string, error) {
+	h, err := p.hash()
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(h, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < p.Digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", p.Digits, v%mod), nil
+}
+
+// Find the time step the code is valid for. Returns false if it is not
+// valid within the window
+func (p params) validate(secret []byte, code string, now time.Time) (uint64, bool) {
+	if len(code) != p.Digits {
+		return 0, false
+	}
+	current := uint64(now.Unix()) / uint64(p.Period)
+	for d := -p.Window; d <= p.Window; d++ {
+		counter := current + uint64(d)
+		expected, err := p.code(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// Key URI understood by authenticator apps
+func (p params) uri(issuer, user, secret string) string {
+	label := url.PathEscape(user)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+	q := url.Values{}
+	q.Set("secret", secret)
+	if issuer != "" {
+		q.Set("issuer", issuer)
+	}
+	q.Set("algorithm", strings.ToUpper(p.Algorithm))
+	q.Set("digits", fmt.Sprint(p.Digits))
+	q.Set("period", fmt.Sprint(p.Period))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
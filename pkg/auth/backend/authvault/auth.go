@@ -0,0 +1,257 @@
+package authvault
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const subjectName = "subjectName"
+
+// Template context with the token and its identity
+type identity struct {
+	DisplayName string
+	EntityID    string
+	EntityName  string
+	Aliases     []string
+	Groups      []string
+	Policies    []string
+	Metadata    map[string]string
+}
+
+// AuthVault authenticates with a Vault token or an AppRole login and maps
+// the identity of the token to principals
+type AuthVault struct {
+	config *Config
+	log    *logrus.Entry
+	client *vaultClient
+	tpls   *template.Template
+}
+
+func (av *AuthVault) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil || len(creds.Secret) == 0 {
+		return nil, false
+	}
+	log := av.log.WithField("action", "authenticate")
+	if v, ok := creds.Meta[auth.MetaAuditID]; ok {
+		log = log.WithField(auth.MetaAuditID, v)
+	}
+
+	token := string(creds.Secret)
+	if av.config.Method == MethodAppRole {
+		log = log.WithField("role_id", creds.UserIdentifier)
+		var err error
+		if token, err = av.client.appRoleLogin(av.config.AppRoleMount, creds.UserIdentifier, token); err != nil {
+			log.WithError(err).Info("AppRole login failed")
+			if unavailable(err) {
+				creds.SetBackendError(err)
+			}
+			return nil, false
+		}
+		// The token is only needed for the lookups
+		defer func() {
+			if err := av.client.revokeSelf(token); err != nil {
+				log.WithError(err).Warn("cannot revoke the AppRole token")
+			}
+		}()
+	}
+	id, err := av.identity(token)
+	if err != nil {
+		log.WithError(err).Info("Vault auth failed")
+		if unavailable(err) {
+			creds.SetBackendError(err)
+		}
+		return nil, false
+	}
+	log = log.WithField("display_name", id.DisplayName).WithField("entity_id", id.EntityID)
+	if !av.policyAllowed(id.Policies) {
+		log.WithField("policies", id.Policies).Info("no allowed policy")
+		return nil, false
+	}
+	log.Debug("Vault auth successful")
+
+	actx := &auth.AuthContext{
+		Status:          auth.StatusCompleted,
+		Parent:          pctx,
+		SubjectName:     av.renderTpl(subjectName, id),
+		CriticalOptions: av.config.CriticalOptions,
+		Extensions:      av.config.Extensions,
+		Authenticator:   av.Name(),
+		AuthMeta:        creds.Meta,
+	}
+	for i := range av.config.PrincipalTemplates {
+		actx.Principals = append(actx.Principals, av.renderPrincipals(principalTpl(i), id)...)
+	}
+	for _, p := range id.Policies {
+		actx.Principals = append(actx.Principals, av.config.PolicyPrincipals[p]...)
+	}
+	actx.Principals = append(actx.Principals, av.config.Principals...)
+	if len(id.Groups) > 0 {
+		actx.AuthMeta = make(map[string]interface{}, len(creds.Meta)+1)
+		for k, v := range creds.Meta {
+			actx.AuthMeta[k] = v
+		}
+		actx.AuthMeta[auth.MetaGroups] = id.Groups
+	}
+	return actx, true
+}
+
+// Look up the token and the entity behind it
+func (av *AuthVault) identity(token string) (*identity, error) {
+	ti, err := av.client.lookupSelf(token)
+	if err != nil {
+		return nil, err
+	}
+	id := &identity{
+		DisplayName: ti.DisplayName,
+		EntityID:    ti.EntityID,
+		Metadata:    ti.Meta,
+	}
+	seen := map[string]bool{}
+	for _, p := range append(ti.Policies, ti.Identity...) {
+		if !seen[p] {
+			seen[p] = true
+			id.Policies = append(id.Policies, p)
+		}
+	}
+	sort.Strings(id.Policies)
+	if ti.EntityID == "" || av.config.IdentityToken == "" {
+		return id, nil
+	}
+	e, err := av.client.entity(av.config.IdentityToken, ti.EntityID)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot look up the entity")
+	}
+	if e.Disabled {
+		return nil, errors.New("entity is disabled")
+	}
+	id.EntityName = e.Name
+	for _, a := range e.Aliases {
+		id.Aliases = append(id.Aliases, a.Name)
+	}
+	for _, gid := range e.GroupIDs {
+		g, err := av.client.group(av.config.IdentityToken, gid)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot look up the groups of the entity")
+		}
+		id.Groups = append(id.Groups, g.Name)
+	}
+	return id, nil
+}
+
+func (av *AuthVault) policyAllowed(policies []string) bool {
+	if len(av.config.AllowedPolicies) == 0 {
+		return true
+	}
+	for _, p := range policies {
+		for _, a := range av.config.AllowedPolicies {
+			if p == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (av *AuthVault) renderPrincipals(name string, data interface{}) []string {
+	var r []string
+	for _, line := range strings.Split(av.renderTpl(name, data), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && line != "<no value>" {
+			r = append(r, line)
+		}
+	}
+	return r
+}
+
+func (av *AuthVault) renderTpl(name string, data interface{}) string {
+	buf := bytes.NewBuffer([]byte{})
+	err := av.tpls.ExecuteTemplate(buf, name, data)
+	if err != nil {
+		av.log.WithError(err).Errorf("template render error: %s", name)
+	}
+	return buf.String()
+}
+
+func principalTpl(i int) string {
+	return fmt.Sprintf("principal%d", i)
+}
+
+func (av *AuthVault) Probe() error {
+	return av.client.health()
+}
+
+func (av *AuthVault) Type() string {
+	return Type
+}
+
+func (av *AuthVault) Name() string {
+	return av.config.Name
+}
+
+func (av *AuthVault) Realm() string {
+	return av.config.Realm
+}
+
+func (av *AuthVault) CredentialType() string {
+	return auth.CredentialUserPassword
+}
+
+func New(config *Config) (*AuthVault, error) {
+	if config.Address == "" {
+		return nil, errors.Errorf("%s: required config items: address", config.Name)
+	}
+	switch config.Method {
+	case MethodToken, MethodAppRole:
+	default:
+		return nil, errors.Errorf("%s: invalid method %q, must be token or approle", config.Name, config.Method)
+	}
+	tlsConfig := &tls.Config{}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s: cannot read caFile", config.Name)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("%s: no certificates in caFile", config.Name)
+		}
+	}
+	av := &AuthVault{
+		config: config,
+		client: &vaultClient{
+			address:   strings.TrimSuffix(config.Address, "/"),
+			namespace: config.Namespace,
+			http: &http.Client{
+				Timeout:   time.Duration(config.Timeout) * time.Second,
+				Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+			},
+		},
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+	}
+	av.tpls = template.New("").Funcs(util.TemplateFuncs)
+	if _, err := av.tpls.New(subjectName).Parse(config.SubjectNameTemplate); err != nil {
+		return nil, errors.Wrapf(err, "%s: cannot parse subjectNameTemplate", config.Name)
+	}
+	for i, t := range config.PrincipalTemplates {
+		if _, err := av.tpls.New(principalTpl(i)).Parse(t); err != nil {
+			return nil, errors.Wrapf(err, "%s: cannot parse principalTemplates", config.Name)
+		}
+	}
+	return av, nil
+}
@@ -0,0 +1,150 @@
+package authvault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testToken         = "s.usertoken"
+	testIdentityToken = "s.identitytoken"
+	testRoleID        = "role-id"
+	testSecretID      = "secret-id"
+)
+
+// Vault with a user token, an AppRole and the identity of both
+func testVault(t *testing.T, revoked *[]string) *httptest.Server {
+	reply := func(w http.ResponseWriter, field string, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{field: v})
+	}
+	fail := func(w http.ResponseWriter, status int) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Vault-Token")
+		switch r.URL.Path {
+		case "/v1/sys/health":
+			reply(w, "initialized", true)
+		case "/v1/auth/approle/login":
+			var in map[string]string
+			json.NewDecoder(r.Body).Decode(&in)
+			if in["role_id"] != testRoleID || in["secret_id"] != testSecretID {
+				fail(w, http.StatusBadRequest)
+				return
+			}
+			reply(w, "auth", map[string]interface{}{"client_token": "s.approletoken"})
+		case "/v1/auth/token/lookup-self":
+			switch token {
+			case testToken:
+				reply(w, "data", map[string]interface{}{
+					"display_name":      "ldap-alice",
+					"entity_id":         "e1",
+					"policies":          []string{"default", "ssh-admin"},
+					"identity_policies": []string{"ssh-admin", "ssh-user"},
+					"meta":              map[string]string{"username": "alice"},
+				})
+			case "s.approletoken":
+				reply(w, "data", map[string]interface{}{
+					"display_name": "approle",
+					"policies":     []string{"default", "deploy"},
+					"meta":         map[string]string{"role_name": "ci"},
+				})
+			default:
+				fail(w, http.StatusForbidden)
+			}
+		case "/v1/auth/token/revoke-self":
+			*revoked = append(*revoked, token)
+			w.WriteHeader(http.StatusNoContent)
+		case "/v1/identity/entity/id/e1":
+			if token != testIdentityToken {
+				fail(w, http.StatusForbidden)
+				return
+			}
+			reply(w, "data", map[string]interface{}{
+				"name":      "alice",
+				"aliases":   []map[string]string{{"name": "alice"}, {"name": "alice@example.com"}},
+				"group_ids": []string{"g1"},
+			})
+		case "/v1/identity/group/id/g1":
+			reply(w, "data", map[string]string{"name": "ops"})
+		default:
+			fail(w, http.StatusNotFound)
+		}
+	}))
+}
+
+func TestAuthVault(t *testing.T) {
+	assert := assert.New(t)
+	var revoked []string
+	srv := testVault(t, &revoked)
+	defer srv.Close()
+
+	conf := *Defaults
+	conf.Address = srv.URL
+	conf.IdentityToken = testIdentityToken
+	conf.PrincipalTemplates = []string{"{{.EntityName}}", "{{range .Aliases}}{{if contains \"@\" .}}{{.}}{{end}}\n{{end}}"}
+	conf.PolicyPrincipals = map[string][]string{"ssh-admin": {"root"}}
+	conf.AllowedPolicies = []string{"ssh-user", "deploy"}
+	av, err := New(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.NoError(av.Probe())
+
+	actx, ok := av.Authenticate(nil, &auth.Credentials{Secret: []byte(testToken)})
+	if assert.True(ok) {
+		assert.Equal("ldap-alice", actx.GetSubjectName())
+		assert.Equal([]string{"alice", "alice@example.com", "root"}, actx.GetPrincipals())
+		assert.Equal([]string{"ops"}, actx.GetGroups())
+	}
+	creds := &auth.Credentials{Secret: []byte("s.invalid")}
+	_, ok = av.Authenticate(nil, creds)
+	assert.False(ok)
+	assert.False(creds.BackendError())
+
+	// Without the identity token only the token is known
+	conf.IdentityToken = ""
+	actx, ok = av.Authenticate(nil, &auth.Credentials{Secret: []byte(testToken)})
+	if assert.True(ok) {
+		assert.Equal([]string{"root"}, actx.GetPrincipals())
+	}
+
+	// AppRole
+	conf.Method = MethodAppRole
+	conf.PrincipalTemplates = []string{"{{.Metadata.role_name}}"}
+	if av, err = New(&conf); !assert.NoError(err) {
+		return
+	}
+	actx, ok = av.Authenticate(nil, &auth.Credentials{UserIdentifier: testRoleID, Secret: []byte(testSecretID)})
+	if assert.True(ok) {
+		assert.Equal([]string{"ci"}, actx.GetPrincipals())
+	}
+	assert.Equal([]string{"s.approletoken"}, revoked)
+	_, ok = av.Authenticate(nil, &auth.Credentials{UserIdentifier: testRoleID, Secret: []byte("wrong")})
+	assert.False(ok)
+
+	// Policy not allowed
+	conf.AllowedPolicies = []string{"ssh-user"}
+	_, ok = av.Authenticate(nil, &auth.Credentials{UserIdentifier: testRoleID, Secret: []byte(testSecretID)})
+	assert.False(ok)
+	assert.Len(revoked, 2)
+
+	// Unreachable Vault is reported as the failure of the backend
+	srv.Close()
+	creds = &auth.Credentials{UserIdentifier: testRoleID, Secret: []byte(testSecretID)}
+	_, ok = av.Authenticate(nil, creds)
+	assert.False(ok)
+	assert.True(creds.BackendError())
+
+	conf.Method = "userpass"
+	_, err = New(&conf)
+	assert.True(err != nil && strings.Contains(err.Error(), "invalid method"))
+}
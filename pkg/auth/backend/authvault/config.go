@@ -0,0 +1,54 @@
+package authvault
+
+const (
+	// The password is a Vault token
+	MethodToken = "token"
+	// The user name is a role ID and the password a secret ID
+	MethodAppRole = "approle"
+)
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// Vault server address, e.g. https://vault.example.com:8200
+	Address   string
+	Namespace string
+	// CA certificates to verify the server certificate
+	CAFile  string `yaml:"caFile"`
+	Timeout int
+
+	// token or approle
+	Method string
+	// Mount path of the AppRole auth method
+	AppRoleMount string `yaml:"appRoleMount"`
+	// Token allowed to read the identity entities and groups. The entity
+	// names, aliases and groups are not available without it
+	IdentityToken string `yaml:"identityToken"`
+
+	// Accept only tokens with one of these policies. Empty accepts all
+	AllowedPolicies []string `yaml:"allowedPolicies"`
+	// Principals for the tokens with the policy
+	PolicyPrincipals map[string][]string `yaml:"policyPrincipals"`
+
+	// Templates with .DisplayName, .EntityID, .EntityName, .Aliases,
+	// .Groups, .Policies and .Metadata. Each line of the principal template
+	// output is a principal
+	SubjectNameTemplate string   `yaml:"subjectNameTemplate"`
+	PrincipalTemplates  []string `yaml:"principalTemplates"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:                DefaultName,
+	Realm:               DefaultRealm,
+	Address:             "https://127.0.0.1:8200",
+	Timeout:             10,
+	Method:              MethodToken,
+	AppRoleMount:        "approle",
+	SubjectNameTemplate: "{{.DisplayName}}",
+	PrincipalTemplates:  []string{"{{.EntityName}}"},
+}
@@ -0,0 +1,184 @@
+package authvault
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Limit for the API responses
+const maxResponseSize = 1 << 20
+
+// Client of the Vault HTTP API
+type vaultClient struct {
+	address   string
+	namespace string
+	http      *http.Client
+}
+
+type apiErrors struct {
+	Errors []string `json:"errors"`
+}
+
+// Vault could not be reached or failed, as opposed to refusing the request
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func unavailable(err error) bool {
+	_, ok := errors.Cause(err).(*unavailableError)
+	return ok
+}
+
+type tokenInfo struct {
+	DisplayName string            `json:"display_name"`
+	EntityID    string            `json:"entity_id"`
+	Policies    []string          `json:"policies"`
+	Identity    []string          `json:"identity_policies"`
+	Meta        map[string]string `json:"meta"`
+}
+
+type loginAuth struct {
+	ClientToken string `json:"client_token"`
+}
+
+type entity struct {
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled"`
+	Aliases  []struct {
+		Name string `json:"name"`
+	} `json:"aliases"`
+	GroupIDs []string `json:"group_ids"`
+}
+
+type group struct {
+	Name string `json:"name"`
+}
+
+// Call the API with the token, decoding the data or the auth field of the
+// response into out
+func (vc *vaultClient) call(method, path, token string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, vc.address+"/v1/"+strings.TrimPrefix(path, "/"), body)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if vc.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vc.namespace)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := vc.http.Do(req)
+	if err != nil {
+		return &unavailableError{err: err}
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize))
+	if resp.StatusCode >= 300 {
+		var e apiErrors
+		dec.Decode(&e)
+		err := errors.Errorf("vault: %s", resp.Status)
+		if len(e.Errors) > 0 {
+			err = errors.Errorf("vault: %s: %s", resp.Status, strings.Join(e.Errors, ", "))
+		}
+		// Sealed or failing
+		if resp.StatusCode >= 500 {
+			return &unavailableError{err: err}
+		}
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	var r struct {
+		Data json.RawMessage `json:"data"`
+		Auth json.RawMessage `json:"auth"`
+	}
+	if err := dec.Decode(&r); err != nil {
+		return errors.Wrap(err, "vault: invalid response")
+	}
+	raw := r.Data
+	if len(r.Auth) > 0 && string(r.Auth) != "null" {
+		raw = r.Auth
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return errors.New("vault: empty response")
+	}
+	return errors.Wrap(json.Unmarshal(raw, out), "vault: invalid response")
+}
+
+func (vc *vaultClient) lookupSelf(token string) (*tokenInfo, error) {
+	var ti tokenInfo
+	if err := vc.call(http.MethodGet, "auth/token/lookup-self", token, nil, &ti); err != nil {
+		return nil, err
+	}
+	return &ti, nil
+}
+
+func (vc *vaultClient) appRoleLogin(mount, roleID, secretID string) (string, error) {
+	var a loginAuth
+	in := map[string]string{"role_id": roleID, "secret_id": secretID}
+	if err := vc.call(http.MethodPost, "auth/"+strings.Trim(mount, "/")+"/login", "", in, &a); err != nil {
+		return "", err
+	}
+	if a.ClientToken == "" {
+		return "", errors.New("vault: no token in the login response")
+	}
+	return a.ClientToken, nil
+}
+
+func (vc *vaultClient) revokeSelf(token string) error {
+	return vc.call(http.MethodPost, "auth/token/revoke-self", token, nil, nil)
+}
+
+func (vc *vaultClient) entity(token, id string) (*entity, error) {
+	var e entity
+	if err := vc.call(http.MethodGet, "identity/entity/id/"+id, token, nil, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func (vc *vaultClient) group(token, id string) (*group, error) {
+	var g group
+	if err := vc.call(http.MethodGet, "identity/group/id/"+id, token, nil, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (vc *vaultClient) health() error {
+	// Standby nodes count as healthy
+	req, err := http.NewRequest(http.MethodGet, vc.address+"/v1/sys/health?standbyok=true", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := vc.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("vault: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,379 @@
+package authwebauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stateKey = "state"
+
+	challengeSize = 32
+)
+
+var ErrEnrollmentDisabled = errors.New("enrollment is disabled")
+
+// Pending registration or login ceremony. Kept in the shared state store so
+// the page and the callback can be handled by any replica
+type ceremony struct {
+	Register  bool      `json:"register"`
+	User      string    `json:"user"`
+	Challenge []byte    `json:"challenge"`
+	Done      bool      `json:"done"`
+	Created   time.Time `json:"created"`
+}
+
+type AuthWebAuthn struct {
+	config *Config
+	rp     relyingParty
+	store  CredentialStore
+	log    *logrus.Entry
+	now    func() time.Time
+}
+
+func (aw *AuthWebAuthn) authFlowTimeout() time.Duration {
+	return time.Duration(aw.config.AuthFlowTimeout) * time.Second
+}
+
+func (aw *AuthWebAuthn) stateKey(state string) string {
+	return "webauthn:" + aw.Name() + ":" + state
+}
+
+func (aw *AuthWebAuthn) saveCeremony(state string, c *ceremony) error {
+	ttl := c.Created.Add(aw.authFlowTimeout()).Sub(aw.now())
+	if ttl <= 0 {
+		return errors.New("ceremony has expired")
+	}
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode ceremony")
+	}
+	return sharedstate.Get().Set(aw.stateKey(state), raw, ttl)
+}
+
+func (aw *AuthWebAuthn) getCeremony(state string) (*ceremony, bool) {
+	if state == "" {
+		return nil, false
+	}
+	raw, err := sharedstate.Get().Get(aw.stateKey(state))
+	if err != nil {
+		return nil, false
+	}
+	var c ceremony
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, false
+	}
+	if !c.Created.Add(aw.authFlowTimeout()).After(aw.now()) {
+		return nil, false
+	}
+	return &c, true
+}
+
+func (aw *AuthWebAuthn) deleteCeremony(state string) {
+	if err := sharedstate.Get().Delete(aw.stateKey(state)); err != nil && err != sharedstate.ErrNotFound {
+		aw.log.WithError(err).WithField("state", state).Error("cannot delete ceremony")
+	}
+}
+
+// Start a ceremony and return the state identifying it
+func (aw *AuthWebAuthn) newCeremony(user string, register bool) (string, error) {
+	state := strings.NewReplacer("+", "-", "/", "_").Replace(util.RandB64(32))
+	c := &ceremony{
+		Register:  register,
+		User:      user,
+		Challenge: util.RandBytes(challengeSize),
+		Created:   aw.now(),
+	}
+	return state, aw.saveCeremony(state, c)
+}
+
+// URL of the ceremony page
+func (aw *AuthWebAuthn) pageURL(state string) string {
+	return strings.TrimSuffix(aw.config.URL, "/") + "/v1/auth/" + url.PathEscape(aw.Name()) +
+		"/page?" + url.Values{stateKey: {state}}.Encode()
+}
+
+func (aw *AuthWebAuthn) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if creds == nil {
+		return nil, false
+	}
+	if pctx != nil && pctx.Status == auth.StatusPending && pctx.Authenticator == aw.Name() {
+		aw.log.Debug("completing flow")
+		return aw.completeFlow(pctx)
+	}
+	return aw.startFlow(pctx, creds.Meta)
+}
+
+// WebAuthn is a second factor for the user of the parent context
+func (aw *AuthWebAuthn) startFlow(pctx *auth.AuthContext, meta map[string]interface{}) (*auth.AuthContext, bool) {
+	log := aw.log.WithField("action", "startFlow").WithField(auth.MetaAuditID, meta[auth.MetaAuditID])
+	if pctx == nil || !pctx.IsValid() || pctx.GetSubjectName() == "" {
+		log.Info("no authenticated parent context")
+		return nil, false
+	}
+	user := pctx.GetSubjectName()
+	log = log.WithField("user", user)
+	creds, err := aw.store.Credentials(user)
+	if err != nil {
+		log.WithError(err).Error("cannot get credentials")
+		return nil, false
+	}
+	if len(creds) == 0 {
+		log.Info("user has no registered credentials")
+		return nil, false
+	}
+	state, err := aw.newCeremony(user, false)
+	if err != nil {
+		log.WithError(err).Error("cannot save ceremony")
+		return nil, false
+	}
+	newMeta := make(map[string]interface{}, len(meta)+2)
+	for k, v := range meta {
+		newMeta[k] = v
+	}
+	newMeta[stateKey] = state
+	newMeta[auth.MetaFederationAuthURL] = aw.pageURL(state)
+	log.WithField("state", state).Info("waiting for assertion")
+	return &auth.AuthContext{
+		Status:        auth.StatusPending,
+		Parent:        pctx,
+		Authenticator: aw.Name(),
+		AuthMeta:      newMeta,
+	}, true
+}
+
+func (aw *AuthWebAuthn) completeFlow(pctx *auth.AuthContext) (*auth.AuthContext, bool) {
+	state := pctx.GetMetaString(stateKey)
+	log := aw.log.WithField("action", "completeFlow").
+		WithField(auth.MetaAuditID, pctx.GetMetaString(auth.MetaAuditID)).
+		WithField("state", state)
+	c, ok := aw.getCeremony(state)
+	if !ok || c.Register {
+		log.Warning("unknown pending auth request")
+		return nil, false
+	}
+	if !c.Done {
+		log.Debug("auth flow is incomplete")
+		return pctx, true
+	}
+	aw.deleteCeremony(state)
+	pctx.Status = auth.StatusCompleted
+	pctx.Principals = append([]string{}, aw.config.Principals...)
+	pctx.CriticalOptions = aw.config.CriticalOptions
+	pctx.Extensions = aw.config.Extensions
+	pctx.AddIdentity(auth.IdentityMFA, "hwk")
+	log.WithField("user", c.User).Info("completed authentication")
+	return pctx, true
+}
+
+// Finish the ceremony with the response posted by the page
+func (aw *AuthWebAuthn) FederationCallback(data interface{}) error {
+	log := aw.log.WithField("action", "callback")
+	resp, ok := data.(url.Values)
+	if !ok {
+		log.Info("decoding error")
+		return errors.New("decoding error")
+	}
+	state := resp.Get(stateKey)
+	log = log.WithField("state", state)
+	c, ok := aw.getCeremony(state)
+	if !ok || c.Done {
+		log.Info("unknown state")
+		return errors.New("no matching state found")
+	}
+	log = log.WithField("user", c.User)
+	field := func(name string) []byte {
+		b, _ := b64.DecodeString(resp.Get(name))
+		return b
+	}
+	var err error
+	if c.Register {
+		err = aw.finishRegistration(c, field("clientDataJSON"), field("attestationObject"))
+	} else {
+		err = aw.finishLogin(c, field("id"), field("clientDataJSON"), field("authenticatorData"), field("signature"))
+	}
+	if err != nil {
+		log.WithError(err).Info("ceremony failed")
+		return err
+	}
+	if c.Register {
+		aw.deleteCeremony(state)
+		log.Info("credential registered")
+		return nil
+	}
+	c.Done = true
+	if err := aw.saveCeremony(state, c); err != nil {
+		return err
+	}
+	log.Info("callback succeeded")
+	return nil
+}
+
+func (aw *AuthWebAuthn) finishRegistration(c *ceremony, clientDataJSON, attestationObject []byte) error {
+	if err := aw.rp.checkClientData(clientDataJSON, "webauthn.create", c.Challenge); err != nil {
+		return err
+	}
+	raw, err := parseAttestationObject(attestationObject)
+	if err != nil {
+		return err
+	}
+	ad, err := parseAuthenticatorData(raw)
+	if err != nil {
+		return err
+	}
+	if err := aw.rp.checkAuthenticatorData(ad); err != nil {
+		return err
+	}
+	if len(ad.CredentialID) == 0 {
+		return errors.New("no attested credential")
+	}
+	if _, _, err := parsePublicKey(ad.PublicKey); err != nil {
+		return err
+	}
+	return aw.store.Add(c.User, Credential{
+		ID:        ad.CredentialID,
+		PublicKey: ad.PublicKey,
+		SignCount: ad.SignCount,
+		Created:   aw.now(),
+	})
+}
+
+func (aw *AuthWebAuthn) finishLogin(c *ceremony, id, clientDataJSON, authData, sig []byte) error {
+	creds, err := aw.store.Credentials(c.User)
+	if err != nil {
+		return errors.Wrap(err, "cannot get credentials")
+	}
+	var cred *Credential
+	for i := range creds {
+		if bytes.Equal(creds[i].ID, id) {
+			cred = &creds[i]
+		}
+	}
+	if cred == nil {
+		return errors.New("unknown credential")
+	}
+	if err := aw.rp.checkClientData(clientDataJSON, "webauthn.get", c.Challenge); err != nil {
+		return err
+	}
+	ad, err := parseAuthenticatorData(authData)
+	if err != nil {
+		return err
+	}
+	if err := aw.rp.checkAuthenticatorData(ad); err != nil {
+		return err
+	}
+	if err := verifySignature(cred.PublicKey, authData, clientDataJSON, sig); err != nil {
+		return err
+	}
+	// Authenticators without a counter always report zero
+	if (ad.SignCount != 0 || cred.SignCount != 0) && ad.SignCount <= cred.SignCount {
+		return errors.New("signature counter did not increase, the authenticator may be cloned")
+	}
+	cred.SignCount = ad.SignCount
+	cred.LastUsed = aw.now()
+	return aw.store.Update(c.User, *cred)
+}
+
+// Register a credential for the user of the auth context. Users with
+// credentials have to log in with one to register more
+func (aw *AuthWebAuthn) Enroll(actx *auth.AuthContext) (*auth.Enrollment, error) {
+	if !aw.config.AllowEnrollment {
+		return nil, ErrEnrollmentDisabled
+	}
+	if actx == nil || !actx.IsValid() || actx.GetSubjectName() == "" {
+		return nil, errors.New("authenticated user required")
+	}
+	user := actx.GetSubjectName()
+	creds, err := aw.store.Credentials(user)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get credentials")
+	}
+	if len(creds) > 0 {
+		verified := false
+		for _, a := range actx.GetAuthenticators() {
+			verified = verified || a == aw.Name()
+		}
+		if !verified {
+			return nil, auth.ErrAlreadyEnrolled
+		}
+	}
+	state, err := aw.newCeremony(user, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot save ceremony")
+	}
+	aw.log.WithField("user", user).Info("registration started")
+	return &auth.Enrollment{URI: aw.pageURL(state)}, nil
+}
+
+// User handle of the credentials, an opaque id not revealing the user name
+func (aw *AuthWebAuthn) userHandle(user string) []byte {
+	h := sha256.Sum256([]byte(aw.rp.ID + "\x00" + user))
+	return h[:]
+}
+
+func (aw *AuthWebAuthn) Type() string {
+	return Type
+}
+
+func (aw *AuthWebAuthn) Name() string {
+	return aw.config.Name
+}
+
+func (aw *AuthWebAuthn) Realm() string {
+	return aw.config.Realm
+}
+
+func (aw *AuthWebAuthn) CredentialType() string {
+	return auth.CredentialFederated
+}
+
+func New(config *Config) (*AuthWebAuthn, error) {
+	store, err := NewFileStore(config.Store)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: cannot open credential store", config.Name)
+	}
+	return newAuthWebAuthn(config, store)
+}
+
+func newAuthWebAuthn(config *Config, store CredentialStore) (*AuthWebAuthn, error) {
+	u, err := url.Parse(config.URL)
+	if config.URL == "" || err != nil || u.Host == "" {
+		return nil, errors.Errorf("%s: required config items: url", config.Name)
+	}
+	rp := relyingParty{
+		ID:               config.RPID,
+		Origins:          config.Origins,
+		UserVerification: config.UserVerification,
+	}
+	if rp.ID == "" {
+		rp.ID = u.Hostname()
+	}
+	if len(rp.Origins) == 0 {
+		rp.Origins = []string{u.Scheme + "://" + u.Host}
+	}
+	switch rp.UserVerification {
+	case userVerificationRequired, userVerificationPreferred, userVerificationDiscouraged:
+	default:
+		return nil, errors.Errorf("%s: userVerification must be required, preferred or discouraged", config.Name)
+	}
+	return &AuthWebAuthn{
+		config: config,
+		rp:     rp,
+		store:  store,
+		log: Log.WithFields(logrus.Fields{
+			"realm": config.Realm,
+			"name":  config.Name,
+		}),
+		now: time.Now,
+	}, nil
+}
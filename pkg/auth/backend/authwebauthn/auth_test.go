@@ -0,0 +1,359 @@
+package authwebauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testURL    = "https://ca.example.com"
+	testOrigin = "https://ca.example.com"
+)
+
+type cborMap map[interface{}]interface{}
+
+func cborEncode(v interface{}) []byte {
+	b, err := cbor.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestParsePublicKey(t *testing.T) {
+	assert := assert.New(t)
+	ta := newTestAuthenticator(t, false)
+	pub, alg, err := parsePublicKey(ta.coseKey())
+	if assert.NoError(err) {
+		assert.Equal(int64(algES256), alg)
+		assert.True(ta.ec.PublicKey.Equal(pub))
+	}
+	ta = newTestAuthenticator(t, true)
+	pub, alg, err = parsePublicKey(ta.coseKey())
+	if assert.NoError(err) {
+		assert.Equal(int64(algEdDSA), alg)
+		assert.True(ta.ed.Public().(ed25519.PublicKey).Equal(pub))
+	}
+
+	// Valid Ed25519 key made invalid
+	key := ta.coseKey()
+	for name, b := range map[string][]byte{
+		"trailing data":     append(append([]byte{}, key...), 0),
+		"duplicate key":     append(append([]byte{0xa5}, key[1:]...), 0x03, 0x27),
+		"indefinite length": append(append([]byte{0xbf}, key[1:]...), 0xff),
+		"truncated":         key[:len(key)-1],
+	} {
+		_, _, err := parsePublicKey(b)
+		assert.Error(err, name)
+	}
+	for name, h := range map[string]string{
+		"empty":           "",
+		"not a map":       "83010203",
+		"unsupported kty": "a2010403182a",
+		"curve as bytes":  "a4010103272041062141ff",
+		"short x":         "a40101032720062141ff",
+	} {
+		b, _ := hex.DecodeString(h)
+		_, _, err := parsePublicKey(b)
+		assert.Error(err, name)
+	}
+}
+
+// Software authenticator with a P-256 or Ed25519 key
+type testAuthenticator struct {
+	id      []byte
+	ec      *ecdsa.PrivateKey
+	ed      ed25519.PrivateKey
+	counter uint32
+	rpID    string
+	origin  string
+	flags   byte
+}
+
+func newTestAuthenticator(t *testing.T, edwards bool) *testAuthenticator {
+	ta := &testAuthenticator{id: []byte("credential-" + t.Name()), rpID: "ca.example.com", origin: testOrigin, flags: flagUserPresent | flagUserVerified}
+	var err error
+	if edwards {
+		_, ta.ed, err = ed25519.GenerateKey(rand.Reader)
+	} else {
+		ta.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ta
+}
+
+func (ta *testAuthenticator) coseKey() []byte {
+	if ta.ed != nil {
+		return cborEncode(cborMap{1: 1, 3: algEdDSA, -1: 6, -2: []byte(ta.ed.Public().(ed25519.PublicKey))})
+	}
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	ta.ec.X.FillBytes(x)
+	ta.ec.Y.FillBytes(y)
+	return cborEncode(cborMap{1: 2, 3: algES256, -1: 1, -2: x, -3: y})
+}
+
+func (ta *testAuthenticator) authData(attested bool) []byte {
+	hash := sha256.Sum256([]byte(ta.rpID))
+	b := append([]byte{}, hash[:]...)
+	flags := ta.flags
+	if attested {
+		flags |= flagAttestedCredData
+	}
+	b = append(b, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], ta.counter)
+	if attested {
+		b = append(b, make([]byte, 16)...)
+		b = append(b, byte(len(ta.id)>>8), byte(len(ta.id)))
+		b = append(b, ta.id...)
+		b = append(b, ta.coseKey()...)
+	}
+	return b
+}
+
+func (ta *testAuthenticator) clientData(typ string, challenge []byte) []byte {
+	b, _ := json.Marshal(map[string]interface{}{
+		"type":      typ,
+		"challenge": b64.EncodeToString(challenge),
+		"origin":    ta.origin,
+	})
+	return b
+}
+
+func (ta *testAuthenticator) create(state string, challenge []byte) url.Values {
+	att := cborEncode(cborMap{"fmt": "none", "attStmt": cborMap{}, "authData": ta.authData(true)})
+	return url.Values{
+		"state":             {state},
+		"id":                {b64.EncodeToString(ta.id)},
+		"clientDataJSON":    {b64.EncodeToString(ta.clientData("webauthn.create", challenge))},
+		"attestationObject": {b64.EncodeToString(att)},
+	}
+}
+
+func (ta *testAuthenticator) get(state string, challenge []byte) url.Values {
+	ta.counter++
+	ad := ta.authData(false)
+	cd := ta.clientData("webauthn.get", challenge)
+	hash := sha256.Sum256(cd)
+	signed := append(append([]byte{}, ad...), hash[:]...)
+	var sig []byte
+	if ta.ed != nil {
+		sig = ed25519.Sign(ta.ed, signed)
+	} else {
+		digest := sha256.Sum256(signed)
+		sig, _ = ecdsa.SignASN1(rand.Reader, ta.ec, digest[:])
+	}
+	return url.Values{
+		"state":             {state},
+		"id":                {b64.EncodeToString(ta.id)},
+		"clientDataJSON":    {b64.EncodeToString(cd)},
+		"authenticatorData": {b64.EncodeToString(ad)},
+		"signature":         {b64.EncodeToString(sig)},
+	}
+}
+
+func newTestAuth(t *testing.T) *AuthWebAuthn {
+	config := *Defaults
+	config.Name = "webauthn-" + t.Name()
+	config.URL = testURL
+	config.Principals = []string{"mfa"}
+	store, err := NewFileStore(filepath.Join(t.TempDir(), "credentials.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aw, err := newAuthWebAuthn(&config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aw
+}
+
+func stateOf(t *testing.T, u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Query().Get(stateKey)
+}
+
+func register(t *testing.T, aw *AuthWebAuthn, parent *auth.AuthContext, ta *testAuthenticator) {
+	enrollment, err := aw.Enroll(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := stateOf(t, enrollment.URI)
+	c, ok := aw.getCeremony(state)
+	if !ok {
+		t.Fatal("no ceremony")
+	}
+	if err := aw.FederationCallback(ta.create(state, c.Challenge)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	assert := assert.New(t)
+	aw := newTestAuth(t)
+	parent := &auth.AuthContext{Status: auth.StatusCompleted, SubjectName: "user", Authenticator: "ldap"}
+	ta := newTestAuthenticator(t, false)
+
+	_, err := aw.Enroll(&auth.AuthContext{Status: auth.StatusPending, SubjectName: "user"})
+	assert.Error(err)
+	enrollment, err := aw.Enroll(parent)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Empty(enrollment.Secret)
+	assert.True(strings.HasPrefix(enrollment.URI, testURL+"/v1/auth/"+url.PathEscape(aw.Name())+"/page?state="))
+	state := stateOf(t, enrollment.URI)
+	page, err := aw.Page(url.Values{stateKey: {state}})
+	if assert.NoError(err) {
+		assert.Contains(page, "navigator.credentials.create")
+		assert.Contains(page, `"rp":{"id":"ca.example.com","name":"ssh-inscribe"}`)
+	}
+	_, err = aw.Page(url.Values{stateKey: {"unknown"}})
+	assert.Error(err)
+
+	c, _ := aw.getCeremony(state)
+	// Wrong origin, RP and challenge
+	ta.origin = "https://evil.example.com"
+	assert.Error(aw.FederationCallback(ta.create(state, c.Challenge)))
+	ta.origin = testOrigin
+	ta.rpID = "evil.example.com"
+	assert.Error(aw.FederationCallback(ta.create(state, c.Challenge)))
+	ta.rpID = "ca.example.com"
+	assert.Error(aw.FederationCallback(ta.create(state, []byte("wrong"))))
+
+	assert.NoError(aw.FederationCallback(ta.create(state, c.Challenge)))
+	creds, _ := aw.store.Credentials("user")
+	if assert.Len(creds, 1) {
+		assert.Equal(ta.id, creds[0].ID)
+	}
+	// The ceremony is single use
+	assert.Error(aw.FederationCallback(ta.create(state, c.Challenge)))
+
+	// More credentials need a login with an existing one
+	_, err = aw.Enroll(parent)
+	assert.Equal(auth.ErrAlreadyEnrolled, err)
+	_, err = aw.Enroll(&auth.AuthContext{Status: auth.StatusCompleted, Parent: parent, Authenticator: aw.Name()})
+	assert.NoError(err)
+
+	aw.config.AllowEnrollment = false
+	_, err = aw.Enroll(parent)
+	assert.Equal(ErrEnrollmentDisabled, err)
+}
+
+func testLogin(t *testing.T, edwards bool) {
+	assert := assert.New(t)
+	aw := newTestAuth(t)
+	parent := &auth.AuthContext{Status: auth.StatusCompleted, SubjectName: "user", Authenticator: "ldap"}
+	ta := newTestAuthenticator(t, edwards)
+	creds := &auth.Credentials{Meta: map[string]interface{}{}}
+
+	_, ok := aw.Authenticate(nil, creds)
+	assert.False(ok, "parent required")
+	_, ok = aw.Authenticate(parent, creds)
+	assert.False(ok, "no credentials")
+	register(t, aw, parent, ta)
+
+	pending, ok := aw.Authenticate(parent, creds)
+	if !assert.True(ok) {
+		return
+	}
+	assert.Equal(auth.StatusPending, pending.Status)
+	authURL := pending.GetMetaString(auth.MetaFederationAuthURL)
+	state := stateOf(t, authURL)
+	page, err := aw.Page(url.Values{stateKey: {state}})
+	if assert.NoError(err) {
+		assert.Contains(page, "navigator.credentials.get")
+		assert.Contains(page, b64.EncodeToString(ta.id))
+	}
+
+	actx, ok := aw.Authenticate(pending, creds)
+	if assert.True(ok) {
+		assert.Equal(auth.StatusPending, actx.Status)
+	}
+	c, _ := aw.getCeremony(state)
+	bad := ta.get(state, c.Challenge)
+	bad.Set("signature", b64.EncodeToString([]byte("invalid")))
+	assert.Error(aw.FederationCallback(bad))
+	assert.NoError(aw.FederationCallback(ta.get(state, c.Challenge)))
+	assert.Error(aw.FederationCallback(ta.get(state, c.Challenge)), "completed")
+
+	actx, ok = aw.Authenticate(pending, creds)
+	if assert.True(ok) {
+		assert.Equal(auth.StatusCompleted, actx.Status)
+		assert.Equal("user", actx.GetSubjectName())
+		assert.Equal([]string{"mfa"}, actx.GetPrincipals())
+		assert.Equal([]string{aw.Name(), "ldap"}, actx.GetAuthenticators())
+	}
+	// The pending token cannot be used again
+	pending.Status = auth.StatusPending
+	_, ok = aw.Authenticate(pending, creds)
+	assert.False(ok)
+
+	// Cloned authenticators are detected with the signature counter
+	pending, _ = aw.Authenticate(parent, creds)
+	state = stateOf(t, pending.GetMetaString(auth.MetaFederationAuthURL))
+	c, _ = aw.getCeremony(state)
+	ta.counter = 0
+	assert.Error(aw.FederationCallback(ta.get(state, c.Challenge)))
+	// User verification
+	aw.rp.UserVerification = userVerificationRequired
+	ta.counter = 10
+	ta.flags = flagUserPresent
+	assert.Error(aw.FederationCallback(ta.get(state, c.Challenge)))
+	ta.flags = flagUserPresent | flagUserVerified
+	assert.NoError(aw.FederationCallback(ta.get(state, c.Challenge)))
+}
+
+func TestLogin(t *testing.T) {
+	t.Run("ES256", func(t *testing.T) { testLogin(t, false) })
+	t.Run("EdDSA", func(t *testing.T) { testLogin(t, true) })
+}
+
+func TestCeremonyExpiry(t *testing.T) {
+	aw := newTestAuth(t)
+	parent := &auth.AuthContext{Status: auth.StatusCompleted, SubjectName: "user"}
+	enrollment, err := aw.Enroll(parent)
+	if !assert.NoError(t, err) {
+		return
+	}
+	now := time.Now().Add(aw.authFlowTimeout() + time.Second)
+	aw.now = func() time.Time { return now }
+	_, err = aw.Page(url.Values{stateKey: {stateOf(t, enrollment.URI)}})
+	assert.Error(t, err)
+}
+
+func TestConfig(t *testing.T) {
+	config := *Defaults
+	_, err := newAuthWebAuthn(&config, nil)
+	assert.Error(t, err)
+	config.URL = "https://ca.example.com:8540/"
+	aw, err := newAuthWebAuthn(&config, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ca.example.com", aw.rp.ID)
+		assert.Equal(t, []string{"https://ca.example.com:8540"}, aw.rp.Origins)
+		assert.Equal(t, "https://ca.example.com:8540/v1/auth/authwebauthn/page?state=x", aw.pageURL("x"))
+	}
+	config.UserVerification = "always"
+	_, err = newAuthWebAuthn(&config, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package authwebauthn
+
+import (
+	"path"
+
+	"github.com/aakso/ssh-inscribe/pkg/globals"
+)
+
+type Config struct {
+	Name  string
+	Realm string
+
+	// External URL of the server, e.g. https://ca.example.com. The
+	// ceremony page is served under it
+	URL string
+	// Relying party id, defaults to the host of the URL
+	RPID   string `yaml:"rpID"`
+	RPName string `yaml:"rpName"`
+	// Origins accepted in the client data, defaults to the origin of the URL
+	Origins []string
+	// required, preferred or discouraged
+	UserVerification string `yaml:"userVerification"`
+	// Seconds the user has to complete the ceremony
+	AuthFlowTimeout int `yaml:"authFlowTimeout"`
+	// Credential file
+	Store string
+	// Allow users to register credentials through the enroll endpoint
+	AllowEnrollment bool `yaml:"allowEnrollment"`
+
+	Principals      []string
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	Extensions      map[string]string
+}
+
+var Defaults *Config = &Config{
+	Name:             DefaultName,
+	Realm:            DefaultRealm,
+	RPName:           "ssh-inscribe",
+	UserVerification: userVerificationPreferred,
+	AuthFlowTimeout:  240,
+	Store:            path.Join(globals.VarDir(), "ssh_inscribe_webauthn_credentials.json"),
+	AllowEnrollment:  true,
+}
@@ -0,0 +1,162 @@
+package authwebauthn
+
+import (
+	"bytes"
+	"html/template"
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+type pageData struct {
+	Title    string
+	Register bool
+	State    string
+	Callback string
+	Options  map[string]interface{}
+}
+
+var pageTemplate = template.Must(template.New("page").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 44em; margin: 2em auto; padding: 0 1em; color: #222; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Use your security key or passkey to continue.</p>
+<button id="start" type="button">Continue</button>
+<p id="status"></p>
+<script>
+(function() {
+  "use strict";
+  var options = {{.Options}};
+  var register = {{.Register}};
+  var state = {{.State}};
+  var callback = {{.Callback}};
+
+  function $(id) { return document.getElementById(id); }
+  function decode(s) {
+    s = s.replace(/-/g, "+").replace(/_/g, "/");
+    while (s.length % 4) { s += "="; }
+    var b = atob(s), a = new Uint8Array(b.length);
+    for (var i = 0; i < b.length; i++) { a[i] = b.charCodeAt(i); }
+    return a.buffer;
+  }
+  function encode(buf) {
+    var b = new Uint8Array(buf), s = "";
+    for (var i = 0; i < b.length; i++) { s += String.fromCharCode(b[i]); }
+    return btoa(s).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+  function status(msg, error) {
+    $("status").textContent = msg;
+    $("status").className = error ? "error" : "";
+  }
+
+  options.challenge = decode(options.challenge);
+  if (register) {
+    options.user.id = decode(options.user.id);
+  }
+  (options.allowCredentials || options.excludeCredentials || []).forEach(function(c) { c.id = decode(c.id); });
+
+  $("start").addEventListener("click", function() {
+    status("Waiting for the authenticator...");
+    var p = register ? navigator.credentials.create({publicKey: options}) : navigator.credentials.get({publicKey: options});
+    p.then(function(cred) {
+      var body = new URLSearchParams();
+      body.set("state", state);
+      body.set("id", encode(cred.rawId));
+      body.set("clientDataJSON", encode(cred.response.clientDataJSON));
+      if (register) {
+        body.set("attestationObject", encode(cred.response.attestationObject));
+      } else {
+        body.set("authenticatorData", encode(cred.response.authenticatorData));
+        body.set("signature", encode(cred.response.signature));
+      }
+      return fetch(callback, {method: "POST", body: body});
+    }).then(function(res) {
+      return res.text().then(function(t) {
+        if (!res.ok) {
+          try { var p = JSON.parse(t); t = p.detail || p.title || t; } catch (e) {}
+          throw new Error(t);
+        }
+        $("start").disabled = true;
+        status(register ? "Registration successful, you can close the window now" : t);
+      });
+    }).catch(function(e) { status(e.message, true); });
+  });
+})();
+</script>
+</body>
+</html>
+`))
+
+// Page running the WebAuthn ceremony of the state in the parameters
+func (aw *AuthWebAuthn) Page(data interface{}) (string, error) {
+	params, ok := data.(url.Values)
+	if !ok {
+		return "", errors.New("decoding error")
+	}
+	state := params.Get(stateKey)
+	c, ok := aw.getCeremony(state)
+	if !ok || c.Done {
+		return "", errors.New("no matching state found")
+	}
+	creds, err := aw.store.Credentials(c.User)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot get credentials")
+	}
+	var descriptors []map[string]interface{}
+	for _, cred := range creds {
+		descriptors = append(descriptors, map[string]interface{}{
+			"type": "public-key",
+			"id":   b64.EncodeToString(cred.ID),
+		})
+	}
+	timeout := c.Created.Add(aw.authFlowTimeout()).Sub(aw.now()).Milliseconds()
+	options := map[string]interface{}{
+		"challenge":        b64.EncodeToString(c.Challenge),
+		"timeout":          timeout,
+		"userVerification": aw.rp.UserVerification,
+	}
+	pd := pageData{
+		Title:    "Log in to " + aw.config.RPName,
+		Register: c.Register,
+		State:    state,
+		// The page is served from /v1/auth/<name>/page
+		Callback: "../../auth_callback/" + url.PathEscape(aw.Name()),
+		Options:  options,
+	}
+	if c.Register {
+		pd.Title = "Register a security key for " + aw.config.RPName
+		options["rp"] = map[string]interface{}{"id": aw.rp.ID, "name": aw.config.RPName}
+		options["user"] = map[string]interface{}{
+			"id":          b64.EncodeToString(aw.userHandle(c.User)),
+			"name":        c.User,
+			"displayName": c.User,
+		}
+		options["pubKeyCredParams"] = []map[string]interface{}{
+			{"type": "public-key", "alg": algES256},
+			{"type": "public-key", "alg": algEdDSA},
+			{"type": "public-key", "alg": algRS256},
+		}
+		options["attestation"] = "none"
+		options["authenticatorSelection"] = map[string]interface{}{"userVerification": aw.rp.UserVerification}
+		if len(descriptors) > 0 {
+			options["excludeCredentials"] = descriptors
+		}
+	} else {
+		options["rpId"] = aw.rp.ID
+		options["allowCredentials"] = descriptors
+	}
+	var buf bytes.Buffer
+	if err := pageTemplate.Execute(&buf, pd); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,129 @@
+package authwebauthn
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Registered credential of a user
+type Credential struct {
+	ID []byte `json:"id"`
+	// COSE_Key
+	PublicKey []byte    `json:"publicKey"`
+	SignCount uint32    `json:"signCount"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastUsed,omitempty"`
+}
+
+// CredentialStore stores the credentials of the users
+type CredentialStore interface {
+	Credentials(user string) ([]Credential, error)
+	Add(user string, cred Credential) error
+	// Replace the credential with the same id
+	Update(user string, cred Credential) error
+}
+
+// FileStore keeps the credentials in a JSON file which is rewritten on
+// changes
+type FileStore struct {
+	sync.RWMutex
+	path  string
+	creds map[string][]Credential
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	if path == "" {
+		return nil, errors.New("credential store path is not set")
+	}
+	fs := &FileStore{path: path, creds: make(map[string][]Credential)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read credential file")
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &fs.creds); err != nil {
+			return nil, errors.Wrap(err, "cannot parse credential file")
+		}
+	}
+	return fs, nil
+}
+
+func (fs *FileStore) Credentials(user string) ([]Credential, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+	return append([]Credential{}, fs.creds[user]...), nil
+}
+
+func (fs *FileStore) Add(user string, cred Credential) error {
+	fs.Lock()
+	defer fs.Unlock()
+	old := fs.creds[user]
+	for _, c := range old {
+		if bytes.Equal(c.ID, cred.ID) {
+			return errors.New("credential is already registered")
+		}
+	}
+	fs.creds[user] = append(append([]Credential{}, old...), cred)
+	if err := fs.save(); err != nil {
+		fs.creds[user] = old
+		return err
+	}
+	return nil
+}
+
+func (fs *FileStore) Update(user string, cred Credential) error {
+	fs.Lock()
+	defer fs.Unlock()
+	old := fs.creds[user]
+	updated := append([]Credential{}, old...)
+	found := false
+	for i, c := range updated {
+		if bytes.Equal(c.ID, cred.ID) {
+			updated[i] = cred
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("credential not found")
+	}
+	fs.creds[user] = updated
+	if err := fs.save(); err != nil {
+		fs.creds[user] = old
+		return err
+	}
+	return nil
+}
+
+// Write to a temporary file and rename so readers never see a partial file
+func (fs *FileStore) save() error {
+	data, err := json.MarshalIndent(fs.creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), ".webauthn-credentials")
+	if err != nil {
+		return errors.Wrap(err, "cannot write credential file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "cannot write credential file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "cannot write credential file")
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return errors.Wrap(err, "cannot write credential file")
+	}
+	return errors.Wrap(os.Rename(tmp.Name(), fs.path), "cannot write credential file")
+}
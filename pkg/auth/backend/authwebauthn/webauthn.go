@@ -0,0 +1,245 @@
+package authwebauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/pkg/errors"
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent      = 0x01
+	flagUserVerified     = 0x04
+	flagAttestedCredData = 0x40
+)
+
+// COSE algorithms
+const (
+	algES256 = -7
+	algEdDSA = -8
+	algRS256 = -257
+)
+
+const (
+	userVerificationRequired    = "required"
+	userVerificationPreferred   = "preferred"
+	userVerificationDiscouraged = "discouraged"
+)
+
+var b64 = base64.RawURLEncoding
+
+// CBOR decoding of authenticator messages. Indefinite lengths and duplicate
+// map keys are not allowed in CTAP2
+var cborDecMode, _ = cbor.DecOptions{
+	DupMapKey:       cbor.DupMapKeyEnforcedAPF,
+	IndefLength:     cbor.IndefLengthForbidden,
+	MaxNestedLevels: 16,
+}.DecMode()
+
+// Relying party checks of the WebAuthn Level 2 ceremonies
+type relyingParty struct {
+	ID               string
+	Origins          []string
+	UserVerification string
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type attestationObject struct {
+	Fmt      string          `cbor:"fmt"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+	AuthData []byte          `cbor:"authData"`
+}
+
+// COSE_Key parameters, the meaning of the negative labels depends on the
+// key type
+type coseKey struct {
+	Kty int64           `cbor:"1,keyasint"`
+	Alg int64           `cbor:"3,keyasint"`
+	P1  cbor.RawMessage `cbor:"-1,keyasint"`
+	P2  []byte          `cbor:"-2,keyasint"`
+	P3  []byte          `cbor:"-3,keyasint"`
+}
+
+type authenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+	// Attested credential data, only in registrations
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+// Check the collected client data of a ceremony
+func (rp *relyingParty) checkClientData(raw []byte, typ string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return errors.Wrap(err, "invalid client data")
+	}
+	if cd.Type != typ {
+		return errors.Errorf("unexpected client data type %q", cd.Type)
+	}
+	got, err := b64.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return errors.New("challenge does not match")
+	}
+	for _, o := range rp.Origins {
+		if cd.Origin == o {
+			return nil
+		}
+	}
+	return errors.Errorf("origin %q is not allowed", cd.Origin)
+}
+
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	ad := &authenticatorData{
+		RPIDHash:  b[:32],
+		Flags:     b[32],
+		SignCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if ad.Flags&flagAttestedCredData == 0 {
+		return ad, nil
+	}
+	rest := b[37:]
+	// AAGUID and the credential id length
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data too short")
+	}
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < n {
+		return nil, errors.New("attested credential data too short")
+	}
+	ad.CredentialID = rest[:n]
+	// The public key is followed by extensions when the ED flag is set
+	var key cbor.RawMessage
+	if _, err := cborDecMode.UnmarshalFirst(rest[n:], &key); err != nil {
+		return nil, errors.Wrap(err, "invalid credential public key")
+	}
+	ad.PublicKey = key
+	return ad, nil
+}
+
+// Check the RP ID hash and the user presence and verification flags
+func (rp *relyingParty) checkAuthenticatorData(ad *authenticatorData) error {
+	hash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(ad.RPIDHash, hash[:]) != 1 {
+		return errors.New("RP ID does not match")
+	}
+	if ad.Flags&flagUserPresent == 0 {
+		return errors.New("user was not present")
+	}
+	if rp.UserVerification == userVerificationRequired && ad.Flags&flagUserVerified == 0 {
+		return errors.New("user was not verified")
+	}
+	return nil
+}
+
+// Authenticator data of an attestation object. The attestation statement
+// is not verified, the credentials are trusted on first use
+func parseAttestationObject(b []byte) ([]byte, error) {
+	var att attestationObject
+	if err := cborDecMode.Unmarshal(b, &att); err != nil {
+		return nil, errors.Wrap(err, "invalid attestation object")
+	}
+	if att.Fmt == "" {
+		return nil, errors.New("attestation object without format")
+	}
+	if len(att.AuthData) == 0 {
+		return nil, errors.New("attestation object without authenticator data")
+	}
+	return att.AuthData, nil
+}
+
+// Parse a COSE_Key (RFC 8152) of a supported algorithm
+func parsePublicKey(b []byte) (crypto.PublicKey, int64, error) {
+	var k coseKey
+	if err := cborDecMode.Unmarshal(b, &k); err != nil {
+		return nil, 0, errors.Wrap(err, "invalid public key")
+	}
+	kty, alg := k.Kty, k.Alg
+	// Curve of the EC2 and OKP keys
+	crv := func() int64 {
+		var v int64
+		if cborDecMode.Unmarshal(k.P1, &v) != nil {
+			return 0
+		}
+		return v
+	}
+	switch {
+	case kty == 2 && alg == algES256:
+		x, y := k.P2, k.P3
+		if crv() != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("invalid P-256 key")
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, 0, errors.New("invalid P-256 key")
+		}
+		return pub, alg, nil
+	case kty == 1 && alg == algEdDSA:
+		x := k.P2
+		if crv() != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case kty == 3 && alg == algRS256:
+		var n []byte
+		if err := cborDecMode.Unmarshal(k.P1, &n); err != nil {
+			return nil, 0, errors.New("invalid RSA key")
+		}
+		e := k.P2
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("invalid RSA key")
+		}
+		exp := 0
+		for _, c := range e {
+			exp = exp<<8 | int(c)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}, alg, nil
+	}
+	return nil, 0, errors.Errorf("unsupported key type %d with algorithm %d", kty, alg)
+}
+
+// Verify an assertion signature over the authenticator data and the hash
+// of the client data
+func verifySignature(publicKey, authData, clientDataJSON, sig []byte) error {
+	pub, _, err := parsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	cdHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authData...), cdHash[:]...)
+	digest := sha256.Sum256(signed)
+	valid := false
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		valid = ecdsa.VerifyASN1(k, digest[:], sig)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, signed, sig)
+	case *rsa.PublicKey:
+		valid = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	}
+	if !valid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -27,3 +28,64 @@ func MakeCertificate(key ssh.PublicKey, actx *AuthContext) *ssh.Certificate {
 		},
 	}
 }
+
+// Host certificate for the given hostnames requested by the auth context
+// subject
+func MakeHostCertificate(key ssh.PublicKey, hostnames []string, actx *AuthContext) *ssh.Certificate {
+	kid := []string{}
+	kid = append(kid, fmt.Sprintf("host=%q", hostnames[0]))
+	kid = append(kid, fmt.Sprintf("requested_by=%q", actx.GetSubjectName()))
+	if aid, ok := actx.GetAuthMeta()[MetaAuditID]; ok {
+		kid = append(kid, fmt.Sprintf("audit_id=%q", aid))
+	}
+	return &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.HostCert,
+		KeyId:           strings.Join(kid, " "),
+		ValidPrincipals: hostnames,
+		ValidAfter:      uint64(time.Now().Unix()),
+	}
+}
+
+// Return the subject name encoded in the key id by MakeCertificate
+func SubjectFromKeyID(kid string) string {
+	var subject string
+	if _, err := fmt.Sscanf(kid, "subject=%q", &subject); err != nil {
+		return ""
+	}
+	return subject
+}
+
+// Check the names and identity variables of extension formats. Only
+// vendor extensions named like name@domain can be set, the standard
+// permit-* extensions come from the backends
+func CheckExtensions(formats map[string]string) error {
+	for name, format := range formats {
+		if i := strings.IndexByte(name, '@'); i < 1 || i == len(name)-1 {
+			return errors.Errorf("extension %s is not named like name@domain", name)
+		}
+		if err := CheckVariables(format); err != nil {
+			return errors.Wrapf(err, "invalid extension %s", name)
+		}
+	}
+	return nil
+}
+
+// Set the extensions of the certificate from formats with identity
+// variables. Extensions expanding to empty are left out
+func ExpandExtensions(formats map[string]string, actx *AuthContext, cert *ssh.Certificate) error {
+	for name, format := range formats {
+		v, err := Expand(format, actx)
+		if err != nil {
+			return errors.Wrapf(err, "cannot expand extension %s", name)
+		}
+		if v == "" {
+			continue
+		}
+		if cert.Extensions == nil {
+			cert.Extensions = map[string]string{}
+		}
+		cert.Extensions[name] = v
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Identity variables available in key id formats and principal mapping
+// rules:
+//
+//	%u                subject name
+//	%a                audit id
+//	%%                literal %
+//	%{subject}        subject name
+//	%{audit_id}       audit id
+//	%{backend}        authenticator that completed the authentication
+//	%{backends}       all authenticators, comma separated
+//	%{principals}     principals, comma separated
+//	%{groups}         groups, comma separated
+//	%{ldap.<attr>}    attribute of the LDAP user entry
+//	%{claims.<name>}  identity claim of a federated backend
+//	%{identity.<key>} identity attribute from the backends, e.g.
+//	                  %{identity.employee_id} or %{identity.mfa}
+//	%{meta.<key>}     auth meta value
+const (
+	varPrefixLDAP   = "ldap."
+	varPrefixClaims = "claims."
+	varPrefixMeta   = "meta."
+	varPrefixIdent  = "identity."
+)
+
+// Whether s contains identity variables
+func HasVariables(s string) bool {
+	return strings.Contains(s, "%")
+}
+
+// Check the variables of s are known
+func CheckVariables(s string) error {
+	_, err := Expand(s, &AuthContext{})
+	return err
+}
+
+// Expand the identity variables of s from the auth context. Unset values
+// expand to empty strings
+func Expand(s string, actx *AuthContext) (string, error) {
+	var meta map[string]interface{}
+	getMeta := func() map[string]interface{} {
+		if meta == nil {
+			meta = actx.GetAuthMeta()
+		}
+		return meta
+	}
+	return expand(s, func(name string) (string, bool) {
+		switch name {
+		case "subject":
+			return actx.GetSubjectName(), true
+		case "audit_id":
+			return actx.GetMetaString(MetaAuditID), true
+		case "backend":
+			if a := actx.GetAuthenticators(); len(a) > 0 {
+				return a[0], true
+			}
+			return "", true
+		case "backends":
+			return strings.Join(actx.GetAuthenticators(), ","), true
+		case "principals":
+			return strings.Join(actx.GetPrincipals(), ","), true
+		case "groups":
+			return strings.Join(actx.GetGroups(), ","), true
+		}
+		switch {
+		case strings.HasPrefix(name, varPrefixLDAP):
+			entry, _ := getMeta()[MetaLDAPUserEntry].(map[string]interface{})
+			return metaValue(entry, strings.TrimPrefix(name, varPrefixLDAP), true), true
+		case strings.HasPrefix(name, varPrefixClaims):
+			claims, _ := getMeta()[MetaClaims].(map[string]interface{})
+			return metaValue(claims, strings.TrimPrefix(name, varPrefixClaims), false), true
+		case strings.HasPrefix(name, varPrefixIdent):
+			return metaValue(actx.GetIdentity(), strings.TrimPrefix(name, varPrefixIdent), false), true
+		case strings.HasPrefix(name, varPrefixMeta):
+			return metaValue(getMeta(), strings.TrimPrefix(name, varPrefixMeta), false), true
+		}
+		return "", false
+	})
+}
+
+// Format a meta value. LDAP attributes use the first value like the LDAP
+// backend templates, other lists are comma separated
+func metaValue(m map[string]interface{}, k string, first bool) string {
+	var values []string
+	switch v := m[k].(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []string:
+		values = v
+	case []interface{}:
+		for _, e := range v {
+			values = append(values, fmt.Sprint(e))
+		}
+	default:
+		return fmt.Sprint(v)
+	}
+	if first {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	}
+	return strings.Join(values, ",")
+}
+
+func expand(s string, lookup func(name string) (string, bool)) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", errors.Errorf("trailing %% in %q", s)
+		}
+		i++
+		var name string
+		switch s[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case 'u':
+			name = "subject"
+		case 'a':
+			name = "audit_id"
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return "", errors.Errorf("unterminated variable in %q", s)
+			}
+			name = s[i+1 : i+end]
+			i += end
+		default:
+			return "", errors.Errorf("unknown variable %%%c in %q", s[i], s)
+		}
+		v, ok := lookup(name)
+		if !ok {
+			return "", errors.Errorf("unknown variable %%{%s} in %q", name, s)
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,374 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pluginpb "github.com/aakso/ssh-inscribe/pkg/auth/plugin/proto"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Crashed plugins are restarted at most this often
+const restartInterval = time.Second
+
+var (
+	ErrClosed     = errors.New("plugin is closed")
+	ErrTimeout    = errors.New("plugin call timed out")
+	ErrRestarting = errors.New("plugin crashed and is waiting to be restarted")
+)
+
+// Error returned by the plugin. The plugin keeps running
+type ServerError string
+
+func (e ServerError) Error() string {
+	return string(e)
+}
+
+type ClientConfig struct {
+	// Program and its arguments
+	Command []string
+	// Environment of the program in addition to PATH and the protocol
+	// variables. The environment of the server is not passed on
+	Env map[string]string
+	// Limit for the start of the plugin and for each call
+	Timeout time.Duration
+	// Sent to the plugin after every start
+	Config *Config
+	Log    *logrus.Entry
+}
+
+// Client runs a plugin and makes the calls to it. A plugin exiting or hanging
+// fails only the calls in progress, it is started again on the next call
+type Client struct {
+	config ClientConfig
+	env    []string
+	// Private directory of the plugin socket
+	dir string
+
+	mu       sync.Mutex
+	inflight sync.WaitGroup
+	proc     *process
+	info     Info
+	started  time.Time
+	closed   bool
+}
+
+// A running plugin program
+type process struct {
+	cmd    *exec.Cmd
+	stdin  io.Closer
+	conn   *grpc.ClientConn
+	client pluginpb.PluginClient
+	exited chan struct{}
+}
+
+// Start the plugin. It is configured before returning
+func NewClient(config ClientConfig) (*Client, error) {
+	if len(config.Command) == 0 || config.Command[0] == "" {
+		return nil, errors.New("no plugin command")
+	}
+	dir, err := ioutil.TempDir("", "ssh-inscribe-plugin")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create plugin socket directory")
+	}
+	c := &Client{
+		config: config,
+		dir:    dir,
+		env: []string{
+			"PATH=" + os.Getenv("PATH"),
+			cookieEnv + "=" + cookieValue,
+			versionsEnv + "=" + formatVersions(supportedVersions),
+			socketEnv + "=" + filepath.Join(dir, "plugin.sock"),
+		},
+	}
+	var extra []string
+	for k, v := range config.Env {
+		extra = append(extra, k+"="+v)
+	}
+	sort.Strings(extra)
+	c.env = append(c.env, extra...)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return c, nil
+}
+
+// What the plugin returned on configure
+func (c *Client) Info() Info {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+func (c *Client) Authenticate(req *AuthRequest) (*AuthResponse, error) {
+	var res *pluginpb.AuthenticateResponse
+	err := c.call(func(ctx context.Context, p *process) (err error) {
+		res, err = p.client.Authenticate(ctx, req.toProto())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return authResponseFromProto(res), nil
+}
+
+func (c *Client) Probe() error {
+	return c.call(func(ctx context.Context, p *process) error {
+		_, err := p.client.Probe(ctx, &pluginpb.ProbeRequest{})
+		return err
+	})
+}
+
+// Stop the plugin after the calls in progress. It gets the end of its input
+// and is killed unless it exits within the timeout
+func (c *Client) Close() error {
+	defer os.RemoveAll(c.dir)
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.inflight.Wait()
+	c.mu.Lock()
+	p := c.proc
+	c.proc = nil
+	c.mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	p.conn.Close()
+	p.stdin.Close()
+	select {
+	case <-p.exited:
+	case <-time.After(c.config.Timeout):
+		p.cmd.Process.Kill()
+		<-p.exited
+	}
+	return nil
+}
+
+func (c *Client) call(fn func(ctx context.Context, p *process) error) error {
+	p, err := c.running()
+	if err != nil {
+		return err
+	}
+	defer c.inflight.Done()
+	err = p.call(fn, c.config.Timeout)
+	if _, ok := err.(ServerError); err != nil && !ok {
+		// The plugin is gone or hangs
+		c.stop(p)
+	}
+	return err
+}
+
+// Make the call. Errors returned by the plugin are ServerErrors
+func (p *process) call(fn func(ctx context.Context, p *process) error, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := fn(ctx, p)
+	if err == nil {
+		return nil
+	}
+	switch st := status.Convert(err); st.Code() {
+	case codes.DeadlineExceeded:
+		return ErrTimeout
+	case codes.Unavailable, codes.Canceled, codes.Internal:
+		return errors.Wrap(err, "plugin failed")
+	default:
+		return ServerError(st.Message())
+	}
+}
+
+// The running plugin, started again if it has exited. The call is counted
+// in progress unless an error is returned
+func (c *Client) running() (p *process, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	defer func() {
+		if err == nil {
+			c.inflight.Add(1)
+		}
+	}()
+	if c.proc != nil {
+		select {
+		case <-c.proc.exited:
+			c.proc.conn.Close()
+			c.proc = nil
+		default:
+			return c.proc, nil
+		}
+	}
+	if time.Since(c.started) < restartInterval {
+		return nil, ErrRestarting
+	}
+	c.config.Log.Warn("restarting plugin")
+	return c.start()
+}
+
+// Kill the plugin unless it was already replaced
+func (c *Client) stop(p *process) {
+	c.mu.Lock()
+	if c.proc == p {
+		c.proc = nil
+	}
+	c.mu.Unlock()
+	p.conn.Close()
+	p.cmd.Process.Kill()
+}
+
+// Start and configure the plugin. Called with the lock held
+func (c *Client) start() (*process, error) {
+	c.started = time.Now()
+	cmd := exec.Command(c.config.Command[0], c.config.Command[1:]...)
+	cmd.Env = c.env
+	cmd.Stderr = &logWriter{log: c.config.Log}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "cannot start plugin")
+	}
+	p := &process{cmd: cmd, stdin: stdin, exited: make(chan struct{})}
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			c.config.Log.WithError(err).Warn("plugin exited")
+		} else {
+			c.config.Log.Info("plugin exited")
+		}
+		close(p.exited)
+	}()
+	fail := func(err error) (*process, error) {
+		cmd.Process.Kill()
+		<-p.exited
+		return nil, err
+	}
+
+	r := bufio.NewReader(stdout)
+	version, network, address, err := c.handshake(r)
+	if err != nil {
+		return fail(err)
+	}
+	// The rest of the output is only logged
+	go io.Copy(&logWriter{log: c.config.Log}, r)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.Timeout)
+	defer cancel()
+	p.conn, err = grpc.DialContext(ctx, address,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}))
+	if err != nil {
+		return fail(errors.Wrap(err, "cannot connect to plugin"))
+	}
+	p.client = pluginpb.NewPluginClient(p.conn)
+	conf, err := c.config.Config.toProto()
+	if err != nil {
+		p.conn.Close()
+		return fail(err)
+	}
+	var info *pluginpb.ConfigureResponse
+	err = p.call(func(ctx context.Context, p *process) (err error) {
+		info, err = p.client.Configure(ctx, conf)
+		return err
+	}, c.config.Timeout)
+	if err != nil {
+		p.conn.Close()
+		return fail(errors.Wrap(err, "cannot configure plugin"))
+	}
+	c.proc = p
+	c.info = Info{CredentialType: info.CredentialType, Version: info.Version}
+	c.config.Log.WithField("protocol_version", version).
+		WithField("plugin_version", c.info.Version).
+		Info("plugin started")
+	return p, nil
+}
+
+// Read the handshake line, check the protocol version and return the
+// address the plugin listens on
+func (c *Client) handshake(r *bufio.Reader) (version int, network, address string, err error) {
+	type result struct {
+		line string
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		line, err := r.ReadString('\n')
+		ch <- result{line, err}
+	}()
+	var res result
+	select {
+	case res = <-ch:
+	case <-time.After(c.config.Timeout):
+		return 0, "", "", errors.New("plugin did not complete the handshake in time")
+	}
+	if res.err != nil {
+		return 0, "", "", errors.New("plugin exited before the handshake, see the log for its output")
+	}
+	line := strings.TrimSpace(res.line)
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 || parts[0] != handshakePrefix {
+		return 0, "", "", errors.Errorf("invalid plugin handshake: %q", line)
+	}
+	version, err = strconv.Atoi(parts[1])
+	if err != nil || negotiate(supportedVersions, parts[1]) != version {
+		return 0, "", "", errors.Errorf("unsupported plugin protocol version %s, supported: %s",
+			parts[1], formatVersions(supportedVersions))
+	}
+	if len(parts) != 4 || (parts[2] != "unix" && parts[2] != "tcp") || parts[3] == "" {
+		return 0, "", "", errors.Errorf("invalid plugin handshake: %q", line)
+	}
+	return version, parts[2], parts[3], nil
+}
+
+// Log the output of the plugin line by line
+type logWriter struct {
+	log *logrus.Entry
+	buf []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.log.WithField("output", string(bytes.TrimSpace(w.buf[:i]))).Info("plugin output")
+		w.buf = w.buf[i+1:]
+	}
+	// Do not keep a long line without newlines forever
+	if len(w.buf) > 4096 {
+		w.log.WithField("output", string(w.buf)).Info("plugin output")
+		w.buf = nil
+	}
+	return len(p), nil
+}
@@ -0,0 +1,172 @@
+// Package plugin implements the protocol between ssh-inscribed and auth
+// backends running as separate programs. A plugin is a program calling Serve
+// with its Backend. The server starts it, agrees on the protocol version in a
+// handshake and then makes gRPC calls to the Plugin service the plugin
+// serves on a local socket. The service is defined in proto/plugin.proto so
+// plugins can be written in other languages as well
+package plugin
+
+import (
+	"strconv"
+	"strings"
+
+	pluginpb "github.com/aakso/ssh-inscribe/pkg/auth/plugin/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+const (
+	// Newest version of the protocol this package speaks. Version 1 was
+	// JSON-RPC over the standard input and output of the plugin
+	ProtocolVersion = 2
+
+	// Tells the plugin it was started by the server. Not a security measure,
+	// only keeps the plugin from waiting for calls when run by hand
+	cookieEnv   = "SSH_INSCRIBE_PLUGIN_COOKIE"
+	cookieValue = "3c5d1f8e6a0b4e72b9d4c1a7f2e0d68b"
+	// Comma separated protocol versions the server speaks
+	versionsEnv = "SSH_INSCRIBE_PLUGIN_PROTOCOL_VERSIONS"
+	// Unix socket the plugin listens on
+	socketEnv = "SSH_INSCRIBE_PLUGIN_SOCKET"
+	// First line of the plugin output is
+	// handshakePrefix|<version>|<network>|<address>
+	handshakePrefix = "ssh-inscribe-plugin"
+)
+
+var supportedVersions = []int{ProtocolVersion}
+
+// Sent to the plugin once after every start
+type Config struct {
+	Name  string
+	Realm string
+	// Free-form settings from the server configuration
+	Settings map[string]interface{}
+}
+
+// Returned by the plugin on configure
+type Info struct {
+	// Credential type the plugin takes, user_password by default
+	CredentialType string
+	// Version of the plugin for the logs
+	Version string
+}
+
+type AuthRequest struct {
+	User string
+	// Password, token or the DER certificate depending on the credential
+	// type
+	Secret  []byte
+	AuditID string
+	// Result of the preceding backends in the chain
+	Parent *Parent
+}
+
+type Parent struct {
+	Subject        string
+	Principals     []string
+	Groups         []string
+	Authenticators []string
+}
+
+// The authentication fails unless Success is set
+type AuthResponse struct {
+	Success         bool
+	SubjectName     string
+	Principals      []string
+	Groups          []string
+	CriticalOptions map[string]string
+	Extensions      map[string]string
+	// Duration string like 8h
+	MaxLifetime string
+	// Logged when the authentication fails
+	Message string
+}
+
+func (c *Config) toProto() (*pluginpb.ConfigureRequest, error) {
+	settings, err := structpb.NewStruct(c.Settings)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid plugin settings")
+	}
+	return &pluginpb.ConfigureRequest{Name: c.Name, Realm: c.Realm, Settings: settings}, nil
+}
+
+func configFromProto(m *pluginpb.ConfigureRequest) *Config {
+	return &Config{Name: m.Name, Realm: m.Realm, Settings: m.Settings.AsMap()}
+}
+
+func (r *AuthRequest) toProto() *pluginpb.AuthenticateRequest {
+	m := &pluginpb.AuthenticateRequest{User: r.User, Secret: r.Secret, AuditId: r.AuditID}
+	if p := r.Parent; p != nil {
+		m.Parent = &pluginpb.Parent{
+			Subject:        p.Subject,
+			Principals:     p.Principals,
+			Groups:         p.Groups,
+			Authenticators: p.Authenticators,
+		}
+	}
+	return m
+}
+
+func authRequestFromProto(m *pluginpb.AuthenticateRequest) *AuthRequest {
+	r := &AuthRequest{User: m.User, Secret: m.Secret, AuditID: m.AuditId}
+	if p := m.Parent; p != nil {
+		r.Parent = &Parent{
+			Subject:        p.Subject,
+			Principals:     p.Principals,
+			Groups:         p.Groups,
+			Authenticators: p.Authenticators,
+		}
+	}
+	return r
+}
+
+func (r *AuthResponse) toProto() *pluginpb.AuthenticateResponse {
+	return &pluginpb.AuthenticateResponse{
+		Success:         r.Success,
+		SubjectName:     r.SubjectName,
+		Principals:      r.Principals,
+		Groups:          r.Groups,
+		CriticalOptions: r.CriticalOptions,
+		Extensions:      r.Extensions,
+		MaxLifetime:     r.MaxLifetime,
+		Message:         r.Message,
+	}
+}
+
+func authResponseFromProto(m *pluginpb.AuthenticateResponse) *AuthResponse {
+	return &AuthResponse{
+		Success:         m.Success,
+		SubjectName:     m.SubjectName,
+		Principals:      m.Principals,
+		Groups:          m.Groups,
+		CriticalOptions: m.CriticalOptions,
+		Extensions:      m.Extensions,
+		MaxLifetime:     m.MaxLifetime,
+		Message:         m.Message,
+	}
+}
+
+func formatVersions(versions []int) string {
+	s := make([]string, len(versions))
+	for i, v := range versions {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ",")
+}
+
+// Newest version in both lists, zero if none
+func negotiate(ours []int, theirs string) int {
+	r := 0
+	for _, s := range strings.Split(theirs, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+		for _, o := range ours {
+			if v == o && v > r {
+				r = v
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,114 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	pluginpb "github.com/aakso/ssh-inscribe/pkg/auth/plugin/proto"
+	"google.golang.org/grpc"
+)
+
+// Implemented by the plugins. The calls are concurrent
+type Backend interface {
+	Configure(config *Config) (*Info, error)
+	Authenticate(req *AuthRequest) (*AuthResponse, error)
+}
+
+// Optionally implemented by the plugins to check their backing service
+type Prober interface {
+	Probe() error
+}
+
+// Serve the backend to the server until it closes the standard input of the
+// plugin. Anything the plugin writes to the standard output ends up in the
+// server log like the standard error
+func Serve(b Backend) {
+	if os.Getenv(cookieEnv) != cookieValue {
+		fmt.Fprintln(os.Stderr, "This is an ssh-inscribe auth plugin, it is started by ssh-inscribed")
+		os.Exit(1)
+	}
+	version := negotiate(supportedVersions, os.Getenv(versionsEnv))
+	if version == 0 {
+		fmt.Fprintf(os.Stderr, "no common protocol version, the plugin speaks %s and the server %s\n",
+			formatVersions(supportedVersions), os.Getenv(versionsEnv))
+		os.Exit(1)
+	}
+	socket := os.Getenv(socketEnv)
+	if socket == "" {
+		fmt.Fprintf(os.Stderr, "%s is not set\n", socketEnv)
+		os.Exit(1)
+	}
+	os.Remove(socket)
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer os.Remove(socket)
+
+	srv := grpc.NewServer()
+	pluginpb.RegisterPluginServer(srv, &service{b: b})
+	go func() {
+		// The server is done with the plugin
+		io.Copy(ioutil.Discard, os.Stdin)
+		srv.GracefulStop()
+	}()
+
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	fmt.Fprintf(out, "%s|%d|unix|%s\n", handshakePrefix, version, socket)
+	if err := srv.Serve(l); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+// Plugin service turning panics of the backend into errors so that a bad
+// request does not take the plugin down
+type service struct {
+	pluginpb.UnimplementedPluginServer
+	b Backend
+}
+
+func (s *service) Configure(ctx context.Context, in *pluginpb.ConfigureRequest) (_ *pluginpb.ConfigureResponse, err error) {
+	defer recoverError(&err)
+	info, err := s.b.Configure(configFromProto(in))
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		info = &Info{}
+	}
+	return &pluginpb.ConfigureResponse{CredentialType: info.CredentialType, Version: info.Version}, nil
+}
+
+func (s *service) Authenticate(ctx context.Context, in *pluginpb.AuthenticateRequest) (_ *pluginpb.AuthenticateResponse, err error) {
+	defer recoverError(&err)
+	res, err := s.b.Authenticate(authRequestFromProto(in))
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		res = &AuthResponse{}
+	}
+	return res.toProto(), nil
+}
+
+func (s *service) Probe(ctx context.Context, in *pluginpb.ProbeRequest) (_ *pluginpb.ProbeResponse, err error) {
+	defer recoverError(&err)
+	if p, ok := s.b.(Prober); ok {
+		if err := p.Probe(); err != nil {
+			return nil, err
+		}
+	}
+	return &pluginpb.ProbeResponse{}, nil
+}
+
+func recoverError(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("plugin panic: %v", r)
+	}
+}
@@ -0,0 +1,24 @@
+package auth
+
+import (
+	"crypto/sha512"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Namespace of the signatures answering the challenges of the authsshkey
+// backend, as in the namespaces option of allowed_signers
+const SSHKeyNamespace = "ssh-inscribe-login"
+
+// Data the client signs with its SSH key to answer a challenge. It is the
+// blob of the SSHSIG format of ssh-keygen -Y sign, so the signature cannot
+// pass for an SSH user authentication or a signature in another namespace
+func SSHKeySignedData(challenge string) []byte {
+	h := sha512.Sum512([]byte(challenge))
+	return append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Hash      []byte
+	}{SSHKeyNamespace, "", "sha512", h[:]})...)
+}
@@ -0,0 +1,293 @@
+package bootstrap
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+)
+
+var Log = logging.GetLogger("bootstrap").WithField("pkg", "bootstrap")
+
+var (
+	ErrInvalidToken    = errors.New("invalid bootstrap token")
+	ErrHostnameDenied  = errors.New("hostname is not allowed by the bootstrap token")
+	ErrNotFound        = errors.New("bootstrap token not found")
+	ErrNoHostnames     = errors.New("bootstrap token must have at least one hostname pattern")
+	ErrInvalidLifetime = errors.New("bootstrap token lifetime must be positive")
+	ErrInvalidPattern  = errors.New("invalid hostname pattern")
+)
+
+// Bootstrap token lets an unattended host request its host certificate
+// without interactive authentication. Only the hash of the secret part is
+// stored
+type Token struct {
+	ID         string    `json:"id"`
+	SecretHash string    `json:"secret_hash,omitempty"`
+	Hostnames  []string  `json:"hostnames"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	Expires    time.Time `json:"expires"`
+	// Remaining uses, the token is removed once this reaches zero
+	UsesLeft int `json:"uses_left"`
+}
+
+// Check that all the hostnames match the token hostname patterns
+func (t *Token) AllowsHostnames(hostnames []string) bool {
+	globs := make([]glob.Glob, 0, len(t.Hostnames))
+	for _, p := range t.Hostnames {
+		g, err := glob.Compile(p)
+		if err != nil {
+			return false
+		}
+		globs = append(globs, g)
+	}
+	for _, h := range hostnames {
+		ok := false
+		for _, g := range globs {
+			if g.Match(h) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Hostnames of the token that are literal names instead of patterns. These
+// are used when the host does not request any specific names
+func (t *Token) LiteralHostnames() []string {
+	var ret []string
+	for _, h := range t.Hostnames {
+		if !strings.ContainsAny(h, `*?[]{}\`) {
+			ret = append(ret, h)
+		}
+	}
+	return ret
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Store keeps the issued bootstrap tokens and persists them into a JSON
+// file. With an empty path the store is kept in memory only
+type Store struct {
+	sync.Mutex
+	path   string
+	tokens map[string]*Token
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path, tokens: make(map[string]*Token)}
+	if path == "" {
+		return s, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "cannot read bootstrap token store")
+	}
+	var tokens []*Token
+	if err := json.Unmarshal(raw, &tokens); err != nil {
+		return nil, errors.Wrap(err, "cannot parse bootstrap token store")
+	}
+	for _, t := range tokens {
+		s.tokens[t.ID] = t
+	}
+	Log.WithField("path", path).WithField("tokens", len(tokens)).Debug("loaded bootstrap token store")
+	return s, nil
+}
+
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+	raw, err := json.MarshalIndent(s.list(true), "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "cannot encode bootstrap token store")
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return errors.Wrap(err, "cannot write bootstrap token store")
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return errors.Wrap(err, "cannot write bootstrap token store")
+	}
+	return nil
+}
+
+// Drop expired and used up tokens. Must be called with the lock held
+func (s *Store) prune(now time.Time) bool {
+	changed := false
+	for id, t := range s.tokens {
+		if t.UsesLeft <= 0 || !now.Before(t.Expires) {
+			delete(s.tokens, id)
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (s *Store) list(withSecret bool) []Token {
+	ret := make([]Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		c := *t
+		c.Hostnames = append([]string(nil), t.Hostnames...)
+		if !withSecret {
+			c.SecretHash = ""
+		}
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].CreatedAt.Before(ret[j].CreatedAt) })
+	return ret
+}
+
+// Create a new token valid for ttl and the given number of uses. The
+// returned string is the only copy of the secret
+func (s *Store) Create(hostnames []string, ttl time.Duration, uses int, createdBy string) (string, *Token, error) {
+	if len(hostnames) == 0 {
+		return "", nil, ErrNoHostnames
+	}
+	for _, h := range hostnames {
+		if _, err := glob.Compile(h); err != nil {
+			return "", nil, errors.Wrapf(ErrInvalidPattern, "%q", h)
+		}
+	}
+	if ttl <= 0 {
+		return "", nil, ErrInvalidLifetime
+	}
+	if uses <= 0 {
+		uses = 1
+	}
+	var idb [8]byte
+	var secretb [32]byte
+	if _, err := rand.Read(idb[:]); err != nil {
+		return "", nil, errors.Wrap(err, "cannot generate token")
+	}
+	if _, err := rand.Read(secretb[:]); err != nil {
+		return "", nil, errors.Wrap(err, "cannot generate token")
+	}
+	secret := base64.RawURLEncoding.EncodeToString(secretb[:])
+	now := time.Now().UTC()
+	t := &Token{
+		ID:         hex.EncodeToString(idb[:]),
+		SecretHash: hashSecret(secret),
+		Hostnames:  append([]string(nil), hostnames...),
+		CreatedBy:  createdBy,
+		CreatedAt:  now,
+		Expires:    now.Add(ttl),
+		UsesLeft:   uses,
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.prune(now)
+	s.tokens[t.ID] = t
+	if err := s.save(); err != nil {
+		delete(s.tokens, t.ID)
+		return "", nil, err
+	}
+	ret := *t
+	ret.SecretHash = ""
+	return t.ID + "." + secret, &ret, nil
+}
+
+// Lookup a valid token. Must be called with the lock held
+func (s *Store) lookup(raw string) *Token {
+	parts := strings.SplitN(strings.TrimSpace(raw), ".", 2)
+	if len(parts) != 2 {
+		return nil
+	}
+	t := s.tokens[parts[0]]
+	if t == nil || t.UsesLeft <= 0 || !time.Now().Before(t.Expires) {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashSecret(parts[1])), []byte(t.SecretHash)) != 1 {
+		return nil
+	}
+	return t
+}
+
+// Validate the token without using it
+func (s *Store) Peek(raw string) (*Token, error) {
+	s.Lock()
+	defer s.Unlock()
+	t := s.lookup(raw)
+	if t == nil {
+		return nil, ErrInvalidToken
+	}
+	ret := *t
+	ret.SecretHash = ""
+	return &ret, nil
+}
+
+// Validate the token against the requested hostnames and use it once.
+// A use is consumed only when all the checks pass
+func (s *Store) Consume(raw string, hostnames []string) (*Token, error) {
+	s.Lock()
+	defer s.Unlock()
+	t := s.lookup(raw)
+	if t == nil {
+		return nil, ErrInvalidToken
+	}
+	if !t.AllowsHostnames(hostnames) {
+		return nil, ErrHostnameDenied
+	}
+	t.UsesLeft--
+	ret := *t
+	ret.SecretHash = ""
+	if t.UsesLeft <= 0 {
+		delete(s.tokens, t.ID)
+	}
+	if err := s.save(); err != nil {
+		// Fail closed: keep the use consumed in memory
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// List the active tokens without the secret hashes
+func (s *Store) List() []Token {
+	s.Lock()
+	defer s.Unlock()
+	if s.prune(time.Now()) {
+		if err := s.save(); err != nil {
+			Log.WithError(err).Error("cannot prune bootstrap tokens")
+		}
+	}
+	return s.list(false)
+}
+
+func (s *Store) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	t, ok := s.tokens[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.tokens, id)
+	if err := s.save(); err != nil {
+		s.tokens[id] = t
+		return err
+	}
+	return nil
+}
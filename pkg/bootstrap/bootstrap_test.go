@@ -0,0 +1,92 @@
+package bootstrap
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "bootstraptest")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "tokens.json")
+
+	s, err := NewStore(fn)
+	if !assert.NoError(err) {
+		return
+	}
+	_, _, err = s.Create(nil, time.Hour, 1, "admin")
+	assert.Equal(ErrNoHostnames, err)
+	_, _, err = s.Create([]string{"a"}, 0, 1, "admin")
+	assert.Equal(ErrInvalidLifetime, err)
+
+	raw, tok, err := s.Create([]string{"web1.example.com", "*.web1.example.com"}, time.Hour, 2, "admin")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Empty(tok.SecretHash)
+	_, _, err = s.Create([]string{"[a"}, time.Hour, 1, "admin")
+	assert.Equal(ErrInvalidPattern, errors.Cause(err))
+	peek, err := s.Peek(raw)
+	if assert.NoError(err) {
+		assert.Equal(2, peek.UsesLeft)
+	}
+	assert.Equal([]string{"web1.example.com"}, tok.LiteralHostnames())
+
+	// Wrong secret, wrong hostname
+	_, err = s.Consume(tok.ID+".wrong", []string{"web1.example.com"})
+	assert.Equal(ErrInvalidToken, err)
+	_, err = s.Consume(raw, []string{"web2.example.com"})
+	assert.Equal(ErrHostnameDenied, err)
+
+	// Persisted
+	s, err = NewStore(fn)
+	if !assert.NoError(err) {
+		return
+	}
+	if assert.Len(s.List(), 1) {
+		assert.Equal(2, s.List()[0].UsesLeft)
+		assert.Empty(s.List()[0].SecretHash)
+	}
+
+	used, err := s.Consume(raw, []string{"web1.example.com", "a.web1.example.com"})
+	if assert.NoError(err) {
+		assert.Equal(1, used.UsesLeft)
+	}
+	_, err = s.Consume(raw, []string{"web1.example.com"})
+	assert.NoError(err)
+	_, err = s.Consume(raw, []string{"web1.example.com"})
+	assert.Equal(ErrInvalidToken, err)
+	assert.Len(s.List(), 0)
+
+	// Delete
+	_, tok, err = s.Create([]string{"db*"}, time.Hour, 1, "admin")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Nil(tok.LiteralHostnames())
+	assert.NoError(s.Delete(tok.ID))
+	assert.Equal(ErrNotFound, s.Delete(tok.ID))
+}
+
+func TestExpiry(t *testing.T) {
+	assert := assert.New(t)
+	s, _ := NewStore("")
+	raw, tok, err := s.Create([]string{"h"}, time.Hour, 1, "")
+	if !assert.NoError(err) {
+		return
+	}
+	s.tokens[tok.ID].Expires = time.Now().Add(-time.Second)
+	_, err = s.Consume(raw, []string{"h"})
+	assert.Equal(ErrInvalidToken, err)
+	assert.Len(s.List(), 0)
+}
@@ -0,0 +1,104 @@
+// Package carotation persists the state of CA key rotations
+package carotation
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+var Log = logging.GetLogger("carotation").WithField("pkg", "carotation")
+
+type RetiredKey struct {
+	Fingerprint string    `json:"fingerprint"`
+	PublicKey   string    `json:"public_key"`
+	RetiredAt   time.Time `json:"retired_at"`
+	RetiredBy   string    `json:"retired_by,omitempty"`
+}
+
+type State struct {
+	// Fingerprint of the default key after a completed rotation. Takes
+	// precedence over the configured signing key fingerprint
+	Current string `json:"current,omitempty"`
+	// Pending rotation
+	Next      string       `json:"next,omitempty"`
+	Cutover   *time.Time   `json:"cutover,omitempty"`
+	StartedBy string       `json:"started_by,omitempty"`
+	StartedAt *time.Time   `json:"started_at,omitempty"`
+	Retired   []RetiredKey `json:"retired,omitempty"`
+}
+
+// Store keeps the rotation state in a JSON file. With an empty path the
+// state is kept in memory only
+type Store struct {
+	sync.Mutex
+	path  string
+	state State
+}
+
+func NewStore(path string) (*Store, error) {
+	s := &Store{path: path}
+	if path == "" {
+		return s, nil
+	}
+	raw, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "cannot read CA rotation store")
+	}
+	if err := json.Unmarshal(raw, &s.state); err != nil {
+		return nil, errors.Wrap(err, "cannot parse CA rotation store")
+	}
+	Log.WithField("path", path).Debug("loaded CA rotation store")
+	return s, nil
+}
+
+func (s *Store) State() State {
+	s.Lock()
+	defer s.Unlock()
+	st := s.state
+	st.Retired = append([]RetiredKey(nil), s.state.Retired...)
+	return st
+}
+
+// Modify the state and persist it. Nothing is changed if fn returns an
+// error
+func (s *Store) Update(fn func(st *State) error) error {
+	s.Lock()
+	defer s.Unlock()
+	st := s.state
+	st.Retired = append([]RetiredKey(nil), s.state.Retired...)
+	if err := fn(&st); err != nil {
+		return err
+	}
+	if err := s.save(st); err != nil {
+		return err
+	}
+	s.state = st
+	return nil
+}
+
+func (s *Store) save(st State) error {
+	if s.path == "" {
+		return nil
+	}
+	raw, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "cannot encode CA rotation store")
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return errors.Wrap(err, "cannot write CA rotation store")
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return errors.Wrap(err, "cannot write CA rotation store")
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package carotation
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "carotation")
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "rotation.json")
+
+	s, err := NewStore(fn)
+	if !assert.NoError(err) {
+		return
+	}
+	cutover := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	assert.NoError(s.Update(func(st *State) error {
+		st.Next = "SHA256:next"
+		st.Cutover = &cutover
+		return nil
+	}))
+	assert.Error(s.Update(func(st *State) error {
+		st.Next = ""
+		return errors.New("fail")
+	}))
+	assert.Equal("SHA256:next", s.State().Next)
+
+	// Reload from disk
+	s, err = NewStore(fn)
+	if assert.NoError(err) {
+		st := s.State()
+		assert.Equal("SHA256:next", st.Next)
+		if assert.NotNil(st.Cutover) {
+			assert.True(cutover.Equal(*st.Cutover))
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package certdb
+
+import (
+	"sort"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrNotFound = errors.New("certificate not found")
+
+// Metadata of an issued certificate
+type Record struct {
+	Serial               uint64    `json:"serial"`
+	KeyID                string    `json:"keyId"`
+	Type                 string    `json:"type"`
+	Subject              string    `json:"subject"`
+	Principals           []string  `json:"principals"`
+	ValidAfter           time.Time `json:"validAfter"`
+	ValidBefore          time.Time `json:"validBefore"`
+	PublicKeyFingerprint string    `json:"pubkeyFingerprint"`
+	CAFingerprint        string    `json:"caFingerprint"`
+	Authenticators       []string  `json:"authenticators,omitempty"`
+	AuditID              string    `json:"auditId,omitempty"`
+	RemoteAddress        string    `json:"remoteAddress,omitempty"`
+	IssuedAt             time.Time `json:"issuedAt"`
+	// Certificate in authorized_keys format if enabled
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// Fill certificate derived fields of the record
+func NewRecord(cert *ssh.Certificate, storeCert bool) *Record {
+	r := &Record{
+		Serial:               cert.Serial,
+		KeyID:                cert.KeyId,
+		Type:                 "user",
+		Principals:           cert.ValidPrincipals,
+		ValidAfter:           time.Unix(int64(cert.ValidAfter), 0).UTC(),
+		ValidBefore:          time.Unix(int64(cert.ValidBefore), 0).UTC(),
+		PublicKeyFingerprint: ssh.FingerprintSHA256(cert.Key),
+		IssuedAt:             time.Now().UTC(),
+	}
+	if cert.CertType == ssh.HostCert {
+		r.Type = "host"
+	}
+	if cert.SignatureKey != nil {
+		r.CAFingerprint = ssh.FingerprintSHA256(cert.SignatureKey)
+	}
+	if storeCert {
+		r.Certificate = string(ssh.MarshalAuthorizedKey(cert))
+	}
+	return r
+}
+
+// Valid reports whether the certificate validity period includes t
+func (r *Record) Valid(t time.Time) bool {
+	return !t.Before(r.ValidAfter) && t.Before(r.ValidBefore)
+}
+
+// Query parameters for List. Zero values match everything
+type Filter struct {
+	Subject   string
+	Principal string
+	KeyID     string
+	// Only certificates valid at this time
+	ValidAt time.Time
+	// Issuance time range
+	IssuedAfter  time.Time
+	IssuedBefore time.Time
+	// Expiry time range
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+	// Newest first, 0 is unlimited
+	Limit int
+}
+
+func (f *Filter) match(r *Record) bool {
+	if f.Subject != "" && f.Subject != r.Subject {
+		return false
+	}
+	if f.KeyID != "" && f.KeyID != r.KeyID {
+		return false
+	}
+	if !f.ValidAt.IsZero() && !r.Valid(f.ValidAt) {
+		return false
+	}
+	if !f.IssuedAfter.IsZero() && r.IssuedAt.Before(f.IssuedAfter) {
+		return false
+	}
+	if !f.IssuedBefore.IsZero() && !r.IssuedAt.Before(f.IssuedBefore) {
+		return false
+	}
+	if !f.ExpiresAfter.IsZero() && r.ValidBefore.Before(f.ExpiresAfter) {
+		return false
+	}
+	if !f.ExpiresBefore.IsZero() && !r.ValidBefore.Before(f.ExpiresBefore) {
+		return false
+	}
+	if f.Principal != "" {
+		found := false
+		for _, p := range r.Principals {
+			if p == f.Principal {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type Store interface {
+	Put(r *Record) error
+	// Returns ErrNotFound if no such serial
+	Get(serial uint64) (*Record, error)
+	List(f Filter) ([]*Record, error)
+	Close() error
+}
+
+// Sort newest first and apply the limit
+func sortAndLimit(records []*Record, limit int) []*Record {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].IssuedAt.After(records[j].IssuedAt)
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records
+}
+
+// Open the store according to the configuration. Returns nil store if the
+// database is disabled
+func Open() (Store, *Config, error) {
+	tmp, err := config.Get("certdb")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot initialize certdb")
+	}
+	conf, _ := tmp.(*Config)
+	if conf == nil {
+		return nil, nil, errors.New("cannot initialize certdb. Invalid configuration")
+	}
+	var store Store
+	switch conf.Type {
+	case "":
+		return nil, conf, nil
+	case TypeFile:
+		store, err = NewFileStore(conf.Path)
+	case TypeSQL:
+		store, err = NewSQLStore(conf.Driver, conf.DSN)
+	default:
+		err = errors.Errorf("unknown certdb type: %s", conf.Type)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot initialize certdb")
+	}
+	Log.WithField("type", conf.Type).Info("certificate database opened")
+	return store, conf, nil
+}
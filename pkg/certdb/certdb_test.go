@@ -0,0 +1,187 @@
+package certdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRecords(now time.Time) []*Record {
+	return []*Record{
+		&Record{
+			Serial:      1,
+			KeyID:       "one",
+			Subject:     "alice",
+			Principals:  []string{"alice", "admin"},
+			ValidAfter:  now.Add(-2 * time.Hour),
+			ValidBefore: now.Add(-time.Hour),
+			IssuedAt:    now.Add(-2 * time.Hour),
+		},
+		&Record{
+			Serial:      2,
+			KeyID:       "two",
+			Subject:     "alice",
+			Principals:  []string{"alice"},
+			ValidAfter:  now.Add(-time.Minute),
+			ValidBefore: now.Add(time.Hour),
+			IssuedAt:    now.Add(-time.Minute),
+		},
+		&Record{
+			Serial:      3,
+			KeyID:       "three",
+			Subject:     "bob",
+			Principals:  []string{"bob"},
+			ValidAfter:  now,
+			ValidBefore: now.Add(time.Hour),
+			IssuedAt:    now,
+		},
+	}
+}
+
+// Queries on the records of testRecords
+func testQueries(t *testing.T, s Store, now time.Time) {
+	assert := assert.New(t)
+	r, err := s.Get(2)
+	if assert.NoError(err) {
+		assert.Equal("two", r.KeyID)
+		assert.Equal([]string{"alice"}, r.Principals)
+	}
+	_, err = s.Get(4)
+	assert.Equal(ErrNotFound, err)
+
+	list, _ := s.List(Filter{})
+	if assert.Len(list, 3) {
+		assert.Equal(uint64(3), list[0].Serial)
+	}
+	list, _ = s.List(Filter{Subject: "alice"})
+	assert.Len(list, 2)
+	list, _ = s.List(Filter{Principal: "admin"})
+	assert.Len(list, 1)
+	list, _ = s.List(Filter{Subject: "alice", ValidAt: now})
+	if assert.Len(list, 1) {
+		assert.Equal(uint64(2), list[0].Serial)
+	}
+	list, _ = s.List(Filter{IssuedAfter: now.Add(-time.Hour), IssuedBefore: now})
+	if assert.Len(list, 1) {
+		assert.Equal(uint64(2), list[0].Serial)
+	}
+	list, _ = s.List(Filter{ExpiresBefore: now})
+	if assert.Len(list, 1) {
+		assert.Equal(uint64(1), list[0].Serial)
+	}
+	list, _ = s.List(Filter{ExpiresAfter: now})
+	assert.Len(list, 2)
+	list, _ = s.List(Filter{Limit: 1})
+	if assert.Len(list, 1) {
+		assert.Equal(uint64(3), list[0].Serial)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "certdbtest")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "certs.jsonl")
+
+	fs, err := NewFileStore(fn)
+	if !assert.NoError(err) {
+		return
+	}
+	now := time.Now().UTC()
+	for _, r := range testRecords(now) {
+		assert.NoError(fs.Put(r))
+	}
+	assert.NoError(fs.Close())
+
+	// Reload from disk
+	fs, err = NewFileStore(fn)
+	if !assert.NoError(err) {
+		return
+	}
+	defer fs.Close()
+	testQueries(t, fs, now)
+}
+
+func TestSQLStore(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewSQLStore("nonexistent", "")
+	assert.Error(err)
+
+	s := &SQLStore{postgres: true}
+	assert.Equal("SELECT a FROM t WHERE b = $1 AND c = $2", s.query("SELECT a FROM t WHERE b = ? AND c = ?"))
+	s.postgres = false
+	assert.Equal("SELECT a FROM t WHERE b = ?", s.query("SELECT a FROM t WHERE b = ?"))
+
+	dir, err := ioutil.TempDir("", "certdbtest")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	dsn := path.Join(dir, "certs.db")
+	s, err = NewSQLStore(Defaults.Driver, dsn)
+	if !assert.NoError(err) {
+		return
+	}
+	now := time.Now().UTC()
+	for _, r := range testRecords(now) {
+		assert.NoError(s.Put(r))
+	}
+	// Stored again with the certificate
+	r := testRecords(now)[2]
+	r.Certificate = "ssh-ed25519-cert-v01@openssh.com AAAA"
+	assert.NoError(s.Put(r))
+	assert.NoError(s.Close())
+
+	s, err = NewSQLStore(Defaults.Driver, dsn)
+	if !assert.NoError(err) {
+		return
+	}
+	defer s.Close()
+	testQueries(t, s, now)
+	r, err = s.Get(3)
+	if assert.NoError(err) {
+		assert.Equal("ssh-ed25519-cert-v01@openssh.com AAAA", r.Certificate)
+		assert.True(now.Equal(r.IssuedAt))
+	}
+
+	// Instances sharing the database never get the same serial
+	other, err := NewSQLStore(Defaults.Driver, dsn)
+	if !assert.NoError(err) {
+		return
+	}
+	defer other.Close()
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		serials = map[uint64]bool{}
+	)
+	for _, st := range []*SQLStore{s, other, s, other} {
+		wg.Add(1)
+		go func(st *SQLStore) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				n, err := st.NextSerial()
+				if !assert.NoError(err) {
+					return
+				}
+				mu.Lock()
+				assert.False(serials[n], "duplicate serial %d", n)
+				serials[n] = true
+				mu.Unlock()
+			}
+		}(st)
+	}
+	wg.Wait()
+	assert.Len(serials, 40)
+	n, err := s.NextSerial()
+	assert.NoError(err)
+	assert.Equal(uint64(41), n)
+}
@@ -0,0 +1,31 @@
+package certdb
+
+import (
+	"path"
+
+	"github.com/aakso/ssh-inscribe/pkg/globals"
+	"github.com/aakso/ssh-inscribe/pkg/storage/sqlutil"
+)
+
+type Config struct {
+	// Store type: file or sql. Empty disables the database
+	Type string `yaml:"type"`
+	// Store the full certificate in addition to the metadata
+	StoreCertificate bool `yaml:"storeCertificate"`
+
+	// File store
+	Path string `yaml:"path"`
+
+	// SQL store. The driver is sqlite or postgres, the DSN the path of the
+	// SQLite database or the PostgreSQL connection string
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+}
+
+var Defaults = &Config{
+	Type:             TypeSQL,
+	StoreCertificate: false,
+	Path:             path.Join(globals.VarDir(), "ssh_inscribe_certs.jsonl"),
+	Driver:           sqlutil.DriverSQLite,
+	DSN:              path.Join(globals.VarDir(), "ssh_inscribe_certs.db"),
+}
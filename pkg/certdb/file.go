@@ -0,0 +1,91 @@
+package certdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// FileStore appends records as JSON lines to a file and keeps an in-memory
+// index of all records. Later records with the same serial replace earlier
+// ones
+type FileStore struct {
+	sync.RWMutex
+	f       *os.File
+	enc     *json.Encoder
+	records map[uint64]*Record
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	if path == "" {
+		return nil, errors.New("certdb path is not set")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open certdb file")
+	}
+	fs := &FileStore{
+		f:       f,
+		enc:     json.NewEncoder(f),
+		records: make(map[uint64]*Record),
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		r := new(Record)
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			f.Close()
+			return nil, errors.Wrapf(err, "cannot parse certdb file at line %d", line)
+		}
+		fs.records[r.Serial] = r
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "cannot read certdb file")
+	}
+	return fs, nil
+}
+
+func (fs *FileStore) Put(r *Record) error {
+	fs.Lock()
+	defer fs.Unlock()
+	if err := fs.enc.Encode(r); err != nil {
+		return errors.Wrap(err, "cannot write certdb file")
+	}
+	fs.records[r.Serial] = r
+	return nil
+}
+
+func (fs *FileStore) Get(serial uint64) (*Record, error) {
+	fs.RLock()
+	defer fs.RUnlock()
+	r, ok := fs.records[serial]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return r, nil
+}
+
+func (fs *FileStore) List(f Filter) ([]*Record, error) {
+	fs.RLock()
+	var records []*Record
+	for _, r := range fs.records {
+		if f.match(r) {
+			records = append(records, r)
+		}
+	}
+	fs.RUnlock()
+	return sortAndLimit(records, f.Limit), nil
+}
+
+func (fs *FileStore) Close() error {
+	fs.Lock()
+	defer fs.Unlock()
+	return fs.f.Close()
+}
@@ -0,0 +1,18 @@
+package certdb
+
+import (
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var Log *logrus.Entry = logging.GetLogger("certdb").WithField("pkg", "certdb")
+
+const (
+	TypeFile = "file"
+	TypeSQL  = "sql"
+)
+
+func init() {
+	config.SetDefault("certdb", Defaults)
+}
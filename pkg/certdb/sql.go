@@ -0,0 +1,250 @@
+package certdb
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/storage/sqlutil"
+	"github.com/pkg/errors"
+)
+
+const sqlSchema = `CREATE TABLE IF NOT EXISTS issued_certificates (
+	serial BIGINT PRIMARY KEY,
+	key_id TEXT NOT NULL,
+	cert_type TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	principals TEXT NOT NULL,
+	valid_after BIGINT NOT NULL,
+	valid_before BIGINT NOT NULL,
+	pubkey_fp TEXT NOT NULL,
+	ca_fp TEXT NOT NULL,
+	authenticators TEXT NOT NULL,
+	audit_id TEXT NOT NULL,
+	remote_address TEXT NOT NULL,
+	issued_at BIGINT NOT NULL,
+	certificate TEXT NOT NULL
+)`
+
+const sqlCounterSchema = `CREATE TABLE IF NOT EXISTS serial_counter (
+	id INTEGER PRIMARY KEY,
+	last_serial BIGINT NOT NULL
+)`
+
+const sqlColumns = `serial, key_id, cert_type, subject, principals, valid_after, valid_before,
+	pubkey_fp, ca_fp, authenticators, audit_id, remote_address, issued_at, certificate`
+
+// SQLStore stores records using database/sql with SQLite or PostgreSQL
+// dialect. Serials are stored as signed 64-bit integers
+type SQLStore struct {
+	db       *sql.DB
+	postgres bool
+}
+
+func NewSQLStore(driver, dsn string) (*SQLStore, error) {
+	db, err := sqlutil.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &SQLStore{
+		db:       db,
+		postgres: sqlutil.IsPostgres(driver),
+	}
+	for _, schema := range []string{sqlSchema, sqlCounterSchema} {
+		if _, err := db.Exec(schema); err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "cannot create schema")
+		}
+	}
+	return s, nil
+}
+
+func (s *SQLStore) query(q string) string {
+	return sqlutil.Rebind(s.postgres, q)
+}
+
+func (s *SQLStore) Put(r *Record) error {
+	principals, _ := json.Marshal(r.Principals)
+	authenticators, _ := json.Marshal(r.Authenticators)
+	_, err := s.db.Exec(s.query(`INSERT INTO issued_certificates (`+sqlColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (serial) DO UPDATE SET
+			key_id = excluded.key_id,
+			cert_type = excluded.cert_type,
+			subject = excluded.subject,
+			principals = excluded.principals,
+			valid_after = excluded.valid_after,
+			valid_before = excluded.valid_before,
+			pubkey_fp = excluded.pubkey_fp,
+			ca_fp = excluded.ca_fp,
+			authenticators = excluded.authenticators,
+			audit_id = excluded.audit_id,
+			remote_address = excluded.remote_address,
+			issued_at = excluded.issued_at,
+			certificate = excluded.certificate`),
+		int64(r.Serial),
+		r.KeyID,
+		r.Type,
+		r.Subject,
+		string(principals),
+		r.ValidAfter.Unix(),
+		r.ValidBefore.Unix(),
+		r.PublicKeyFingerprint,
+		r.CAFingerprint,
+		string(authenticators),
+		r.AuditID,
+		r.RemoteAddress,
+		r.IssuedAt.UnixNano(),
+		r.Certificate,
+	)
+	if err != nil {
+		return errors.Wrap(err, "cannot store certificate")
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRecord(row scanner) (*Record, error) {
+	var (
+		r                                         Record
+		serial, validAfter, validBefore, issuedAt int64
+		principals, authenticators                string
+	)
+	err := row.Scan(
+		&serial,
+		&r.KeyID,
+		&r.Type,
+		&r.Subject,
+		&principals,
+		&validAfter,
+		&validBefore,
+		&r.PublicKeyFingerprint,
+		&r.CAFingerprint,
+		&authenticators,
+		&r.AuditID,
+		&r.RemoteAddress,
+		&issuedAt,
+		&r.Certificate,
+	)
+	if err != nil {
+		return nil, err
+	}
+	r.Serial = uint64(serial)
+	r.ValidAfter = time.Unix(validAfter, 0).UTC()
+	r.ValidBefore = time.Unix(validBefore, 0).UTC()
+	r.IssuedAt = time.Unix(0, issuedAt).UTC()
+	json.Unmarshal([]byte(principals), &r.Principals)
+	json.Unmarshal([]byte(authenticators), &r.Authenticators)
+	return &r, nil
+}
+
+func (s *SQLStore) Get(serial uint64) (*Record, error) {
+	row := s.db.QueryRow(s.query(`SELECT `+sqlColumns+` FROM issued_certificates WHERE serial = ?`), int64(serial))
+	r, err := scanRecord(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query certificate")
+	}
+	return r, nil
+}
+
+func (s *SQLStore) List(f Filter) ([]*Record, error) {
+	var (
+		where []string
+		args  []interface{}
+	)
+	if f.Subject != "" {
+		where = append(where, "subject = ?")
+		args = append(args, f.Subject)
+	}
+	if f.KeyID != "" {
+		where = append(where, "key_id = ?")
+		args = append(args, f.KeyID)
+	}
+	if !f.ValidAt.IsZero() {
+		where = append(where, "valid_after <= ? AND valid_before > ?")
+		args = append(args, f.ValidAt.Unix(), f.ValidAt.Unix())
+	}
+	if !f.IssuedAfter.IsZero() {
+		where = append(where, "issued_at >= ?")
+		args = append(args, f.IssuedAfter.UnixNano())
+	}
+	if !f.IssuedBefore.IsZero() {
+		where = append(where, "issued_at < ?")
+		args = append(args, f.IssuedBefore.UnixNano())
+	}
+	if !f.ExpiresAfter.IsZero() {
+		where = append(where, "valid_before >= ?")
+		args = append(args, f.ExpiresAfter.Unix())
+	}
+	if !f.ExpiresBefore.IsZero() {
+		where = append(where, "valid_before < ?")
+		args = append(args, f.ExpiresBefore.Unix())
+	}
+	q := `SELECT ` + sqlColumns + ` FROM issued_certificates`
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY issued_at DESC"
+	// Principals are matched after the query
+	if f.Limit > 0 && f.Principal == "" {
+		q += fmt.Sprintf(" LIMIT %d", f.Limit)
+	}
+	rows, err := s.db.Query(s.query(q), args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot query certificates")
+	}
+	defer rows.Close()
+	var records []*Record
+	for rows.Next() {
+		r, err := scanRecord(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot query certificates")
+		}
+		if f.match(r) {
+			records = append(records, r)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "cannot query certificates")
+	}
+	return sortAndLimit(records, f.Limit), nil
+}
+
+// Allocate the next certificate serial from a counter stored in the
+// database. Safe to use from multiple instances sharing the database
+func (s *SQLStore) NextSerial() (uint64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot allocate serial")
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(s.query(`UPDATE serial_counter SET last_serial = last_serial + 1 WHERE id = 1`))
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot allocate serial")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := tx.Exec(s.query(`INSERT INTO serial_counter (id, last_serial) VALUES (1, 1)`)); err != nil {
+			return 0, errors.Wrap(err, "cannot allocate serial")
+		}
+	}
+	var last int64
+	if err := tx.QueryRow(s.query(`SELECT last_serial FROM serial_counter WHERE id = 1`)).Scan(&last); err != nil {
+		return 0, errors.Wrap(err, "cannot allocate serial")
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "cannot allocate serial")
+	}
+	return uint64(last), nil
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
@@ -5,7 +5,11 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -43,6 +47,7 @@ const (
 	CredentialTypeUser     = "username"
 	CredentialTypePassword = "password"
 	CredentialTypePin      = "pin"
+	CredentialTypeResponse = "response"
 
 	CurrentApiVersion = "v1"
 
@@ -50,6 +55,7 @@ const (
 	AgentComment = "ssh-inscribe managed"
 
 	FederatedAuthenticatorPollInterval = 3
+	ApprovalPollInterval               = 5
 
 	DefaultGenerateKeypairSize = 2048
 )
@@ -66,6 +72,7 @@ type Client struct {
 	Config          *Config
 	rest            *resty.Client
 	restSRV         *resty.SRVRecord
+	grpc            *grpcTransport
 	agentClient     agent.Agent
 	agentConn       net.Conn
 	credentialInput func(name, realm, credentialType, def string) []byte
@@ -110,6 +117,181 @@ func (c *Client) GetCA() (ssh.PublicKey, error) {
 	return c.ca, nil
 }
 
+// Show the CA key rotation status
+func (c *Client) CARotationStatus() error {
+	if err := c.initAdmin(); err != nil {
+		return errors.Wrap(err, "could not get ca rotation status")
+	}
+	var result objects.CARotationStatus
+	res, err := c.newReq().
+		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
+		SetResult(&result).
+		Get(c.urlFor("admin/ca/rotation"))
+	if err != nil {
+		return errors.Wrap(err, "could not get ca rotation status")
+	}
+	if res.StatusCode() != http.StatusOK {
+		return errors.Errorf("could not get ca rotation status, got code %d and message: %s", res.StatusCode(), errorMessage(res))
+	}
+	fmt.Print("CA ROTATION:")
+	if result.Signing != nil {
+		fmt.Printf("\n%20s: %s", "Signing key", result.Signing.Fingerprint)
+	}
+	if result.Next != nil {
+		fmt.Printf("\n%20s: %s", "Next key", result.Next.Fingerprint)
+		fmt.Printf("\n%20s: %s", "Started by", result.StartedBy)
+	}
+	if result.Cutover != nil {
+		fmt.Printf("\n%20s: %s", "Cutover", result.Cutover.Local())
+	}
+	for _, k := range result.Retired {
+		fmt.Printf("\n%20s: %s at %s", "Retired key", k.Fingerprint, k.RetiredAt.Local())
+	}
+	fmt.Println()
+	return nil
+}
+
+// Start rotating the CA key. The next key is read from the CA key file or
+// generated on the server if the file is not set
+func (c *Client) StartCARotation() error {
+	if err := c.initAdmin(); err != nil {
+		return errors.Wrap(err, "could not start ca rotation")
+	}
+	var body objects.CARotationRequest
+	if c.Config.CAKeyFile != "" {
+		content, err := c.readCAKey()
+		if err != nil {
+			return err
+		}
+		body.PrivateKey = string(content)
+	}
+	if c.Config.CARotationCutover != 0 {
+		cutover := time.Now().Add(c.Config.CARotationCutover)
+		body.Cutover = &cutover
+	}
+	var result objects.CAKeyInfo
+	res, err := c.newReq().
+		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
+		SetBody(body).
+		SetResult(&result).
+		Post(c.urlFor("admin/ca/rotation"))
+	if err != nil {
+		return errors.Wrap(err, "could not start ca rotation")
+	}
+	if res.StatusCode() != http.StatusCreated {
+		return errors.Errorf("could not start ca rotation, got code %d and message: %s", res.StatusCode(), errorMessage(res))
+	}
+	if !c.Config.Quiet {
+		fmt.Fprintf(os.Stderr, "started ca rotation to %s\n", result.Fingerprint)
+	}
+	fmt.Println(result.PublicKey)
+	return nil
+}
+
+// Cancel a pending CA key rotation
+func (c *Client) CancelCARotation() error {
+	if err := c.initAdmin(); err != nil {
+		return errors.Wrap(err, "could not cancel ca rotation")
+	}
+	res, err := c.newReq().
+		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
+		Delete(c.urlFor("admin/ca/rotation"))
+	if err != nil {
+		return errors.Wrap(err, "could not cancel ca rotation")
+	}
+	if res.StatusCode() != http.StatusNoContent {
+		return errors.Errorf("could not cancel ca rotation, got code %d and message: %s", res.StatusCode(), errorMessage(res))
+	}
+	return nil
+}
+
+// Retire the previous CA key after the rotation cutover
+func (c *Client) RetireCAKey() error {
+	if err := c.initAdmin(); err != nil {
+		return errors.Wrap(err, "could not retire ca key")
+	}
+	var result objects.CAKeyInfo
+	res, err := c.newReq().
+		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
+		SetResult(&result).
+		Post(c.urlFor("admin/ca/rotation/retire"))
+	if err != nil {
+		return errors.Wrap(err, "could not retire ca key")
+	}
+	if res.StatusCode() != http.StatusOK {
+		return errors.Errorf("could not retire ca key, got code %d and message: %s", res.StatusCode(), errorMessage(res))
+	}
+	if !c.Config.Quiet {
+		fmt.Fprintf(os.Stderr, "retired ca key %s\n", result.Fingerprint)
+	}
+	return nil
+}
+
+// List approval requests. Approvers see all requests, other users their own
+func (c *Client) ListApprovals(status string) error {
+	if err := c.initAdmin(); err != nil {
+		return errors.Wrap(err, "could not list approval requests")
+	}
+	var result []objects.ApprovalRequest
+	req := c.newReq().
+		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
+		SetResult(&result)
+	if status != "" {
+		req.SetQueryParam("status", status)
+	}
+	res, err := req.Get(c.urlFor("approvals"))
+	if err != nil {
+		return errors.Wrap(err, "could not list approval requests")
+	}
+	if res.StatusCode() != http.StatusOK {
+		return errors.Errorf("could not list approval requests, got code %d and message: %s", res.StatusCode(), errorMessage(res))
+	}
+	for _, r := range result {
+		fmt.Printf("%s  %-8s  %-20s  %s  %s  %s\n", r.ID, r.Status, r.Requester,
+			strings.Join(r.SensitivePrincipals, ","), r.ValidBefore.Sub(r.CreatedAt).Round(time.Minute),
+			r.Expires.Local().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Approve or deny a pending approval request
+func (c *Client) DecideApproval(id string, approve bool) error {
+	action := "deny"
+	if approve {
+		action = "approve"
+	}
+	if err := c.initAdmin(); err != nil {
+		return errors.Wrapf(err, "could not %s approval request", action)
+	}
+	var result objects.ApprovalRequest
+	res, err := c.newReq().
+		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
+		SetBody(objects.ApprovalDecision{Comment: c.Config.ApprovalComment}).
+		SetResult(&result).
+		Post(c.urlFor("approvals/" + id + "/" + action))
+	if err != nil {
+		return errors.Wrapf(err, "could not %s approval request", action)
+	}
+	if res.StatusCode() != http.StatusOK {
+		return errors.Errorf("could not %s approval request, got code %d and message: %s", action, res.StatusCode(), errorMessage(res))
+	}
+	if !c.Config.Quiet {
+		fmt.Fprintf(os.Stderr, "%s %s for %s: %s\n", result.Status, result.ID, result.Requester,
+			strings.Join(result.Principals, ","))
+	}
+	return nil
+}
+
+func (c *Client) initAdmin() error {
+	if err := c.initREST(); err != nil {
+		return err
+	}
+	if err := c.checkVersion(); err != nil {
+		return err
+	}
+	return c.authenticate()
+}
+
 func (c *Client) GetServerVersion() (semver.Version, error) {
 	if err := c.initREST(); err != nil {
 		return semver.Version{}, errors.Wrap(err, "could not get server version")
@@ -151,6 +333,237 @@ func (c *Client) Logout() error {
 	return nil
 }
 
+// Revoke the current certificate from the agent or the identity file and
+// remove it from the agent
+func (c *Client) Revoke() error {
+	if err := c.initREST(); err != nil {
+		return errors.Wrap(err, "could not revoke")
+	}
+	if err := c.checkVersion(); err != nil {
+		return errors.Wrap(err, "could not revoke")
+	}
+	if err := c.discoverCA(); err != nil {
+		return errors.Wrap(err, "could not revoke")
+	}
+	if c.Config.UseAgent {
+		if err := c.connectAgent(); err != nil {
+			return errors.Wrap(err, "could not revoke")
+		}
+		if err := c.discoverCertFromAgent(); err != nil {
+			return errors.Wrap(err, "could not revoke")
+		}
+	}
+	if c.userCert == nil && c.Config.IdentityFile != "" {
+		if err := c.discoverIdentityFile(); err != nil {
+			return errors.Wrap(err, "could not revoke")
+		}
+	}
+	if c.userCert == nil {
+		return errors.New("could not revoke. No valid certificate found")
+	}
+	if err := c.authenticate(); err != nil {
+		return errors.Wrap(err, "could not revoke")
+	}
+	if err := c.revoke(); err != nil {
+		return errors.Wrap(err, "could not revoke")
+	}
+	if c.Config.UseAgent {
+		if err := c.deleteCertsFromAgent(); err != nil {
+			return errors.Wrap(err, "could not remove revoked certificate from the agent")
+		}
+	}
+	return nil
+}
+
+// Enroll the authenticated user to the auth backend, e.g. to get a TOTP
+// seed. Authentication uses the login endpoints
+func (c *Client) Enroll(authName string) (*objects.EnrollResult, error) {
+	if err := c.initREST(); err != nil {
+		return nil, errors.Wrap(err, "could not enroll")
+	}
+	if err := c.checkVersion(); err != nil {
+		return nil, errors.Wrap(err, "could not enroll")
+	}
+	if err := c.authenticate(); err != nil {
+		return nil, errors.Wrap(err, "could not enroll")
+	}
+	log := Log.WithField("action", "enroll").WithField("authenticator", authName)
+	log.Debug("enrolling")
+	var result objects.EnrollResult
+	res, err := c.newReq().
+		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
+		SetResult(&result).
+		Post(c.urlFor("auth/" + url.PathEscape(authName) + "/enroll"))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not enroll")
+	}
+	if res.StatusCode() != http.StatusOK {
+		return nil, errors.Errorf("could not enroll, got code %d and message: %s", res.StatusCode(), errorMessage(res))
+	}
+	log.Debug("enrolled")
+	return &result, nil
+}
+
+// Request a host certificate for the host public key. The certificate is
+// written next to the key if WriteCert is set and printed otherwise
+func (c *Client) SignHost() error {
+	// With a bootstrap token the hostnames default to the ones in the token
+	if len(c.Config.Hostnames) == 0 && c.Config.BootstrapToken == "" {
+		return errors.New("no hostnames specified")
+	}
+	if err := c.initREST(); err != nil {
+		return errors.Wrap(err, "could not sign host key")
+	}
+	if err := c.checkVersion(); err != nil {
+		return errors.Wrap(err, "could not sign host key")
+	}
+	content, err := ioutil.ReadFile(c.Config.HostKeyFile)
+	if err != nil {
+		return errors.Wrap(err, "could not read host key")
+	}
+	if c.Config.BootstrapToken == "" {
+		if err := c.authenticate(); err != nil {
+			return errors.Wrap(err, "could not sign host key")
+		}
+	}
+	cert, err := c.signHost(content)
+	if err != nil {
+		return errors.Wrap(err, "could not sign host key")
+	}
+	if !c.Config.WriteCert {
+		fmt.Printf("%s", ssh.MarshalAuthorizedKey(cert))
+		return nil
+	}
+	certFile := strings.TrimSuffix(c.Config.HostKeyFile, ".pub") + "-cert.pub"
+	if err := ioutil.WriteFile(certFile, ssh.MarshalAuthorizedKey(cert), 0644); err != nil {
+		return errors.Wrap(err, "could not write host certificate")
+	}
+	if !c.Config.Quiet {
+		fmt.Printf("host certificate written to %s\n", certFile)
+	}
+	return nil
+}
+
+// Mint a bootstrap token for unattended host enrollment and print it.
+// Requires admin privileges on the server
+func (c *Client) CreateBootstrapToken() error {
+	if len(c.Config.Hostnames) == 0 {
+		return errors.New("no hostnames specified")
+	}
+	if err := c.initREST(); err != nil {
+		return errors.Wrap(err, "could not create bootstrap token")
+	}
+	if err := c.checkVersion(); err != nil {
+		return errors.Wrap(err, "could not create bootstrap token")
+	}
+	if err := c.authenticate(); err != nil {
+		return errors.Wrap(err, "could not create bootstrap token")
+	}
+	body := objects.BootstrapTokenRequest{
+		Hostnames: c.Config.Hostnames,
+		Uses:      c.Config.BootstrapTokenUses,
+	}
+	if c.Config.BootstrapTokenTTL != 0 {
+		body.TTL = c.Config.BootstrapTokenTTL.String()
+	}
+	var result objects.BootstrapTokenResponse
+	res, err := c.newReq().
+		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
+		SetBody(body).
+		SetResult(&result).
+		Post(c.urlFor("admin/bootstrap_tokens"))
+	if err != nil {
+		return errors.Wrap(err, "could not create bootstrap token")
+	}
+	if res.StatusCode() != http.StatusCreated {
+		return errors.Errorf("could not create bootstrap token, got code %d and message: %s", res.StatusCode(), errorMessage(res))
+	}
+	if !c.Config.Quiet {
+		fmt.Fprintf(os.Stderr, "bootstrap token %s for %s valid until %s for %d use(s)\n",
+			result.ID, strings.Join(result.Hostnames, ","), result.Expires.Local().Format(time.RFC3339), result.Uses)
+	}
+	fmt.Println(result.Token)
+	return nil
+}
+
+// Authenticate and print what the resulting token entitles to
+func (c *Client) Status() error {
+	if err := c.initREST(); err != nil {
+		return errors.Wrap(err, "could not get status")
+	}
+	if err := c.checkVersion(); err != nil {
+		return errors.Wrap(err, "could not get status")
+	}
+	backends, err := c.discoverAuthenticators()
+	if err != nil {
+		return errors.Wrap(err, "could not get status")
+	}
+	if err := c.authenticate(); err != nil {
+		// Tell whether the login failed because of a backend being down
+		printBackendHealth(os.Stderr, backends)
+		return errors.Wrap(err, "could not get status")
+	}
+	result, err := c.introspect()
+	if err != nil {
+		return errors.Wrap(err, "could not get status")
+	}
+	fmt.Print("TOKEN DETAILS:")
+	fmt.Printf("\n%20s: %s", "Subject", result.Subject)
+	fmt.Printf("\n%20s: %s", "Backends", strings.Join(result.Backends, ", "))
+	if result.Expires != nil {
+		fmt.Printf("\n%20s: %s", "Token expires", result.Expires.Local())
+	}
+	if result.Policy != "" {
+		fmt.Printf("\n%20s: %s", "Policy", result.Policy)
+	}
+	fmt.Printf("\n%20s: %s", "Max cert lifetime", result.MaxCertLifetime)
+	fmt.Printf("\n%20s:", "Principals")
+	for _, p := range result.Principals {
+		fmt.Printf("\n%20s  %s", " ", p)
+	}
+	fmt.Println()
+	printBackendHealth(os.Stdout, backends)
+	return nil
+}
+
+// Print the health of the backends, nothing if the server does not check it
+func printBackendHealth(w io.Writer, backends []objects.DiscoverResult) {
+	checked := false
+	for _, b := range backends {
+		checked = checked || b.Health != ""
+	}
+	if !checked {
+		return
+	}
+	fmt.Fprint(w, "AUTH BACKENDS:")
+	for _, b := range backends {
+		health := b.Health
+		if health == "" {
+			health = "not checked"
+		}
+		fmt.Fprintf(w, "\n%20s: %s", b.AuthenticatorName, health)
+	}
+	fmt.Fprintln(w)
+}
+
+func (c *Client) introspect() (*objects.IntrospectResponse, error) {
+	var result objects.IntrospectResponse
+	res, err := c.newReq().
+		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
+		SetResult(&result).
+		Post(c.urlFor("introspect"))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode() != http.StatusOK {
+		return nil, errors.Errorf("introspection failed, got code %d and message: %s", res.StatusCode(), errorMessage(res))
+	}
+	if !result.Active {
+		return nil, errors.New("token is not active")
+	}
+	return &result, nil
+}
+
 func (c *Client) Login() error {
 	if err := c.initREST(); err != nil {
 		return errors.Wrap(err, "could not login")
@@ -216,17 +629,15 @@ func (c *Client) Login() error {
 	return nil
 }
 
-// Add CA key to server from file
-func (c *Client) addCAKey() error {
-	log := Log.WithField("action", "addCAKey")
-	log.Debug("reading ca key file")
+// Read and decrypt the CA key file for sending to the server
+func (c *Client) readCAKey() ([]byte, error) {
 	content, err := ioutil.ReadFile(c.Config.CAKeyFile)
 	if err != nil {
-		return errors.Wrap(err, "could not open ca key file")
+		return nil, errors.Wrap(err, "could not open ca key file")
 	}
 	key, err := c.parsePrivateKey(content, "CA private key")
 	if err != nil {
-		return errors.Wrap(err, "could not parse ca key")
+		return nil, errors.Wrap(err, "could not parse ca key")
 	}
 	opts := &sshkeys.MarshalOptions{}
 	switch key.(type) {
@@ -237,18 +648,32 @@ func (c *Client) addCAKey() error {
 	}
 	content, err = sshkeys.Marshal(key, opts)
 	if err != nil {
-		return errors.Wrap(err, "could not marshal ca key")
+		return nil, errors.Wrap(err, "could not marshal ca key")
+	}
+	return content, nil
+}
+
+// Add CA key to server from file
+func (c *Client) addCAKey() error {
+	log := Log.WithField("action", "addCAKey")
+	log.Debug("reading ca key file")
+	content, err := c.readCAKey()
+	if err != nil {
+		return err
 	}
 	log.Debug("sending ca key to the server")
-	res, err := c.newReq().
+	req := c.newReq().
 		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
-		SetBody(content).
-		Post(c.urlFor("ca"))
+		SetBody(content)
+	if c.Config.CA != "" {
+		req.SetQueryParam("ca", c.Config.CA)
+	}
+	res, err := req.Post(c.urlFor("ca"))
 	if err != nil {
 		return errors.Wrap(err, "could not send key")
 	}
 	if res.StatusCode() != http.StatusAccepted {
-		return errors.Errorf("could not send key, got code %d and message: %s", res.StatusCode(), res.Body())
+		return errors.Errorf("could not send key, got code %d and message: %s", res.StatusCode(), errorMessage(res))
 	}
 	log.Debug("sent ca key to the server")
 	return nil
@@ -457,9 +882,10 @@ func (c *Client) sign() error {
 		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
 		SetBody(ssh.MarshalAuthorizedKey(signer.PublicKey()))
 
+	var expires time.Time
 	if c.Config.CertLifetime != 0 {
-		expires := time.Now().Add(c.Config.CertLifetime).Format(time.RFC3339)
-		req.SetQueryParam("expires", expires)
+		expires = time.Now().Add(c.Config.CertLifetime)
+		req.SetQueryParam("expires", expires.Format(time.RFC3339))
 	}
 	if c.Config.IncludePrincipals != "" {
 		req.SetQueryParam("include_principals", c.Config.IncludePrincipals)
@@ -467,13 +893,39 @@ func (c *Client) sign() error {
 	if c.Config.ExcludePrincipals != "" {
 		req.SetQueryParam("exclude_principals", c.Config.ExcludePrincipals)
 	}
+	if c.Config.CA != "" {
+		req.SetQueryParam("ca", c.Config.CA)
+	}
 
 	res, err := req.Post(c.urlFor("sign"))
 	if err != nil {
 		return errors.Wrap(err, "could not sign")
 	}
+	// Long-lived or sensitive certificates requiring an additional login
+	if backends := stepUpBackends(res); len(backends) > 0 {
+		if err := c.stepUp(backends); err != nil {
+			return err
+		}
+		req.SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken))
+		if res, err = req.Post(c.urlFor("sign")); err != nil {
+			return errors.Wrap(err, "could not sign")
+		}
+	}
+	// Principals requiring approval from another user
+	if res.StatusCode() == http.StatusAccepted {
+		r, err := c.waitForApproval(res.Body())
+		if err != nil {
+			return err
+		}
+		// Approvals do not cover certificates expiring later than requested
+		req.SetQueryParam("approval", r.ID)
+		req.SetQueryParam("expires", r.ValidBefore.Format(time.RFC3339))
+		if res, err = req.Post(c.urlFor("sign")); err != nil {
+			return errors.Wrap(err, "could not sign")
+		}
+	}
 	if res.StatusCode() != http.StatusOK {
-		return errors.Errorf("could not sign got code %d and message: %s", res.StatusCode(), res.Body())
+		return errors.Errorf("could not sign got code %d and message: %s", res.StatusCode(), errorMessage(res))
 	}
 
 	key, _, _, _, err := ssh.ParseAuthorizedKey(res.Body())
@@ -485,10 +937,322 @@ func (c *Client) sign() error {
 		return errors.Errorf("could not parse certificate. Unknown type %T", key)
 	}
 	log.WithField("keyid", cert.KeyId).Debug("certificate received")
+	// The server may clamp the lifetime to the maximum allowed for the user
+	if !expires.IsZero() && int64(cert.ValidBefore) < expires.Unix() && !c.Config.Quiet {
+		fmt.Fprintf(os.Stderr, "WARNING: certificate lifetime was limited by the server, expires %s\n",
+			time.Unix(int64(cert.ValidBefore), 0).Format(time.RFC3339))
+	}
 	c.userCert = cert
 	return nil
 }
 
+// Log in also with one of the backends the server asked for, preferring the
+// ones given with --login
+func (c *Client) stepUp(backends []string) error {
+	discoverResult, err := c.discoverAuthenticators()
+	if err != nil {
+		return err
+	}
+	available := map[string]objects.DiscoverResult{}
+	for _, au := range discoverResult {
+		available[au.AuthenticatorName] = au
+	}
+	var candidates []string
+	for _, v := range c.Config.LoginAuthEndpoints {
+		for _, b := range backends {
+			if v == b {
+				candidates = append(candidates, b)
+			}
+		}
+	}
+	candidates = append(candidates, backends...)
+	for _, name := range candidates {
+		au, ok := available[name]
+		if !ok {
+			continue
+		}
+		if !c.Config.Quiet {
+			fmt.Fprintf(os.Stderr, "Certificate requires step-up authentication with %s\n", name)
+		}
+		return c.authenticateWith(au)
+	}
+	return errors.Errorf("certificate requires step-up authentication with %s, which the server does not allow for this client",
+		strings.Join(backends, " or "))
+}
+
+// Backends the server asks to step up with, nil if the response is not
+// about a step-up
+func stepUpBackends(res *resty.Response) []string {
+	if res.StatusCode() != http.StatusForbidden || !strings.HasPrefix(res.Header().Get("Content-Type"), objects.MIMEProblemJSON) {
+		return nil
+	}
+	var p objects.Problem
+	if err := json.Unmarshal(res.Body(), &p); err != nil || p.Code != objects.ErrorStepUpRequired {
+		return nil
+	}
+	return p.StepUpBackends
+}
+
+// Poll the approval request until it is decided on or expires. Returns the
+// request to sign with once approved
+func (c *Client) waitForApproval(body []byte) (*objects.ApprovalRequest, error) {
+	var r objects.ApprovalRequest
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, errors.Wrap(err, "could not parse approval request")
+	}
+	log := Log.WithField("action", "waitForApproval").WithField("id", r.ID)
+	if !c.Config.Quiet {
+		fmt.Fprintf(os.Stderr, "principals %s require approval, waiting for request %s to be approved\n",
+			strings.Join(r.SensitivePrincipals, ","), r.ID)
+	}
+	for r.Status == objects.ApprovalPending {
+		if time.Now().After(r.Expires) {
+			return nil, errors.Errorf("approval request %s expired", r.ID)
+		}
+		time.Sleep(ApprovalPollInterval * time.Second)
+		log.Debug("polling approval request")
+		res, err := c.newReq().
+			SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
+			SetResult(&r).
+			Get(c.urlFor("approvals/" + r.ID))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not get approval request")
+		}
+		if res.StatusCode() != http.StatusOK {
+			return nil, errors.Errorf("could not get approval request, got code %d and message: %s", res.StatusCode(), errorMessage(res))
+		}
+	}
+	if r.Status != objects.ApprovalApproved {
+		msg := fmt.Sprintf("approval request %s was %s by %s", r.ID, r.Status, r.DecidedBy)
+		if r.Comment != "" {
+			msg += ": " + r.Comment
+		}
+		return nil, errors.New(msg)
+	}
+	if !c.Config.Quiet {
+		fmt.Fprintf(os.Stderr, "request %s approved by %s\n", r.ID, r.DecidedBy)
+	}
+	return &r, nil
+}
+
+func (c *Client) signHost(pubKey []byte) (*ssh.Certificate, error) {
+	log := Log.WithField("action", "signHost").WithField("hostnames", c.Config.Hostnames)
+	log.Debug("requesting host certificate")
+	req := c.newReq().SetBody(pubKey)
+	if len(c.Config.Hostnames) > 0 {
+		req.SetQueryParam("hostnames", strings.Join(c.Config.Hostnames, ","))
+	}
+	if c.Config.CertLifetime != 0 {
+		expires := time.Now().Add(c.Config.CertLifetime).Format(time.RFC3339)
+		req.SetQueryParam("expires", expires)
+	}
+	if c.Config.CA != "" {
+		req.SetQueryParam("ca", c.Config.CA)
+	}
+	endpoint := "host/sign"
+	if c.Config.BootstrapToken != "" {
+		endpoint = "host/bootstrap"
+		req.SetHeader("X-Bootstrap-Token", c.Config.BootstrapToken)
+	} else {
+		req.SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken))
+	}
+	res, err := req.Post(c.urlFor(endpoint))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not sign")
+	}
+	if res.StatusCode() != http.StatusOK {
+		return nil, errors.Errorf("could not sign got code %d and message: %s", res.StatusCode(), errorMessage(res))
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(res.Body())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse certificate")
+	}
+	cert, _ := key.(*ssh.Certificate)
+	if cert == nil {
+		return nil, errors.Errorf("could not parse certificate. Unknown type %T", key)
+	}
+	log.WithField("keyid", cert.KeyId).Debug("host certificate received")
+	return cert, nil
+}
+
+func (c *Client) revoke() error {
+	log := Log.WithField("action", "revoke").WithField("keyid", c.userCert.KeyId)
+	log.Debug("revoking certificate")
+	req := c.newReq().
+		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken)).
+		SetBody(ssh.MarshalAuthorizedKey(c.userCert))
+	if c.Config.RevokeReason != "" {
+		req.SetQueryParam("reason", c.Config.RevokeReason)
+	}
+	res, err := req.Post(c.urlFor("revoke"))
+	if err != nil {
+		return errors.Wrap(err, "could not revoke")
+	}
+	if res.StatusCode() != http.StatusNoContent {
+		return errors.Errorf("could not revoke, got code %d and message: %s", res.StatusCode(), errorMessage(res))
+	}
+	log.Debug("certificate revoked")
+	return nil
+}
+
+// Authenticate with the Kerberos ticket of the user
+func (c *Client) authenticateNegotiate(authName string) error {
+	log := Log.WithField("action", "authenticateNegotiate").WithField("authenticator", authName)
+	parsed, err := url.Parse(c.Config.URL)
+	if err != nil {
+		return errors.Wrap(err, "cannot parse server URL")
+	}
+	token, principal, err := negotiateToken(parsed.Hostname())
+	if err != nil {
+		return err
+	}
+	log.WithField("principal", principal).Debug("authenticating")
+	req := c.newReq().SetHeader("Authorization", "Negotiate "+base64.StdEncoding.EncodeToString(token))
+	if c.signerToken != nil {
+		req.SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken))
+	}
+	res, err := req.Post(c.urlFor("auth/" + authName))
+	if err != nil {
+		return errors.Wrap(err, "could not authenticate")
+	}
+	if res.StatusCode() != http.StatusOK {
+		return authFailed(res)
+	}
+	c.signerToken = res.Body()
+	log.Debug("authentication successful")
+	return nil
+}
+
+// The server takes the identity from the TLS client certificate
+func (c *Client) authenticateClientCert(authName string) error {
+	log := Log.WithField("action", "authenticateClientCert").WithField("authenticator", authName)
+	if c.Config.ClientCertFile == "" {
+		return errors.New("no client certificate configured")
+	}
+	req := c.newReq()
+	if c.signerToken != nil {
+		req.SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken))
+	}
+	res, err := req.Post(c.urlFor("auth/" + authName))
+	if err != nil {
+		return errors.Wrap(err, "could not authenticate")
+	}
+	if res.StatusCode() != http.StatusOK {
+		return authFailed(res)
+	}
+	c.signerToken = res.Body()
+	log.Debug("authentication successful")
+	return nil
+}
+
+// Exchange the token in the token file, e.g. a workload identity token
+func (c *Client) authenticateBearerToken(authName string) error {
+	log := Log.WithField("action", "authenticateBearerToken").WithField("authenticator", authName)
+	if c.Config.TokenFile == "" {
+		return errors.New("no token file configured")
+	}
+	token, err := ioutil.ReadFile(c.Config.TokenFile)
+	if err != nil {
+		return errors.Wrap(err, "cannot read token file")
+	}
+	req := c.newReq().SetHeader("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	if c.signerToken != nil {
+		req.SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken))
+	}
+	res, err := req.Post(c.urlFor("auth/" + authName))
+	if err != nil {
+		return errors.Wrap(err, "could not authenticate")
+	}
+	if res.StatusCode() != http.StatusOK {
+		return authFailed(res)
+	}
+	c.signerToken = res.Body()
+	log.Debug("authentication successful")
+	return nil
+}
+
+// Log in by signing the challenge of the server with the keys in the agent
+func (c *Client) authenticateSSHKey(authName, authRealm string) error {
+	log := Log.WithField("action", "authenticateSSHKey").WithField("authenticator", authName)
+	if c.agentClient == nil {
+		if err := c.connectAgent(); err != nil {
+			return err
+		}
+	}
+	userName := string(c.getCredential(authName, authRealm, CredentialTypeUser, getCurrentUsername()))
+	req := c.newReq().SetBasicAuth(userName, "")
+	if c.signerToken != nil {
+		req.SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken))
+	}
+	res, err := req.Post(c.urlFor("auth/" + authName))
+	if err != nil {
+		return errors.Wrap(err, "could not authenticate")
+	}
+	challenge := res.Header().Get(objects.AuthChallengeHeader)
+	if res.StatusCode() != http.StatusAccepted || challenge == "" {
+		return authFailed(res)
+	}
+	response, err := c.signChallenge(challenge)
+	if err != nil {
+		return errors.Wrap(err, "could not authenticate")
+	}
+	res, err = c.newReq().
+		SetBasicAuth(userName, response).
+		SetHeader("X-Auth", fmt.Sprintf("Bearer %s", res.Body())).
+		Post(c.urlFor("auth/" + authName))
+	if err != nil {
+		return errors.Wrap(err, "could not authenticate")
+	}
+	if res.StatusCode() != http.StatusOK {
+		return authFailed(res)
+	}
+	c.signerToken = res.Body()
+	log.Debug("authentication successful")
+	return nil
+}
+
+// Signatures of the challenge with the keys in the agent, a line for each
+// with the public key and the signature in base64 encoded wire format.
+// Certificates are skipped as the server knows only the plain keys
+func (c *Client) signChallenge(challenge string) (string, error) {
+	const maxSignatures = 16
+	keys, err := c.agentClient.List()
+	if err != nil {
+		return "", errors.Wrap(err, "could not list agent keys")
+	}
+	data := auth.SSHKeySignedData(challenge)
+	var lines []string
+	for _, k := range keys {
+		if len(lines) == maxSignatures {
+			break
+		}
+		pub, err := ssh.ParsePublicKey(k.Blob)
+		if err != nil {
+			continue
+		}
+		if _, ok := pub.(*ssh.Certificate); ok {
+			continue
+		}
+		var sig *ssh.Signature
+		// SHA-1 signatures are refused
+		if ext, ok := c.agentClient.(agent.ExtendedAgent); ok && pub.Type() == ssh.KeyAlgoRSA {
+			sig, err = ext.SignWithFlags(pub, data, agent.SignatureFlagRsaSha512)
+		} else {
+			sig, err = c.agentClient.Sign(pub, data)
+		}
+		if err != nil {
+			Log.WithError(err).WithField("key", k.Comment).Debug("could not sign with the key")
+			continue
+		}
+		lines = append(lines, base64.StdEncoding.EncodeToString(pub.Marshal())+" "+
+			base64.StdEncoding.EncodeToString(ssh.Marshal(sig)))
+	}
+	if len(lines) == 0 {
+		return "", errors.New("no keys in the agent to sign the challenge with")
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
 func (c *Client) authenticateFederated(authName, authRealm string) error {
 	log := Log.WithField("action", "authenticateFederated").
 		WithField("authenticator", authName)
@@ -508,6 +1272,9 @@ func (c *Client) authenticateFederated(authName, authRealm string) error {
 			c.signerToken = res.Body()
 			if initial {
 				url := res.Header().Get("Location")
+				if code := res.Header().Get(objects.FederationUserCodeHeader); code != "" {
+					fmt.Printf("Enter the code %s to authenticate\n", code)
+				}
 				openFederatedAuthURL(url)
 			}
 			fmt.Printf("\rWaiting for authentication to complete for %q (%s) %s ",
@@ -521,8 +1288,8 @@ func (c *Client) authenticateFederated(authName, authRealm string) error {
 			c.signerToken = res.Body()
 			log.Debug("authentication successful")
 			return nil
-		case http.StatusUnauthorized:
-			return errors.New("authentication failed")
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+			return authFailed(res)
 		default:
 			return errors.Errorf("unknown federated auth response: %d", res.StatusCode())
 		}
@@ -573,7 +1340,7 @@ func (c *Client) authenticate() error {
 	case len(c.Config.LoginAuthEndpoints) > 0:
 		for _, v := range c.Config.LoginAuthEndpoints {
 			if au, ok := availableAuthenticators[v]; !ok {
-				return errors.Errorf("unknown auth endpoint name: %s", v)
+				return errors.Errorf("unknown auth endpoint name: %s, or the server does not allow it for this client", v)
 			} else {
 				finalAuthenticators = append(finalAuthenticators, au)
 			}
@@ -588,40 +1355,86 @@ func (c *Client) authenticate() error {
 	log.WithField("authenticator_list", finalAuthenticators).Debug("begin authentication")
 
 	for _, au := range finalAuthenticators {
-		var userName, secret string
-		switch au.AuthenticatorCredentialType {
-		case auth.CredentialUserPassword:
-			userName = string(c.getCredential(au.AuthenticatorName, au.AuthenticatorRealm, CredentialTypeUser, getCurrentUsername()))
-			secret = string(c.getCredential(au.AuthenticatorName, au.AuthenticatorRealm, CredentialTypePassword, ""))
-		case auth.CredentialPin:
-			secret = string(c.getCredential(au.AuthenticatorName, au.AuthenticatorRealm, CredentialTypePin, ""))
-		case auth.CredentialFederated:
-			if err := c.authenticateFederated(au.AuthenticatorName, au.AuthenticatorRealm); err != nil {
-				return err
-			}
-			continue
-		default:
-			return errors.Errorf("unknown credential type %s", au.AuthenticatorCredentialType)
-		}
-		log.WithField("authenticator", au.AuthenticatorName).Debug("authenticating")
-		// Send Credentials
-		req := c.newReq().SetBasicAuth(userName, secret)
-		if c.signerToken != nil {
-			req.SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken))
+		if err := c.authenticateWith(au); err != nil {
+			return err
 		}
-		res, err := req.Post(c.urlFor("auth/" + au.AuthenticatorName))
+	}
+	return nil
+}
+
+// Log in with the authenticator, chaining the login to the current token if
+// any
+func (c *Client) authenticateWith(au objects.DiscoverResult) error {
+	log := Log.WithField("action", "authenticate")
+	var userName, secret string
+	switch au.AuthenticatorCredentialType {
+	case auth.CredentialUserPassword:
+		userName = string(c.getCredential(au.AuthenticatorName, au.AuthenticatorRealm, CredentialTypeUser, getCurrentUsername()))
+		secret = string(c.getCredential(au.AuthenticatorName, au.AuthenticatorRealm, CredentialTypePassword, ""))
+	case auth.CredentialPin:
+		secret = string(c.getCredential(au.AuthenticatorName, au.AuthenticatorRealm, CredentialTypePin, ""))
+	case auth.CredentialFederated:
+		return c.authenticateFederated(au.AuthenticatorName, au.AuthenticatorRealm)
+	case auth.CredentialNegotiate:
+		return c.authenticateNegotiate(au.AuthenticatorName)
+	case auth.CredentialClientCert:
+		return c.authenticateClientCert(au.AuthenticatorName)
+	case auth.CredentialBearerToken:
+		return c.authenticateBearerToken(au.AuthenticatorName)
+	case auth.CredentialSSHKey:
+		return c.authenticateSSHKey(au.AuthenticatorName, au.AuthenticatorRealm)
+	default:
+		return errors.Errorf("unknown credential type %s", au.AuthenticatorCredentialType)
+	}
+	log.WithField("authenticator", au.AuthenticatorName).Debug("authenticating")
+	// Send Credentials
+	req := c.newReq().SetBasicAuth(userName, secret)
+	if c.signerToken != nil {
+		req.SetHeader("X-Auth", fmt.Sprintf("Bearer %s", c.signerToken))
+	}
+	res, err := req.Post(c.urlFor("auth/" + au.AuthenticatorName))
+	if err != nil {
+		return errors.Wrap(err, "could not authenticate")
+	}
+	// Challenge-response authenticators ask for more input
+	for res.StatusCode() == http.StatusAccepted && res.Header().Get(objects.AuthChallengeHeader) != "" {
+		fmt.Println(res.Header().Get(objects.AuthChallengeHeader))
+		response := c.getCredential(au.AuthenticatorName, au.AuthenticatorRealm, CredentialTypeResponse, "")
+		res, err = c.newReq().
+			SetBasicAuth(userName, string(response)).
+			SetHeader("X-Auth", fmt.Sprintf("Bearer %s", res.Body())).
+			Post(c.urlFor("auth/" + au.AuthenticatorName))
 		if err != nil {
 			return errors.Wrap(err, "could not authenticate")
 		}
-		if res.StatusCode() != http.StatusOK {
-			return errors.New("authentication failed")
-		}
-		c.signerToken = res.Body()
-		log.WithField("authenticator", au.AuthenticatorName).Debug("authentication successful")
 	}
+	if res.StatusCode() != http.StatusOK {
+		return authFailed(res)
+	}
+	c.signerToken = res.Body()
+	log.WithField("authenticator", au.AuthenticatorName).Debug("authentication successful")
+	c.warnPasswordExpiry(au.AuthenticatorName, res)
 	return nil
 }
 
+// Warn when the server tells the password expires soon
+func (c *Client) warnPasswordExpiry(authName string, res *resty.Response) {
+	expires, err := time.Parse(time.RFC3339, res.Header().Get(objects.PasswordExpiresHeader))
+	if err != nil || c.Config.Quiet {
+		return
+	}
+	left := time.Until(expires)
+	switch {
+	case left <= 0:
+		fmt.Fprintf(os.Stderr, "WARNING: password for %s has expired, change it now\n", authName)
+	case left < 24*time.Hour:
+		fmt.Fprintf(os.Stderr, "WARNING: password for %s expires in %s\n", authName, left.Round(time.Minute))
+	default:
+		fmt.Fprintf(os.Stderr, "WARNING: password for %s expires in %d days, on %s\n",
+			authName, int(left.Hours()/24), expires.Local().Format("2006-01-02 15:04"))
+	}
+}
+
 // Parse private key and decrypt it if necessary
 func (c *Client) parsePrivateKey(raw []byte, desc string) (interface{}, error) {
 	var (
@@ -697,12 +1510,16 @@ func (c *Client) discoverCA() error {
 		return nil
 	}
 	log.Debug("discovering ca")
-	res, err := c.newReq().Get(c.urlFor("ca"))
+	req := c.newReq()
+	if c.Config.CA != "" {
+		req.SetQueryParam("ca", c.Config.CA)
+	}
+	res, err := req.Get(c.urlFor("ca"))
 	if err != nil {
 		return errors.Wrap(err, "could not discover CA")
 	}
 	if res.StatusCode() != http.StatusOK {
-		return errors.Errorf("could not discover CA, got code %d and message: %s", res.StatusCode(), res.Body())
+		return errors.Errorf("could not discover CA, got code %d and message: %s", res.StatusCode(), errorMessage(res))
 	}
 	key, _, _, _, err := ssh.ParseAuthorizedKey(res.Body())
 	if err != nil {
@@ -861,7 +1678,7 @@ func (c *Client) checkReady() error {
 		return errors.Wrap(err, "could not check readiness")
 	}
 	if res.StatusCode() != http.StatusNoContent {
-		return errors.Errorf("got code %d and message: %s", res.StatusCode(), res.Body())
+		return errors.Errorf("got code %d and message: %s", res.StatusCode(), errorMessage(res))
 	}
 	return nil
 }
@@ -887,19 +1704,53 @@ func (c *Client) initREST() error {
 		SetLogger(ioutil.Discard).
 		SetRedirectPolicy(&ignoreRedirects{})
 
-	if parsed.Scheme == "https" {
+	switch parsed.Scheme {
+	case "https":
 		rest.SetScheme("https")
-		rest.SetTLSClientConfig(&tls.Config{
-			ServerName:         parsed.Hostname(),
-			InsecureSkipVerify: c.Config.Insecure,
-		})
-	} else {
+		tc, err := c.tlsConfig(parsed)
+		if err != nil {
+			return err
+		}
+		rest.SetTLSClientConfig(tc)
+	case SchemeGRPC, SchemeGRPCS:
+		// The requests are made over the gRPC API by the transport
+		var tc *tls.Config
+		if parsed.Scheme == SchemeGRPCS {
+			if tc, err = c.tlsConfig(parsed); err != nil {
+				return err
+			}
+		} else {
+			log.Warn("You should really not use unencrypted connection")
+		}
+		t, err := newGRPCTransport(parsed.Host, tc)
+		if err != nil {
+			return err
+		}
+		if c.grpc != nil {
+			c.grpc.Close()
+		}
+		c.grpc = t
+		rest.SetTransport(t).
+			SetScheme("http").
+			SetHostURL((&url.URL{Scheme: "http", Host: parsed.Host, Path: parsed.Path}).String())
+	default:
 		rest.SetScheme("http")
 		log.Warn("You should really not use unencrypted connection")
 	}
 
 	rest.Header.Set("User-Agent", globals.ClientUserAgent)
 	rest.Header.Set("X-Version", globals.Version().String())
+	if c.Config.CorrelationID == "" {
+		c.Config.CorrelationID = hex.EncodeToString(util.RandBytes(16))
+	}
+	rest.Header.Set(objects.CorrelationIDHeader, c.Config.CorrelationID)
+	log.WithField("correlation_id", c.Config.CorrelationID).Debug("using correlation id")
+	if c.Config.Audience != "" {
+		rest.Header.Set(objects.AudienceHeader, c.Config.Audience)
+	}
+	if c.Config.Realm != "" {
+		rest.Header.Set(objects.RealmHeader, c.Config.Realm)
+	}
 	if c.Config.Debug {
 		rest.SetDebug(true).
 			SetLogger(os.Stderr)
@@ -908,6 +1759,9 @@ func (c *Client) initREST() error {
 
 	// Let's not use Resty's SRV mechanism as we need to be connected to the same server for
 	// the duration of the session to make federated auth work.
+	if parsed.Scheme == SchemeGRPC || parsed.Scheme == SchemeGRPCS {
+		return nil
+	}
 	if name, addrs, err := net.LookupSRV(parsed.Scheme, "tcp", parsed.Hostname()); err == nil {
 		log.WithField("SRV", name).Debug("discovering with SRV records")
 		for _, addr := range addrs {
@@ -925,6 +1779,26 @@ func (c *Client) initREST() error {
 	return nil
 }
 
+// TLS configuration for the server with the client certificate if any
+func (c *Client) tlsConfig(server *url.URL) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         server.Hostname(),
+		InsecureSkipVerify: c.Config.Insecure,
+	}
+	if c.Config.ClientCertFile != "" {
+		keyFile := c.Config.ClientKeyFile
+		if keyFile == "" {
+			keyFile = c.Config.ClientCertFile
+		}
+		cert, err := tls.LoadX509KeyPair(c.Config.ClientCertFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot load client certificate")
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
 func (c *Client) printCertificate() {
 	validFrom := time.Unix(int64(c.userCert.ValidAfter), 0)
 	validTo := time.Unix(int64(c.userCert.ValidBefore), 0)
@@ -956,6 +1830,33 @@ func (c *Client) printCertificate() {
 	fmt.Println()
 }
 
+// Tell why the login was refused, like a locked out user or a backend being
+// down. Wrong credentials are not detailed
+func authFailed(res *resty.Response) error {
+	if res.StatusCode() == http.StatusUnauthorized {
+		return errors.New("authentication failed")
+	}
+	return errors.Errorf("authentication failed: %s", errorMessage(res))
+}
+
+// Return the detail and code of a problem details response, or the body of
+// servers returning plain text errors
+func errorMessage(res *resty.Response) string {
+	if strings.HasPrefix(res.Header().Get("Content-Type"), objects.MIMEProblemJSON) {
+		var p objects.Problem
+		if err := json.Unmarshal(res.Body(), &p); err == nil {
+			if p.RequestID != "" {
+				return fmt.Sprintf("%s (%s, request id %s)", p.Error(), p.Code, p.RequestID)
+			}
+			return fmt.Sprintf("%s (%s)", p.Error(), p.Code)
+		}
+	}
+	if rid := res.Header().Get(objects.RequestIDHeader); rid != "" {
+		return fmt.Sprintf("%s (request id %s)", res.Body(), rid)
+	}
+	return string(res.Body())
+}
+
 func (c *Client) newReq() *resty.Request {
 	r := c.rest.R()
 	if c.restSRV != nil {
@@ -976,6 +1877,9 @@ func (c *Client) Close() {
 	if c.agentClient != nil {
 		c.agentConn.Close()
 	}
+	if c.grpc != nil {
+		c.grpc.Close()
+	}
 }
 
 func openFederatedAuthURL(url string) {
@@ -42,9 +42,21 @@ type Config struct {
 	// Skip TLS validation for server connection
 	Insecure bool
 
+	// TLS client certificate and key files, for client certificate auth
+	// backends
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// File with the token for bearer token auth backends, e.g. a workload
+	// identity token. Read on every login as the tokens are rotated
+	TokenFile string
+
 	// Client timeout
 	Timeout time.Duration
 
+	// Sent with every request and logged by the server, generated when empty
+	CorrelationID string
+
 	// How many retries on failed requests
 	// For example if the server timeouts
 	Retries int
@@ -52,9 +64,40 @@ type Config struct {
 	// Which auth endpoints to login to
 	LoginAuthEndpoints []string
 
+	// Audience, e.g. the tenant, and realm of the auth endpoints restricted
+	// to them
+	Audience string
+	Realm    string
+
 	// Request only principals matching the pattern to be included
 	IncludePrincipals string
 
 	// Request only principals not matching the pattern to be included
 	ExcludePrincipals string
+
+	// Name of the CA key to sign with, server default if empty
+	CA string
+
+	// Time from now until the next CA key takes over signing
+	CARotationCutover time.Duration
+
+	// Reason to record when revoking a certificate
+	RevokeReason string
+
+	// Comment to record when deciding on an approval request
+	ApprovalComment string
+
+	// Host public key file to sign
+	HostKeyFile string
+
+	// Hostnames to request for the host certificate
+	Hostnames []string
+
+	// Use a bootstrap token instead of authenticating when requesting a
+	// host certificate
+	BootstrapToken string
+
+	// Lifetime and number of uses for minted bootstrap tokens
+	BootstrapTokenTTL  time.Duration
+	BootstrapTokenUses int
 }
@@ -0,0 +1,275 @@
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/globals"
+	"github.com/aakso/ssh-inscribe/pkg/server/grpcapi"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	signapipb "github.com/aakso/ssh-inscribe/pkg/server/signapi/proto"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Server URL schemes of the gRPC API with and without TLS
+const (
+	SchemeGRPC  = "grpc"
+	SchemeGRPCS = "grpcs"
+)
+
+// Transport making the REST requests of the client over the gRPC API.
+// Endpoints without a gRPC counterpart, like the admin API and approvals,
+// fail with 501
+type grpcTransport struct {
+	conn   *grpc.ClientConn
+	auth   signapipb.AuthClient
+	signer signapipb.SignerClient
+}
+
+// Connect to the gRPC API at host:port, using TLS if the config is set
+func newGRPCTransport(target string, tc *tls.Config) (*grpcTransport, error) {
+	opts := []grpc.DialOption{grpc.WithUserAgent(globals.ClientUserAgent)}
+	if tc != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tc)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot connect to the grpc server")
+	}
+	return newGRPCTransportConn(conn), nil
+}
+
+func newGRPCTransportConn(conn *grpc.ClientConn) *grpcTransport {
+	return &grpcTransport{
+		conn:   conn,
+		auth:   signapipb.NewAuthClient(conn),
+		signer: signapipb.NewSignerClient(conn),
+	}
+}
+
+func (t *grpcTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	ctx := metadata.NewOutgoingContext(req.Context(), requestMetadata(req))
+	var header, trailer metadata.MD
+	opts := []grpc.CallOption{grpc.Header(&header), grpc.Trailer(&trailer)}
+	q := req.URL.Query()
+	path := strings.TrimPrefix(req.URL.Path, "/"+CurrentApiVersion)
+
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/version":
+		r, err := t.signer.GetVersion(ctx, &signapipb.GetVersionRequest{}, opts...)
+		if err != nil {
+			return errorResponse(req, err, header, trailer)
+		}
+		return newResponse(req, http.StatusOK, header, "text/plain", []byte(r.Version)), nil
+
+	case req.Method == http.MethodGet && path == "/ready":
+		if _, err := t.signer.GetVersion(ctx, &signapipb.GetVersionRequest{}, opts...); err != nil {
+			return errorResponse(req, err, header, trailer)
+		}
+		return newResponse(req, http.StatusNoContent, header, "", nil), nil
+
+	case req.Method == http.MethodGet && path == "/auth":
+		r, err := t.auth.Discover(ctx, &signapipb.DiscoverRequest{}, opts...)
+		if err != nil {
+			return errorResponse(req, err, header, trailer)
+		}
+		results := []objects.DiscoverResult{}
+		for _, v := range r.Authenticators {
+			results = append(results, objects.DiscoverResult{
+				AuthenticatorName:           v.Name,
+				AuthenticatorRealm:          v.Realm,
+				AuthenticatorCredentialType: v.CredentialType,
+				Default:                     v.Default,
+				Health:                      v.Health,
+			})
+		}
+		b, _ := json.Marshal(results)
+		return newResponse(req, http.StatusOK, header, "application/json", b), nil
+
+	case req.Method == http.MethodPost && strings.HasPrefix(path, "/auth/") && strings.Count(path, "/") == 2:
+		in := &signapipb.LoginRequest{}
+		in.Authenticator, _ = url.PathUnescape(strings.TrimPrefix(path, "/auth/"))
+		in.Username, in.Password, _ = req.BasicAuth()
+		r, err := t.auth.Login(ctx, in, opts...)
+		if err != nil {
+			return errorResponse(req, err, header, trailer)
+		}
+		if header == nil {
+			header = metadata.MD{}
+		}
+		code := http.StatusOK
+		switch {
+		case r.RedirectUrl != "":
+			code = http.StatusSeeOther
+			header.Set("Location", r.RedirectUrl)
+			if r.UserCode != "" {
+				header.Set(objects.FederationUserCodeHeader, r.UserCode)
+			}
+		case r.Challenge != "":
+			code = http.StatusAccepted
+			header.Set(objects.AuthChallengeHeader, r.Challenge)
+		case r.PasswordExpires != nil:
+			header.Set(objects.PasswordExpiresHeader, r.PasswordExpires.AsTime().Format(time.RFC3339))
+		}
+		return newResponse(req, code, header, "application/jwt", []byte(r.Token)), nil
+
+	case req.Method == http.MethodPost && path == "/sign":
+		expires, err := queryTime(q, "expires")
+		if err != nil {
+			return nil, err
+		}
+		r, err := t.signer.Sign(ctx, &signapipb.SignRequest{
+			PublicKey:         string(body),
+			Expires:           expires,
+			IncludePrincipals: q.Get("include_principals"),
+			ExcludePrincipals: q.Get("exclude_principals"),
+			Ca:                q.Get("ca"),
+		}, opts...)
+		return certificateResponse(req, r, err, header, trailer)
+
+	case req.Method == http.MethodPost && path == "/host/sign":
+		expires, err := queryTime(q, "expires")
+		if err != nil {
+			return nil, err
+		}
+		r, err := t.signer.SignHost(ctx, &signapipb.SignHostRequest{
+			PublicKey: string(body),
+			Hostnames: q["hostnames"],
+			Expires:   expires,
+			Ca:        q.Get("ca"),
+		}, opts...)
+		return certificateResponse(req, r, err, header, trailer)
+
+	case req.Method == http.MethodPost && path == "/host/bootstrap":
+		expires, err := queryTime(q, "expires")
+		if err != nil {
+			return nil, err
+		}
+		r, err := t.signer.BootstrapHost(ctx, &signapipb.BootstrapHostRequest{
+			Token:     req.Header.Get("X-Bootstrap-Token"),
+			PublicKey: string(body),
+			Hostnames: q["hostnames"],
+			Expires:   expires,
+			Ca:        q.Get("ca"),
+		}, opts...)
+		return certificateResponse(req, r, err, header, trailer)
+
+	case req.Method == http.MethodGet && path == "/ca":
+		r, err := t.signer.GetCA(ctx, &signapipb.GetCARequest{Ca: q.Get("ca")}, opts...)
+		if err != nil {
+			return errorResponse(req, err, header, trailer)
+		}
+		return newResponse(req, http.StatusOK, header, "text/plain", []byte(r.PublicKey)), nil
+
+	case req.Method == http.MethodGet && path == "/krl":
+		r, err := t.signer.GetKRL(ctx, &signapipb.GetKRLRequest{}, opts...)
+		if err != nil {
+			return errorResponse(req, err, header, trailer)
+		}
+		return newResponse(req, http.StatusOK, header, "application/octet-stream", r.Krl), nil
+	}
+	msg := fmt.Sprintf("%s %s is not available over gRPC, use an https server URL", req.Method, req.URL.Path)
+	return newResponse(req, http.StatusNotImplemented, nil, "text/plain", []byte(msg)), nil
+}
+
+// Request headers as metadata. Basic auth is sent in the login request
+func requestMetadata(req *http.Request) metadata.MD {
+	md := metadata.MD{}
+	for k, v := range req.Header {
+		switch k {
+		case "Content-Type", "Content-Length", "User-Agent", "Accept", "Accept-Encoding":
+			continue
+		case "Authorization":
+			if _, _, ok := req.BasicAuth(); ok {
+				continue
+			}
+		}
+		md[strings.ToLower(k)] = v
+	}
+	return md
+}
+
+func queryTime(q url.Values, k string) (*timestamppb.Timestamp, error) {
+	v := q.Get(k)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", k)
+	}
+	return timestamppb.New(t), nil
+}
+
+func certificateResponse(req *http.Request, r *signapipb.CertificateResponse, err error, header, trailer metadata.MD) (*http.Response, error) {
+	if err != nil {
+		return errorResponse(req, err, header, trailer)
+	}
+	return newResponse(req, http.StatusOK, header, "text/plain", []byte(r.Certificate)), nil
+}
+
+// The failed call as the response of the REST API. Calls that did not reach
+// the server are returned as errors
+func errorResponse(req *http.Request, err error, header, trailer metadata.MD) (*http.Response, error) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return nil, err
+	}
+	md := metadata.Join(header, trailer)
+	if p := grpcapi.ProblemFromStatus(st); p != nil {
+		b, _ := json.Marshal(p)
+		return newResponse(req, p.Status, md, objects.MIMEProblemJSON, b), nil
+	}
+	switch st.Code() {
+	case codes.Unavailable, codes.Canceled, codes.DeadlineExceeded:
+		return nil, errors.Errorf("grpc call failed: %s", st.Message())
+	}
+	return newResponse(req, grpcapi.HTTPStatus(st.Code()), md, "text/plain", []byte(st.Message())), nil
+}
+
+func newResponse(req *http.Request, code int, md metadata.MD, contentType string, body []byte) *http.Response {
+	res := &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/2.0",
+		ProtoMajor:    2,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	for k, v := range md {
+		res.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	if contentType != "" {
+		res.Header.Set("Content-Type", contentType)
+	}
+	return res
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/grpcapi"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	"gopkg.in/resty.v1"
+)
+
+// REST API of a server signing the keys of user "test"
+func restStub(t *testing.T, ca ssh.Signer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth":
+			json.NewEncoder(w).Encode([]objects.DiscoverResult{{
+				AuthenticatorName:           "file",
+				AuthenticatorCredentialType: auth.CredentialUserPassword,
+				Default:                     true,
+			}})
+		case "/v1/auth/file":
+			if user, pw, _ := r.BasicAuth(); user != "test" || pw != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("token"))
+		case "/v1/ca":
+			w.Write(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+		case "/v1/sign":
+			if r.Header.Get("X-Auth") != "Bearer token" {
+				w.Header().Set("Content-Type", objects.MIMEProblemJSON)
+				w.Header().Set(objects.RequestIDHeader, "req1")
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(objects.Problem{Status: http.StatusUnauthorized, Detail: "invalid token", Code: objects.ErrorUnauthorized})
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			key, _, _, _, err := ssh.ParseAuthorizedKey(body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			expires, _ := time.Parse(time.RFC3339, r.URL.Query().Get("expires"))
+			cert := &ssh.Certificate{
+				Key:             key,
+				CertType:        ssh.UserCert,
+				KeyId:           "test",
+				ValidPrincipals: []string{"test"},
+				ValidBefore:     uint64(expires.Unix()),
+			}
+			if err := cert.SignCert(rand.Reader, ca); err != nil {
+				t.Error(err)
+			}
+			w.Write(ssh.MarshalAuthorizedKey(cert))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+// Client talking to the REST API stub over gRPC
+func newGRPCClient(t *testing.T, h http.Handler) *Client {
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	grpcapi.New(h).Register(srv)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := newGRPCTransportConn(conn)
+	t.Cleanup(func() { transport.Close() })
+	return &Client{
+		Config: &Config{CertLifetime: time.Hour, Quiet: true},
+		rest: resty.New().
+			SetTransport(transport).
+			SetHostURL("http://bufnet").
+			SetRedirectPolicy(&ignoreRedirects{}),
+		grpc: transport,
+		credentialInput: func(name, realm, credentialType, def string) []byte {
+			if credentialType == CredentialTypeUser {
+				return []byte("test")
+			}
+			return []byte("secret")
+		},
+	}
+}
+
+func TestGRPCLogin(t *testing.T) {
+	assert := assert.New(t)
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	ca, _ := ssh.NewSignerFromKey(caKey)
+	_, userKey, _ := ed25519.GenerateKey(rand.Reader)
+	c := newGRPCClient(t, restStub(t, ca))
+	c.userPrivateKey = userKey
+
+	if assert.NoError(c.discoverCA()) {
+		assert.Equal(ca.PublicKey().Marshal(), c.ca.Marshal())
+	}
+	if assert.NoError(c.authenticate()) {
+		assert.Equal("token", string(c.signerToken))
+	}
+	if assert.NoError(c.sign()) {
+		assert.Equal("test", c.userCert.KeyId)
+		assert.InDelta(time.Now().Add(time.Hour).Unix(), int64(c.userCert.ValidBefore), 5)
+	}
+
+	// Problem details of the REST API are kept
+	c.signerToken = []byte("invalid")
+	err := c.sign()
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "invalid token (unauthorized)")
+	}
+
+	// Wrong credentials
+	c.credentialInput = func(name, realm, credentialType, def string) []byte { return []byte("wrong") }
+	assert.EqualError(c.authenticate(), "authentication failed")
+}
+
+func TestGRPCUnsupported(t *testing.T) {
+	assert := assert.New(t)
+	c := newGRPCClient(t, http.NotFoundHandler())
+	res, err := c.newReq().Get(c.urlFor("approvals"))
+	if assert.NoError(err) {
+		assert.Equal(http.StatusNotImplemented, res.StatusCode())
+		assert.Contains(string(res.Body()), "not available over gRPC")
+	}
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/pkg/errors"
+)
+
+// Path of the credential cache of the user. Only FILE caches are supported
+func ccachePath() (string, error) {
+	name := os.Getenv("KRB5CCNAME")
+	if name == "" {
+		return "/tmp/krb5cc_" + strconv.Itoa(os.Getuid()), nil
+	}
+	if strings.HasPrefix(name, "FILE:") {
+		return strings.TrimPrefix(name, "FILE:"), nil
+	}
+	if i := strings.Index(name, ":"); i > 0 && !strings.Contains(name[:i], "/") {
+		return "", errors.Errorf("credential cache type %s is not supported, use a FILE cache", name[:i])
+	}
+	return name, nil
+}
+
+// The system krb5.conf. The KDCs are looked up from DNS when there is none
+func krb5Config() (*config.Config, error) {
+	path := os.Getenv("KRB5_CONFIG")
+	if path == "" {
+		path = "/etc/krb5.conf"
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return config.New(), nil
+	}
+	conf, err := config.Load(path)
+	if _, ok := err.(config.UnsupportedDirective); err != nil && !ok {
+		return nil, errors.Wrapf(err, "cannot load %s", path)
+	}
+	return conf, nil
+}
+
+// SPNEGO token for the HTTP service of the host and the principal of the
+// user, using the ticket in the credential cache
+func negotiateToken(host string) ([]byte, string, error) {
+	path, err := ccachePath()
+	if err != nil {
+		return nil, "", err
+	}
+	cc, err := credentials.LoadCCache(path)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "cannot load Kerberos credential cache, run kinit first")
+	}
+	conf, err := krb5Config()
+	if err != nil {
+		return nil, "", err
+	}
+	if conf.LibDefaults.DefaultRealm == "" {
+		conf.LibDefaults.DefaultRealm = cc.DefaultPrincipal.Realm
+	}
+	cl, err := client.NewFromCCache(cc, conf, client.DisablePAFXFAST(true))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "cannot use Kerberos credential cache, run kinit first")
+	}
+	defer cl.Destroy()
+	principal := cl.Credentials.CName().PrincipalNameString() + "@" + cl.Credentials.Realm()
+
+	sp := spnego.SPNEGOClient(cl, "HTTP/"+host)
+	if err := sp.AcquireCred(); err != nil {
+		return nil, principal, errors.Wrap(err, "cannot acquire Kerberos credentials, run kinit first")
+	}
+	ct, err := sp.InitSecContext()
+	if err != nil {
+		return nil, principal, errors.Wrap(err, "cannot create Kerberos token")
+	}
+	token, err := ct.Marshal()
+	if err != nil {
+		return nil, principal, errors.Wrap(err, "cannot create Kerberos token")
+	}
+	return token, principal, nil
+}
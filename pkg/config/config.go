@@ -3,6 +3,7 @@ package config
 import (
 	"io/ioutil"
 	"strings"
+	"sync"
 
 	"github.com/ghodss/yaml"
 	"github.com/mitchellh/copystructure"
@@ -13,19 +14,71 @@ import (
 var globalConfig map[string]interface{} = make(map[string]interface{})
 var globalDefaults map[string]interface{} = make(map[string]interface{})
 
+var (
+	mu         sync.RWMutex
+	loadedFrom string
+)
+
 func LoadConfig(loc string) error {
 	data, err := ioutil.ReadFile(loc)
 	if err != nil {
 		return errors.Wrap(err, "cannot load configuration")
 	}
-	return LoadBytes(data)
+	if err := LoadBytes(data); err != nil {
+		return err
+	}
+	mu.Lock()
+	loadedFrom = loc
+	mu.Unlock()
+	return nil
 }
 
 func LoadBytes(data []byte) error {
-	err := yaml.Unmarshal(data, &globalConfig)
+	conf, err := parse(data)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for k, v := range conf {
+		globalConfig[k] = v
+	}
+	return nil
+}
+
+// Parse the configuration and resolve the secret references in it
+func parse(data []byte) (map[string]interface{}, error) {
+	conf := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return nil, errors.Wrap(err, "cannot parse configuration")
+	}
+	if _, err := resolveSecrets("", conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// Re-read the configuration file loaded with LoadConfig. The previous
+// configuration is replaced entirely and kept if the file cannot be parsed
+// or a secret reference cannot be resolved
+func Reload() error {
+	mu.RLock()
+	loc := loadedFrom
+	mu.RUnlock()
+	if loc == "" {
+		return errors.New("no configuration file loaded")
+	}
+	data, err := ioutil.ReadFile(loc)
+	if err != nil {
+		return errors.Wrap(err, "cannot load configuration")
+	}
+	conf, err := parse(data)
 	if err != nil {
-		return errors.Wrap(err, "cannot parse configuration")
+		return err
 	}
+	mu.Lock()
+	globalConfig = conf
+	mu.Unlock()
 	return nil
 }
 
@@ -51,6 +104,8 @@ func Get(section string) (interface{}, error) {
 
 // Return submap with key "section1.section2"
 func getLoaded(section string) interface{} {
+	mu.RLock()
+	defer mu.RUnlock()
 	return findValue(strings.Split(section, "."), globalConfig)
 }
 func findValue(remaining []string, conf map[string]interface{}) interface{} {
@@ -2,6 +2,11 @@ package config
 
 import (
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -51,3 +56,84 @@ func TestLoadConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestReload(t *testing.T) {
+	assert := assert.New(t)
+	f, err := ioutil.TempFile("", "config")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.Remove(f.Name())
+	f.Write(loadConf)
+	f.Close()
+	assert.NoError(LoadConfig(f.Name()))
+
+	ioutil.WriteFile(f.Name(), []byte("test1:\n  test2:\n    test3:\n      secondfield: 5\n"), 0600)
+	assert.NoError(Reload())
+	val, err := Get("test1.test2.test3")
+	if assert.NoError(err) {
+		conf, _ := val.(*testConf)
+		// Values removed from the file revert to defaults
+		assert.Equal("test", conf.FirstField)
+		assert.Equal(5, conf.SecondField)
+	}
+
+	// Broken file keeps the previous configuration
+	ioutil.WriteFile(f.Name(), []byte("test1: ["), 0600)
+	assert.Error(Reload())
+	val, _ = Get("test1.test2.test3")
+	assert.Equal(5, val.(*testConf).SecondField)
+}
+
+func TestSecretReferences(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "config")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "secret"), []byte("from file\n"), 0600)
+	os.Setenv("INSCRIBE_TEST_SECRET", "from env")
+	defer os.Unsetenv("INSCRIBE_TEST_SECRET")
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/inscribe":
+			fmt.Fprint(w, `{"data":{"data":{"key":"from vault v2"},"metadata":{"version":1}}}`)
+		case "/v1/kv/inscribe":
+			fmt.Fprint(w, `{"data":{"value":"from vault v1"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	os.Setenv("VAULT_ADDR", vault.URL)
+	os.Setenv("VAULT_TOKEN", "token")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	conf := fmt.Sprintf(`
+secrettest:
+  env: env://INSCRIBE_TEST_SECRET
+  file: file://%s
+  list: [vault://secret/data/inscribe#key, vault://kv/inscribe]
+  url: https://example.com
+`, path.Join(dir, "secret"))
+	if assert.NoError(LoadBytes([]byte(conf))) {
+		val, err := Get("secrettest")
+		if assert.NoError(err) {
+			m := val.(map[string]interface{})
+			assert.Equal("from env", m["env"])
+			assert.Equal("from file", m["file"])
+			assert.Equal([]interface{}{"from vault v2", "from vault v1"}, m["list"])
+			assert.Equal("https://example.com", m["url"])
+		}
+	}
+
+	err := LoadBytes([]byte("secrettest:\n  env: env://INSCRIBE_TEST_MISSING\n"))
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "secrettest.env")
+	}
+	assert.Error(LoadBytes([]byte("secrettest:\n  vault: vault://secret/data/missing\n")))
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Resolves the part of a secret reference after "<scheme>://"
+type SecretResolver func(ref string) (string, error)
+
+var (
+	resolversMu sync.RWMutex
+	resolvers   = map[string]SecretResolver{}
+)
+
+// Register a resolver for references of the form <scheme>://<ref>. String
+// values using a registered scheme are replaced with the resolved secret
+// when the configuration is loaded or reloaded
+func RegisterSecretResolver(scheme string, r SecretResolver) {
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	resolvers[scheme] = r
+}
+
+func init() {
+	RegisterSecretResolver("env", resolveEnv)
+	RegisterSecretResolver("file", resolveFile)
+	RegisterSecretResolver("vault", resolveVault)
+}
+
+// Resolve a single value, returning values without a registered scheme as is
+func ResolveSecret(v string) (string, error) {
+	i := strings.Index(v, "://")
+	if i <= 0 {
+		return v, nil
+	}
+	resolversMu.RLock()
+	r, ok := resolvers[v[:i]]
+	resolversMu.RUnlock()
+	if !ok {
+		return v, nil
+	}
+	return r(v[i+3:])
+}
+
+// Replace the secret references in the parsed configuration
+func resolveSecrets(path string, v interface{}) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		s, err := ResolveSecret(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "cannot resolve secret reference at %s", path)
+		}
+		return s, nil
+	case map[string]interface{}:
+		for k, item := range val {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			r, err := resolveSecrets(p, item)
+			if err != nil {
+				return nil, err
+			}
+			val[k] = r
+		}
+	case []interface{}:
+		for i, item := range val {
+			r, err := resolveSecrets(path+"["+strconv.Itoa(i)+"]", item)
+			if err != nil {
+				return nil, err
+			}
+			val[i] = r
+		}
+	}
+	return v, nil
+}
+
+// env://NAME
+func resolveEnv(ref string) (string, error) {
+	v, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", errors.Errorf("environment variable %s is not set", ref)
+	}
+	return v, nil
+}
+
+// file:///absolute/path or file://relative/path. A trailing newline is removed
+func resolveFile(ref string) (string, error) {
+	data, err := ioutil.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// vault://<path>#<field> read with VAULT_ADDR and VAULT_TOKEN. Both KV version
+// 1 and 2 paths are supported, e.g. vault://secret/data/inscribe#tokenKey.
+// The field defaults to "value"
+func resolveVault(ref string) (string, error) {
+	addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	token := os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", errors.New("VAULT_ADDR and VAULT_TOKEN must be set for vault references")
+	}
+	path, field := ref, "value"
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		path, field = ref[:i], ref[i+1:]
+	}
+	req, err := http.NewRequest(http.MethodGet, addr+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "vault request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+	var r struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", errors.Wrap(err, "invalid vault response")
+	}
+	data := r.Data
+	// KV version 2 nests the secret under data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, meta := data["metadata"]; meta {
+			data = nested
+		}
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return "", errors.Errorf("field %s not found in vault secret %s", field, path)
+	}
+	return v, nil
+}
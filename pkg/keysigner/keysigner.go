@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -65,6 +66,12 @@ type KeySignerService struct {
 	preferredSigningKeyHash string
 	selectedSigningKey      *agent.Key
 
+	// Additional CA keys on the agent by name and fingerprint
+	namedKeys map[string]string
+
+	// Pending rotation of the default key
+	rotation *Rotation
+
 	// PKCS11 stuff
 	pkcs11Provider    string
 	pkcs11Pin         string
@@ -88,6 +95,71 @@ func New(socketPath, preferredKeyHash string) *KeySignerService {
 	return r
 }
 
+// Name of the CA key selected by fingerprint or discovered from the agent
+const DefaultCA = "default"
+
+// Configure additional CA keys by name and SHA256 fingerprint. The keys are
+// looked up from the agent when used
+func (ks *KeySignerService) SetNamedKeys(keys map[string]string) error {
+	for name, fp := range keys {
+		if name == "" || name == DefaultCA {
+			return errors.Errorf("invalid CA key name %q", name)
+		}
+		if fp == "" {
+			return errors.Errorf("CA key %s has no fingerprint", name)
+		}
+	}
+	ks.Lock()
+	defer ks.Unlock()
+	ks.namedKeys = keys
+	return nil
+}
+
+// Names of the configured CA keys including the default one
+func (ks *KeySignerService) CANames() []string {
+	ks.Lock()
+	defer ks.Unlock()
+	names := []string{DefaultCA}
+	for name := range ks.namedKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// Find a CA key by name from the agent. Empty name is the default key
+func (ks *KeySignerService) namedKey(name string) (*agent.Key, error) {
+	if name == "" || name == DefaultCA {
+		return ks.defaultKey()
+	}
+	fp, ok := ks.namedKeys[name]
+	if !ok {
+		return nil, errors.Errorf("unknown CA key %s", name)
+	}
+	key, err := ks.agentKey(fp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "CA key %s", name)
+	}
+	return key, nil
+}
+
+// Find a key from the agent by SHA256 fingerprint
+func (ks *KeySignerService) agentKey(fp string) (*agent.Key, error) {
+	if ks.client == nil {
+		return nil, errors.New("agent is not available")
+	}
+	keys, err := ks.client.List()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot list agent keys")
+	}
+	for _, key := range keys {
+		if ssh.FingerprintSHA256(key) == fp {
+			return key, nil
+		}
+	}
+	return nil, errors.New("key is not available on the agent")
+}
+
 func (ks *KeySignerService) discoverSigningKey() bool {
 	if ks.selectedSigningKey != nil {
 		return true
@@ -160,10 +232,45 @@ func (ks *KeySignerService) agentPing() bool {
 func (ks *KeySignerService) GetPublicKey() (ssh.PublicKey, error) {
 	ks.Lock()
 	defer ks.Unlock()
-	if ks.selectedSigningKey == nil {
-		return nil, errors.New("no signing key available")
+	key, err := ks.defaultKey()
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Public key of a CA key by name
+func (ks *KeySignerService) GetNamedPublicKey(name string) (ssh.PublicKey, error) {
+	ks.Lock()
+	defer ks.Unlock()
+	key, err := ks.namedKey(name)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Public keys of all active CA keys, i.e. the keys certificates issued by this
+// service may be signed with. Named keys missing from the agent are skipped
+func (ks *KeySignerService) GetPublicKeys() ([]ssh.PublicKey, error) {
+	key, err := ks.GetPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	keys := []ssh.PublicKey{key}
+	// Both keys are trusted for the duration of a rotation
+	if other, err := ks.rotationPeer(); err == nil {
+		keys = append(keys, other)
+	}
+	for _, name := range ks.CANames()[1:] {
+		key, err := ks.GetNamedPublicKey(name)
+		if err != nil {
+			ks.log.WithField("ca", name).WithError(err).Warn("CA key is not available")
+			continue
+		}
+		keys = append(keys, key)
 	}
-	return ks.selectedSigningKey, nil
+	return keys, nil
 }
 
 func (ks *KeySignerService) AddSmartcard(id, pin string) error {
@@ -213,6 +320,39 @@ func (ks *KeySignerService) removeSmartcard(id string) error {
 	return errors.New("agent: failure")
 }
 
+// Add a configured named CA key to the agent. The key must match the
+// configured fingerprint
+func (ks *KeySignerService) AddNamedSigningKey(name string, pemKey []byte, comment string) error {
+	if name == "" || name == DefaultCA {
+		return ks.AddSigningKey(pemKey, comment)
+	}
+	ks.Lock()
+	defer ks.Unlock()
+	fp, ok := ks.namedKeys[name]
+	if !ok {
+		return errors.Errorf("unknown CA key %s", name)
+	}
+	if !ks.agentPing() {
+		return errors.New("cannot add signing key: agent is not responding")
+	}
+	key, err := ssh.ParseRawPrivateKey(pemKey)
+	if err != nil {
+		return errors.Wrap(err, "cannot add signing key")
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return errors.Wrap(err, "cannot add signing key")
+	}
+	if ssh.FingerprintSHA256(signer.PublicKey()) != fp {
+		return errors.New("signing key fingerprint doesn't match the configured value")
+	}
+	err = ks.client.Add(agent.AddedKey{
+		PrivateKey: key,
+		Comment:    comment,
+	})
+	return errors.Wrap(err, "cannot add signing key")
+}
+
 func (ks *KeySignerService) AddSigningKey(pemKey []byte, comment string) error {
 	ks.Lock()
 	defer ks.Unlock()
@@ -250,6 +390,10 @@ func (ks *KeySignerService) AddSigningKey(pemKey []byte, comment string) error {
 }
 
 func (ks *KeySignerService) getSigner() (ssh.Signer, error) {
+	return ks.getSignerFor(ks.selectedSigningKey)
+}
+
+func (ks *KeySignerService) getSignerFor(key *agent.Key) (ssh.Signer, error) {
 	signers, err := ks.client.Signers()
 	if err != nil {
 		ks.log.WithError(err).Error("cannot get signers")
@@ -259,7 +403,7 @@ func (ks *KeySignerService) getSigner() (ssh.Signer, error) {
 		return nil, errors.New("service is not ready for signing")
 	}
 	for _, signer := range signers {
-		if bytes.Compare(signer.PublicKey().Marshal(), ks.selectedSigningKey.Blob) == 0 {
+		if bytes.Compare(signer.PublicKey().Marshal(), key.Blob) == 0 {
 			return signer, nil
 		}
 	}
@@ -267,18 +411,42 @@ func (ks *KeySignerService) getSigner() (ssh.Signer, error) {
 	return nil, errors.New("service is not ready for signing")
 }
 
+// Sign user or host certificate with the selected CA key
 func (ks *KeySignerService) SignCertificate(cert *ssh.Certificate) error {
+	return ks.SignCertificateWith("", cert)
+}
+
+// Sign user or host certificate with a CA key by name. Empty name is the
+// default key
+func (ks *KeySignerService) SignCertificateWith(name string, cert *ssh.Certificate) error {
 	if !ks.Ready() {
 		return errors.New("service is not ready for signing")
 	}
+	var certType string
+	switch cert.CertType {
+	case ssh.UserCert:
+		certType = "user"
+	case ssh.HostCert:
+		certType = "host"
+	default:
+		return errors.Errorf("unknown certificate type %d", cert.CertType)
+	}
 	ks.Lock()
 	defer ks.Unlock()
 
-	signer, err := ks.getSigner()
+	key, err := ks.namedKey(name)
+	if err != nil {
+		return err
+	}
+	signer, err := ks.getSignerFor(key)
 	if err != nil {
-		ks.log.Error("cannot get signer")
+		ks.log.WithField("ca", name).Error("cannot get signer")
 		return err
 	}
+	start := time.Now()
+	defer func() {
+		metricSigningDuration.WithLabelValues(certType).Observe(time.Since(start).Seconds())
+	}()
 	if err := cert.SignCert(rand.Reader, signer); err != nil {
 		return err
 	} else {
@@ -286,6 +454,29 @@ func (ks *KeySignerService) SignCertificate(cert *ssh.Certificate) error {
 	}
 }
 
+// Sign arbitrary data with the default CA key, e.g. audit log checkpoints.
+// The key used is returned along with the signature
+func (ks *KeySignerService) SignData(data []byte) (*ssh.Signature, ssh.PublicKey, error) {
+	if !ks.Ready() {
+		return nil, nil, errors.New("service is not ready for signing")
+	}
+	ks.Lock()
+	defer ks.Unlock()
+	key, err := ks.defaultKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := ks.getSignerFor(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	sig, err := signer.Sign(rand.Reader, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sig, signer.PublicKey(), nil
+}
+
 // Kill agent if it was started by us
 func (ks *KeySignerService) KillAgent() bool {
 	ks.Lock()
@@ -475,7 +666,6 @@ func unmarshal(packet []byte) (interface{}, error) {
 	if len(packet) < 1 {
 		return nil, errors.New("agent: empty packet")
 	}
-	var msg interface{}
 	switch packet[0] {
 	case agentFailure:
 		return new(failureAgentMsg), nil
@@ -484,5 +674,4 @@ func unmarshal(packet []byte) (interface{}, error) {
 	default:
 		return nil, errors.Errorf("agent: unknown type tag %d", packet[0])
 	}
-	return msg, nil
 }
@@ -274,6 +274,65 @@ func TestSign(t *testing.T) {
 	}
 }
 
+func TestNamedKeys(t *testing.T) {
+	assert := assert.New(t)
+	srv := New(socketPath, ssh.FingerprintSHA256(testCaPublicParsed))
+	defer srv.KillAgent()
+	defer srv.Close()
+
+	stagingKey, _, _, _, _ := ssh.ParseAuthorizedKey(testCaPublicInvalid)
+	assert.Error(srv.SetNamedKeys(map[string]string{DefaultCA: "x"}))
+	assert.NoError(srv.SetNamedKeys(map[string]string{"staging": ssh.FingerprintSHA256(stagingKey)}))
+	assert.Equal([]string{DefaultCA, "staging"}, srv.CANames())
+
+	assert.True(wait(srv.AgentPing))
+	assert.NoError(srv.AddSigningKey(testCaPrivatePem, "test-ca"))
+	_, err := srv.GetNamedPublicKey("staging")
+	assert.Error(err, "key should not be on the agent yet")
+	assert.Error(srv.AddNamedSigningKey("staging", testCaPrivatePem, "staging"), "fingerprint should not match")
+	assert.NoError(srv.AddNamedSigningKey("staging", testCaPrivatePemInvalid, "staging"))
+
+	keys, err := srv.GetPublicKeys()
+	if assert.NoError(err) && assert.Len(keys, 2) {
+		assert.Equal(testCaPublicParsed.Marshal(), keys[0].Marshal())
+		assert.Equal(stagingKey.Marshal(), keys[1].Marshal())
+	}
+	if assert.True(srv.Ready(), "service should be ready") {
+		userCert := testCert()
+		assert.NoError(srv.SignCertificateWith("staging", userCert))
+		assert.Equal(stagingKey.Marshal(), userCert.SignatureKey.Marshal())
+		assert.Error(srv.SignCertificateWith("bogus", testCert()))
+	}
+}
+
+func TestSignHostCertificate(t *testing.T) {
+	assert := assert.New(t)
+	srv := New(socketPath, ssh.FingerprintSHA256(testCaPublicParsed))
+	defer srv.KillAgent()
+	defer srv.Close()
+
+	assert.True(wait(srv.AgentPing))
+	if assert.NoError(srv.AddSigningKey(testCaPrivatePem, "test-ca")) {
+		if assert.True(srv.Ready(), "service should be ready") {
+			hostCert := testCert()
+			hostCert.CertType = ssh.HostCert
+			hostCert.ValidPrincipals = []string{"host.example.com"}
+			hostCert.Permissions = ssh.Permissions{}
+			assert.NoError(srv.SignCertificate(hostCert), "signing should work")
+			cc := &ssh.CertChecker{
+				IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+					return bytes.Equal(auth.Marshal(), testCaPublicParsed.Marshal())
+				},
+			}
+			assert.NoError(cc.CheckCert("host.example.com", hostCert))
+
+			invalid := testCert()
+			invalid.CertType = 3
+			assert.Error(srv.SignCertificate(invalid))
+		}
+	}
+}
+
 func TestGetPublicKey(t *testing.T) {
 	assert := assert.New(t)
 	srv := New(socketPath, ssh.FingerprintSHA256(testCaPublicParsed))
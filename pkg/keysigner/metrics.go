@@ -0,0 +1,14 @@
+package keysigner
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricSigningDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name: "ssh_inscribe_signing_duration_seconds",
+		Help: "Time spent signing certificates on the agent",
+	},
+	[]string{"type"},
+)
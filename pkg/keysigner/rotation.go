@@ -0,0 +1,175 @@
+package keysigner
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Rotation replaces the default CA key with the next key at the cutover
+// time. Both keys are served as trusted until the old one is retired
+type Rotation struct {
+	// SHA256 fingerprint of the next key
+	Next    string
+	Cutover time.Time
+}
+
+// The default key. After the cutover of a pending rotation this is the next
+// key if it is available on the agent
+func (ks *KeySignerService) defaultKey() (*agent.Key, error) {
+	if ks.rotation != nil && !time.Now().Before(ks.rotation.Cutover) {
+		key, err := ks.agentKey(ks.rotation.Next)
+		if err == nil {
+			return key, nil
+		}
+		ks.log.WithError(err).WithField("fingerprint", ks.rotation.Next).
+			Error("next CA key is not available, signing with the previous key")
+	}
+	if ks.selectedSigningKey == nil {
+		return nil, errors.New("no signing key available")
+	}
+	return ks.selectedSigningKey, nil
+}
+
+// The key of a pending rotation that is not currently the default key
+func (ks *KeySignerService) rotationPeer() (ssh.PublicKey, error) {
+	ks.Lock()
+	defer ks.Unlock()
+	if ks.rotation == nil {
+		return nil, errors.New("no rotation in progress")
+	}
+	next, err := ks.agentKey(ks.rotation.Next)
+	if err != nil {
+		return nil, err
+	}
+	def, err := ks.defaultKey()
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(def.Blob, next.Blob) {
+		if ks.selectedSigningKey == nil {
+			return nil, errors.New("no signing key available")
+		}
+		return ks.selectedSigningKey, nil
+	}
+	return next, nil
+}
+
+// Generate a new Ed25519 key on the agent. The private key exists only on
+// the agent and is lost if the agent is restarted
+func (ks *KeySignerService) GenerateSigningKey(comment string) (ssh.PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot generate key")
+	}
+	ks.Lock()
+	defer ks.Unlock()
+	if err := ks.addAgentKey(priv, comment); err != nil {
+		return nil, err
+	}
+	return ssh.NewPublicKey(pub)
+}
+
+// Add a private key to the agent without selecting it for signing
+func (ks *KeySignerService) AddAgentKey(pemKey []byte, comment string) (ssh.PublicKey, error) {
+	key, err := ssh.ParseRawPrivateKey(pemKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot add key")
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot add key")
+	}
+	ks.Lock()
+	defer ks.Unlock()
+	if err := ks.addAgentKey(key, comment); err != nil {
+		return nil, err
+	}
+	return signer.PublicKey(), nil
+}
+
+func (ks *KeySignerService) addAgentKey(key interface{}, comment string) error {
+	if !ks.agentPing() {
+		return errors.New("cannot add key: agent is not responding")
+	}
+	err := ks.client.Add(agent.AddedKey{
+		PrivateKey: key,
+		Comment:    comment,
+	})
+	return errors.Wrap(err, "cannot add key")
+}
+
+// Start rotating the default key to the key with the given fingerprint
+func (ks *KeySignerService) SetRotation(r Rotation) error {
+	ks.Lock()
+	defer ks.Unlock()
+	if ks.selectedSigningKey != nil && ssh.FingerprintSHA256(ks.selectedSigningKey) == r.Next {
+		return errors.New("next key is already the default key")
+	}
+	ks.rotation = &r
+	return nil
+}
+
+// Cancel a pending rotation. The next key is left on the agent
+func (ks *KeySignerService) ClearRotation() {
+	ks.Lock()
+	defer ks.Unlock()
+	ks.rotation = nil
+}
+
+func (ks *KeySignerService) Rotation() (Rotation, bool) {
+	ks.Lock()
+	defer ks.Unlock()
+	if ks.rotation == nil {
+		return Rotation{}, false
+	}
+	return *ks.rotation, true
+}
+
+// Complete the rotation after the cutover: the next key becomes the default
+// key and the previous key is removed from the agent. Returns the retired key
+func (ks *KeySignerService) RetireDefault() (ssh.PublicKey, error) {
+	ks.Lock()
+	defer ks.Unlock()
+	r := ks.rotation
+	switch {
+	case r == nil:
+		return nil, errors.New("no rotation in progress")
+	case time.Now().Before(r.Cutover):
+		return nil, errors.New("cutover time has not been reached")
+	case ks.selectedSigningKey == nil:
+		return nil, errors.New("no signing key available")
+	}
+	next, err := ks.agentKey(r.Next)
+	if err != nil {
+		return nil, errors.Wrap(err, "next CA key")
+	}
+	old := ks.selectedSigningKey
+	if err := ks.client.Remove(old); err != nil {
+		return nil, errors.Wrap(err, "cannot remove the previous key from the agent")
+	}
+	ks.preferredSigningKeyHash = r.Next
+	ks.selectedSigningKey = next
+	ks.rotation = nil
+	ks.log.WithField("fingerprint", r.Next).WithField("retired", ssh.FingerprintSHA256(old)).Info("CA key rotation completed")
+	return old, nil
+}
+
+// Select the default key by fingerprint, e.g. after a completed rotation
+func (ks *KeySignerService) SetDefaultFingerprint(fp string) {
+	ks.Lock()
+	defer ks.Unlock()
+	if ks.preferredSigningKeyHash == fp {
+		return
+	}
+	ks.preferredSigningKeyHash = fp
+	ks.selectedSigningKey = nil
+	if ks.client != nil {
+		ks.discoverSigningKey()
+	}
+}
@@ -0,0 +1,165 @@
+// Package krl implements the OpenSSH key revocation list format as described
+// in PROTOCOL.krl of the OpenSSH distribution
+package krl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	magic         uint64 = 0x5353484b524c0a00
+	formatVersion uint32 = 1
+
+	sectionCertificates      byte = 1
+	sectionExplicitKey       byte = 2
+	sectionFingerprintSHA256 byte = 5
+
+	certSectionSerialList byte = 0x20
+	certSectionKeyID      byte = 0x23
+)
+
+// Revoked certificates issued by a single CA. A nil CA matches any CA
+type CertificateSection struct {
+	CA      ssh.PublicKey
+	Serials []uint64
+	KeyIDs  []string
+}
+
+type KRL struct {
+	Version       uint64
+	GeneratedDate time.Time
+	Comment       string
+	Certificates  []*CertificateSection
+	// Revoked plain keys (and certificates carrying them)
+	Keys []ssh.PublicKey
+	// Raw SHA256 hashes of revoked public key blobs
+	SHA256Fingerprints [][]byte
+}
+
+type buffer struct {
+	bytes.Buffer
+}
+
+func (b *buffer) uint32(v uint32) {
+	var tmp [4]byte
+	binary.BigEndian.PutUint32(tmp[:], v)
+	b.Write(tmp[:])
+}
+
+func (b *buffer) uint64(v uint64) {
+	var tmp [8]byte
+	binary.BigEndian.PutUint64(tmp[:], v)
+	b.Write(tmp[:])
+}
+
+func (b *buffer) string(v []byte) {
+	b.uint32(uint32(len(v)))
+	b.Write(v)
+}
+
+func (b *buffer) section(typ byte, data []byte) {
+	b.WriteByte(typ)
+	b.string(data)
+}
+
+func (cs *CertificateSection) marshal() []byte {
+	var b buffer
+	if cs.CA != nil {
+		b.string(cs.CA.Marshal())
+	} else {
+		b.string(nil)
+	}
+	// reserved
+	b.string(nil)
+
+	if len(cs.Serials) > 0 {
+		serials := append([]uint64(nil), cs.Serials...)
+		sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+		var sb buffer
+		var prev uint64
+		for i, s := range serials {
+			if i > 0 && s == prev {
+				continue
+			}
+			sb.uint64(s)
+			prev = s
+		}
+		b.section(certSectionSerialList, sb.Bytes())
+	}
+	if len(cs.KeyIDs) > 0 {
+		ids := append([]string(nil), cs.KeyIDs...)
+		sort.Strings(ids)
+		var kb buffer
+		for i, id := range ids {
+			if i > 0 && id == ids[i-1] {
+				continue
+			}
+			kb.string([]byte(id))
+		}
+		b.section(certSectionKeyID, kb.Bytes())
+	}
+	return b.Bytes()
+}
+
+// Marshal the KRL into the binary format understood by sshd RevokedKeys
+// and ssh-keygen -Q
+func (k *KRL) Marshal() []byte {
+	var b buffer
+	b.uint64(magic)
+	b.uint32(formatVersion)
+	b.uint64(k.Version)
+	generated := k.GeneratedDate
+	if generated.IsZero() {
+		generated = time.Now()
+	}
+	b.uint64(uint64(generated.Unix()))
+	// flags
+	b.uint64(0)
+	// reserved
+	b.string(nil)
+	b.string([]byte(k.Comment))
+
+	for _, cs := range k.Certificates {
+		if len(cs.Serials) == 0 && len(cs.KeyIDs) == 0 {
+			continue
+		}
+		b.section(sectionCertificates, cs.marshal())
+	}
+	if len(k.Keys) > 0 {
+		blobs := make([][]byte, 0, len(k.Keys))
+		for _, key := range k.Keys {
+			blobs = append(blobs, key.Marshal())
+		}
+		b.section(sectionExplicitKey, marshalBlobs(blobs))
+	}
+	if len(k.SHA256Fingerprints) > 0 {
+		b.section(sectionFingerprintSHA256, marshalBlobs(k.SHA256Fingerprints))
+	}
+	return b.Bytes()
+}
+
+// Sorted and deduplicated list of strings
+func marshalBlobs(blobs [][]byte) []byte {
+	var b buffer
+	sorted := append([][]byte(nil), blobs...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	for i, blob := range sorted {
+		if i > 0 && bytes.Equal(blob, sorted[i-1]) {
+			continue
+		}
+		b.string(blob)
+	}
+	return b.Bytes()
+}
+
+// Raw SHA256 hash of a public key as used in the fingerprint section
+func SHA256Fingerprint(key ssh.PublicKey) []byte {
+	h := sha256.Sum256(key.Marshal())
+	return h[:]
+}
@@ -0,0 +1,104 @@
+package krl
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func newKey(t *testing.T) (ssh.PublicKey, ssh.Signer) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := ssh.NewSignerFromKey(priv)
+	sshPub, _ := ssh.NewPublicKey(pub)
+	return sshPub, signer
+}
+
+func newCert(t *testing.T, ca ssh.Signer, serial uint64, keyID string) *ssh.Certificate {
+	pub, _ := newKey(t)
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          serial,
+		KeyId:           keyID,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"test"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestMarshalHeader(t *testing.T) {
+	assert := assert.New(t)
+	data := (&KRL{Version: 42, Comment: "test"}).Marshal()
+	assert.Equal("SSHKRL\n\x00", string(data[:8]))
+	assert.Equal(uint32(1), binary.BigEndian.Uint32(data[8:12]))
+	assert.Equal(uint64(42), binary.BigEndian.Uint64(data[12:20]))
+	assert.True(strings.HasSuffix(string(data), "\x00\x00\x00\x04test"))
+}
+
+// Verify the generated KRL with ssh-keygen if available
+func TestSSHKeygen(t *testing.T) {
+	assert := assert.New(t)
+	keygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen not available")
+	}
+	dir, err := ioutil.TempDir("", "krltest")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	caPub, ca := newKey(t)
+	otherPub, _ := newKey(t)
+	revokedSerial := newCert(t, ca, 10, "serial")
+	revokedKeyID := newCert(t, ca, 11, "revoked")
+	ok := newCert(t, ca, 12, "ok")
+	revokedKey, _ := newKey(t)
+	revokedFingerprint, _ := newKey(t)
+
+	krl := &KRL{
+		Version: 1,
+		Comment: "ssh-inscribe",
+		Certificates: []*CertificateSection{
+			&CertificateSection{CA: caPub, Serials: []uint64{10, 5, 10}, KeyIDs: []string{"revoked"}},
+			&CertificateSection{CA: otherPub, Serials: []uint64{12}},
+		},
+		Keys:               []ssh.PublicKey{revokedKey},
+		SHA256Fingerprints: [][]byte{SHA256Fingerprint(revokedFingerprint)},
+	}
+	krlFile := path.Join(dir, "krl")
+	assert.NoError(ioutil.WriteFile(krlFile, krl.Marshal(), 0600))
+
+	check := func(key ssh.PublicKey, revoked bool) {
+		fn := path.Join(dir, "key.pub")
+		ioutil.WriteFile(fn, ssh.MarshalAuthorizedKey(key), 0600)
+		out, err := exec.Command(keygen, "-Q", "-f", krlFile, fn).CombinedOutput()
+		if revoked {
+			assert.Error(err, string(out))
+			assert.Contains(string(out), "REVOKED")
+		} else {
+			assert.NoError(err, string(out))
+		}
+	}
+	check(revokedSerial, true)
+	check(revokedKeyID, true)
+	check(ok, false)
+	check(revokedKey, true)
+	check(revokedFingerprint, true)
+	check(otherPub, false)
+}
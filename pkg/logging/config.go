@@ -7,6 +7,15 @@ type Config struct {
 	EnableConsole bool   `yaml:"enableConsole"`
 	EnableSyslog  bool   `yaml:"enableSyslog"`
 	SyslogURL     string `yaml:"syslogURL"`
+	// Options for the json format
+	JSON JSONConfig `yaml:"json"`
+}
+
+type JSONConfig struct {
+	// Layout of the timestamps, RFC3339 if empty
+	TimestampFormat string `yaml:"timestampFormat"`
+	// Rename the time, level and msg fields, e.g. time: "@timestamp"
+	FieldNames map[string]string `yaml:"fieldNames"`
 }
 
 var Defaults = &Config{
@@ -16,4 +25,8 @@ var Defaults = &Config{
 	EnableConsole: true,
 	EnableSyslog:  false,
 	SyslogURL:     "",
+	JSON: JSONConfig{
+		TimestampFormat: "",
+		FieldNames:      map[string]string{},
+	},
 }
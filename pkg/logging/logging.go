@@ -1,7 +1,9 @@
 package logging
 
 import (
+	"io"
 	"io/ioutil"
+	"os"
 	"strings"
 
 	"github.com/aakso/ssh-inscribe/pkg/config"
@@ -58,22 +60,28 @@ func Setup() error {
 
 	}
 
+	// Setup may be called again on configuration reload, so outputs and
+	// hooks are always reset
+	var out io.Writer = os.Stderr
 	if !conf.EnableConsole {
-		logrus.SetOutput(ioutil.Discard)
-		for _, logger := range pkgLoggers {
-			logger.Out = ioutil.Discard
-		}
+		out = ioutil.Discard
+	}
+	logrus.SetOutput(out)
+	for _, logger := range pkgLoggers {
+		logger.Out = out
 	}
 
+	hooks := make(logrus.LevelHooks)
 	if conf.EnableSyslog {
 		hook, err := getSyslogLoggerHook(conf.SyslogURL)
 		if err != nil {
 			return errors.Wrap(err, "cannot create syslog hook")
 		}
-		logrus.AddHook(hook)
-		for _, logger := range pkgLoggers {
-			logger.Hooks.Add(hook)
-		}
+		hooks.Add(hook)
+	}
+	logrus.StandardLogger().ReplaceHooks(hooks)
+	for _, logger := range pkgLoggers {
+		logger.ReplaceHooks(hooks)
 	}
 
 	level, err = logrus.ParseLevel(strings.ToLower(conf.DefaultLevel))
@@ -86,7 +94,10 @@ func Setup() error {
 	case "text":
 		formatter = new(logrus.TextFormatter)
 	case "json":
-		formatter = new(logrus.JSONFormatter)
+		formatter, err = newJSONFormatter(conf.JSON)
+		if err != nil {
+			return err
+		}
 	default:
 		return errors.Errorf("unknown log formatter: %q, available: text, json", conf.Format)
 	}
@@ -116,3 +127,23 @@ func Setup() error {
 
 	return nil
 }
+
+func newJSONFormatter(conf JSONConfig) (*logrus.JSONFormatter, error) {
+	fieldMap := logrus.FieldMap{}
+	for k, v := range conf.FieldNames {
+		switch k {
+		case logrus.FieldKeyTime:
+			fieldMap[logrus.FieldKeyTime] = v
+		case logrus.FieldKeyLevel:
+			fieldMap[logrus.FieldKeyLevel] = v
+		case logrus.FieldKeyMsg:
+			fieldMap[logrus.FieldKeyMsg] = v
+		default:
+			return nil, errors.Errorf("unknown json field: %q, available: time, level, msg", k)
+		}
+	}
+	return &logrus.JSONFormatter{
+		TimestampFormat: conf.TimestampFormat,
+		FieldMap:        fieldMap,
+	}, nil
+}
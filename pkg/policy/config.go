@@ -0,0 +1,67 @@
+package policy
+
+type TemplateConfig struct {
+	Name string `yaml:"name"`
+	// Allowed principal patterns. Principals not matching any pattern are
+	// removed from the certificate. Empty allows all
+	Principals []string `yaml:"principals"`
+	// Lifetimes override the server defaults. The server maximum lifetime
+	// still applies
+	DefaultLifetime string `yaml:"defaultLifetime"`
+	MaxLifetime     string `yaml:"maxLifetime"`
+	// Critical options set on every certificate, e.g. force-command or
+	// source-address
+	CriticalOptions map[string]string `yaml:"criticalOptions"`
+	// Allowed extension patterns. Other extensions are removed. Empty
+	// allows all
+	Extensions []string `yaml:"extensions"`
+	// Command forced on every certificate regardless of the critical options
+	// set by the backends, e.g. a session recording wrapper. Rendered as a
+	// template with .Subject and .Principals
+	ForceCommand string `yaml:"forceCommand"`
+	// Set to "client" to restrict the certificate to the requester address
+	// with the source-address critical option
+	SourceAddress string `yaml:"sourceAddress"`
+	// Widen the client address to a network of this size. Defaults to the
+	// single address
+	SourceAddressPrefixV4 int `yaml:"sourceAddressPrefixV4"`
+	SourceAddressPrefixV6 int `yaml:"sourceAddressPrefixV6"`
+	// Key id with identity variables like the server keyIDFormat, which it
+	// overrides
+	KeyID string `yaml:"keyID"`
+	// Vendor extensions from formats with identity variables, e.g.
+	// employee-id@example.com: "%{identity.employee_id}". Extensions
+	// expanding to empty are left out
+	IdentityExtensions map[string]string `yaml:"identityExtensions"`
+	// Names of the CA keys certificates may be signed with. The first one is
+	// used unless the request selects another. Empty allows any CA key
+	CAs []string `yaml:"cas"`
+}
+
+// Binding applies a template to the auth contexts matching all the given
+// criteria. Empty criteria match anything
+type BindingConfig struct {
+	// Authenticator name patterns, any authenticator in the chain may match
+	Backends []string `yaml:"backends"`
+	// Subject name patterns
+	Subjects []string `yaml:"subjects"`
+	// Group patterns. Auth backends expose group memberships as principals
+	Groups   []string `yaml:"groups"`
+	Template string   `yaml:"template"`
+}
+
+type Config struct {
+	Enabled   bool             `yaml:"enabled"`
+	Templates []TemplateConfig `yaml:"templates"`
+	// Bindings are evaluated in order, the first match wins
+	Bindings []BindingConfig `yaml:"bindings"`
+	// Template used when no binding matches. If empty, signing is denied
+	DefaultTemplate string `yaml:"defaultTemplate"`
+}
+
+var Defaults = &Config{
+	Enabled:         false,
+	Templates:       []TemplateConfig{},
+	Bindings:        []BindingConfig{},
+	DefaultTemplate: "",
+}
@@ -0,0 +1,20 @@
+package policy
+
+import (
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var Log *logrus.Entry = logging.GetLogger("policy").WithField("pkg", "policy")
+
+const (
+	SourceAddressClient = "client"
+
+	optSourceAddress = "source-address"
+	optForceCommand  = "force-command"
+)
+
+func init() {
+	config.SetDefault("policy", Defaults)
+}
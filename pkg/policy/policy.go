@@ -0,0 +1,396 @@
+package policy
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	ErrNoPolicy            = errors.New("no certificate policy matches the user")
+	ErrNoPrincipals        = errors.New("no principals allowed by the certificate policy")
+	ErrNoClientAddress     = errors.New("client address is not known")
+	ErrSourceAddressDenied = errors.New("client address is not allowed by the certificate source-address")
+)
+
+// Template is a compiled certificate policy template
+type Template struct {
+	Name            string
+	principals      []glob.Glob
+	defaultLifetime time.Duration
+	maxLifetime     time.Duration
+	criticalOptions map[string]string
+	extensions      []glob.Glob
+	forceCommand    *template.Template
+	sourceAddress   bool
+	prefixV4        int
+	prefixV6        int
+	cas             []string
+	keyID           string
+	identityExts    map[string]string
+}
+
+// Request details the templates are applied with
+type Request struct {
+	Subject  string
+	ClientIP net.IP
+	// For the identity variables of the key id and extensions
+	AuthContext *auth.AuthContext
+}
+
+type binding struct {
+	backends []glob.Glob
+	subjects []glob.Glob
+	groups   []glob.Glob
+	template *Template
+}
+
+// Engine selects the policy template for an auth context
+type Engine struct {
+	templates map[string]*Template
+	bindings  []binding
+	def       *Template
+}
+
+func compileGlobs(patterns []string) ([]glob.Glob, error) {
+	globs := make([]glob.Glob, 0, len(patterns))
+	for _, p := range patterns {
+		g, err := glob.Compile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", p)
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+func matchAny(globs []glob.Glob, values ...string) bool {
+	for _, g := range globs {
+		for _, v := range values {
+			if g.Match(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func newTemplate(conf TemplateConfig) (*Template, error) {
+	if conf.Name == "" {
+		return nil, errors.New("template name is required")
+	}
+	t := &Template{
+		Name:            conf.Name,
+		criticalOptions: conf.CriticalOptions,
+		cas:             conf.CAs,
+		keyID:           conf.KeyID,
+		identityExts:    conf.IdentityExtensions,
+	}
+	if err := auth.CheckVariables(conf.KeyID); err != nil {
+		return nil, errors.Wrap(err, "invalid keyID")
+	}
+	if err := auth.CheckExtensions(conf.IdentityExtensions); err != nil {
+		return nil, err
+	}
+	var err error
+	if t.principals, err = compileGlobs(conf.Principals); err != nil {
+		return nil, errors.Wrap(err, "invalid principals")
+	}
+	if t.extensions, err = compileGlobs(conf.Extensions); err != nil {
+		return nil, errors.Wrap(err, "invalid extensions")
+	}
+	if t.defaultLifetime, err = parseDuration(conf.DefaultLifetime); err != nil {
+		return nil, errors.Wrap(err, "invalid defaultLifetime")
+	}
+	if t.maxLifetime, err = parseDuration(conf.MaxLifetime); err != nil {
+		return nil, errors.Wrap(err, "invalid maxLifetime")
+	}
+	if t.maxLifetime != 0 && t.defaultLifetime > t.maxLifetime {
+		return nil, errors.New("defaultLifetime exceeds maxLifetime")
+	}
+	if conf.ForceCommand != "" {
+		if t.forceCommand, err = template.New("forceCommand").Option("missingkey=error").Parse(conf.ForceCommand); err != nil {
+			return nil, errors.Wrap(err, "invalid forceCommand")
+		}
+	}
+	switch conf.SourceAddress {
+	case "":
+	case SourceAddressClient:
+		t.sourceAddress = true
+	default:
+		return nil, errors.Errorf("invalid sourceAddress %q", conf.SourceAddress)
+	}
+	t.prefixV4, t.prefixV6 = conf.SourceAddressPrefixV4, conf.SourceAddressPrefixV6
+	if t.prefixV4 == 0 {
+		t.prefixV4 = 8 * net.IPv4len
+	}
+	if t.prefixV6 == 0 {
+		t.prefixV6 = 8 * net.IPv6len
+	}
+	if t.prefixV4 < 0 || t.prefixV4 > 8*net.IPv4len || t.prefixV6 < 0 || t.prefixV6 > 8*net.IPv6len {
+		return nil, errors.New("invalid source address prefix length")
+	}
+	return t, nil
+}
+
+func New(conf *Config) (*Engine, error) {
+	e := &Engine{templates: make(map[string]*Template)}
+	for _, tc := range conf.Templates {
+		t, err := newTemplate(tc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "policy template %q", tc.Name)
+		}
+		if _, ok := e.templates[t.Name]; ok {
+			return nil, errors.Errorf("duplicate policy template %q", t.Name)
+		}
+		e.templates[t.Name] = t
+	}
+	for i, bc := range conf.Bindings {
+		b := binding{template: e.templates[bc.Template]}
+		if b.template == nil {
+			return nil, errors.Errorf("policy binding %d: unknown template %q", i, bc.Template)
+		}
+		var err error
+		if b.backends, err = compileGlobs(bc.Backends); err != nil {
+			return nil, errors.Wrapf(err, "policy binding %d: invalid backends", i)
+		}
+		if b.subjects, err = compileGlobs(bc.Subjects); err != nil {
+			return nil, errors.Wrapf(err, "policy binding %d: invalid subjects", i)
+		}
+		if b.groups, err = compileGlobs(bc.Groups); err != nil {
+			return nil, errors.Wrapf(err, "policy binding %d: invalid groups", i)
+		}
+		e.bindings = append(e.bindings, b)
+	}
+	if conf.DefaultTemplate != "" {
+		if e.def = e.templates[conf.DefaultTemplate]; e.def == nil {
+			return nil, errors.Errorf("unknown default policy template %q", conf.DefaultTemplate)
+		}
+	}
+	return e, nil
+}
+
+// Setup the policy engine from the configuration. Returns nil if policies
+// are not enabled
+func Setup() (*Engine, error) {
+	tmp, err := config.Get("policy")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot initialize policy")
+	}
+	conf, _ := tmp.(*Config)
+	if conf == nil {
+		return nil, errors.New("cannot initialize policy. Invalid configuration")
+	}
+	if !conf.Enabled {
+		return nil, nil
+	}
+	e, err := New(conf)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot initialize policy")
+	}
+	Log.WithField("templates", len(e.templates)).WithField("bindings", len(e.bindings)).Info("certificate policy enabled")
+	return e, nil
+}
+
+func (b *binding) matches(actx *auth.AuthContext) bool {
+	if len(b.backends) > 0 && !matchAny(b.backends, actx.GetAuthenticators()...) {
+		return false
+	}
+	if len(b.subjects) > 0 && !matchAny(b.subjects, actx.GetSubjectName()) {
+		return false
+	}
+	if len(b.groups) > 0 && !matchAny(b.groups, actx.GetPrincipals()...) {
+		return false
+	}
+	return true
+}
+
+// Whether any template sets the key id
+func (e *Engine) SetsKeyID() bool {
+	for _, t := range e.templates {
+		if t.keyID != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the template for the auth context
+func (e *Engine) Lookup(actx *auth.AuthContext) (*Template, error) {
+	for i := range e.bindings {
+		if e.bindings[i].matches(actx) {
+			return e.bindings[i].template, nil
+		}
+	}
+	if e.def != nil {
+		return e.def, nil
+	}
+	return nil, ErrNoPolicy
+}
+
+// Return the effective default and maximum lifetimes given the server
+// limits
+func (t *Template) Lifetimes(def, max time.Duration) (time.Duration, time.Duration) {
+	if t.maxLifetime != 0 && t.maxLifetime < max {
+		max = t.maxLifetime
+	}
+	if t.defaultLifetime != 0 {
+		def = t.defaultLifetime
+	}
+	if def > max {
+		def = max
+	}
+	return def, max
+}
+
+// Return the CA key to sign with given the one requested, which may be
+// empty
+func (t *Template) SelectCA(requested string) (string, error) {
+	if len(t.cas) == 0 {
+		return requested, nil
+	}
+	if requested == "" {
+		return t.cas[0], nil
+	}
+	for _, ca := range t.cas {
+		if ca == requested {
+			return ca, nil
+		}
+	}
+	return "", errors.Errorf("CA %s is not allowed by policy %s", requested, t.Name)
+}
+
+// Restrict the certificate principals and extensions and set the required
+// critical options
+func (t *Template) Apply(cert *ssh.Certificate, req Request) error {
+	if len(t.principals) > 0 {
+		var principals []string
+		for _, p := range cert.ValidPrincipals {
+			if matchAny(t.principals, p) {
+				principals = append(principals, p)
+			}
+		}
+		cert.ValidPrincipals = principals
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return ErrNoPrincipals
+	}
+	if len(t.extensions) > 0 {
+		for k := range cert.Extensions {
+			if !matchAny(t.extensions, k) {
+				delete(cert.Extensions, k)
+			}
+		}
+	}
+	if t.keyID != "" || len(t.identityExts) > 0 {
+		actx := req.AuthContext
+		if actx == nil {
+			actx = &auth.AuthContext{SubjectName: req.Subject}
+		}
+		if t.keyID != "" {
+			kid, err := auth.Expand(t.keyID, actx)
+			if err != nil {
+				return errors.Wrap(err, "cannot expand keyID")
+			}
+			cert.KeyId = kid
+		}
+		if err := auth.ExpandExtensions(t.identityExts, actx, cert); err != nil {
+			return err
+		}
+	}
+	if len(t.criticalOptions) > 0 && cert.CriticalOptions == nil {
+		cert.CriticalOptions = make(map[string]string)
+	}
+	for k, v := range t.criticalOptions {
+		cert.CriticalOptions[k] = v
+	}
+	if t.forceCommand != nil {
+		buf := &bytes.Buffer{}
+		data := map[string]interface{}{
+			"Subject":    req.Subject,
+			"Principals": cert.ValidPrincipals,
+		}
+		if err := t.forceCommand.Execute(buf, data); err != nil {
+			return errors.Wrap(err, "cannot render forceCommand")
+		}
+		if cert.CriticalOptions == nil {
+			cert.CriticalOptions = make(map[string]string)
+		}
+		cert.CriticalOptions[optForceCommand] = buf.String()
+	}
+	if t.sourceAddress {
+		if req.ClientIP == nil {
+			return ErrNoClientAddress
+		}
+		addr, err := t.clientSourceAddress(req.ClientIP, cert.CriticalOptions[optSourceAddress])
+		if err != nil {
+			return err
+		}
+		if cert.CriticalOptions == nil {
+			cert.CriticalOptions = make(map[string]string)
+		}
+		cert.CriticalOptions[optSourceAddress] = addr
+	}
+	return nil
+}
+
+// Derive the source-address from the client address. An existing
+// source-address is never widened: the client must be within it and the
+// derived network is narrowed to the client address if it does not fit
+func (t *Template) clientSourceAddress(ip net.IP, existing string) (string, error) {
+	bits, prefix := 8*net.IPv6len, t.prefixV6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, prefix = ip4, 8*net.IPv4len, t.prefixV4
+	}
+	derived := &net.IPNet{IP: ip.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+	if existing == "" {
+		return derived.String(), nil
+	}
+	var allowed []*net.IPNet
+	for _, s := range strings.Split(existing, ",") {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			if a := net.ParseIP(s); a != nil && a.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return "", errors.Wrapf(err, "invalid source-address %q", existing)
+		}
+		allowed = append(allowed, n)
+	}
+	within := false
+	for _, n := range allowed {
+		if !n.Contains(ip) {
+			continue
+		}
+		within = true
+		ones, _ := n.Mask.Size()
+		if ones <= prefix {
+			return derived.String(), nil
+		}
+	}
+	if !within {
+		return "", ErrSourceAddressDenied
+	}
+	host := &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	return host.String(), nil
+}
@@ -0,0 +1,243 @@
+package policy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+var testConfig = &Config{
+	Enabled: true,
+	Templates: []TemplateConfig{
+		{
+			Name:            "admins",
+			MaxLifetime:     "12h",
+			DefaultLifetime: "4h",
+		},
+		{
+			Name:            "developers",
+			Principals:      []string{"dev-*", "alice"},
+			MaxLifetime:     "1h",
+			CriticalOptions: map[string]string{"source-address": "10.0.0.0/8"},
+			Extensions:      []string{"permit-pty", "permit-port-*"},
+		},
+		{
+			Name:       "readonly",
+			Principals: []string{"readonly"},
+		},
+	},
+	Bindings: []BindingConfig{
+		{Backends: []string{"ldap"}, Groups: []string{"ssh-admins"}, Template: "admins"},
+		{Groups: []string{"dev-*"}, Template: "developers"},
+		{Subjects: []string{"bot-*"}, Template: "readonly"},
+	},
+}
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+	_, err := New(testConfig)
+	assert.NoError(err)
+
+	_, err = New(&Config{Bindings: []BindingConfig{{Template: "missing"}}})
+	assert.Error(err)
+	_, err = New(&Config{DefaultTemplate: "missing"})
+	assert.Error(err)
+	_, err = New(&Config{Templates: []TemplateConfig{{Name: "a"}, {Name: "a"}}})
+	assert.Error(err)
+	_, err = New(&Config{Templates: []TemplateConfig{{Name: "a", MaxLifetime: "1h", DefaultLifetime: "2h"}}})
+	assert.Error(err)
+	_, err = New(&Config{Templates: []TemplateConfig{{Name: "a", Principals: []string{"[a"}}}})
+	assert.Error(err)
+}
+
+func TestLookup(t *testing.T) {
+	assert := assert.New(t)
+	e, _ := New(testConfig)
+
+	ctx := &auth.AuthContext{Authenticator: "ldap", SubjectName: "alice", Principals: []string{"ssh-admins", "dev-web"}}
+	tmpl, err := e.Lookup(ctx)
+	if assert.NoError(err) {
+		assert.Equal("admins", tmpl.Name)
+	}
+	// Backend mismatch falls through to the next binding
+	ctx.Authenticator = "file"
+	tmpl, err = e.Lookup(ctx)
+	if assert.NoError(err) {
+		assert.Equal("developers", tmpl.Name)
+	}
+	tmpl, err = e.Lookup(&auth.AuthContext{SubjectName: "bot-ci", Principals: []string{"x"}})
+	if assert.NoError(err) {
+		assert.Equal("readonly", tmpl.Name)
+	}
+	_, err = e.Lookup(&auth.AuthContext{SubjectName: "mallory", Principals: []string{"x"}})
+	assert.Equal(ErrNoPolicy, err)
+
+	e.def = e.templates["readonly"]
+	tmpl, err = e.Lookup(&auth.AuthContext{SubjectName: "mallory"})
+	if assert.NoError(err) {
+		assert.Equal("readonly", tmpl.Name)
+	}
+}
+
+func TestApply(t *testing.T) {
+	assert := assert.New(t)
+	e, _ := New(testConfig)
+
+	cert := &ssh.Certificate{
+		ValidPrincipals: []string{"dev-web", "root", "alice"},
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{
+				"permit-pty":              "",
+				"permit-port-forwarding":  "",
+				"permit-agent-forwarding": "",
+			},
+		},
+	}
+	tmpl := e.templates["developers"]
+	assert.NoError(tmpl.Apply(cert, Request{}))
+	assert.Equal([]string{"dev-web", "alice"}, cert.ValidPrincipals)
+	assert.Equal(map[string]string{"permit-pty": "", "permit-port-forwarding": ""}, cert.Extensions)
+	assert.Equal(map[string]string{"source-address": "10.0.0.0/8"}, cert.CriticalOptions)
+
+	def, max := tmpl.Lifetimes(2*time.Hour, 24*time.Hour)
+	assert.Equal(time.Hour, def)
+	assert.Equal(time.Hour, max)
+	def, max = e.templates["admins"].Lifetimes(time.Hour, 8*time.Hour)
+	assert.Equal(4*time.Hour, def)
+	assert.Equal(8*time.Hour, max)
+
+	cert = &ssh.Certificate{ValidPrincipals: []string{"root"}}
+	assert.Equal(ErrNoPrincipals, e.templates["readonly"].Apply(cert, Request{}))
+}
+
+func TestSourceAddress(t *testing.T) {
+	assert := assert.New(t)
+	newTpl := func(conf TemplateConfig) *Template {
+		conf.Name = "test"
+		tmpl, err := newTemplate(conf)
+		assert.NoError(err)
+		return tmpl
+	}
+	apply := func(tmpl *Template, ip string, existing string) (string, error) {
+		cert := &ssh.Certificate{ValidPrincipals: []string{"a"}}
+		if existing != "" {
+			cert.CriticalOptions = map[string]string{"source-address": existing}
+		}
+		err := tmpl.Apply(cert, Request{ClientIP: net.ParseIP(ip)})
+		return cert.CriticalOptions["source-address"], err
+	}
+
+	exact := newTpl(TemplateConfig{SourceAddress: SourceAddressClient})
+	v, err := apply(exact, "192.0.2.10", "")
+	assert.NoError(err)
+	assert.Equal("192.0.2.10/32", v)
+	v, err = apply(exact, "2001:db8::1", "")
+	assert.NoError(err)
+	assert.Equal("2001:db8::1/128", v)
+	_, err = apply(exact, "", "")
+	assert.Equal(ErrNoClientAddress, err)
+
+	wide := newTpl(TemplateConfig{SourceAddress: SourceAddressClient, SourceAddressPrefixV4: 24, SourceAddressPrefixV6: 64})
+	v, _ = apply(wide, "192.0.2.10", "")
+	assert.Equal("192.0.2.0/24", v)
+	v, _ = apply(wide, "2001:db8::1", "")
+	assert.Equal("2001:db8::/64", v)
+
+	// Existing source-address is never widened
+	v, err = apply(wide, "192.0.2.10", "10.0.0.0/8,192.0.0.0/16")
+	assert.NoError(err)
+	assert.Equal("192.0.2.0/24", v)
+	v, err = apply(wide, "192.0.2.10", "192.0.2.0/28")
+	assert.NoError(err)
+	assert.Equal("192.0.2.10/32", v)
+	v, err = apply(wide, "192.0.2.10", "192.0.2.10")
+	assert.NoError(err)
+	assert.Equal("192.0.2.10/32", v)
+	_, err = apply(wide, "198.51.100.1", "192.0.2.0/24")
+	assert.Equal(ErrSourceAddressDenied, err)
+
+	_, err = newTemplate(TemplateConfig{Name: "a", SourceAddress: "invalid"})
+	assert.Error(err)
+	_, err = newTemplate(TemplateConfig{Name: "a", SourceAddressPrefixV4: 33})
+	assert.Error(err)
+}
+
+func TestForceCommand(t *testing.T) {
+	assert := assert.New(t)
+	tmpl, err := newTemplate(TemplateConfig{
+		Name:         "contractors",
+		ForceCommand: "/usr/bin/record-session --user {{.Subject}}",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	// Overrides the force-command set by the backend
+	cert := &ssh.Certificate{
+		ValidPrincipals: []string{"a"},
+		Permissions: ssh.Permissions{
+			CriticalOptions: map[string]string{"force-command": "/bin/sh"},
+		},
+	}
+	assert.NoError(tmpl.Apply(cert, Request{Subject: "alice"}))
+	assert.Equal("/usr/bin/record-session --user alice", cert.CriticalOptions["force-command"])
+
+	_, err = newTemplate(TemplateConfig{Name: "a", ForceCommand: "{{"})
+	assert.Error(err)
+}
+
+func TestIdentity(t *testing.T) {
+	assert := assert.New(t)
+	tmpl, err := newTemplate(TemplateConfig{
+		Name:       "contractors",
+		Extensions: []string{"permit-pty"},
+		KeyID:      "%u employee=%{identity.employee_id}",
+		IdentityExtensions: map[string]string{
+			"mfa@example.com":       "%{identity.mfa}",
+			"device-id@example.com": "%{identity.device_id}",
+		},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	actx := &auth.AuthContext{SubjectName: "alice"}
+	actx.AddIdentity(auth.IdentityEmployeeID, "1234")
+	actx.AddIdentity(auth.IdentityMFA, "pwd", "otp")
+	cert := &ssh.Certificate{
+		KeyId:           "subject=\"alice\"",
+		ValidPrincipals: []string{"a"},
+		Permissions: ssh.Permissions{
+			Extensions: map[string]string{"permit-pty": "", "vendor@example.com": "x"},
+		},
+	}
+	// Added after the allowed extensions are applied
+	assert.NoError(tmpl.Apply(cert, Request{Subject: "alice", AuthContext: actx}))
+	assert.Equal("alice employee=1234", cert.KeyId)
+	assert.Equal(map[string]string{"permit-pty": "", "mfa@example.com": "pwd,otp"}, cert.Extensions)
+
+	_, err = newTemplate(TemplateConfig{Name: "a", KeyID: "%{unknown}"})
+	assert.Error(err)
+	_, err = newTemplate(TemplateConfig{Name: "a", IdentityExtensions: map[string]string{"@example.com": "%u"}})
+	assert.Error(err)
+}
+
+func TestSelectCA(t *testing.T) {
+	assert := assert.New(t)
+	open, _ := newTemplate(TemplateConfig{Name: "open"})
+	ca, err := open.SelectCA("")
+	assert.NoError(err)
+	assert.Empty(ca)
+	ca, _ = open.SelectCA("staging")
+	assert.Equal("staging", ca)
+
+	restricted, _ := newTemplate(TemplateConfig{Name: "staging", CAs: []string{"staging", "staging-next"}})
+	ca, _ = restricted.SelectCA("")
+	assert.Equal("staging", ca)
+	ca, _ = restricted.SelectCA("staging-next")
+	assert.Equal("staging-next", ca)
+	_, err = restricted.SelectCA("default")
+	assert.Error(err)
+}
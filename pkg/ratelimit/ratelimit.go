@@ -0,0 +1,125 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Buckets idle for this long are full again and can be dropped
+const pruneInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a token bucket rate limiter keyed by an arbitrary string such
+// as user identity or source address
+type Limiter struct {
+	sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	now       func() time.Time
+
+	shared Counter
+	name   string
+}
+
+// Counter with expiring keys shared between server replicas
+type Counter interface {
+	Incr(key string, ttl time.Duration) (int64, error)
+}
+
+// New limiter allowing rate requests per second on average with bursts of
+// burst requests. Burst defaults to one
+func New(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Share the limit between replicas using the counter. Shared limits use a
+// fixed window of burst/rate seconds allowing burst requests per window. The
+// name separates the limiters sharing the counter. If the counter fails the
+// local bucket is used
+func (l *Limiter) WithCounter(c Counter, name string) *Limiter {
+	l.shared = c
+	l.name = name
+	return l
+}
+
+// Take a token for the key. If none is available, returns false and the
+// time until the next token
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l.shared != nil {
+		ok, wait, err := l.allowShared(key)
+		if err == nil {
+			return ok, wait
+		}
+	}
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	l.prune(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+func (l *Limiter) allowShared(key string) (bool, time.Duration, error) {
+	window := time.Duration(l.burst / l.rate * float64(time.Second))
+	if window <= 0 {
+		window = time.Second
+	}
+	now := l.now()
+	start := now.Truncate(window)
+	k := fmt.Sprintf("ratelimit:%s:%s:%d", l.name, key, start.UnixNano()/int64(window))
+	n, err := l.shared.Incr(k, window)
+	if err != nil {
+		return false, 0, err
+	}
+	if float64(n) > l.burst {
+		return false, start.Add(window).Sub(now), nil
+	}
+	return true, 0, nil
+}
+
+// Drop the buckets that have refilled. Must be called with the lock held
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < pruneInterval {
+		return
+	}
+	l.lastPrune = now
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Number of tracked keys
+func (l *Limiter) Len() int {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.buckets)
+}
@@ -0,0 +1,83 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1000, 0)
+	l := New(0.5, 2)
+	l.now = func() time.Time { return now }
+
+	ok, _ := l.Allow("a")
+	assert.True(ok)
+	ok, _ = l.Allow("a")
+	assert.True(ok)
+	ok, wait := l.Allow("a")
+	assert.False(ok)
+	assert.Equal(2*time.Second, wait)
+
+	// Keys are independent
+	ok, _ = l.Allow("b")
+	assert.True(ok)
+
+	now = now.Add(time.Second)
+	ok, wait = l.Allow("a")
+	assert.False(ok)
+	assert.Equal(time.Second, wait)
+	now = now.Add(time.Second)
+	ok, _ = l.Allow("a")
+	assert.True(ok)
+
+	// Refilled buckets are pruned
+	now = now.Add(time.Hour)
+	l.Allow("c")
+	assert.Equal(1, l.Len())
+}
+
+type mapCounter struct {
+	counts map[string]int64
+	fail   bool
+}
+
+func (m *mapCounter) Incr(key string, ttl time.Duration) (int64, error) {
+	if m.fail {
+		return 0, errors.New("unavailable")
+	}
+	m.counts[key]++
+	return m.counts[key], nil
+}
+
+func TestSharedLimiter(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1000, 0)
+	c := &mapCounter{counts: map[string]int64{}}
+	// Two replicas sharing the counter
+	a := New(0.5, 2).WithCounter(c, "sign")
+	a.now = func() time.Time { return now }
+	b := New(0.5, 2).WithCounter(c, "sign")
+	b.now = func() time.Time { return now }
+
+	ok, _ := a.Allow("u")
+	assert.True(ok)
+	ok, _ = b.Allow("u")
+	assert.True(ok)
+	ok, wait := a.Allow("u")
+	assert.False(ok)
+	assert.Equal(4*time.Second, wait)
+
+	// Next window
+	now = now.Add(4 * time.Second)
+	ok, _ = b.Allow("u")
+	assert.True(ok)
+
+	// Local bucket is used if the counter fails
+	c.fail = true
+	ok, _ = a.Allow("u")
+	assert.True(ok)
+}
@@ -0,0 +1,84 @@
+package revocation
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+
+	"github.com/aakso/ssh-inscribe/pkg/storage/sqlutil"
+	"github.com/pkg/errors"
+)
+
+// Backend persists the encoded store
+type Backend interface {
+	// Returns nil if nothing has been saved yet
+	Load() ([]byte, error)
+	Save(data []byte) error
+}
+
+// Keeps the store in a JSON file, replaced atomically on save
+type FileBackend struct {
+	Path string
+}
+
+func (b *FileBackend) Load() ([]byte, error) {
+	raw, err := ioutil.ReadFile(b.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return raw, err
+}
+
+func (b *FileBackend) Save(data []byte) error {
+	tmp := b.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.Path)
+}
+
+const sqlSchema = `CREATE TABLE IF NOT EXISTS revocations (
+	id INTEGER PRIMARY KEY,
+	data TEXT NOT NULL
+)`
+
+// Keeps the store in a single row using database/sql with SQLite or
+// PostgreSQL dialect
+type SQLBackend struct {
+	db       *sql.DB
+	postgres bool
+}
+
+func NewSQLBackend(driver, dsn string) (*SQLBackend, error) {
+	db, err := sqlutil.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqlSchema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "cannot create schema")
+	}
+	return &SQLBackend{
+		db:       db,
+		postgres: sqlutil.IsPostgres(driver),
+	}, nil
+}
+
+func (b *SQLBackend) Load() ([]byte, error) {
+	var data string
+	err := b.db.QueryRow("SELECT data FROM revocations WHERE id = 1").Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return []byte(data), err
+}
+
+func (b *SQLBackend) Save(data []byte) error {
+	q := "INSERT INTO revocations (id, data) VALUES (1, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data"
+	_, err := b.db.Exec(sqlutil.Rebind(b.postgres, q), string(data))
+	return err
+}
+
+func (b *SQLBackend) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,355 @@
+package revocation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/krl"
+	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+var Log = logging.GetLogger("revocation").WithField("pkg", "revocation")
+
+// Revocation entry. Exactly one of Serial, KeyID, PublicKey or Fingerprint
+// is set
+type Entry struct {
+	Serial uint64 `json:"serial,omitempty"`
+	KeyID  string `json:"key_id,omitempty"`
+	// Public key in authorized_keys format
+	PublicKey string `json:"public_key,omitempty"`
+	// Public key fingerprint in the SHA256:<base64> format
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	RevokedBy   string    `json:"revoked_by,omitempty"`
+	RevokedAt   time.Time `json:"revoked_at"`
+	// Entry is left out of the KRL after this as the certificate has expired
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (e *Entry) validate() error {
+	n := 0
+	if e.Serial != 0 {
+		n++
+	}
+	if e.KeyID != "" {
+		n++
+	}
+	if e.PublicKey != "" {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(e.PublicKey)); err != nil {
+			return errors.Wrap(err, "invalid public key")
+		}
+		n++
+	}
+	if e.Fingerprint != "" {
+		if _, err := decodeFingerprint(e.Fingerprint); err != nil {
+			return err
+		}
+		n++
+	}
+	if n != 1 {
+		return errors.New("exactly one of serial, key_id, public_key or fingerprint must be set")
+	}
+	return nil
+}
+
+func (e *Entry) expired(now time.Time) bool {
+	return e.Expires != nil && e.Expires.Before(now)
+}
+
+// Matches reports whether the entry revokes the given certificate
+func (e *Entry) Matches(cert *ssh.Certificate) bool {
+	switch {
+	case e.Serial != 0:
+		return cert.Serial == e.Serial
+	case e.KeyID != "":
+		return cert.KeyId == e.KeyID
+	case e.PublicKey != "" && cert.Key != nil:
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(e.PublicKey))
+		if err != nil {
+			return false
+		}
+		return bytes.Equal(key.Marshal(), cert.Key.Marshal())
+	case e.Fingerprint != "" && cert.Key != nil:
+		return ssh.FingerprintSHA256(cert.Key) == e.Fingerprint
+	}
+	return false
+}
+
+func decodeFingerprint(fp string) ([]byte, error) {
+	if !strings.HasPrefix(fp, "SHA256:") {
+		return nil, errors.New("fingerprint must be in the SHA256:<base64> format")
+	}
+	h, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(fp, "SHA256:"))
+	if err != nil || len(h) != sha256.Size {
+		return nil, errors.New("invalid fingerprint")
+	}
+	return h, nil
+}
+
+type storeData struct {
+	Version uint64  `json:"version"`
+	Entries []Entry `json:"entries"`
+	// Last entry applied from the shared log
+	Synced int64 `json:"synced,omitempty"`
+}
+
+const (
+	sharedSeqKey   = "revocations:seq"
+	sharedEntryKey = "revocations:entry:"
+	// Shared log is checked for new entries at most this often
+	sharedRefreshInterval = time.Second
+	// Entry missing from the shared log, due to a replica failing between
+	// allocating and writing it, is skipped after this long
+	sharedGapTimeout = 30 * time.Second
+)
+
+// Shared is a key value store shared by server replicas
+type Shared interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Incr(key string, ttl time.Duration) (int64, error)
+}
+
+// Store keeps the revoked entries and persists them with the backend.
+// Without a backend the store is kept in memory only
+type Store struct {
+	sync.RWMutex
+	backend Backend
+	data    storeData
+
+	shared      Shared
+	lastRefresh time.Time
+	gapSince    time.Time
+}
+
+// Open a store persisted into a JSON file. With an empty path the store is
+// kept in memory only
+func NewStore(path string) (*Store, error) {
+	if path == "" {
+		return &Store{}, nil
+	}
+	return NewStoreWithBackend(&FileBackend{Path: path})
+}
+
+func NewStoreWithBackend(b Backend) (*Store, error) {
+	s := &Store{backend: b}
+	raw, err := b.Load()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot read revocation store")
+	}
+	if raw == nil {
+		return s, nil
+	}
+	if err := json.Unmarshal(raw, &s.data); err != nil {
+		return nil, errors.Wrap(err, "cannot parse revocation store")
+	}
+	Log.WithField("entries", len(s.data.Entries)).Debug("loaded revocation store")
+	return s, nil
+}
+
+func (s *Store) save() error {
+	if s.backend == nil {
+		return nil
+	}
+	raw, err := json.MarshalIndent(&s.data, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "cannot encode revocation store")
+	}
+	if err := s.backend.Save(raw); err != nil {
+		return errors.Wrap(err, "cannot write revocation store")
+	}
+	return nil
+}
+
+// Share the revocations with other replicas. Revocations are appended to a
+// log in the shared store and applied to the local store as they are seen.
+// Entries revoked before sharing was enabled stay local
+func (s *Store) SetShared(shared Shared) {
+	s.Lock()
+	defer s.Unlock()
+	s.shared = shared
+	s.lastRefresh = time.Time{}
+}
+
+// Apply new entries from the shared log
+func (s *Store) refresh(force bool) {
+	s.RLock()
+	due := s.shared != nil && (force || time.Since(s.lastRefresh) >= sharedRefreshInterval)
+	s.RUnlock()
+	if !due {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if err := s.sync(); err != nil {
+		Log.WithError(err).Warn("cannot refresh shared revocations")
+	}
+}
+
+// Must be called with the lock held
+func (s *Store) sync() error {
+	now := time.Now()
+	s.lastRefresh = now
+	raw, err := s.shared.Get(sharedSeqKey)
+	if err != nil {
+		// Nothing revoked yet
+		return nil
+	}
+	head, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "invalid shared revocation sequence")
+	}
+	changed := false
+	for n := s.data.Synced + 1; n <= head; n++ {
+		raw, err := s.shared.Get(sharedEntryKey + strconv.FormatInt(n, 10))
+		if err != nil {
+			if s.gapSince.IsZero() {
+				s.gapSince = now
+			}
+			if now.Sub(s.gapSince) < sharedGapTimeout {
+				break
+			}
+			Log.WithField("entry", n).Warn("skipping missing shared revocation entry")
+		} else {
+			var e Entry
+			if err := json.Unmarshal(raw, &e); err != nil {
+				Log.WithError(err).WithField("entry", n).Error("invalid shared revocation entry")
+			} else {
+				s.data.Entries = append(s.data.Entries, e)
+				s.data.Version++
+			}
+		}
+		s.gapSince = time.Time{}
+		s.data.Synced = n
+		changed = true
+	}
+	if changed {
+		return s.save()
+	}
+	return nil
+}
+
+// Add a revocation entry and persist the store
+func (s *Store) Revoke(e Entry) error {
+	if err := e.validate(); err != nil {
+		return err
+	}
+	if e.RevokedAt.IsZero() {
+		e.RevokedAt = time.Now().UTC()
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.shared != nil {
+		raw, err := json.Marshal(&e)
+		if err != nil {
+			return errors.Wrap(err, "cannot encode revocation entry")
+		}
+		n, err := s.shared.Incr(sharedSeqKey, 0)
+		if err != nil {
+			return errors.Wrap(err, "cannot revoke")
+		}
+		if err := s.shared.Set(sharedEntryKey+strconv.FormatInt(n, 10), raw, 0); err != nil {
+			return errors.Wrap(err, "cannot revoke")
+		}
+		return s.sync()
+	}
+	s.data.Entries = append(s.data.Entries, e)
+	s.data.Version++
+	if err := s.save(); err != nil {
+		s.data.Entries = s.data.Entries[:len(s.data.Entries)-1]
+		s.data.Version--
+		return err
+	}
+	return nil
+}
+
+func (s *Store) Entries() []Entry {
+	s.refresh(false)
+	s.RLock()
+	defer s.RUnlock()
+	return append([]Entry(nil), s.data.Entries...)
+}
+
+// Version is incremented on each change
+func (s *Store) Version() uint64 {
+	s.refresh(false)
+	s.RLock()
+	defer s.RUnlock()
+	return s.data.Version
+}
+
+func (s *Store) IsRevoked(cert *ssh.Certificate) bool {
+	s.refresh(false)
+	s.RLock()
+	defer s.RUnlock()
+	for i := range s.data.Entries {
+		if s.data.Entries[i].Matches(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// Build a KRL from the non-expired entries. Serial and key id revocations
+// are scoped to each of the given CAs, or to any CA if none or nil is given
+func (s *Store) KRL(cas ...ssh.PublicKey) *krl.KRL {
+	s.refresh(false)
+	s.RLock()
+	defer s.RUnlock()
+	now := time.Now()
+	if len(cas) == 0 {
+		cas = []ssh.PublicKey{nil}
+	}
+	var (
+		serials []uint64
+		keyIDs  []string
+	)
+	k := &krl.KRL{
+		Version:       s.data.Version,
+		GeneratedDate: now,
+		Comment:       "ssh-inscribe",
+	}
+	for _, e := range s.data.Entries {
+		if e.expired(now) {
+			continue
+		}
+		switch {
+		case e.Serial != 0:
+			serials = append(serials, e.Serial)
+		case e.KeyID != "":
+			keyIDs = append(keyIDs, e.KeyID)
+		case e.PublicKey != "":
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(e.PublicKey))
+			if err != nil {
+				Log.WithError(err).Error("invalid public key in revocation store")
+				continue
+			}
+			k.Keys = append(k.Keys, key)
+		case e.Fingerprint != "":
+			h, err := decodeFingerprint(e.Fingerprint)
+			if err != nil {
+				Log.WithError(err).Error("invalid fingerprint in revocation store")
+				continue
+			}
+			k.SHA256Fingerprints = append(k.SHA256Fingerprints, h)
+		}
+	}
+	// Serials are allocated over all CA keys so every section gets the same
+	// revocations
+	for _, ca := range cas {
+		k.Certificates = append(k.Certificates, &krl.CertificateSection{
+			CA:      ca,
+			Serials: serials,
+			KeyIDs:  keyIDs,
+		})
+	}
+	return k
+}
@@ -0,0 +1,135 @@
+package revocation
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+const testPublicKey = `ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIKDlmQ+jPHDE7B5/2ZCq2m+ky6kXZCvtGb5j9RZLRSL4 test`
+
+func TestStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "revocationtest")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	fn := path.Join(dir, "revocations.json")
+
+	s, err := NewStore(fn)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Error(s.Revoke(Entry{}))
+	assert.Error(s.Revoke(Entry{Serial: 1, KeyID: "both"}))
+	assert.Error(s.Revoke(Entry{PublicKey: "invalid"}))
+	assert.Error(s.Revoke(Entry{Fingerprint: "MD5:invalid"}))
+
+	past := time.Now().Add(-time.Hour)
+	assert.NoError(s.Revoke(Entry{Serial: 10, Reason: "test"}))
+	assert.NoError(s.Revoke(Entry{KeyID: "revoked"}))
+	assert.NoError(s.Revoke(Entry{PublicKey: testPublicKey}))
+	assert.NoError(s.Revoke(Entry{KeyID: "expired", Expires: &past}))
+	assert.NoError(s.Revoke(Entry{Fingerprint: "SHA256:KUJHQ00IzkEmhH10HO3E7rddgARypH1pJgRH0ODbOHs"}))
+	assert.Equal(uint64(5), s.Version())
+
+	// Reload from disk
+	s, err = NewStore(fn)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Len(s.Entries(), 5)
+	assert.Equal(uint64(5), s.Version())
+	assert.Equal("test", s.Entries()[0].Reason)
+	assert.False(s.Entries()[0].RevokedAt.IsZero())
+
+	key, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(testPublicKey))
+	assert.True(s.IsRevoked(&ssh.Certificate{Serial: 10}))
+	assert.True(s.IsRevoked(&ssh.Certificate{KeyId: "revoked"}))
+	assert.True(s.IsRevoked(&ssh.Certificate{Key: key}))
+	assert.False(s.IsRevoked(&ssh.Certificate{Serial: 11, KeyId: "ok"}))
+
+	k := s.KRL(nil)
+	assert.Equal(uint64(5), k.Version)
+	if assert.Len(k.Certificates, 1) {
+		assert.Equal([]uint64{10}, k.Certificates[0].Serials)
+		assert.Equal([]string{"revoked"}, k.Certificates[0].KeyIDs)
+	}
+	assert.Len(k.Keys, 1)
+	assert.Len(k.SHA256Fingerprints, 1)
+
+	other, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(testPublicKey))
+	k = s.KRL(key, other)
+	if assert.Len(k.Certificates, 2) {
+		assert.Equal([]uint64{10}, k.Certificates[1].Serials)
+		assert.Equal(other, k.Certificates[1].CA)
+	}
+}
+
+func TestSQLBackend(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "revocationtest")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	dsn := path.Join(dir, "revocations.db")
+
+	for i := 0; i < 2; i++ {
+		b, err := NewSQLBackend("sqlite", dsn)
+		if !assert.NoError(err) {
+			return
+		}
+		s, err := NewStoreWithBackend(b)
+		if assert.NoError(err) {
+			assert.Len(s.Entries(), i)
+			assert.NoError(s.Revoke(Entry{Serial: uint64(i + 1)}))
+		}
+		assert.NoError(b.Close())
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	assert := assert.New(t)
+	key, _, _, _, _ := ssh.ParseAuthorizedKey([]byte(testPublicKey))
+	s, _ := NewStore("")
+	assert.NoError(s.Revoke(Entry{Fingerprint: ssh.FingerprintSHA256(key)}))
+	assert.True(s.IsRevoked(&ssh.Certificate{Key: key}))
+}
+
+func TestShared(t *testing.T) {
+	assert := assert.New(t)
+	shared := sharedstate.NewMemoryStore()
+	a, _ := NewStore("")
+	b, _ := NewStore("")
+	a.SetShared(shared)
+	b.SetShared(shared)
+
+	if !assert.NoError(a.Revoke(Entry{Serial: 10})) {
+		return
+	}
+	assert.NoError(b.Revoke(Entry{KeyID: "alice"}))
+	assert.Len(a.Entries(), 1)
+	// Refresh is throttled
+	time.Sleep(sharedRefreshInterval)
+	assert.Len(a.Entries(), 2)
+	assert.True(a.IsRevoked(&ssh.Certificate{KeyId: "alice"}))
+	assert.True(b.IsRevoked(&ssh.Certificate{Serial: 10}))
+	assert.Equal(uint64(2), a.Version())
+	assert.Equal(uint64(2), b.Version())
+
+	// Writer failing after allocating an entry
+	shared.Incr(sharedSeqKey, 0)
+	assert.NoError(a.Revoke(Entry{Serial: 11}))
+	assert.Len(a.Entries(), 2)
+	a.gapSince = time.Now().Add(-sharedGapTimeout)
+	a.refresh(true)
+	assert.Len(a.Entries(), 3)
+}
@@ -0,0 +1,110 @@
+// Package serial allocates certificate serial numbers
+package serial
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+type Generator interface {
+	// Return the next serial. Serials are never zero
+	Next() (uint64, error)
+}
+
+// Adapter for using a function as a Generator
+type GeneratorFunc func() (uint64, error)
+
+func (f GeneratorFunc) Next() (uint64, error) {
+	return f()
+}
+
+// Random serials, these don't survive restarts in any meaningful way but
+// are unlikely to repeat
+type Random struct{}
+
+func (Random) Next() (uint64, error) {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, errors.Wrap(err, "cannot generate serial")
+		}
+		if s := binary.BigEndian.Uint64(b[:]); s != 0 {
+			return s, nil
+		}
+	}
+}
+
+// Monotonic counter persisted to a file. The new value is written to disk
+// before it is handed out, so serials never repeat even after a crash
+type FileCounter struct {
+	sync.Mutex
+	path string
+	last uint64
+}
+
+func NewFileCounter(path string) (*FileCounter, error) {
+	fc := &FileCounter{path: path}
+	raw, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return fc, nil
+	case err != nil:
+		return nil, errors.Wrap(err, "cannot read serial counter")
+	}
+	fc.last, err = strconv.ParseUint(strings.TrimSpace(string(raw)), 10, 64)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid serial counter in %s", path)
+	}
+	return fc, nil
+}
+
+func (fc *FileCounter) Next() (uint64, error) {
+	fc.Lock()
+	defer fc.Unlock()
+	next := fc.last + 1
+	if next == 0 {
+		return 0, errors.New("serial counter exhausted")
+	}
+	if err := fc.write(next); err != nil {
+		return 0, err
+	}
+	fc.last = next
+	return next, nil
+}
+
+// Last allocated serial, zero if none
+func (fc *FileCounter) Last() uint64 {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.last
+}
+
+func (fc *FileCounter) write(v uint64) error {
+	f, err := ioutil.TempFile(filepath.Dir(fc.path), filepath.Base(fc.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "cannot write serial counter")
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(strconv.FormatUint(v, 10) + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot write serial counter")
+	}
+	if err := os.Rename(f.Name(), fc.path); err != nil {
+		return errors.Wrap(err, "cannot write serial counter")
+	}
+	return nil
+}
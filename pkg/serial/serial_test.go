@@ -0,0 +1,47 @@
+package serial
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandom(t *testing.T) {
+	assert := assert.New(t)
+	a, err := Random{}.Next()
+	assert.NoError(err)
+	b, _ := Random{}.Next()
+	assert.NotEqual(a, b)
+}
+
+func TestFileCounter(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "serial")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "serial")
+
+	fc, err := NewFileCounter(p)
+	if !assert.NoError(err) {
+		return
+	}
+	for i := uint64(1); i <= 3; i++ {
+		s, err := fc.Next()
+		assert.NoError(err)
+		assert.Equal(i, s)
+	}
+
+	// Survives restarts
+	fc, err = NewFileCounter(p)
+	if assert.NoError(err) {
+		assert.Equal(uint64(3), fc.Last())
+		s, _ := fc.Next()
+		assert.Equal(uint64(4), s)
+	}
+
+	ioutil.WriteFile(p, []byte("bogus"), 0600)
+	_, err = NewFileCounter(p)
+	assert.Error(err)
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Certificates are renewed in the background by the manager and served
+// through GetCertificate, so renewals take effect without a reload
+func newACMEManager(conf ACMEConfig) (*autocert.Manager, error) {
+	if len(conf.Hostnames) == 0 {
+		return nil, errors.New("acme requires at least one hostname")
+	}
+	if conf.CacheDir == "" {
+		return nil, errors.New("acme cache directory is not set")
+	}
+	renewBefore, err := time.ParseDuration(conf.RenewBefore)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid acme renewBefore")
+	}
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(conf.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(conf.Hostnames...),
+		Email:       conf.Email,
+		RenewBefore: renewBefore,
+	}
+	if conf.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: conf.DirectoryURL}
+	}
+	return m, nil
+}
+
+func (s *Server) newACMETLSConfig(conf *Config) (*tls.Config, error) {
+	if s.acme == nil {
+		return nil, errors.New("enabling acme requires a restart")
+	}
+	if conf.TLSCertFile != "" || len(conf.TLSCertFiles) > 0 {
+		return nil, errors.New("Unsupported configuration, either enable acme or set the TLS certificate files, not both")
+	}
+	return &tls.Config{
+		GetCertificate: s.acme.GetCertificate,
+		// TLS-ALPN-01 challenges are answered on the main listener
+		NextProtos: conf.HTTP.nextProtos(acme.ALPNProto),
+	}, nil
+}
+
+// Answer HTTP-01 challenges and redirect everything else to https
+func (s *Server) startACMEListener(l net.Listener) {
+	s.acmeServer = &http.Server{
+		Addr:    s.config.ACME.HTTPListen,
+		Handler: s.acme.HTTPHandler(nil),
+	}
+	log := Log.WithField("listen", s.config.ACME.HTTPListen)
+	go func() {
+		log.Info("acme challenge listener starting")
+		if err := s.serveListener("acme", s.acmeServer, l); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("acme challenge listener failed")
+		}
+	}()
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+func (c AdminListenerConfig) enabled() bool {
+	return c.Listen != "" || c.UnixSocket.Path != ""
+}
+
+// Admin API, metrics and debug endpoints for the separate admin listener
+func (s *Server) newAdminWeb(conf *Config, api *signapi.SignApi, ipExtractor echo.IPExtractor) *echo.Echo {
+	web := echo.New()
+	web.Logger.SetOutput(ioutil.Discard)
+	web.IPExtractor = ipExtractor
+	web.Use(RecoverHandler(Log.Data))
+	web.HTTPErrorHandler = errorHandler
+	web.Use(signapi.RequestID())
+	web.Use(TraceRequests())
+	web.Use(RequestLogger(Log.WithField("listener", "admin").Data))
+	web.Use(RequestMetrics())
+	web.Use(middleware.BodyLimit(conf.RequestLimits.MaxBodySize))
+	if conf.SecurityHeaders.Enabled {
+		web.Use(SecurityHeaders(conf.SecurityHeaders))
+	}
+	if len(conf.ResponseHeaders) > 0 {
+		web.Use(ResponseHeaders(conf.ResponseHeaders))
+	}
+	api.RegisterAdminRoutes(web.Group("/v1"))
+	web.GET("/version", handleVersion)
+	if conf.Metrics.Enabled && conf.Metrics.Listen == "" {
+		web.GET("/metrics", echo.WrapHandler(metricsHandler(conf.Metrics)))
+	}
+	if conf.AdminListener.Debug {
+		web.GET("/debug/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+		web.GET("/debug/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+		web.GET("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+		web.GET("/debug/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+		web.GET("/debug/pprof/*", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+	}
+	return web
+}
+
+func newAdminTLSConfig(conf AdminListenerConfig) (*tls.Config, error) {
+	if conf.TLSCertFile == "" && conf.TLSKeyFile == "" {
+		if conf.ClientCAFile != "" {
+			return nil, errors.New("clientCAFile requires TLS")
+		}
+		return nil, nil
+	}
+	cert, err := loadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read clientCAFile")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in clientCAFile")
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// Serve the admin web on its own listener. The listener is opened here
+// unless passed by systemd
+func (s *Server) startAdminListener(l net.Listener) error {
+	conf := s.config.AdminListener
+	tc, err := newAdminTLSConfig(conf)
+	if err != nil {
+		return errors.Wrap(err, "invalid admin listener TLS configuration")
+	}
+	if l == nil {
+		if conf.UnixSocket.Path != "" {
+			l, err = newUnixListener(conf.UnixSocket)
+		} else {
+			l, err = net.Listen("tcp", conf.Listen)
+		}
+		if err != nil {
+			return errors.Wrap(err, "cannot start admin listener")
+		}
+	}
+	s.addListener("admin", l)
+	s.adminServer = &http.Server{
+		Handler:   http.HandlerFunc(s.serveAdmin),
+		TLSConfig: tc,
+		ErrorLog:  stdlog.New(Log.WriterLevel(logrus.DebugLevel), "", 0),
+	}
+	log := Log.WithField("listen", fmt.Sprintf("%s:%s", l.Addr().Network(), l.Addr()))
+	go func() {
+		log.Info("admin listener starting")
+		if tc != nil && l.Addr().Network() != "unix" {
+			err = s.adminServer.ServeTLS(l, "", "")
+		} else {
+			err = s.adminServer.Serve(l)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("admin listener failed")
+		}
+	}()
+	return nil
+}
+
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	if isUnixConn(r) {
+		r.RemoteAddr = unixPeerAddr
+	}
+	s.mu.RLock()
+	web := s.adminWeb
+	s.mu.RUnlock()
+	web.ServeHTTP(w, r)
+}
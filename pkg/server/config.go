@@ -2,7 +2,9 @@ package server
 
 import (
 	"crypto/tls"
+	"io/ioutil"
 	"path"
+	"strings"
 
 	"github.com/aakso/ssh-inscribe/pkg/globals"
 
@@ -18,24 +20,519 @@ type AuthBackend struct {
 	Type    string
 	Config  string
 	Default bool
+	// Name the clients use for the backend instead of its own, so that
+	// tenants can each have e.g. an ldap backend. Backends sharing it need
+	// audiences or realms in the conditions
+	Endpoint string `yaml:"endpoint"`
+	// Maximum certificate lifetime for users authenticated with this backend
+	MaxCertLifetime string `yaml:"maxCertLifetime"`
+	// Lifetime when the client does not request one, overriding
+	// defaultCertLifetime, and the shortest lifetime that can be requested
+	DefaultCertLifetime string `yaml:"defaultCertLifetime"`
+	MinCertLifetime     string `yaml:"minCertLifetime"`
+	// Rewrite the principals the backend contributes so that backends
+	// cannot grant each other's principals. The template gets .Principal,
+	// .Subject, .Groups and .IsGroup and each line of its output is a
+	// principal. The prefix is added after the template
+	PrincipalTemplate string `yaml:"principalTemplate"`
+	PrincipalPrefix   string `yaml:"principalPrefix"`
+	// Principals from the groups of the backend matching regular
+	// expressions, added after the rewrite above
+	GroupPrincipals []GroupPrincipalsConfig `yaml:"groupPrincipals"`
+	// Clients that may use the backend. The backend is left out of the
+	// discovery for other clients
+	Conditions BackendConditionsConfig `yaml:"conditions"`
+	// Concurrency cap, timeout and circuit breaker so that a hung backend
+	// does not block the logins with the other backends
+	Limits BackendLimitsConfig `yaml:"limits"`
+}
+
+type BackendLimitsConfig struct {
+	// Logins calling the backend at once. Excess logins wait for
+	// queueTimeout before 503 is returned
+	MaxConcurrent int    `yaml:"maxConcurrent"`
+	QueueTimeout  string `yaml:"queueTimeout"`
+	// Logins not answered in time fail with 503
+	Timeout string `yaml:"timeout"`
+	// Consecutive timeouts, or failures the backend reports as its own or
+	// while the health check reports it down, opening the circuit. Logins
+	// are refused for openTimeout before a trial login is let through
+	FailureThreshold int    `yaml:"failureThreshold"`
+	OpenTimeout      string `yaml:"openTimeout"`
+}
+
+type BackendConditionsConfig struct {
+	Networks NetworkFilterConfig `yaml:"networks"`
+	// Require a client certificate signed by these CAs, with a subject
+	// common name matching one of the patterns if any
+	ClientCAFile    string   `yaml:"clientCAFile"`
+	ClientCertNames []string `yaml:"clientCertNames"`
+	// Principal names or patterns certificates signed with the backend may
+	// have
+	Principals []string `yaml:"principals"`
+	// Audiences and realms, or patterns of them, the client needs to name
+	// with --audience and --realm. The backend is unknown to other clients.
+	// The client chooses what it names, restrict access with networks or
+	// client certificates
+	Audiences []string `yaml:"audiences"`
+	Realms    []string `yaml:"realms"`
+}
+
+type GroupPrincipalsConfig struct {
+	// Regular expression for the group names, e.g.
+	// ^ssh-(?P<env>\w+)-(?P<role>\w+)$
+	Match string `yaml:"match"`
+	// Principals with %{name} or %{1} for the capture groups, e.g.
+	// %{role}@%{env}
+	Principals []string `yaml:"principals"`
+}
+
+// Additional CA key on the agent selectable by name
+type CAKey struct {
+	Name        string
+	Fingerprint string
+}
+
+type GroupCertLifetime struct {
+	// Group patterns matched against the user principals
+	Groups          []string
+	MaxCertLifetime string `yaml:"maxCertLifetime"`
+}
+
+type MetricsConfig struct {
+	Enabled bool
+	// Serve metrics on a separate plain HTTP listener instead of the main one
+	Listen string
+	// Require basic auth for the metrics endpoint if set
+	Username string
+	Password string
+}
+
+// Token bucket rate limit. Rate is in requests per second, zero disables
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type RateLimitConfig struct {
+	Enabled      bool
+	LoginPerUser RateLimit `yaml:"loginPerUser"`
+	LoginPerIP   RateLimit `yaml:"loginPerIP"`
+	SignPerUser  RateLimit `yaml:"signPerUser"`
+	SignPerIP    RateLimit `yaml:"signPerIP"`
+}
+
+// Temporary lockout of user names and source addresses after failed logins.
+// The durations are Go durations
+type LockoutConfig struct {
+	Enabled bool
+	// Failed logins within window before locking out, 0 disables
+	MaxUserFailures int `yaml:"maxUserFailures"`
+	MaxIPFailures   int `yaml:"maxIPFailures"`
+	Window          string
+	// First lockout, doubled by each further lockout up to maxDuration
+	Duration    string
+	MaxDuration string `yaml:"maxDuration"`
+	// Failed logins are answered after delay times the failures so far
+	Delay    string
+	MaxDelay string `yaml:"maxDelay"`
+}
+
+// Certificate serial number allocation. Type is one of random, file or
+// certdb. The certdb type requires the SQL certificate store
+type SerialConfig struct {
+	Type string
+	Path string
+}
+
+// Obtain and renew the server certificate with ACME instead of the
+// configured certificate files
+type ACMEConfig struct {
+	Enabled   bool
+	Hostnames []string
+	// Contact address for the ACME account
+	Email string
+	// Directory of the ACME CA, Let's Encrypt if empty
+	DirectoryURL string `yaml:"directoryURL"`
+	// Account key and certificates are cached here
+	CacheDir string `yaml:"cacheDir"`
+	// Plain HTTP listener answering HTTP-01 challenges. Only TLS-ALPN-01 on
+	// the main listener is used if empty
+	HTTPListen string `yaml:"httpListen"`
+	// How long before expiry certificates are renewed
+	RenewBefore string `yaml:"renewBefore"`
+}
+
+// Unix socket listener served in addition to the TCP listener. Mode is in
+// octal, e.g. 0660
+type UnixSocketConfig struct {
+	Path  string
+	Mode  string
+	Owner string
+	Group string
+}
+
+// Certificates with principals matching the patterns are only signed once
+// another user has approved the request
+type ApprovalConfig struct {
+	Enabled    bool
+	Principals []string
+	// Users with principals matching these patterns may decide on requests.
+	// Admins are always allowed
+	ApproverPrincipals []string `yaml:"approverPrincipals"`
+	// Time to decide on a request and to use an approval
+	TTL   string `yaml:"ttl"`
+	Store string
+}
+
+// Federation between instances. A frontend authenticates users and forwards
+// the certificates to an upstream instance holding the CA keys
+type FederationConfig struct {
+	// Frontends allowed to forward signing requests to this instance. The
+	// lifetime limits, policy hook, step-up, approval and quota settings of
+	// this instance apply to the forwarded certificates
+	Frontends []FederationFrontendConfig
+	// Sign with the upstream instead of the local CA keys if the url is set
+	Upstream UpstreamConfig
+}
+
+type FederationFrontendConfig struct {
+	Name string
+	// Shared with the frontend, at least 32 bytes
+	Key string
+	// Principals the frontend may request, others are dropped
+	Principals      []string
+	MaxCertLifetime string `yaml:"maxCertLifetime"`
+}
+
+type UpstreamConfig struct {
+	URL string
+	// Name and key of this instance in the upstream frontends
+	Name string
+	Key  string
+	// CA certificate to verify the upstream TLS certificate
+	CAFile   string `yaml:"caFile"`
+	Insecure bool
+	Timeout  string
+}
+
+type HostCertificatesConfig struct {
+	Enabled bool
+	// Users with principals matching these patterns may request host
+	// certificates. Admins are always allowed
+	RequesterPrincipals []string `yaml:"requesterPrincipals"`
+	// Allowed hostname patterns
+	Hostnames       []string
+	DefaultLifetime string `yaml:"defaultLifetime"`
+	MaxLifetime     string `yaml:"maxLifetime"`
+	// Bootstrap tokens let unattended hosts request their certificate once.
+	// Disabled if the store path is empty
+	BootstrapTokenStore  string `yaml:"bootstrapTokenStore"`
+	BootstrapTokenMaxTTL string `yaml:"bootstrapTokenMaxTTL"`
 }
 
 type Config struct {
-	Listen                    string
-	TLSCertFile               string        `yaml:"TLSCertFile"`
-	TLSKeyFile                string        `yaml:"TLSKeyFile"`
-	TLSCertFiles              []string      `yaml:"TLSCertFiles"`
-	TLSKeyFiles               []string      `yaml:"TLSKeyFiles"`
-	TLSCertNames              []string      `yaml:"TLSCertNames"`
-	AuthBackends              []AuthBackend `yaml:"authBackends"`
-	DefaultAuthBackends       []string      `yaml:"defaultAuthBackends"`
-	MaxCertLifetime           string        `yaml:"maxCertLifetime"`
-	DefaultCertLifetime       string        `yaml:"defaultCertLifetime"`
-	AgentSocket               string        `yaml:"agentSocket"`
-	PKCS11Provider            string        `yaml:"pkcs11Provider"`
-	PKCS11Pin                 string        `yaml:"pkcs11Pin"`
-	CertSigningKeyFingerprint string        `yaml:"certSigningKeyFingerprint"`
-	TokenSigningKey           string        `yaml:"tokenSigningKey"`
+	Listen              string
+	TLSCertFile         string              `yaml:"TLSCertFile"`
+	TLSKeyFile          string              `yaml:"TLSKeyFile"`
+	TLSCertFiles        []string            `yaml:"TLSCertFiles"`
+	TLSKeyFiles         []string            `yaml:"TLSKeyFiles"`
+	TLSCertNames        []string            `yaml:"TLSCertNames"`
+	AuthBackends        []AuthBackend       `yaml:"authBackends"`
+	DefaultAuthBackends []string            `yaml:"defaultAuthBackends"`
+	MaxCertLifetime     string              `yaml:"maxCertLifetime"`
+	DefaultCertLifetime string              `yaml:"defaultCertLifetime"`
+	GroupCertLifetimes  []GroupCertLifetime `yaml:"groupCertLifetimes"`
+	// Combinations of auth backend names accepted for signing, e.g.
+	// [[ldap, totp], [oidc]] for (ldap and totp) or oidc. Any login is
+	// accepted if empty
+	AuthChains [][]string `yaml:"authChains"`
+	// Probe the auth backends supporting it periodically
+	HealthChecks HealthChecksConfig `yaml:"healthChecks"`
+	// Additional logins required for long-lived or sensitive certificates
+	StepUp []StepUpConfig `yaml:"stepUp"`
+	// Either reject or clamp requests exceeding the maximum lifetime
+	CertLifetimeExceeded      string                 `yaml:"certLifetimeExceeded"`
+	AgentSocket               string                 `yaml:"agentSocket"`
+	PKCS11Provider            string                 `yaml:"pkcs11Provider"`
+	PKCS11Pin                 string                 `yaml:"pkcs11Pin"`
+	CertSigningKeyFingerprint string                 `yaml:"certSigningKeyFingerprint"`
+	CAKeys                    []CAKey                `yaml:"caKeys"`
+	TokenSigningKey           string                 `yaml:"tokenSigningKey"`
+	Metrics                   MetricsConfig          `yaml:"metrics"`
+	RevocationStore           string                 `yaml:"revocationStore"`
+	AdminPrincipals           []string               `yaml:"adminPrincipals"`
+	HostCertificates          HostCertificatesConfig `yaml:"hostCertificates"`
+	// Proxy networks trusted to set X-Forwarded-For. If empty, the peer
+	// address is used as the client address
+	TrustedProxies []string        `yaml:"trustedProxies"`
+	RateLimit      RateLimitConfig `yaml:"rateLimit"`
+	Lockout        LockoutConfig   `yaml:"lockout"`
+	// Serve the browser based UI under /ui/
+	WebUI bool `yaml:"webUI"`
+	// Time to let requests in flight finish on shutdown
+	ShutdownGracePeriod string `yaml:"shutdownGracePeriod"`
+	// Time to wait for the new process to take over the listeners when
+	// upgrading on SIGUSR2
+	UpgradeTimeout string       `yaml:"upgradeTimeout"`
+	Serial         SerialConfig `yaml:"serial"`
+	// State of CA key rotations. Rotation is disabled if empty
+	CARotationStore string     `yaml:"caRotationStore"`
+	ACME            ACMEConfig `yaml:"acme"`
+	// Set listen to empty to serve only on the unix socket
+	UnixSocket UnixSocketConfig `yaml:"unixSocket"`
+	Approval   ApprovalConfig   `yaml:"approval"`
+	Federation FederationConfig `yaml:"federation"`
+	// Auth token signing keys are derived from tokenSigningKey and rotated
+	// this often. Set to empty to sign with tokenSigningKey as is
+	TokenKeyRotationInterval string `yaml:"tokenKeyRotationInterval"`
+	// Tokens signed with these are accepted after replacing tokenSigningKey
+	PreviousTokenSigningKeys []string    `yaml:"previousTokenSigningKeys"`
+	Token                    TokenConfig `yaml:"token"`
+	// Nonces and used tokens are tracked in the shared state
+	ReplayProtection ReplayProtectionConfig `yaml:"replayProtection"`
+	RequestLimits    RequestLimitsConfig    `yaml:"requestLimits"`
+	// Browser origins allowed to call the API. CORS is disabled if empty
+	CORS            CORSConfig            `yaml:"cors"`
+	SecurityHeaders SecurityHeadersConfig `yaml:"securityHeaders"`
+	// Additional headers set on all responses
+	ResponseHeaders map[string]string `yaml:"responseHeaders"`
+	// HTTP/2 and connection settings of the API listener
+	HTTP HTTPConfig `yaml:"http"`
+	// Source networks allowed to reach the signing and admin endpoints
+	NetworkACL NetworkACLConfig `yaml:"networkACL"`
+	// Extensions the server may place in certificates, regardless of what
+	// the auth backends and policy templates set
+	Extensions ExtensionLimitsConfig `yaml:"extensions"`
+	// Principals removed from all certificates after the principal mapping
+	// and policy. Signing is refused if none remain
+	DeniedPrincipals []DeniedPrincipalsConfig `yaml:"deniedPrincipals"`
+	// Principals only issued during time windows or when a webhook allows,
+	// e.g. production access during business hours or on-call shifts
+	IssuanceWindows []IssuanceWindowConfig `yaml:"issuanceWindows"`
+	// Requires the certificate database
+	CertificateQuota CertificateQuotaConfig `yaml:"certificateQuota"`
+	// Key id of user certificates with identity variables such as %u,
+	// %{backend} or %{ldap.department}. Principal mapping rules may use the
+	// same variables. With revocation enabled, a custom key id here or in the
+	// policy templates requires the certificate database
+	KeyIDFormat string `yaml:"keyIDFormat"`
+	// Vendor extensions of user certificates from formats with the same
+	// variables, e.g. employee-id@example.com: "%{identity.employee_id}"
+	IdentityExtensions map[string]string `yaml:"identityExtensions"`
+	// Serve the admin API, metrics and debug endpoints on a separate
+	// listener. They are then removed from the main listener
+	AdminListener AdminListenerConfig `yaml:"adminListener"`
+	// External policy decision point allowing, denying or modifying user
+	// certificates before signing
+	PolicyHook PolicyHookConfig `yaml:"policyHook"`
+	// Serve the API also over gRPC on a separate listener
+	GRPC GRPCConfig `yaml:"grpc"`
+}
+
+type GRPCConfig struct {
+	// TCP address, gRPC is disabled if empty. TLS is configured as on the
+	// main listener
+	Listen string `yaml:"listen"`
+}
+
+type PolicyHookConfig struct {
+	// Called with the auth context and the certificate. Disabled if empty
+	URL string `yaml:"url"`
+	// HMAC-SHA256 key for signing the request body
+	Secret  string            `yaml:"secret"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout string            `yaml:"timeout"`
+	// Sign without a decision when the hook fails instead of refusing
+	FailOpen bool `yaml:"failOpen"`
+}
+
+type AdminListenerConfig struct {
+	// TCP address, or empty to use only the unix socket
+	Listen     string           `yaml:"listen"`
+	UnixSocket UnixSocketConfig `yaml:"unixSocket"`
+	// Plain HTTP if not set. Not used on the unix socket
+	TLSCertFile string `yaml:"TLSCertFile"`
+	TLSKeyFile  string `yaml:"TLSKeyFile"`
+	// Require client certificates signed by these CAs in addition to the
+	// admin token
+	ClientCAFile string `yaml:"clientCAFile"`
+	// Serve the Go profiler under /debug/pprof/
+	Debug bool `yaml:"debug"`
+}
+
+type HealthChecksConfig struct {
+	// Go duration, health checks are disabled if empty
+	Interval string `yaml:"interval"`
+	// Probes taking longer count as failed
+	Timeout string `yaml:"timeout"`
+}
+
+// Step-up rule. Applies to certificates valid for longer than lifetime (Go
+// duration) with a principal matching principals, both optional. A login
+// with any of backends satisfies it, or an approval if approval is set
+type StepUpConfig struct {
+	Lifetime   string   `yaml:"lifetime"`
+	Principals []string `yaml:"principals"`
+	Backends   []string `yaml:"backends"`
+	Approval   bool     `yaml:"approval"`
+}
+
+type CertificateQuotaConfig struct {
+	// Maximum number of concurrently valid user certificates per subject.
+	// Disabled if 0
+	MaxActive int `yaml:"maxActive"`
+	// Revoke the oldest certificates instead of refusing to sign
+	RevokeOldest bool `yaml:"revokeOldest"`
+}
+
+type TimeWindowConfig struct {
+	// Weekday names, e.g. mon. Every day if empty
+	Days []string `yaml:"days"`
+	// HH:MM, the window wraps over midnight if end is before start
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+}
+
+type IssuanceWebhookConfig struct {
+	// Called outside the time windows with the subject and principal.
+	// Disabled if empty
+	URL string `yaml:"url"`
+	// HMAC-SHA256 key for signing the request body
+	Secret  string            `yaml:"secret"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout string            `yaml:"timeout"`
+}
+
+type IssuanceWindowConfig struct {
+	// Principal names or patterns
+	Principals []string `yaml:"principals"`
+	// IANA time zone of the windows, the local time zone if empty
+	Timezone string                `yaml:"timezone"`
+	Windows  []TimeWindowConfig    `yaml:"windows"`
+	Webhook  IssuanceWebhookConfig `yaml:"webhook"`
+}
+
+type DeniedPrincipalsConfig struct {
+	// Principal names or patterns, e.g. root or admin*
+	Principals []string `yaml:"principals"`
+	// Authenticator name patterns the rule applies to. Empty applies to all
+	Backends []string `yaml:"backends"`
+	// Authenticator name patterns exempt from the rule
+	ExceptBackends []string `yaml:"exceptBackends"`
+}
+
+type GroupExtensionsConfig struct {
+	// Group patterns matched against the user principals
+	Groups  []string `yaml:"groups"`
+	Allowed []string `yaml:"allowed"`
+	Denied  []string `yaml:"denied"`
+}
+
+type ExtensionLimitsConfig struct {
+	// Extension patterns. Empty allowed allows all, denied take precedence
+	Allowed []string                `yaml:"allowed"`
+	Denied  []string                `yaml:"denied"`
+	Groups  []GroupExtensionsConfig `yaml:"groups"`
+}
+
+type NetworkFilterConfig struct {
+	// Networks in CIDR notation or single addresses. Everything is allowed
+	// if empty
+	Allow []string `yaml:"allow"`
+	// Denied networks take precedence over allowed ones
+	Deny []string `yaml:"deny"`
+}
+
+type NetworkACLConfig struct {
+	Sign  NetworkFilterConfig `yaml:"sign"`
+	Admin NetworkFilterConfig `yaml:"admin"`
+}
+
+type CORSConfig struct {
+	AllowOrigins []string `yaml:"allowOrigins"`
+	// Allow cookies and the Authorization header on cross-origin requests
+	AllowCredentials bool `yaml:"allowCredentials"`
+	// Seconds browsers may cache preflight responses
+	MaxAge int `yaml:"maxAge"`
+}
+
+type HTTPConfig struct {
+	// Serve HTTP/2 on the TLS listener
+	HTTP2 bool `yaml:"http2"`
+	// Serve HTTP/2 without TLS on plain listeners, for proxies speaking h2c
+	H2C bool `yaml:"h2c"`
+	// Concurrent HTTP/2 streams per connection
+	MaxConcurrentStreams uint32 `yaml:"maxConcurrentStreams"`
+	// Time idle keep-alive connections are kept open
+	IdleTimeout       string `yaml:"idleTimeout"`
+	ReadHeaderTimeout string `yaml:"readHeaderTimeout"`
+	// Limits for reading a request and writing a response. Unlimited if
+	// empty, consider the approval wait and Duo pushes before setting a
+	// write timeout
+	ReadTimeout  string `yaml:"readTimeout"`
+	WriteTimeout string `yaml:"writeTimeout"`
+	// Serve one request per connection
+	DisableKeepAlives bool `yaml:"disableKeepAlives"`
+	// TCP keep-alive probe interval, negative disables
+	TCPKeepAlive string `yaml:"tcpKeepAlive"`
+	// Open connections at once. Further connections wait to be accepted.
+	// Unlimited if 0
+	MaxConnections int `yaml:"maxConnections"`
+	MaxHeaderBytes int `yaml:"maxHeaderBytes"`
+}
+
+type SecurityHeadersConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Strict-Transport-Security max-age in seconds, sent on TLS requests only.
+	// Set to 0 to disable
+	HSTSMaxAge            int    `yaml:"hstsMaxAge"`
+	ContentSecurityPolicy string `yaml:"contentSecurityPolicy"`
+	// Origins allowed to frame the web UI, for example an SSO portal. Framing
+	// is denied if empty
+	FrameAncestors []string `yaml:"frameAncestors"`
+	ReferrerPolicy string   `yaml:"referrerPolicy"`
+}
+
+type EndpointLimitsConfig struct {
+	// Size with an optional K, M or G suffix
+	MaxBodySize string `yaml:"maxBodySize"`
+	// Requests handled at once. Excess requests wait for queueTimeout
+	// before 503 is returned
+	MaxConcurrent int    `yaml:"maxConcurrent"`
+	QueueTimeout  string `yaml:"queueTimeout"`
+	Timeout       string `yaml:"timeout"`
+}
+
+type RequestLimitsConfig struct {
+	// Body size limit for all requests
+	MaxBodySize string               `yaml:"maxBodySize"`
+	Login       EndpointLimitsConfig `yaml:"login"`
+	Sign        EndpointLimitsConfig `yaml:"sign"`
+	Admin       EndpointLimitsConfig `yaml:"admin"`
+}
+
+type ReplayProtectionConfig struct {
+	// Each auth token can be used to sign a single certificate. This is the
+	// replay control for signing requests, as a captured request cannot be
+	// repeated without a fresh login
+	SingleUseTokens bool `yaml:"singleUseTokens"`
+	// Tolerated difference between the clocks of the replicas
+	ClockSkew string `yaml:"clockSkew"`
+}
+
+type TokenConfig struct {
+	// Lifetime of the auth tokens issued on login
+	Lifetime string `yaml:"lifetime"`
+	// Set into issued tokens and required from presented tokens if not empty
+	Audience string `yaml:"audience"`
+	Issuer   string `yaml:"issuer"`
+	// Claim name to the auth context value copied into the token: subject,
+	// principals, groups, backends or meta.<key>
+	Claims map[string]string `yaml:"claims"`
+	// Cap the token lifetime to the longest certificate lifetime the user
+	// is allowed
+	CapToCertLifetime bool `yaml:"capToCertLifetime"`
 }
 
 var Defaults *Config = &Config{
@@ -52,13 +549,165 @@ var Defaults *Config = &Config{
 		},
 	},
 	DefaultAuthBackends:       []string{},
+	AuthChains:                [][]string{},
+	StepUp:                    []StepUpConfig{},
 	MaxCertLifetime:           "24h",
 	DefaultCertLifetime:       "1h",
+	GroupCertLifetimes:        []GroupCertLifetime{},
+	CertLifetimeExceeded:      LifetimeExceededReject,
 	AgentSocket:               path.Join(globals.VarDir(), "ssh_inscribe_agent.sock"),
 	PKCS11Provider:            "",
 	PKCS11Pin:                 "",
 	CertSigningKeyFingerprint: "",
+	CAKeys:                    []CAKey{},
+	CARotationStore:           path.Join(globals.VarDir(), "ssh_inscribe_ca_rotation.json"),
 	TokenSigningKey:           "",
+	Metrics: MetricsConfig{
+		Enabled:  false,
+		Listen:   "",
+		Username: "",
+		Password: "",
+	},
+	RevocationStore: path.Join(globals.VarDir(), "ssh_inscribe_revocations.json"),
+	AdminPrincipals: []string{},
+	TrustedProxies:  []string{},
+	RateLimit: RateLimitConfig{
+		Enabled:      false,
+		LoginPerUser: RateLimit{Rate: 0.1, Burst: 5},
+		LoginPerIP:   RateLimit{Rate: 1, Burst: 20},
+		SignPerUser:  RateLimit{Rate: 1, Burst: 10},
+		SignPerIP:    RateLimit{Rate: 5, Burst: 50},
+	},
+	Lockout: LockoutConfig{
+		Enabled:         false,
+		MaxUserFailures: 5,
+		MaxIPFailures:   50,
+		Window:          "15m",
+		Duration:        "5m",
+		MaxDuration:     "1h",
+		Delay:           "500ms",
+		MaxDelay:        "5s",
+	},
+	WebUI:               false,
+	ShutdownGracePeriod: "30s",
+	UpgradeTimeout:      "1m",
+	Serial: SerialConfig{
+		Type: SerialFile,
+		Path: path.Join(globals.VarDir(), "ssh_inscribe_serial"),
+	},
+	HostCertificates: HostCertificatesConfig{
+		Enabled:              false,
+		RequesterPrincipals:  []string{},
+		Hostnames:            []string{},
+		DefaultLifetime:      "720h",
+		MaxLifetime:          "8760h",
+		BootstrapTokenStore:  path.Join(globals.VarDir(), "ssh_inscribe_bootstrap_tokens.json"),
+		BootstrapTokenMaxTTL: "168h",
+	},
+	ACME: ACMEConfig{
+		Enabled:     false,
+		Hostnames:   []string{},
+		CacheDir:    path.Join(globals.VarDir(), "ssh_inscribe_acme"),
+		HTTPListen:  "",
+		RenewBefore: "720h",
+	},
+	UnixSocket: UnixSocketConfig{
+		Path: "",
+		Mode: "0660",
+	},
+	Approval: ApprovalConfig{
+		Enabled:            false,
+		Principals:         []string{},
+		ApproverPrincipals: []string{},
+		TTL:                "1h",
+		Store:              path.Join(globals.VarDir(), "ssh_inscribe_approvals.json"),
+	},
+	Federation: FederationConfig{
+		Frontends: []FederationFrontendConfig{},
+		Upstream: UpstreamConfig{
+			Timeout: "10s",
+		},
+	},
+	HealthChecks: HealthChecksConfig{
+		Interval: "1m",
+		Timeout:  "10s",
+	},
+	TokenKeyRotationInterval: "24h",
+	PreviousTokenSigningKeys: []string{},
+	Token: TokenConfig{
+		Lifetime: "2m",
+		Claims:   map[string]string{},
+	},
+	ReplayProtection: ReplayProtectionConfig{
+		SingleUseTokens: false,
+		ClockSkew:       "5m",
+	},
+	RequestLimits: RequestLimitsConfig{
+		MaxBodySize: "1M",
+		Login: EndpointLimitsConfig{
+			MaxBodySize: "64K",
+			Timeout:     "60s",
+		},
+		Sign: EndpointLimitsConfig{
+			MaxBodySize:   "64K",
+			MaxConcurrent: 32,
+			QueueTimeout:  "5s",
+			Timeout:       "30s",
+		},
+		Admin: EndpointLimitsConfig{
+			Timeout: "60s",
+		},
+	},
+	CORS: CORSConfig{
+		AllowOrigins: []string{},
+		MaxAge:       600,
+	},
+	SecurityHeaders: SecurityHeadersConfig{
+		Enabled:               true,
+		HSTSMaxAge:            31536000,
+		ContentSecurityPolicy: "default-src 'none'",
+		FrameAncestors:        []string{},
+		ReferrerPolicy:        "no-referrer",
+	},
+	ResponseHeaders: map[string]string{},
+	HTTP: HTTPConfig{
+		HTTP2:                true,
+		H2C:                  false,
+		MaxConcurrentStreams: 250,
+		IdleTimeout:          "2m",
+		ReadHeaderTimeout:    "10s",
+		ReadTimeout:          "",
+		WriteTimeout:         "",
+		TCPKeepAlive:         "30s",
+		MaxConnections:       0,
+		MaxHeaderBytes:       1 << 20,
+	},
+	NetworkACL: NetworkACLConfig{
+		Sign:  NetworkFilterConfig{Allow: []string{}, Deny: []string{}},
+		Admin: NetworkFilterConfig{Allow: []string{}, Deny: []string{}},
+	},
+	Extensions: ExtensionLimitsConfig{
+		Allowed: []string{},
+		Denied:  []string{},
+		Groups:  []GroupExtensionsConfig{},
+	},
+	DeniedPrincipals: []DeniedPrincipalsConfig{},
+	IssuanceWindows:  []IssuanceWindowConfig{},
+	KeyIDFormat:      "",
+	AdminListener: AdminListenerConfig{
+		Listen: "",
+		UnixSocket: UnixSocketConfig{
+			Path: "",
+			Mode: "0600",
+		},
+		Debug: false,
+	},
+	PolicyHook: PolicyHookConfig{
+		Timeout: "5s",
+	},
+	GRPC: GRPCConfig{
+		Listen: "",
+	},
 }
 
 func (c Config) GetCertificateMap() (cc CertificateConfig, err error) {
@@ -73,7 +722,7 @@ func (c Config) GetCertificateMap() (cc CertificateConfig, err error) {
 			return cc, errors.New("Unsupported configuration, either set TLSCertFile or TLSCertFiles, not both")
 		}
 
-		var certificate, err = tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		var certificate, err = loadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
 		if err != nil {
 			return cc, err
 		}
@@ -88,7 +737,7 @@ func (c Config) GetCertificateMap() (cc CertificateConfig, err error) {
 
 		cc.Certificates = make([]tls.Certificate, len(c.TLSCertFiles))
 		for index, cert := range c.TLSCertFiles {
-			var certificate, err = tls.LoadX509KeyPair(cert, c.TLSKeyFiles[index])
+			var certificate, err = loadX509KeyPair(cert, c.TLSKeyFiles[index])
 			if err != nil {
 				return cc, err
 			}
@@ -99,3 +748,24 @@ func (c Config) GetCertificateMap() (cc CertificateConfig, err error) {
 	}
 	return cc, nil
 }
+
+// Load a certificate and key from files or from PEM given inline, e.g. from a
+// secret reference
+func loadX509KeyPair(cert, key string) (tls.Certificate, error) {
+	certPEM, err := readPEM(cert)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := readPEM(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+func readPEM(v string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(v), "-----BEGIN") {
+		return []byte(v), nil
+	}
+	return ioutil.ReadFile(v)
+}
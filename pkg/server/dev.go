@@ -0,0 +1,245 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/aakso/ssh-inscribe/pkg/storage"
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const devAuthSection = "devauth"
+
+type DevOptions struct {
+	// Use port 0 to pick a free port
+	Listen string
+	// Credentials of the static test user. The password is generated if
+	// empty
+	User     string
+	Password string
+	// Principals of the test user in addition to the user name
+	Principals []string
+	// Serve with a self-signed certificate instead of plain HTTP
+	TLS bool
+}
+
+// Throwaway environment for evaluation and integration tests. The CA key
+// lives only in an in-process agent and the state in a temporary directory
+// removed on Close
+type DevEnv struct {
+	DevOptions
+	URL  string
+	Dir  string
+	CA   ssh.PublicKey
+	sock net.Listener
+}
+
+// Prepare the development environment and load a configuration using it.
+// Build the server afterwards as usual
+func NewDevEnv(opts DevOptions) (*DevEnv, error) {
+	listen, err := devListenAddr(opts.Listen)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid listen address")
+	}
+	opts.Listen = listen
+	if opts.Password == "" {
+		opts.Password = util.RandB64(18)
+	}
+	dir, err := ioutil.TempDir("", "ssh-inscribe-dev")
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create temporary directory")
+	}
+	env := &DevEnv{DevOptions: opts, Dir: dir}
+	if err := env.setup(); err != nil {
+		env.Close()
+		return nil, errors.Wrap(err, "cannot setup development environment")
+	}
+	return env, nil
+}
+
+func (env *DevEnv) setup() error {
+	keyring := agent.NewKeyring()
+	sockPath := filepath.Join(env.Dir, "agent.sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return err
+	}
+	env.sock = sock
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := keyring.Add(agent.AddedKey{PrivateKey: caKey, Comment: "ssh-inscribe dev CA"}); err != nil {
+		return err
+	}
+	if env.CA, err = ssh.NewPublicKey(caKey.Public()); err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(env.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	users, err := yaml.Marshal(map[string]interface{}{
+		"users": []map[string]interface{}{{
+			"name":       env.User,
+			"password":   string(hash),
+			"principals": append([]string{env.User}, env.Principals...),
+			"extensions": map[string]string{
+				"permit-pty":              "",
+				"permit-user-rc":          "",
+				"permit-agent-forwarding": "",
+				"permit-port-forwarding":  "",
+			},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	usersFile := filepath.Join(env.Dir, "users.yaml")
+	if err := ioutil.WriteFile(usersFile, users, 0600); err != nil {
+		return err
+	}
+
+	server := map[string]interface{}{
+		"listen":                    env.Listen,
+		"agentSocket":               sockPath,
+		"certSigningKeyFingerprint": ssh.FingerprintSHA256(env.CA),
+		"authBackends": []map[string]interface{}{{
+			"type":    "authfile",
+			"config":  devAuthSection,
+			"default": true,
+		}},
+		"adminPrincipals": []string{env.User},
+		"caRotationStore": filepath.Join(env.Dir, "ca_rotation.json"),
+		"webUI":           true,
+	}
+	env.URL = "http://" + env.Listen
+	if env.TLS {
+		certFile, keyFile, err := writeSelfSignedCert(env.Dir)
+		if err != nil {
+			return err
+		}
+		server["TLSCertFile"] = certFile
+		server["TLSKeyFile"] = keyFile
+		env.URL = "https://" + env.Listen
+	}
+	conf, err := json.Marshal(map[string]interface{}{
+		"server": server,
+		devAuthSection: map[string]interface{}{
+			"name":  "dev",
+			"realm": "development",
+			"path":  usersFile,
+		},
+		"storage": map[string]interface{}{
+			"type": storage.TypeFile,
+			"dir":  env.Dir,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return config.LoadBytes(conf)
+}
+
+// Environment variables for the client, in shell syntax
+func (env *DevEnv) ClientEnv() []string {
+	r := []string{fmt.Sprintf("export SSH_INSCRIBE_URL=%s", env.URL)}
+	if env.TLS {
+		r = append(r, "export SSH_INSCRIBE_INSECURE=1")
+	}
+	return r
+}
+
+func (env *DevEnv) Close() {
+	if env.sock != nil {
+		env.sock.Close()
+	}
+	os.RemoveAll(env.Dir)
+}
+
+// Resolve port 0 to a free port so that the client URL is known upfront
+func devListenAddr(listen string) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil || port != "0" {
+		return listen, err
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+func writeSelfSignedCert(dir string) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "ssh-inscribe dev"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return "", "", err
+	}
+	return certFile, keyFile, nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi"
+	"github.com/pkg/errors"
+)
+
+func setupFederation(api *signapi.SignApi, conf FederationConfig) error {
+	var frontends []signapi.FederationFrontend
+	for _, f := range conf.Frontends {
+		var max time.Duration
+		if f.MaxCertLifetime != "" {
+			var err error
+			if max, err = time.ParseDuration(f.MaxCertLifetime); err != nil {
+				return errors.Wrapf(err, "invalid MaxCertLifetime for federation frontend %s", f.Name)
+			}
+		}
+		frontends = append(frontends, signapi.FederationFrontend{
+			Name:        f.Name,
+			Key:         []byte(f.Key),
+			Principals:  f.Principals,
+			MaxLifetime: max,
+		})
+	}
+	if err := api.SetFederationFrontends(frontends); err != nil {
+		return err
+	}
+
+	uc := conf.Upstream
+	if uc.URL == "" {
+		return nil
+	}
+	timeout, err := time.ParseDuration(uc.Timeout)
+	if err != nil {
+		return errors.Wrap(err, "invalid upstream timeout")
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: uc.Insecure}
+	if uc.CAFile != "" {
+		pem, err := ioutil.ReadFile(uc.CAFile)
+		if err != nil {
+			return errors.Wrap(err, "cannot read upstream caFile")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in upstream caFile")
+		}
+	}
+	upstream, err := signapi.NewUpstream(signapi.UpstreamConfig{
+		URL:       uc.URL,
+		Name:      uc.Name,
+		Key:       []byte(uc.Key),
+		TLSConfig: tlsConfig,
+		Timeout:   timeout,
+	})
+	if err != nil {
+		return err
+	}
+	api.SetUpstream(upstream)
+	Log.WithField("upstream", uc.URL).Info("forwarding signing requests to the upstream")
+	return nil
+}
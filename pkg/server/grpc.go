@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/aakso/ssh-inscribe/pkg/server/grpcapi"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// Serve the gRPC API on its own listener. The calls are dispatched to the
+// REST API with the current configuration. The listener is opened here
+// unless passed by systemd
+func (s *Server) startGRPCListener(l net.Listener) error {
+	var opts []grpc.ServerOption
+	scheme := "grpc"
+	if s.tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{
+			GetConfigForClient: s.getGRPCTLSConfig,
+		})))
+		scheme = "grpcs"
+	}
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", s.config.GRPC.Listen); err != nil {
+			return errors.Wrap(err, "cannot start grpc listener")
+		}
+	}
+	s.addListener("grpc", l)
+	s.grpcServer = grpc.NewServer(opts...)
+	grpcapi.New(s).Register(s.grpcServer)
+	log := Log.WithField("listen", fmt.Sprintf("%s://%s", scheme, l.Addr()))
+	go func() {
+		if scheme == "grpc" {
+			log.Warn("grpc listener starting without TLS")
+		} else {
+			log.Info("grpc listener starting")
+		}
+		if err := s.grpcServer.Serve(l); err != nil {
+			log.WithError(err).Error("grpc listener failed")
+		}
+	}()
+	return nil
+}
+
+// TLS configuration of the main listener negotiating HTTP/2 as gRPC requires
+func (s *Server) getGRPCTLSConfig(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	tc, err := s.getTLSConfig(hello)
+	if err != nil || tc == nil {
+		return tc, err
+	}
+	tc = tc.Clone()
+	tc.NextProtos = []string{"h2"}
+	return tc, nil
+}
+
+// Let the calls in flight finish until the context is done
+func (s *Server) stopGRPC(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+	}
+}
@@ -0,0 +1,389 @@
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	signapipb "github.com/aakso/ssh-inscribe/pkg/server/signapi/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Serves the gRPC API by dispatching the calls to the REST API, so the
+// middleware and handlers of the REST API apply to both
+type Service struct {
+	signapipb.UnimplementedAuthServer
+	signapipb.UnimplementedSignerServer
+	handler http.Handler
+}
+
+// New returns a service dispatching to the handler of the REST API
+func New(handler http.Handler) *Service {
+	return &Service{handler: handler}
+}
+
+// Register the Auth and Signer services on the server
+func (s *Service) Register(srv *grpc.Server) {
+	signapipb.RegisterAuthServer(srv, s)
+	signapipb.RegisterSignerServer(srv, s)
+}
+
+func (s *Service) Discover(ctx context.Context, in *signapipb.DiscoverRequest) (*signapipb.DiscoverResponse, error) {
+	res, err := s.call(ctx, http.MethodGet, "/v1/auth", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.status != http.StatusOK {
+		return nil, res.err(ctx)
+	}
+	var results []objects.DiscoverResult
+	if err := json.Unmarshal(res.body.Bytes(), &results); err != nil {
+		return nil, status.Errorf(codes.Internal, "cannot parse authenticators: %s", err)
+	}
+	r := &signapipb.DiscoverResponse{}
+	for _, v := range results {
+		r.Authenticators = append(r.Authenticators, &signapipb.Authenticator{
+			Name:           v.AuthenticatorName,
+			Realm:          v.AuthenticatorRealm,
+			CredentialType: v.AuthenticatorCredentialType,
+			Default:        v.Default,
+			Health:         v.Health,
+		})
+	}
+	return r, res.sendHeader(ctx)
+}
+
+func (s *Service) Login(ctx context.Context, in *signapipb.LoginRequest) (*signapipb.LoginResponse, error) {
+	header := http.Header{}
+	if in.Username != "" || in.Password != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(in.Username + ":" + in.Password))
+		header.Set("Authorization", "Basic "+creds)
+	}
+	res, err := s.call(ctx, http.MethodPost, "/v1/auth/"+url.PathEscape(in.Authenticator), nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	r := &signapipb.LoginResponse{Token: res.body.String()}
+	switch {
+	case res.status == http.StatusOK:
+		if expires, err := time.Parse(time.RFC3339, res.header.Get(objects.PasswordExpiresHeader)); err == nil {
+			r.PasswordExpires = timestamppb.New(expires)
+		}
+	case (res.status == http.StatusSeeOther || res.status == http.StatusAccepted) && res.header.Get("Location") != "":
+		r.RedirectUrl = res.header.Get("Location")
+		r.UserCode = res.header.Get(objects.FederationUserCodeHeader)
+	case res.status == http.StatusAccepted && res.header.Get(objects.AuthChallengeHeader) != "":
+		r.Challenge = res.header.Get(objects.AuthChallengeHeader)
+	default:
+		return nil, res.err(ctx)
+	}
+	return r, res.sendHeader(ctx)
+}
+
+func (s *Service) Sign(ctx context.Context, in *signapipb.SignRequest) (*signapipb.CertificateResponse, error) {
+	q := url.Values{}
+	setTime(q, "expires", in.Expires)
+	setString(q, "include_principals", in.IncludePrincipals)
+	setString(q, "exclude_principals", in.ExcludePrincipals)
+	setString(q, "ca", in.Ca)
+	res, err := s.call(ctx, http.MethodPost, "/v1/sign", q, nil, []byte(in.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	if res.status == http.StatusAccepted {
+		return nil, status.Error(codes.Unimplemented, "the principals require approval, which is only available over the REST API")
+	}
+	return res.certificate(ctx)
+}
+
+func (s *Service) SignHost(ctx context.Context, in *signapipb.SignHostRequest) (*signapipb.CertificateResponse, error) {
+	q := url.Values{"hostnames": in.Hostnames}
+	setTime(q, "expires", in.Expires)
+	setString(q, "ca", in.Ca)
+	res, err := s.call(ctx, http.MethodPost, "/v1/host/sign", q, nil, []byte(in.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	return res.certificate(ctx)
+}
+
+func (s *Service) BootstrapHost(ctx context.Context, in *signapipb.BootstrapHostRequest) (*signapipb.CertificateResponse, error) {
+	q := url.Values{"hostnames": in.Hostnames}
+	setTime(q, "expires", in.Expires)
+	setString(q, "ca", in.Ca)
+	header := http.Header{}
+	if in.Token != "" {
+		header.Set("X-Bootstrap-Token", in.Token)
+	}
+	res, err := s.call(ctx, http.MethodPost, "/v1/host/bootstrap", q, header, []byte(in.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	return res.certificate(ctx)
+}
+
+func (s *Service) GetCA(ctx context.Context, in *signapipb.GetCARequest) (*signapipb.GetCAResponse, error) {
+	q := url.Values{}
+	setString(q, "ca", in.Ca)
+	res, err := s.call(ctx, http.MethodGet, "/v1/ca", q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.status != http.StatusOK {
+		return nil, res.err(ctx)
+	}
+	return &signapipb.GetCAResponse{PublicKey: res.body.String()}, res.sendHeader(ctx)
+}
+
+func (s *Service) GetKRL(ctx context.Context, in *signapipb.GetKRLRequest) (*signapipb.GetKRLResponse, error) {
+	res, err := s.call(ctx, http.MethodGet, "/v1/krl", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.status != http.StatusOK {
+		return nil, res.err(ctx)
+	}
+	return &signapipb.GetKRLResponse{Krl: res.body.Bytes()}, res.sendHeader(ctx)
+}
+
+func (s *Service) GetVersion(ctx context.Context, in *signapipb.GetVersionRequest) (*signapipb.GetVersionResponse, error) {
+	res, err := s.call(ctx, http.MethodGet, "/version", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if res.status != http.StatusOK {
+		return nil, res.err(ctx)
+	}
+	return &signapipb.GetVersionResponse{Version: res.body.String()}, res.sendHeader(ctx)
+}
+
+// Serve the REST request built from the call and its metadata
+func (s *Service) call(ctx context.Context, method, path string, query url.Values, header http.Header, body []byte) (*response, error) {
+	u := &url.URL{Path: path}
+	if len(query) > 0 {
+		u.RawQuery = query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, v := range md {
+		if forwardKey(k) {
+			for _, vv := range v {
+				req.Header.Add(k, vv)
+			}
+		}
+	}
+	if v := md.Get(":authority"); len(v) > 0 {
+		req.Host = v[0]
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		req.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state := info.State
+			req.TLS = &state
+		}
+	}
+	res := &response{header: http.Header{}}
+	s.handler.ServeHTTP(res, req)
+	if res.status == 0 {
+		res.status = http.StatusOK
+	}
+	return res, nil
+}
+
+// Metadata forwarded as request headers. Reserved and binary keys are
+// skipped along with the ones describing the gRPC request itself
+func forwardKey(k string) bool {
+	if strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") || strings.HasSuffix(k, "-bin") {
+		return false
+	}
+	switch k {
+	case "content-type", "content-length", "te":
+		return false
+	}
+	return true
+}
+
+func setString(q url.Values, k, v string) {
+	if v != "" {
+		q.Set(k, v)
+	}
+}
+
+func setTime(q url.Values, k string, ts *timestamppb.Timestamp) {
+	if ts != nil {
+		q.Set(k, ts.AsTime().Format(time.RFC3339))
+	}
+}
+
+// Response of the REST API
+type response struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (r *response) Header() http.Header {
+	return r.header
+}
+
+func (r *response) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.body.Write(b)
+}
+
+func (r *response) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *response) certificate(ctx context.Context) (*signapipb.CertificateResponse, error) {
+	if r.status != http.StatusOK {
+		return nil, r.err(ctx)
+	}
+	return &signapipb.CertificateResponse{Certificate: r.body.String()}, r.sendHeader(ctx)
+}
+
+// Response headers as metadata
+func (r *response) metadata() metadata.MD {
+	md := metadata.MD{}
+	for k, v := range r.header {
+		switch k {
+		case "Content-Type", "Content-Length":
+			continue
+		}
+		md[strings.ToLower(k)] = v
+	}
+	return md
+}
+
+func (r *response) sendHeader(ctx context.Context) error {
+	return grpc.SetHeader(ctx, r.metadata())
+}
+
+// The failed response as a status with the problem details
+func (r *response) err(ctx context.Context) error {
+	grpc.SetTrailer(ctx, r.metadata())
+	p := &objects.Problem{}
+	if strings.HasPrefix(r.header.Get("Content-Type"), objects.MIMEProblemJSON) {
+		json.Unmarshal(r.body.Bytes(), p)
+	}
+	if p.Status == 0 {
+		p.Status = r.status
+		p.Title = http.StatusText(r.status)
+		p.Detail = strings.TrimSpace(r.body.String())
+	}
+	st := status.New(StatusCode(p.Status), p.Error())
+	if ds, err := st.WithDetails(&signapipb.Problem{
+		Type:           p.Type,
+		Title:          p.Title,
+		Status:         int32(p.Status),
+		Detail:         p.Detail,
+		Instance:       p.Instance,
+		Code:           p.Code,
+		RequestId:      p.RequestID,
+		CorrelationId:  p.CorrelationID,
+		AuditId:        p.AuditID,
+		StepUpBackends: p.StepUpBackends,
+	}); err == nil {
+		st = ds
+	}
+	return st.Err()
+}
+
+// StatusCode returns the gRPC code matching the HTTP status
+func StatusCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		return codes.Unavailable
+	case http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	if httpStatus >= 500 {
+		return codes.Internal
+	}
+	return codes.Unknown
+}
+
+// HTTPStatus returns the HTTP status matching the gRPC code
+func HTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.Aborted, codes.AlreadyExists:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// ProblemFromStatus returns the problem details carried by the status, nil
+// if there are none
+func ProblemFromStatus(st *status.Status) *objects.Problem {
+	for _, d := range st.Details() {
+		if p, ok := d.(*signapipb.Problem); ok {
+			return &objects.Problem{
+				Type:           p.Type,
+				Title:          p.Title,
+				Status:         int(p.Status),
+				Detail:         p.Detail,
+				Instance:       p.Instance,
+				Code:           p.Code,
+				RequestID:      p.RequestId,
+				CorrelationID:  p.CorrelationId,
+				AuditID:        p.AuditId,
+				StepUpBackends: p.StepUpBackends,
+			}
+		}
+	}
+	return nil
+}
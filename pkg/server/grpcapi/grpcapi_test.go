@@ -0,0 +1,177 @@
+package grpcapi
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	signapipb "github.com/aakso/ssh-inscribe/pkg/server/signapi/proto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// REST API stub recording the last request
+type restStub struct {
+	req  *http.Request
+	body string
+}
+
+func (rs *restStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rs.req = r
+	b, _ := ioutil.ReadAll(r.Body)
+	rs.body = string(b)
+	switch r.URL.Path {
+	case "/v1/auth":
+		json.NewEncoder(w).Encode([]objects.DiscoverResult{{AuthenticatorName: "file", AuthenticatorCredentialType: "user_password", Default: true}})
+	case "/v1/auth/file":
+		user, pw, _ := r.BasicAuth()
+		switch {
+		case user == "test" && pw == "secret":
+			w.Header().Set(objects.PasswordExpiresHeader, "2030-01-02T03:04:05Z")
+			w.Write([]byte("token"))
+		case user == "test" && pw == "":
+			w.Header().Set(objects.AuthChallengeHeader, "enter the code")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte("pending"))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	case "/v1/sign":
+		if r.URL.Query().Get("include_principals") == "sensitive" {
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		if r.Header.Get("X-Auth") != "Bearer token" {
+			w.Header().Set("Content-Type", objects.MIMEProblemJSON)
+			w.Header().Set(objects.RequestIDHeader, "req1")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(objects.Problem{
+				Status:         http.StatusUnauthorized,
+				Title:          "Unauthorized",
+				Detail:         "log in again",
+				Code:           objects.ErrorStepUpRequired,
+				StepUpBackends: []string{"totp"},
+			})
+			return
+		}
+		w.Write([]byte("cert"))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func dial(t *testing.T, h http.Handler) *grpc.ClientConn {
+	l := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	New(h).Register(srv)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return l.Dial() }),
+		grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	stub := &restStub{}
+	client := signapipb.NewAuthClient(dial(t, stub))
+	ctx := context.Background()
+
+	dr, err := client.Discover(ctx, &signapipb.DiscoverRequest{})
+	if assert.NoError(err) && assert.Len(dr.Authenticators, 1) {
+		assert.Equal("file", dr.Authenticators[0].Name)
+		assert.True(dr.Authenticators[0].Default)
+	}
+
+	lr, err := client.Login(ctx, &signapipb.LoginRequest{Authenticator: "file", Username: "test", Password: "secret"})
+	if assert.NoError(err) {
+		assert.Equal("token", lr.Token)
+		assert.Equal(time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC), lr.PasswordExpires.AsTime())
+	}
+	assert.Equal(http.MethodPost, stub.req.Method)
+
+	lr, err = client.Login(ctx, &signapipb.LoginRequest{Authenticator: "file", Username: "test"})
+	if assert.NoError(err) {
+		assert.Equal("pending", lr.Token)
+		assert.Equal("enter the code", lr.Challenge)
+	}
+
+	_, err = client.Login(ctx, &signapipb.LoginRequest{Authenticator: "file", Username: "test", Password: "wrong"})
+	assert.Equal(codes.Unauthenticated, status.Code(err))
+}
+
+func TestSign(t *testing.T) {
+	assert := assert.New(t)
+	stub := &restStub{}
+	client := signapipb.NewSignerClient(dial(t, stub))
+	expires := time.Now().Add(time.Hour).Truncate(time.Second)
+	in := &signapipb.SignRequest{
+		PublicKey:         "ssh-ed25519 AAAA",
+		Expires:           timestamppb.New(expires),
+		ExcludePrincipals: "root",
+	}
+
+	// Metadata is passed as headers
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-auth", "Bearer token", "x-correlation-id", "corr1")
+	var header metadata.MD
+	res, err := client.Sign(ctx, in, grpc.Header(&header))
+	if assert.NoError(err) {
+		assert.Equal("cert", res.Certificate)
+	}
+	assert.Equal("ssh-ed25519 AAAA", stub.body)
+	assert.Equal("corr1", stub.req.Header.Get(objects.CorrelationIDHeader))
+	assert.Equal("root", stub.req.URL.Query().Get("exclude_principals"))
+	parsed, _ := time.Parse(time.RFC3339, stub.req.URL.Query().Get("expires"))
+	assert.True(expires.Equal(parsed))
+
+	// Problem details and headers of errors
+	var trailer metadata.MD
+	_, err = client.Sign(context.Background(), in, grpc.Trailer(&trailer))
+	st, _ := status.FromError(err)
+	assert.Equal(codes.Unauthenticated, st.Code())
+	assert.Equal("log in again", st.Message())
+	if p := ProblemFromStatus(st); assert.NotNil(p) {
+		assert.Equal(objects.ErrorStepUpRequired, p.Code)
+		assert.Equal(http.StatusUnauthorized, p.Status)
+		assert.Equal([]string{"totp"}, p.StepUpBackends)
+	}
+	assert.Equal([]string{"req1"}, trailer.Get(objects.RequestIDHeader))
+
+	// Approvals are not available
+	in.IncludePrincipals = "sensitive"
+	_, err = client.Sign(ctx, in)
+	assert.Equal(codes.Unimplemented, status.Code(err))
+}
+
+func TestStatusCodes(t *testing.T) {
+	assert := assert.New(t)
+	for _, s := range []int{
+		http.StatusBadRequest,
+		http.StatusUnauthorized,
+		http.StatusForbidden,
+		http.StatusNotFound,
+		http.StatusConflict,
+		http.StatusTooManyRequests,
+		http.StatusNotImplemented,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+		http.StatusInternalServerError,
+	} {
+		assert.Equal(s, HTTPStatus(StatusCode(s)))
+	}
+}
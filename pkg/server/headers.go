@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// Set the standard security headers on all responses. Handlers may override
+// them, the web UI sets its own content security policy
+func SecurityHeaders(conf SecurityHeadersConfig) echo.MiddlewareFunc {
+	csp := conf.ContentSecurityPolicy
+	if csp != "" && !strings.Contains(csp, "frame-ancestors") {
+		ancestors := "'none'"
+		if len(conf.FrameAncestors) > 0 {
+			ancestors = strings.Join(conf.FrameAncestors, " ")
+		}
+		csp += "; frame-ancestors " + ancestors
+	}
+	hsts := ""
+	if conf.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d; includeSubDomains", conf.HSTSMaxAge)
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			h := c.Response().Header()
+			h.Set("X-Content-Type-Options", "nosniff")
+			if len(conf.FrameAncestors) == 0 {
+				h.Set("X-Frame-Options", "DENY")
+			}
+			if csp != "" {
+				h.Set("Content-Security-Policy", csp)
+			}
+			if conf.ReferrerPolicy != "" {
+				h.Set("Referrer-Policy", conf.ReferrerPolicy)
+			}
+			if hsts != "" && (c.IsTLS() || c.Request().Header.Get(echo.HeaderXForwardedProto) == "https") {
+				h.Set(echo.HeaderStrictTransportSecurity, hsts)
+			}
+			// Tokens and certificates must not end up in shared caches
+			if strings.HasPrefix(c.Request().URL.Path, "/v1/") {
+				h.Set("Cache-Control", "no-store")
+			}
+			return next(c)
+		}
+	}
+}
+
+// Set additional headers on all responses, e.g. for gateways in front of
+// the server. Handlers may override them
+func ResponseHeaders(headers map[string]string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			h := c.Response().Header()
+			for k, v := range headers {
+				h.Set(k, v)
+			}
+			return next(c)
+		}
+	}
+}
+
+// CORS for browser based login flows on the configured origins
+func newCORS(conf CORSConfig) echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins: conf.AllowOrigins,
+		AllowMethods: []string{http.MethodGet, http.MethodPost, http.MethodDelete},
+		AllowHeaders: []string{
+			"X-Auth",
+			echo.HeaderAuthorization,
+			echo.HeaderContentType,
+			objects.CorrelationIDHeader,
+			objects.AudienceHeader,
+			objects.RealmHeader,
+		},
+		ExposeHeaders:    []string{echo.HeaderLocation, echo.HeaderXRequestID, objects.RequestIDHeader, objects.CorrelationIDHeader, objects.FederationUserCodeHeader, objects.AuthChallengeHeader, objects.PasswordExpiresHeader, "Retry-After"},
+		AllowCredentials: conf.AllowCredentials,
+		MaxAge:           conf.MaxAge,
+	})
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ALPN protocols offered on the TLS listener
+func (conf HTTPConfig) nextProtos(extra ...string) []string {
+	r := []string{"http/1.1"}
+	if conf.HTTP2 {
+		r = []string{"h2", "http/1.1"}
+	}
+	return append(r, extra...)
+}
+
+func parseTimeout(name, v string) (time.Duration, error) {
+	if v == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s", name)
+	}
+	return d, nil
+}
+
+// Apply the timeouts and protocol settings to the server. HTTP/2 is
+// configured explicitly so that the stream limits apply
+func (conf HTTPConfig) configure(srv *http.Server) error {
+	var err error
+	if srv.IdleTimeout, err = parseTimeout("idleTimeout", conf.IdleTimeout); err != nil {
+		return err
+	}
+	if srv.ReadHeaderTimeout, err = parseTimeout("readHeaderTimeout", conf.ReadHeaderTimeout); err != nil {
+		return err
+	}
+	if srv.ReadTimeout, err = parseTimeout("readTimeout", conf.ReadTimeout); err != nil {
+		return err
+	}
+	if srv.WriteTimeout, err = parseTimeout("writeTimeout", conf.WriteTimeout); err != nil {
+		return err
+	}
+	if conf.MaxConnections < 0 {
+		return errors.New("maxConnections must not be negative")
+	}
+	srv.MaxHeaderBytes = conf.MaxHeaderBytes
+	srv.SetKeepAlivesEnabled(!conf.DisableKeepAlives)
+	if !conf.HTTP2 {
+		// A non-nil empty map disables the automatic HTTP/2 support
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return nil
+	}
+	return http2.ConfigureServer(srv, conf.http2Server(srv))
+}
+
+func (conf HTTPConfig) http2Server(srv *http.Server) *http2.Server {
+	return &http2.Server{
+		MaxConcurrentStreams: conf.MaxConcurrentStreams,
+		IdleTimeout:          srv.IdleTimeout,
+	}
+}
+
+// Wrap the handler to accept HTTP/2 without TLS when enabled
+func (conf HTTPConfig) handler(srv *http.Server, h http.Handler) http.Handler {
+	if !conf.H2C {
+		return h
+	}
+	return h2c.NewHandler(h, conf.http2Server(srv))
+}
+
+// Open a TCP listener with the keep-alive settings
+func (conf HTTPConfig) listen(addr string) (net.Listener, error) {
+	keepAlive, err := parseTimeout("tcpKeepAlive", conf.TCPKeepAlive)
+	if err != nil {
+		return nil, err
+	}
+	lc := net.ListenConfig{KeepAlive: keepAlive}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func (conf HTTPConfig) limit(l net.Listener) net.Listener {
+	if conf.MaxConnections <= 0 {
+		return l
+	}
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, conf.MaxConnections),
+		done:     make(chan struct{}),
+	}
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+// Accepts at most cap(sem) connections at once
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
@@ -5,6 +5,15 @@ import "github.com/aakso/ssh-inscribe/pkg/logging"
 
 var Log = logging.GetLogger("server").WithField("pkg", "server")
 
+const (
+	LifetimeExceededReject = "reject"
+	LifetimeExceededClamp  = "clamp"
+
+	SerialRandom = "random"
+	SerialFile   = "file"
+	SerialCertDB = "certdb"
+)
+
 func init() {
 	config.SetDefault("server", Defaults)
 }
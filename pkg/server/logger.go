@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi"
+	"github.com/aakso/ssh-inscribe/pkg/tracing"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 )
@@ -32,17 +34,18 @@ func RequestLogger(lf logrus.Fields) echo.MiddlewareFunc {
 				WithField("client_version", req.Header.Get("X-Version")).
 				WithField("remote_address", ra).
 				WithField("remote_port", port).
-				WithField("url", req.URL).
+				WithField("url", req.URL.String()).
 				WithField("method", req.Method)
+			if span := tracing.FromContext(req.Context()); span != nil {
+				log = log.WithField("trace_id", span.TraceID.String())
+			}
 
 			err := next(c)
 			end := time.Now()
 			log = log.
 				WithField("status", resp.Status).
-				WithField("took", end.Sub(start))
-			if rid := resp.Header().Get(echo.HeaderXRequestID); rid != "" {
-				log = log.WithField("audit_id", rid)
-			}
+				WithField("took", end.Sub(start).String()).
+				WithFields(signapi.LogFields(c))
 			if err != nil {
 				c.Error(err)
 				log.WithError(err).
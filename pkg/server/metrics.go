@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ssh_inscribe_http_requests_in_flight",
+		Help: "Number of HTTP requests currently being served",
+	})
+	metricHTTPRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ssh_inscribe_http_requests_total",
+			Help: "HTTP requests by method and response code",
+		},
+		[]string{"method", "code"},
+	)
+)
+
+func RequestMetrics() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			metricInFlight.Inc()
+			defer metricInFlight.Dec()
+			err := next(c)
+			code := responseStatus(c, err)
+			metricHTTPRequests.WithLabelValues(c.Request().Method, strconv.Itoa(code)).Inc()
+			return err
+		}
+	}
+}
+
+// Status of the response including errors not yet handled
+func responseStatus(c echo.Context, err error) int {
+	if he, ok := err.(*echo.HTTPError); ok {
+		return he.Code
+	} else if err != nil {
+		return http.StatusInternalServerError
+	}
+	return c.Response().Status
+}
+
+// Metrics handler with optional basic auth
+func metricsHandler(conf MetricsConfig) http.Handler {
+	h := promhttp.Handler()
+	if conf.Username == "" && conf.Password == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pw, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(conf.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pw), []byte(conf.Password)) != 1 {
+			w.Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="metrics"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) startMetricsListener(l net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(s.config.Metrics))
+	s.metricsServer = &http.Server{
+		Addr:    s.config.Metrics.Listen,
+		Handler: mux,
+	}
+	log := Log.WithField("listen", s.config.Metrics.Listen)
+	go func() {
+		log.Info("metrics listener starting")
+		if err := s.serveListener("metrics", s.metricsServer, l); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("metrics listener failed")
+		}
+	}()
+}
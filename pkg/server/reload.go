@@ -0,0 +1,118 @@
+package server
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/aakso/ssh-inscribe/pkg/systemd"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricConfigReloads = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ssh_inscribe_config_reloads_total",
+		Help: "Configuration reloads by result",
+	},
+	[]string{"result"},
+)
+
+// Re-read the configuration file and apply it without dropping requests in
+// flight. Settings bound to the listeners, the signer and the stores keep
+// their startup values until restart
+func (s *Server) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	notify(systemd.Reloading)
+	defer notify(systemd.Ready)
+	err := s.reload()
+	if err != nil {
+		metricConfigReloads.WithLabelValues("failure").Inc()
+		Log.WithError(err).Error("configuration reload failed, keeping the previous configuration")
+		return err
+	}
+	metricConfigReloads.WithLabelValues("success").Inc()
+	Log.Info("configuration reloaded")
+	return nil
+}
+
+func (s *Server) reload() error {
+	if err := config.Reload(); err != nil {
+		return err
+	}
+	if err := logging.Setup(); err != nil {
+		return errors.Wrap(err, "cannot reload logging")
+	}
+	conf, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	for _, name := range restartRequired(s.startConfig, conf) {
+		Log.WithField("setting", name).Warn("setting changed but requires a restart to take effect")
+	}
+	return s.apply(conf)
+}
+
+// Settings that cannot be changed at runtime
+func restartRequired(old, new *Config) []string {
+	var r []string
+	check := func(name string, changed bool) {
+		if changed {
+			r = append(r, name)
+		}
+	}
+	check("listen", old.Listen != new.Listen)
+	check("agentSocket", old.AgentSocket != new.AgentSocket)
+	check("pkcs11Provider", old.PKCS11Provider != new.PKCS11Provider)
+	check("certSigningKeyFingerprint", old.CertSigningKeyFingerprint != new.CertSigningKeyFingerprint)
+	check("tokenSigningKey", old.TokenSigningKey != new.TokenSigningKey)
+	check("revocationStore", old.RevocationStore != new.RevocationStore)
+	check("metrics.listen", old.Metrics.Listen != new.Metrics.Listen)
+	check("hostCertificates.bootstrapTokenStore",
+		old.HostCertificates.BootstrapTokenStore != new.HostCertificates.BootstrapTokenStore)
+	check("serial", old.Serial != new.Serial)
+	check("caRotationStore", old.CARotationStore != new.CARotationStore)
+	check("unixSocket", old.UnixSocket != new.UnixSocket)
+	check("adminListener", old.AdminListener != new.AdminListener)
+	check("grpc", old.GRPC != new.GRPC)
+	check("http", old.HTTP != new.HTTP)
+	check("acme", !reflect.DeepEqual(old.ACME, new.ACME))
+	check("approval.store", old.Approval.Store != new.Approval.Store)
+	check("approval.ttl", old.Approval.TTL != new.Approval.TTL)
+	return r
+}
+
+// Reload the configuration on SIGHUP and shut down gracefully on SIGTERM and
+// SIGINT
+func (s *Server) handleSignals() {
+	ch := make(chan os.Signal, 1)
+	sigs := []os.Signal{syscall.SIGHUP, syscall.SIGTERM, os.Interrupt}
+	if upgradeSignal != nil {
+		sigs = append(sigs, upgradeSignal)
+	}
+	signal.Notify(ch, sigs...)
+	go func() {
+		for sig := range ch {
+			switch sig {
+			case syscall.SIGHUP:
+				Log.Info("received SIGHUP, reloading configuration")
+				s.Reload()
+			case upgradeSignal:
+				Log.WithField("signal", sig.String()).Info("received signal, upgrading")
+				if err := s.Upgrade(); err != nil {
+					Log.WithError(err).Error("upgrade failed, continuing to serve")
+				}
+			default:
+				Log.WithField("signal", sig.String()).Info("received signal")
+				signal.Stop(ch)
+				s.Shutdown()
+				return
+			}
+		}
+	}()
+}
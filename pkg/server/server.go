@@ -2,89 +2,307 @@ package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
+	stdlog "log"
+	"net"
 	"net/http"
+	"os"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aakso/ssh-inscribe/pkg/globals"
 
+	"github.com/aakso/ssh-inscribe/pkg/approval"
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/auth/authz/authzmap"
 	authbackend "github.com/aakso/ssh-inscribe/pkg/auth/backend"
+	"github.com/aakso/ssh-inscribe/pkg/bootstrap"
+	"github.com/aakso/ssh-inscribe/pkg/carotation"
+	"github.com/aakso/ssh-inscribe/pkg/certdb"
 	"github.com/aakso/ssh-inscribe/pkg/config"
 	"github.com/aakso/ssh-inscribe/pkg/keysigner"
+	"github.com/aakso/ssh-inscribe/pkg/policy"
+	"github.com/aakso/ssh-inscribe/pkg/ratelimit"
+	"github.com/aakso/ssh-inscribe/pkg/revocation"
+	"github.com/aakso/ssh-inscribe/pkg/serial"
 	"github.com/aakso/ssh-inscribe/pkg/server/signapi"
+	"github.com/aakso/ssh-inscribe/pkg/server/webui"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/aakso/ssh-inscribe/pkg/storage"
+	"github.com/aakso/ssh-inscribe/pkg/systemd"
+	"github.com/aakso/ssh-inscribe/pkg/tracing"
 	"github.com/aakso/ssh-inscribe/pkg/util"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/bytes"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
 )
 
 type Server struct {
-	config *Config
-	web    *echo.Echo
+	metricsServer *http.Server
+	acmeServer    *http.Server
+	adminServer   *http.Server
+	httpServer    *http.Server
+	grpcServer    *grpc.Server
+
+	// Created once and kept over configuration reloads
+	startConfig *Config
+	signer      *keysigner.KeySignerService
+	tokenKey    []byte
+	revocations *revocation.Store
+	certs       certdb.Store
+	storeCerts  bool
+	storage     storage.Storage
+	bootstrap   *bootstrap.Store
+	rotation    *carotation.Store
+	approvals   *approval.Store
+	serials     serial.Generator
+	acme        *autocert.Manager
+
+	// Serializes reloads
+	reloadMu sync.Mutex
+	// Closed once shutdown has completed
+	shutdownDone chan struct{}
+	shutdownOnce sync.Once
+
+	// Listeners handed over on upgrade and the binary started for it
+	listenersMu sync.Mutex
+	listeners   []inheritedListener
+	pausables   []*pauseListener
+	executable  string
+	upgrading   int32
+	// Connections waiting for their first request
+	connsMu  sync.Mutex
+	newConns map[net.Conn]struct{}
+	// Set once the listeners are served by the new process
+	handedOver int32
+
+	// Replaced on configuration reload
+	mu        sync.RWMutex
+	config    *Config
+	web       *echo.Echo
+	adminWeb  *echo.Echo
+	tlsConfig *tls.Config
 
 	// APIs
 	signapi *signapi.SignApi
 }
 
 func (s *Server) Start() error {
-	var err error
-	log := Log.WithField("server_version", globals.Version())
-	s.web.Logger.SetOutput(ioutil.Discard)
-
-	cc, err := s.config.GetCertificateMap()
+	if exe, err := os.Executable(); err == nil {
+		s.executable = exe
+	}
+	inheritListeners()
+	activated, err := systemd.Listeners()
 	if err != nil {
-		return errors.Wrap(err, "invalid certificate configuration")
+		return errors.Wrap(err, "cannot start server")
+	}
+	// Sockets passed by systemd or by the previous process on upgrade are
+	// matched by their FileDescriptorName. Unnamed sockets are served as the
+	// API
+	var listeners []net.Listener
+	var metricsListener, acmeListener, adminListener, grpcListener net.Listener
+	for _, l := range activated {
+		switch l.Name {
+		case "metrics":
+			metricsListener = l.Listener
+		case "acme":
+			acmeListener = l.Listener
+		case "admin":
+			adminListener = l.Listener
+		case "grpc":
+			grpcListener = l.Listener
+		default:
+			listeners = append(listeners, l.Listener)
+		}
 	}
 
-	if len(cc.Certificates) > 0 {
-		// Configure TLSServer before starting
-		tlsServer := s.web.TLSServer
-		tlsServer.TLSConfig = new(tls.Config)
-
-		if len(cc.Certificates) == 1 {
-			tlsServer.TLSConfig.Certificates = make([]tls.Certificate, 1)
-			tlsServer.TLSConfig.Certificates[0] = cc.Certificates[0]
-		} else {
-			tlsServer.TLSConfig.NameToCertificate = cc.CertificateMap
-			tlsServer.TLSConfig.Certificates = cc.Certificates
+	if s.config.Metrics.Enabled && (s.config.Metrics.Listen != "" || metricsListener != nil) {
+		s.startMetricsListener(metricsListener)
+	} else if metricsListener != nil {
+		Log.Warn("metrics socket passed by systemd but separate metrics listener is not enabled")
+		metricsListener.Close()
+	}
+	if s.acme != nil && (s.config.ACME.HTTPListen != "" || acmeListener != nil) {
+		s.startACMEListener(acmeListener)
+	} else if acmeListener != nil {
+		Log.Warn("acme socket passed by systemd but acme is not enabled")
+		acmeListener.Close()
+	}
+	if s.config.AdminListener.enabled() || adminListener != nil {
+		if err := s.startAdminListener(adminListener); err != nil {
+			return err
 		}
+	}
+	if s.config.GRPC.Listen != "" || grpcListener != nil {
+		if err := s.startGRPCListener(grpcListener); err != nil {
+			return err
+		}
+	}
 
-		tlsServer.Addr = s.config.Listen
-		if !s.web.DisableHTTP2 {
-			tlsServer.TLSConfig.NextProtos = append(tlsServer.TLSConfig.NextProtos, "h2")
+	s.httpServer = &http.Server{
+		Addr:     s.config.Listen,
+		ErrorLog: stdlog.New(Log.WriterLevel(logrus.DebugLevel), "", 0),
+	}
+	if s.tlsConfig != nil {
+		s.httpServer.TLSConfig = &tls.Config{
+			NextProtos:         s.config.HTTP.nextProtos(),
+			GetConfigForClient: s.getTLSConfig,
 		}
-		log.WithField("listen", fmt.Sprintf("https://%s", s.config.Listen)).WithField(
-			"certificates", fmt.Sprintf("%d", len(cc.Certificates))).Info("server starting")
+	}
+	if err := s.config.HTTP.configure(s.httpServer); err != nil {
+		return errors.Wrap(err, "invalid http configuration")
+	}
+	s.httpServer.Handler = s.config.HTTP.handler(s.httpServer, s)
+	s.httpServer.ConnState = s.trackConnState
+	if len(listeners) > 0 {
+		Log.WithField("sockets", len(listeners)).Info("using inherited sockets, ignoring listen and unixSocket")
+		for i, l := range listeners {
+			s.addListener(listenerNameAPI, l)
+			if l.Addr().Network() != "unix" {
+				listeners[i] = s.config.HTTP.limit(l)
+			}
+		}
+	} else if listeners, err = s.listen(); err != nil {
+		return errors.Wrap(err, "cannot start server")
+	}
+	if len(listeners) == 0 {
+		return errors.New("cannot start server: no listeners configured")
+	}
+	s.handleSignals()
+
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go s.serve(s.pausable(l), errCh)
+	}
+	notify(systemd.Ready)
+	upgradeReady()
+	s.startWatchdog()
+
+	select {
+	case err := <-errCh:
+		return errors.Wrap(err, "cannot start server")
+	case <-s.shutdownDone:
+		// Requests in flight have drained
+		return nil
+	}
+}
 
-		err = s.web.StartServer(tlsServer)
+// Open the configured TCP and unix socket listeners
+func (s *Server) listen() ([]net.Listener, error) {
+	var r []net.Listener
+	if s.config.Listen != "" {
+		l, err := s.config.HTTP.listen(s.config.Listen)
 		if err != nil {
-			return errors.Wrap(err, "cannot start server")
+			return nil, err
 		}
-	} else {
-		log.WithField("listen", fmt.Sprintf("http://%s", s.config.Listen)).Warn("server starting without TLS")
-		err = s.web.Start(s.config.Listen)
+		s.addListener(listenerNameAPI, l)
+		r = append(r, s.config.HTTP.limit(l))
 	}
-	if err != nil {
-		return errors.Wrap(err, "cannot start server")
+	if s.config.UnixSocket.Path != "" {
+		l, err := newUnixListener(s.config.UnixSocket)
+		if err != nil {
+			for _, l := range r {
+				l.Close()
+			}
+			return nil, errors.Wrap(err, "cannot listen on unix socket")
+		}
+		s.addListener(listenerNameAPI, l)
+		r = append(r, l)
 	}
-	return nil
+	return r, nil
 }
 
-func (s *Server) initApi() {
-	s.web.Use(RecoverHandler(Log.Data))
-	s.web.HTTPErrorHandler = errorHandler
-	s.web.Use(RequestLogger(Log.Data))
-	s.web.Use(middleware.BodyLimit("1M"))
-	g := s.web.Group("/v1")
-	s.signapi.RegisterRoutes(g)
-	s.web.GET("/version", handleVersion)
+// Serve the API on the listener. TLS is not used on unix sockets
+func (s *Server) serve(l net.Listener, errCh chan<- error) {
+	log := Log.WithField("server_version", globals.Version())
+	var err error
+	switch {
+	case l.Addr().Network() == "unix":
+		log.WithField("listen", fmt.Sprintf("unix:%s", l.Addr())).Info("server starting")
+		err = s.httpServer.Serve(l)
+	case s.tlsConfig != nil:
+		log = log.WithField("listen", fmt.Sprintf("https://%s", l.Addr()))
+		if s.acme != nil {
+			log = log.WithField("acme_hostnames", strings.Join(s.config.ACME.Hostnames, ","))
+		} else {
+			log = log.WithField("certificates", fmt.Sprintf("%d", len(s.tlsConfig.Certificates)))
+		}
+		log.Info("server starting")
+		err = s.httpServer.ServeTLS(l, "", "")
+	default:
+		log.WithField("listen", fmt.Sprintf("http://%s", l.Addr())).Warn("server starting without TLS")
+		err = s.httpServer.Serve(l)
+	}
+	if err != nil && err != http.ErrServerClosed {
+		errCh <- err
+	}
 }
 
-func Build() (*Server, error) {
-	// Configuration
+// Serve with the current configuration. Requests in flight during a reload
+// finish with the configuration they started with
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isUnixConn(r) {
+		r.RemoteAddr = unixPeerAddr
+	}
+	s.mu.RLock()
+	web := s.web
+	s.mu.RUnlock()
+	web.ServeHTTP(w, r)
+}
+
+func (s *Server) getTLSConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tlsConfig, nil
+}
+
+func (s *Server) newWeb(conf *Config, api *signapi.SignApi, ipExtractor echo.IPExtractor) *echo.Echo {
+	web := echo.New()
+	web.Logger.SetOutput(ioutil.Discard)
+	web.IPExtractor = ipExtractor
+	web.Use(RecoverHandler(Log.Data))
+	web.HTTPErrorHandler = errorHandler
+	web.Use(signapi.RequestID())
+	web.Use(TraceRequests())
+	web.Use(RequestLogger(Log.Data))
+	web.Use(RequestMetrics())
+	web.Use(middleware.BodyLimit(conf.RequestLimits.MaxBodySize))
+	if conf.SecurityHeaders.Enabled {
+		web.Use(SecurityHeaders(conf.SecurityHeaders))
+	}
+	if len(conf.ResponseHeaders) > 0 {
+		web.Use(ResponseHeaders(conf.ResponseHeaders))
+	}
+	if len(conf.CORS.AllowOrigins) > 0 {
+		web.Use(newCORS(conf.CORS))
+	}
+	g := web.Group("/v1")
+	if conf.AdminListener.enabled() {
+		api.RegisterPublicRoutes(g)
+	} else {
+		api.RegisterRoutes(g)
+	}
+	web.GET("/version", handleVersion)
+	if conf.WebUI {
+		webui.RegisterRoutes(web, conf.SecurityHeaders.FrameAncestors...)
+	}
+	if conf.Metrics.Enabled && conf.Metrics.Listen == "" && !conf.AdminListener.enabled() {
+		web.GET("/metrics", echo.WrapHandler(metricsHandler(conf.Metrics)))
+	}
+	return web
+}
+
+func loadConfig() (*Config, error) {
 	tmp, err := config.Get("server")
 	if err != nil {
 		return nil, errors.Wrap(err, "cannot initialize server")
@@ -93,26 +311,34 @@ func Build() (*Server, error) {
 	if conf == nil {
 		return nil, errors.New("cannot initialize server. Invalid configuration")
 	}
-	maxlife, err := time.ParseDuration(conf.MaxCertLifetime)
-	if err != nil {
-		return nil, errors.Wrap(err, "invalid MaxCertLifeTime")
+	return conf, nil
+}
+
+func (s *Server) newTLSConfig(conf *Config) (*tls.Config, error) {
+	if conf.ACME.Enabled {
+		return s.newACMETLSConfig(conf)
 	}
-	defaultlife, err := time.ParseDuration(conf.DefaultCertLifetime)
+	cc, err := conf.GetCertificateMap()
 	if err != nil {
-		return nil, errors.Wrap(err, "invalid DefaultCertLifetime")
+		return nil, errors.Wrap(err, "invalid certificate configuration")
+	}
+	if len(cc.Certificates) == 0 {
+		return nil, nil
+	}
+	tc := &tls.Config{
+		Certificates: cc.Certificates,
+		NextProtos:   conf.HTTP.nextProtos(),
 	}
+	if len(cc.Certificates) > 1 {
+		tc.NameToCertificate = cc.CertificateMap
+	}
+	return tc, nil
+}
 
-	// Auth backends
-	authList := []signapi.AuthenticatorListEntry{}
-	for _, ab := range conf.AuthBackends {
-		instance, err := authbackend.GetBackend(ab.Type, ab.Config)
-		if err != nil {
-			return nil, errors.Wrap(err, "cannot initialize server")
-		}
-		authList = append(authList, signapi.AuthenticatorListEntry{
-			Authenticator: instance,
-			Default:       ab.Default,
-		})
+func Build() (*Server, error) {
+	conf, err := loadConfig()
+	if err != nil {
+		return nil, err
 	}
 
 	signer := keysigner.New(conf.AgentSocket, conf.CertSigningKeyFingerprint)
@@ -133,35 +359,774 @@ func Build() (*Server, error) {
 	}
 
 	// Generate random jwt token signing key in case none is set
-	if conf.TokenSigningKey == "" {
+	tokenKey := conf.TokenSigningKey
+	if tokenKey == "" {
 		Log.Info("generating random JWT token signing key as none is set")
-		conf.TokenSigningKey = util.RandB64(256)
+		tokenKey = util.RandB64(256)
+	}
+
+	s := &Server{
+		startConfig:  conf,
+		signer:       signer,
+		tokenKey:     []byte(tokenKey),
+		shutdownDone: make(chan struct{}),
+		newConns:     map[net.Conn]struct{}{},
+	}
+	audit.SetCASigner(signer.SignData)
+	if err := s.openStores(conf); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if conf.CARotationStore != "" {
+		if s.rotation, err = newRotationStore(conf, signer); err != nil {
+			return nil, errors.Wrap(err, "cannot initialize server")
+		}
+	}
+	if ac := conf.Approval; ac.Enabled {
+		ttl, err := time.ParseDuration(ac.TTL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid Approval.TTL")
+		}
+		if s.approvals, err = approval.NewStore(ac.Store, ttl); err != nil {
+			return nil, errors.Wrap(err, "cannot initialize server")
+		}
+	}
+	if conf.ACME.Enabled {
+		if s.acme, err = newACMEManager(conf.ACME); err != nil {
+			return nil, errors.Wrap(err, "cannot initialize server")
+		}
+	}
+	if hc := conf.HostCertificates; hc.Enabled && hc.BootstrapTokenStore != "" {
+		tokens, err := bootstrap.NewStore(hc.BootstrapTokenStore)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot initialize server")
+		}
+		s.bootstrap = tokens
+	}
+
+	if err := s.apply(conf); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load the CA rotation state and apply it to the signer
+func newRotationStore(conf *Config, signer *keysigner.KeySignerService) (*carotation.Store, error) {
+	store, err := carotation.NewStore(conf.CARotationStore)
+	if err != nil {
+		return nil, err
+	}
+	st := store.State()
+	if st.Current != "" {
+		if conf.CertSigningKeyFingerprint != "" && conf.CertSigningKeyFingerprint != st.Current {
+			Log.WithField("fingerprint", st.Current).
+				Warn("certSigningKeyFingerprint is overridden by a completed CA rotation, consider updating the configuration")
+		}
+		signer.SetDefaultFingerprint(st.Current)
+	}
+	if st.Next != "" && st.Cutover != nil {
+		err := signer.SetRotation(keysigner.Rotation{Next: st.Next, Cutover: *st.Cutover})
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid CA rotation state")
+		}
+		Log.WithField("fingerprint", st.Next).WithField("cutover", *st.Cutover).Info("CA key rotation in progress")
+	}
+	return store, nil
+}
+
+func newSerialGenerator(conf SerialConfig, certs certdb.Store) (serial.Generator, error) {
+	switch conf.Type {
+	case SerialRandom:
+		return serial.Random{}, nil
+	case SerialFile:
+		if conf.Path == "" {
+			return nil, errors.New("serial counter path is not set")
+		}
+		return serial.NewFileCounter(conf.Path)
+	case SerialCertDB:
+		sqlStore, ok := certs.(*certdb.SQLStore)
+		if !ok {
+			return nil, errors.New("serial type certdb requires the sql certificate store")
+		}
+		return serial.GeneratorFunc(sqlStore.NextSerial), nil
+	default:
+		return nil, errors.Errorf("invalid serial type: %s", conf.Type)
+	}
+}
+
+func newCAKeys(keys []CAKey) (map[string]string, error) {
+	r := make(map[string]string)
+	for _, k := range keys {
+		switch {
+		case k.Name == "" || k.Name == keysigner.DefaultCA:
+			return nil, errors.Errorf("invalid CA key name %q", k.Name)
+		case k.Fingerprint == "":
+			return nil, errors.Errorf("CA key %s has no fingerprint", k.Name)
+		}
+		if _, ok := r[k.Name]; ok {
+			return nil, errors.Errorf("duplicate CA key %s", k.Name)
+		}
+		r[k.Name] = k.Fingerprint
+	}
+	return r, nil
+}
+
+// Build the API from the configuration and make it current
+func (s *Server) apply(conf *Config) error {
+	tlsConfig, err := s.newTLSConfig(conf)
+	if err != nil {
+		return err
+	}
+	api, err := s.buildAPI(conf)
+	if err != nil {
+		return err
+	}
+	applied := false
+	defer func() {
+		if !applied {
+			api.CloseAuthenticators()
+		}
+	}()
+	ipExtractor, err := newIPExtractor(conf.TrustedProxies)
+	if err != nil {
+		return errors.Wrap(err, "invalid TrustedProxies")
+	}
+	if tlsConfig != nil && (api.UsesCredentialType(auth.CredentialClientCert) || api.UsesClientCertConditions()) {
+		// Client certificates are verified by the auth backends and the
+		// backend conditions
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+	web := s.newWeb(conf, api, ipExtractor)
+	adminWeb := s.newAdminWeb(conf, api, ipExtractor)
+	caKeys, err := newCAKeys(conf.CAKeys)
+	if err != nil {
+		return errors.Wrap(err, "invalid caKeys")
+	}
+
+	// Audit sinks are replaced last as they cannot be rolled back
+	if err := audit.Setup(); err != nil {
+		return errors.Wrap(err, "cannot initialize server")
+	}
+	if err := tracing.Setup(); err != nil {
+		return errors.Wrap(err, "cannot initialize server")
+	}
+	if err := s.signer.SetNamedKeys(caKeys); err != nil {
+		return errors.Wrap(err, "invalid caKeys")
+	}
+
+	s.mu.Lock()
+	prev := s.signapi
+	if prev != nil {
+		api.KeepRuntimeState(prev)
+	}
+	s.config = conf
+	s.signapi = api
+	s.web = web
+	s.adminWeb = adminWeb
+	s.tlsConfig = tlsConfig
+	s.mu.Unlock()
+	applied = true
+	api.StartHealthChecks()
+	if prev != nil {
+		// Requests in flight may still use the backends of the old API
+		go prev.CloseAuthenticators()
+	}
+	return nil
+}
+
+func (s *Server) buildAPI(conf *Config) (api *signapi.SignApi, err error) {
+	maxlife, err := time.ParseDuration(conf.MaxCertLifetime)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid MaxCertLifeTime")
+	}
+	defaultlife, err := time.ParseDuration(conf.DefaultCertLifetime)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid DefaultCertLifetime")
+	}
+
+	// Certificate lifetime limits
+	limits := signapi.LifetimeLimits{
+		Backends:        make(map[string]time.Duration),
+		BackendDefaults: make(map[string]time.Duration),
+		BackendMinimums: make(map[string]time.Duration),
+	}
+	switch conf.CertLifetimeExceeded {
+	case LifetimeExceededReject:
+	case LifetimeExceededClamp:
+		limits.Clamp = true
+	default:
+		return nil, errors.Errorf("invalid CertLifetimeExceeded: %s", conf.CertLifetimeExceeded)
+	}
+	for _, gl := range conf.GroupCertLifetimes {
+		max, err := time.ParseDuration(gl.MaxCertLifetime)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid GroupCertLifetimes.MaxCertLifetime")
+		}
+		limits.Groups = append(limits.Groups, signapi.GroupLifetime{Groups: gl.Groups, MaxLifetime: max})
+	}
+
+	// Auth backends
+	authList := []signapi.AuthenticatorListEntry{}
+	rewrites := map[string]signapi.BackendPrincipals{}
+	conditions := map[string]signapi.BackendConditions{}
+	backendLimits := map[string]signapi.BackendLimits{}
+	defer func() {
+		// Stop the plugins started for an API that is not used
+		if err != nil {
+			for _, e := range authList {
+				if c, ok := e.Authenticator.(io.Closer); ok {
+					c.Close()
+				}
+			}
+		}
+	}()
+	for _, ab := range conf.AuthBackends {
+		instance, err := authbackend.GetBackend(ab.Type, ab.Config)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot initialize server")
+		}
+		if ab.MaxCertLifetime != "" {
+			max, err := time.ParseDuration(ab.MaxCertLifetime)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid MaxCertLifetime for auth backend %s", instance.Name())
+			}
+			limits.Backends[instance.Name()] = max
+		}
+		if ab.DefaultCertLifetime != "" {
+			def, err := time.ParseDuration(ab.DefaultCertLifetime)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid DefaultCertLifetime for auth backend %s", instance.Name())
+			}
+			limits.BackendDefaults[instance.Name()] = def
+		}
+		if ab.MinCertLifetime != "" {
+			min, err := time.ParseDuration(ab.MinCertLifetime)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid MinCertLifetime for auth backend %s", instance.Name())
+			}
+			limits.BackendMinimums[instance.Name()] = min
+		}
+		rewrite := signapi.BackendPrincipals{
+			Template: ab.PrincipalTemplate,
+			Prefix:   ab.PrincipalPrefix,
+		}
+		for _, g := range ab.GroupPrincipals {
+			rewrite.Groups = append(rewrite.Groups, signapi.GroupPrincipals{Match: g.Match, Principals: g.Principals})
+		}
+		rewrites[instance.Name()] = rewrite
+		cond, err := newBackendConditions(ab.Conditions)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid conditions for auth backend %s", instance.Name())
+		}
+		if cond != nil {
+			conditions[instance.Name()] = *cond
+		}
+		bl, err := newBackendLimits(ab.Limits)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid limits for auth backend %s", instance.Name())
+		}
+		if bl != nil {
+			backendLimits[instance.Name()] = *bl
+		}
+		authList = append(authList, signapi.AuthenticatorListEntry{
+			Authenticator: instance,
+			Default:       ab.Default,
+			Endpoint:      ab.Endpoint,
+		})
 	}
 
 	// Signing API
-	signapi := signapi.New(
+	api = signapi.New(
 		authList,
-		signer,
-		[]byte(conf.TokenSigningKey),
+		s.signer,
+		s.tokenKey,
 		defaultlife,
 		maxlife,
 	)
+	tkeys, err := newTokenKeys(conf, s.tokenKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	api.SetTokenKeys(tkeys)
+	tokenLife, err := time.ParseDuration(conf.Token.Lifetime)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid Token.Lifetime")
+	}
+	err = api.SetTokenPolicy(signapi.TokenPolicy{
+		Lifetime:          tokenLife,
+		Audience:          conf.Token.Audience,
+		Issuer:            conf.Token.Issuer,
+		Claims:            conf.Token.Claims,
+		CapToCertLifetime: conf.Token.CapToCertLifetime,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if s.revocations != nil {
+		api.SetRevocationStore(s.revocations)
+	}
+	if s.certs != nil {
+		api.SetCertStore(s.certs, s.storeCerts)
+	}
+	api.SetSerialGenerator(s.serials)
+	if s.rotation != nil {
+		api.SetRotationStore(s.rotation)
+	}
+	if err := api.SetLifetimeLimits(limits); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	extLimits := signapi.ExtensionLimits{
+		Allowed: conf.Extensions.Allowed,
+		Denied:  conf.Extensions.Denied,
+	}
+	for _, g := range conf.Extensions.Groups {
+		extLimits.Groups = append(extLimits.Groups, signapi.GroupExtensions{
+			Groups:  g.Groups,
+			Allowed: g.Allowed,
+			Denied:  g.Denied,
+		})
+	}
+	if err := api.SetExtensionLimits(extLimits); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	var denied []signapi.DeniedPrincipals
+	for _, d := range conf.DeniedPrincipals {
+		denied = append(denied, signapi.DeniedPrincipals{
+			Principals:     d.Principals,
+			Backends:       d.Backends,
+			ExceptBackends: d.ExceptBackends,
+		})
+	}
+	if err := api.SetDeniedPrincipals(denied); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if err := api.SetAuthChains(conf.AuthChains); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if err := api.SetBackendPrincipals(rewrites); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if err := api.SetBackendConditions(conditions); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if err := api.SetBackendLimits(backendLimits); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	var stepUps []signapi.StepUp
+	for i, su := range conf.StepUp {
+		r := signapi.StepUp{
+			Principals: su.Principals,
+			Backends:   su.Backends,
+			Approval:   su.Approval,
+		}
+		if su.Lifetime != "" {
+			if r.Lifetime, err = time.ParseDuration(su.Lifetime); err != nil {
+				return nil, errors.Wrapf(err, "invalid StepUp[%d].Lifetime", i)
+			}
+		}
+		stepUps = append(stepUps, r)
+	}
+	if err := api.SetStepUp(stepUps); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	var healthInterval, healthTimeout time.Duration
+	if conf.HealthChecks.Interval != "" {
+		if healthInterval, err = time.ParseDuration(conf.HealthChecks.Interval); err != nil {
+			return nil, errors.Wrap(err, "invalid HealthChecks.Interval")
+		}
+		if healthTimeout, err = time.ParseDuration(conf.HealthChecks.Timeout); err != nil {
+			return nil, errors.Wrap(err, "invalid HealthChecks.Timeout")
+		}
+	}
+	if err := api.SetHealthChecks(healthInterval, healthTimeout); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	windows, err := newIssuanceWindows(conf.IssuanceWindows)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid IssuanceWindows")
+	}
+	if err := api.SetIssuanceWindows(windows); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	err = api.SetCertificateQuota(signapi.CertificateQuota{
+		MaxActive:    conf.CertificateQuota.MaxActive,
+		RevokeOldest: conf.CertificateQuota.RevokeOldest,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if err := api.SetKeyIDFormat(conf.KeyIDFormat); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if err := api.SetIdentityExtensions(conf.IdentityExtensions); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if ph := conf.PolicyHook; ph.URL != "" {
+		timeout, err := time.ParseDuration(ph.Timeout)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid PolicyHook.Timeout")
+		}
+		err = api.SetPolicyHook(&signapi.PolicyHook{
+			URL:      ph.URL,
+			Secret:   []byte(ph.Secret),
+			Headers:  ph.Headers,
+			Timeout:  timeout,
+			FailOpen: ph.FailOpen,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot initialize server")
+		}
+	}
+	mapper, err := authzmap.Setup()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if mapper != nil {
+		api.SetPrincipalMapper(mapper)
+	}
+	pol, err := policy.Setup()
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if pol != nil {
+		api.SetPolicy(pol)
+	}
+	if err := api.CheckSelfRevocation(); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if err := api.SetAdminPrincipals(conf.AdminPrincipals); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if hc := conf.HostCertificates; hc.Enabled {
+		hostDefaultLife, err := time.ParseDuration(hc.DefaultLifetime)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid HostCertificates.DefaultLifetime")
+		}
+		hostMaxLife, err := time.ParseDuration(hc.MaxLifetime)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid HostCertificates.MaxLifetime")
+		}
+		tokenMaxTTL, err := time.ParseDuration(hc.BootstrapTokenMaxTTL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid HostCertificates.BootstrapTokenMaxTTL")
+		}
+		err = api.EnableHostSigning(signapi.HostSignConfig{
+			RequesterPrincipals:  hc.RequesterPrincipals,
+			Hostnames:            hc.Hostnames,
+			DefaultLifetime:      hostDefaultLife,
+			MaxLifetime:          hostMaxLife,
+			BootstrapTokenMaxTTL: tokenMaxTTL,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot initialize server")
+		}
+		if s.bootstrap != nil {
+			api.SetBootstrapStore(s.bootstrap)
+		}
+	}
+	if ac := conf.Approval; ac.Enabled {
+		if s.approvals == nil {
+			return nil, errors.New("enabling approvals requires a restart")
+		}
+		err := api.EnableApprovals(signapi.ApprovalConfig{
+			Principals:         ac.Principals,
+			ApproverPrincipals: ac.ApproverPrincipals,
+		}, s.approvals)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot initialize server")
+		}
+	}
+	if err := setupFederation(api, conf.Federation); err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	if rp := conf.ReplayProtection; rp.SingleUseTokens {
+		skew, err := time.ParseDuration(rp.ClockSkew)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid ReplayProtection.ClockSkew")
+		}
+		err = api.SetReplayProtection(signapi.ReplayProtection{
+			SingleUseTokens: rp.SingleUseTokens,
+			ClockSkew:       skew,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot initialize server")
+		}
+	}
+	reqLimits, err := newRequestLimits(conf.RequestLimits)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot initialize server")
+	}
+	api.SetRequestLimits(reqLimits)
+	acl, err := newNetworkACL(conf.NetworkACL)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid NetworkACL")
+	}
+	api.SetNetworkACL(acl)
+	if rl := conf.RateLimit; rl.Enabled {
+		api.SetRateLimits(signapi.RateLimits{
+			LoginPerUser: newLimiter("login_user", rl.LoginPerUser),
+			LoginPerIP:   newLimiter("login_ip", rl.LoginPerIP),
+			SignPerUser:  newLimiter("sign_user", rl.SignPerUser),
+			SignPerIP:    newLimiter("sign_ip", rl.SignPerIP),
+		})
+	}
+	if lc := conf.Lockout; lc.Enabled {
+		lockout, err := newLockout(lc)
+		if err != nil {
+			return nil, err
+		}
+		if err := api.SetLockout(lockout); err != nil {
+			return nil, errors.Wrap(err, "cannot initialize server")
+		}
+	}
+	api.SetReloader(s.Reload)
+	return api, nil
+}
 
-	s := &Server{
-		config:  conf,
-		web:     echo.New(),
-		signapi: signapi,
+func newLockout(conf LockoutConfig) (signapi.Lockout, error) {
+	r := signapi.Lockout{
+		MaxUserFailures: conf.MaxUserFailures,
+		MaxIPFailures:   conf.MaxIPFailures,
 	}
-	s.initApi()
-	return s, nil
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"Window", conf.Window, &r.Window},
+		{"Duration", conf.Duration, &r.Duration},
+		{"MaxDuration", conf.MaxDuration, &r.MaxDuration},
+		{"Delay", conf.Delay, &r.Delay},
+		{"MaxDelay", conf.MaxDelay, &r.MaxDelay},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil {
+			return r, errors.Wrap(err, "invalid Lockout."+d.name)
+		}
+		*d.dst = v
+	}
+	return r, nil
+}
+
+func newTokenKeys(conf *Config, secret []byte) (*signapi.TokenKeys, error) {
+	var interval time.Duration
+	if conf.TokenKeyRotationInterval != "" {
+		var err error
+		if interval, err = time.ParseDuration(conf.TokenKeyRotationInterval); err != nil {
+			return nil, errors.Wrap(err, "invalid TokenKeyRotationInterval")
+		}
+	}
+	var previous [][]byte
+	for _, k := range conf.PreviousTokenSigningKeys {
+		previous = append(previous, []byte(k))
+	}
+	return signapi.NewTokenKeys(secret, interval, previous...)
+}
+
+func newRequestLimits(conf RequestLimitsConfig) (signapi.RequestLimits, error) {
+	var ret signapi.RequestLimits
+	if _, err := bytes.Parse(conf.MaxBodySize); err != nil {
+		return ret, errors.Wrap(err, "invalid RequestLimits.MaxBodySize")
+	}
+	endpoint := func(name string, c EndpointLimitsConfig) (signapi.EndpointLimits, error) {
+		var (
+			l   signapi.EndpointLimits
+			err error
+		)
+		if c.MaxBodySize != "" {
+			if l.MaxBodySize, err = bytes.Parse(c.MaxBodySize); err != nil {
+				return l, errors.Wrapf(err, "invalid RequestLimits.%s.MaxBodySize", name)
+			}
+		}
+		if c.QueueTimeout != "" {
+			if l.QueueTimeout, err = time.ParseDuration(c.QueueTimeout); err != nil {
+				return l, errors.Wrapf(err, "invalid RequestLimits.%s.QueueTimeout", name)
+			}
+		}
+		if c.Timeout != "" {
+			if l.Timeout, err = time.ParseDuration(c.Timeout); err != nil {
+				return l, errors.Wrapf(err, "invalid RequestLimits.%s.Timeout", name)
+			}
+		}
+		l.MaxConcurrent = c.MaxConcurrent
+		return l, nil
+	}
+	var err error
+	if ret.Login, err = endpoint("Login", conf.Login); err != nil {
+		return ret, err
+	}
+	if ret.Sign, err = endpoint("Sign", conf.Sign); err != nil {
+		return ret, err
+	}
+	if ret.Admin, err = endpoint("Admin", conf.Admin); err != nil {
+		return ret, err
+	}
+	return ret, nil
+}
+
+// Limits are shared between replicas with a shared state store
+func newLimiter(name string, rl RateLimit) *ratelimit.Limiter {
+	if rl.Rate <= 0 || rl.Burst <= 0 {
+		return nil
+	}
+	l := ratelimit.New(rl.Rate, rl.Burst)
+	if sharedstate.IsShared() {
+		l.WithCounter(sharedstate.Get(), name)
+	}
+	return l
+}
+
+// Client address is taken from X-Forwarded-For only when the request comes
+// through the trusted proxies
+func newIPExtractor(proxies []string) (echo.IPExtractor, error) {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	nets, err := signapi.ParseNetworks(proxies)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nets {
+		opts = append(opts, echo.TrustIPRange(n))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...), nil
+}
+
+func newNetworkACL(conf NetworkACLConfig) (acl signapi.NetworkACL, err error) {
+	filters := []struct {
+		conf NetworkFilterConfig
+		f    *signapi.NetworkFilter
+	}{
+		{conf.Sign, &acl.Sign},
+		{conf.Admin, &acl.Admin},
+	}
+	for _, v := range filters {
+		if v.f.Allow, err = signapi.ParseNetworks(v.conf.Allow); err != nil {
+			return acl, err
+		}
+		if v.f.Deny, err = signapi.ParseNetworks(v.conf.Deny); err != nil {
+			return acl, err
+		}
+	}
+	return acl, nil
+}
+
+// Nil if the config has no conditions
+func newBackendConditions(conf BackendConditionsConfig) (*signapi.BackendConditions, error) {
+	if len(conf.Networks.Allow) == 0 && len(conf.Networks.Deny) == 0 && conf.ClientCAFile == "" &&
+		len(conf.ClientCertNames) == 0 && len(conf.Principals) == 0 && len(conf.Audiences) == 0 && len(conf.Realms) == 0 {
+		return nil, nil
+	}
+	r := &signapi.BackendConditions{
+		ClientCertNames: conf.ClientCertNames,
+		Principals:      conf.Principals,
+		Audiences:       conf.Audiences,
+		Realms:          conf.Realms,
+	}
+	var err error
+	if r.Networks.Allow, err = signapi.ParseNetworks(conf.Networks.Allow); err != nil {
+		return nil, err
+	}
+	if r.Networks.Deny, err = signapi.ParseNetworks(conf.Networks.Deny); err != nil {
+		return nil, err
+	}
+	if conf.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot read clientCAFile")
+		}
+		r.ClientCAs = x509.NewCertPool()
+		if !r.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in clientCAFile")
+		}
+	}
+	return r, nil
+}
+
+// Nil if the config has no limits
+func newBackendLimits(conf BackendLimitsConfig) (*signapi.BackendLimits, error) {
+	if conf == (BackendLimitsConfig{}) {
+		return nil, nil
+	}
+	r := &signapi.BackendLimits{
+		MaxConcurrent:    conf.MaxConcurrent,
+		FailureThreshold: conf.FailureThreshold,
+	}
+	var err error
+	if conf.QueueTimeout != "" {
+		if r.QueueTimeout, err = time.ParseDuration(conf.QueueTimeout); err != nil {
+			return nil, errors.Wrap(err, "invalid queueTimeout")
+		}
+	}
+	if conf.Timeout != "" {
+		if r.Timeout, err = time.ParseDuration(conf.Timeout); err != nil {
+			return nil, errors.Wrap(err, "invalid timeout")
+		}
+	}
+	if conf.OpenTimeout != "" {
+		if r.OpenTimeout, err = time.ParseDuration(conf.OpenTimeout); err != nil {
+			return nil, errors.Wrap(err, "invalid openTimeout")
+		}
+	}
+	return r, nil
+}
+
+func newIssuanceWindows(conf []IssuanceWindowConfig) ([]signapi.IssuanceWindow, error) {
+	var ret []signapi.IssuanceWindow
+	for _, c := range conf {
+		w := signapi.IssuanceWindow{Principals: c.Principals}
+		if c.Timezone != "" {
+			loc, err := time.LoadLocation(c.Timezone)
+			if err != nil {
+				return nil, err
+			}
+			w.Location = loc
+		}
+		for _, tw := range c.Windows {
+			parsed, err := signapi.ParseTimeWindow(tw.Days, tw.Start, tw.End)
+			if err != nil {
+				return nil, err
+			}
+			w.Windows = append(w.Windows, parsed)
+		}
+		if c.Webhook.URL != "" {
+			timeout := 5 * time.Second
+			if c.Webhook.Timeout != "" {
+				var err error
+				if timeout, err = time.ParseDuration(c.Webhook.Timeout); err != nil {
+					return nil, errors.Wrap(err, "invalid webhook timeout")
+				}
+			}
+			w.Webhook = &signapi.IssuanceWebhook{
+				URL:     c.Webhook.URL,
+				Secret:  []byte(c.Webhook.Secret),
+				Headers: c.Webhook.Headers,
+				Timeout: timeout,
+			}
+		}
+		ret = append(ret, w)
+	}
+	return ret, nil
 }
 
 func handleVersion(c echo.Context) error {
 	return c.String(http.StatusOK, fmt.Sprint(globals.Version()))
 }
 
-// Simplified version of the standard echo's errorhandler
+// Simplified version of the standard echo's errorhandler. Errors of the API
+// endpoints are returned as problem details
 func errorHandler(err error, c echo.Context) {
+	if strings.HasPrefix(c.Request().URL.Path, "/v1/") {
+		signapi.HTTPErrorHandler(err, c)
+		return
+	}
 	var (
 		code = http.StatusInternalServerError
 		msg  interface{}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/aakso/ssh-inscribe/pkg/systemd"
+	"github.com/aakso/ssh-inscribe/pkg/tracing"
+	"github.com/pkg/errors"
+)
+
+// Stop accepting new requests and wait for the requests in flight to finish
+// within the grace period. Audit sinks are flushed and the signer released
+// afterwards. Safe to call more than once
+func (s *Server) Shutdown() error {
+	var err error
+	s.shutdownOnce.Do(func() {
+		defer close(s.shutdownDone)
+		err = s.shutdown()
+	})
+	return err
+}
+
+func (s *Server) shutdown() error {
+	s.mu.RLock()
+	conf := s.config
+	s.mu.RUnlock()
+	grace, err := time.ParseDuration(conf.ShutdownGracePeriod)
+	if err != nil {
+		Log.WithError(err).Warn("invalid ShutdownGracePeriod, using 30s")
+		grace = 30 * time.Second
+	}
+	log := Log.WithField("grace_period", grace)
+	log.Info("shutting down, draining requests in flight")
+	// The service continues in the new process after an upgrade
+	if atomic.LoadInt32(&s.handedOver) == 0 {
+		notify(systemd.Stopping)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	var result error
+	if s.metricsServer != nil {
+		s.metricsServer.Shutdown(ctx)
+	}
+	if s.acmeServer != nil {
+		s.acmeServer.Shutdown(ctx)
+	}
+	if s.adminServer != nil {
+		s.adminServer.Shutdown(ctx)
+	}
+	if s.grpcServer != nil {
+		s.stopGRPC(ctx)
+	}
+	if s.httpServer != nil {
+		if err := s.httpServer.Shutdown(ctx); err != nil {
+			log.WithError(err).Warn("grace period exceeded, closing remaining connections")
+			s.httpServer.Close()
+			result = errors.Wrap(err, "requests did not finish within the grace period")
+		}
+	}
+
+	s.mu.RLock()
+	api := s.signapi
+	s.mu.RUnlock()
+	if api != nil {
+		api.CloseAuthenticators()
+	}
+	audit.Close()
+	tracing.Close()
+	if s.storage != nil {
+		// Includes the certificate and shared state stores
+		if err := s.storage.Close(); err != nil {
+			log.WithError(err).Error("cannot close storage")
+		}
+	} else {
+		if s.certs != nil {
+			if err := s.certs.Close(); err != nil {
+				log.WithError(err).Error("cannot close certificate store")
+			}
+		}
+		if err := sharedstate.Close(); err != nil {
+			log.WithError(err).Error("cannot close shared state store")
+		}
+	}
+	s.signer.Close()
+	log.Info("shutdown complete")
+	return result
+}
@@ -0,0 +1,50 @@
+package signapi
+
+import (
+	"net/http"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// Users having a principal matching any of the patterns are allowed to use
+// the admin endpoints
+func (sa *SignApi) SetAdminPrincipals(patterns []string) error {
+	globs, err := compileGlobs(patterns)
+	if err != nil {
+		return errors.Wrap(err, "invalid admin principals")
+	}
+	sa.adminPrincipals = globs
+	return nil
+}
+
+func (sa *SignApi) isAdmin(actx *auth.AuthContext) bool {
+	if actx == nil || !actx.IsValid() {
+		return false
+	}
+	for _, p := range actx.GetPrincipals() {
+		if matchAny(sa.adminPrincipals, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sa *SignApi) adminOnly() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var actx *auth.AuthContext
+			if token, _ := c.Get("user").(*jwt.Token); token != nil {
+				if claims, _ := token.Claims.(*SignClaim); claims != nil {
+					actx = claims.AuthContext
+				}
+			}
+			if !sa.isAdmin(actx) {
+				return echo.NewHTTPError(http.StatusForbidden, "admin privileges required")
+			}
+			return next(c)
+		}
+	}
+}
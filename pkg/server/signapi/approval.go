@@ -0,0 +1,285 @@
+package signapi
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/approval"
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gobwas/glob"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Approval request used to sign is stored in the request context
+const ctxApproval = "approval"
+
+type ApprovalConfig struct {
+	// Certificates with principals matching any of these patterns require
+	// approval from another user
+	Principals []string
+	// Principal patterns of users allowed to decide on approval requests in
+	// addition to admins
+	ApproverPrincipals []string
+}
+
+type approvals struct {
+	store      *approval.Store
+	principals []glob.Glob
+	approvers  []glob.Glob
+}
+
+// Require approval for certificates with sensitive principals
+func (sa *SignApi) EnableApprovals(conf ApprovalConfig, store *approval.Store) error {
+	principals, err := compileGlobs(conf.Principals)
+	if err != nil {
+		return errors.Wrap(err, "invalid approval principals")
+	}
+	approvers, err := compileGlobs(conf.ApproverPrincipals)
+	if err != nil {
+		return errors.Wrap(err, "invalid approver principals")
+	}
+	sa.approvals = &approvals{
+		store:      store,
+		principals: principals,
+		approvers:  approvers,
+	}
+	return nil
+}
+
+// Principals requiring approval
+func (ap *approvals) sensitive(principals []string) []string {
+	var ret []string
+	seen := map[string]bool{}
+	for _, p := range principals {
+		if !seen[p] && matchAny(ap.principals, p) {
+			ret = append(ret, p)
+		}
+		seen[p] = true
+	}
+	return ret
+}
+
+func (sa *SignApi) isApprover(actx *auth.AuthContext) bool {
+	if actx == nil || !actx.IsValid() {
+		return false
+	}
+	if sa.isAdmin(actx) {
+		return true
+	}
+	for _, p := range actx.GetPrincipals() {
+		if matchAny(sa.approvals.approvers, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that a certificate with sensitive principals has been approved.
+// Without an approval the request is queued and 202 Accepted is returned
+// for the client to poll. Signing may proceed only if true is returned
+func (sa *SignApi) checkApproval(c echo.Context, actx *auth.AuthContext, cert *ssh.Certificate, caName string) (bool, error) {
+	if sa.approvals == nil {
+		return true, nil
+	}
+	sensitive := sa.approvals.sensitive(cert.ValidPrincipals)
+	if len(sensitive) == 0 && c.Get(ctxStepUpApproval) != nil {
+		sensitive = cert.ValidPrincipals
+	}
+	if len(sensitive) == 0 {
+		return true, nil
+	}
+	store := sa.approvals.store
+	subject := actx.GetSubjectName()
+	fp := ssh.FingerprintSHA256(cert.Key)
+	validBefore := time.Unix(int64(cert.ValidBefore), 0).UTC()
+
+	if id := c.QueryParam("approval"); id != "" {
+		r, err := store.Consume(id, subject, fp, caName, cert.ValidPrincipals, validBefore)
+		switch err {
+		case nil:
+			c.Set(ctxApproval, r)
+			return true, nil
+		case approval.ErrPending:
+			r, err := store.Get(id)
+			if err != nil {
+				return false, echo.NewHTTPError(http.StatusForbidden, err.Error())
+			}
+			return false, sa.approvalAccepted(c, r)
+		case approval.ErrDenied, approval.ErrNotFound, approval.ErrMismatch:
+			auditCertificateDenied(c, actx, cert, err.Error())
+			return false, echo.NewHTTPError(http.StatusForbidden, err.Error())
+		default:
+			requestLog(c).WithError(err).Error("cannot use approval")
+			return false, echo.NewHTTPError(http.StatusInternalServerError, "cannot use approval")
+		}
+	}
+
+	r, created, err := store.Create(approval.Request{
+		Requester:            subject,
+		Principals:           cert.ValidPrincipals,
+		SensitivePrincipals:  sensitive,
+		PublicKeyFingerprint: fp,
+		CA:                   caName,
+		ValidBefore:          validBefore,
+	})
+	if err != nil {
+		requestLog(c).WithError(err).Error("cannot create approval request")
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "cannot create approval request")
+	}
+	if created {
+		requestLog(c).
+			WithField("approval_id", r.ID).
+			WithField("subject", subject).
+			WithField("principals", sensitive).
+			Info("certificate requires approval")
+		ev := newAuditEvent(c, audit.EventApprovalRequested)
+		ev.Success = true
+		ev.Subject = subject
+		ev.ApprovalID = r.ID
+		ev.Principals = r.Principals
+		ev.PublicKeyFingerprint = fp
+		ev.CA = caName
+		audit.Record(ev)
+	}
+	return false, sa.approvalAccepted(c, r)
+}
+
+func (sa *SignApi) approvalAccepted(c echo.Context, r *approval.Request) error {
+	location := strings.TrimSuffix(strings.TrimSuffix(c.Path(), "/sign"), "/federation") + "/approvals/" + r.ID
+	c.Response().Header().Set(echo.HeaderLocation, location)
+	return c.JSON(http.StatusAccepted, approvalObject(r))
+}
+
+func approvalObject(r *approval.Request) objects.ApprovalRequest {
+	return objects.ApprovalRequest{
+		ID:                  r.ID,
+		Status:              r.Status,
+		Requester:           r.Requester,
+		Principals:          r.Principals,
+		SensitivePrincipals: r.SensitivePrincipals,
+		Fingerprint:         r.PublicKeyFingerprint,
+		CA:                  r.CA,
+		ValidBefore:         r.ValidBefore,
+		CreatedAt:           r.CreatedAt,
+		Expires:             r.Expires,
+		DecidedBy:           r.DecidedBy,
+		DecidedAt:           r.DecidedAt,
+		Comment:             r.Comment,
+	}
+}
+
+// List approval requests. Approvers see all requests, other users their own
+func (sa *SignApi) HandleListApprovals(c echo.Context) error {
+	if sa.approvals == nil {
+		return echo.ErrNotFound
+	}
+	var actx *auth.AuthContext
+	if token, _ := c.Get("user").(*jwt.Token); token != nil {
+		if claims, _ := token.Claims.(*SignClaim); claims != nil {
+			actx = claims.AuthContext
+		}
+	}
+	if actx == nil || !actx.IsValid() {
+		return echo.ErrUnauthorized
+	}
+	approver := sa.isApprover(actx)
+	ret := []objects.ApprovalRequest{}
+	for _, r := range sa.approvals.store.List(c.QueryParam("status")) {
+		if approver || r.Requester == actx.GetSubjectName() {
+			ret = append(ret, approvalObject(&r))
+		}
+	}
+	return c.JSON(http.StatusOK, ret)
+}
+
+func (sa *SignApi) HandleGetApproval(c echo.Context) error {
+	if sa.approvals == nil {
+		return echo.ErrNotFound
+	}
+	var actx *auth.AuthContext
+	if token, _ := c.Get("user").(*jwt.Token); token != nil {
+		if claims, _ := token.Claims.(*SignClaim); claims != nil {
+			actx = claims.AuthContext
+		}
+	}
+	if actx == nil || !actx.IsValid() {
+		return echo.ErrUnauthorized
+	}
+	r, err := sa.approvals.store.Get(c.Param("id"))
+	if err != nil || (r.Requester != actx.GetSubjectName() && !sa.isApprover(actx)) {
+		return echo.NewHTTPError(http.StatusNotFound, approval.ErrNotFound.Error())
+	}
+	return c.JSON(http.StatusOK, approvalObject(r))
+}
+
+func (sa *SignApi) HandleApprove(c echo.Context) error {
+	return sa.decideApproval(c, true)
+}
+
+func (sa *SignApi) HandleDeny(c echo.Context) error {
+	return sa.decideApproval(c, false)
+}
+
+func (sa *SignApi) decideApproval(c echo.Context, approve bool) error {
+	if sa.approvals == nil {
+		return echo.ErrNotFound
+	}
+	var actx *auth.AuthContext
+	if token, _ := c.Get("user").(*jwt.Token); token != nil {
+		if claims, _ := token.Claims.(*SignClaim); claims != nil {
+			actx = claims.AuthContext
+		}
+	}
+	if !sa.isApprover(actx) {
+		return echo.NewHTTPError(http.StatusForbidden, "approver privileges required")
+	}
+	var req objects.ApprovalDecision
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "invalid request").Error())
+		}
+	}
+	subject := actx.GetSubjectName()
+	r, err := sa.approvals.store.Decide(c.Param("id"), subject, approve, req.Comment)
+	switch err {
+	case nil:
+	case approval.ErrNotFound:
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	case approval.ErrNotPending:
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	case approval.ErrSelfApproval:
+		return echo.NewHTTPError(http.StatusForbidden, err.Error())
+	default:
+		requestLog(c).WithError(err).Error("cannot decide on approval request")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot decide on approval request")
+	}
+
+	typ := audit.EventApprovalDenied
+	if approve {
+		typ = audit.EventApprovalApproved
+	}
+	requestLog(c).
+		WithField("approval_id", r.ID).
+		WithField("requester", r.Requester).
+		WithField("approver", subject).
+		WithField("status", r.Status).
+		Info("approval request decided")
+	ev := newAuditEvent(c, typ)
+	ev.Success = true
+	ev.Subject = subject
+	ev.ApprovalID = r.ID
+	ev.Approver = subject
+	ev.UserIdentifier = r.Requester
+	ev.Principals = r.Principals
+	ev.PublicKeyFingerprint = r.PublicKeyFingerprint
+	ev.CA = r.CA
+	ev.Reason = r.Comment
+	audit.Record(ev)
+	return c.JSON(http.StatusOK, approvalObject(r))
+}
@@ -0,0 +1,92 @@
+package signapi
+
+import (
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/approval"
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/ssh"
+)
+
+// Name of the applied policy template and the selected CA key are stored in
+// the request context
+const (
+	ctxPolicy = "policy"
+	ctxCA     = "ca"
+)
+
+func newAuditEvent(c echo.Context, typ string) *audit.Event {
+	return &audit.Event{
+		Type:          typ,
+		AuditID:       c.Response().Header().Get(echo.HeaderXRequestID),
+		RequestID:     requestID(c),
+		CorrelationID: correlationID(c),
+		RemoteAddress: c.RealIP(),
+	}
+}
+
+func auditAuthentication(c echo.Context, backend string, user string, actx *auth.AuthContext, success bool) {
+	ev := newAuditEvent(c, audit.EventAuthentication)
+	ev.Success = success
+	ev.UserIdentifier = user
+	ev.Authenticator = backend
+	if actx != nil {
+		ev.Subject = actx.GetSubjectName()
+		ev.Authenticators = actx.GetAuthenticators()
+		ev.Principals = actx.GetPrincipals()
+	}
+	audit.Record(ev)
+}
+
+func auditCertificate(c echo.Context, actx *auth.AuthContext, cert *ssh.Certificate) {
+	ev := newAuditEvent(c, audit.EventCertificateIssued)
+	ev.Success = true
+	ev.Subject = actx.GetSubjectName()
+	ev.Authenticators = actx.GetAuthenticators()
+	ev.CertType = "user"
+	if cert.CertType == ssh.HostCert {
+		ev.CertType = "host"
+	}
+	ev.Serial = cert.Serial
+	ev.KeyID = cert.KeyId
+	ev.Principals = cert.ValidPrincipals
+	ev.CriticalOptions = cert.CriticalOptions
+	ev.Extensions = cert.Extensions
+	validAfter := time.Unix(int64(cert.ValidAfter), 0).UTC()
+	validBefore := time.Unix(int64(cert.ValidBefore), 0).UTC()
+	ev.ValidAfter = &validAfter
+	ev.ValidBefore = &validBefore
+	ev.PublicKeyFingerprint = ssh.FingerprintSHA256(cert.Key)
+	ev.Policy, _ = c.Get(ctxPolicy).(string)
+	ev.CA, _ = c.Get(ctxCA).(string)
+	ev.ForceCommand = cert.CriticalOptions["force-command"]
+	if r, _ := c.Get(ctxApproval).(*approval.Request); r != nil {
+		ev.ApprovalID = r.ID
+		ev.Approver = r.DecidedBy
+	}
+	audit.Record(ev)
+}
+
+// Record a refused signing request. The certificate is nil if the request
+// was refused before one was built
+func auditCertificateDenied(c echo.Context, actx *auth.AuthContext, cert *ssh.Certificate, reason string) {
+	ev := newAuditEvent(c, audit.EventCertificateDenied)
+	ev.Success = false
+	ev.Reason = reason
+	ev.Subject = actx.GetSubjectName()
+	ev.Authenticators = actx.GetAuthenticators()
+	ev.Policy, _ = c.Get(ctxPolicy).(string)
+	ev.CA, _ = c.Get(ctxCA).(string)
+	if cert != nil {
+		ev.CertType = "user"
+		if cert.CertType == ssh.HostCert {
+			ev.CertType = "host"
+		}
+		ev.KeyID = cert.KeyId
+		ev.Principals = cert.ValidPrincipals
+		ev.PublicKeyFingerprint = ssh.FingerprintSHA256(cert.Key)
+	}
+	audit.Record(ev)
+}
@@ -0,0 +1,64 @@
+package signapi
+
+import (
+	"strings"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/pkg/errors"
+)
+
+// Combinations of auth backends accepted for signing. Each chain lists the
+// backends that all need to be in the auth context and any one chain is
+// enough, e.g. [[ldap, totp], [oidc]] is (ldap and totp) or oidc. Any login
+// is enough when empty
+func (sa *SignApi) SetAuthChains(chains [][]string) error {
+	var r [][]string
+	for _, chain := range chains {
+		if len(chain) == 0 {
+			return errors.New("invalid auth chains: empty chain")
+		}
+		for _, name := range chain {
+			if _, ok := sa.auth[name]; !ok {
+				return errors.Errorf("invalid auth chains: unknown auth backend %s", name)
+			}
+		}
+		r = append(r, append([]string(nil), chain...))
+	}
+	sa.authChains = r
+	return nil
+}
+
+// Backends still needed for each of the chains by the names the clients use,
+// nil when the auth context satisfies one of them
+func (sa *SignApi) missingAuth(actx *auth.AuthContext) [][]string {
+	if len(sa.authChains) == 0 {
+		return nil
+	}
+	done := map[string]bool{}
+	for _, a := range actx.GetAuthenticators() {
+		done[a] = true
+	}
+	var r [][]string
+	for _, chain := range sa.authChains {
+		var missing []string
+		for _, name := range chain {
+			if !done[name] {
+				missing = append(missing, sa.endpointName(name))
+			}
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		r = append(r, missing)
+	}
+	return r
+}
+
+// Tell the user what to log in with next
+func missingAuthDetail(missing [][]string) string {
+	alternatives := make([]string, len(missing))
+	for i, m := range missing {
+		alternatives[i] = strings.Join(m, " and ")
+	}
+	return "authentication incomplete, log in also with " + strings.Join(alternatives, ", or with ")
+}
@@ -0,0 +1,245 @@
+package signapi
+
+import (
+	"crypto/x509"
+	"net"
+	"net/http"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gobwas/glob"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Conditions on the clients that may use an auth backend, e.g. Kerberos
+// only from the internal networks. They are checked at login and again at
+// signing for each backend of the auth context, so a token cannot be
+// carried elsewhere
+type BackendConditions struct {
+	// Source networks of the client
+	Networks NetworkFilter
+	// The client needs a TLS certificate verified by these CAs, with a
+	// subject common name matching one of ClientCertNames if any
+	ClientCAs       *x509.CertPool
+	ClientCertNames []string
+	// Principal names or patterns certificates signed with the backend may
+	// have. Other principals are removed
+	Principals []string
+	// Audiences and realms, or patterns of them, the client needs to name
+	// to see and use the backend, so that tenants do not see each other's
+	// backends. They are named by the client and bound to the token at
+	// login; they do not authenticate the tenant
+	Audiences []string
+	Realms    []string
+}
+
+type backendConditions struct {
+	networks   NetworkFilter
+	clientCAs  *x509.CertPool
+	certNames  []glob.Glob
+	principals []glob.Glob
+	audiences  []glob.Glob
+	realms     []glob.Glob
+}
+
+// Conditions by the auth backend name. Backends sharing an endpoint name
+// need audiences or realms to tell them apart
+func (sa *SignApi) SetBackendConditions(conf map[string]BackendConditions) error {
+	shared := map[string]int{}
+	for _, e := range sa.authList {
+		shared[e.endpoint()]++
+	}
+	for _, e := range sa.authList {
+		name := e.Authenticator.Name()
+		if e.Endpoint != "" && e.Endpoint != name {
+			if _, ok := sa.auth[e.Endpoint]; ok {
+				return errors.Errorf("invalid endpoint for %s: %s is the name of another auth backend", name, e.Endpoint)
+			}
+		}
+		if v := conf[name]; shared[e.endpoint()] > 1 && len(v.Audiences) == 0 && len(v.Realms) == 0 {
+			return errors.Errorf("invalid backend conditions for %s: endpoint %s is shared without audiences or realms", name, e.endpoint())
+		}
+	}
+	r := map[string]*backendConditions{}
+	for name, v := range conf {
+		if _, ok := sa.auth[name]; !ok {
+			return errors.Errorf("invalid backend conditions: unknown auth backend %s", name)
+		}
+		if len(v.ClientCertNames) > 0 && v.ClientCAs == nil {
+			return errors.Errorf("invalid backend conditions for %s: client certificate names without CAs", name)
+		}
+		bc := &backendConditions{networks: v.Networks, clientCAs: v.ClientCAs}
+		var err error
+		if bc.certNames, err = compileGlobs(v.ClientCertNames); err != nil {
+			return errors.Wrapf(err, "invalid backend conditions for %s", name)
+		}
+		if bc.principals, err = compileGlobs(v.Principals); err != nil {
+			return errors.Wrapf(err, "invalid backend conditions for %s", name)
+		}
+		if bc.audiences, err = compileGlobs(v.Audiences); err != nil {
+			return errors.Wrapf(err, "invalid backend conditions for %s", name)
+		}
+		if bc.realms, err = compileGlobs(v.Realms); err != nil {
+			return errors.Wrapf(err, "invalid backend conditions for %s", name)
+		}
+		r[name] = bc
+	}
+	sa.conditions = r
+	return nil
+}
+
+// Whether a condition needs the client certificate. The TLS listener then
+// asks the clients for one
+func (sa *SignApi) UsesClientCertConditions() bool {
+	for _, bc := range sa.conditions {
+		if bc.clientCAs != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Audience and realm the client named. Requests with a token use the ones
+// the token was issued for, the headers cannot change them
+func clientScope(c echo.Context) (string, string) {
+	if token, _ := c.Get("user").(*jwt.Token); token != nil {
+		if claims, _ := token.Claims.(*SignClaim); claims != nil {
+			return claims.ClientAudience, claims.ClientRealm
+		}
+	}
+	header := c.Request().Header
+	return header.Get(objects.AudienceHeader), header.Get(objects.RealmHeader)
+}
+
+// The backend the client means with the name: the one with the endpoint
+// name for the audience and realm of the client, or else the one with the
+// name. Backends hidden from the client are not found
+func (sa *SignApi) lookupBackend(c echo.Context, name string) (auth.Authenticator, bool) {
+	for _, e := range sa.authList {
+		if e.endpoint() == name && !sa.backendHidden(c, e.Authenticator.Name()) {
+			return e.Authenticator, true
+		}
+	}
+	if ab, ok := sa.auth[name]; ok && !sa.backendHidden(c, name) {
+		return ab, true
+	}
+	return nil, false
+}
+
+// Name the clients use for the backend
+func (sa *SignApi) endpointName(name string) string {
+	for _, e := range sa.authList {
+		if e.Authenticator.Name() == name {
+			return e.endpoint()
+		}
+	}
+	return name
+}
+
+// Whether the backend is restricted to audiences or realms the client did
+// not name. Such backends are reported as unknown
+func (sa *SignApi) backendHidden(c echo.Context, name string) bool {
+	bc := sa.conditions[name]
+	if bc == nil {
+		return false
+	}
+	audience, realm := clientScope(c)
+	return len(bc.audiences) > 0 && !matchAny(bc.audiences, audience) ||
+		len(bc.realms) > 0 && !matchAny(bc.realms, realm)
+}
+
+// Why the client may not use the backend, empty if it may
+func (sa *SignApi) backendRefused(c echo.Context, name string) string {
+	bc := sa.conditions[name]
+	if bc == nil {
+		return ""
+	}
+	if sa.backendHidden(c, name) {
+		return "not available for this audience or realm"
+	}
+	if !bc.networks.allowed(net.ParseIP(c.RealIP())) {
+		return "not allowed from this network"
+	}
+	if bc.clientCAs != nil && !bc.verifyClientCert(c.Request()) {
+		return "client certificate required"
+	}
+	return ""
+}
+
+func (bc *backendConditions) verifyClientCert(r *http.Request) bool {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return false
+	}
+	cert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         bc.clientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return false
+	}
+	return len(bc.certNames) == 0 || matchAny(bc.certNames, cert.Subject.CommonName)
+}
+
+func backendNotAllowed(name, reason string) error {
+	return newProblem(http.StatusForbidden, objects.ErrorAuthBackendNotAllowed, "auth backend "+name+" is "+reason)
+}
+
+// Refuse signing if the client may not use one of the backends of the auth
+// context
+func (sa *SignApi) checkBackendConditions(c echo.Context, actx *auth.AuthContext) error {
+	if len(sa.conditions) == 0 {
+		return nil
+	}
+	for _, name := range actx.GetAuthenticators() {
+		if reason := sa.backendRefused(c, name); reason != "" {
+			auditCertificateDenied(c, actx, nil, "auth backend "+name+" is "+reason)
+			return backendNotAllowed(sa.endpointName(name), reason)
+		}
+	}
+	return nil
+}
+
+// Remove the principals the backends of the auth context may not have.
+// Signing is refused if no principals remain
+func (sa *SignApi) checkBackendPrincipals(c echo.Context, actx *auth.AuthContext, cert *ssh.Certificate) error {
+	if len(sa.conditions) == 0 {
+		return nil
+	}
+	var allowed, removed []string
+	for _, p := range cert.ValidPrincipals {
+		ok := true
+		for _, name := range actx.GetAuthenticators() {
+			if bc := sa.conditions[name]; bc != nil && len(bc.principals) > 0 && !matchAny(bc.principals, p) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			allowed = append(allowed, p)
+		} else {
+			removed = append(removed, p)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	requestLog(c).
+		WithField("subject", actx.GetSubjectName()).
+		WithField("principals", removed).
+		Warn("removed principals not allowed for the auth backends")
+	if len(allowed) == 0 {
+		auditCertificateDenied(c, actx, cert, "no principals allowed for the auth backends")
+		return newProblem(http.StatusForbidden, objects.ErrorPrincipalsDenied, errors.Errorf("principals %v are not allowed for the auth backends", removed).Error())
+	}
+	cert.ValidPrincipals = allowed
+	return nil
+}
@@ -0,0 +1,260 @@
+package signapi
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricBackendLimited = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ssh_inscribe_auth_backend_limited_total",
+			Help: "Logins rejected by the auth backend limits by backend and reason",
+		},
+		[]string{"backend", "reason"},
+	)
+	metricBackendCircuitOpen = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ssh_inscribe_auth_backend_circuit_open",
+			Help: "Whether the circuit breaker of the auth backend is open or half-open",
+		},
+		[]string{"backend"},
+	)
+)
+
+// Limits keeping a slow or failing auth backend from tying up the workers
+// serving the other backends. Zero values are disabled
+type BackendLimits struct {
+	// Logins calling the backend at once. Excess logins wait for a free
+	// slot for QueueTimeout before 503 is returned
+	MaxConcurrent int
+	QueueTimeout  time.Duration
+	// Logins the backend has not answered in this time fail with 503. The
+	// call keeps its slot until the backend returns
+	Timeout time.Duration
+	// Open the circuit after this many consecutive failures of the
+	// backend: timeouts, and failed logins the backend reports as its own
+	// errors or while the health check reports it down. Logins are refused
+	// without calling the backend for OpenTimeout, after which a single
+	// trial login closes the circuit if the backend answers in time
+	FailureThreshold int
+	OpenTimeout      time.Duration
+}
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return objects.CircuitOpen
+	case circuitHalfOpen:
+		return objects.CircuitHalfOpen
+	}
+	return objects.CircuitClosed
+}
+
+type backendLimiter struct {
+	BackendLimits
+	name  string
+	slots chan struct{}
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+	// A trial login of the half-open circuit is running
+	trial bool
+}
+
+func (sa *SignApi) SetBackendLimits(conf map[string]BackendLimits) error {
+	r := map[string]*backendLimiter{}
+	for name, v := range conf {
+		if _, ok := sa.auth[name]; !ok {
+			return errors.Errorf("invalid backend limits: unknown auth backend %s", name)
+		}
+		if v.MaxConcurrent < 0 || v.QueueTimeout < 0 || v.Timeout < 0 || v.FailureThreshold < 0 || v.OpenTimeout < 0 {
+			return errors.Errorf("invalid backend limits for %s: negative value", name)
+		}
+		if v.FailureThreshold > 0 && v.OpenTimeout == 0 {
+			return errors.Errorf("invalid backend limits for %s: failure threshold without open timeout", name)
+		}
+		bl := &backendLimiter{BackendLimits: v, name: name}
+		if v.MaxConcurrent > 0 {
+			bl.slots = make(chan struct{}, v.MaxConcurrent)
+		}
+		metricBackendCircuitOpen.WithLabelValues(name).Set(0)
+		r[name] = bl
+	}
+	sa.backendLimits = r
+	return nil
+}
+
+// Take a slot, waiting for the queue timeout if none is free
+func (bl *backendLimiter) acquire(ctx context.Context) bool {
+	if bl.slots == nil {
+		return true
+	}
+	select {
+	case bl.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if bl.QueueTimeout <= 0 {
+		return false
+	}
+	t := time.NewTimer(bl.QueueTimeout)
+	defer t.Stop()
+	select {
+	case bl.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+	case <-t.C:
+	}
+	return false
+}
+
+func (bl *backendLimiter) release() {
+	if bl.slots != nil {
+		<-bl.slots
+	}
+}
+
+// Whether a login may call the backend and whether it is the trial of a
+// half-open circuit. Otherwise returns the time until the next trial
+func (bl *backendLimiter) allow(now time.Time) (ok, trial bool, wait time.Duration) {
+	if bl.FailureThreshold == 0 {
+		return true, false, 0
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	switch bl.state {
+	case circuitOpen:
+		if wait := bl.openedAt.Add(bl.OpenTimeout).Sub(now); wait > 0 {
+			return false, false, wait
+		}
+		bl.state = circuitHalfOpen
+		fallthrough
+	case circuitHalfOpen:
+		if bl.trial {
+			return false, false, bl.Timeout
+		}
+		bl.trial = true
+		return true, true, 0
+	}
+	return true, false, 0
+}
+
+// Record the result of a call to the backend
+func (bl *backendLimiter) done(trial, failed bool, now time.Time) {
+	if bl.FailureThreshold == 0 {
+		return
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if trial {
+		bl.trial = false
+	}
+	if !failed {
+		bl.failures = 0
+		if trial {
+			bl.state = circuitClosed
+			metricBackendCircuitOpen.WithLabelValues(bl.name).Set(0)
+			Log.WithField("authenticator", bl.name).Info("auth backend recovered, circuit closed")
+		}
+		return
+	}
+	bl.failures++
+	if trial || (bl.state == circuitClosed && bl.failures >= bl.FailureThreshold) {
+		bl.state = circuitOpen
+		bl.openedAt = now
+		metricBackendCircuitOpen.WithLabelValues(bl.name).Set(1)
+		Log.WithField("authenticator", bl.name).WithField("failures", bl.failures).Warn("auth backend failing, circuit opened")
+	}
+}
+
+func (bl *backendLimiter) circuit() circuitState {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	return bl.state
+}
+
+func backendUnavailable(c echo.Context, wait time.Duration, code, detail string) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(wait/time.Second)+1))
+	return newProblem(http.StatusServiceUnavailable, code, detail)
+}
+
+type authResult struct {
+	actx *auth.AuthContext
+	ok   bool
+}
+
+// Authenticate with the backend within its limits. The error is returned
+// to the client when the backend was not called or did not answer in time
+func (sa *SignApi) authenticate(c echo.Context, ab auth.Authenticator, pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool, error) {
+	bl := sa.backendLimits[ab.Name()]
+	if bl == nil {
+		actx, ok := ab.Authenticate(pctx, creds)
+		return actx, ok, nil
+	}
+	log := requestLog(c).WithField("authenticator", ab.Name())
+	if !bl.acquire(c.Request().Context()) {
+		metricBackendLimited.WithLabelValues(ab.Name(), "concurrency").Inc()
+		log.Warn("too many concurrent logins with the auth backend")
+		return nil, false, backendUnavailable(c, 0, objects.ErrorAuthBackendBusy, "too many concurrent logins with the auth backend")
+	}
+	ok, trial, wait := bl.allow(time.Now())
+	if !ok {
+		bl.release()
+		metricBackendLimited.WithLabelValues(ab.Name(), "circuit_open").Inc()
+		return nil, false, backendUnavailable(c, wait, objects.ErrorAuthBackendDown, "auth backend is failing, try again later")
+	}
+	if bl.Timeout == 0 {
+		actx, ok := ab.Authenticate(pctx, creds)
+		bl.release()
+		bl.done(trial, !ok && sa.backendFailed(ab.Name(), creds), time.Now())
+		return actx, ok, nil
+	}
+
+	// The backend cannot be interrupted, a hung call is left running
+	// with its slot
+	ch := make(chan authResult, 1)
+	go func() {
+		defer bl.release()
+		actx, ok := ab.Authenticate(pctx, creds)
+		ch <- authResult{actx: actx, ok: ok}
+	}()
+	t := time.NewTimer(bl.Timeout)
+	defer t.Stop()
+	select {
+	case r := <-ch:
+		bl.done(trial, !r.ok && sa.backendFailed(ab.Name(), creds), time.Now())
+		return r.actx, r.ok, nil
+	case <-t.C:
+		bl.done(trial, true, time.Now())
+		metricBackendLimited.WithLabelValues(ab.Name(), "timeout").Inc()
+		log.Warn("auth backend did not answer in time")
+		return nil, false, backendUnavailable(c, 0, objects.ErrorAuthBackendDown, "auth backend did not answer in time")
+	}
+}
+
+// Whether a failed login was caused by the backend rather than the
+// credentials
+func (sa *SignApi) backendFailed(name string, creds *auth.Credentials) bool {
+	return creds.BackendError() || sa.backendDown(name)
+}
@@ -0,0 +1,201 @@
+package signapi
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/util"
+	"github.com/pkg/errors"
+)
+
+// Rewrite of the principals an auth backend contributes, keeping backends
+// with overlapping principal names from granting each other's principals
+type BackendPrincipals struct {
+	// Template with .Principal, .Subject, .Groups and .IsGroup, set when the
+	// principal is one of the groups resolved by the backend. Each line of
+	// the output is a principal, none drops the principal
+	Template string
+	// Prepended to the principals after the template
+	Prefix string
+	// Principals from the groups resolved by the backend. Added as they are
+	// after the template and prefix
+	Groups []GroupPrincipals
+}
+
+// Principals for the groups matching a regular expression. The principals
+// refer to the capture groups with %{name} or %{1}, e.g.
+// ^ssh-(?P<env>\w+)-(?P<role>\w+)$ to %{role}@%{env}
+type GroupPrincipals struct {
+	Match      string
+	Principals []string
+}
+
+type backendPrincipals struct {
+	tpl    *template.Template
+	prefix string
+	groups []groupPrincipals
+}
+
+type groupPrincipals struct {
+	match      *regexp.Regexp
+	principals []string
+}
+
+// Template context of BackendPrincipals
+type principalData struct {
+	Principal string
+	Subject   string
+	Groups    []string
+	IsGroup   bool
+}
+
+// %{name} or %{1} in the group principals
+var captureRef = regexp.MustCompile(`%\{(\w+)\}`)
+
+// Principal rewrites by the auth backend name
+func (sa *SignApi) SetBackendPrincipals(conf map[string]BackendPrincipals) error {
+	r := map[string]*backendPrincipals{}
+	for name, v := range conf {
+		if _, ok := sa.auth[name]; !ok {
+			return errors.Errorf("invalid principal rewrite: unknown auth backend %s", name)
+		}
+		if v.Template == "" && v.Prefix == "" && len(v.Groups) == 0 {
+			continue
+		}
+		bp := &backendPrincipals{prefix: v.Prefix}
+		if v.Template != "" {
+			tpl, err := template.New(name).Funcs(util.TemplateFuncs).Parse(v.Template)
+			if err != nil {
+				return errors.Wrapf(err, "invalid principal template for auth backend %s", name)
+			}
+			bp.tpl = tpl
+		}
+		for _, g := range v.Groups {
+			gp, err := newGroupPrincipals(g)
+			if err != nil {
+				return errors.Wrapf(err, "invalid group principals for auth backend %s", name)
+			}
+			bp.groups = append(bp.groups, gp)
+		}
+		r[name] = bp
+	}
+	sa.backendRewrites = r
+	return nil
+}
+
+func newGroupPrincipals(conf GroupPrincipals) (groupPrincipals, error) {
+	re, err := regexp.Compile(conf.Match)
+	if err != nil {
+		return groupPrincipals{}, err
+	}
+	if len(conf.Principals) == 0 {
+		return groupPrincipals{}, errors.Errorf("no principals for %s", conf.Match)
+	}
+	names := map[string]bool{}
+	for i, n := range re.SubexpNames() {
+		names[strconv.Itoa(i)] = true
+		if n != "" {
+			names[n] = true
+		}
+	}
+	for _, p := range conf.Principals {
+		for _, m := range captureRef.FindAllStringSubmatch(p, -1) {
+			if !names[m[1]] {
+				return groupPrincipals{}, errors.Errorf("%s refers to unknown capture group %s", p, m[1])
+			}
+		}
+	}
+	return groupPrincipals{match: re, principals: conf.Principals}, nil
+}
+
+// Principals for the group, nil if it does not match
+func (gp groupPrincipals) expand(group string) []string {
+	m := gp.match.FindStringSubmatch(group)
+	if m == nil {
+		return nil
+	}
+	values := map[string]string{}
+	for i, n := range gp.match.SubexpNames() {
+		values[strconv.Itoa(i)] = m[i]
+		if n != "" {
+			values[n] = m[i]
+		}
+	}
+	var r []string
+	for _, p := range gp.principals {
+		p = captureRef.ReplaceAllStringFunc(p, func(ref string) string {
+			return values[ref[2:len(ref)-1]]
+		})
+		if p != "" {
+			r = append(r, p)
+		}
+	}
+	return r
+}
+
+// Rewrite the principals of the auth context completed by the backend. The
+// principals of the preceding backends are left alone
+func (sa *SignApi) rewritePrincipals(actx *auth.AuthContext) error {
+	bp := sa.backendRewrites[actx.Authenticator]
+	if bp == nil {
+		return nil
+	}
+	var groups []string
+	switch v := actx.AuthMeta[auth.MetaGroups].(type) {
+	case []string:
+		groups = v
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	isGroup := map[string]bool{}
+	for _, g := range groups {
+		isGroup[g] = true
+	}
+	var r []string
+	for _, p := range actx.Principals {
+		if bp.tpl == nil {
+			r = append(r, bp.prefix+p)
+			continue
+		}
+		buf := bytes.NewBuffer([]byte{})
+		err := bp.tpl.Execute(buf, principalData{
+			Principal: p,
+			Subject:   actx.GetSubjectName(),
+			Groups:    groups,
+			IsGroup:   isGroup[p],
+		})
+		if err != nil {
+			return errors.Wrap(err, "cannot render principal template")
+		}
+		for _, line := range strings.Split(buf.String(), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && line != "<no value>" {
+				r = append(r, bp.prefix+line)
+			}
+		}
+	}
+	seen := map[string]bool{}
+	for _, p := range r {
+		seen[p] = true
+	}
+	for _, g := range groups {
+		for _, gp := range bp.groups {
+			for _, p := range gp.expand(g) {
+				if !seen[p] {
+					seen[p] = true
+					r = append(r, p)
+				}
+			}
+		}
+	}
+	actx.Principals = r
+	return nil
+}
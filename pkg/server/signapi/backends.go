@@ -0,0 +1,199 @@
+package signapi
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/labstack/echo/v4"
+)
+
+type disabledBackend struct {
+	by     string
+	at     time.Time
+	reason string
+}
+
+// Auth backends disabled at runtime. The state is not persisted, a restart
+// enables all configured backends again
+type backendState struct {
+	sync.RWMutex
+	disabled map[string]disabledBackend
+}
+
+func (bs *backendState) get(name string) (disabledBackend, bool) {
+	bs.RLock()
+	defer bs.RUnlock()
+	d, ok := bs.disabled[name]
+	return d, ok
+}
+
+func (bs *backendState) isDisabled(name string) bool {
+	_, ok := bs.get(name)
+	return ok
+}
+
+func (bs *backendState) disable(name string, d disabledBackend) {
+	bs.Lock()
+	defer bs.Unlock()
+	if bs.disabled == nil {
+		bs.disabled = make(map[string]disabledBackend)
+	}
+	bs.disabled[name] = d
+}
+
+func (bs *backendState) enable(name string) {
+	bs.Lock()
+	defer bs.Unlock()
+	delete(bs.disabled, name)
+}
+
+func (sa *SignApi) backendStatus(e AuthenticatorListEntry) objects.BackendStatus {
+	a := e.Authenticator
+	_, probe := a.(auth.Prober)
+	r := objects.BackendStatus{
+		Name:           a.Name(),
+		Type:           a.Type(),
+		Realm:          a.Realm(),
+		CredentialType: a.CredentialType(),
+		Default:        e.Default,
+		Enabled:        true,
+		Probe:          probe,
+	}
+	if h, ok := sa.backendHealth(a.Name()); ok {
+		r.Health = h.object(a.Name(), true)
+	}
+	if bl := sa.backendLimits[a.Name()]; bl != nil && bl.FailureThreshold > 0 {
+		r.Circuit = bl.circuit().String()
+	}
+	if d, ok := sa.backends.get(a.Name()); ok {
+		at := d.at
+		r.Enabled = false
+		r.DisabledBy = d.by
+		r.DisabledAt = &at
+		r.Reason = d.reason
+	}
+	return r
+}
+
+// Whether any of the auth backends takes the credential type
+func (sa *SignApi) UsesCredentialType(t string) bool {
+	for _, e := range sa.authList {
+		if e.Authenticator.CredentialType() == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop the health checks and release the resources of the auth backends
+// holding any, like the plugin processes. Called when the API is replaced or
+// the server shuts down
+func (sa *SignApi) CloseAuthenticators() {
+	sa.stopHealthChecks()
+	for _, e := range sa.authList {
+		if c, ok := e.Authenticator.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				Log.WithError(err).WithField("backend", e.Authenticator.Name()).Warn("cannot close auth backend")
+			}
+		}
+	}
+}
+
+func (sa *SignApi) adminBackend(c echo.Context) (AuthenticatorListEntry, error) {
+	name, _ := url.PathUnescape(c.Param("name"))
+	for _, e := range sa.authList {
+		if e.Authenticator.Name() == name {
+			return e, nil
+		}
+	}
+	return AuthenticatorListEntry{}, echo.NewHTTPError(http.StatusNotFound, "no such auth backend")
+}
+
+func (sa *SignApi) HandleAdminListBackends(c echo.Context) error {
+	r := []objects.BackendStatus{}
+	for _, e := range sa.authList {
+		r = append(r, sa.backendStatus(e))
+	}
+	return c.JSON(http.StatusOK, r)
+}
+
+func (sa *SignApi) HandleAdminDisableBackend(c echo.Context) error {
+	e, err := sa.adminBackend(c)
+	if err != nil {
+		return err
+	}
+	name := e.Authenticator.Name()
+	subject := adminSubject(c)
+	reason := c.QueryParam("reason")
+	sa.backends.disable(name, disabledBackend{
+		by:     subject,
+		at:     time.Now().UTC(),
+		reason: reason,
+	})
+	requestLog(c).
+		WithField("authenticator", name).
+		WithField("disabled_by", subject).
+		WithField("reason", reason).
+		Warn("auth backend disabled")
+	ev := newAuditEvent(c, audit.EventBackendDisabled)
+	ev.Success = true
+	ev.Subject = subject
+	ev.Authenticator = name
+	ev.Reason = reason
+	audit.Record(ev)
+	return c.JSON(http.StatusOK, sa.backendStatus(e))
+}
+
+func (sa *SignApi) HandleAdminEnableBackend(c echo.Context) error {
+	e, err := sa.adminBackend(c)
+	if err != nil {
+		return err
+	}
+	name := e.Authenticator.Name()
+	subject := adminSubject(c)
+	sa.backends.enable(name)
+	requestLog(c).
+		WithField("authenticator", name).
+		WithField("enabled_by", subject).
+		Info("auth backend enabled")
+	ev := newAuditEvent(c, audit.EventBackendEnabled)
+	ev.Success = true
+	ev.Subject = subject
+	ev.Authenticator = name
+	audit.Record(ev)
+	return c.JSON(http.StatusOK, sa.backendStatus(e))
+}
+
+// Test connectivity to the service behind the backend. Probe failures are
+// reported in the result, not as an error status
+func (sa *SignApi) HandleAdminProbeBackend(c echo.Context) error {
+	e, err := sa.adminBackend(c)
+	if err != nil {
+		return err
+	}
+	p, ok := e.Authenticator.(auth.Prober)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotImplemented, "auth backend does not support probing")
+	}
+	start := time.Now()
+	err = p.Probe()
+	if sa.health != nil {
+		sa.health.record(e.Authenticator.Name(), start, err)
+	}
+	r := objects.BackendProbeResult{
+		Name:     e.Authenticator.Name(),
+		Success:  err == nil,
+		Duration: time.Since(start).String(),
+	}
+	if err != nil {
+		r.Error = err.Error()
+		requestLog(c).WithField("authenticator", r.Name).WithError(err).Warn("auth backend probe failed")
+	}
+	return c.JSON(http.StatusOK, r)
+}
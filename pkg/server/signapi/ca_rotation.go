@@ -0,0 +1,225 @@
+package signapi
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/carotation"
+	"github.com/aakso/ssh-inscribe/pkg/keysigner"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Enable the CA rotation admin endpoints. The store keeps the rotation
+// state over restarts
+func (sa *SignApi) SetRotationStore(s *carotation.Store) {
+	sa.rotation = s
+}
+
+func caKeyInfo(key ssh.PublicKey) *objects.CAKeyInfo {
+	return &objects.CAKeyInfo{
+		Fingerprint: ssh.FingerprintSHA256(key),
+		PublicKey:   strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+	}
+}
+
+func (sa *SignApi) HandleAdminGetCARotation(c echo.Context) error {
+	if sa.rotation == nil {
+		return echo.ErrNotFound
+	}
+	var status objects.CARotationStatus
+	if key, err := sa.signer.GetPublicKey(); err == nil {
+		status.Signing = caKeyInfo(key)
+	}
+	st := sa.rotation.State()
+	if r, ok := sa.signer.Rotation(); ok {
+		status.Next = &objects.CAKeyInfo{Fingerprint: r.Next}
+		if keys, err := sa.signer.GetPublicKeys(); err == nil {
+			for _, k := range keys {
+				if ssh.FingerprintSHA256(k) == r.Next {
+					status.Next = caKeyInfo(k)
+				}
+			}
+		}
+		status.Cutover = &r.Cutover
+		status.StartedBy = st.StartedBy
+		status.StartedAt = st.StartedAt
+	}
+	for _, rk := range st.Retired {
+		status.Retired = append(status.Retired, objects.RetiredCAKey{
+			CAKeyInfo: objects.CAKeyInfo{Fingerprint: rk.Fingerprint, PublicKey: rk.PublicKey},
+			RetiredAt: rk.RetiredAt,
+			RetiredBy: rk.RetiredBy,
+		})
+	}
+	return c.JSON(http.StatusOK, status)
+}
+
+// Add or generate the next CA key and schedule the cutover
+func (sa *SignApi) HandleAdminStartCARotation(c echo.Context) error {
+	if sa.rotation == nil {
+		return echo.ErrNotFound
+	}
+	var req objects.CARotationRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "invalid request").Error())
+	}
+	now := time.Now().UTC()
+	cutover := now
+	if req.Cutover != nil {
+		cutover = req.Cutover.UTC()
+	}
+	subject := adminSubject(c)
+
+	var next ssh.PublicKey
+	err := sa.rotation.Update(func(st *carotation.State) error {
+		if _, ok := sa.signer.Rotation(); ok || st.Next != "" {
+			return echo.NewHTTPError(http.StatusConflict, "CA rotation is already in progress")
+		}
+		var err error
+		if req.PrivateKey != "" {
+			next, err = sa.signer.AddAgentKey([]byte(req.PrivateKey), "ssh-inscribe rotation")
+		} else {
+			next, err = sa.signer.GenerateSigningKey("ssh-inscribe rotation")
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		r := keysigner.Rotation{Next: ssh.FingerprintSHA256(next), Cutover: cutover}
+		if err := sa.signer.SetRotation(r); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		st.Next = r.Next
+		st.Cutover = &cutover
+		st.StartedBy = subject
+		st.StartedAt = &now
+		return nil
+	})
+	if err != nil {
+		if next != nil {
+			sa.signer.ClearRotation()
+		}
+		return rotationError(err)
+	}
+
+	fp := ssh.FingerprintSHA256(next)
+	requestLog(c).
+		WithField("fingerprint", fp).
+		WithField("cutover", cutover).
+		WithField("started_by", subject).
+		Info("started CA key rotation")
+	ev := newAuditEvent(c, audit.EventCARotationStarted)
+	ev.Success = true
+	ev.Subject = subject
+	ev.PublicKeyFingerprint = fp
+	ev.Cutover = &cutover
+	audit.Record(ev)
+	return c.JSON(http.StatusCreated, caKeyInfo(next))
+}
+
+// Cancel a pending rotation. The default key keeps signing
+func (sa *SignApi) HandleAdminCancelCARotation(c echo.Context) error {
+	if sa.rotation == nil {
+		return echo.ErrNotFound
+	}
+	var r keysigner.Rotation
+	err := sa.rotation.Update(func(st *carotation.State) error {
+		var ok bool
+		if r, ok = sa.signer.Rotation(); !ok {
+			return echo.NewHTTPError(http.StatusConflict, "no CA rotation in progress")
+		}
+		st.Next = ""
+		st.Cutover = nil
+		st.StartedBy = ""
+		st.StartedAt = nil
+		return nil
+	})
+	if err != nil {
+		return rotationError(err)
+	}
+	sa.signer.ClearRotation()
+
+	subject := adminSubject(c)
+	requestLog(c).
+		WithField("fingerprint", r.Next).
+		WithField("cancelled_by", subject).
+		Info("cancelled CA key rotation")
+	ev := newAuditEvent(c, audit.EventCARotationCancelled)
+	ev.Success = true
+	ev.Subject = subject
+	ev.PublicKeyFingerprint = r.Next
+	audit.Record(ev)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Complete the rotation by retiring the previous key after the cutover
+func (sa *SignApi) HandleAdminRetireCAKey(c echo.Context) error {
+	if sa.rotation == nil {
+		return echo.ErrNotFound
+	}
+	subject := adminSubject(c)
+	var (
+		old  ssh.PublicKey
+		next string
+	)
+	err := sa.rotation.Update(func(st *carotation.State) error {
+		r, ok := sa.signer.Rotation()
+		if !ok {
+			return echo.NewHTTPError(http.StatusConflict, "no CA rotation in progress")
+		}
+		if time.Now().Before(r.Cutover) {
+			return echo.NewHTTPError(http.StatusConflict, "cutover time has not been reached")
+		}
+		var err error
+		if old, err = sa.signer.RetireDefault(); err != nil {
+			return err
+		}
+		next = r.Next
+		st.Current = r.Next
+		st.Next = ""
+		st.Cutover = nil
+		st.StartedBy = ""
+		st.StartedAt = nil
+		info := caKeyInfo(old)
+		st.Retired = append(st.Retired, carotation.RetiredKey{
+			Fingerprint: info.Fingerprint,
+			PublicKey:   info.PublicKey,
+			RetiredAt:   time.Now().UTC(),
+			RetiredBy:   subject,
+		})
+		return nil
+	})
+	if err != nil {
+		if old != nil {
+			// The key is already gone from the agent, only the state on disk
+			// is stale
+			requestLog(c).WithError(err).Error("retired CA key but cannot persist the rotation state")
+		}
+		return rotationError(err)
+	}
+
+	fp := ssh.FingerprintSHA256(old)
+	requestLog(c).
+		WithField("fingerprint", fp).
+		WithField("signing", next).
+		WithField("retired_by", subject).
+		Info("retired CA key")
+	ev := newAuditEvent(c, audit.EventCAKeyRetired)
+	ev.Success = true
+	ev.Subject = subject
+	ev.PublicKeyFingerprint = fp
+	audit.Record(ev)
+	return c.JSON(http.StatusOK, caKeyInfo(old))
+}
+
+func rotationError(err error) error {
+	if he, ok := err.(*echo.HTTPError); ok {
+		return he
+	}
+	Log.WithError(err).Error("CA rotation failed")
+	return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+}
@@ -0,0 +1,108 @@
+package signapi
+
+import (
+	"net/http"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/gobwas/glob"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+type DeniedPrincipals struct {
+	// Principal names or patterns
+	Principals []string
+	// Authenticator name patterns the rule applies to. Empty applies to all
+	Backends []string
+	// Authenticator name patterns exempt from the rule, e.g. the admin
+	// backend
+	ExceptBackends []string
+}
+
+type deniedPrincipals struct {
+	principals     []glob.Glob
+	backends       []glob.Glob
+	exceptBackends []glob.Glob
+}
+
+func (d *deniedPrincipals) appliesTo(authenticators []string) bool {
+	matched := len(d.backends) == 0
+	for _, a := range authenticators {
+		if matchAny(d.exceptBackends, a) {
+			return false
+		}
+		if matchAny(d.backends, a) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Principals that may never appear in an issued certificate. Checked after
+// the principal mapping, user filters and policy templates
+func (sa *SignApi) SetDeniedPrincipals(conf []DeniedPrincipals) error {
+	var denied []deniedPrincipals
+	for _, v := range conf {
+		var (
+			d   deniedPrincipals
+			err error
+		)
+		if d.principals, err = compileGlobs(v.Principals); err != nil {
+			return errors.Wrap(err, "invalid denied principals")
+		}
+		if d.backends, err = compileGlobs(v.Backends); err != nil {
+			return errors.Wrap(err, "invalid denied principals backends")
+		}
+		if d.exceptBackends, err = compileGlobs(v.ExceptBackends); err != nil {
+			return errors.Wrap(err, "invalid denied principals backends")
+		}
+		denied = append(denied, d)
+	}
+	sa.principalDeny = denied
+	return nil
+}
+
+// Remove the denied principals from the certificate. Signing is refused if
+// no principals remain
+func (sa *SignApi) checkDeniedPrincipals(c echo.Context, actx *auth.AuthContext, cert *ssh.Certificate) error {
+	if len(sa.principalDeny) == 0 {
+		return nil
+	}
+	authenticators := actx.GetAuthenticators()
+	var rules []*deniedPrincipals
+	for i := range sa.principalDeny {
+		if sa.principalDeny[i].appliesTo(authenticators) {
+			rules = append(rules, &sa.principalDeny[i])
+		}
+	}
+	var allowed, removed []string
+	for _, p := range cert.ValidPrincipals {
+		deny := false
+		for _, r := range rules {
+			if matchAny(r.principals, p) {
+				deny = true
+				break
+			}
+		}
+		if deny {
+			removed = append(removed, p)
+		} else {
+			allowed = append(allowed, p)
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	requestLog(c).
+		WithField("subject", actx.GetSubjectName()).
+		WithField("principals", removed).
+		Warn("removed denied principals")
+	if len(allowed) == 0 {
+		auditCertificateDenied(c, actx, cert, "all principals are denied")
+		return newProblem(http.StatusForbidden, objects.ErrorPrincipalsDenied, errors.Errorf("principals %v are not allowed", removed).Error())
+	}
+	cert.ValidPrincipals = allowed
+	return nil
+}
@@ -0,0 +1,104 @@
+package signapi
+
+import (
+	"sort"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+type GroupExtensions struct {
+	// Group patterns matched against the user principals
+	Groups  []string
+	Allowed []string
+	Denied  []string
+}
+
+// Extension patterns the server may place in certificates. An extension
+// must be allowed and not denied by the global lists and by every matching
+// group. Empty allowed lists allow all
+type ExtensionLimits struct {
+	Allowed []string
+	Denied  []string
+	Groups  []GroupExtensions
+}
+
+type extensionRule struct {
+	groups  []glob.Glob
+	allowed []glob.Glob
+	denied  []glob.Glob
+}
+
+func (r *extensionRule) permits(ext string) bool {
+	if matchAny(r.denied, ext) {
+		return false
+	}
+	return len(r.allowed) == 0 || matchAny(r.allowed, ext)
+}
+
+type extensionLimits struct {
+	global extensionRule
+	groups []extensionRule
+}
+
+func newExtensionRule(groups, allowed, denied []string) (r extensionRule, err error) {
+	if r.groups, err = compileGlobs(groups); err != nil {
+		return r, err
+	}
+	if r.allowed, err = compileGlobs(allowed); err != nil {
+		return r, err
+	}
+	r.denied, err = compileGlobs(denied)
+	return r, err
+}
+
+// Restrict the extensions of all signed certificates regardless of what the
+// auth backends, policy templates or federation frontends set
+func (sa *SignApi) SetExtensionLimits(conf ExtensionLimits) error {
+	global, err := newExtensionRule(nil, conf.Allowed, conf.Denied)
+	if err != nil {
+		return errors.Wrap(err, "invalid extension limits")
+	}
+	el := &extensionLimits{global: global}
+	for _, g := range conf.Groups {
+		r, err := newExtensionRule(g.Groups, g.Allowed, g.Denied)
+		if err != nil {
+			return errors.Wrapf(err, "invalid extension limits for groups %v", g.Groups)
+		}
+		el.groups = append(el.groups, r)
+	}
+	sa.extensionLimits = el
+	return nil
+}
+
+// Remove the extensions not permitted for the user. Returns the removed
+// extensions
+func (el *extensionLimits) apply(actx *auth.AuthContext, cert *ssh.Certificate) []string {
+	if el == nil || len(cert.Extensions) == 0 {
+		return nil
+	}
+	principals := append(actx.GetPrincipals(), cert.ValidPrincipals...)
+	rules := []*extensionRule{&el.global}
+	for i := range el.groups {
+		for _, p := range principals {
+			if matchAny(el.groups[i].groups, p) {
+				rules = append(rules, &el.groups[i])
+				break
+			}
+		}
+	}
+	var removed []string
+	for ext := range cert.Extensions {
+		for _, r := range rules {
+			if !r.permits(ext) {
+				delete(cert.Extensions, ext)
+				removed = append(removed, ext)
+				break
+			}
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
@@ -0,0 +1,430 @@
+package signapi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gobwas/glob"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Frontends authenticate forwarded signing requests with a short lived
+// assertion signed with the key shared with the upstream
+const (
+	FederationAssertionHeader = "X-Federation-Assertion"
+	federationAudience        = "ssh-inscribe-federation"
+	federationAssertionLife   = time.Minute
+	federationMinKeyLen       = 32
+	// Allowed difference between the clocks of the frontend and this instance
+	federationClockSkew = 5 * time.Minute
+)
+
+type federationClaims struct {
+	jwt.StandardClaims
+	// Binds the assertion to the forwarded request
+	BodyHash string `json:"body_sha256"`
+}
+
+// Frontend allowed to forward signing requests to this instance
+type FederationFrontend struct {
+	Name string
+	Key  []byte
+	// Principals the frontend may request. Others are dropped from the
+	// forwarded certificates
+	Principals []string
+	// Forwarded certificates are clamped to the lifetime if set
+	MaxLifetime time.Duration
+}
+
+type federationFrontend struct {
+	FederationFrontend
+	principals []glob.Glob
+}
+
+// Accept signing requests forwarded by the frontends
+func (sa *SignApi) SetFederationFrontends(frontends []FederationFrontend) error {
+	m := make(map[string]*federationFrontend)
+	for _, f := range frontends {
+		if f.Name == "" {
+			return errors.New("federation frontend name is not set")
+		}
+		if len(f.Key) < federationMinKeyLen {
+			return errors.Errorf("federation key for %s must be at least %d bytes", f.Name, federationMinKeyLen)
+		}
+		if _, ok := m[f.Name]; ok {
+			return errors.Errorf("duplicate federation frontend %s", f.Name)
+		}
+		principals, err := compileGlobs(f.Principals)
+		if err != nil {
+			return errors.Wrapf(err, "invalid principals for federation frontend %s", f.Name)
+		}
+		m[f.Name] = &federationFrontend{FederationFrontend: f, principals: principals}
+	}
+	sa.frontends = m
+	return nil
+}
+
+type UpstreamConfig struct {
+	// Base URL of the upstream instance, e.g. https://ca.example.com:8540
+	URL string
+	// Name and key of this frontend on the upstream
+	Name      string
+	Key       []byte
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+}
+
+// Upstream instance holding the CA keys. Certificates are built and checked
+// against the local configuration and forwarded to the upstream for signing
+type Upstream struct {
+	url    string
+	name   string
+	key    []byte
+	client *http.Client
+}
+
+func NewUpstream(conf UpstreamConfig) (*Upstream, error) {
+	if conf.URL == "" || conf.Name == "" {
+		return nil, errors.New("upstream url and name are required")
+	}
+	if len(conf.Key) < federationMinKeyLen {
+		return nil, errors.Errorf("upstream key must be at least %d bytes", federationMinKeyLen)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = conf.TLSConfig
+	return &Upstream{
+		url:    strings.TrimSuffix(conf.URL, "/") + "/v1/",
+		name:   conf.Name,
+		key:    conf.Key,
+		client: &http.Client{Timeout: conf.Timeout, Transport: transport},
+	}, nil
+}
+
+// Forward signing to the upstream instead of the local signer
+func (sa *SignApi) SetUpstream(u *Upstream) {
+	sa.upstream = u
+}
+
+func (u *Upstream) sign(c echo.Context, actx *auth.AuthContext, caName string, cert *ssh.Certificate) error {
+	req := objects.FederationSignRequest{
+		PublicKey:       string(ssh.MarshalAuthorizedKey(cert.Key)),
+		CertType:        "user",
+		KeyID:           cert.KeyId,
+		Principals:      cert.ValidPrincipals,
+		ValidAfter:      time.Unix(int64(cert.ValidAfter), 0).UTC(),
+		ValidBefore:     time.Unix(int64(cert.ValidBefore), 0).UTC(),
+		CriticalOptions: cert.CriticalOptions,
+		Extensions:      cert.Extensions,
+		CA:              caName,
+		AuditID:         c.Response().Header().Get(echo.HeaderXRequestID),
+	}
+	if cert.CertType == ssh.HostCert {
+		req.CertType = "host"
+	}
+	if actx != nil {
+		req.Subject = actx.GetSubjectName()
+		req.Authenticators = actx.GetAuthenticators()
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode upstream request")
+	}
+	assertion, err := u.assertion(body)
+	if err != nil {
+		return err
+	}
+	target := u.url + "federation/sign"
+	// Requests needing an approval on the upstream are retried with its id
+	if id := c.QueryParam("approval"); id != "" {
+		target += "?approval=" + url.QueryEscape(id)
+	}
+	hreq, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq = hreq.WithContext(c.Request().Context())
+	hreq.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	hreq.Header.Set(FederationAssertionHeader, assertion)
+	setRequestHeaders(c, hreq.Header)
+	resp, err := u.client.Do(hreq)
+	if err != nil {
+		return errors.Wrap(err, "upstream request failed")
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return errors.Wrap(err, "cannot read upstream response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("upstream returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return errors.Wrap(err, "cannot parse upstream certificate")
+	}
+	signed, ok := key.(*ssh.Certificate)
+	if !ok || !bytes.Equal(signed.Key.Marshal(), cert.Key.Marshal()) {
+		return errors.New("upstream returned a certificate for another key")
+	}
+	// The upstream may have attenuated the request
+	*cert = *signed
+	return nil
+}
+
+func (u *Upstream) assertion(body []byte) (string, error) {
+	sum := sha256.Sum256(body)
+	var jti [16]byte
+	if _, err := rand.Read(jti[:]); err != nil {
+		return "", errors.Wrap(err, "cannot generate assertion id")
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, federationClaims{
+		StandardClaims: jwt.StandardClaims{
+			Id:        hex.EncodeToString(jti[:]),
+			Issuer:    u.name,
+			Audience:  federationAudience,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(federationAssertionLife).Unix(),
+		},
+		BodyHash: hex.EncodeToString(sum[:]),
+	})
+	ss, err := token.SignedString(u.key)
+	return ss, errors.Wrap(err, "cannot sign upstream assertion")
+}
+
+// Pass a public read only request through to the upstream
+func (u *Upstream) forward(c echo.Context, path string) error {
+	target := u.url + path
+	if q := c.QueryString(); q != "" {
+		target += "?" + q
+	}
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(c.Request().Context())
+	if v := c.Request().Header.Get("If-None-Match"); v != "" {
+		req.Header.Set("If-None-Match", v)
+	}
+	setRequestHeaders(c, req.Header)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		requestLog(c).WithError(err).Error("upstream request failed")
+		return echo.NewHTTPError(http.StatusBadGateway, "upstream request failed")
+	}
+	defer resp.Body.Close()
+	for _, h := range []string{echo.HeaderContentType, "ETag", "Cache-Control"} {
+		if v := resp.Header.Get(h); v != "" {
+			c.Response().Header().Set(h, v)
+		}
+	}
+	c.Response().WriteHeader(resp.StatusCode)
+	_, err = io.Copy(c.Response(), resp.Body)
+	return err
+}
+
+// Sign a certificate forwarded by a frontend. The frontend has already
+// authenticated the user and applied its own configuration, the request is
+// attenuated here to what the frontend is allowed to request
+func (sa *SignApi) HandleFederationSign(c echo.Context) error {
+	if len(sa.frontends) == 0 {
+		return echo.ErrNotFound
+	}
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot read request")
+	}
+	frontend, err := sa.verifyAssertion(c.Request().Header.Get(FederationAssertionHeader), body)
+	if err != nil {
+		requestLog(c).WithError(err).WithField("remote_address", c.RealIP()).Warn("rejected federation request")
+		return echo.ErrUnauthorized
+	}
+	var req objects.FederationSignRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "invalid request").Error())
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(req.PublicKey))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "cannot parse public key").Error())
+	}
+
+	// Identity and authenticators asserted by the frontend. The step-up rules
+	// and backend limits of this instance apply to the forwarded
+	// authenticators by name
+	var parent *auth.AuthContext
+	for i := len(req.Authenticators) - 1; i >= 0; i-- {
+		parent = &auth.AuthContext{Status: auth.StatusCompleted, Authenticator: req.Authenticators[i], Parent: parent}
+	}
+	actx := &auth.AuthContext{
+		Status:        auth.StatusCompleted,
+		SubjectName:   req.Subject,
+		Authenticator: "federation:" + frontend.Name,
+		Parent:        parent,
+	}
+	log := requestLog(c).
+		WithField("frontend", frontend.Name).
+		WithField("frontend_audit_id", req.AuditID)
+
+	cert := &ssh.Certificate{
+		Key:             pubKey,
+		CertType:        ssh.UserCert,
+		KeyId:           req.KeyID,
+		ValidAfter:      uint64(req.ValidAfter.Unix()),
+		ValidBefore:     uint64(req.ValidBefore.Unix()),
+		Permissions:     ssh.Permissions{CriticalOptions: req.CriticalOptions, Extensions: req.Extensions},
+		ValidPrincipals: []string{},
+	}
+	if req.CertType == "host" {
+		cert.CertType = ssh.HostCert
+	}
+	for _, p := range req.Principals {
+		if matchAny(frontend.principals, p) {
+			cert.ValidPrincipals = append(cert.ValidPrincipals, p)
+		} else {
+			log.WithField("principal", p).Info("dropping principal not allowed for the frontend")
+		}
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		auditCertificateDenied(c, actx, cert, "no principals allowed for the frontend")
+		return echo.NewHTTPError(http.StatusForbidden, "no principals allowed for the frontend")
+	}
+	// Certificates may be postdated but not backdated
+	if time.Since(req.ValidAfter) > federationClockSkew {
+		auditCertificateDenied(c, actx, cert, "validity start is outside the allowed clock skew")
+		return echo.NewHTTPError(http.StatusBadRequest, "validity start is outside the allowed clock skew")
+	}
+
+	// Forwarded lifetimes are clamped to the limits of this instance
+	maxLife := sa.maxCertLife
+	if frontend.MaxLifetime > 0 && frontend.MaxLifetime < maxLife {
+		maxLife = frontend.MaxLifetime
+	}
+	_, minLife, maxLife := sa.lifetimeLimits.bounds(actx, sa.defaultCertLife, maxLife)
+	validBefore := req.ValidBefore
+	if max := time.Now().Add(maxLife); validBefore.After(max) {
+		log.WithField("requested", validBefore).WithField("max_lifetime", maxLife).Info("clamping forwarded certificate lifetime")
+		validBefore = max
+	}
+	if min := time.Now().Add(minLife); validBefore.Before(min) {
+		validBefore = min
+	}
+	cert.ValidBefore = uint64(validBefore.Unix())
+	if cert.ValidBefore <= cert.ValidAfter {
+		auditCertificateDenied(c, actx, cert, "certificate would never be valid")
+		return echo.NewHTTPError(http.StatusBadRequest, "certificate would never be valid")
+	}
+
+	caName, err := sa.checkCA(req.CA)
+	if err != nil {
+		return err
+	}
+	c.Set(ctxCA, caName)
+	if err := sa.checkPolicyHook(c, actx, cert, caName); err != nil {
+		return err
+	}
+	if err := sa.checkDeniedPrincipals(c, actx, cert); err != nil {
+		return err
+	}
+	if err := sa.checkBackendPrincipals(c, actx, cert); err != nil {
+		return err
+	}
+	if err := sa.checkIssuanceWindows(c, actx, cert); err != nil {
+		return err
+	}
+	if err := sa.checkStepUp(c, actx, cert); err != nil {
+		return err
+	}
+	if sa.revocations != nil && sa.revocations.IsRevoked(cert) {
+		auditCertificateDenied(c, actx, cert, "public key or key id has been revoked")
+		return echo.NewHTTPError(http.StatusForbidden, "public key or key id has been revoked")
+	}
+	if ok, err := sa.checkApproval(c, actx, cert, caName); !ok {
+		return err
+	}
+	if err := sa.checkQuota(c, actx, cert); err != nil {
+		return err
+	}
+	if cert.Serial, err = sa.nextSerial(); err != nil {
+		log.WithError(err).Error("cannot allocate certificate serial")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot allocate certificate serial")
+	}
+	if err := sa.signCertificate(c, actx, caName, cert); err != nil {
+		err = errors.Wrap(err, "cannot sign")
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := sa.recordCertificate(c, actx, cert); err != nil {
+		log.WithError(err).Error("cannot record issued certificate")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot record issued certificate")
+	}
+	log.
+		WithField("serial", cert.Serial).
+		WithField("key_id", cert.KeyId).
+		WithField("ca", caName).
+		WithField("principals", cert.ValidPrincipals).
+		WithField("expires", time.Unix(int64(cert.ValidBefore), 0)).
+		WithField("pubkey_fp", ssh.FingerprintSHA256(pubKey)).
+		Info("issued certificate for federation frontend")
+	auditCertificate(c, actx, cert)
+	return c.Blob(http.StatusOK, "text/plain", ssh.MarshalAuthorizedKey(cert))
+}
+
+func (sa *SignApi) verifyAssertion(assertion string, body []byte) (*federationFrontend, error) {
+	if assertion == "" {
+		return nil, errors.New("assertion is missing")
+	}
+	var frontend *federationFrontend
+	claims := &federationClaims{}
+	_, err := jwt.ParseWithClaims(assertion, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		if frontend = sa.frontends[claims.Issuer]; frontend == nil {
+			return nil, errors.Errorf("unknown frontend %s", claims.Issuer)
+		}
+		return frontend.Key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	if !claims.VerifyAudience(federationAudience, true) || !claims.VerifyExpiresAt(now, true) {
+		return nil, errors.New("invalid assertion claims")
+	}
+	if claims.ExpiresAt-claims.IssuedAt > int64(federationAssertionLife/time.Second) {
+		return nil, errors.New("assertion lifetime is too long")
+	}
+	sum := sha256.Sum256(body)
+	if claims.BodyHash != hex.EncodeToString(sum[:]) {
+		return nil, errors.New("assertion does not match the request")
+	}
+	// Each assertion is accepted once. With a shared state store this holds
+	// over all replicas
+	if claims.Id == "" {
+		return nil, errors.New("assertion id is missing")
+	}
+	ttl := time.Until(time.Unix(claims.ExpiresAt, 0)) + time.Second
+	fresh, err := sharedstate.Get().SetNX("federation:jti:"+claims.Issuer+":"+claims.Id, []byte{1}, ttl)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot check assertion replay")
+	}
+	if !fresh {
+		return nil, errors.New("assertion has already been used")
+	}
+	return frontend, nil
+}
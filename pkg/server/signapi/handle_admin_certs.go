@@ -0,0 +1,94 @@
+package signapi
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/certdb"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// Build a certificate filter from the query parameters
+func certFilterFromQuery(c echo.Context) (certdb.Filter, error) {
+	f := certdb.Filter{
+		Subject:   c.QueryParam("user"),
+		Principal: c.QueryParam("principal"),
+		KeyID:     c.QueryParam("key_id"),
+	}
+	times := []struct {
+		param string
+		dst   *time.Time
+	}{
+		{"issued_after", &f.IssuedAfter},
+		{"issued_before", &f.IssuedBefore},
+		{"expires_after", &f.ExpiresAfter},
+		{"expires_before", &f.ExpiresBefore},
+		{"valid_at", &f.ValidAt},
+	}
+	for _, t := range times {
+		v := c.QueryParam(t.param)
+		if v == "" {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, errors.Wrapf(err, "invalid %s", t.param)
+		}
+		*t.dst = ts
+	}
+	if v := c.QueryParam("valid"); v != "" {
+		valid, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, errors.Wrap(err, "invalid valid")
+		}
+		if valid {
+			f.ValidAt = time.Now()
+		}
+	}
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return f, errors.New("invalid limit")
+		}
+		f.Limit = limit
+	}
+	return f, nil
+}
+
+func (sa *SignApi) HandleAdminListCerts(c echo.Context) error {
+	if sa.certs == nil {
+		return echo.ErrNotFound
+	}
+	f, err := certFilterFromQuery(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	records, err := sa.certs.List(f)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if records == nil {
+		records = []*certdb.Record{}
+	}
+	return c.JSON(http.StatusOK, records)
+}
+
+func (sa *SignApi) HandleAdminGetCert(c echo.Context) error {
+	if sa.certs == nil {
+		return echo.ErrNotFound
+	}
+	serial, err := strconv.ParseUint(c.Param("serial"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid serial")
+	}
+	r, err := sa.certs.Get(serial)
+	if err == certdb.ErrNotFound {
+		return echo.ErrNotFound
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, r)
+}
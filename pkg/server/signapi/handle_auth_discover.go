@@ -10,12 +10,20 @@ import (
 func (sa *SignApi) HandleAuthDiscover(c echo.Context) error {
 	var r []objects.DiscoverResult
 	for _, v := range sa.authList {
-		r = append(r, objects.DiscoverResult{
-			AuthenticatorName:           v.Authenticator.Name(),
+		// Left out so that the client picks the backends it may use
+		if sa.backends.isDisabled(v.Authenticator.Name()) || sa.backendRefused(c, v.Authenticator.Name()) != "" {
+			continue
+		}
+		d := objects.DiscoverResult{
+			AuthenticatorName:           v.endpoint(),
 			AuthenticatorRealm:          v.Authenticator.Realm(),
 			AuthenticatorCredentialType: v.Authenticator.CredentialType(),
 			Default:                     v.Default,
-		})
+		}
+		if h, ok := sa.backendHealth(v.Authenticator.Name()); ok {
+			d.Health = h.status()
+		}
+		r = append(r, d)
 	}
 	return c.JSON(http.StatusOK, r)
 }
@@ -0,0 +1,184 @@
+package signapi
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/bootstrap"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	BootstrapTokenHeader = "X-Bootstrap-Token"
+
+	defaultBootstrapTokenTTL = 24 * time.Hour
+)
+
+// Issue a host certificate to an unattended host presenting a bootstrap
+// token. The requested hostnames must be allowed by both the token and the
+// host signing configuration
+func (sa *SignApi) HandleHostBootstrap(c echo.Context) error {
+	if sa.hostSigning == nil || sa.bootstrap == nil {
+		return echo.ErrNotFound
+	}
+	raw := c.Request().Header.Get(BootstrapTokenHeader)
+	if raw == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "missing bootstrap token")
+	}
+	pubKey, err := readPublicKey(c)
+	if err != nil {
+		return err
+	}
+	hostnames := hostnamesFromQuery(c)
+	if err := sa.checkHostnames(hostnames); err != nil {
+		return err
+	}
+
+	var token *bootstrap.Token
+	if len(hostnames) > 0 {
+		token, err = sa.bootstrap.Consume(raw, hostnames)
+	} else {
+		// Default to the literal names in the token. Lookup the token
+		// first without consuming it to find them
+		token, err = sa.bootstrap.Peek(raw)
+		if err == nil {
+			hostnames = token.LiteralHostnames()
+			if len(hostnames) == 0 {
+				return echo.NewHTTPError(http.StatusBadRequest, "no hostnames requested")
+			}
+			if err := sa.checkHostnames(hostnames); err != nil {
+				return err
+			}
+			token, err = sa.bootstrap.Consume(raw, hostnames)
+		}
+	}
+	switch err {
+	case nil:
+	case bootstrap.ErrInvalidToken, bootstrap.ErrHostnameDenied:
+		ev := newAuditEvent(c, audit.EventBootstrapTokenRejected)
+		ev.Reason = err.Error()
+		ev.Principals = hostnames
+		audit.Record(ev)
+		requestLog(c).WithField("remote_address", c.RealIP()).WithError(err).Warn("rejected bootstrap token")
+		if err == bootstrap.ErrHostnameDenied {
+			return echo.NewHTTPError(http.StatusForbidden, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+	default:
+		requestLog(c).WithError(err).Error("cannot use bootstrap token")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot use bootstrap token")
+	}
+
+	actx := &auth.AuthContext{
+		Status:        auth.StatusCompleted,
+		SubjectName:   "bootstrap:" + token.ID,
+		Authenticator: "bootstrap_token",
+		AuthMeta: map[string]interface{}{
+			auth.MetaAuditID: c.Response().Header().Get(echo.HeaderXRequestID),
+		},
+	}
+	return sa.issueHostCertificate(c, actx, pubKey, hostnames)
+}
+
+func adminSubject(c echo.Context) string {
+	if token, _ := c.Get("user").(*jwt.Token); token != nil {
+		if claims, _ := token.Claims.(*SignClaim); claims != nil && claims.AuthContext != nil {
+			return claims.AuthContext.GetSubjectName()
+		}
+	}
+	return ""
+}
+
+func (sa *SignApi) HandleAdminCreateBootstrapToken(c echo.Context) error {
+	if sa.hostSigning == nil || sa.bootstrap == nil {
+		return echo.ErrNotFound
+	}
+	var req objects.BootstrapTokenRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "invalid request").Error())
+	}
+	ttl := defaultBootstrapTokenTTL
+	if max := sa.hostSigning.tokenMaxTTL; max > 0 && ttl > max {
+		ttl = max
+	}
+	if req.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(req.TTL); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "invalid ttl").Error())
+		}
+	}
+	if max := sa.hostSigning.tokenMaxTTL; max > 0 && ttl > max {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.Errorf("maximum ttl is %s", max).Error())
+	}
+
+	subject := adminSubject(c)
+	raw, token, err := sa.bootstrap.Create(req.Hostnames, ttl, req.Uses, subject)
+	switch errors.Cause(err) {
+	case nil:
+	case bootstrap.ErrNoHostnames, bootstrap.ErrInvalidLifetime, bootstrap.ErrInvalidPattern:
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	default:
+		requestLog(c).WithError(err).Error("cannot create bootstrap token")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot create bootstrap token")
+	}
+
+	requestLog(c).
+		WithField("id", token.ID).
+		WithField("hostnames", token.Hostnames).
+		WithField("expires", token.Expires).
+		WithField("uses", token.UsesLeft).
+		WithField("created_by", subject).
+		Info("created bootstrap token")
+	ev := newAuditEvent(c, audit.EventBootstrapTokenCreated)
+	ev.Success = true
+	ev.Subject = subject
+	ev.KeyID = token.ID
+	ev.Principals = token.Hostnames
+	ev.ValidBefore = &token.Expires
+	audit.Record(ev)
+
+	return c.JSON(http.StatusCreated, objects.BootstrapTokenResponse{
+		Token:     raw,
+		ID:        token.ID,
+		Hostnames: token.Hostnames,
+		Expires:   token.Expires,
+		Uses:      token.UsesLeft,
+	})
+}
+
+func (sa *SignApi) HandleAdminListBootstrapTokens(c echo.Context) error {
+	if sa.hostSigning == nil || sa.bootstrap == nil {
+		return echo.ErrNotFound
+	}
+	return c.JSON(http.StatusOK, sa.bootstrap.List())
+}
+
+func (sa *SignApi) HandleAdminDeleteBootstrapToken(c echo.Context) error {
+	if sa.hostSigning == nil || sa.bootstrap == nil {
+		return echo.ErrNotFound
+	}
+	id := c.Param("id")
+	switch err := sa.bootstrap.Delete(id); err {
+	case nil:
+	case bootstrap.ErrNotFound:
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	default:
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	subject := adminSubject(c)
+	requestLog(c).
+		WithField("id", id).
+		WithField("deleted_by", subject).
+		Info("deleted bootstrap token")
+	ev := newAuditEvent(c, audit.EventBootstrapTokenDeleted)
+	ev.Success = true
+	ev.Subject = subject
+	ev.KeyID = id
+	audit.Record(ev)
+	return c.NoContent(http.StatusNoContent)
+}
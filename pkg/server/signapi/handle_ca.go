@@ -1,10 +1,15 @@
 package signapi
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 
 	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/keysigner"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
@@ -21,7 +26,7 @@ func (sa *SignApi) HandleAddKey(c echo.Context) error {
 	if actx == nil {
 		return errors.New("no auth context")
 	}
-	log := Log.WithField("audit_id", actx.GetAuthMeta()[auth.MetaAuditID])
+	log := requestLog(c)
 
 	body, err := ioutil.ReadAll(c.Request().Body)
 	if err != nil {
@@ -29,17 +34,102 @@ func (sa *SignApi) HandleAddKey(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	if err := sa.signer.AddSigningKey(body, ""); err != nil {
+	caName, err := sa.checkCA(c.QueryParam("ca"))
+	if err != nil {
+		return err
+	}
+	if err := sa.signer.AddNamedSigningKey(caName, body, ""); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
-	log.Info("added signing key")
+	log.WithField("ca", caName).Info("added signing key")
 	return c.NoContent(http.StatusAccepted)
 }
 
 func (sa *SignApi) HandleGetKey(c echo.Context) error {
-	if key, err := sa.signer.GetPublicKey(); err != nil {
+	if sa.upstream != nil {
+		return sa.upstream.forward(c, "ca")
+	}
+	caName, err := sa.checkCA(c.QueryParam("ca"))
+	if err != nil {
+		return err
+	}
+	if key, err := sa.signer.GetNamedPublicKey(caName); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	} else {
 		return c.Blob(http.StatusOK, "text/plain", ssh.MarshalAuthorizedKey(key))
 	}
 }
+
+const (
+	BundleFormatAuthorizedKeys = "authorized_keys"
+	BundleFormatKnownHosts     = "known_hosts"
+)
+
+// Serve all active CA public keys either for TrustedUserCAKeys or as
+// @cert-authority lines for known_hosts. The ETag changes only when the set
+// of keys changes so clients can poll cheaply
+func (sa *SignApi) HandleGetTrustBundle(c echo.Context) error {
+	if sa.upstream != nil {
+		return sa.upstream.forward(c, "ca/bundle")
+	}
+	var keys []ssh.PublicKey
+	if name := c.QueryParam("ca"); name != "" {
+		caName, err := sa.checkCA(name)
+		if err != nil {
+			return err
+		}
+		key, err := sa.signer.GetNamedPublicKey(caName)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		keys = []ssh.PublicKey{key}
+	} else {
+		var err error
+		if keys, err = sa.signer.GetPublicKeys(); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	}
+	var buf bytes.Buffer
+	switch c.QueryParam("format") {
+	case "", BundleFormatAuthorizedKeys:
+		for _, key := range keys {
+			buf.Write(ssh.MarshalAuthorizedKey(key))
+		}
+	case BundleFormatKnownHosts:
+		hosts := c.QueryParam("hosts")
+		if hosts == "" {
+			hosts = "*"
+		}
+		for _, key := range keys {
+			fmt.Fprintf(&buf, "@cert-authority %s %s", hosts, ssh.MarshalAuthorizedKey(key))
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "format must be authorized_keys or known_hosts")
+	}
+
+	sum := sha256.Sum256(buf.Bytes())
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	if match := c.Request().Header.Get("If-None-Match"); match == etag || match == "W/"+etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, "text/plain", buf.Bytes())
+}
+
+// Check the CA key name is configured. Empty name selects the default key
+func (sa *SignApi) checkCA(name string) (string, error) {
+	if name == "" {
+		return keysigner.DefaultCA, nil
+	}
+	// Upstream checks the keys it holds
+	if sa.upstream != nil {
+		return name, nil
+	}
+	for _, n := range sa.signer.CANames() {
+		if n == name {
+			return name, nil
+		}
+	}
+	return "", echo.NewHTTPError(http.StatusBadRequest, errors.Errorf("unknown CA %s", name).Error())
+}
@@ -0,0 +1,79 @@
+package signapi
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/skip2/go-qrcode"
+)
+
+const defaultQRScale = 4
+
+// Enroll the authenticated user to an auth backend, for example to create
+// a TOTP seed. Returns the provisioning details as JSON or as a QR code
+// image with format=png
+func (sa *SignApi) HandleEnroll(c echo.Context) error {
+	endpoint, _ := url.PathUnescape(c.Param("name"))
+	ab, ok := sa.lookupBackend(c, endpoint)
+	if !ok {
+		return echo.ErrNotFound
+	}
+	name := ab.Name()
+	ea, ok := ab.(auth.EnrollableAuthenticator)
+	if !ok {
+		return echo.ErrNotFound
+	}
+	if sa.backends.isDisabled(name) {
+		return newProblem(http.StatusServiceUnavailable, objects.ErrorAuthBackendDisabled, "auth backend is disabled")
+	}
+	var actx *auth.AuthContext
+	if token, _ := c.Get("user").(*jwt.Token); token != nil {
+		if claims, _ := token.Claims.(*SignClaim); claims != nil {
+			actx = claims.AuthContext
+		}
+	}
+	if actx == nil {
+		return errors.New("no auth context")
+	}
+	if !actx.IsValid() {
+		return echo.NewHTTPError(http.StatusBadRequest, "auth context is not valid")
+	}
+
+	enrollment, err := ea.Enroll(actx)
+	if err != nil {
+		if err == auth.ErrAlreadyEnrolled {
+			return newProblem(http.StatusConflict, objects.ErrorAlreadyEnrolled, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	Log.WithField("backend", name).WithField("subject", actx.GetSubjectName()).Info("user enrolled")
+
+	if c.QueryParam("format") != "png" {
+		return c.JSON(http.StatusOK, objects.EnrollResult{
+			Secret: enrollment.Secret,
+			URI:    enrollment.URI,
+		})
+	}
+	scale := defaultQRScale
+	if v := c.QueryParam("scale"); v != "" {
+		if scale, err = strconv.Atoi(v); err != nil || scale < 1 || scale > 32 {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid scale")
+		}
+	}
+	code, err := qrcode.New(enrollment.URI, qrcode.Medium)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode QR code")
+	}
+	// Negative size is the number of pixels per module
+	b, err := code.PNG(-scale)
+	if err != nil {
+		return errors.Wrap(err, "cannot encode QR code")
+	}
+	return c.Blob(http.StatusOK, "image/png", b)
+}
@@ -0,0 +1,158 @@
+package signapi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+func (sa *SignApi) HandleHostSign(c echo.Context) error {
+	if sa.hostSigning == nil {
+		return echo.ErrNotFound
+	}
+	var actx *auth.AuthContext
+	if token, _ := c.Get("user").(*jwt.Token); token != nil {
+		if claims, _ := token.Claims.(*SignClaim); claims != nil {
+			actx = claims.AuthContext
+		}
+	}
+	if actx == nil {
+		return errors.New("no auth context")
+	}
+
+	if !actx.IsValid() {
+		return echo.NewHTTPError(http.StatusBadRequest, "auth context is not valid")
+	}
+	if missing := sa.missingAuth(actx); missing != nil {
+		detail := missingAuthDetail(missing)
+		auditCertificateDenied(c, actx, nil, detail)
+		return newProblem(http.StatusForbidden, objects.ErrorAuthChainIncomplete, detail)
+	}
+	if err := sa.checkBackendConditions(c, actx); err != nil {
+		return err
+	}
+	if !sa.isAdmin(actx) && !sa.hostSigning.allowedRequester(actx) {
+		auditCertificateDenied(c, actx, nil, "not allowed to request host certificates")
+		return newProblem(http.StatusForbidden, objects.ErrorHostSigningNotAllowed, "not allowed to request host certificates")
+	}
+
+	hostnames := hostnamesFromQuery(c)
+	if len(hostnames) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "no hostnames requested")
+	}
+	if err := sa.checkHostnames(hostnames); err != nil {
+		auditCertificateDenied(c, actx, nil, "requested hostname is not allowed")
+		return err
+	}
+	pubKey, err := readPublicKey(c)
+	if err != nil {
+		return err
+	}
+	return sa.issueHostCertificate(c, actx, pubKey, hostnames)
+}
+
+// Parse hostnames given either as comma separated or repeated query params
+func hostnamesFromQuery(c echo.Context) []string {
+	var hostnames []string
+	for _, v := range c.QueryParams()["hostnames"] {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				hostnames = append(hostnames, h)
+			}
+		}
+	}
+	return hostnames
+}
+
+func (sa *SignApi) checkHostnames(hostnames []string) error {
+	for _, h := range hostnames {
+		if !sa.hostSigning.allowedHostname(h) {
+			return newProblem(http.StatusForbidden, objects.ErrorHostnameNotAllowed, errors.Errorf("hostname %q is not allowed", h).Error())
+		}
+	}
+	return nil
+}
+
+func readPublicKey(c echo.Context) (ssh.PublicKey, error) {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		err = errors.Wrap(err, "cannot read public key")
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(body)
+	if err != nil {
+		err = errors.Wrap(err, "cannot parse public key")
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return pubKey, nil
+}
+
+func (sa *SignApi) issueHostCertificate(c echo.Context, actx *auth.AuthContext, pubKey ssh.PublicKey, hostnames []string) error {
+	log := requestLog(c)
+
+	caName, err := sa.checkCA(c.QueryParam("ca"))
+	if err != nil {
+		return err
+	}
+	c.Set(ctxCA, caName)
+
+	cert := auth.MakeHostCertificate(pubKey, hostnames, actx)
+	cert.ValidBefore = uint64(time.Now().Add(sa.hostSigning.defaultLifetime).Unix())
+	if exp := c.QueryParam("expires"); exp != "" {
+		ts, err := time.Parse(time.RFC3339, exp)
+		if err != nil {
+			err = errors.Wrap(err, "invalid expires")
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if time.Until(ts) > sa.hostSigning.maxLifetime {
+			err := errors.Errorf("maxmimum lifetime is %s", sa.hostSigning.maxLifetime)
+			auditCertificateDenied(c, actx, cert, err.Error())
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		cert.ValidBefore = uint64(ts.Unix())
+	}
+
+	if err := sa.checkDeniedPrincipals(c, actx, cert); err != nil {
+		return err
+	}
+	if err := sa.checkIssuanceWindows(c, actx, cert); err != nil {
+		return err
+	}
+	if sa.revocations != nil && sa.revocations.IsRevoked(cert) {
+		auditCertificateDenied(c, actx, cert, "public key has been revoked")
+		return newProblem(http.StatusForbidden, objects.ErrorKeyRevoked, "public key has been revoked")
+	}
+	if err := sa.consumeToken(c); err != nil {
+		return err
+	}
+	if cert.Serial, err = sa.nextSerial(); err != nil {
+		log.WithError(err).Error("cannot allocate certificate serial")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot allocate certificate serial")
+	}
+	if err := sa.signCertificate(c, actx, caName, cert); err != nil {
+		err = errors.Wrap(err, "cannot sign")
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	if err := sa.recordCertificate(c, actx, cert); err != nil {
+		log.WithError(err).Error("cannot record issued certificate")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot record issued certificate")
+	}
+	log.
+		WithField("serial", cert.Serial).
+		WithField("key_id", cert.KeyId).
+		WithField("hostnames", cert.ValidPrincipals).
+		WithField("ca", caName).
+		WithField("expires", time.Unix(int64(cert.ValidBefore), 0)).
+		WithField("pubkey_fp", ssh.FingerprintSHA256(pubKey)).
+		Info("issued host certificate")
+	auditCertificate(c, actx, cert)
+	return c.Blob(http.StatusOK, "text/plain", ssh.MarshalAuthorizedKey(cert))
+}
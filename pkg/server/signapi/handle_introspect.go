@@ -0,0 +1,93 @@
+package signapi
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+// Describe an auth token and what it entitles to. Invalid tokens are reported
+// as inactive rather than as an error, like in RFC 7662
+func (sa *SignApi) HandleIntrospect(c echo.Context) error {
+	var req objects.IntrospectRequest
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(&req); err != nil {
+			return err
+		}
+	}
+
+	var claims *SignClaim
+	if req.Token == "" {
+		if token, _ := c.Get("user").(*jwt.Token); token != nil {
+			claims, _ = token.Claims.(*SignClaim)
+		}
+		if claims == nil {
+			return errors.New("no auth context")
+		}
+	} else {
+		token, err := jwt.ParseWithClaims(req.Token, &SignClaim{}, sa.tokenKeyFunc)
+		if err != nil || !token.Valid {
+			return c.JSON(http.StatusOK, objects.IntrospectResponse{})
+		}
+		claims, _ = token.Claims.(*SignClaim)
+	}
+	actx := claims.AuthContext
+	if actx == nil {
+		return c.JSON(http.StatusOK, objects.IntrospectResponse{})
+	}
+
+	issued := time.Unix(claims.NotBefore, 0).UTC()
+	expires := time.Unix(claims.ExpiresAt, 0).UTC()
+	r := objects.IntrospectResponse{
+		Active:   true,
+		Complete: actx.IsValid(),
+		Subject:  actx.GetSubjectName(),
+		Audience: claims.Audience,
+		Issuer:   claims.Issuer,
+		Backends: actx.GetAuthenticators(),
+		IssuedAt: &issued,
+		Expires:  &expires,
+		Claims:   claims.Claims,
+	}
+	if r.Complete {
+		r.MissingBackends = sa.missingAuth(actx)
+		r.Complete = r.MissingBackends == nil
+	}
+	if !r.Complete {
+		return c.JSON(http.StatusOK, r)
+	}
+
+	// Entitlements as HandleSign would see them
+	if sa.principalMapper != nil {
+		ctx, ok := sa.principalMapper.Authorize(actx)
+		if !ok {
+			return c.JSON(http.StatusOK, r)
+		}
+		actx = ctx
+	}
+	defaultLife := sa.lifetimeLimits.defaultLifetime(actx, sa.defaultCertLife)
+	maxLife := sa.maxCertLife
+	if sa.policy != nil {
+		tmpl, err := sa.policy.Lookup(actx)
+		if err != nil {
+			// Signing would be denied
+			return c.JSON(http.StatusOK, r)
+		}
+		defaultLife, maxLife = tmpl.Lifetimes(defaultLife, maxLife)
+		r.Policy = tmpl.Name
+	}
+	r.Principals = actx.GetPrincipals()
+	r.CriticalOptions = actx.GetCriticalOptions()
+	r.Extensions = actx.GetExtensions()
+	defaultLife, minLife, maxLife := sa.lifetimeLimits.bounds(actx, defaultLife, maxLife)
+	r.DefaultCertLifetime = defaultLife.String()
+	r.MaxCertLifetime = maxLife.String()
+	if minLife > 0 {
+		r.MinCertLifetime = minLife.String()
+	}
+	return c.JSON(http.StatusOK, r)
+}
@@ -0,0 +1,19 @@
+package signapi
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Serve the OpenSSH KRL for sshd RevokedKeys
+func (sa *SignApi) HandleGetKRL(c echo.Context) error {
+	if sa.revocations == nil {
+		return echo.ErrNotFound
+	}
+	// Without CA keys the serial and key id revocations apply to any CA
+	cas, _ := sa.signer.GetPublicKeys()
+	k := sa.revocations.KRL(cas...)
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	return c.Blob(http.StatusOK, "application/octet-stream", k.Marshal())
+}
@@ -1,11 +1,15 @@
 package signapi
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/aakso/ssh-inscribe/pkg/tracing"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
@@ -13,12 +17,20 @@ import (
 
 const (
 	MaxAuthContextChainLength = 8
+
+	negotiateScheme = "Negotiate"
+	bearerScheme    = "Bearer"
+
+	// Pages of the backends only run their own inline script and post to us
+	authPageContentSecurityPolicy = "default-src 'none'; script-src 'unsafe-inline'; " +
+		"style-src 'unsafe-inline'; connect-src 'self'; form-action 'none'; frame-ancestors 'none'"
 )
 
 func (sa *SignApi) LoginUserPasswordAuthSkipper(c echo.Context) bool {
 	name, _ := url.PathUnescape(c.Param("name"))
-	if ab, ok := sa.auth[name]; ok {
-		if ab.CredentialType() == auth.CredentialFederated {
+	if ab, ok := sa.lookupBackend(c, name); ok {
+		switch ab.CredentialType() {
+		case auth.CredentialFederated, auth.CredentialNegotiate, auth.CredentialClientCert, auth.CredentialBearerToken:
 			return true
 		}
 	}
@@ -27,11 +39,19 @@ func (sa *SignApi) LoginUserPasswordAuthSkipper(c echo.Context) bool {
 
 func (sa *SignApi) HandleLogin(c echo.Context) error {
 	var parentCtx *auth.AuthContext
-	name, _ := url.PathUnescape(c.Param("name"))
-	ab, ok := sa.auth[name]
+	endpoint, _ := url.PathUnescape(c.Param("name"))
+	ab, ok := sa.lookupBackend(c, endpoint)
 	if !ok {
 		return echo.ErrNotFound
 	}
+	name := ab.Name()
+	if sa.backends.isDisabled(name) {
+		return newProblem(http.StatusServiceUnavailable, objects.ErrorAuthBackendDisabled, "auth backend is disabled")
+	}
+	if reason := sa.backendRefused(c, name); reason != "" {
+		requestLog(c).WithField("authenticator", name).WithField("reason", reason).Warn("auth backend not allowed for the client")
+		return backendNotAllowed(endpoint, reason)
+	}
 
 	if token, _ := c.Get("user").(*jwt.Token); token != nil {
 		if claims, _ := token.Claims.(*SignClaim); claims != nil {
@@ -45,6 +65,10 @@ func (sa *SignApi) HandleLogin(c echo.Context) error {
 
 	user, _ := c.Get("username").(string)
 	pw, _ := c.Get("password").(string)
+	lockoutID := lockoutUserID(user, parentCtx)
+	if err := sa.checkLockout(c, ab.Name(), lockoutID); err != nil {
+		return err
+	}
 	creds := &auth.Credentials{
 		UserIdentifier: user,
 		Secret:         []byte(pw),
@@ -52,13 +76,86 @@ func (sa *SignApi) HandleLogin(c echo.Context) error {
 			auth.MetaAuditID: c.Response().Header().Get(echo.HeaderXRequestID),
 		},
 	}
-	actx, ok := ab.Authenticate(parentCtx, creds)
+	if ab.CredentialType() == auth.CredentialNegotiate {
+		token, err := negotiateToken(c.Request().Header.Get(echo.HeaderAuthorization))
+		if err != nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, negotiateScheme)
+			return echo.ErrUnauthorized
+		}
+		creds.Secret = token
+	}
+	if ab.CredentialType() == auth.CredentialBearerToken {
+		token, err := bearerToken(c.Request().Header.Get(echo.HeaderAuthorization))
+		if err != nil {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, bearerScheme)
+			return echo.ErrUnauthorized
+		}
+		creds.Secret = token
+	}
+	if ab.CredentialType() == auth.CredentialClientCert {
+		// Verified by the backend against its own CAs
+		state := c.Request().TLS
+		if state == nil || len(state.PeerCertificates) == 0 {
+			return echo.NewHTTPError(http.StatusUnauthorized, "client certificate required")
+		}
+		var chain []byte
+		for _, cert := range state.PeerCertificates {
+			chain = append(chain, cert.Raw...)
+		}
+		creds.Secret = chain
+	}
+	// Federated backends complete the pending auth context of the parent
+	completing := parentCtx != nil && parentCtx.Status == auth.StatusPending && parentCtx.Authenticator == ab.Name()
+	_, span := tracing.Start(c.Request().Context(), "auth.authenticate")
+	span.SetAttribute("auth.backend", ab.Name())
+	actx, ok, err := sa.authenticate(c, ab, parentCtx, creds)
+	span.SetAttribute("auth.success", ok)
+	span.End()
+	if err != nil {
+		return err
+	}
 	if !ok {
+		setLogIdentity(c, user, ab.Name())
+		metricAuthAttempts.WithLabelValues(ab.Name(), "failure").Inc()
+		auditAuthentication(c, ab.Name(), user, parentCtx, false)
+		if sa.backendFailed(ab.Name(), creds) {
+			// Most likely failed because of the backend, not the credentials
+			return newProblem(http.StatusServiceUnavailable, objects.ErrorAuthBackendDown, "auth backend is down")
+		}
+		// The password was right, tell the user what to do instead of
+		// counting it as a failure
+		switch creds.Meta[auth.MetaPasswordFailure] {
+		case auth.PasswordExpired:
+			return newProblem(http.StatusForbidden, objects.ErrorPasswordExpired, "password has expired, change it before logging in")
+		case auth.PasswordMustChange:
+			return newProblem(http.StatusForbidden, objects.ErrorPasswordMustChange, "password must be changed before logging in")
+		case auth.MFAEnrollRequired:
+			return newProblem(http.StatusForbidden, objects.ErrorMFAEnrollRequired, "enroll a second factor before logging in")
+		}
+		sa.loginFailed(c, ab.Name(), lockoutID)
 		return echo.ErrUnauthorized
 	}
+	if actx.Status == auth.StatusCompleted {
+		sa.loginSucceeded(ab.Name(), lockoutID)
+		if expires := actx.GetMetaString(auth.MetaPasswordExpires); expires != "" && actx.Authenticator == ab.Name() {
+			c.Response().Header().Set(objects.PasswordExpiresHeader, expires)
+		}
+	}
+	if actx.Status == auth.StatusCompleted && actx.Authenticator == ab.Name() && (actx != parentCtx || completing) {
+		if err := sa.rewritePrincipals(actx); err != nil {
+			return errors.Wrapf(err, "cannot rewrite principals of %s", ab.Name())
+		}
+	}
+	metricAuthAttempts.WithLabelValues(ab.Name(), "success").Inc()
+	auditAuthentication(c, ab.Name(), user, actx, true)
+	setLogIdentity(c, actx.GetSubjectName(), strings.Join(actx.GetAuthenticators(), ","))
 
 	token := sa.makeToken(actx)
-	signed, err := token.SignedString(sa.tkey)
+	// Later requests with the token see the backends the login saw
+	claims := token.Claims.(SignClaim)
+	claims.ClientAudience, claims.ClientRealm = clientScope(c)
+	token.Claims = claims
+	signed, err := sa.tkeys.sign(token)
 	if err != nil {
 		return errors.Wrap(err, "cannot sign token")
 	}
@@ -66,17 +163,49 @@ func (sa *SignApi) HandleLogin(c echo.Context) error {
 	if actx.Status == auth.StatusPending {
 		// Federated login redirect
 		if redirectURL := actx.GetMetaString(auth.MetaFederationAuthURL); redirectURL != "" {
+			// Browser clients cannot read the location of a redirect they
+			// follow, let them ask for 202 instead
+			status := http.StatusSeeOther
+			if c.QueryParam("redirect") == "false" {
+				status = http.StatusAccepted
+			}
 			c.Response().Header().Set(echo.HeaderContentType, "application/jwt")
 			c.Response().Header().Set(echo.HeaderLocation, redirectURL)
-			c.Response().WriteHeader(http.StatusSeeOther)
+			if code := actx.GetMetaString(auth.MetaFederationUserCode); code != "" {
+				c.Response().Header().Set(objects.FederationUserCodeHeader, code)
+			}
+			c.Response().WriteHeader(status)
 			_, err := fmt.Fprint(c.Response().Writer, signed)
 			return err
 		}
+		// Challenge-response, the client answers with the pending token
+		if challenge := actx.GetMetaString(auth.MetaChallenge); challenge != "" {
+			c.Response().Header().Set(objects.AuthChallengeHeader, challenge)
+			return c.Blob(http.StatusAccepted, "application/jwt", []byte(signed))
+		}
 	}
 
 	return c.Blob(http.StatusOK, "application/jwt", []byte(signed))
 }
 
+// SPNEGO token of an "Authorization: Negotiate" header (RFC 4559)
+func negotiateToken(header string) ([]byte, error) {
+	prefix := negotiateScheme + " "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return nil, errors.New("missing negotiate token")
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+}
+
+// Token of an "Authorization: Bearer" header (RFC 6750)
+func bearerToken(header string) ([]byte, error) {
+	prefix := bearerScheme + " "
+	if len(header) <= len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return nil, errors.New("missing bearer token")
+	}
+	return []byte(strings.TrimSpace(header[len(prefix):])), nil
+}
+
 func (sa *SignApi) HandleAuthCallback(c echo.Context) error {
 	name, _ := url.PathUnescape(c.Param("name"))
 	ab, ok := sa.auth[name]
@@ -88,6 +217,9 @@ func (sa *SignApi) HandleAuthCallback(c echo.Context) error {
 	if !ok {
 		return echo.ErrNotFound
 	}
+	if sa.backends.isDisabled(name) {
+		return newProblem(http.StatusServiceUnavailable, objects.ErrorAuthBackendDisabled, "auth backend is disabled")
+	}
 
 	params, err := c.FormParams()
 	if err != nil {
@@ -100,3 +232,28 @@ func (sa *SignApi) HandleAuthCallback(c echo.Context) error {
 
 	return c.String(http.StatusOK, "Authentication successful, you can close the window now")
 }
+
+// Page of a backend running the login in the browser, the federated auth URL
+// of backends like WebAuthn
+func (sa *SignApi) HandleAuthPage(c echo.Context) error {
+	name, _ := url.PathUnescape(c.Param("name"))
+	ab, ok := sa.auth[name]
+	if !ok {
+		return echo.ErrNotFound
+	}
+	pa, ok := ab.(auth.PageAuthenticator)
+	if !ok {
+		return echo.ErrNotFound
+	}
+	if sa.backends.isDisabled(name) {
+		return newProblem(http.StatusServiceUnavailable, objects.ErrorAuthBackendDisabled, "auth backend is disabled")
+	}
+	page, err := pa.Page(c.QueryParams())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	h := c.Response().Header()
+	h.Set("Content-Security-Policy", authPageContentSecurityPolicy)
+	h.Set("X-Frame-Options", "DENY")
+	return c.HTML(http.StatusOK, page)
+}
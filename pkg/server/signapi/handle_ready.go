@@ -7,6 +7,9 @@ import (
 )
 
 func (sa *SignApi) HandleReady(c echo.Context) error {
+	if sa.upstream != nil {
+		return sa.upstream.forward(c, "ready")
+	}
 	if !sa.signer.Ready() {
 		return echo.NewHTTPError(http.StatusInternalServerError, "signing service is not ready for signing")
 	}
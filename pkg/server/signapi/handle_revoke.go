@@ -0,0 +1,158 @@
+package signapi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/revocation"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Self-service revocation. The request body is a certificate issued to the
+// authenticated user
+func (sa *SignApi) HandleRevoke(c echo.Context) error {
+	if sa.revocations == nil {
+		return echo.ErrNotFound
+	}
+	var actx *auth.AuthContext
+	if token, _ := c.Get("user").(*jwt.Token); token != nil {
+		if claims, _ := token.Claims.(*SignClaim); claims != nil {
+			actx = claims.AuthContext
+		}
+	}
+	if actx == nil {
+		return errors.New("no auth context")
+	}
+	if !actx.IsValid() {
+		return echo.NewHTTPError(http.StatusBadRequest, "auth context is not valid")
+	}
+
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		err = errors.Wrap(err, "cannot read certificate")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(body)
+	if err != nil {
+		err = errors.Wrap(err, "cannot parse certificate")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	cert, _ := key.(*ssh.Certificate)
+	if cert == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "not a certificate")
+	}
+
+	// Only certificates issued by one of our CA keys to the same subject can
+	// be revoked
+	cas, err := sa.signer.GetPublicKeys()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	issued := false
+	for _, ca := range cas {
+		if bytes.Equal(cert.SignatureKey.Marshal(), ca.Marshal()) {
+			issued = true
+			break
+		}
+	}
+	if !issued {
+		return echo.NewHTTPError(http.StatusForbidden, "certificate is not issued by this CA")
+	}
+	// Verifies the signature and validity period
+	var principal string
+	if len(cert.ValidPrincipals) > 0 {
+		principal = cert.ValidPrincipals[0]
+	}
+	checker := &ssh.CertChecker{}
+	for k := range cert.CriticalOptions {
+		checker.SupportedCriticalOptions = append(checker.SupportedCriticalOptions, k)
+	}
+	if err := checker.CheckCert(principal, cert); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "invalid certificate").Error())
+	}
+	if sa.certSubject(cert) != actx.GetSubjectName() {
+		return echo.NewHTTPError(http.StatusForbidden, "certificate is not issued to the current user")
+	}
+
+	entry := revocation.Entry{
+		Reason:    c.QueryParam("reason"),
+		RevokedBy: actx.GetSubjectName(),
+	}
+	if cert.Serial != 0 {
+		entry.Serial = cert.Serial
+	} else {
+		entry.KeyID = cert.KeyId
+	}
+	if cert.ValidBefore != ssh.CertTimeInfinity {
+		expires := time.Unix(int64(cert.ValidBefore), 0).UTC()
+		entry.Expires = &expires
+	}
+	return sa.revoke(c, entry)
+}
+
+func (sa *SignApi) HandleAdminRevoke(c echo.Context) error {
+	if sa.revocations == nil {
+		return echo.ErrNotFound
+	}
+	var actx *auth.AuthContext
+	if token, _ := c.Get("user").(*jwt.Token); token != nil {
+		if claims, _ := token.Claims.(*SignClaim); claims != nil {
+			actx = claims.AuthContext
+		}
+	}
+	if actx == nil {
+		return errors.New("no auth context")
+	}
+
+	req := new(objects.RevokeRequest)
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	entry := revocation.Entry{
+		Serial:      req.Serial,
+		KeyID:       req.KeyID,
+		Fingerprint: req.Fingerprint,
+		Reason:      req.Reason,
+		RevokedBy:   actx.GetSubjectName(),
+	}
+	// Entry can be pruned from the KRL once the certificate has expired
+	if sa.certs != nil && req.Serial != 0 {
+		if r, err := sa.certs.Get(req.Serial); err == nil {
+			entry.Expires = &r.ValidBefore
+		}
+	}
+	return sa.revoke(c, entry)
+}
+
+func (sa *SignApi) revoke(c echo.Context, entry revocation.Entry) error {
+	log := requestLog(c)
+	if err := sa.revocations.Revoke(entry); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, errors.Wrap(err, "cannot revoke").Error())
+	}
+	log.
+		WithField("serial", entry.Serial).
+		WithField("key_id", entry.KeyID).
+		WithField("fingerprint", entry.Fingerprint).
+		WithField("revoked_by", entry.RevokedBy).
+		WithField("reason", entry.Reason).
+		Info("revoked certificate")
+
+	ev := newAuditEvent(c, audit.EventCertificateRevoked)
+	ev.Success = true
+	ev.Subject = entry.RevokedBy
+	ev.Serial = entry.Serial
+	ev.KeyID = entry.KeyID
+	ev.PublicKeyFingerprint = entry.Fingerprint
+	ev.Reason = entry.Reason
+	audit.Record(ev)
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -2,12 +2,17 @@ package signapi
 
 import (
 	"io/ioutil"
+	"net"
 	"net/http"
 	"time"
 
 	"github.com/aakso/ssh-inscribe/pkg/auth/authz/authzfilter"
 
 	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/certdb"
+	"github.com/aakso/ssh-inscribe/pkg/policy"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/aakso/ssh-inscribe/pkg/tracing"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo/v4"
 	"github.com/pkg/errors"
@@ -24,11 +29,28 @@ func (sa *SignApi) HandleSign(c echo.Context) error {
 	if actx == nil {
 		return errors.New("no auth context")
 	}
-	log := Log.WithField("audit_id", actx.GetAuthMeta()[auth.MetaAuditID])
+	log := requestLog(c)
 
 	if !actx.IsValid() {
 		return echo.NewHTTPError(http.StatusBadRequest, "auth context is not valid")
 	}
+	if missing := sa.missingAuth(actx); missing != nil {
+		detail := missingAuthDetail(missing)
+		auditCertificateDenied(c, actx, nil, detail)
+		return newProblem(http.StatusForbidden, objects.ErrorAuthChainIncomplete, detail)
+	}
+	if err := sa.checkBackendConditions(c, actx); err != nil {
+		return err
+	}
+
+	if sa.principalMapper != nil {
+		ctx, ok := sa.principalMapper.Authorize(actx)
+		if !ok {
+			auditCertificateDenied(c, actx, nil, "no principals could be mapped")
+			return newProblem(http.StatusForbidden, objects.ErrorNoPrincipals, "no principals could be mapped for the user")
+		}
+		actx = ctx
+	}
 
 	// User requests to filter principals
 	principalsInclude := c.QueryParam("include_principals")
@@ -59,11 +81,54 @@ func (sa *SignApi) HandleSign(c echo.Context) error {
 	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(body)
 	if err != nil {
 		err = errors.Wrap(err, "cannot parse public key")
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return newProblem(http.StatusBadRequest, objects.ErrorInvalidPublicKey, err.Error())
 	}
 
 	cert := auth.MakeCertificate(pubKey, actx)
-	cert.ValidBefore = uint64(time.Now().Add(sa.defaultCertLife).Unix())
+	if err := sa.expandIdentity(actx, cert); err != nil {
+		log.WithError(err).Error("cannot expand identity variables")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot expand identity variables")
+	}
+
+	// Certificate policy
+	defaultLife := sa.lifetimeLimits.defaultLifetime(actx, sa.defaultCertLife)
+	maxLife := sa.maxCertLife
+	var policyName string
+	caName := c.QueryParam("ca")
+	if sa.policy != nil {
+		tmpl, err := sa.policy.Lookup(actx)
+		if err != nil {
+			log.WithField("subject", actx.GetSubjectName()).WithError(err).Warn("certificate policy denied signing")
+			auditCertificateDenied(c, actx, cert, err.Error())
+			return newProblem(http.StatusForbidden, objects.ErrorPolicyDenied, err.Error())
+		}
+		req := policy.Request{
+			Subject:     actx.GetSubjectName(),
+			ClientIP:    net.ParseIP(c.RealIP()),
+			AuthContext: actx,
+		}
+		if err := tmpl.Apply(cert, req); err != nil {
+			log.WithField("policy", tmpl.Name).WithError(err).Warn("certificate policy denied signing")
+			c.Set(ctxPolicy, tmpl.Name)
+			auditCertificateDenied(c, actx, cert, err.Error())
+			return newProblem(http.StatusForbidden, objects.ErrorPolicyDenied, err.Error())
+		}
+		defaultLife, maxLife = tmpl.Lifetimes(defaultLife, maxLife)
+		policyName = tmpl.Name
+		c.Set(ctxPolicy, policyName)
+		if caName, err = tmpl.SelectCA(caName); err != nil {
+			auditCertificateDenied(c, actx, cert, err.Error())
+			return newProblem(http.StatusForbidden, objects.ErrorPolicyDenied, err.Error())
+		}
+	}
+	if caName, err = sa.checkCA(caName); err != nil {
+		return err
+	}
+	c.Set(ctxCA, caName)
+	// Per backend and per group limits
+	defaultLife, minLife, maxLife := sa.lifetimeLimits.bounds(actx, defaultLife, maxLife)
+
+	cert.ValidBefore = uint64(time.Now().Add(defaultLife).Unix())
 	// Validity
 	if exp := c.QueryParam("expires"); exp != "" {
 		ts, err := time.Parse(time.RFC3339, exp)
@@ -71,18 +136,75 @@ func (sa *SignApi) HandleSign(c echo.Context) error {
 			err = errors.Wrap(err, "invalid expires")
 			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 		}
-		if time.Until(ts) > sa.maxCertLife {
-			return echo.NewHTTPError(http.StatusBadRequest, errors.Errorf("maxmimum lifetime is %s", sa.maxCertLife).Error())
+		if time.Until(ts) > maxLife {
+			if !sa.lifetimeLimits.clampEnabled() {
+				err := errors.Errorf("requested lifetime exceeds the maximum of %s allowed for the user", maxLife)
+				auditCertificateDenied(c, actx, cert, err.Error())
+				return newProblem(http.StatusBadRequest, objects.ErrorLifetimeExceeded, err.Error())
+			}
+			log.WithField("requested", ts).WithField("max_lifetime", maxLife).Info("clamping requested certificate lifetime")
+			ts = time.Now().Add(maxLife)
+		}
+		if time.Until(ts) < minLife {
+			if !sa.lifetimeLimits.clampEnabled() {
+				err := errors.Errorf("requested lifetime is below the minimum of %s required for the user", minLife)
+				auditCertificateDenied(c, actx, cert, err.Error())
+				return newProblem(http.StatusBadRequest, objects.ErrorLifetimeTooShort, err.Error())
+			}
+			log.WithField("requested", ts).WithField("min_lifetime", minLife).Info("clamping requested certificate lifetime")
+			ts = time.Now().Add(minLife)
 		}
 		cert.ValidBefore = uint64(ts.Unix())
 	}
 
-	if err := sa.signer.SignCertificate(cert); err != nil {
+	if err := sa.checkPolicyHook(c, actx, cert, caName); err != nil {
+		return err
+	}
+	if err := sa.checkDeniedPrincipals(c, actx, cert); err != nil {
+		return err
+	}
+	if err := sa.checkBackendPrincipals(c, actx, cert); err != nil {
+		return err
+	}
+	if err := sa.checkIssuanceWindows(c, actx, cert); err != nil {
+		return err
+	}
+	if err := sa.checkStepUp(c, actx, cert); err != nil {
+		return err
+	}
+	if sa.revocations != nil && sa.revocations.IsRevoked(cert) {
+		auditCertificateDenied(c, actx, cert, "public key or key id has been revoked")
+		return newProblem(http.StatusForbidden, objects.ErrorKeyRevoked, "public key or key id has been revoked")
+	}
+
+	if ok, err := sa.checkApproval(c, actx, cert, caName); !ok {
+		return err
+	}
+	if err := sa.checkQuota(c, actx, cert); err != nil {
+		return err
+	}
+	if err := sa.consumeToken(c); err != nil {
+		return err
+	}
+
+	// Allocated last so that denied requests do not use up serials
+	if cert.Serial, err = sa.nextSerial(); err != nil {
+		log.WithError(err).Error("cannot allocate certificate serial")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot allocate certificate serial")
+	}
+	if err := sa.signCertificate(c, actx, caName, cert); err != nil {
 		err = errors.Wrap(err, "cannot sign")
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
+	if err := sa.recordCertificate(c, actx, cert); err != nil {
+		log.WithError(err).Error("cannot record issued certificate")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot record issued certificate")
+	}
 	log.
+		WithField("serial", cert.Serial).
 		WithField("key_id", cert.KeyId).
+		WithField("policy", policyName).
+		WithField("ca", caName).
 		WithField("principals", cert.ValidPrincipals).
 		WithField("critical_options", cert.CriticalOptions).
 		WithField("extensions", cert.Extensions).
@@ -91,5 +213,44 @@ func (sa *SignApi) HandleSign(c echo.Context) error {
 		WithField("pubkey_fp", ssh.FingerprintSHA256(pubKey)).
 		WithField("pubkey_fp_md5", ssh.FingerprintLegacyMD5(pubKey)).
 		Info("issued certificate")
+	auditCertificate(c, actx, cert)
 	return c.Blob(http.StatusOK, "text/plain", ssh.MarshalAuthorizedKey(cert))
 }
+
+func (sa *SignApi) recordCertificate(c echo.Context, actx *auth.AuthContext, cert *ssh.Certificate) error {
+	if sa.certs == nil {
+		return nil
+	}
+	r := certdb.NewRecord(cert, sa.storeCerts)
+	r.Subject = actx.GetSubjectName()
+	r.Authenticators = actx.GetAuthenticators()
+	r.AuditID = c.Response().Header().Get(echo.HeaderXRequestID)
+	r.RemoteAddress = c.RealIP()
+	return sa.certs.Put(r)
+}
+
+// Sign with the CA key on the agent or on the upstream instance. Traced
+// separately as signing with a hardware backed key may dominate the request
+// latency
+func (sa *SignApi) signCertificate(c echo.Context, actx *auth.AuthContext, caName string, cert *ssh.Certificate) error {
+	if removed := sa.extensionLimits.apply(actx, cert); len(removed) > 0 {
+		requestLog(c).
+			WithField("subject", actx.GetSubjectName()).
+			WithField("extensions", removed).
+			Info("removed extensions not allowed for the user")
+	}
+	if sa.upstream != nil {
+		_, span := tracing.Start(c.Request().Context(), "upstream.sign")
+		defer span.End()
+		span.SetAttribute("ca", caName)
+		err := sa.upstream.sign(c, actx, caName, cert)
+		span.SetError(err)
+		return err
+	}
+	_, span := tracing.Start(c.Request().Context(), "keysigner.sign")
+	defer span.End()
+	span.SetAttribute("ca", caName)
+	err := sa.signer.SignCertificateWith(caName, cert)
+	span.SetError(err)
+	return err
+}
@@ -0,0 +1,215 @@
+package signapi
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricBackendUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ssh_inscribe_auth_backend_up",
+			Help: "Whether the last health check of the auth backend succeeded",
+		},
+		[]string{"backend"},
+	)
+	metricBackendProbeSeconds = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "ssh_inscribe_auth_backend_probe_duration_seconds",
+			Help: "Duration of the last health check of the auth backend",
+		},
+		[]string{"backend"},
+	)
+)
+
+// Result of the last health check of a backend
+type backendHealth struct {
+	up      bool
+	err     string
+	checked time.Time
+	// Since the backend went up or down
+	since    time.Time
+	duration time.Duration
+}
+
+// Periodic health checks of the auth backends supporting probes
+type healthChecks struct {
+	interval time.Duration
+	timeout  time.Duration
+
+	mu      sync.RWMutex
+	results map[string]backendHealth
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// Probe the backends supporting it every interval, or never if zero. A
+// probe not returning within the timeout counts as failed
+func (sa *SignApi) SetHealthChecks(interval, timeout time.Duration) error {
+	if interval < 0 || timeout < 0 || (interval > 0 && timeout == 0) {
+		return errors.New("invalid health check interval or timeout")
+	}
+	sa.health = &healthChecks{
+		interval: interval,
+		timeout:  timeout,
+		results:  map[string]backendHealth{},
+		stop:     make(chan struct{}),
+	}
+	return nil
+}
+
+// Start the health checks in the background. They run until Close
+func (sa *SignApi) StartHealthChecks() {
+	h := sa.health
+	if h == nil || h.interval == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			sa.checkHealth()
+			select {
+			case <-ticker.C:
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (sa *SignApi) stopHealthChecks() {
+	if h := sa.health; h != nil {
+		h.once.Do(func() { close(h.stop) })
+	}
+}
+
+// Probe all the backends concurrently and record the results
+func (sa *SignApi) checkHealth() {
+	var wg sync.WaitGroup
+	for _, e := range sa.authList {
+		p, ok := e.Authenticator.(auth.Prober)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(name string, p auth.Prober) {
+			defer wg.Done()
+			start := time.Now()
+			err := probeTimeout(p, sa.health.timeout)
+			sa.health.record(name, start, err)
+		}(e.Authenticator.Name(), p)
+	}
+	wg.Wait()
+}
+
+func probeTimeout(p auth.Prober, timeout time.Duration) error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- p.Probe()
+	}()
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(timeout):
+		return errors.Errorf("no response in %s", timeout)
+	}
+}
+
+func (h *healthChecks) record(name string, start time.Time, err error) {
+	now := time.Now()
+	r := backendHealth{
+		up:       err == nil,
+		checked:  now.UTC(),
+		since:    now.UTC(),
+		duration: now.Sub(start),
+	}
+	if err != nil {
+		r.err = err.Error()
+	}
+	h.mu.Lock()
+	prev, seen := h.results[name]
+	if seen && prev.up == r.up {
+		r.since = prev.since
+	}
+	h.results[name] = r
+	h.mu.Unlock()
+
+	up := 0.0
+	if r.up {
+		up = 1
+	}
+	metricBackendUp.WithLabelValues(name).Set(up)
+	metricBackendProbeSeconds.WithLabelValues(name).Set(r.duration.Seconds())
+	if r.up != prev.up || !seen {
+		log := Log.WithField("authenticator", name)
+		if r.up {
+			log.Info("auth backend is up")
+		} else {
+			log.WithField("error", r.err).Warn("auth backend is down")
+		}
+	}
+}
+
+// Result of the last health check, false if the backend has not been
+// checked
+func (sa *SignApi) backendHealth(name string) (backendHealth, bool) {
+	if sa.health == nil {
+		return backendHealth{}, false
+	}
+	sa.health.mu.RLock()
+	defer sa.health.mu.RUnlock()
+	r, ok := sa.health.results[name]
+	return r, ok
+}
+
+// Whether the last health check of the backend failed
+func (sa *SignApi) backendDown(name string) bool {
+	r, ok := sa.backendHealth(name)
+	return ok && !r.up
+}
+
+func (r backendHealth) object(name string, admin bool) *objects.BackendHealth {
+	o := &objects.BackendHealth{
+		Name:     name,
+		Status:   r.status(),
+		Checked:  r.checked,
+		Since:    r.since,
+		Duration: r.duration.String(),
+	}
+	if admin {
+		o.Error = r.err
+	}
+	return o
+}
+
+func (r backendHealth) status() string {
+	if r.up {
+		return objects.HealthUp
+	}
+	return objects.HealthDown
+}
+
+// Health of the enabled backends. The probe errors are left out as they may
+// reveal internal addresses, admins get them from the backend status
+func (sa *SignApi) HandleHealth(c echo.Context) error {
+	r := []*objects.BackendHealth{}
+	for _, e := range sa.authList {
+		name := e.Authenticator.Name()
+		if sa.backends.isDisabled(name) {
+			continue
+		}
+		if h, ok := sa.backendHealth(name); ok {
+			r = append(r, h.object(name, false))
+		}
+	}
+	return c.JSON(http.StatusOK, r)
+}
@@ -0,0 +1,86 @@
+package signapi
+
+import (
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+)
+
+type HostSignConfig struct {
+	// Principal patterns of users allowed to request host certificates in
+	// addition to admins
+	RequesterPrincipals []string
+	// Requested hostnames must match any of these patterns
+	Hostnames       []string
+	DefaultLifetime time.Duration
+	MaxLifetime     time.Duration
+	// Maximum lifetime of the bootstrap tokens minted by admins
+	BootstrapTokenMaxTTL time.Duration
+}
+
+type hostSigning struct {
+	requesters      []glob.Glob
+	hostnames       []glob.Glob
+	defaultLifetime time.Duration
+	maxLifetime     time.Duration
+	tokenMaxTTL     time.Duration
+}
+
+func compileGlobs(patterns []string) ([]glob.Glob, error) {
+	globs := make([]glob.Glob, 0, len(patterns))
+	for _, p := range patterns {
+		g, err := glob.Compile(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", p)
+		}
+		globs = append(globs, g)
+	}
+	return globs, nil
+}
+
+func matchAny(globs []glob.Glob, s string) bool {
+	for _, g := range globs {
+		if g.Match(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Enable host certificate signing endpoint
+func (sa *SignApi) EnableHostSigning(conf HostSignConfig) error {
+	requesters, err := compileGlobs(conf.RequesterPrincipals)
+	if err != nil {
+		return errors.Wrap(err, "invalid host signing requester principals")
+	}
+	hostnames, err := compileGlobs(conf.Hostnames)
+	if err != nil {
+		return errors.Wrap(err, "invalid host signing hostnames")
+	}
+	if conf.DefaultLifetime > conf.MaxLifetime {
+		return errors.New("default host certificate lifetime exceeds maximum")
+	}
+	sa.hostSigning = &hostSigning{
+		requesters:      requesters,
+		hostnames:       hostnames,
+		defaultLifetime: conf.DefaultLifetime,
+		maxLifetime:     conf.MaxLifetime,
+		tokenMaxTTL:     conf.BootstrapTokenMaxTTL,
+	}
+	return nil
+}
+
+func (hs *hostSigning) allowedRequester(actx *auth.AuthContext) bool {
+	for _, p := range actx.GetPrincipals() {
+		if matchAny(hs.requesters, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (hs *hostSigning) allowedHostname(name string) bool {
+	return matchAny(hs.hostnames, name)
+}
@@ -0,0 +1,296 @@
+package signapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/gobwas/glob"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Time of day range on the given weekdays. The range wraps over midnight if
+// End is before Start
+type TimeWindow struct {
+	// Every day if empty
+	Days []time.Weekday
+	// Offsets from midnight
+	Start time.Duration
+	End   time.Duration
+}
+
+// External check consulted outside the time windows, e.g. an on-call
+// schedule. The request is signed like the audit webhooks
+type IssuanceWebhook struct {
+	URL     string
+	Secret  []byte
+	Headers map[string]string
+	Timeout time.Duration
+}
+
+// Principals only issued during the time windows or when the webhook allows
+type IssuanceWindow struct {
+	Principals []string
+	Location   *time.Location
+	Windows    []TimeWindow
+	Webhook    *IssuanceWebhook
+}
+
+// Sent to the issuance webhook
+type IssuanceCheckRequest struct {
+	Subject        string    `json:"subject"`
+	Principal      string    `json:"principal"`
+	Authenticators []string  `json:"authenticators"`
+	Time           time.Time `json:"time"`
+}
+
+// Expected from the issuance webhook
+type IssuanceCheckResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+type issuanceWindow struct {
+	IssuanceWindow
+	principals []glob.Glob
+	client     *http.Client
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Parse a time window from weekday names (mon, tue, ...) and HH:MM times.
+// An end of 24:00 is accepted for the end of the day
+func ParseTimeWindow(days []string, start, end string) (w TimeWindow, err error) {
+	for _, d := range days {
+		wd, ok := weekdays[strings.ToLower(d)[:min(3, len(d))]]
+		if !ok {
+			return w, errors.Errorf("invalid weekday %q", d)
+		}
+		w.Days = append(w.Days, wd)
+	}
+	if w.Start, err = parseTimeOfDay(start); err != nil {
+		return w, err
+	}
+	if end == "24:00" {
+		w.End = 24 * time.Hour
+	} else if w.End, err = parseTimeOfDay(end); err != nil {
+		return w, err
+	}
+	if w.Start == w.End {
+		return w, errors.New("time window start and end are equal")
+	}
+	return w, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (w TimeWindow) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	day := t.Weekday()
+	if w.End < w.Start {
+		// Past midnight the window belongs to the previous day
+		if offset < w.End {
+			return w.onDay((day + 6) % 7)
+		}
+		return offset >= w.Start && w.onDay(day)
+	}
+	return offset >= w.Start && offset < w.End && w.onDay(day)
+}
+
+func (w TimeWindow) onDay(d time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, v := range w.Days {
+		if v == d {
+			return true
+		}
+	}
+	return false
+}
+
+func (w TimeWindow) String() string {
+	var days []string
+	for _, d := range w.Days {
+		days = append(days, d.String()[:3])
+	}
+	hhmm := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	s := hhmm(w.Start) + "-" + hhmm(w.End)
+	if len(days) > 0 {
+		s = strings.Join(days, ",") + " " + s
+	}
+	return s
+}
+
+// Restrict issuing the matching principals to the time windows. A principal
+// must be allowed by every matching rule
+func (sa *SignApi) SetIssuanceWindows(conf []IssuanceWindow) error {
+	var windows []*issuanceWindow
+	for _, v := range conf {
+		principals, err := compileGlobs(v.Principals)
+		if err != nil {
+			return errors.Wrap(err, "invalid issuance window principals")
+		}
+		if len(v.Windows) == 0 && v.Webhook == nil {
+			return errors.Errorf("issuance window for %v has no time windows or webhook", v.Principals)
+		}
+		w := &issuanceWindow{IssuanceWindow: v, principals: principals}
+		if w.Location == nil {
+			w.Location = time.Local
+		}
+		if v.Webhook != nil {
+			if v.Webhook.URL == "" {
+				return errors.New("issuance webhook url is not set")
+			}
+			w.client = &http.Client{Timeout: v.Webhook.Timeout}
+		}
+		windows = append(windows, w)
+	}
+	sa.issuanceWindows = windows
+	return nil
+}
+
+// Check whether the principal may be issued now. Returns the denial reason
+func (w *issuanceWindow) check(actx *auth.AuthContext, principal string, now time.Time) (string, error) {
+	local := now.In(w.Location)
+	for _, tw := range w.Windows {
+		if tw.contains(local) {
+			return "", nil
+		}
+	}
+	var reason string
+	if len(w.Windows) > 0 {
+		var s []string
+		for _, tw := range w.Windows {
+			s = append(s, tw.String())
+		}
+		reason = fmt.Sprintf("principal %q is only issued during %s %s", principal, strings.Join(s, ", "), w.Location)
+	}
+	if w.Webhook == nil {
+		return reason, nil
+	}
+	r, err := w.callWebhook(IssuanceCheckRequest{
+		Subject:        actx.GetSubjectName(),
+		Principal:      principal,
+		Authenticators: actx.GetAuthenticators(),
+		Time:           now.UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+	if r.Allowed {
+		return "", nil
+	}
+	if r.Reason != "" {
+		return fmt.Sprintf("principal %q is not allowed: %s", principal, r.Reason), nil
+	}
+	if reason == "" {
+		reason = fmt.Sprintf("principal %q is not allowed at this time", principal)
+	}
+	return reason, nil
+}
+
+func (w *issuanceWindow) callWebhook(ir IssuanceCheckRequest) (*IssuanceCheckResponse, error) {
+	data, _ := json.Marshal(ir)
+	req, err := http.NewRequest(http.MethodPost, w.Webhook.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create request")
+	}
+	for k, v := range w.Webhook.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if len(w.Webhook.Secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(audit.WebhookTimestampHeader, ts)
+		req.Header.Set(audit.WebhookSignatureHeader, "sha256="+audit.WebhookSignature(w.Webhook.Secret, ts, data))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "issuance webhook request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("issuance webhook returned %s", resp.Status)
+	}
+	var r IssuanceCheckResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, errors.Wrap(err, "invalid issuance webhook response")
+	}
+	return &r, nil
+}
+
+// Remove the principals outside their issuance windows. Signing is refused
+// with the reasons if no principals remain
+func (sa *SignApi) checkIssuanceWindows(c echo.Context, actx *auth.AuthContext, cert *ssh.Certificate) error {
+	if len(sa.issuanceWindows) == 0 {
+		return nil
+	}
+	log := requestLog(c).
+		WithField("subject", actx.GetSubjectName())
+	now := time.Now()
+	var allowed, reasons []string
+	for _, p := range cert.ValidPrincipals {
+		var reason string
+		for _, w := range sa.issuanceWindows {
+			if !matchAny(w.principals, p) {
+				continue
+			}
+			r, err := w.check(actx, p, now)
+			if err != nil {
+				log.WithError(err).WithField("principal", p).Error("cannot check issuance window")
+				r = fmt.Sprintf("principal %q cannot be checked: issuance check failed", p)
+			}
+			if r != "" {
+				reason = r
+				break
+			}
+		}
+		if reason == "" {
+			allowed = append(allowed, p)
+			continue
+		}
+		log.WithField("principal", p).WithField("reason", reason).Info("removed principal outside its issuance window")
+		reasons = append(reasons, reason)
+	}
+	if len(allowed) == 0 && len(reasons) > 0 {
+		msg := strings.Join(reasons, "; ")
+		auditCertificateDenied(c, actx, cert, msg)
+		return newProblem(http.StatusForbidden, objects.ErrorOutsideIssuanceWindow, msg)
+	}
+	cert.ValidPrincipals = allowed
+	return nil
+}
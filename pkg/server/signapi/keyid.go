@@ -0,0 +1,66 @@
+package signapi
+
+import (
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Set the key id of user certificates from a format with identity variables,
+// e.g. "%u via %{backend} dept=%{ldap.department}". The default key id is
+// used if empty
+func (sa *SignApi) SetKeyIDFormat(format string) error {
+	if err := auth.CheckVariables(format); err != nil {
+		return errors.Wrap(err, "invalid key id format")
+	}
+	sa.keyIDFormat = format
+	return nil
+}
+
+// Set vendor extensions of user certificates from formats with identity
+// variables, e.g. "employee-id@example.com": "%{identity.employee_id}"
+func (sa *SignApi) SetIdentityExtensions(formats map[string]string) error {
+	if err := auth.CheckExtensions(formats); err != nil {
+		return errors.Wrap(err, "invalid identity extensions")
+	}
+	sa.identityExts = formats
+	return nil
+}
+
+// Expand the key id format and the identity extensions. The principals are
+// left as is, identity variables in them are expanded by the principal
+// mapping rules
+func (sa *SignApi) expandIdentity(actx *auth.AuthContext, cert *ssh.Certificate) error {
+	if sa.keyIDFormat != "" {
+		kid, err := auth.Expand(sa.keyIDFormat, actx)
+		if err != nil {
+			return errors.Wrap(err, "cannot expand key id")
+		}
+		cert.KeyId = kid
+	}
+	return auth.ExpandExtensions(sa.identityExts, actx, cert)
+}
+
+// Self-service revocation matches the certificate to the user by the
+// subject in the default key id. Custom key ids from the key id format or
+// the policy templates need the certificate database for the lookup
+func (sa *SignApi) CheckSelfRevocation() error {
+	if sa.revocations == nil || sa.certs != nil {
+		return nil
+	}
+	if sa.keyIDFormat != "" || (sa.policy != nil && sa.policy.SetsKeyID()) {
+		return errors.New("revocation with a custom key id requires the certificate database")
+	}
+	return nil
+}
+
+// Subject the certificate was issued to. Looked up from the certificate
+// database if enabled as custom key id formats do not carry the subject
+func (sa *SignApi) certSubject(cert *ssh.Certificate) string {
+	if sa.certs != nil && cert.Serial != 0 {
+		if r, err := sa.certs.Get(cert.Serial); err == nil {
+			return r.Subject
+		}
+	}
+	return auth.SubjectFromKeyID(cert.KeyId)
+}
@@ -0,0 +1,172 @@
+package signapi
+
+import (
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/gobwas/glob"
+	"github.com/pkg/errors"
+)
+
+type GroupLifetime struct {
+	// Group patterns matched against the user principals
+	Groups      []string
+	MaxLifetime time.Duration
+}
+
+type LifetimeLimits struct {
+	// Maximum lifetime by authenticator name
+	Backends map[string]time.Duration
+	// Lifetime used when the client does not request one, and the shortest
+	// lifetime that can be requested, by authenticator name
+	BackendDefaults map[string]time.Duration
+	BackendMinimums map[string]time.Duration
+	Groups          []GroupLifetime
+	// Clamp requested lifetimes exceeding the maximum instead of rejecting
+	// the request
+	Clamp bool
+}
+
+type groupLifetime struct {
+	groups      []glob.Glob
+	maxLifetime time.Duration
+}
+
+type lifetimeLimits struct {
+	backends map[string]time.Duration
+	defaults map[string]time.Duration
+	minimums map[string]time.Duration
+	groups   []groupLifetime
+	clamp    bool
+}
+
+// Limit certificate lifetimes per auth backend and per group. The most
+// restrictive matching limit applies, including the maximum lifetime set by
+// the backends for the user
+func (sa *SignApi) SetLifetimeLimits(conf LifetimeLimits) error {
+	ll := &lifetimeLimits{
+		backends: make(map[string]time.Duration),
+		defaults: make(map[string]time.Duration),
+		minimums: make(map[string]time.Duration),
+		clamp:    conf.Clamp,
+	}
+	for k, v := range conf.Backends {
+		if v > 0 {
+			ll.backends[k] = v
+		}
+	}
+	for k, v := range conf.BackendMinimums {
+		if max, ok := ll.backends[k]; ok && v > max {
+			return errors.Errorf("minimum lifetime %s of %s exceeds the maximum %s", v, k, max)
+		}
+		if v > 0 {
+			ll.minimums[k] = v
+		}
+	}
+	for k, v := range conf.BackendDefaults {
+		if v <= 0 {
+			continue
+		}
+		if max, ok := ll.backends[k]; ok && v > max {
+			return errors.Errorf("default lifetime %s of %s exceeds the maximum %s", v, k, max)
+		}
+		if min := ll.minimums[k]; v < min {
+			return errors.Errorf("default lifetime %s of %s is below the minimum %s", v, k, min)
+		}
+		ll.defaults[k] = v
+	}
+	for _, g := range conf.Groups {
+		if g.MaxLifetime <= 0 {
+			return errors.Errorf("invalid maximum lifetime %s for groups %v", g.MaxLifetime, g.Groups)
+		}
+		globs, err := compileGlobs(g.Groups)
+		if err != nil {
+			return errors.Wrap(err, "invalid group lifetime")
+		}
+		ll.groups = append(ll.groups, groupLifetime{globs, g.MaxLifetime})
+	}
+	sa.lifetimeLimits = ll
+	return nil
+}
+
+// Return the maximum lifetime for the auth context given the default
+func (ll *lifetimeLimits) maxLifetime(actx *auth.AuthContext, max time.Duration) time.Duration {
+	if v := actx.GetMaxLifetime(); v > 0 && v < max {
+		max = v
+	}
+	if ll == nil {
+		return max
+	}
+	for _, name := range actx.GetAuthenticators() {
+		if v, ok := ll.backends[name]; ok && v < max {
+			max = v
+		}
+	}
+	principals := actx.GetPrincipals()
+	for _, g := range ll.groups {
+		if g.maxLifetime >= max {
+			continue
+		}
+		for _, p := range principals {
+			if matchAny(g.groups, p) {
+				max = g.maxLifetime
+				break
+			}
+		}
+	}
+	return max
+}
+
+// Return the default lifetime for the auth context given the global default.
+// The shortest backend default applies
+func (ll *lifetimeLimits) defaultLifetime(actx *auth.AuthContext, def time.Duration) time.Duration {
+	if ll == nil {
+		return def
+	}
+	var r time.Duration
+	for _, name := range actx.GetAuthenticators() {
+		if v, ok := ll.defaults[name]; ok && (r == 0 || v < r) {
+			r = v
+		}
+	}
+	if r == 0 {
+		return def
+	}
+	return r
+}
+
+// Return the minimum lifetime for the auth context. The longest backend
+// minimum applies
+func (ll *lifetimeLimits) minLifetime(actx *auth.AuthContext) time.Duration {
+	var min time.Duration
+	if ll == nil {
+		return min
+	}
+	for _, name := range actx.GetAuthenticators() {
+		if v := ll.minimums[name]; v > min {
+			min = v
+		}
+	}
+	return min
+}
+
+// Apply the limits to the default and maximum lifetimes, returning the
+// default, minimum and maximum. The maximum wins over the minimum
+func (ll *lifetimeLimits) bounds(actx *auth.AuthContext, def, max time.Duration) (time.Duration, time.Duration, time.Duration) {
+	max = ll.maxLifetime(actx, max)
+	min := ll.minLifetime(actx)
+	if min > max {
+		min = max
+	}
+	if def > max {
+		def = max
+	}
+	if def < min {
+		def = min
+	}
+	return def, min, max
+}
+
+func (ll *lifetimeLimits) clampEnabled() bool {
+	return ll != nil && ll.clamp
+}
@@ -0,0 +1,138 @@
+package signapi
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const limitAdmin = "admin"
+
+type EndpointLimits struct {
+	// Maximum request body size in bytes
+	MaxBodySize int64
+	// Maximum number of requests handled at once. Requests wait for a free
+	// slot for QueueTimeout before 503 is returned
+	MaxConcurrent int
+	QueueTimeout  time.Duration
+	// Deadline for handling the request, including queueing and upstream
+	// calls
+	Timeout time.Duration
+}
+
+// Limits for the login, signing and admin endpoints. Zero values are
+// disabled
+type RequestLimits struct {
+	Login EndpointLimits
+	Sign  EndpointLimits
+	Admin EndpointLimits
+}
+
+type endpointLimiter struct {
+	EndpointLimits
+	slots chan struct{}
+}
+
+func newEndpointLimiter(l EndpointLimits) *endpointLimiter {
+	el := &endpointLimiter{EndpointLimits: l}
+	if l.MaxConcurrent > 0 {
+		el.slots = make(chan struct{}, l.MaxConcurrent)
+	}
+	return el
+}
+
+func (sa *SignApi) SetRequestLimits(rl RequestLimits) {
+	sa.requestLimits = map[string]*endpointLimiter{
+		rateLimitLogin: newEndpointLimiter(rl.Login),
+		rateLimitSign:  newEndpointLimiter(rl.Sign),
+		limitAdmin:     newEndpointLimiter(rl.Admin),
+	}
+}
+
+// Take a slot, waiting for the queue timeout if none is free
+func (l *endpointLimiter) acquire(ctx context.Context, c echo.Context, endpoint string) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.QueueTimeout > 0 {
+		t := time.NewTimer(l.QueueTimeout)
+		defer t.Stop()
+		select {
+		case l.slots <- struct{}{}:
+			return nil
+		case <-ctx.Done():
+			metricRequestsLimited.WithLabelValues(endpoint, "timeout").Inc()
+			return serviceUnavailable(c, "request timed out waiting for capacity")
+		case <-t.C:
+		}
+	}
+	metricRequestsLimited.WithLabelValues(endpoint, "concurrency").Inc()
+	requestLog(c).WithField("endpoint", endpoint).Warn("too many concurrent requests")
+	return serviceUnavailable(c, "too many concurrent requests")
+}
+
+func serviceUnavailable(c echo.Context, msg string) error {
+	c.Response().Header().Set("Retry-After", "1")
+	return echo.NewHTTPError(http.StatusServiceUnavailable, msg)
+}
+
+// Reader failing once more than the limit has been read
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	if b.left < 0 {
+		return n, echo.ErrStatusRequestEntityTooLarge
+	}
+	return n, err
+}
+
+// Apply the request limits of the endpoint. Should run before the other
+// middlewares so that oversized and excess requests are rejected early
+func (sa *SignApi) limitRequests(endpoint string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			l := sa.requestLimits[endpoint]
+			if l == nil {
+				return next(c)
+			}
+			req := c.Request()
+			if l.MaxBodySize > 0 {
+				if req.ContentLength > l.MaxBodySize {
+					metricRequestsLimited.WithLabelValues(endpoint, "body_size").Inc()
+					return echo.ErrStatusRequestEntityTooLarge
+				}
+				req.Body = &limitedBody{ReadCloser: req.Body, left: l.MaxBodySize}
+			}
+			ctx := req.Context()
+			if l.Timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, l.Timeout)
+				defer cancel()
+				c.SetRequest(req.WithContext(ctx))
+			}
+			if l.slots != nil {
+				if err := l.acquire(ctx, c, endpoint); err != nil {
+					return err
+				}
+				defer func() { <-l.slots }()
+			}
+			err := next(c)
+			if err != nil && ctx.Err() == context.DeadlineExceeded && !c.Response().Committed {
+				metricRequestsLimited.WithLabelValues(endpoint, "timeout").Inc()
+				requestLog(c).WithField("endpoint", endpoint).WithError(err).Warn("request timed out")
+				return serviceUnavailable(c, "request timed out")
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package signapi
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	lockoutUser = "user"
+	lockoutIP   = "ip"
+)
+
+// Temporary lockout of user names and source addresses after failed logins.
+// The failures are counted in the shared state so that all replicas see
+// them
+type Lockout struct {
+	// Failed logins within Window before locking out. Zero disables the
+	// lockout of the user names or addresses
+	MaxUserFailures int
+	MaxIPFailures   int
+	Window          time.Duration
+	// Length of the first lockout, doubled by each further lockout within
+	// MaxDuration of the first one
+	Duration    time.Duration
+	MaxDuration time.Duration
+	// Failed logins are answered after Delay times the failures so far, at
+	// most MaxDelay
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+func (sa *SignApi) SetLockout(l Lockout) error {
+	if l.MaxUserFailures < 0 || l.MaxIPFailures < 0 {
+		return errors.New("invalid lockout: negative failure limit")
+	}
+	if l.Window <= 0 || l.Duration <= 0 {
+		return errors.New("invalid lockout: window and duration must be positive")
+	}
+	if l.MaxDuration < l.Duration {
+		l.MaxDuration = l.Duration
+	}
+	sa.lockout = &l
+	return nil
+}
+
+func lockoutKey(state, kind, id string) string {
+	return "lockout:" + state + ":" + kind + ":" + id
+}
+
+// User name the failures are counted for. Chained logins without a user
+// name, like TOTP, count for the subject of the previous login
+func lockoutUserID(user string, pctx *auth.AuthContext) string {
+	if user == "" && pctx != nil {
+		user = pctx.GetSubjectName()
+	}
+	return strings.ToLower(user)
+}
+
+// Failures of users are counted per backend, so that a login with one
+// backend does not forget the failures with another
+func userLockoutKey(state, backend, user string) string {
+	return lockoutKey(state, lockoutUser, backend+"/"+user)
+}
+
+// Time left of the lockout, zero if not locked out. Errors of the shared
+// state do not block logins
+func lockedOut(key string) time.Duration {
+	v, err := sharedstate.Get().Get(key)
+	if err == sharedstate.ErrNotFound {
+		return 0
+	}
+	if err != nil {
+		Log.WithError(err).Error("cannot check lockout")
+		return 0
+	}
+	until, err := strconv.ParseInt(string(v), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return time.Until(time.Unix(until, 0))
+}
+
+// Refuse the login if the user or the source address is locked out
+func (sa *SignApi) checkLockout(c echo.Context, backend, user string) error {
+	if sa.lockout == nil {
+		return nil
+	}
+	wait := lockedOut(lockoutKey("lock", lockoutIP, c.RealIP()))
+	if user != "" {
+		if d := lockedOut(userLockoutKey("lock", backend, user)); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return nil
+	}
+	metricAuthAttempts.WithLabelValues(backend, "locked_out").Inc()
+	ev := newAuditEvent(c, audit.EventAuthentication)
+	ev.UserIdentifier = user
+	ev.Authenticator = backend
+	ev.Reason = "locked out"
+	audit.Record(ev)
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	return newProblem(http.StatusTooManyRequests, objects.ErrorLockedOut, "too many failed logins, try again later")
+}
+
+// Count the failed login against the user of the backend and the source
+// address, locking them out at the limits, and delay the response
+func (sa *SignApi) loginFailed(c echo.Context, backend, user string) {
+	if sa.lockout == nil {
+		return
+	}
+	failures := sa.countFailure(c, lockoutIP, "", c.RealIP(), sa.lockout.MaxIPFailures)
+	if user != "" {
+		if n := sa.countFailure(c, lockoutUser, backend, user, sa.lockout.MaxUserFailures); n > failures {
+			failures = n
+		}
+	}
+	delay := sa.lockout.Delay * time.Duration(failures)
+	if delay > sa.lockout.MaxDelay {
+		delay = sa.lockout.MaxDelay
+	}
+	if delay <= 0 {
+		return
+	}
+	select {
+	case <-time.After(delay):
+	case <-c.Request().Context().Done():
+	}
+}
+
+// Forget the failures of the user with the backend, the address and the
+// other backends keep their counts
+func (sa *SignApi) loginSucceeded(backend, user string) {
+	if sa.lockout == nil || user == "" {
+		return
+	}
+	if err := sharedstate.Get().Delete(userLockoutKey("fail", backend, user)); err != nil {
+		Log.WithError(err).Error("cannot reset failed logins")
+	}
+}
+
+// Returns the failures within the window. The backend is only used for the
+// user failures
+func (sa *SignApi) countFailure(c echo.Context, kind, backend, id string, max int) int64 {
+	key := func(state string) string {
+		if kind == lockoutUser {
+			return userLockoutKey(state, backend, id)
+		}
+		return lockoutKey(state, kind, id)
+	}
+	store := sharedstate.Get()
+	n, err := store.Incr(key("fail"), sa.lockout.Window)
+	if err != nil {
+		requestLog(c).WithError(err).Error("cannot count failed login")
+		return 0
+	}
+	if max == 0 || n < int64(max) {
+		return n
+	}
+	lockouts, err := store.Incr(key("count"), sa.lockout.MaxDuration)
+	if err != nil {
+		requestLog(c).WithError(err).Error("cannot count lockouts")
+		lockouts = 1
+	}
+	d := sa.lockout.Duration
+	for i := int64(1); i < lockouts && d < sa.lockout.MaxDuration; i++ {
+		d *= 2
+	}
+	if d > sa.lockout.MaxDuration {
+		d = sa.lockout.MaxDuration
+	}
+	until := time.Now().Add(d)
+	if err := store.Set(key("lock"), []byte(strconv.FormatInt(until.Unix(), 10)), d); err != nil {
+		requestLog(c).WithError(err).Error("cannot lock out")
+		return n
+	}
+	// Count afresh once the lockout ends
+	store.Delete(key("fail"))
+
+	metricLockouts.WithLabelValues(kind).Inc()
+	requestLog(c).
+		WithField("lockout", kind).
+		WithField("id", id).
+		WithField("failures", n).
+		WithField("duration", d.String()).
+		Warn("locked out after failed logins")
+	ev := newAuditEvent(c, audit.EventLockout)
+	ev.Reason = kind + " locked out for " + d.String()
+	if kind == lockoutUser {
+		ev.UserIdentifier = id
+		ev.Authenticator = backend
+	}
+	audit.Record(ev)
+	return n
+}
+
+// Lift the lockout and forget the failures of the user with all backends or
+// the address given in the query
+func (sa *SignApi) HandleAdminUnlock(c echo.Context) error {
+	user := strings.ToLower(c.QueryParam("user"))
+	address := c.QueryParam("address")
+	if user == "" && address == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "user or address required")
+	}
+	var keys []string
+	for _, state := range []string{"lock", "fail", "count"} {
+		if user != "" {
+			for _, v := range sa.authList {
+				keys = append(keys, userLockoutKey(state, v.Authenticator.Name(), user))
+			}
+		}
+		if address != "" {
+			keys = append(keys, lockoutKey(state, lockoutIP, address))
+		}
+	}
+	store := sharedstate.Get()
+	for _, key := range keys {
+		if err := store.Delete(key); err != nil {
+			return errors.Wrap(err, "cannot unlock")
+		}
+	}
+	subject := adminSubject(c)
+	requestLog(c).
+		WithField("user", user).
+		WithField("address", address).
+		WithField("unlocked_by", subject).
+		Info("lockout lifted")
+	ev := newAuditEvent(c, audit.EventLockoutCleared)
+	ev.Success = true
+	ev.Subject = subject
+	ev.UserIdentifier = user
+	if address != "" {
+		ev.Reason = "address " + address
+	}
+	audit.Record(ev)
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,47 @@
+package signapi
+
+import (
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// Identity of the login attempt is stored in the request context as the
+// token of a login request is not yet issued
+const (
+	ctxLogUser    = "log_user"
+	ctxLogBackend = "log_backend"
+)
+
+func setLogIdentity(c echo.Context, user, backend string) {
+	c.Set(ctxLogUser, user)
+	c.Set(ctxLogBackend, backend)
+}
+
+// Return the ids, the user identity and the authentication backends of the
+// request for the request log
+func LogFields(c echo.Context) logrus.Fields {
+	var user, backend string
+	if token, _ := c.Get("user").(*jwt.Token); token != nil {
+		if claims, _ := token.Claims.(*SignClaim); claims != nil && claims.AuthContext != nil {
+			user = claims.AuthContext.GetSubjectName()
+			backend = strings.Join(claims.AuthContext.GetAuthenticators(), ",")
+		}
+	}
+	if v, ok := c.Get(ctxLogUser).(string); ok {
+		user = v
+	}
+	if v, ok := c.Get(ctxLogBackend).(string); ok {
+		backend = v
+	}
+	f := requestFields(c)
+	if user != "" {
+		f["user"] = user
+	}
+	if backend != "" {
+		f["backend"] = backend
+	}
+	return f
+}
@@ -0,0 +1,101 @@
+package signapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/labstack/echo/v4"
+)
+
+// The maintenance mode is kept in the shared state so that it applies to
+// all replicas and survives configuration reloads
+const maintenanceKey = "maintenance"
+
+func getMaintenance() (objects.MaintenanceStatus, error) {
+	var m objects.MaintenanceStatus
+	b, err := sharedstate.Get().Get(maintenanceKey)
+	if err == sharedstate.ErrNotFound {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+// Refuse signing while in maintenance mode. If the state cannot be read the
+// request is let through so that a shared state outage does not stop signing
+func checkMaintenance() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			m, err := getMaintenance()
+			if err != nil {
+				requestLog(c).WithError(err).Error("cannot read maintenance mode")
+				return next(c)
+			}
+			if m.Enabled {
+				msg := "signing is disabled for maintenance"
+				if m.Reason != "" {
+					msg += ": " + m.Reason
+				}
+				return newProblem(http.StatusServiceUnavailable, objects.ErrorMaintenance, msg)
+			}
+			return next(c)
+		}
+	}
+}
+
+func (sa *SignApi) HandleAdminGetMaintenance(c echo.Context) error {
+	m, err := getMaintenance()
+	if err != nil {
+		requestLog(c).WithError(err).Error("cannot read maintenance mode")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot read maintenance mode")
+	}
+	return c.JSON(http.StatusOK, m)
+}
+
+func (sa *SignApi) HandleAdminEnableMaintenance(c echo.Context) error {
+	now := time.Now().UTC()
+	m := objects.MaintenanceStatus{
+		Enabled:   true,
+		EnabledBy: adminSubject(c),
+		EnabledAt: &now,
+		Reason:    c.QueryParam("reason"),
+	}
+	b, _ := json.Marshal(m)
+	if err := sharedstate.Get().Set(maintenanceKey, b, 0); err != nil {
+		requestLog(c).WithError(err).Error("cannot enable maintenance mode")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot enable maintenance mode")
+	}
+	requestLog(c).
+		WithField("enabled_by", m.EnabledBy).
+		WithField("reason", m.Reason).
+		Warn("maintenance mode enabled, signing is disabled")
+	ev := newAuditEvent(c, audit.EventMaintenanceEnabled)
+	ev.Success = true
+	ev.Subject = m.EnabledBy
+	ev.Reason = m.Reason
+	audit.Record(ev)
+	return c.JSON(http.StatusOK, m)
+}
+
+func (sa *SignApi) HandleAdminDisableMaintenance(c echo.Context) error {
+	subject := adminSubject(c)
+	if err := sharedstate.Get().Delete(maintenanceKey); err != nil && err != sharedstate.ErrNotFound {
+		requestLog(c).WithError(err).Error("cannot disable maintenance mode")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot disable maintenance mode")
+	}
+	requestLog(c).
+		WithField("disabled_by", subject).
+		Info("maintenance mode disabled")
+	ev := newAuditEvent(c, audit.EventMaintenanceDisabled)
+	ev.Success = true
+	ev.Subject = subject
+	audit.Record(ev)
+	return c.JSON(http.StatusOK, objects.MaintenanceStatus{})
+}
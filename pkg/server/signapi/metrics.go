@@ -0,0 +1,79 @@
+package signapi
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricSignRequests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ssh_inscribe_sign_requests_total",
+			Help: "Certificate signing requests by response code",
+		},
+		[]string{"code"},
+	)
+	metricAuthAttempts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ssh_inscribe_auth_attempts_total",
+			Help: "Authentication attempts by auth backend and result",
+		},
+		[]string{"backend", "result"},
+	)
+	metricTokenValidations = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ssh_inscribe_token_validations_total",
+			Help: "Auth token validations by result",
+		},
+		[]string{"result"},
+	)
+	metricRateLimited = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ssh_inscribe_rate_limited_requests_total",
+			Help: "Requests rejected by rate limits by endpoint and limit key",
+		},
+		[]string{"endpoint", "key"},
+	)
+	metricRequestsLimited = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ssh_inscribe_limited_requests_total",
+			Help: "Requests rejected by request limits by endpoint and reason",
+		},
+		[]string{"endpoint", "reason"},
+	)
+	metricReplaysRejected = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ssh_inscribe_replays_rejected_total",
+			Help: "Signing requests rejected as replays by check",
+		},
+		[]string{"check"},
+	)
+	metricLockouts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ssh_inscribe_lockouts_total",
+			Help: "Lockouts after failed logins by lockout key",
+		},
+		[]string{"key"},
+	)
+)
+
+// Count handler results by the response code
+func countResponses(cv *prometheus.CounterVec) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			code := c.Response().Status
+			if he, ok := err.(*echo.HTTPError); ok {
+				code = he.Code
+			} else if err != nil {
+				code = http.StatusInternalServerError
+			}
+			cv.WithLabelValues(strconv.Itoa(code)).Inc()
+			return err
+		}
+	}
+}
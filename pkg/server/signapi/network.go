@@ -0,0 +1,90 @@
+package signapi
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/labstack/echo/v4"
+)
+
+// Source networks allowed to reach an endpoint. Denied networks take
+// precedence. Everything is allowed if Allow is empty
+type NetworkFilter struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+type NetworkACL struct {
+	Sign  NetworkFilter
+	Admin NetworkFilter
+}
+
+// Parse networks in CIDR notation. Plain addresses are taken as single host
+// networks
+func ParseNetworks(list []string) ([]*net.IPNet, error) {
+	var ret []*net.IPNet
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+// Restrict the source networks of the signing and admin endpoints. The
+// client address is taken after the trusted proxy handling
+func (sa *SignApi) SetNetworkACL(acl NetworkACL) {
+	sa.networkACL = map[string]*NetworkFilter{
+		rateLimitSign: &acl.Sign,
+		limitAdmin:    &acl.Admin,
+	}
+}
+
+func (f *NetworkFilter) allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(f.Allow) == 0 && len(f.Deny) == 0
+	}
+	for _, n := range f.Deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, n := range f.Allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (sa *SignApi) checkSource(endpoint string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			f := sa.networkACL[endpoint]
+			if f == nil {
+				return next(c)
+			}
+			ip := c.RealIP()
+			if !f.allowed(net.ParseIP(ip)) {
+				metricRequestsLimited.WithLabelValues(endpoint, "source_ip").Inc()
+				requestLog(c).WithField("endpoint", endpoint).WithField("ip", ip).Warn("request from a disallowed network")
+				return newProblem(http.StatusForbidden, objects.ErrorNetworkDenied, "access from this network is not allowed")
+			}
+			return next(c)
+		}
+	}
+}
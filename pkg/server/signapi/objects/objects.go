@@ -1,8 +1,305 @@
 package objects
 
+import "time"
+
 type DiscoverResult struct {
 	AuthenticatorName           string `json:"authenticatorName"`
 	AuthenticatorRealm          string `json:"authenticatorRealm"`
 	AuthenticatorCredentialType string `json:"authenticatorCredentialType"`
 	Default                     bool   `json:"default"`
+	// HealthUp or HealthDown as of the last health check, empty if the
+	// backend is not checked
+	Health string `json:"health,omitempty"`
+}
+
+const (
+	HealthUp   = "up"
+	HealthDown = "down"
+)
+
+// States of the circuit breaker of an auth backend
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// Result of the last periodic health check of an auth backend
+type BackendHealth struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Only returned to admins
+	Error    string    `json:"error,omitempty"`
+	Checked  time.Time `json:"checked"`
+	Since    time.Time `json:"since"`
+	Duration string    `json:"duration"`
+}
+
+type EnrollResult struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type RevokeRequest struct {
+	Serial      uint64 `json:"serial,omitempty"`
+	KeyID       string `json:"keyId,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+type BootstrapTokenRequest struct {
+	Hostnames []string `json:"hostnames"`
+	// Go duration string
+	TTL  string `json:"ttl,omitempty"`
+	Uses int    `json:"uses,omitempty"`
+}
+
+type BootstrapTokenResponse struct {
+	Token     string    `json:"token"`
+	ID        string    `json:"id"`
+	Hostnames []string  `json:"hostnames"`
+	Expires   time.Time `json:"expires"`
+	Uses      int       `json:"uses"`
+}
+
+type IntrospectRequest struct {
+	// Token to inspect, the caller's own token if empty
+	Token string `json:"token,omitempty"`
+}
+
+type IntrospectResponse struct {
+	// False for invalid and expired tokens, the other fields are then unset
+	Active bool `json:"active"`
+	// Whether all chained authentications have completed and the backends
+	// satisfy one of the auth chains required for signing
+	Complete bool `json:"complete,omitempty"`
+	// Backends still needed for each of the auth chains when incomplete
+	MissingBackends [][]string        `json:"missingBackends,omitempty"`
+	Subject         string            `json:"subject,omitempty"`
+	Audience        string            `json:"audience,omitempty"`
+	Issuer          string            `json:"issuer,omitempty"`
+	Backends        []string          `json:"backends,omitempty"`
+	IssuedAt        *time.Time        `json:"issuedAt,omitempty"`
+	Expires         *time.Time        `json:"expires,omitempty"`
+	Principals      []string          `json:"principals,omitempty"`
+	CriticalOptions map[string]string `json:"criticalOptions,omitempty"`
+	Extensions      map[string]string `json:"extensions,omitempty"`
+	Policy          string            `json:"policy,omitempty"`
+	// Certificate lifetimes for the token, Go durations. The default is used
+	// when no expiry is requested
+	DefaultCertLifetime string `json:"defaultCertLifetime,omitempty"`
+	MinCertLifetime     string `json:"minCertLifetime,omitempty"`
+	MaxCertLifetime     string `json:"maxCertLifetime,omitempty"`
+	// Auth context values copied into the token
+	Claims map[string]interface{} `json:"claims,omitempty"`
+}
+
+type BackendStatus struct {
+	Name           string `json:"name"`
+	Type           string `json:"type"`
+	Realm          string `json:"realm"`
+	CredentialType string `json:"credentialType"`
+	Default        bool   `json:"default"`
+	Enabled        bool   `json:"enabled"`
+	// Set when disabled at runtime
+	DisabledBy string     `json:"disabledBy,omitempty"`
+	DisabledAt *time.Time `json:"disabledAt,omitempty"`
+	Reason     string     `json:"reason,omitempty"`
+	// Whether the backend supports connectivity probes
+	Probe bool `json:"probe"`
+	// Set when health checks are enabled and the backend has been checked
+	Health *BackendHealth `json:"health,omitempty"`
+	// Set when the backend has a circuit breaker
+	Circuit string `json:"circuit,omitempty"`
+}
+
+type BackendProbeResult struct {
+	Name     string `json:"name"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type CARotationRequest struct {
+	// Next CA private key in PEM format. If empty, an Ed25519 key is
+	// generated on the agent
+	PrivateKey string `json:"privateKey,omitempty"`
+	// Time after which the next key signs, immediately if unset
+	Cutover *time.Time `json:"cutover,omitempty"`
+}
+
+type CAKeyInfo struct {
+	Fingerprint string `json:"fingerprint"`
+	PublicKey   string `json:"publicKey"`
+}
+
+type RetiredCAKey struct {
+	CAKeyInfo
+	RetiredAt time.Time `json:"retiredAt"`
+	RetiredBy string    `json:"retiredBy,omitempty"`
+}
+
+type CARotationStatus struct {
+	// Key signing certificates right now
+	Signing *CAKeyInfo `json:"signing,omitempty"`
+	// Pending rotation. Both keys are trusted until the previous key is
+	// retired
+	Next      *CAKeyInfo     `json:"next,omitempty"`
+	Cutover   *time.Time     `json:"cutover,omitempty"`
+	StartedBy string         `json:"startedBy,omitempty"`
+	StartedAt *time.Time     `json:"startedAt,omitempty"`
+	Retired   []RetiredCAKey `json:"retired,omitempty"`
+}
+
+// Signing is refused while enabled
+type MaintenanceStatus struct {
+	Enabled   bool       `json:"enabled"`
+	EnabledBy string     `json:"enabledBy,omitempty"`
+	EnabledAt *time.Time `json:"enabledAt,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+}
+
+// Every response carries the id the server generated for the request. The
+// correlation id sent by the client is echoed back, the request id is used
+// when the client did not send one
+const (
+	RequestIDHeader     = "X-Inscribe-Request-ID"
+	CorrelationIDHeader = "X-Correlation-ID"
+)
+
+// Code the user enters at the federation auth URL when the authenticator uses
+// the device flow
+const FederationUserCodeHeader = "X-Federation-User-Code"
+
+// Prompt of a challenge-response authenticator. The client sends the
+// response as the password together with the returned pending token
+const AuthChallengeHeader = "X-Auth-Challenge"
+
+// Audience and realm the client names, e.g. its tenant, for the backends
+// restricted to them
+const (
+	AudienceHeader = "X-Auth-Audience"
+	RealmHeader    = "X-Auth-Realm"
+)
+
+// Time the password of the user expires, as RFC 3339. Set on logins when
+// the password expires soon
+const PasswordExpiresHeader = "X-Password-Expires"
+
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalDenied   = "denied"
+)
+
+type ApprovalRequest struct {
+	ID                  string     `json:"id"`
+	Status              string     `json:"status"`
+	Requester           string     `json:"requester"`
+	Principals          []string   `json:"principals"`
+	SensitivePrincipals []string   `json:"sensitivePrincipals"`
+	Fingerprint         string     `json:"fingerprint"`
+	CA                  string     `json:"ca,omitempty"`
+	ValidBefore         time.Time  `json:"validBefore"`
+	CreatedAt           time.Time  `json:"createdAt"`
+	Expires             time.Time  `json:"expires"`
+	DecidedBy           string     `json:"decidedBy,omitempty"`
+	DecidedAt           *time.Time `json:"decidedAt,omitempty"`
+	Comment             string     `json:"comment,omitempty"`
+}
+
+type ApprovalDecision struct {
+	Comment string `json:"comment,omitempty"`
+}
+
+// Certificate forwarded by a federation frontend for signing
+type FederationSignRequest struct {
+	PublicKey       string            `json:"publicKey"`
+	CertType        string            `json:"certType"`
+	KeyID           string            `json:"keyId"`
+	Principals      []string          `json:"principals"`
+	ValidAfter      time.Time         `json:"validAfter"`
+	ValidBefore     time.Time         `json:"validBefore"`
+	CriticalOptions map[string]string `json:"criticalOptions,omitempty"`
+	Extensions      map[string]string `json:"extensions,omitempty"`
+	CA              string            `json:"ca,omitempty"`
+	// Identity authenticated on the frontend and its audit id
+	Subject        string   `json:"subject,omitempty"`
+	Authenticators []string `json:"authenticators,omitempty"`
+	AuditID        string   `json:"auditId,omitempty"`
+}
+
+// Errors of the API endpoints are returned as RFC 7807 problem details
+const MIMEProblemJSON = "application/problem+json"
+
+// Prefix of the problem type, followed by the error code
+const ProblemTypePrefix = "urn:ssh-inscribe:error:"
+
+// Machine readable error codes. The codes are stable while the details are
+// meant for humans and may change
+const (
+	ErrorBadRequest       = "bad_request"
+	ErrorUnauthorized     = "unauthorized"
+	ErrorForbidden        = "forbidden"
+	ErrorNotFound         = "not_found"
+	ErrorMethodNotAllowed = "method_not_allowed"
+	ErrorConflict         = "conflict"
+	ErrorPayloadTooLarge  = "payload_too_large"
+	ErrorRateLimited      = "rate_limited"
+	ErrorInternal         = "internal_error"
+	ErrorBadGateway       = "bad_gateway"
+	ErrorUnavailable      = "unavailable"
+	ErrorTimeout          = "timeout"
+	ErrorUnknown          = "error"
+
+	ErrorInvalidPublicKey      = "invalid_public_key"
+	ErrorNoPrincipals          = "no_principals"
+	ErrorLifetimeExceeded      = "lifetime_exceeded"
+	ErrorLifetimeTooShort      = "lifetime_too_short"
+	ErrorKeyRevoked            = "key_revoked"
+	ErrorPrincipalsDenied      = "principals_denied"
+	ErrorOutsideIssuanceWindow = "outside_issuance_window"
+	ErrorQuotaExceeded         = "quota_exceeded"
+	ErrorPolicyDenied          = "policy_denied"
+	ErrorPolicyUnavailable     = "policy_unavailable"
+	ErrorNetworkDenied         = "network_denied"
+	ErrorTokenReused           = "token_reused"
+	ErrorMaintenance           = "maintenance"
+	ErrorAuthBackendDisabled   = "auth_backend_disabled"
+	ErrorHostnameNotAllowed    = "hostname_not_allowed"
+	ErrorHostSigningNotAllowed = "host_signing_not_allowed"
+	ErrorAlreadyEnrolled       = "already_enrolled"
+	ErrorAuthChainIncomplete   = "auth_chain_incomplete"
+	ErrorAuthBackendDown       = "auth_backend_down"
+	ErrorAuthBackendBusy       = "auth_backend_busy"
+	ErrorLockedOut             = "locked_out"
+	ErrorAuthBackendNotAllowed = "auth_backend_not_allowed"
+	ErrorStepUpRequired        = "step_up_required"
+	ErrorPasswordExpired       = "password_expired"
+	ErrorPasswordMustChange    = "password_must_change"
+	ErrorMFAEnrollRequired     = "mfa_enroll_required"
+)
+
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// Request path
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+	// Ids for correlating the error with the server logs
+	RequestID     string `json:"requestId,omitempty"`
+	CorrelationID string `json:"correlationId,omitempty"`
+	AuditID       string `json:"auditId,omitempty"`
+	// Auth backends any of which the client may log in with to get the
+	// certificate, with step_up_required
+	StepUpBackends []string `json:"stepUpBackends,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
 }
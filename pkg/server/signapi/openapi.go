@@ -0,0 +1,1024 @@
+package signapi
+
+import (
+	"net/http"
+
+	"github.com/aakso/ssh-inscribe/pkg/globals"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/labstack/echo/v4"
+)
+
+// OpenAPI 3 description of the signing API. Keep in sync with routes.go,
+// the tests check that every route is documented
+
+type oaObject map[string]interface{}
+
+func oaRef(name string) oaObject {
+	return oaObject{"$ref": "#/components/schemas/" + name}
+}
+
+func oaText(description string) oaObject {
+	return oaObject{
+		"description": description,
+		"content":     oaObject{"text/plain": oaObject{"schema": oaObject{"type": "string"}}},
+	}
+}
+
+func oaJSON(description string, schema oaObject) oaObject {
+	return oaObject{
+		"description": description,
+		"content":     oaObject{"application/json": oaObject{"schema": schema}},
+	}
+}
+
+// Errors are returned as problem details
+func oaError(description string) oaObject {
+	return oaObject{
+		"description": description,
+		"content":     oaObject{objects.MIMEProblemJSON: oaObject{"schema": oaRef("Problem")}},
+	}
+}
+
+func oaParam(in, name, description, typ string, required bool) oaObject {
+	p := oaObject{
+		"in":          in,
+		"name":        name,
+		"description": description,
+		"required":    required,
+		"schema":      oaObject{"type": typ},
+	}
+	if typ == "date-time" {
+		p["schema"] = oaObject{"type": "string", "format": "date-time"}
+	}
+	return p
+}
+
+func oaQuery(name, description, typ string) oaObject {
+	return oaParam("query", name, description, typ, false)
+}
+
+var (
+	oaBearer    = []oaObject{{"bearer": []string{}}}
+	oaPublicKey = oaObject{
+		"required":    true,
+		"description": "Public key in the authorized_keys format",
+		"content":     oaObject{"text/plain": oaObject{"schema": oaObject{"type": "string"}}},
+	}
+	oaCertificate = oaText("Signed certificate in the authorized_keys format")
+	oaHostnames   = oaObject{
+		"in":          "query",
+		"name":        "hostnames",
+		"description": "Hostnames to include in the certificate, may be repeated",
+		"schema":      oaObject{"type": "array", "items": oaObject{"type": "string"}},
+		"style":       "form",
+		"explode":     true,
+	}
+	oaCA       = oaQuery("ca", "Name of the CA key, defaults to the default key", "string")
+	oaAudience = oaParam("header", objects.AudienceHeader,
+		"Audience of the client, e.g. its tenant, for the backends restricted to audiences", "string", false)
+	oaRealm = oaParam("header", objects.RealmHeader,
+		"Realm of the client for the backends restricted to realms", "string", false)
+)
+
+func openAPISpec() oaObject {
+	stringArray := oaObject{"type": "array", "items": oaObject{"type": "string"}}
+	dateTime := oaObject{"type": "string", "format": "date-time"}
+	stringMap := oaObject{"type": "object", "additionalProperties": oaObject{"type": "string"}}
+
+	paths := oaObject{
+		"/v1/auth": oaObject{
+			"get": oaObject{
+				"summary":     "List the available authenticators",
+				"operationId": "discoverAuthenticators",
+				"parameters":  []oaObject{oaAudience, oaRealm},
+				"responses": oaObject{
+					"200": oaJSON("Authenticators", oaObject{"type": "array", "items": oaRef("DiscoverResult")}),
+				},
+			},
+		},
+		"/v1/auth/{name}": oaObject{
+			"post": oaObject{
+				"summary": "Authenticate against a backend",
+				"description": "User and password backends take the credentials with basic auth. " +
+					"An existing token may be passed in X-Auth to chain authenticators for multi factor " +
+					"authentication. Federated backends return the identity provider URL in Location " +
+					"and a pending token, the request is then repeated with the pending token until " +
+					"the login completes. Negotiate backends take a SPNEGO token in " +
+					"\"Authorization: Negotiate\" and answer 401 with WWW-Authenticate when it is missing. " +
+					"Challenge-response backends answer 202 with the prompt in X-Auth-Challenge and a " +
+					"pending token, the response is then sent as the password with the pending token.",
+				"operationId": "login",
+				"security":    []oaObject{{"basic": []string{}}, {"bearer": []string{}}, {}},
+				"parameters": []oaObject{
+					oaParam("path", "name", "Authenticator name", "string", true),
+					oaQuery("redirect", "Set to false to get 202 instead of 303 for federated logins", "boolean"),
+					oaAudience,
+					oaRealm,
+				},
+				"responses": oaObject{
+					"200": oaObject{
+						"description": "Signed token",
+						"headers": oaObject{objects.PasswordExpiresHeader: oaObject{
+							"description": "Time the password expires when it expires soon",
+							"schema":      oaObject{"type": "string", "format": "date-time"},
+						}},
+						"content": oaObject{"application/jwt": oaObject{"schema": oaObject{"type": "string"}}},
+					},
+					"202": oaObject{
+						"description": "Federated login pending, see 303, or a challenge for the user. " +
+							"The body is the pending token",
+						"headers": oaObject{objects.AuthChallengeHeader: oaObject{"schema": oaObject{"type": "string"}}},
+					},
+					"303": oaObject{
+						"description": "Federated login pending. The body is the pending token",
+						"headers":     oaObject{"Location": oaObject{"schema": oaObject{"type": "string"}}},
+					},
+					"400": oaError("Auth context chain too long"),
+					"401": oaError("Authentication failed"),
+					"403": oaError("Backend not allowed for the client, the password has expired or must be changed, " +
+						"or a second factor must be enrolled"),
+					"404": oaError("Unknown authenticator, or not available for the audience or realm"),
+					"429": oaRef429(),
+					"503": oaError("Authenticator is disabled, down, busy or failing"),
+				},
+			},
+		},
+		"/v1/auth/{name}/enroll": oaObject{
+			"post": oaObject{
+				"summary": "Enroll the caller to a backend",
+				"description": "Creates a credential such as a TOTP seed for the authenticated user. " +
+					"A pending enrollment is replaced until the first successful login with it.",
+				"operationId": "enroll",
+				"security":    oaBearer,
+				"parameters": []oaObject{
+					oaParam("path", "name", "Authenticator name", "string", true),
+					oaQuery("format", "Set to png to get the provisioning URI as a QR code", "string"),
+					oaQuery("scale", "Pixels per QR code module with the png format", "integer"),
+				},
+				"responses": oaObject{
+					"200": oaObject{
+						"description": "Provisioning details",
+						"content": oaObject{
+							"application/json": oaObject{"schema": oaRef("EnrollResult")},
+							"image/png":        oaObject{"schema": oaObject{"type": "string", "format": "binary"}},
+						},
+					},
+					"400": oaError("Enrollment failed"),
+					"404": oaError("Unknown authenticator or enrollment not supported"),
+					"409": oaError("Already enrolled"),
+					"429": oaRef429(),
+					"503": oaError("Authenticator is disabled"),
+				},
+			},
+		},
+		"/v1/auth/{name}/page": oaObject{
+			"get": oaObject{
+				"summary": "Login page of a browser based backend",
+				"description": "Runs the WebAuthn ceremony of a pending login or registration in the browser " +
+					"and posts the result to the auth callback. This is the Location of such logins.",
+				"operationId": "authPage",
+				"parameters": []oaObject{
+					oaParam("path", "name", "Authenticator name", "string", true),
+					oaQuery("state", "State of the pending request", "string"),
+				},
+				"responses": oaObject{
+					"200": oaObject{
+						"description": "HTML page",
+						"content":     oaObject{"text/html": oaObject{"schema": oaObject{"type": "string"}}},
+					},
+					"400": oaError("Unknown or expired state"),
+					"404": oaError("Unknown authenticator"),
+					"503": oaError("Authenticator is disabled"),
+				},
+			},
+		},
+		"/v1/auth_callback/{name}": oaObject{
+			"get":  oaCallback("authCallbackGet"),
+			"post": oaCallback("authCallbackPost"),
+		},
+		"/v1/sign": oaObject{
+			"post": oaObject{
+				"summary":     "Sign a user public key",
+				"operationId": "sign",
+				"security":    oaBearer,
+				"parameters": []oaObject{
+					oaQuery("expires", "Certificate expiry time in RFC 3339 format", "date-time"),
+					oaQuery("include_principals", "Glob pattern of principals to include", "string"),
+					oaQuery("exclude_principals", "Glob pattern of principals to exclude", "string"),
+					oaCA,
+					oaQuery("approval", "ID of an approved request for sensitive principals", "string"),
+					oaAudience,
+					oaRealm,
+				},
+				"requestBody": oaPublicKey,
+				"responses": oaObject{
+					"200": oaCertificate,
+					"202": oaObject{
+						"description": "Principals require approval. Poll the request in Location and repeat " +
+							"the signing request with the approval parameter once approved",
+						"headers": oaObject{"Location": oaObject{"schema": oaObject{"type": "string"}}},
+						"content": oaObject{"application/json": oaObject{"schema": oaRef("ApprovalRequest")}},
+					},
+					"400": oaError("Invalid request or lifetime"),
+					"401": oaError("Missing or invalid token"),
+					"403": oaError("Denied by policy or approval, or step_up_required with the backends to " +
+						"log in also with in stepUpBackends"),
+					"409": oaError("Replayed request or token already used"),
+					"429": oaRef429(),
+					"503": oaError("Signing is disabled for maintenance or the server is busy"),
+				},
+			},
+		},
+		"/v1/host/sign": oaObject{
+			"post": oaObject{
+				"summary":     "Sign a host public key",
+				"operationId": "signHost",
+				"security":    oaBearer,
+				"parameters": []oaObject{
+					oaHostnames,
+					oaQuery("expires", "Certificate expiry time in RFC 3339 format", "date-time"),
+					oaCA,
+				},
+				"requestBody": oaPublicKey,
+				"responses": oaObject{
+					"200": oaCertificate,
+					"400": oaError("Invalid request"),
+					"401": oaError("Missing or invalid token"),
+					"403": oaError("Requester or hostname not allowed"),
+					"404": oaError("Host signing is not enabled"),
+					"409": oaError("Replayed request or token already used"),
+					"429": oaRef429(),
+					"503": oaError("Signing is disabled for maintenance or the server is busy"),
+				},
+			},
+		},
+		"/v1/host/bootstrap": oaObject{
+			"post": oaObject{
+				"summary":     "Sign a host public key with a bootstrap token",
+				"operationId": "bootstrapHost",
+				"security":    []oaObject{{"bootstrapToken": []string{}}},
+				"parameters":  []oaObject{oaHostnames, oaCA},
+				"requestBody": oaPublicKey,
+				"responses": oaObject{
+					"200": oaCertificate,
+					"400": oaError("Invalid request"),
+					"401": oaError("Invalid or expired token"),
+					"403": oaError("Hostname not allowed"),
+					"404": oaError("Bootstrap tokens are not enabled"),
+					"409": oaError("Replayed request"),
+					"429": oaRef429(),
+					"503": oaError("Signing is disabled for maintenance or the server is busy"),
+				},
+			},
+		},
+		"/v1/federation/sign": oaObject{
+			"post": oaObject{
+				"summary": "Sign a certificate forwarded by a federation frontend",
+				"description": "The frontend authenticates the user and builds the certificate. " +
+					"Principals the frontend is not allowed to request are dropped and the lifetime " +
+					"is clamped to the frontend maximum.",
+				"operationId": "federationSign",
+				"security":    []oaObject{{"federationAssertion": []string{}}},
+				"requestBody": oaObject{
+					"required": true,
+					"content":  oaObject{"application/json": oaObject{"schema": oaRef("FederationSignRequest")}},
+				},
+				"responses": oaObject{
+					"200": oaCertificate,
+					"400": oaError("Invalid request"),
+					"401": oaError("Missing or invalid assertion"),
+					"403": oaError("No principals allowed for the frontend or key revoked"),
+					"404": oaError("Federation is not enabled"),
+					"503": oaError("Signing is disabled for maintenance or the server is busy"),
+				},
+			},
+		},
+		"/v1/ca": oaObject{
+			"get": oaObject{
+				"summary":     "Get the CA public key",
+				"operationId": "getCA",
+				"parameters":  []oaObject{oaCA},
+				"responses": oaObject{
+					"200": oaText("CA public key in the authorized_keys format"),
+					"400": oaError("Unknown CA"),
+					"500": oaError("No signing key available"),
+				},
+			},
+			"post": oaObject{
+				"summary":     "Add the CA signing key",
+				"operationId": "addCA",
+				"security":    oaBearer,
+				"parameters":  []oaObject{oaCA},
+				"requestBody": oaObject{
+					"required":    true,
+					"description": "Private key in PEM format",
+					"content":     oaObject{"text/plain": oaObject{"schema": oaObject{"type": "string"}}},
+				},
+				"responses": oaObject{
+					"202": oaObject{"description": "Key added"},
+					"400": oaError("Invalid key"),
+					"401": oaError("Missing or invalid token"),
+				},
+			},
+		},
+		"/v1/ca/bundle": oaObject{
+			"get": oaObject{
+				"summary":     "Get all active CA public keys",
+				"operationId": "getTrustBundle",
+				"parameters": []oaObject{
+					oaQuery("format", "Either authorized_keys for TrustedUserCAKeys or known_hosts", "string"),
+					oaQuery("hosts", "Host pattern for the known_hosts format, defaults to *", "string"),
+					oaQuery("ca", "Only include the named CA key", "string"),
+					oaParam("header", "If-None-Match", "ETag of a previously fetched bundle", "string", false),
+				},
+				"responses": oaObject{
+					"200": oaText("CA public keys, one per line"),
+					"304": oaObject{"description": "Bundle has not changed"},
+					"400": oaError("Invalid format or unknown CA"),
+					"500": oaError("No signing key available"),
+				},
+			},
+		},
+		"/v1/health": oaObject{
+			"get": oaObject{
+				"summary":     "Get the results of the auth backend health checks",
+				"operationId": "health",
+				"responses": oaObject{
+					"200": oaJSON("Backend health", oaObject{"type": "array", "items": oaRef("BackendHealth")}),
+				},
+			},
+		},
+		"/v1/ready": oaObject{
+			"get": oaObject{
+				"summary":     "Check that the signer is ready",
+				"operationId": "ready",
+				"responses": oaObject{
+					"204": oaObject{"description": "Ready for signing"},
+					"500": oaError("Not ready"),
+				},
+			},
+		},
+		"/v1/krl": oaObject{
+			"get": oaObject{
+				"summary":     "Get the key revocation list",
+				"operationId": "getKRL",
+				"responses": oaObject{
+					"200": oaObject{
+						"description": "KRL in the OpenSSH binary format",
+						"content":     oaObject{"application/octet-stream": oaObject{"schema": oaObject{"type": "string", "format": "binary"}}},
+					},
+					"404": oaError("Revocation is not enabled"),
+				},
+			},
+		},
+		"/v1/revoke": oaObject{
+			"post": oaObject{
+				"summary":     "Revoke a certificate issued to the caller",
+				"operationId": "revoke",
+				"security":    oaBearer,
+				"parameters":  []oaObject{oaQuery("reason", "Revocation reason", "string")},
+				"requestBody": oaObject{
+					"required":    true,
+					"description": "Certificate in the authorized_keys format",
+					"content":     oaObject{"text/plain": oaObject{"schema": oaObject{"type": "string"}}},
+				},
+				"responses": oaObject{
+					"204": oaObject{"description": "Revoked"},
+					"400": oaError("Invalid certificate"),
+					"403": oaError("Certificate not issued to the caller"),
+					"404": oaError("Revocation is not enabled"),
+				},
+			},
+		},
+		"/v1/admin/revoke": oaObject{
+			"post": oaObject{
+				"summary":     "Revoke certificates by serial, key id or key fingerprint",
+				"operationId": "adminRevoke",
+				"security":    oaBearer,
+				"requestBody": oaObject{
+					"required": true,
+					"content":  oaObject{"application/json": oaObject{"schema": oaRef("RevokeRequest")}},
+				},
+				"responses": oaObject{
+					"204": oaObject{"description": "Revoked"},
+					"400": oaError("Invalid request"),
+					"403": oaError("Not an admin"),
+					"404": oaError("Revocation is not enabled"),
+				},
+			},
+		},
+		"/v1/admin/certs": oaObject{
+			"get": oaObject{
+				"summary":     "Search issued certificates",
+				"operationId": "adminListCerts",
+				"security":    oaBearer,
+				"parameters": []oaObject{
+					oaQuery("user", "Subject name", "string"),
+					oaQuery("principal", "Principal", "string"),
+					oaQuery("key_id", "Key id", "string"),
+					oaQuery("issued_after", "", "date-time"),
+					oaQuery("issued_before", "", "date-time"),
+					oaQuery("expires_after", "", "date-time"),
+					oaQuery("expires_before", "", "date-time"),
+					oaQuery("valid_at", "", "date-time"),
+					oaQuery("valid", "Only currently valid certificates", "boolean"),
+					oaQuery("limit", "Maximum number of results", "integer"),
+				},
+				"responses": oaObject{
+					"200": oaJSON("Certificates", oaObject{"type": "array", "items": oaRef("CertificateRecord")}),
+					"400": oaError("Invalid filter"),
+					"403": oaError("Not an admin"),
+					"404": oaError("Certificate store is not enabled"),
+				},
+			},
+		},
+		"/v1/admin/certs/{serial}": oaObject{
+			"get": oaObject{
+				"summary":     "Get an issued certificate by serial",
+				"operationId": "adminGetCert",
+				"security":    oaBearer,
+				"parameters":  []oaObject{oaParam("path", "serial", "Certificate serial", "integer", true)},
+				"responses": oaObject{
+					"200": oaJSON("Certificate", oaRef("CertificateRecord")),
+					"403": oaError("Not an admin"),
+					"404": oaError("Not found"),
+				},
+			},
+		},
+		"/v1/admin/bootstrap_tokens": oaObject{
+			"get": oaObject{
+				"summary":     "List bootstrap tokens",
+				"operationId": "adminListBootstrapTokens",
+				"security":    oaBearer,
+				"responses": oaObject{
+					"200": oaJSON("Tokens", oaObject{"type": "array", "items": oaRef("BootstrapToken")}),
+					"403": oaError("Not an admin"),
+					"404": oaError("Bootstrap tokens are not enabled"),
+				},
+			},
+			"post": oaObject{
+				"summary":     "Create a bootstrap token",
+				"operationId": "adminCreateBootstrapToken",
+				"security":    oaBearer,
+				"requestBody": oaObject{
+					"required": true,
+					"content":  oaObject{"application/json": oaObject{"schema": oaRef("BootstrapTokenRequest")}},
+				},
+				"responses": oaObject{
+					"201": oaJSON("Created token. The secret is only returned here", oaRef("BootstrapTokenResponse")),
+					"400": oaError("Invalid request"),
+					"403": oaError("Not an admin"),
+					"404": oaError("Bootstrap tokens are not enabled"),
+				},
+			},
+		},
+		"/v1/admin/bootstrap_tokens/{id}": oaObject{
+			"delete": oaObject{
+				"summary":     "Delete a bootstrap token",
+				"operationId": "adminDeleteBootstrapToken",
+				"security":    oaBearer,
+				"parameters":  []oaObject{oaParam("path", "id", "Token id", "string", true)},
+				"responses": oaObject{
+					"204": oaObject{"description": "Deleted"},
+					"403": oaError("Not an admin"),
+					"404": oaError("Not found"),
+				},
+			},
+		},
+		"/v1/admin/backends": oaObject{
+			"get": oaObject{
+				"summary":     "List auth backends and their runtime status",
+				"operationId": "adminListBackends",
+				"security":    oaBearer,
+				"responses": oaObject{
+					"200": oaJSON("Backends", oaObject{"type": "array", "items": oaRef("BackendStatus")}),
+					"403": oaError("Not an admin"),
+				},
+			},
+		},
+		"/v1/admin/backends/{name}/disable": oaObject{
+			"post": oaObject{
+				"summary":     "Disable an auth backend until enabled again or the server restarts",
+				"operationId": "adminDisableBackend",
+				"security":    oaBearer,
+				"parameters": []oaObject{
+					oaParam("path", "name", "Authenticator name", "string", true),
+					oaQuery("reason", "Reason for disabling", "string"),
+				},
+				"responses": oaObject{
+					"200": oaJSON("Backend status", oaRef("BackendStatus")),
+					"403": oaError("Not an admin"),
+					"404": oaError("Unknown authenticator"),
+				},
+			},
+		},
+		"/v1/admin/backends/{name}/enable": oaObject{
+			"post": oaObject{
+				"summary":     "Enable a disabled auth backend",
+				"operationId": "adminEnableBackend",
+				"security":    oaBearer,
+				"parameters":  []oaObject{oaParam("path", "name", "Authenticator name", "string", true)},
+				"responses": oaObject{
+					"200": oaJSON("Backend status", oaRef("BackendStatus")),
+					"403": oaError("Not an admin"),
+					"404": oaError("Unknown authenticator"),
+				},
+			},
+		},
+		"/v1/admin/backends/{name}/probe": oaObject{
+			"post": oaObject{
+				"summary":     "Test connectivity to the service behind an auth backend",
+				"operationId": "adminProbeBackend",
+				"security":    oaBearer,
+				"parameters":  []oaObject{oaParam("path", "name", "Authenticator name", "string", true)},
+				"responses": oaObject{
+					"200": oaJSON("Probe result", oaRef("BackendProbeResult")),
+					"403": oaError("Not an admin"),
+					"404": oaError("Unknown authenticator"),
+					"501": oaError("Probing is not supported by the backend"),
+				},
+			},
+		},
+		"/v1/admin/reload": oaObject{
+			"post": oaObject{
+				"summary":     "Reload the server configuration",
+				"operationId": "adminReload",
+				"security":    oaBearer,
+				"responses": oaObject{
+					"204": oaObject{"description": "Reloaded"},
+					"403": oaError("Not an admin"),
+					"500": oaError("Reload failed, the previous configuration is kept"),
+				},
+			},
+		},
+		"/v1/admin/lockouts/unlock": oaObject{
+			"post": oaObject{
+				"summary":     "Lift the lockout after failed logins of a user or address",
+				"operationId": "adminUnlock",
+				"security":    oaBearer,
+				"parameters": []oaObject{
+					oaQuery("user", "User name", "string"),
+					oaQuery("address", "Source address", "string"),
+				},
+				"responses": oaObject{
+					"204": oaObject{"description": "Unlocked"},
+					"400": oaError("Neither user nor address given"),
+					"403": oaError("Not an admin"),
+				},
+			},
+		},
+		"/v1/admin/ca/rotation": oaObject{
+			"get": oaObject{
+				"summary":     "Show the CA key rotation status",
+				"operationId": "adminGetCARotation",
+				"security":    oaBearer,
+				"responses": oaObject{
+					"200": oaJSON("Rotation status", oaRef("CARotationStatus")),
+					"403": oaError("Not an admin"),
+					"404": oaError("CA rotation is not enabled"),
+				},
+			},
+			"post": oaObject{
+				"summary":     "Start rotating the default CA key",
+				"operationId": "adminStartCARotation",
+				"security":    oaBearer,
+				"requestBody": oaObject{
+					"content": oaObject{"application/json": oaObject{"schema": oaRef("CARotationRequest")}},
+				},
+				"responses": oaObject{
+					"201": oaJSON("Next CA key", oaRef("CAKeyInfo")),
+					"400": oaError("Invalid request or key"),
+					"403": oaError("Not an admin"),
+					"404": oaError("CA rotation is not enabled"),
+					"409": oaError("Rotation already in progress"),
+				},
+			},
+			"delete": oaObject{
+				"summary":     "Cancel a pending CA key rotation",
+				"operationId": "adminCancelCARotation",
+				"security":    oaBearer,
+				"responses": oaObject{
+					"204": oaObject{"description": "Cancelled"},
+					"403": oaError("Not an admin"),
+					"404": oaError("CA rotation is not enabled"),
+					"409": oaError("No rotation in progress"),
+				},
+			},
+		},
+		"/v1/admin/ca/rotation/retire": oaObject{
+			"post": oaObject{
+				"summary":     "Retire the previous CA key after the cutover",
+				"operationId": "adminRetireCAKey",
+				"security":    oaBearer,
+				"responses": oaObject{
+					"200": oaJSON("Retired CA key", oaRef("CAKeyInfo")),
+					"403": oaError("Not an admin"),
+					"404": oaError("CA rotation is not enabled"),
+					"409": oaError("No rotation in progress or cutover not reached"),
+				},
+			},
+		},
+		"/v1/admin/maintenance": oaObject{
+			"get": oaObject{
+				"summary":     "Get the maintenance mode",
+				"operationId": "adminGetMaintenance",
+				"security":    oaBearer,
+				"responses": oaObject{
+					"200": oaJSON("Maintenance mode", oaRef("MaintenanceStatus")),
+					"403": oaError("Not an admin"),
+				},
+			},
+			"post": oaObject{
+				"summary": "Enable the maintenance mode",
+				"description": "New signing requests are refused on all replicas. Health, trust bundle, " +
+					"login and token introspection requests are still served.",
+				"operationId": "adminEnableMaintenance",
+				"security":    oaBearer,
+				"parameters":  []oaObject{oaQuery("reason", "Reason shown to refused clients", "string")},
+				"responses": oaObject{
+					"200": oaJSON("Maintenance mode", oaRef("MaintenanceStatus")),
+					"403": oaError("Not an admin"),
+				},
+			},
+			"delete": oaObject{
+				"summary":     "Disable the maintenance mode",
+				"operationId": "adminDisableMaintenance",
+				"security":    oaBearer,
+				"responses": oaObject{
+					"200": oaJSON("Maintenance mode", oaRef("MaintenanceStatus")),
+					"403": oaError("Not an admin"),
+				},
+			},
+		},
+		"/v1/approvals": oaObject{
+			"get": oaObject{
+				"summary":     "List approval requests. Approvers see all requests, other users their own",
+				"operationId": "listApprovals",
+				"security":    oaBearer,
+				"parameters": []oaObject{
+					oaQuery("status", "Only requests with the status: pending, approved or denied", "string"),
+				},
+				"responses": oaObject{
+					"200": oaJSON("Approval requests", oaObject{"type": "array", "items": oaRef("ApprovalRequest")}),
+					"401": oaError("Missing or invalid token"),
+					"404": oaError("Approvals are not enabled"),
+				},
+			},
+		},
+		"/v1/approvals/{id}": oaObject{
+			"get": oaObject{
+				"summary":     "Show an approval request",
+				"operationId": "getApproval",
+				"security":    oaBearer,
+				"parameters":  []oaObject{oaParam("path", "id", "Approval request ID", "string", true)},
+				"responses": oaObject{
+					"200": oaJSON("Approval request", oaRef("ApprovalRequest")),
+					"401": oaError("Missing or invalid token"),
+					"404": oaError("Approval request not found"),
+				},
+			},
+		},
+		"/v1/approvals/{id}/approve": oaApprovalDecision("approveApproval", "Approve a pending request"),
+		"/v1/approvals/{id}/deny":    oaApprovalDecision("denyApproval", "Deny a pending request"),
+		"/v1/introspect": oaObject{
+			"post": oaObject{
+				"summary":     "Describe an auth token and its signing entitlements",
+				"operationId": "introspect",
+				"security":    oaBearer,
+				"requestBody": oaObject{
+					"description": "Token to inspect, the caller's own token if empty",
+					"content":     oaObject{"application/json": oaObject{"schema": oaRef("IntrospectRequest")}},
+				},
+				"responses": oaObject{
+					"200": oaJSON("Token details. Invalid tokens are reported as inactive", oaRef("IntrospectResponse")),
+					"401": oaError("Missing or invalid token"),
+				},
+			},
+		},
+		"/v1/openapi.json": oaObject{
+			"get": oaObject{
+				"summary":     "This document",
+				"operationId": "openAPI",
+				"responses":   oaObject{"200": oaJSON("OpenAPI document", oaObject{"type": "object"})},
+			},
+		},
+	}
+
+	schemas := oaObject{
+		"Problem": oaObject{
+			"type":     "object",
+			"required": []string{"type", "title", "status", "code"},
+			"properties": oaObject{
+				"type":          oaObject{"type": "string"},
+				"title":         oaObject{"type": "string"},
+				"status":        oaObject{"type": "integer"},
+				"detail":        oaObject{"type": "string"},
+				"instance":      oaObject{"type": "string"},
+				"code":          oaObject{"type": "string", "description": "Stable machine readable error code"},
+				"requestId":     oaObject{"type": "string"},
+				"correlationId": oaObject{"type": "string"},
+				"auditId":       oaObject{"type": "string"},
+				"stepUpBackends": oaObject{
+					"type":        "array",
+					"items":       oaObject{"type": "string"},
+					"description": "Auth backends satisfying a step-up",
+				},
+			},
+		},
+		"DiscoverResult": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"authenticatorName":           oaObject{"type": "string"},
+				"authenticatorRealm":          oaObject{"type": "string"},
+				"authenticatorCredentialType": oaObject{"type": "string", "enum": []string{"user_password", "pin", "federated", "negotiate", "client_cert", "bearer_token", "ssh_key"}},
+				"default":                     oaObject{"type": "boolean"},
+				"health":                      oaObject{"type": "string", "enum": []string{"up", "down"}},
+			},
+		},
+		"EnrollResult": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"secret": oaObject{"type": "string"},
+				"uri":    oaObject{"type": "string"},
+			},
+		},
+		"RevokeRequest": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"serial":      oaObject{"type": "integer", "format": "uint64"},
+				"keyId":       oaObject{"type": "string"},
+				"fingerprint": oaObject{"type": "string"},
+				"reason":      oaObject{"type": "string"},
+			},
+		},
+		"CertificateRecord": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"serial":            oaObject{"type": "integer", "format": "uint64"},
+				"keyId":             oaObject{"type": "string"},
+				"type":              oaObject{"type": "string", "enum": []string{"user", "host"}},
+				"subject":           oaObject{"type": "string"},
+				"principals":        stringArray,
+				"validAfter":        dateTime,
+				"validBefore":       dateTime,
+				"pubkeyFingerprint": oaObject{"type": "string"},
+				"caFingerprint":     oaObject{"type": "string"},
+				"authenticators":    stringArray,
+				"auditId":           oaObject{"type": "string"},
+				"remoteAddress":     oaObject{"type": "string"},
+				"issuedAt":          dateTime,
+				"certificate":       oaObject{"type": "string"},
+			},
+		},
+		"BootstrapToken": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"id":         oaObject{"type": "string"},
+				"hostnames":  stringArray,
+				"created_by": oaObject{"type": "string"},
+				"created_at": dateTime,
+				"expires":    dateTime,
+				"uses_left":  oaObject{"type": "integer"},
+			},
+		},
+		"BootstrapTokenRequest": oaObject{
+			"type":     "object",
+			"required": []string{"hostnames"},
+			"properties": oaObject{
+				"hostnames": stringArray,
+				"ttl":       oaObject{"type": "string", "description": "Go duration, e.g. 24h"},
+				"uses":      oaObject{"type": "integer"},
+			},
+		},
+		"BackendStatus": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"name":           oaObject{"type": "string"},
+				"type":           oaObject{"type": "string"},
+				"realm":          oaObject{"type": "string"},
+				"credentialType": oaObject{"type": "string"},
+				"default":        oaObject{"type": "boolean"},
+				"enabled":        oaObject{"type": "boolean"},
+				"disabledBy":     oaObject{"type": "string"},
+				"disabledAt":     dateTime,
+				"reason":         oaObject{"type": "string"},
+				"probe":          oaObject{"type": "boolean"},
+				"health":         oaRef("BackendHealth"),
+				"circuit":        oaObject{"type": "string", "enum": []string{"closed", "open", "half_open"}},
+			},
+		},
+		"BackendHealth": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"name":     oaObject{"type": "string"},
+				"status":   oaObject{"type": "string", "enum": []string{"up", "down"}},
+				"error":    oaObject{"type": "string"},
+				"checked":  dateTime,
+				"since":    dateTime,
+				"duration": oaObject{"type": "string"},
+			},
+		},
+		"BackendProbeResult": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"name":     oaObject{"type": "string"},
+				"success":  oaObject{"type": "boolean"},
+				"error":    oaObject{"type": "string"},
+				"duration": oaObject{"type": "string"},
+			},
+		},
+		"CARotationRequest": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"privateKey": oaObject{"type": "string", "description": "PEM encoded key, generated if empty"},
+				"cutover":    dateTime,
+			},
+		},
+		"CAKeyInfo": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"fingerprint": oaObject{"type": "string"},
+				"publicKey":   oaObject{"type": "string"},
+			},
+		},
+		"MaintenanceStatus": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"enabled":   oaObject{"type": "boolean"},
+				"enabledBy": oaObject{"type": "string"},
+				"enabledAt": dateTime,
+				"reason":    oaObject{"type": "string"},
+			},
+		},
+		"CARotationStatus": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"signing":   oaRef("CAKeyInfo"),
+				"next":      oaRef("CAKeyInfo"),
+				"cutover":   dateTime,
+				"startedBy": oaObject{"type": "string"},
+				"startedAt": dateTime,
+				"retired": oaObject{
+					"type": "array",
+					"items": oaObject{
+						"type": "object",
+						"properties": oaObject{
+							"fingerprint": oaObject{"type": "string"},
+							"publicKey":   oaObject{"type": "string"},
+							"retiredAt":   dateTime,
+							"retiredBy":   oaObject{"type": "string"},
+						},
+					},
+				},
+			},
+		},
+		"IntrospectRequest": oaObject{
+			"type":       "object",
+			"properties": oaObject{"token": oaObject{"type": "string"}},
+		},
+		"IntrospectResponse": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"active":              oaObject{"type": "boolean"},
+				"complete":            oaObject{"type": "boolean"},
+				"subject":             oaObject{"type": "string"},
+				"audience":            oaObject{"type": "string"},
+				"issuer":              oaObject{"type": "string"},
+				"backends":            stringArray,
+				"issuedAt":            dateTime,
+				"expires":             dateTime,
+				"principals":          stringArray,
+				"criticalOptions":     stringMap,
+				"extensions":          stringMap,
+				"policy":              oaObject{"type": "string"},
+				"defaultCertLifetime": oaObject{"type": "string", "description": "Go duration, used when no expiry is requested"},
+				"minCertLifetime":     oaObject{"type": "string", "description": "Go duration"},
+				"maxCertLifetime":     oaObject{"type": "string", "description": "Go duration, e.g. 24h0m0s"},
+				"claims":              oaObject{"type": "object", "description": "Auth context values copied into the token"},
+			},
+		},
+		"ApprovalRequest": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"id":                  oaObject{"type": "string"},
+				"status":              oaObject{"type": "string", "enum": []string{"pending", "approved", "denied"}},
+				"requester":           oaObject{"type": "string"},
+				"principals":          stringArray,
+				"sensitivePrincipals": stringArray,
+				"fingerprint":         oaObject{"type": "string"},
+				"ca":                  oaObject{"type": "string"},
+				"validBefore":         dateTime,
+				"createdAt":           dateTime,
+				"expires":             dateTime,
+				"decidedBy":           oaObject{"type": "string"},
+				"decidedAt":           dateTime,
+				"comment":             oaObject{"type": "string"},
+			},
+		},
+		"ApprovalDecision": oaObject{
+			"type":       "object",
+			"properties": oaObject{"comment": oaObject{"type": "string"}},
+		},
+		"FederationSignRequest": oaObject{
+			"type":     "object",
+			"required": []string{"publicKey", "principals", "validAfter", "validBefore"},
+			"properties": oaObject{
+				"publicKey":       oaObject{"type": "string"},
+				"certType":        oaObject{"type": "string", "enum": []string{"user", "host"}},
+				"keyId":           oaObject{"type": "string"},
+				"principals":      stringArray,
+				"validAfter":      dateTime,
+				"validBefore":     dateTime,
+				"criticalOptions": stringMap,
+				"extensions":      stringMap,
+				"ca":              oaObject{"type": "string"},
+				"subject":         oaObject{"type": "string"},
+				"authenticators":  stringArray,
+				"auditId":         oaObject{"type": "string"},
+			},
+		},
+		"BootstrapTokenResponse": oaObject{
+			"type": "object",
+			"properties": oaObject{
+				"token":     oaObject{"type": "string"},
+				"id":        oaObject{"type": "string"},
+				"hostnames": stringArray,
+				"expires":   dateTime,
+				"uses":      oaObject{"type": "integer"},
+			},
+		},
+	}
+
+	return oaObject{
+		"openapi": "3.0.3",
+		"info": oaObject{
+			"title":   "ssh-inscribe signing API",
+			"version": globals.Version().String(),
+		},
+		"paths": paths,
+		"components": oaObject{
+			"schemas": schemas,
+			"securitySchemes": oaObject{
+				"basic": oaObject{"type": "http", "scheme": "basic"},
+				"bearer": oaObject{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        "X-Auth",
+					"description": "Token from the login endpoint as \"Bearer <token>\"",
+				},
+				"bootstrapToken": oaObject{"type": "apiKey", "in": "header", "name": BootstrapTokenHeader},
+				"federationAssertion": oaObject{
+					"type":        "apiKey",
+					"in":          "header",
+					"name":        FederationAssertionHeader,
+					"description": "HS256 JWT issued by the frontend with the key shared with this instance",
+				},
+			},
+		},
+	}
+}
+
+func oaRef429() oaObject {
+	return oaObject{
+		"description": "Rate limit exceeded",
+		"headers":     oaObject{"Retry-After": oaObject{"schema": oaObject{"type": "integer"}}},
+		"content":     oaObject{"text/plain": oaObject{"schema": oaObject{"type": "string"}}},
+	}
+}
+
+func oaApprovalDecision(operationID, summary string) oaObject {
+	return oaObject{
+		"post": oaObject{
+			"summary":     summary,
+			"operationId": operationID,
+			"security":    oaBearer,
+			"parameters":  []oaObject{oaParam("path", "id", "Approval request ID", "string", true)},
+			"requestBody": oaObject{
+				"content": oaObject{"application/json": oaObject{"schema": oaRef("ApprovalDecision")}},
+			},
+			"responses": oaObject{
+				"200": oaJSON("Decided approval request", oaRef("ApprovalRequest")),
+				"403": oaError("Not an approver or deciding on own request"),
+				"404": oaError("Approval request not found"),
+				"409": oaError("Approval request is not pending"),
+			},
+		},
+	}
+}
+
+func oaCallback(operationID string) oaObject {
+	return oaObject{
+		"summary":     "Federated login callback from the identity provider or a login page",
+		"operationId": operationID,
+		"parameters":  []oaObject{oaParam("path", "name", "Authenticator name", "string", true)},
+		"responses": oaObject{
+			"200": oaText("Login completed"),
+			"400": oaError("Invalid callback"),
+			"404": oaError("Unknown authenticator"),
+		},
+	}
+}
+
+func (sa *SignApi) HandleOpenAPI(c echo.Context) error {
+	return c.JSON(http.StatusOK, openAPISpec())
+}
@@ -0,0 +1,216 @@
+package signapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// External policy decision point consulted before signing user certificates.
+// The request is signed like the audit webhooks
+type PolicyHook struct {
+	URL     string
+	Secret  []byte
+	Headers map[string]string
+	Timeout time.Duration
+	// Sign without the decision when the hook cannot be reached or fails.
+	// Signing is refused by default
+	FailOpen bool
+}
+
+// Certificate parameters in the policy hook request and mutations in the
+// response
+type PolicyHookCertificate struct {
+	KeyID           string            `json:"key_id,omitempty"`
+	Principals      []string          `json:"principals,omitempty"`
+	CriticalOptions map[string]string `json:"critical_options,omitempty"`
+	Extensions      map[string]string `json:"extensions,omitempty"`
+	ValidAfter      *time.Time        `json:"valid_after,omitempty"`
+	ValidBefore     *time.Time        `json:"valid_before,omitempty"`
+}
+
+// Sent to the policy hook
+type PolicyHookRequest struct {
+	Subject        string                 `json:"subject"`
+	Principals     []string               `json:"principals"`
+	Groups         []string               `json:"groups,omitempty"`
+	Authenticators []string               `json:"authenticators"`
+	Meta           map[string]interface{} `json:"meta,omitempty"`
+	RemoteAddress  string                 `json:"remote_address"`
+	CA             string                 `json:"ca,omitempty"`
+	Policy         string                 `json:"policy,omitempty"`
+	PublicKey      string                 `json:"public_key"`
+	// Type of the public key, e.g. ssh-ed25519
+	PublicKeyType string                `json:"public_key_type"`
+	Certificate   PolicyHookCertificate `json:"certificate"`
+}
+
+// Expected from the policy hook. Fields of the certificate left out are not
+// changed. Principals and options are replaced as a whole and the validity can
+// only be shortened
+type PolicyHookResponse struct {
+	Allowed     bool                   `json:"allowed"`
+	Reason      string                 `json:"reason"`
+	Certificate *PolicyHookCertificate `json:"certificate"`
+}
+
+type policyHook struct {
+	PolicyHook
+	client *http.Client
+}
+
+// Consult the policy hook before signing user certificates, nil disables
+func (sa *SignApi) SetPolicyHook(h *PolicyHook) error {
+	if h == nil {
+		sa.policyHook = nil
+		return nil
+	}
+	if h.URL == "" {
+		return errors.New("policy hook url is not set")
+	}
+	sa.policyHook = &policyHook{
+		PolicyHook: *h,
+		client:     &http.Client{Timeout: h.Timeout},
+	}
+	return nil
+}
+
+func (ph *policyHook) call(c echo.Context, pr *PolicyHookRequest) (*PolicyHookResponse, error) {
+	data, _ := json.Marshal(pr)
+	req, err := http.NewRequest(http.MethodPost, ph.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot create request")
+	}
+	for k, v := range ph.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	setRequestHeaders(c, req.Header)
+	if len(ph.Secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(audit.WebhookTimestampHeader, ts)
+		req.Header.Set(audit.WebhookSignatureHeader, "sha256="+audit.WebhookSignature(ph.Secret, ts, data))
+	}
+	resp, err := ph.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "policy hook request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("policy hook returned %s", resp.Status)
+	}
+	var r PolicyHookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, errors.Wrap(err, "invalid policy hook response")
+	}
+	return &r, nil
+}
+
+// Apply the mutations of the response to the certificate
+func (ph *PolicyHookCertificate) apply(cert *ssh.Certificate) error {
+	if ph.KeyID != "" {
+		cert.KeyId = ph.KeyID
+	}
+	if ph.Principals != nil {
+		if len(ph.Principals) == 0 {
+			return errors.New("policy hook removed all principals")
+		}
+		cert.ValidPrincipals = ph.Principals
+	}
+	if ph.CriticalOptions != nil {
+		cert.CriticalOptions = ph.CriticalOptions
+	}
+	if ph.Extensions != nil {
+		cert.Extensions = ph.Extensions
+	}
+	if ph.ValidAfter != nil {
+		if va := ph.ValidAfter.Unix(); va > int64(cert.ValidAfter) {
+			cert.ValidAfter = uint64(va)
+		}
+	}
+	if ph.ValidBefore != nil {
+		if vb := ph.ValidBefore.Unix(); vb < int64(cert.ValidBefore) {
+			cert.ValidBefore = uint64(vb)
+		}
+	}
+	if cert.ValidBefore <= cert.ValidAfter {
+		return errors.New("policy hook left the certificate without validity")
+	}
+	return nil
+}
+
+func unixTime(v uint64) *time.Time {
+	t := time.Unix(int64(v), 0).UTC()
+	return &t
+}
+
+// Ask the policy hook to allow, deny or mutate the certificate
+func (sa *SignApi) checkPolicyHook(c echo.Context, actx *auth.AuthContext, cert *ssh.Certificate, caName string) error {
+	if sa.policyHook == nil {
+		return nil
+	}
+	log := requestLog(c).
+		WithField("subject", actx.GetSubjectName())
+	policyName, _ := c.Get(ctxPolicy).(string)
+	pr := &PolicyHookRequest{
+		Subject:        actx.GetSubjectName(),
+		Principals:     actx.GetPrincipals(),
+		Groups:         actx.GetGroups(),
+		Authenticators: actx.GetAuthenticators(),
+		Meta:           actx.GetAuthMeta(),
+		RemoteAddress:  c.RealIP(),
+		CA:             caName,
+		Policy:         policyName,
+		PublicKey:      strings.TrimSpace(string(ssh.MarshalAuthorizedKey(cert.Key))),
+		PublicKeyType:  cert.Key.Type(),
+		Certificate: PolicyHookCertificate{
+			KeyID:           cert.KeyId,
+			Principals:      cert.ValidPrincipals,
+			CriticalOptions: cert.CriticalOptions,
+			Extensions:      cert.Extensions,
+			ValidAfter:      unixTime(cert.ValidAfter),
+			ValidBefore:     unixTime(cert.ValidBefore),
+		},
+	}
+	r, err := sa.policyHook.call(c, pr)
+	if err != nil {
+		if sa.policyHook.FailOpen {
+			log.WithError(err).Warn("policy hook failed, signing without a decision")
+			return nil
+		}
+		log.WithError(err).Error("policy hook failed")
+		auditCertificateDenied(c, actx, cert, "policy hook failed")
+		return newProblem(http.StatusForbidden, objects.ErrorPolicyUnavailable, "policy decision is not available")
+	}
+	if !r.Allowed {
+		reason := "denied by policy hook"
+		if r.Reason != "" {
+			reason += ": " + r.Reason
+		}
+		log.WithField("reason", r.Reason).Info("policy hook denied signing")
+		auditCertificateDenied(c, actx, cert, reason)
+		return newProblem(http.StatusForbidden, objects.ErrorPolicyDenied, reason)
+	}
+	if r.Certificate != nil {
+		if err := r.Certificate.apply(cert); err != nil {
+			log.WithError(err).Warn("invalid policy hook mutation")
+			auditCertificateDenied(c, actx, cert, err.Error())
+			return newProblem(http.StatusForbidden, objects.ErrorPolicyDenied, err.Error())
+		}
+		log.
+			WithField("principals", cert.ValidPrincipals).
+			WithField("expires", time.Unix(int64(cert.ValidBefore), 0)).
+			Info("policy hook modified the certificate")
+	}
+	return nil
+}
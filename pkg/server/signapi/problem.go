@@ -0,0 +1,78 @@
+package signapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/labstack/echo/v4"
+)
+
+// Error codes of responses without a specific code
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:            objects.ErrorBadRequest,
+	http.StatusUnauthorized:          objects.ErrorUnauthorized,
+	http.StatusForbidden:             objects.ErrorForbidden,
+	http.StatusNotFound:              objects.ErrorNotFound,
+	http.StatusMethodNotAllowed:      objects.ErrorMethodNotAllowed,
+	http.StatusConflict:              objects.ErrorConflict,
+	http.StatusRequestEntityTooLarge: objects.ErrorPayloadTooLarge,
+	http.StatusTooManyRequests:       objects.ErrorRateLimited,
+	http.StatusInternalServerError:   objects.ErrorInternal,
+	http.StatusBadGateway:            objects.ErrorBadGateway,
+	http.StatusServiceUnavailable:    objects.ErrorUnavailable,
+	http.StatusGatewayTimeout:        objects.ErrorTimeout,
+}
+
+// Return an error with a specific error code
+func newProblem(status int, code, detail string) *echo.HTTPError {
+	return echo.NewHTTPError(status, &objects.Problem{Code: code, Detail: detail})
+}
+
+// Render errors as problem details. Errors other than echo.HTTPError are
+// reported as internal errors without details
+func HTTPErrorHandler(err error, c echo.Context) {
+	p := &objects.Problem{Status: http.StatusInternalServerError}
+	if he, ok := err.(*echo.HTTPError); ok {
+		p.Status = he.Code
+		switch m := he.Message.(type) {
+		case *objects.Problem:
+			p.Code = m.Code
+			p.Detail = m.Detail
+			p.StepUpBackends = m.StepUpBackends
+		case string:
+			p.Detail = m
+		case error:
+			p.Detail = m.Error()
+		default:
+			p.Detail = fmt.Sprint(m)
+		}
+	}
+	if p.Code == "" {
+		p.Code = statusErrorCodes[p.Status]
+	}
+	if p.Code == "" {
+		p.Code = objects.ErrorUnknown
+	}
+	p.Type = objects.ProblemTypePrefix + p.Code
+	p.Title = http.StatusText(p.Status)
+	if p.Detail == "" || p.Detail == p.Title {
+		p.Detail = ""
+	}
+	p.Instance = c.Request().URL.Path
+	p.RequestID = requestID(c)
+	p.CorrelationID = correlationID(c)
+	p.AuditID = c.Response().Header().Get(echo.HeaderXRequestID)
+
+	if c.Response().Committed {
+		return
+	}
+	if c.Request().Method == echo.HEAD {
+		c.NoContent(p.Status)
+		return
+	}
+	c.Response().Header().Set(echo.HeaderContentType, objects.MIMEProblemJSON)
+	c.Response().WriteHeader(p.Status)
+	json.NewEncoder(c.Response()).Encode(p)
+}
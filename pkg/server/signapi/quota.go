@@ -0,0 +1,104 @@
+package signapi
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/certdb"
+	"github.com/aakso/ssh-inscribe/pkg/revocation"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+type CertificateQuota struct {
+	// Maximum number of valid, non-revoked user certificates per subject
+	MaxActive int
+	// Revoke the oldest certificates to make room instead of refusing
+	RevokeOldest bool
+}
+
+// Limit the number of concurrently valid certificates per user. Requires
+// the certificate store, and the revocation store for RevokeOldest
+func (sa *SignApi) SetCertificateQuota(q CertificateQuota) error {
+	if q.MaxActive <= 0 {
+		sa.quota = nil
+		return nil
+	}
+	if sa.certs == nil {
+		return errors.New("certificate quota requires the certificate database")
+	}
+	if q.RevokeOldest && sa.revocations == nil {
+		return errors.New("revoking the oldest certificates requires the revocation store")
+	}
+	sa.quota = &q
+	return nil
+}
+
+func (sa *SignApi) isRecordRevoked(r *certdb.Record) bool {
+	if sa.revocations == nil {
+		return false
+	}
+	// Revocations by public key are not checked as the record only has the
+	// fingerprint
+	return sa.revocations.IsRevoked(&ssh.Certificate{Serial: r.Serial, KeyId: r.KeyID})
+}
+
+// Check the active certificate quota of the user before signing a new one
+func (sa *SignApi) checkQuota(c echo.Context, actx *auth.AuthContext, cert *ssh.Certificate) error {
+	if sa.quota == nil {
+		return nil
+	}
+	log := requestLog(c).
+		WithField("subject", actx.GetSubjectName())
+	records, err := sa.certs.List(certdb.Filter{
+		Subject: actx.GetSubjectName(),
+		ValidAt: time.Now(),
+	})
+	if err != nil {
+		log.WithError(err).Error("cannot list active certificates")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot check certificate quota")
+	}
+	// Newest first
+	var active []*certdb.Record
+	for _, r := range records {
+		if r.Type == "user" && !sa.isRecordRevoked(r) {
+			active = append(active, r)
+		}
+	}
+	excess := len(active) - sa.quota.MaxActive + 1
+	if excess <= 0 {
+		return nil
+	}
+	if !sa.quota.RevokeOldest {
+		msg := fmt.Sprintf("active certificate quota of %d reached, revoke unused certificates first", sa.quota.MaxActive)
+		auditCertificateDenied(c, actx, cert, msg)
+		return newProblem(http.StatusForbidden, objects.ErrorQuotaExceeded, msg)
+	}
+	for _, r := range active[len(active)-excess:] {
+		expires := r.ValidBefore
+		entry := revocation.Entry{
+			Serial:    r.Serial,
+			Reason:    "active certificate quota exceeded",
+			RevokedBy: actx.GetSubjectName(),
+			Expires:   &expires,
+		}
+		if err := sa.revocations.Revoke(entry); err != nil {
+			log.WithError(err).WithField("serial", r.Serial).Error("cannot revoke certificate over quota")
+			return echo.NewHTTPError(http.StatusInternalServerError, "cannot check certificate quota")
+		}
+		log.WithField("serial", r.Serial).WithField("key_id", r.KeyID).Info("revoked oldest certificate over quota")
+		ev := newAuditEvent(c, audit.EventCertificateRevoked)
+		ev.Success = true
+		ev.Subject = entry.RevokedBy
+		ev.Serial = r.Serial
+		ev.KeyID = r.KeyID
+		ev.Reason = entry.Reason
+		audit.Record(ev)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package signapi
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/ratelimit"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	rateLimitLogin = "login"
+	rateLimitSign  = "sign"
+)
+
+// Rate limiters for the login and signing endpoints. Nil limiters are
+// disabled
+type RateLimits struct {
+	LoginPerUser *ratelimit.Limiter
+	LoginPerIP   *ratelimit.Limiter
+	SignPerUser  *ratelimit.Limiter
+	SignPerIP    *ratelimit.Limiter
+}
+
+func (sa *SignApi) SetRateLimits(rl RateLimits) {
+	sa.rateLimits = rl
+}
+
+func (sa *SignApi) limiters(endpoint string) (perUser, perIP *ratelimit.Limiter) {
+	switch endpoint {
+	case rateLimitLogin:
+		return sa.rateLimits.LoginPerUser, sa.rateLimits.LoginPerIP
+	case rateLimitSign:
+		return sa.rateLimits.SignPerUser, sa.rateLimits.SignPerIP
+	}
+	return nil, nil
+}
+
+// User identity for rate limiting: the login user name or the token subject
+func rateLimitUser(c echo.Context) string {
+	if user, _ := c.Get("username").(string); user != "" {
+		return user
+	}
+	if token, _ := c.Get("user").(*jwt.Token); token != nil {
+		if claims, _ := token.Claims.(*SignClaim); claims != nil && claims.AuthContext != nil {
+			return claims.AuthContext.GetSubjectName()
+		}
+	}
+	return ""
+}
+
+func tooManyRequests(c echo.Context, wait time.Duration) error {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(secs))
+	return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+}
+
+// Limit requests per source address and per user identity. Must run after
+// the middlewares resolving the identity
+func (sa *SignApi) rateLimit(endpoint string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			perUser, perIP := sa.limiters(endpoint)
+			if perIP != nil {
+				ip := c.RealIP()
+				if ok, wait := perIP.Allow(ip); !ok {
+					metricRateLimited.WithLabelValues(endpoint, "ip").Inc()
+					requestLog(c).WithField("endpoint", endpoint).WithField("remote_address", ip).Warn("rate limit exceeded")
+					return tooManyRequests(c, wait)
+				}
+			}
+			if perUser != nil {
+				if user := rateLimitUser(c); user != "" {
+					if ok, wait := perUser.Allow(user); !ok {
+						metricRateLimited.WithLabelValues(endpoint, "user").Inc()
+						requestLog(c).WithField("endpoint", endpoint).WithField("user", user).Warn("rate limit exceeded")
+						return tooManyRequests(c, wait)
+					}
+				}
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package signapi
+
+import (
+	"net/http"
+
+	"github.com/aakso/ssh-inscribe/pkg/audit"
+	"github.com/labstack/echo/v4"
+)
+
+// Set the function reloading the server configuration for the admin reload
+// endpoint
+func (sa *SignApi) SetReloader(f func() error) {
+	sa.reloader = f
+}
+
+// Carry over state changed at runtime from the API being replaced on reload
+func (sa *SignApi) KeepRuntimeState(prev *SignApi) {
+	prev.backends.RLock()
+	defer prev.backends.RUnlock()
+	for name, d := range prev.backends.disabled {
+		if _, ok := sa.auth[name]; ok {
+			sa.backends.disable(name, d)
+		}
+	}
+}
+
+func (sa *SignApi) HandleAdminReload(c echo.Context) error {
+	if sa.reloader == nil {
+		return echo.ErrNotFound
+	}
+	subject := adminSubject(c)
+	requestLog(c).
+		WithField("requested_by", subject).
+		Info("configuration reload requested")
+	err := sa.reloader()
+	ev := newAuditEvent(c, audit.EventConfigReloaded)
+	ev.Success = err == nil
+	ev.Subject = subject
+	if err != nil {
+		ev.Reason = err.Error()
+	}
+	audit.Record(ev)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,58 @@
+package signapi
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+)
+
+type ReplayProtection struct {
+	// Each auth token can be used to sign a single certificate
+	SingleUseTokens bool
+	// Tolerated difference between the clocks of the replicas. Used tokens
+	// are remembered this long past their expiry
+	ClockSkew time.Duration
+}
+
+// Reject replayed signing requests. A captured token cannot be used to sign
+// again as the used tokens are tracked in the shared state, so replays are
+// caught by any replica
+func (sa *SignApi) SetReplayProtection(rp ReplayProtection) error {
+	if rp.ClockSkew < 0 {
+		return errors.New("clock skew must not be negative")
+	}
+	sa.replay = &rp
+	return nil
+}
+
+// Mark the auth token used for signing. Called once the request is about to
+// be signed so that approval polling can reuse the token
+func (sa *SignApi) consumeToken(c echo.Context) error {
+	if sa.replay == nil || !sa.replay.SingleUseTokens {
+		return nil
+	}
+	token, _ := c.Get("user").(*jwt.Token)
+	if token == nil {
+		return nil
+	}
+	claims, _ := token.Claims.(*SignClaim)
+	if claims == nil || claims.Id == "" {
+		return echo.NewHTTPError(http.StatusUnauthorized, "token has no id")
+	}
+	ttl := time.Until(time.Unix(claims.ExpiresAt, 0)) + sa.replay.ClockSkew + time.Second
+	fresh, err := sharedstate.Get().SetNX("replay:jti:"+claims.Id, []byte{1}, ttl)
+	if err != nil {
+		requestLog(c).WithError(err).Error("cannot check token use")
+		return echo.NewHTTPError(http.StatusInternalServerError, "cannot check token use")
+	}
+	if !fresh {
+		metricReplaysRejected.WithLabelValues("token").Inc()
+		return newProblem(http.StatusConflict, objects.ErrorTokenReused, "token has already been used to sign")
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package signapi
+
+import (
+	"net/http"
+
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/random"
+	"github.com/sirupsen/logrus"
+)
+
+// Request and correlation ids are stored in the request context
+const (
+	ctxRequestID     = "request_id"
+	ctxCorrelationID = "correlation_id"
+
+	maxCorrelationIDLen = 128
+)
+
+// Generate an id for every request and accept the correlation id of the
+// client. Both are returned in the response headers. The correlation id
+// defaults to the request id when the client does not send a valid one
+func RequestID() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			rid := random.String(32)
+			cid := c.Request().Header.Get(objects.CorrelationIDHeader)
+			if !validCorrelationID(cid) {
+				cid = rid
+			}
+			c.Set(ctxRequestID, rid)
+			c.Set(ctxCorrelationID, cid)
+			c.Response().Header().Set(objects.RequestIDHeader, rid)
+			c.Response().Header().Set(objects.CorrelationIDHeader, cid)
+			return next(c)
+		}
+	}
+}
+
+// Correlation ids are limited to printable ASCII without spaces so that they
+// are safe to log and to forward
+func validCorrelationID(s string) bool {
+	if s == "" || len(s) > maxCorrelationIDLen {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func requestID(c echo.Context) string {
+	v, _ := c.Get(ctxRequestID).(string)
+	return v
+}
+
+func correlationID(c echo.Context) string {
+	v, _ := c.Get(ctxCorrelationID).(string)
+	return v
+}
+
+// Ids identifying the request in the logs
+func requestFields(c echo.Context) logrus.Fields {
+	f := logrus.Fields{}
+	if v := c.Response().Header().Get(echo.HeaderXRequestID); v != "" {
+		f["audit_id"] = v
+	}
+	if v := requestID(c); v != "" {
+		f["request_id"] = v
+	}
+	if v := correlationID(c); v != "" {
+		f["correlation_id"] = v
+	}
+	return f
+}
+
+// Logger with the ids of the request
+func requestLog(c echo.Context) *logrus.Entry {
+	return Log.WithFields(requestFields(c))
+}
+
+// Forward the ids of the request to an outgoing call
+func setRequestHeaders(c echo.Context, h http.Header) {
+	if v := correlationID(c); v != "" {
+		h.Set(objects.CorrelationIDHeader, v)
+	}
+	if v := requestID(c); v != "" {
+		h.Set(objects.RequestIDHeader, v)
+	}
+}
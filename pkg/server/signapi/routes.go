@@ -1,6 +1,10 @@
 package signapi
 
 import (
+	"net/http"
+	"reflect"
+	"strings"
+
 	"github.com/aakso/ssh-inscribe/pkg/auth"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo/v4"
@@ -9,19 +13,101 @@ import (
 )
 
 func (sa *SignApi) RegisterRoutes(g *echo.Group) {
+	sa.RegisterPublicRoutes(g)
+	sa.RegisterAdminRoutes(g)
+}
+
+// Routes other than /admin
+func (sa *SignApi) RegisterPublicRoutes(g *echo.Group) {
 	g.GET("/auth", sa.HandleAuthDiscover)
 	g.POST("/auth/:name",
 		sa.HandleLogin,
+		sa.limitRequests(rateLimitLogin),
 		userPasswordForward(sa.LoginUserPasswordAuthSkipper),
-		jwtAuth(sa.tkey, &SignClaim{}, true),
+		jwtAuth(sa.tokenKeyFunc, &SignClaim{}, true),
 		auditID(),
+		sa.rateLimit(rateLimitLogin),
 	)
+	g.POST("/auth/:name/enroll", sa.HandleEnroll,
+		sa.limitRequests(rateLimitLogin),
+		jwtAuth(sa.tokenKeyFunc, &SignClaim{}, false),
+		auditID(),
+		sa.rateLimit(rateLimitLogin),
+	)
+	g.GET("/auth/:name/page", sa.HandleAuthPage)
 	g.GET("/auth_callback/:name", sa.HandleAuthCallback)
 	g.POST("/auth_callback/:name", sa.HandleAuthCallback)
-	g.POST("/sign", sa.HandleSign, jwtAuth(sa.tkey, &SignClaim{}, false), auditID())
+	g.POST("/sign", sa.HandleSign,
+		countResponses(metricSignRequests),
+		sa.checkSource(rateLimitSign),
+		checkMaintenance(),
+		sa.limitRequests(rateLimitSign),
+		jwtAuth(sa.tokenKeyFunc, &SignClaim{}, false),
+		auditID(),
+		sa.rateLimit(rateLimitSign),
+	)
+	g.POST("/host/sign", sa.HandleHostSign,
+		countResponses(metricSignRequests),
+		sa.checkSource(rateLimitSign),
+		checkMaintenance(),
+		sa.limitRequests(rateLimitSign),
+		jwtAuth(sa.tokenKeyFunc, &SignClaim{}, false),
+		auditID(),
+		sa.rateLimit(rateLimitSign),
+	)
+	g.POST("/host/bootstrap", sa.HandleHostBootstrap,
+		countResponses(metricSignRequests),
+		sa.checkSource(rateLimitSign),
+		checkMaintenance(),
+		sa.limitRequests(rateLimitSign),
+		auditID(),
+		sa.rateLimit(rateLimitSign),
+	)
+	g.POST("/federation/sign", sa.HandleFederationSign,
+		countResponses(metricSignRequests),
+		sa.checkSource(rateLimitSign),
+		checkMaintenance(),
+		sa.limitRequests(rateLimitSign),
+		auditID(),
+	)
 	g.GET("/ca", sa.HandleGetKey)
-	g.POST("/ca", sa.HandleAddKey, jwtAuth(sa.tkey, &SignClaim{}, false), auditID())
+	g.GET("/ca/bundle", sa.HandleGetTrustBundle)
+	g.POST("/ca", sa.HandleAddKey, jwtAuth(sa.tokenKeyFunc, &SignClaim{}, false), auditID())
 	g.GET("/ready", sa.HandleReady)
+	g.GET("/health", sa.HandleHealth)
+	g.GET("/krl", sa.HandleGetKRL)
+	g.GET("/openapi.json", sa.HandleOpenAPI)
+	g.POST("/introspect", sa.HandleIntrospect, jwtAuth(sa.tokenKeyFunc, &SignClaim{}, false), auditID())
+	g.POST("/revoke", sa.HandleRevoke, jwtAuth(sa.tokenKeyFunc, &SignClaim{}, false), auditID())
+
+	g.GET("/approvals", sa.HandleListApprovals, jwtAuth(sa.tokenKeyFunc, &SignClaim{}, false), auditID())
+	g.GET("/approvals/:id", sa.HandleGetApproval, jwtAuth(sa.tokenKeyFunc, &SignClaim{}, false), auditID())
+	g.POST("/approvals/:id/approve", sa.HandleApprove, jwtAuth(sa.tokenKeyFunc, &SignClaim{}, false), auditID())
+	g.POST("/approvals/:id/deny", sa.HandleDeny, jwtAuth(sa.tokenKeyFunc, &SignClaim{}, false), auditID())
+}
+
+// Routes under /admin. May be served on a separate listener
+func (sa *SignApi) RegisterAdminRoutes(g *echo.Group) {
+	admin := g.Group("/admin", sa.checkSource(limitAdmin), sa.limitRequests(limitAdmin), jwtAuth(sa.tokenKeyFunc, &SignClaim{}, false), auditID(), sa.adminOnly())
+	admin.POST("/revoke", sa.HandleAdminRevoke)
+	admin.GET("/certs", sa.HandleAdminListCerts)
+	admin.GET("/certs/:serial", sa.HandleAdminGetCert)
+	admin.POST("/bootstrap_tokens", sa.HandleAdminCreateBootstrapToken)
+	admin.GET("/bootstrap_tokens", sa.HandleAdminListBootstrapTokens)
+	admin.DELETE("/bootstrap_tokens/:id", sa.HandleAdminDeleteBootstrapToken)
+	admin.GET("/backends", sa.HandleAdminListBackends)
+	admin.POST("/backends/:name/disable", sa.HandleAdminDisableBackend)
+	admin.POST("/backends/:name/enable", sa.HandleAdminEnableBackend)
+	admin.POST("/backends/:name/probe", sa.HandleAdminProbeBackend)
+	admin.POST("/reload", sa.HandleAdminReload)
+	admin.POST("/lockouts/unlock", sa.HandleAdminUnlock)
+	admin.GET("/ca/rotation", sa.HandleAdminGetCARotation)
+	admin.POST("/ca/rotation", sa.HandleAdminStartCARotation)
+	admin.DELETE("/ca/rotation", sa.HandleAdminCancelCARotation)
+	admin.POST("/ca/rotation/retire", sa.HandleAdminRetireCAKey)
+	admin.GET("/maintenance", sa.HandleAdminGetMaintenance)
+	admin.POST("/maintenance", sa.HandleAdminEnableMaintenance)
+	admin.DELETE("/maintenance", sa.HandleAdminDisableMaintenance)
 }
 
 func userPasswordForward(skipper middleware.Skipper) echo.MiddlewareFunc {
@@ -35,22 +121,39 @@ func userPasswordForward(skipper middleware.Skipper) echo.MiddlewareFunc {
 	})
 }
 
-func jwtAuth(key []byte, claims jwt.Claims, skipIfMissing bool) echo.MiddlewareFunc {
-	const authHeader = "X-Auth"
-	config := middleware.JWTConfig{
-		SigningKey:  key,
-		TokenLookup: "header:" + authHeader,
-		Claims:      claims,
-	}
-	if skipIfMissing {
-		config.Skipper = func(c echo.Context) bool {
-			if c.Request().Header.Get(authHeader) == "" {
-				return true
+func jwtAuth(keyFunc jwt.Keyfunc, claims jwt.Claims, skipIfMissing bool) echo.MiddlewareFunc {
+	const (
+		authHeader = "X-Auth"
+		authScheme = "Bearer "
+	)
+	claimsType := reflect.ValueOf(claims).Type().Elem()
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			header := c.Request().Header.Get(authHeader)
+			if skipIfMissing && header == "" {
+				return next(c)
+			}
+			if len(header) <= len(authScheme) || !strings.HasPrefix(header, authScheme) {
+				metricTokenValidations.WithLabelValues("missing").Inc()
+				return middleware.ErrJWTMissing
 			}
-			return false
+			// Keys are looked up by the key id of the token so tokens signed
+			// before a key rotation remain valid
+			claims := reflect.New(claimsType).Interface().(jwt.Claims)
+			token, err := jwt.ParseWithClaims(header[len(authScheme):], claims, keyFunc)
+			if err != nil || !token.Valid {
+				metricTokenValidations.WithLabelValues("invalid").Inc()
+				return &echo.HTTPError{
+					Code:     http.StatusUnauthorized,
+					Message:  "invalid or expired jwt",
+					Internal: err,
+				}
+			}
+			metricTokenValidations.WithLabelValues("valid").Inc()
+			c.Set("user", token)
+			return next(c)
 		}
 	}
-	return middleware.JWTWithConfig(config)
 }
 
 func auditID() echo.MiddlewareFunc {
@@ -4,9 +4,16 @@ import (
 	"time"
 
 	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/bootstrap"
+	"github.com/aakso/ssh-inscribe/pkg/carotation"
+	"github.com/aakso/ssh-inscribe/pkg/certdb"
 	"github.com/aakso/ssh-inscribe/pkg/keysigner"
+	"github.com/aakso/ssh-inscribe/pkg/policy"
+	"github.com/aakso/ssh-inscribe/pkg/revocation"
+	"github.com/aakso/ssh-inscribe/pkg/serial"
 	"github.com/aakso/ssh-inscribe/pkg/util"
 	"github.com/dgrijalva/jwt-go"
+	"github.com/gobwas/glob"
 )
 
 const (
@@ -16,16 +23,61 @@ const (
 type AuthenticatorListEntry struct {
 	Authenticator auth.Authenticator
 	Default       bool
+	// Name the clients use for the backend instead of its own. Backends
+	// restricted to different audiences or realms may share it
+	Endpoint string
+}
+
+func (e AuthenticatorListEntry) endpoint() string {
+	if e.Endpoint != "" {
+		return e.Endpoint
+	}
+	return e.Authenticator.Name()
 }
 
 type SignApi struct {
 	auth            map[string]auth.Authenticator
 	authList        []AuthenticatorListEntry
 	defaultAuth     []string
+	authChains      [][]string
+	backendRewrites map[string]*backendPrincipals
 	signer          *keysigner.KeySignerService
-	tkey            []byte
+	tkeys           *TokenKeys
 	defaultCertLife time.Duration
 	maxCertLife     time.Duration
+	revocations     *revocation.Store
+	adminPrincipals []glob.Glob
+	certs           certdb.Store
+	storeCerts      bool
+	serials         serial.Generator
+	hostSigning     *hostSigning
+	bootstrap       *bootstrap.Store
+	policy          *policy.Engine
+	lifetimeLimits  *lifetimeLimits
+	principalMapper auth.Authorizer
+	rateLimits      RateLimits
+	backends        backendState
+	reloader        func() error
+	rotation        *carotation.Store
+	approvals       *approvals
+	frontends       map[string]*federationFrontend
+	upstream        *Upstream
+	tokenPolicy     *TokenPolicy
+	replay          *ReplayProtection
+	requestLimits   map[string]*endpointLimiter
+	networkACL      map[string]*NetworkFilter
+	extensionLimits *extensionLimits
+	principalDeny   []deniedPrincipals
+	issuanceWindows []*issuanceWindow
+	policyHook      *policyHook
+	quota           *CertificateQuota
+	keyIDFormat     string
+	identityExts    map[string]string
+	health          *healthChecks
+	lockout         *Lockout
+	conditions      map[string]*backendConditions
+	stepUps         []stepUp
+	backendLimits   map[string]*backendLimiter
 }
 
 func New(
@@ -45,25 +97,87 @@ func New(
 		auth:            authMap,
 		authList:        authList,
 		signer:          signer,
-		tkey:            tkey,
+		tkeys:           &TokenKeys{secrets: []tokenSecret{newTokenSecret(tkey)}, now: time.Now},
 		defaultCertLife: defaultlife,
 		maxCertLife:     maxlife,
 	}
 }
 
+// Sign the auth tokens with the keys instead of the static key given to New
+func (sa *SignApi) SetTokenKeys(k *TokenKeys) {
+	sa.tkeys = k
+}
+
+func (sa *SignApi) tokenKeyFunc(token *jwt.Token) (interface{}, error) {
+	if err := sa.verifyTokenClaims(token); err != nil {
+		return nil, err
+	}
+	return sa.tkeys.keyFunc(token)
+}
+
+// Enable certificate revocation and the KRL endpoint
+func (sa *SignApi) SetRevocationStore(s *revocation.Store) {
+	sa.revocations = s
+}
+
+// Record issued certificates into the store. If storeCerts is set, the full
+// certificate is stored as well
+func (sa *SignApi) SetCertStore(s certdb.Store, storeCerts bool) {
+	sa.certs = s
+	sa.storeCerts = storeCerts
+}
+
+// Allocate certificate serials from g. Random serials are used if nil
+func (sa *SignApi) SetSerialGenerator(g serial.Generator) {
+	sa.serials = g
+}
+
+func (sa *SignApi) nextSerial() (uint64, error) {
+	if sa.serials == nil {
+		return serial.Random{}.Next()
+	}
+	return sa.serials.Next()
+}
+
+// Enable host bootstrap tokens. Requires host signing to be enabled as well
+func (sa *SignApi) SetBootstrapStore(s *bootstrap.Store) {
+	sa.bootstrap = s
+}
+
+// Map the auth context attributes to principals before signing
+func (sa *SignApi) SetPrincipalMapper(m auth.Authorizer) {
+	sa.principalMapper = m
+}
+
+// Apply certificate policy templates when signing user certificates
+func (sa *SignApi) SetPolicy(e *policy.Engine) {
+	sa.policy = e
+}
+
 type SignClaim struct {
 	AuthContext *auth.AuthContext
+	// Auth context values copied according to the token policy
+	Claims map[string]interface{} `json:"claims,omitempty"`
+	// Audience and realm the client named at login
+	ClientAudience string `json:"clientAudience,omitempty"`
+	ClientRealm    string `json:"clientRealm,omitempty"`
 	jwt.StandardClaims
 }
 
 func (sa *SignApi) makeToken(actx *auth.AuthContext) *jwt.Token {
+	now := time.Now()
 	claims := SignClaim{
 		AuthContext: actx,
+		Claims:      sa.tokenClaims(actx),
 		StandardClaims: jwt.StandardClaims{
 			Id:        util.RandB64(32), // Nonce
-			NotBefore: time.Now().Unix(),
-			ExpiresAt: time.Now().Add(time.Second * TokenLifeSecs).Unix(),
+			NotBefore: now.Unix(),
+			ExpiresAt: now.Add(sa.tokenLifetime(actx)).Unix(),
 		},
 	}
+	if sa.tokenPolicy != nil {
+		claims.Audience = sa.tokenPolicy.Audience
+		claims.Issuer = sa.tokenPolicy.Issuer
+	}
 	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 }
@@ -2,20 +2,47 @@ package signapi
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/aakso/ssh-inscribe/pkg/approval"
+	"github.com/aakso/ssh-inscribe/pkg/audit"
 	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/auth/authz/authzmap"
 	"github.com/aakso/ssh-inscribe/pkg/auth/backend/authmock"
+	"github.com/aakso/ssh-inscribe/pkg/bootstrap"
+	"github.com/aakso/ssh-inscribe/pkg/carotation"
+	"github.com/aakso/ssh-inscribe/pkg/certdb"
 	"github.com/aakso/ssh-inscribe/pkg/keysigner"
 	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/aakso/ssh-inscribe/pkg/policy"
+	"github.com/aakso/ssh-inscribe/pkg/ratelimit"
+	"github.com/aakso/ssh-inscribe/pkg/revocation"
+	"github.com/aakso/ssh-inscribe/pkg/serial"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/crypto/ssh"
@@ -80,6 +107,8 @@ func TestMain(m *testing.M) {
 		},
 	}
 	signapi = New(auths, signer, signingKey, 1*time.Hour, 24*time.Hour)
+	e.HTTPErrorHandler = HTTPErrorHandler
+	e.Use(RequestID())
 	signapi.RegisterRoutes(e.Group("/v1"))
 	// Give keysigner some time to initialize
 	time.Sleep(50 * time.Millisecond)
@@ -151,7 +180,7 @@ func TestLoginLongAuthContext(t *testing.T) {
 		actx = &auth.AuthContext{Parent: actx, Status: auth.StatusCompleted}
 	}
 	token := signapi.makeToken(actx)
-	ss, _ := token.SignedString(signapi.tkey)
+	ss, _ := token.SignedString(signingKey)
 
 	req, _ := http.NewRequest(echo.POST, "/v1/auth/"+authenticator.Name(), nil)
 	req.SetBasicAuth(authenticator.User, string(authenticator.Secret))
@@ -203,6 +232,88 @@ func TestGetKey(t *testing.T) {
 	assert.NotEmpty(rec.Body.String())
 }
 
+func TestTrustBundle(t *testing.T) {
+	assert := assert.New(t)
+	get := func(url, etag string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.GET, url, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	ca := get("/v1/ca", "").Body.String()
+
+	rec := get("/v1/ca/bundle", "")
+	if !assert.Equal(http.StatusOK, rec.Code) {
+		return
+	}
+	assert.Equal(ca, rec.Body.String())
+	etag := rec.Header().Get("ETag")
+	assert.NotEmpty(etag)
+	assert.Equal(http.StatusNotModified, get("/v1/ca/bundle", etag).Code)
+
+	rec = get("/v1/ca/bundle?format=known_hosts&hosts=*.example.com", etag)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		assert.Equal("@cert-authority *.example.com "+ca, rec.Body.String())
+		assert.NotEqual(etag, rec.Header().Get("ETag"))
+	}
+	assert.Equal(http.StatusBadRequest, get("/v1/ca/bundle?format=bogus", "").Code)
+}
+
+func TestMultipleCAs(t *testing.T) {
+	assert := assert.New(t)
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	stagingPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	stagingKey, _ := ssh.NewPublicKey(priv.Public())
+	assert.NoError(signapi.signer.SetNamedKeys(map[string]string{"staging": ssh.FingerprintSHA256(stagingKey)}))
+	defer signapi.signer.SetNamedKeys(nil)
+
+	do := func(method, url string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBuffer(body))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(http.StatusBadRequest, do(echo.POST, "/v1/ca?ca=bogus", stagingPem).Code)
+	assert.Equal(http.StatusAccepted, do(echo.POST, "/v1/ca?ca=staging", stagingPem).Code)
+	assert.Equal(string(ssh.MarshalAuthorizedKey(stagingKey)), do(echo.GET, "/v1/ca?ca=staging", nil).Body.String())
+	assert.Equal(http.StatusBadRequest, do(echo.GET, "/v1/ca?ca=bogus", nil).Code)
+	assert.Len(strings.Split(strings.TrimSpace(do(echo.GET, "/v1/ca/bundle", nil).Body.String()), "\n"), 2)
+	assert.Equal(string(ssh.MarshalAuthorizedKey(stagingKey)), do(echo.GET, "/v1/ca/bundle?ca=staging", nil).Body.String())
+
+	rec := do(echo.POST, "/v1/sign?ca=staging", testUserPublic)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		raw, _, _, _, _ := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		assert.Equal(stagingKey.Marshal(), raw.(*ssh.Certificate).SignatureKey.Marshal())
+
+		// Certificates of any CA key can be revoked by their owner
+		store, _ := revocation.NewStore("")
+		signapi.SetRevocationStore(store)
+		assert.Equal(http.StatusNoContent, do(echo.POST, "/v1/revoke", rec.Body.Bytes()).Code)
+		assert.True(store.IsRevoked(raw.(*ssh.Certificate)))
+		signapi.SetRevocationStore(nil)
+	}
+	assert.Equal(http.StatusBadRequest, do(echo.POST, "/v1/sign?ca=bogus", testUserPublic).Code)
+
+	// Policy restricts and selects the CA
+	pol, _ := policy.New(&policy.Config{
+		Templates:       []policy.TemplateConfig{{Name: "staging", CAs: []string{"staging"}}},
+		DefaultTemplate: "staging",
+	})
+	signapi.SetPolicy(pol)
+	defer signapi.SetPolicy(nil)
+	rec = do(echo.POST, "/v1/sign", testUserPublic)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		raw, _, _, _, _ := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		assert.Equal(stagingKey.Marshal(), raw.(*ssh.Certificate).SignatureKey.Marshal())
+	}
+	assert.Equal(http.StatusForbidden, do(echo.POST, "/v1/sign?ca=default", testUserPublic).Code)
+}
+
 func TestSignCustomExpires(t *testing.T) {
 	assert := assert.New(t)
 	buf := bytes.NewBuffer(testUserPublic)
@@ -235,7 +346,7 @@ func TestSignPendingAuthContext(t *testing.T) {
 		Status: auth.StatusCompleted,
 	}
 	token := signapi.makeToken(actx)
-	ss, _ := token.SignedString(signapi.tkey)
+	ss, _ := token.SignedString(signingKey)
 
 	u, _ := url.Parse("/v1/sign")
 	req, _ := http.NewRequest(echo.POST, u.String(), nil)
@@ -305,3 +416,2910 @@ func TestSignPrincipalFilterExclude(t *testing.T) {
 		assert.NotContains(cert.ValidPrincipals, "fake2")
 	}
 }
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	logins := testutil.ToFloat64(metricAuthAttempts.WithLabelValues(authenticator.Name(), "success"))
+	failures := testutil.ToFloat64(metricAuthAttempts.WithLabelValues(authenticator.Name(), "failure"))
+	valid := testutil.ToFloat64(metricTokenValidations.WithLabelValues("valid"))
+	invalid := testutil.ToFloat64(metricTokenValidations.WithLabelValues("invalid"))
+	signed := testutil.ToFloat64(metricSignRequests.WithLabelValues("200"))
+
+	req, _ := http.NewRequest(echo.POST, "/v1/auth/"+authenticator.Name(), nil)
+	req.SetBasicAuth(authenticator.User, string(authenticator.Secret))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	token := rec.Body.String()
+	req, _ = http.NewRequest(echo.POST, "/v1/auth/"+authenticator.Name(), nil)
+	req.SetBasicAuth(authenticator.User, "wrong")
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+
+	for _, tok := range []string{token, token, "invalid"} {
+		req, _ = http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+tok)
+		rec = httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+	}
+
+	assert.Equal(float64(1), testutil.ToFloat64(metricAuthAttempts.WithLabelValues(authenticator.Name(), "success"))-logins)
+	assert.Equal(float64(1), testutil.ToFloat64(metricAuthAttempts.WithLabelValues(authenticator.Name(), "failure"))-failures)
+	assert.Equal(float64(2), testutil.ToFloat64(metricTokenValidations.WithLabelValues("valid"))-valid)
+	assert.Equal(float64(1), testutil.ToFloat64(metricTokenValidations.WithLabelValues("invalid"))-invalid)
+	assert.Equal(float64(2), testutil.ToFloat64(metricSignRequests.WithLabelValues("200"))-signed)
+}
+
+func TestAudit(t *testing.T) {
+	assert := assert.New(t)
+	buf := new(bytes.Buffer)
+	audit.SetSinks(audit.NewWriterSink(buf))
+	defer audit.SetSinks()
+
+	req, _ := http.NewRequest(echo.POST, "/v1/auth/"+authenticator.Name(), nil)
+	req.SetBasicAuth(authenticator.User, "wrong")
+	req.Header.Set(echo.HeaderXForwardedFor, "192.0.2.1")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+
+	req, _ = http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	exp := time.Now().Add(25 * time.Hour).Format(time.RFC3339)
+	req, _ = http.NewRequest(echo.POST, "/v1/sign?expires="+url.QueryEscape(exp), bytes.NewBuffer(testUserPublic))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusBadRequest, rec.Code)
+
+	dec := json.NewDecoder(buf)
+	var ev audit.Event
+	if assert.NoError(dec.Decode(&ev)) {
+		assert.Equal(audit.EventAuthentication, ev.Type)
+		assert.False(ev.Success)
+		assert.Equal(authenticator.User, ev.UserIdentifier)
+		assert.Equal(authenticator.Name(), ev.Authenticator)
+		assert.Equal("192.0.2.1", ev.RemoteAddress)
+		assert.NotEmpty(ev.AuditID)
+	}
+	ev = audit.Event{}
+	if assert.NoError(dec.Decode(&ev)) {
+		assert.Equal(audit.EventCertificateIssued, ev.Type)
+		assert.True(ev.Success)
+		assert.Equal(authenticator.User, ev.Subject)
+		assert.Contains(ev.Authenticators, authenticator.Name())
+		assert.Subset(ev.Principals, fakeAuthContext.Principals)
+		assert.NotEmpty(ev.PublicKeyFingerprint)
+		if assert.NotNil(ev.ValidBefore) {
+			assert.True(ev.ValidBefore.After(time.Now()))
+		}
+	}
+	ev = audit.Event{}
+	if assert.NoError(dec.Decode(&ev)) {
+		assert.Equal(audit.EventCertificateDenied, ev.Type)
+		assert.False(ev.Success)
+		assert.Contains(ev.Reason, "exceeds the maximum")
+		assert.Equal(authenticator.User, ev.Subject)
+		assert.NotEmpty(ev.PublicKeyFingerprint)
+	}
+}
+
+func TestKRL(t *testing.T) {
+	assert := assert.New(t)
+	req, _ := http.NewRequest(echo.GET, "/v1/krl", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusNotFound, rec.Code)
+
+	store, _ := revocation.NewStore("")
+	signapi.SetRevocationStore(store)
+	defer signapi.SetRevocationStore(nil)
+	assert.NoError(store.Revoke(revocation.Entry{PublicKey: string(testUserPublic)}))
+
+	req, _ = http.NewRequest(echo.GET, "/v1/krl", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.True(bytes.HasPrefix(rec.Body.Bytes(), []byte("SSHKRL\n\x00")))
+
+	req, _ = http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusForbidden, rec.Code)
+}
+
+func TestRevoke(t *testing.T) {
+	assert := assert.New(t)
+	store, _ := revocation.NewStore("")
+	signapi.SetRevocationStore(store)
+	defer signapi.SetRevocationStore(nil)
+
+	req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if !assert.Equal(http.StatusOK, rec.Code) {
+		return
+	}
+	certBytes := rec.Body.Bytes()
+
+	req, _ = http.NewRequest(echo.POST, "/v1/revoke", bytes.NewBuffer(testUserPublic))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusBadRequest, rec.Code)
+
+	req, _ = http.NewRequest(echo.POST, "/v1/revoke?reason=lost", bytes.NewBuffer(certBytes))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusNoContent, rec.Code)
+	if assert.Len(store.Entries(), 1) {
+		entry := store.Entries()[0]
+		assert.Equal("lost", entry.Reason)
+		assert.Equal(authenticator.User, entry.RevokedBy)
+		assert.NotZero(entry.Serial)
+		assert.NotNil(entry.Expires)
+	}
+	raw, _, _, _, _ := ssh.ParseAuthorizedKey(certBytes)
+	assert.True(store.IsRevoked(raw.(*ssh.Certificate)))
+}
+
+func TestAdminRevoke(t *testing.T) {
+	assert := assert.New(t)
+	store, _ := revocation.NewStore("")
+	signapi.SetRevocationStore(store)
+	defer signapi.SetRevocationStore(nil)
+	defer signapi.SetAdminPrincipals(nil)
+
+	body := `{"fingerprint": "SHA256:KUJHQ00IzkEmhH10HO3E7rddgARypH1pJgRH0ODbOHs", "reason": "compromised"}`
+	doRevoke := func() int {
+		req, _ := http.NewRequest(echo.POST, "/v1/admin/revoke", bytes.NewBufferString(body))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.NoError(signapi.SetAdminPrincipals([]string{"admin*"}))
+	assert.Equal(http.StatusForbidden, doRevoke())
+	assert.Len(store.Entries(), 0)
+
+	assert.NoError(signapi.SetAdminPrincipals([]string{"fake?"}))
+	assert.Equal(http.StatusNoContent, doRevoke())
+	if assert.Len(store.Entries(), 1) {
+		assert.Equal("compromised", store.Entries()[0].Reason)
+	}
+
+	body = `{"serial": 1, "keyId": "both"}`
+	assert.Equal(http.StatusBadRequest, doRevoke())
+}
+
+func TestCertStore(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "signapitest")
+	defer os.RemoveAll(dir)
+	store, err := certdb.NewFileStore(path.Join(dir, "certs.jsonl"))
+	if !assert.NoError(err) {
+		return
+	}
+	signapi.SetCertStore(store, true)
+	defer signapi.SetCertStore(nil, false)
+
+	req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if !assert.Equal(http.StatusOK, rec.Code) {
+		return
+	}
+	raw, _, _, _, _ := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+	cert := raw.(*ssh.Certificate)
+	assert.NotZero(cert.Serial)
+
+	r, err := store.Get(cert.Serial)
+	if assert.NoError(err) {
+		assert.Equal(cert.KeyId, r.KeyID)
+		assert.Equal(authenticator.User, r.Subject)
+		assert.Equal(cert.ValidPrincipals, r.Principals)
+		assert.NotEmpty(r.AuditID)
+		assert.Equal(string(rec.Body.Bytes()), r.Certificate)
+	}
+
+	assert.NoError(signapi.SetAdminPrincipals([]string{"fake1"}))
+	defer signapi.SetAdminPrincipals(nil)
+	adminGet := func(url string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.GET, url, nil)
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	var records []certdb.Record
+	rec = adminGet("/v1/admin/certs?valid=true&principal=fake1&user=" + authenticator.User)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &records))
+		assert.Len(records, 1)
+	}
+	rec = adminGet("/v1/admin/certs?principal=nonexistent")
+	if assert.Equal(http.StatusOK, rec.Code) {
+		assert.Equal("[]\n", rec.Body.String())
+	}
+	rec = adminGet("/v1/admin/certs?expires_before=invalid")
+	assert.Equal(http.StatusBadRequest, rec.Code)
+
+	rec = adminGet(fmt.Sprintf("/v1/admin/certs/%d", cert.Serial))
+	if assert.Equal(http.StatusOK, rec.Code) {
+		var r certdb.Record
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &r))
+		assert.Equal(cert.Serial, r.Serial)
+	}
+	rec = adminGet("/v1/admin/certs/1")
+	assert.Equal(http.StatusNotFound, rec.Code)
+}
+
+func TestHostSign(t *testing.T) {
+	assert := assert.New(t)
+	hostSign := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/host/sign?"+query, bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(http.StatusNotFound, hostSign("hostnames=web1.example.com").Code)
+
+	assert.NoError(signapi.EnableHostSigning(HostSignConfig{
+		RequesterPrincipals: []string{"hostadmin"},
+		Hostnames:           []string{"*.example.com"},
+		DefaultLifetime:     time.Hour,
+		MaxLifetime:         24 * time.Hour,
+	}))
+	defer func() { signapi.hostSigning = nil }()
+
+	// Not an allowed requester
+	assert.Equal(http.StatusForbidden, hostSign("hostnames=web1.example.com").Code)
+
+	assert.NoError(signapi.EnableHostSigning(HostSignConfig{
+		RequesterPrincipals: []string{"fake*"},
+		Hostnames:           []string{"*.example.com"},
+		DefaultLifetime:     time.Hour,
+		MaxLifetime:         24 * time.Hour,
+	}))
+	assert.Equal(http.StatusBadRequest, hostSign("").Code)
+	assert.Equal(http.StatusForbidden, hostSign("hostnames=web1.example.org").Code)
+	exp := time.Now().Add(48 * time.Hour).Format(time.RFC3339)
+	assert.Equal(http.StatusBadRequest, hostSign("hostnames=web1.example.com&expires="+url.QueryEscape(exp)).Code)
+
+	rec := hostSign("hostnames=web1.example.com,web2.example.com")
+	if assert.Equal(http.StatusOK, rec.Code) {
+		raw, _, _, _, err := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		if assert.NoError(err) {
+			cert := raw.(*ssh.Certificate)
+			assert.Equal(uint32(ssh.HostCert), cert.CertType)
+			assert.Equal([]string{"web1.example.com", "web2.example.com"}, cert.ValidPrincipals)
+			assert.Empty(cert.Extensions)
+			assert.Contains(cert.KeyId, `host="web1.example.com"`)
+			assert.InDelta(time.Now().Add(time.Hour).Unix(), int64(cert.ValidBefore), 5)
+		}
+	}
+}
+
+func TestHostBootstrap(t *testing.T) {
+	assert := assert.New(t)
+	admin := func(method, target, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, target, bytes.NewBufferString(body))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	bootstrapSign := func(token, query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/host/bootstrap?"+query, bytes.NewBuffer(testUserPublic))
+		if token != "" {
+			req.Header.Set(BootstrapTokenHeader, token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(http.StatusNotFound, bootstrapSign("x.y", "").Code)
+
+	assert.NoError(signapi.EnableHostSigning(HostSignConfig{
+		Hostnames:            []string{"*.example.com"},
+		DefaultLifetime:      time.Hour,
+		MaxLifetime:          24 * time.Hour,
+		BootstrapTokenMaxTTL: 2 * time.Hour,
+	}))
+	defer func() { signapi.hostSigning = nil }()
+	store, _ := bootstrap.NewStore("")
+	signapi.SetBootstrapStore(store)
+	defer signapi.SetBootstrapStore(nil)
+
+	// Minting requires admin
+	assert.Equal(http.StatusForbidden, admin(echo.POST, "/v1/admin/bootstrap_tokens", `{"hostnames":["web1.example.com"]}`).Code)
+	assert.NoError(signapi.SetAdminPrincipals([]string{"fake1"}))
+	defer signapi.SetAdminPrincipals(nil)
+	assert.Equal(http.StatusBadRequest, admin(echo.POST, "/v1/admin/bootstrap_tokens", `{"hostnames":[]}`).Code)
+	assert.Equal(http.StatusBadRequest, admin(echo.POST, "/v1/admin/bootstrap_tokens", `{"hostnames":["a"],"ttl":"3h"}`).Code)
+
+	rec := admin(echo.POST, "/v1/admin/bootstrap_tokens", `{"hostnames":["web1.example.com","*.web1.example.com"],"ttl":"1h"}`)
+	if !assert.Equal(http.StatusCreated, rec.Code) {
+		return
+	}
+	var resp objects.BootstrapTokenResponse
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(1, resp.Uses)
+
+	rec = admin(echo.GET, "/v1/admin/bootstrap_tokens", "")
+	var tokens []bootstrap.Token
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &tokens))
+	if assert.Len(tokens, 1) {
+		assert.Equal(resp.ID, tokens[0].ID)
+		assert.Equal(authenticator.User, tokens[0].CreatedBy)
+		assert.Empty(tokens[0].SecretHash)
+	}
+
+	assert.Equal(http.StatusUnauthorized, bootstrapSign("", "").Code)
+	assert.Equal(http.StatusUnauthorized, bootstrapSign(resp.ID+".invalid", "").Code)
+	assert.Equal(http.StatusForbidden, bootstrapSign(resp.Token, "hostnames=web2.example.com").Code)
+	assert.Equal(http.StatusForbidden, bootstrapSign(resp.Token, "hostnames=web1.example.org").Code)
+
+	// Hostnames default to the literal names in the token
+	rec = bootstrapSign(resp.Token, "")
+	if assert.Equal(http.StatusOK, rec.Code) {
+		raw, _, _, _, err := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		if assert.NoError(err) {
+			cert := raw.(*ssh.Certificate)
+			assert.Equal(uint32(ssh.HostCert), cert.CertType)
+			assert.Equal([]string{"web1.example.com"}, cert.ValidPrincipals)
+			assert.Contains(cert.KeyId, `requested_by="bootstrap:`+resp.ID+`"`)
+		}
+	}
+	// Single use
+	assert.Equal(http.StatusUnauthorized, bootstrapSign(resp.Token, "").Code)
+
+	rec = admin(echo.POST, "/v1/admin/bootstrap_tokens", `{"hostnames":["*.web1.example.com"],"ttl":"1h","uses":2}`)
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &resp))
+	assert.Equal(http.StatusBadRequest, bootstrapSign(resp.Token, "").Code)
+	assert.Equal(http.StatusOK, bootstrapSign(resp.Token, "hostnames=a.web1.example.com").Code)
+	assert.Equal(http.StatusNoContent, admin(echo.DELETE, "/v1/admin/bootstrap_tokens/"+resp.ID, "").Code)
+	assert.Equal(http.StatusNotFound, admin(echo.DELETE, "/v1/admin/bootstrap_tokens/"+resp.ID, "").Code)
+	assert.Equal(http.StatusUnauthorized, bootstrapSign(resp.Token, "hostnames=b.web1.example.com").Code)
+}
+
+func TestPolicy(t *testing.T) {
+	assert := assert.New(t)
+	sign := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign?"+query, bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	pol, err := policy.New(&policy.Config{
+		Templates: []policy.TemplateConfig{
+			{
+				Name:            "restricted",
+				Principals:      []string{"fake1", "fake2"},
+				DefaultLifetime: "10m",
+				MaxLifetime:     "30m",
+				ForceCommand:    "/bin/true",
+			},
+		},
+		Bindings: []policy.BindingConfig{
+			{Backends: []string{"testauth"}, Groups: []string{"fake3"}, Template: "restricted"},
+		},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	signapi.SetPolicy(pol)
+	defer signapi.SetPolicy(nil)
+	buf := new(bytes.Buffer)
+	audit.SetSinks(audit.NewWriterSink(buf))
+	defer audit.SetSinks()
+
+	rec := sign("")
+	var ev audit.Event
+	if assert.NoError(json.NewDecoder(buf).Decode(&ev)) {
+		assert.Equal("restricted", ev.Policy)
+		assert.Equal("/bin/true", ev.ForceCommand)
+	}
+	if assert.Equal(http.StatusOK, rec.Code) {
+		raw, _, _, _, err := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		if assert.NoError(err) {
+			cert := raw.(*ssh.Certificate)
+			assert.Subset([]string{"fake1", "fake2"}, cert.ValidPrincipals)
+			assert.NotContains(cert.ValidPrincipals, "fake3")
+			assert.Equal("/bin/true", cert.CriticalOptions["force-command"])
+			assert.Equal("fake", cert.CriticalOptions["test"])
+			assert.InDelta(time.Now().Add(10*time.Minute).Unix(), int64(cert.ValidBefore), 5)
+		}
+	}
+	exp := time.Now().Add(time.Hour).Format(time.RFC3339)
+	assert.Equal(http.StatusBadRequest, sign("expires="+url.QueryEscape(exp)).Code)
+
+	// Binding no longer matches after the user filters out the group
+	assert.Equal(http.StatusForbidden, sign("exclude_principals=fake3").Code)
+}
+
+func TestLifetimeLimits(t *testing.T) {
+	assert := assert.New(t)
+	sign := func(lifetime time.Duration) *httptest.ResponseRecorder {
+		exp := time.Now().Add(lifetime).Format(time.RFC3339)
+		req, _ := http.NewRequest(echo.POST, "/v1/sign?expires="+url.QueryEscape(exp), bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	validBefore := func(rec *httptest.ResponseRecorder) int64 {
+		raw, _, _, _, err := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		if !assert.NoError(err) {
+			return 0
+		}
+		return int64(raw.(*ssh.Certificate).ValidBefore)
+	}
+	defer func() { signapi.lifetimeLimits = nil }()
+
+	assert.NoError(signapi.SetLifetimeLimits(LifetimeLimits{
+		Backends: map[string]time.Duration{authenticator.Name(): 4 * time.Hour},
+	}))
+	assert.Equal(http.StatusOK, sign(3*time.Hour).Code)
+	rec := sign(5 * time.Hour)
+	assert.Equal(http.StatusBadRequest, rec.Code)
+	assert.Contains(rec.Body.String(), "maximum of 4h0m0s")
+
+	// Most restrictive group wins
+	assert.NoError(signapi.SetLifetimeLimits(LifetimeLimits{
+		Backends: map[string]time.Duration{authenticator.Name(): 4 * time.Hour},
+		Groups: []GroupLifetime{
+			{Groups: []string{"fake1"}, MaxLifetime: 2 * time.Hour},
+			{Groups: []string{"fake[23]"}, MaxLifetime: 30 * time.Minute},
+			{Groups: []string{"other"}, MaxLifetime: time.Minute},
+		},
+	}))
+	assert.Equal(http.StatusBadRequest, sign(time.Hour).Code)
+	assert.Equal(http.StatusOK, sign(20*time.Minute).Code)
+
+	// Clamp
+	assert.NoError(signapi.SetLifetimeLimits(LifetimeLimits{
+		Groups: []GroupLifetime{{Groups: []string{"fake1"}, MaxLifetime: 30 * time.Minute}},
+		Clamp:  true,
+	}))
+	rec = sign(3 * time.Hour)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		assert.InDelta(time.Now().Add(30*time.Minute).Unix(), validBefore(rec), 5)
+	}
+	assert.Error(signapi.SetLifetimeLimits(LifetimeLimits{Groups: []GroupLifetime{{Groups: []string{"a"}}}}))
+
+	// Backend default and minimum
+	assert.NoError(signapi.SetLifetimeLimits(LifetimeLimits{
+		BackendDefaults: map[string]time.Duration{authenticator.Name(): 2 * time.Hour},
+		BackendMinimums: map[string]time.Duration{authenticator.Name(): 20 * time.Minute},
+	}))
+	req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		assert.InDelta(time.Now().Add(2*time.Hour).Unix(), validBefore(rec), 5)
+	}
+	rec = sign(10 * time.Minute)
+	assert.Equal(http.StatusBadRequest, rec.Code)
+	assert.Contains(rec.Body.String(), "minimum of 20m0s")
+	assert.Equal(http.StatusOK, sign(30*time.Minute).Code)
+
+	// Clamped up to the minimum, which the maximum wins over
+	assert.NoError(signapi.SetLifetimeLimits(LifetimeLimits{
+		BackendMinimums: map[string]time.Duration{authenticator.Name(): 20 * time.Minute},
+		Groups:          []GroupLifetime{{Groups: []string{"fake1"}, MaxLifetime: 15 * time.Minute}},
+		Clamp:           true,
+	}))
+	rec = sign(5 * time.Minute)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		assert.InDelta(time.Now().Add(15*time.Minute).Unix(), validBefore(rec), 5)
+	}
+	assert.Error(signapi.SetLifetimeLimits(LifetimeLimits{
+		Backends:        map[string]time.Duration{"a": time.Hour},
+		BackendMinimums: map[string]time.Duration{"a": 2 * time.Hour},
+	}))
+	assert.Error(signapi.SetLifetimeLimits(LifetimeLimits{
+		BackendDefaults: map[string]time.Duration{"a": time.Minute},
+		BackendMinimums: map[string]time.Duration{"a": time.Hour},
+	}))
+}
+
+func TestPrincipalMapping(t *testing.T) {
+	assert := assert.New(t)
+	sign := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	mapper, err := authzmap.New(&authzmap.Config{
+		Rules: []authzmap.RuleConfig{
+			{ForEach: authzmap.ForEachPrincipals, Match: "fake[12]", Prefix: "mapped-"},
+			{Principals: []string{"{{.Subject}}"}},
+		},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	signapi.SetPrincipalMapper(mapper)
+	defer signapi.SetPrincipalMapper(nil)
+
+	rec := sign()
+	if assert.Equal(http.StatusOK, rec.Code) {
+		raw, _, _, _, err := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		if assert.NoError(err) {
+			assert.Equal([]string{"mapped-fake1", "mapped-fake2", authenticator.User}, raw.(*ssh.Certificate).ValidPrincipals)
+		}
+	}
+
+	mapper, _ = authzmap.New(&authzmap.Config{
+		Rules: []authzmap.RuleConfig{{ForEach: authzmap.ForEachGroups}},
+	})
+	signapi.SetPrincipalMapper(mapper)
+	assert.Equal(http.StatusForbidden, sign().Code)
+}
+
+func TestPolicySourceAddress(t *testing.T) {
+	assert := assert.New(t)
+	pol, err := policy.New(&policy.Config{
+		Templates: []policy.TemplateConfig{
+			{Name: "pinned", SourceAddress: policy.SourceAddressClient, SourceAddressPrefixV4: 24},
+		},
+		DefaultTemplate: "pinned",
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	signapi.SetPolicy(pol)
+	defer signapi.SetPolicy(nil)
+
+	req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	req.RemoteAddr = "198.51.100.7:40000"
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		raw, _, _, _, err := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		if assert.NoError(err) {
+			assert.Equal("198.51.100.0/24", raw.(*ssh.Certificate).CriticalOptions["source-address"])
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	defer signapi.SetRateLimits(RateLimits{})
+	login := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/"+authenticator.Name(), nil)
+		req.SetBasicAuth(authenticator.User, string(authenticator.Secret))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	sign := func(remote string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	signapi.SetRateLimits(RateLimits{LoginPerUser: ratelimit.New(0.001, 2)})
+	assert.Equal(http.StatusOK, login().Code)
+	assert.Equal(http.StatusOK, login().Code)
+	rec := login()
+	assert.Equal(http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(rec.Header().Get("Retry-After"))
+
+	// Per IP limit applies to each address separately
+	signapi.SetRateLimits(RateLimits{SignPerIP: ratelimit.New(0.001, 1)})
+	assert.Equal(http.StatusOK, sign("192.0.2.1:1234").Code)
+	assert.Equal(http.StatusTooManyRequests, sign("192.0.2.1:1234").Code)
+	assert.Equal(http.StatusOK, sign("192.0.2.2:1234").Code)
+
+	// Per user limit applies regardless of the address
+	signapi.SetRateLimits(RateLimits{SignPerUser: ratelimit.New(0.001, 1)})
+	assert.Equal(http.StatusOK, sign("192.0.2.3:1234").Code)
+	assert.Equal(http.StatusTooManyRequests, sign("192.0.2.4:1234").Code)
+	assert.Equal(float64(2), testutil.ToFloat64(metricRateLimited.WithLabelValues(rateLimitSign, "ip"))+testutil.ToFloat64(metricRateLimited.WithLabelValues(rateLimitSign, "user")))
+}
+
+func TestOpenAPI(t *testing.T) {
+	assert := assert.New(t)
+	req, _ := http.NewRequest(echo.GET, "/v1/openapi.json", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if !assert.Equal(http.StatusOK, rec.Code) {
+		return
+	}
+	var doc struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if !assert.NoError(json.Unmarshal(rec.Body.Bytes(), &doc)) {
+		return
+	}
+	assert.Equal("3.0.3", doc.OpenAPI)
+
+	// Every route must be documented
+	param := regexp.MustCompile(`:(\w+)`)
+	for _, r := range e.Routes() {
+		// Skip the catch-all routes echo adds for groups with middleware
+		if !strings.HasPrefix(r.Path, "/v1/") || r.Path == "/v1/admin" || strings.HasSuffix(r.Path, "*") {
+			continue
+		}
+		p := param.ReplaceAllString(r.Path, "{$1}")
+		assert.Contains(doc.Paths[p], strings.ToLower(r.Method), "%s %s is not documented", r.Method, r.Path)
+	}
+}
+
+func TestIntrospect(t *testing.T) {
+	assert := assert.New(t)
+	introspect := func(body string) objects.IntrospectResponse {
+		var r objects.IntrospectResponse
+		req, _ := http.NewRequest(echo.POST, "/v1/introspect", bytes.NewBufferString(body))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if assert.Equal(http.StatusOK, rec.Code) {
+			assert.NoError(json.Unmarshal(rec.Body.Bytes(), &r))
+		}
+		return r
+	}
+
+	// Own token
+	r := introspect("")
+	assert.True(r.Active)
+	assert.True(r.Complete)
+	assert.Equal(authenticator.User, r.Subject)
+	assert.Contains(r.Backends, authenticator.Name())
+	assert.Subset(r.Principals, fakeAuthContext.Principals)
+	assert.Equal(signapi.maxCertLife.String(), r.MaxCertLifetime)
+	assert.NotNil(r.Expires)
+
+	// Other token, limited by backend lifetime
+	defer func() { signapi.lifetimeLimits = nil }()
+	assert.NoError(signapi.SetLifetimeLimits(LifetimeLimits{
+		Backends: map[string]time.Duration{authenticator.Name(): time.Hour},
+	}))
+	r = introspect(fmt.Sprintf(`{"token":%q}`, signedToken))
+	assert.True(r.Active)
+	assert.Equal("1h0m0s", r.MaxCertLifetime)
+
+	// Invalid tokens are inactive
+	r = introspect(`{"token":"bogus"}`)
+	assert.False(r.Active)
+	assert.Empty(r.Subject)
+
+	expired := jwt.NewWithClaims(jwt.SigningMethodHS256, SignClaim{
+		AuthContext:    &auth.AuthContext{Status: auth.StatusCompleted},
+		StandardClaims: jwt.StandardClaims{ExpiresAt: time.Now().Add(-time.Minute).Unix()},
+	})
+	ss, _ := expired.SignedString(signingKey)
+	r = introspect(fmt.Sprintf(`{"token":%q}`, ss))
+	assert.False(r.Active)
+}
+
+func TestAdminBackends(t *testing.T) {
+	assert := assert.New(t)
+	defer signapi.SetAdminPrincipals(nil)
+	defer signapi.backends.enable(authenticator.Name())
+	assert.NoError(signapi.SetAdminPrincipals([]string{"fake?"}))
+
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/v1/admin/backends"+path, nil)
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	login := func() int {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/"+authenticator.Name(), nil)
+		req.SetBasicAuth(authenticator.User, string(authenticator.Secret))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	discover := func() []objects.DiscoverResult {
+		var r []objects.DiscoverResult
+		req, _ := http.NewRequest(echo.GET, "/v1/auth", nil)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		json.Unmarshal(rec.Body.Bytes(), &r)
+		return r
+	}
+
+	var list []objects.BackendStatus
+	rec := admin(echo.GET, "")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &list))
+	if assert.Len(list, 1) {
+		assert.Equal(authenticator.Name(), list[0].Name)
+		assert.True(list[0].Enabled)
+		assert.False(list[0].Probe)
+	}
+	assert.Equal(http.StatusNotImplemented, admin(echo.POST, "/"+authenticator.Name()+"/probe").Code)
+	assert.Equal(http.StatusNotFound, admin(echo.POST, "/nosuch/disable").Code)
+
+	var status objects.BackendStatus
+	rec = admin(echo.POST, "/"+authenticator.Name()+"/disable?reason=incident")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.False(status.Enabled)
+	assert.Equal("incident", status.Reason)
+	assert.Equal(authenticator.User, status.DisabledBy)
+	assert.Equal(http.StatusServiceUnavailable, login())
+	assert.Len(discover(), 0)
+
+	assert.Equal(http.StatusOK, admin(echo.POST, "/"+authenticator.Name()+"/enable").Code)
+	assert.Equal(http.StatusOK, login())
+	assert.Len(discover(), 1)
+}
+
+func TestAdminReload(t *testing.T) {
+	assert := assert.New(t)
+	defer signapi.SetAdminPrincipals(nil)
+	defer signapi.SetReloader(nil)
+	assert.NoError(signapi.SetAdminPrincipals([]string{"fake?"}))
+
+	reload := func() int {
+		req, _ := http.NewRequest(echo.POST, "/v1/admin/reload", nil)
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(http.StatusNotFound, reload())
+
+	calls := 0
+	signapi.SetReloader(func() error {
+		calls++
+		return nil
+	})
+	assert.Equal(http.StatusNoContent, reload())
+	signapi.SetReloader(func() error { return fmt.Errorf("broken") })
+	assert.Equal(http.StatusInternalServerError, reload())
+	assert.Equal(1, calls)
+
+	// Disabled backends stay disabled over reloads
+	signapi.backends.disable(authenticator.Name(), disabledBackend{by: "test"})
+	defer signapi.backends.enable(authenticator.Name())
+	next := New(signapi.authList, signapi.signer, signingKey, signapi.defaultCertLife, signapi.maxCertLife)
+	next.KeepRuntimeState(signapi)
+	assert.True(next.backends.isDisabled(authenticator.Name()))
+}
+
+func TestSerialGenerator(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "signapitest")
+	defer os.RemoveAll(dir)
+	counter, err := serial.NewFileCounter(path.Join(dir, "serial"))
+	if !assert.NoError(err) {
+		return
+	}
+	signapi.SetSerialGenerator(counter)
+	defer signapi.SetSerialGenerator(nil)
+
+	sign := func(query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign"+query, bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := uint64(1); i <= 2; i++ {
+		// Denied requests do not use up serials
+		tooLong := time.Now().Add(100 * 24 * time.Hour).Format(time.RFC3339)
+		assert.Equal(http.StatusBadRequest, sign("?expires="+url.QueryEscape(tooLong)).Code)
+		rec := sign("")
+		if !assert.Equal(http.StatusOK, rec.Code) {
+			return
+		}
+		raw, _, _, _, _ := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		assert.Equal(i, raw.(*ssh.Certificate).Serial)
+	}
+
+	signapi.SetSerialGenerator(serial.GeneratorFunc(func() (uint64, error) {
+		return 0, errors.New("counter unavailable")
+	}))
+	assert.Equal(http.StatusInternalServerError, sign("").Code)
+}
+
+func TestCARotation(t *testing.T) {
+	assert := assert.New(t)
+	do := func(method, url string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req, _ := http.NewRequest(method, url, &buf)
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	signedBy := func() string {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		raw, _, _, _, err := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		if err != nil {
+			return ""
+		}
+		return ssh.FingerprintSHA256(raw.(*ssh.Certificate).SignatureKey)
+	}
+	bundleLen := func() int {
+		rec := do(echo.GET, "/v1/ca/bundle", nil)
+		return len(strings.Split(strings.TrimSpace(rec.Body.String()), "\n"))
+	}
+
+	assert.NoError(signapi.SetAdminPrincipals([]string{"fake?"}))
+	defer signapi.SetAdminPrincipals(nil)
+	assert.Equal(http.StatusNotFound, do(echo.GET, "/v1/admin/ca/rotation", nil).Code)
+	store, _ := carotation.NewStore("")
+	signapi.SetRotationStore(store)
+	defer signapi.SetRotationStore(nil)
+	buf := new(bytes.Buffer)
+	audit.SetSinks(audit.NewWriterSink(buf))
+	defer audit.SetSinks()
+
+	caKey, _ := signapi.signer.GetPublicKey()
+	original := ssh.FingerprintSHA256(caKey)
+
+	// Generated key with a cutover in the future
+	cutover := time.Now().Add(time.Hour)
+	rec := do(echo.POST, "/v1/admin/ca/rotation", objects.CARotationRequest{Cutover: &cutover})
+	if !assert.Equal(http.StatusCreated, rec.Code) {
+		return
+	}
+	var next objects.CAKeyInfo
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &next))
+	assert.Equal(http.StatusConflict, do(echo.POST, "/v1/admin/ca/rotation", objects.CARotationRequest{}).Code)
+	var status objects.CARotationStatus
+	assert.NoError(json.Unmarshal(do(echo.GET, "/v1/admin/ca/rotation", nil).Body.Bytes(), &status))
+	if assert.NotNil(status.Next) && assert.NotNil(status.Signing) {
+		assert.Equal(next.Fingerprint, status.Next.Fingerprint)
+		assert.Equal(original, status.Signing.Fingerprint)
+	}
+	assert.Equal(2, bundleLen())
+	assert.Equal(original, signedBy())
+	assert.Equal(http.StatusConflict, do(echo.POST, "/v1/admin/ca/rotation/retire", nil).Code)
+	assert.Equal(http.StatusNoContent, do(echo.DELETE, "/v1/admin/ca/rotation", nil).Code)
+	assert.Equal(http.StatusConflict, do(echo.DELETE, "/v1/admin/ca/rotation", nil).Code)
+	assert.Equal(1, bundleLen())
+
+	// Immediate cutover
+	rec = do(echo.POST, "/v1/admin/ca/rotation", objects.CARotationRequest{})
+	if !assert.Equal(http.StatusCreated, rec.Code) {
+		return
+	}
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &next))
+	assert.Equal(next.Fingerprint, signedBy())
+	assert.Equal(2, bundleLen())
+	rec = do(echo.POST, "/v1/admin/ca/rotation/retire", nil)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		var retired objects.CAKeyInfo
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &retired))
+		assert.Equal(original, retired.Fingerprint)
+	}
+	assert.Equal(1, bundleLen())
+	assert.Equal(next.Fingerprint, signedBy())
+	assert.Equal(next.Fingerprint, store.State().Current)
+	assert.Len(store.State().Retired, 1)
+
+	// Rotate back to the original key from PEM
+	rec = do(echo.POST, "/v1/admin/ca/rotation", objects.CARotationRequest{PrivateKey: string(testCaPrivatePem)})
+	assert.Equal(http.StatusCreated, rec.Code)
+	assert.Equal(http.StatusOK, do(echo.POST, "/v1/admin/ca/rotation/retire", nil).Code)
+	assert.Equal(original, signedBy())
+
+	var types []string
+	dec := json.NewDecoder(buf)
+	for {
+		var ev audit.Event
+		if dec.Decode(&ev) != nil {
+			break
+		}
+		types = append(types, ev.Type)
+	}
+	assert.Subset(types, []string{audit.EventCARotationStarted, audit.EventCARotationCancelled, audit.EventCAKeyRetired})
+}
+
+func TestLogFields(t *testing.T) {
+	assert := assert.New(t)
+	c := e.NewContext(httptest.NewRequest(echo.GET, "/v1/ca", nil), httptest.NewRecorder())
+	assert.Empty(LogFields(c))
+
+	token, err := jwt.ParseWithClaims(signedToken, &SignClaim{}, func(token *jwt.Token) (interface{}, error) {
+		return signingKey, nil
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	c.Set("user", token)
+	f := LogFields(c)
+	assert.Equal(authenticator.User, f["user"])
+	assert.Contains(f["backend"], authenticator.Name())
+
+	// Failed login
+	req, _ := http.NewRequest(echo.POST, "/v1/auth/"+authenticator.Name(), nil)
+	req.SetBasicAuth("nobody", "wrong")
+	rec := httptest.NewRecorder()
+	c = e.NewContext(req, rec)
+	c.SetParamNames("name")
+	c.SetParamValues(authenticator.Name())
+	c.Set("username", "nobody")
+	assert.Equal(echo.ErrUnauthorized, signapi.HandleLogin(c))
+	assert.Equal(logrus.Fields{"user": "nobody", "backend": authenticator.Name()}, LogFields(c))
+}
+
+func TestApproval(t *testing.T) {
+	assert := assert.New(t)
+	approverToken, _ := signapi.makeToken(&auth.AuthContext{
+		Status:      auth.StatusCompleted,
+		SubjectName: "approver",
+		Principals:  []string{"oncall"},
+	}).SignedString(signingKey)
+	do := func(method, url, token string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, url, bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set("X-Auth", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	decode := func(rec *httptest.ResponseRecorder) objects.ApprovalRequest {
+		var r objects.ApprovalRequest
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &r))
+		return r
+	}
+
+	// Approvals are for a certificate expiring at the latest as requested
+	expires := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	sign := "/v1/sign?expires=" + url.QueryEscape(expires.Format(time.RFC3339))
+	assert.Equal(http.StatusNotFound, do(echo.GET, "/v1/approvals", signedToken, nil).Code)
+	store, _ := approval.NewStore("", time.Hour)
+	assert.NoError(signapi.EnableApprovals(ApprovalConfig{
+		Principals:         []string{"fake3"},
+		ApproverPrincipals: []string{"oncall"},
+	}, store))
+	defer func() { signapi.approvals = nil }()
+	buf := new(bytes.Buffer)
+	audit.SetSinks(audit.NewWriterSink(buf))
+	defer audit.SetSinks()
+
+	// Principals not requiring approval are signed directly
+	rec := do(echo.POST, "/v1/sign?exclude_principals=fake3", signedToken, testUserPublic)
+	assert.Equal(http.StatusOK, rec.Code)
+
+	rec = do(echo.POST, sign, signedToken, testUserPublic)
+	if !assert.Equal(http.StatusAccepted, rec.Code) {
+		return
+	}
+	pending := decode(rec)
+	assert.Equal(approval.StatusPending, pending.Status)
+	assert.Equal([]string{"fake3"}, pending.SensitivePrincipals)
+	assert.Equal("/v1/approvals/"+pending.ID, rec.Header().Get(echo.HeaderLocation))
+	assert.True(expires.Equal(pending.ValidBefore))
+	// Repeated request reuses the pending one
+	assert.Equal(pending.ID, decode(do(echo.POST, sign, signedToken, testUserPublic)).ID)
+	rec = do(echo.POST, sign+"&approval="+pending.ID, signedToken, testUserPublic)
+	assert.Equal(http.StatusAccepted, rec.Code)
+
+	// Requesters cannot decide on their own requests
+	assert.Equal(http.StatusForbidden, do(echo.POST, "/v1/approvals/"+pending.ID+"/approve", signedToken, nil).Code)
+	assert.NoError(signapi.SetAdminPrincipals([]string{"fake?"}))
+	assert.Equal(http.StatusForbidden, do(echo.POST, "/v1/approvals/"+pending.ID+"/approve", signedToken, nil).Code)
+	signapi.SetAdminPrincipals(nil)
+
+	rec = do(echo.GET, "/v1/approvals?status=pending", approverToken, nil)
+	var list []objects.ApprovalRequest
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Len(list, 1)
+	assert.Equal(http.StatusOK, do(echo.GET, "/v1/approvals/"+pending.ID, signedToken, nil).Code)
+	assert.Equal(http.StatusNotFound, do(echo.GET, "/v1/approvals/nope", approverToken, nil).Code)
+
+	rec = do(echo.POST, "/v1/approvals/"+pending.ID+"/approve", approverToken, []byte(`{"comment":"change 123"}`))
+	if assert.Equal(http.StatusOK, rec.Code) {
+		r := decode(rec)
+		assert.Equal(approval.StatusApproved, r.Status)
+		assert.Equal("approver", r.DecidedBy)
+		assert.Equal("change 123", r.Comment)
+	}
+	assert.Equal(http.StatusConflict, do(echo.POST, "/v1/approvals/"+pending.ID+"/deny", approverToken, nil).Code)
+
+	// Approval applies only to the same request and can be used once
+	rec = do(echo.POST, sign+"&exclude_principals=fake1&approval="+pending.ID, signedToken, testUserPublic)
+	assert.Equal(http.StatusForbidden, rec.Code)
+	longer := "/v1/sign?expires=" + url.QueryEscape(expires.Add(time.Hour).Format(time.RFC3339))
+	rec = do(echo.POST, longer+"&approval="+pending.ID, signedToken, testUserPublic)
+	assert.Equal(http.StatusForbidden, rec.Code)
+	rec = do(echo.POST, sign+"&approval="+pending.ID, signedToken, testUserPublic)
+	assert.Equal(http.StatusOK, rec.Code)
+	rec = do(echo.POST, sign+"&approval="+pending.ID, signedToken, testUserPublic)
+	assert.Equal(http.StatusForbidden, rec.Code)
+
+	// Denied
+	id := decode(do(echo.POST, sign, signedToken, testUserPublic)).ID
+	assert.Equal(http.StatusOK, do(echo.POST, "/v1/approvals/"+id+"/deny", approverToken, nil).Code)
+	assert.Equal(http.StatusForbidden, do(echo.POST, sign+"&approval="+id, signedToken, testUserPublic).Code)
+
+	var types []string
+	var issued audit.Event
+	dec := json.NewDecoder(buf)
+	for {
+		var ev audit.Event
+		if err := dec.Decode(&ev); err != nil {
+			break
+		}
+		types = append(types, ev.Type)
+		if ev.Type == audit.EventCertificateIssued && ev.ApprovalID != "" {
+			issued = ev
+		}
+	}
+	assert.Contains(types, audit.EventApprovalRequested)
+	assert.Contains(types, audit.EventApprovalApproved)
+	assert.Contains(types, audit.EventApprovalDenied)
+	assert.Equal(pending.ID, issued.ApprovalID)
+	assert.Equal("approver", issued.Approver)
+}
+
+func TestFederation(t *testing.T) {
+	assert := assert.New(t)
+	key := []byte(strings.Repeat("k", 32))
+	assert.Error(signapi.SetFederationFrontends([]FederationFrontend{{Name: "short", Key: []byte("short")}}))
+	assert.NoError(signapi.SetFederationFrontends([]FederationFrontend{{
+		Name:        "eu",
+		Key:         key,
+		Principals:  []string{"fake1", "fake2"},
+		MaxLifetime: 30 * time.Minute,
+	}}))
+	defer signapi.SetFederationFrontends(nil)
+	upstream := httptest.NewServer(e)
+	defer upstream.Close()
+
+	u, err := NewUpstream(UpstreamConfig{URL: upstream.URL, Name: "eu", Key: key, Timeout: 5 * time.Second})
+	if !assert.NoError(err) {
+		return
+	}
+	frontend := New([]AuthenticatorListEntry{{Authenticator: authenticator}}, signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	frontend.SetUpstream(u)
+	fe := echo.New()
+	frontend.RegisterRoutes(fe.Group("/v1"))
+	do := func(ee *echo.Echo, path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, path, bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(fe, "/v1/sign")
+	if assert.Equal(http.StatusOK, rec.Code, rec.Body.String()) {
+		key, _, _, _, err := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		if assert.NoError(err) {
+			cert := key.(*ssh.Certificate)
+			// Attenuated by the upstream
+			assert.NotContains(cert.ValidPrincipals, "fake3")
+			assert.Contains(cert.ValidPrincipals, "fake1")
+			assert.True(time.Until(time.Unix(int64(cert.ValidBefore), 0)) <= 30*time.Minute)
+			assert.Equal("fake", cert.CriticalOptions["test"])
+		}
+	}
+	// Nothing left to sign
+	rec = do(fe, "/v1/sign?include_principals=fake3")
+	assert.Equal(http.StatusInternalServerError, rec.Code)
+	assert.Contains(rec.Body.String(), "403")
+
+	// Forwarded requests are checked like local ones
+	forward := func(fr objects.FederationSignRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(fr)
+		assertion, _ := u.assertion(body)
+		req, _ := http.NewRequest(echo.POST, "/v1/federation/sign", bytes.NewBuffer(body))
+		req.Header.Set(FederationAssertionHeader, assertion)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	fr := objects.FederationSignRequest{
+		PublicKey:      string(testUserPublic),
+		KeyID:          "forwarded",
+		Principals:     []string{"fake1"},
+		ValidAfter:     time.Now(),
+		ValidBefore:    time.Now().Add(time.Hour),
+		Subject:        authenticator.User,
+		Authenticators: []string{authenticator.Name()},
+	}
+	assert.NoError(signapi.SetLifetimeLimits(LifetimeLimits{Backends: map[string]time.Duration{authenticator.Name(): 10 * time.Minute}}))
+	rec = forward(fr)
+	if assert.Equal(http.StatusOK, rec.Code, rec.Body.String()) {
+		key, _, _, _, _ := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		assert.True(time.Until(time.Unix(int64(key.(*ssh.Certificate).ValidBefore), 0)) <= 10*time.Minute)
+	}
+	signapi.SetLifetimeLimits(LifetimeLimits{})
+	// Backdated beyond the clock skew
+	fr.ValidAfter = time.Now().Add(-time.Hour)
+	assert.Equal(http.StatusBadRequest, forward(fr).Code)
+	fr.ValidAfter = time.Now()
+	// Step-up not satisfied by the forwarded authenticators
+	assert.NoError(signapi.SetStepUp([]StepUp{{Principals: []string{"fake1"}, Backends: []string{authenticator.Name()}}}))
+	assert.Equal(http.StatusOK, forward(fr).Code)
+	fr.Authenticators = nil
+	assert.Equal(http.StatusForbidden, forward(fr).Code)
+	signapi.SetStepUp(nil)
+
+	// CA key is served from the upstream
+	req, _ := http.NewRequest(echo.GET, "/v1/ca", nil)
+	rec = httptest.NewRecorder()
+	fe.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Body.String(), "ssh-rsa")
+
+	// Unauthenticated or forged requests
+	rec = do(e, "/v1/federation/sign")
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+	forged, _ := (&Upstream{name: "eu", key: []byte(strings.Repeat("x", 32))}).assertion(testUserPublic)
+	req, _ = http.NewRequest(echo.POST, "/v1/federation/sign", bytes.NewBuffer(testUserPublic))
+	req.Header.Set(FederationAssertionHeader, forged)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+	// Assertion bound to another body
+	valid, _ := u.assertion([]byte("{}"))
+	req, _ = http.NewRequest(echo.POST, "/v1/federation/sign", bytes.NewBuffer(testUserPublic))
+	req.Header.Set(FederationAssertionHeader, valid)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+	// Replayed assertion
+	valid, _ = u.assertion(testUserPublic)
+	_, err = signapi.verifyAssertion(valid, testUserPublic)
+	assert.NoError(err)
+	_, err = signapi.verifyAssertion(valid, testUserPublic)
+	assert.Error(err)
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewTokenKeys(signingKey, time.Minute)
+	assert.Error(err)
+	keys, err := NewTokenKeys(signingKey, time.Hour)
+	if !assert.NoError(err) {
+		return
+	}
+	now := time.Now()
+	keys.now = func() time.Time { return now }
+	signapi.SetTokenKeys(keys)
+	defer signapi.SetTokenKeys(&TokenKeys{secrets: []tokenSecret{newTokenSecret(signingKey)}, now: time.Now})
+
+	login := func(prev string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/"+authenticator.Name(), nil)
+		req.SetBasicAuth(authenticator.User, string(authenticator.Secret))
+		if prev != "" {
+			req.Header.Set("X-Auth", "Bearer "+prev)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := login("")
+	if !assert.Equal(http.StatusOK, rec.Code) {
+		return
+	}
+	token := rec.Body.String()
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, &SignClaim{})
+	if assert.NoError(err) {
+		assert.Equal(keys.CurrentID(), parsed.Header["kid"])
+	}
+	// Static key is no longer accepted
+	static, _ := signapi.makeToken(&fakeAuthContext).SignedString(signingKey)
+	assert.Equal(http.StatusUnauthorized, login(static).Code)
+
+	// Previous key is accepted after rotation
+	first := keys.CurrentID()
+	now = now.Add(time.Hour)
+	assert.NotEqual(first, keys.CurrentID())
+	assert.Equal(http.StatusOK, login(token).Code)
+
+	// Retired after another rotation
+	now = now.Add(time.Hour)
+	_, err = keys.keyFunc(parsed)
+	assert.Error(err)
+
+	// Replicas sharing the secret agree on the keys and the secret can be
+	// replaced
+	other, _ := NewTokenKeys([]byte("newkey"), time.Hour, signingKey)
+	other.now = keys.now
+	parsed.Header["kid"] = keys.CurrentID()
+	k1, err := keys.keyFunc(parsed)
+	assert.NoError(err)
+	k2, err := other.keyFunc(parsed)
+	assert.NoError(err)
+	assert.Equal(k1, k2)
+
+	// Without rotation the previous secrets are accepted as well
+	static, _ = signapi.makeToken(&fakeAuthContext).SignedString(signingKey)
+	keys, _ = NewTokenKeys([]byte("newkey"), 0, signingKey)
+	signapi.SetTokenKeys(keys)
+	assert.Equal(http.StatusOK, login(static).Code)
+	unknown, _ := signapi.makeToken(&fakeAuthContext).SignedString([]byte("unknown"))
+	assert.Equal(http.StatusUnauthorized, login(unknown).Code)
+	keys, _ = NewTokenKeys([]byte("newkey"), 0)
+	signapi.SetTokenKeys(keys)
+	assert.Equal(http.StatusUnauthorized, login(static).Code)
+}
+
+func TestTokenPolicy(t *testing.T) {
+	assert := assert.New(t)
+	assert.Error(signapi.SetTokenPolicy(TokenPolicy{Claims: map[string]string{"x": "password"}}))
+	err := signapi.SetTokenPolicy(TokenPolicy{
+		Lifetime:          time.Hour,
+		Audience:          "ssh",
+		Issuer:            "inscribe",
+		Claims:            map[string]string{"sub_name": TokenClaimSubject, "p": TokenClaimPrincipals},
+		CapToCertLifetime: true,
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	signapi.SetLifetimeLimits(LifetimeLimits{Backends: map[string]time.Duration{authenticator.Name(): 10 * time.Minute}})
+	defer func() {
+		signapi.tokenPolicy = nil
+		signapi.lifetimeLimits = nil
+	}()
+
+	req, _ := http.NewRequest(echo.POST, "/v1/auth/"+authenticator.Name(), nil)
+	req.SetBasicAuth(authenticator.User, string(authenticator.Secret))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if !assert.Equal(http.StatusOK, rec.Code) {
+		return
+	}
+	token, err := jwt.ParseWithClaims(rec.Body.String(), &SignClaim{}, func(token *jwt.Token) (interface{}, error) {
+		return signingKey, nil
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	claims := token.Claims.(*SignClaim)
+	assert.Equal("ssh", claims.Audience)
+	assert.Equal("inscribe", claims.Issuer)
+	assert.Equal(int64(10*60), claims.ExpiresAt-claims.NotBefore)
+	assert.Equal(authenticator.User, claims.Claims["sub_name"])
+	assert.NotEmpty(claims.Claims["p"])
+
+	introspect := func(tok string) objects.IntrospectResponse {
+		req, _ := http.NewRequest(echo.POST, "/v1/introspect", nil)
+		req.Header.Set("X-Auth", "Bearer "+tok)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var r objects.IntrospectResponse
+		if assert.Equal(http.StatusOK, rec.Code) {
+			json.Unmarshal(rec.Body.Bytes(), &r)
+		}
+		return r
+	}
+	r := introspect(rec.Body.String())
+	assert.Equal("inscribe", r.Issuer)
+	assert.Equal(authenticator.User, r.Claims["sub_name"])
+
+	// Tokens without the audience are rejected
+	req, _ = http.NewRequest(echo.POST, "/v1/introspect", nil)
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusUnauthorized, rec.Code)
+}
+
+func TestReplayProtection(t *testing.T) {
+	assert := assert.New(t)
+	assert.Error(signapi.SetReplayProtection(ReplayProtection{ClockSkew: -time.Minute}))
+	assert.NoError(signapi.SetReplayProtection(ReplayProtection{
+		SingleUseTokens: true,
+		ClockSkew:       time.Minute,
+	}))
+	defer func() { signapi.replay = nil }()
+
+	login := func() string {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/"+authenticator.Name(), nil)
+		req.SetBasicAuth(authenticator.User, string(authenticator.Secret))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	sign := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	token := login()
+	rec := sign(token)
+	assert.Equal(http.StatusOK, rec.Code, rec.Body.String())
+	// Replayed request
+	rec = sign(token)
+	assert.Equal(http.StatusConflict, rec.Code)
+	assert.Contains(rec.Body.String(), objects.ErrorTokenReused)
+	assert.Equal(http.StatusOK, sign(login()).Code)
+}
+
+func TestRequestLimits(t *testing.T) {
+	assert := assert.New(t)
+	sa := &SignApi{}
+	sa.SetRequestLimits(RequestLimits{
+		Sign: EndpointLimits{
+			MaxBodySize:   16,
+			MaxConcurrent: 1,
+			QueueTimeout:  10 * time.Millisecond,
+			Timeout:       50 * time.Millisecond,
+		},
+	})
+	release := make(chan struct{})
+	ee := echo.New()
+	ee.POST("/sign", func(c echo.Context) error {
+		if _, err := ioutil.ReadAll(c.Request().Body); err != nil {
+			return err
+		}
+		select {
+		case <-release:
+			return c.NoContent(http.StatusOK)
+		case <-c.Request().Context().Done():
+			return c.Request().Context().Err()
+		}
+	}, sa.limitRequests(rateLimitSign))
+	do := func(body string) int {
+		req, _ := http.NewRequest(echo.POST, "/sign", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(http.StatusRequestEntityTooLarge, do(strings.Repeat("x", 17)))
+	// Handler deadline
+	assert.Equal(http.StatusServiceUnavailable, do("x"))
+
+	// Concurrency
+	done := make(chan int)
+	go func() { done <- do("x") }()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(http.StatusServiceUnavailable, do("x"))
+	close(release)
+	assert.Equal(http.StatusOK, <-done)
+	assert.Equal(http.StatusOK, do("x"))
+}
+
+func TestNetworkACL(t *testing.T) {
+	assert := assert.New(t)
+	allow, err := ParseNetworks([]string{"10.0.0.0/8", "2001:db8::1"})
+	assert.NoError(err)
+	deny, err := ParseNetworks([]string{"10.1.0.0/16"})
+	assert.NoError(err)
+	_, err = ParseNetworks([]string{"bogus"})
+	assert.Error(err)
+
+	sa := &SignApi{}
+	sa.SetNetworkACL(NetworkACL{Sign: NetworkFilter{Allow: allow, Deny: deny}})
+	ee := echo.New()
+	ee.IPExtractor = echo.ExtractIPFromXFFHeader(echo.TrustLoopback(true))
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	ee.POST("/sign", ok, sa.checkSource(rateLimitSign))
+	ee.POST("/admin", ok, sa.checkSource(limitAdmin))
+	do := func(path, ip string) int {
+		req, _ := http.NewRequest(echo.POST, path, nil)
+		req.RemoteAddr = "127.0.0.1:1234"
+		req.Header.Set(echo.HeaderXForwardedFor, ip)
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(http.StatusOK, do("/sign", "10.2.3.4"))
+	assert.Equal(http.StatusOK, do("/sign", "2001:db8::1"))
+	assert.Equal(http.StatusForbidden, do("/sign", "10.1.3.4"))
+	assert.Equal(http.StatusForbidden, do("/sign", "192.0.2.1"))
+	assert.Equal(http.StatusOK, do("/admin", "192.0.2.1"))
+}
+
+func TestMaintenance(t *testing.T) {
+	assert := assert.New(t)
+	defer signapi.SetAdminPrincipals(nil)
+	defer sharedstate.Get().Delete(maintenanceKey)
+	assert.NoError(signapi.SetAdminPrincipals([]string{"fake?"}))
+
+	do := func(method, path string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var status objects.MaintenanceStatus
+	rec := do(echo.POST, "/v1/admin/maintenance?reason=key+rollover", nil)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.True(status.Enabled)
+	assert.Equal(authenticator.User, status.EnabledBy)
+
+	rec = do(echo.POST, "/v1/sign", testUserPublic)
+	assert.Equal(http.StatusServiceUnavailable, rec.Code)
+	assert.Contains(rec.Body.String(), "key rollover")
+	assert.Equal(http.StatusOK, do(echo.POST, "/v1/introspect", nil).Code)
+	assert.Equal(http.StatusOK, do(echo.GET, "/v1/ca/bundle", nil).Code)
+
+	rec = do(echo.DELETE, "/v1/admin/maintenance", nil)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.NoError(json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.False(status.Enabled)
+	assert.Equal(http.StatusOK, do(echo.POST, "/v1/sign", testUserPublic).Code)
+}
+
+func TestExtensionLimits(t *testing.T) {
+	assert := assert.New(t)
+	sa := &SignApi{}
+	assert.Error(sa.SetExtensionLimits(ExtensionLimits{Allowed: []string{"["}}))
+	assert.NoError(sa.SetExtensionLimits(ExtensionLimits{
+		Allowed: []string{"permit-*"},
+		Denied:  []string{"permit-user-rc"},
+		Groups: []GroupExtensions{
+			{Groups: []string{"contractors"}, Denied: []string{"permit-agent-forwarding"}},
+		},
+	}))
+	newCert := func() *ssh.Certificate {
+		return &ssh.Certificate{Permissions: ssh.Permissions{Extensions: map[string]string{
+			"permit-pty":              "",
+			"permit-agent-forwarding": "",
+			"permit-user-rc":          "",
+			"login@example.com":       "root",
+		}}}
+	}
+
+	cert := newCert()
+	removed := sa.extensionLimits.apply(&auth.AuthContext{Principals: []string{"staff"}}, cert)
+	assert.Equal([]string{"login@example.com", "permit-user-rc"}, removed)
+	assert.Len(cert.Extensions, 2)
+
+	cert = newCert()
+	sa.extensionLimits.apply(&auth.AuthContext{Principals: []string{"contractors"}}, cert)
+	assert.Equal(map[string]string{"permit-pty": ""}, cert.Extensions)
+
+	// Unrestricted
+	cert = newCert()
+	assert.Nil((&SignApi{}).extensionLimits.apply(&auth.AuthContext{}, cert))
+	assert.Len(cert.Extensions, 4)
+}
+
+func TestDeniedPrincipals(t *testing.T) {
+	assert := assert.New(t)
+	defer signapi.SetDeniedPrincipals(nil)
+	sign := func(include string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign?include_principals="+include, bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Error(signapi.SetDeniedPrincipals([]DeniedPrincipals{{Principals: []string{"["}}}))
+	assert.NoError(signapi.SetDeniedPrincipals([]DeniedPrincipals{
+		{Principals: []string{"fake1"}},
+		{Principals: []string{"fake[23]"}, ExceptBackends: []string{authenticator.Name()}},
+	}))
+	rec := sign("*")
+	if assert.Equal(http.StatusOK, rec.Code) {
+		raw, _, _, _, _ := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		cert, _ := raw.(*ssh.Certificate)
+		if assert.NotNil(cert) {
+			assert.NotContains(cert.ValidPrincipals, "fake1")
+			assert.Contains(cert.ValidPrincipals, "fake2")
+		}
+	}
+	assert.Equal(http.StatusForbidden, sign("fake1").Code)
+
+	assert.NoError(signapi.SetDeniedPrincipals([]DeniedPrincipals{
+		{Principals: []string{"fake*"}, Backends: []string{"other"}},
+	}))
+	assert.Equal(http.StatusOK, sign("*").Code)
+}
+
+func TestIssuanceWindows(t *testing.T) {
+	assert := assert.New(t)
+	defer signapi.SetIssuanceWindows(nil)
+
+	_, err := ParseTimeWindow([]string{"someday"}, "09:00", "17:00")
+	assert.Error(err)
+	_, err = ParseTimeWindow(nil, "9am", "17:00")
+	assert.Error(err)
+	office, err := ParseTimeWindow([]string{"mon", "Tuesday"}, "09:00", "17:00")
+	assert.NoError(err)
+	assert.Equal("Mon,Tue 09:00-17:00", office.String())
+	night, err := ParseTimeWindow([]string{"fri"}, "22:00", "06:00")
+	assert.NoError(err)
+
+	at := func(s string) time.Time {
+		ts, _ := time.Parse("2006-01-02 15:04", s)
+		return ts
+	}
+	// 2021-03-01 is a Monday
+	assert.True(office.contains(at("2021-03-01 09:00")))
+	assert.False(office.contains(at("2021-03-01 17:00")))
+	assert.False(office.contains(at("2021-03-03 12:00")))
+	assert.True(night.contains(at("2021-03-05 23:00")))
+	assert.True(night.contains(at("2021-03-06 05:59")))
+	assert.False(night.contains(at("2021-03-06 23:00")))
+
+	var hookReq IssuanceCheckRequest
+	onCall := false
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&hookReq)
+		json.NewEncoder(w).Encode(IssuanceCheckResponse{Allowed: onCall, Reason: "not on call"})
+	}))
+	defer hook.Close()
+
+	assert.NoError(signapi.SetIssuanceWindows([]IssuanceWindow{{
+		Principals: []string{"fake1"},
+		Location:   time.UTC,
+		// Window closed until tomorrow
+		Windows: []TimeWindow{{Days: []time.Weekday{(time.Now().UTC().Weekday() + 1) % 7}, Start: 0, End: time.Minute}},
+		Webhook: &IssuanceWebhook{URL: hook.URL, Timeout: time.Second},
+	}}))
+	sign := func(include string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign?include_principals="+include, bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := sign("fake1")
+	assert.Equal(http.StatusForbidden, rec.Code)
+	assert.Contains(rec.Body.String(), "not on call")
+	assert.Equal("fake1", hookReq.Principal)
+	assert.Equal(authenticator.User, hookReq.Subject)
+	assert.Equal(http.StatusOK, sign("fake[12]").Code)
+
+	onCall = true
+	assert.Equal(http.StatusOK, sign("fake1").Code)
+}
+
+func TestCertificateQuota(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "signapitest")
+	defer os.RemoveAll(dir)
+	certs, err := certdb.NewFileStore(path.Join(dir, "certs.jsonl"))
+	if !assert.NoError(err) {
+		return
+	}
+	revocations, _ := revocation.NewStore("")
+	assert.Error(signapi.SetCertificateQuota(CertificateQuota{MaxActive: 2}))
+	signapi.SetCertStore(certs, false)
+	defer signapi.SetCertStore(nil, false)
+	assert.Error(signapi.SetCertificateQuota(CertificateQuota{MaxActive: 2, RevokeOldest: true}))
+	signapi.SetRevocationStore(revocations)
+	defer signapi.SetRevocationStore(nil)
+	assert.NoError(signapi.SetCertificateQuota(CertificateQuota{MaxActive: 2}))
+	defer signapi.SetCertificateQuota(CertificateQuota{})
+
+	sign := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(http.StatusOK, sign().Code)
+	assert.Equal(http.StatusOK, sign().Code)
+	rec := sign()
+	assert.Equal(http.StatusForbidden, rec.Code)
+	assert.Contains(rec.Body.String(), "quota")
+
+	assert.NoError(signapi.SetCertificateQuota(CertificateQuota{MaxActive: 2, RevokeOldest: true}))
+	records, _ := certs.List(certdb.Filter{})
+	oldest := records[len(records)-1]
+	assert.Equal(http.StatusOK, sign().Code)
+	if assert.Len(revocations.Entries(), 1) {
+		assert.Equal(oldest.Serial, revocations.Entries()[0].Serial)
+	}
+	assert.Equal(http.StatusOK, sign().Code)
+	assert.Len(revocations.Entries(), 2)
+}
+
+func TestKeyIDFormat(t *testing.T) {
+	assert := assert.New(t)
+	assert.Error(signapi.SetKeyIDFormat("%x"))
+	assert.Error(signapi.SetKeyIDFormat("%{unknown}"))
+	assert.Error(signapi.SetKeyIDFormat("%{subject"))
+	assert.NoError(signapi.SetKeyIDFormat("%u via %{backend} (100%%)"))
+	defer signapi.SetKeyIDFormat("")
+
+	req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		raw, _, _, _, _ := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		cert := raw.(*ssh.Certificate)
+		assert.Equal(authenticator.User+" via "+authenticator.Name()+" (100%)", cert.KeyId)
+	}
+
+	// Self-service revocation needs the certificate database to find the
+	// subject of custom key ids
+	revocations, _ := revocation.NewStore("")
+	signapi.SetRevocationStore(revocations)
+	defer signapi.SetRevocationStore(nil)
+	assert.Error(signapi.CheckSelfRevocation())
+	revoke := func() int {
+		req, _ := http.NewRequest(echo.POST, "/v1/revoke", bytes.NewBuffer(rec.Body.Bytes()))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	assert.Equal(http.StatusForbidden, revoke())
+	dir, _ := ioutil.TempDir("", "signapitest")
+	defer os.RemoveAll(dir)
+	certs, _ := certdb.NewFileStore(path.Join(dir, "certs.jsonl"))
+	signapi.SetCertStore(certs, false)
+	defer signapi.SetCertStore(nil, false)
+	assert.NoError(signapi.CheckSelfRevocation())
+	req, _ = http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(http.StatusNoContent, revoke())
+
+	// Key id of a policy template
+	signapi.SetKeyIDFormat("")
+	signapi.SetCertStore(nil, false)
+	assert.NoError(signapi.CheckSelfRevocation())
+	pol, _ := policy.New(&policy.Config{
+		Templates:       []policy.TemplateConfig{{Name: "custom", KeyID: "%u"}},
+		DefaultTemplate: "custom",
+	})
+	signapi.SetPolicy(pol)
+	assert.Error(signapi.CheckSelfRevocation())
+	signapi.SetPolicy(nil)
+
+	actx := &auth.AuthContext{
+		SubjectName:   "jdoe",
+		Authenticator: "ldap",
+		AuthMeta: map[string]interface{}{
+			auth.MetaLDAPUserEntry: map[string]interface{}{"department": []interface{}{"ops", "dev"}},
+			auth.MetaClaims:        map[string]interface{}{"team": "blue"},
+		},
+	}
+	// Principals from the backends are not expanded
+	cert := &ssh.Certificate{ValidPrincipals: []string{"100%-remote", "%{ldap.department}", "plain"}}
+	assert.NoError((&SignApi{}).expandIdentity(actx, cert))
+	assert.Equal([]string{"100%-remote", "%{ldap.department}", "plain"}, cert.ValidPrincipals)
+
+	// Identity attributes of the whole chain
+	actx.AddIdentity(auth.IdentityEmployeeID, "1234")
+	actx.AddIdentity(auth.IdentityMFA, "pwd")
+	actx = &auth.AuthContext{Parent: actx, Authenticator: "totp"}
+	actx.AddIdentity(auth.IdentityMFA, "otp", "pwd")
+	sa := &SignApi{}
+	assert.Error(sa.SetIdentityExtensions(map[string]string{"permit-pty": ""}))
+	assert.Error(sa.SetIdentityExtensions(map[string]string{"mfa@example.com": "%{bad}"}))
+	assert.NoError(sa.SetKeyIDFormat("%u employee=%{identity.employee_id} mfa=%{identity.mfa}"))
+	assert.NoError(sa.SetIdentityExtensions(map[string]string{
+		"employee-id@example.com": "%{identity.employee_id}",
+		"device-id@example.com":   "%{identity.device_id}",
+	}))
+	cert = &ssh.Certificate{}
+	assert.NoError(sa.expandIdentity(actx, cert))
+	assert.Equal("jdoe employee=1234 mfa=pwd,otp", cert.KeyId)
+	assert.Equal(map[string]string{"employee-id@example.com": "1234"}, cert.Extensions)
+}
+
+func TestPolicyHook(t *testing.T) {
+	assert := assert.New(t)
+	defer signapi.SetPolicyHook(nil)
+	var (
+		hookReq  PolicyHookRequest
+		hookResp interface{}
+		status   = http.StatusOK
+	)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if ts := r.Header.Get(audit.WebhookTimestampHeader); ts != "" {
+			sig := audit.WebhookSignature([]byte("secret"), ts, body)
+			assert.Equal("sha256="+sig, r.Header.Get(audit.WebhookSignatureHeader))
+		}
+		assert.NoError(json.Unmarshal(body, &hookReq))
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(hookResp)
+	}))
+	defer hook.Close()
+	assert.Error(signapi.SetPolicyHook(&PolicyHook{}))
+	assert.NoError(signapi.SetPolicyHook(&PolicyHook{URL: hook.URL, Secret: []byte("secret"), Timeout: time.Second}))
+
+	sign := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	hookResp = PolicyHookResponse{Allowed: false, Reason: "not today"}
+	rec := sign()
+	assert.Equal(http.StatusForbidden, rec.Code)
+	assert.Contains(rec.Body.String(), "not today")
+	assert.Equal(authenticator.User, hookReq.Subject)
+	assert.Contains(hookReq.Authenticators, "testauth")
+	assert.Contains(hookReq.Certificate.Principals, "fake1")
+	assert.NotNil(hookReq.Certificate.ValidBefore)
+	assert.Equal("ssh-rsa", hookReq.PublicKeyType)
+
+	expires := time.Now().Add(5 * time.Minute).UTC()
+	hookResp = PolicyHookResponse{Allowed: true, Certificate: &PolicyHookCertificate{
+		Principals:  []string{"fake2"},
+		Extensions:  map[string]string{"permit-pty": ""},
+		ValidBefore: &expires,
+	}}
+	rec = sign()
+	if assert.Equal(http.StatusOK, rec.Code) {
+		raw, _, _, _, err := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		if assert.NoError(err) {
+			cert := raw.(*ssh.Certificate)
+			assert.Equal([]string{"fake2"}, cert.ValidPrincipals)
+			assert.Equal(map[string]string{"permit-pty": ""}, cert.Extensions)
+			assert.Equal(uint64(expires.Unix()), cert.ValidBefore)
+		}
+	}
+
+	// All principals removed
+	hookResp = map[string]interface{}{"allowed": true, "certificate": map[string]interface{}{"principals": []string{}}}
+	assert.Equal(http.StatusForbidden, sign().Code)
+
+	// Fail closed unless configured otherwise
+	status = http.StatusInternalServerError
+	assert.Equal(http.StatusForbidden, sign().Code)
+	assert.NoError(signapi.SetPolicyHook(&PolicyHook{URL: hook.URL, Timeout: time.Second, FailOpen: true}))
+	assert.Equal(http.StatusOK, sign().Code)
+}
+
+func TestProblemDetails(t *testing.T) {
+	assert := assert.New(t)
+	problem := func(rec *httptest.ResponseRecorder) *objects.Problem {
+		assert.Equal(objects.MIMEProblemJSON, rec.Header().Get(echo.HeaderContentType))
+		var p objects.Problem
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &p))
+		assert.Equal(rec.Code, p.Status)
+		assert.Equal(objects.ProblemTypePrefix+p.Code, p.Type)
+		return &p
+	}
+
+	req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBufferString("invalid"))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusBadRequest, rec.Code)
+	p := problem(rec)
+	assert.Equal(objects.ErrorInvalidPublicKey, p.Code)
+	assert.Equal("Bad Request", p.Title)
+	assert.Contains(p.Detail, "cannot parse public key")
+	assert.Equal("/v1/sign", p.Instance)
+
+	exp := time.Now().Add(48 * time.Hour).Format(time.RFC3339)
+	req, _ = http.NewRequest(echo.POST, "/v1/sign?expires="+url.QueryEscape(exp), bytes.NewBuffer(testUserPublic))
+	req.Header.Set("X-Auth", "Bearer "+signedToken)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(objects.ErrorLifetimeExceeded, problem(rec).Code)
+
+	// Codes derived from the status
+	req, _ = http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(objects.ErrorBadRequest, problem(rec).Code)
+	req, _ = http.NewRequest(echo.GET, "/v1/nonexistent", nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	p = problem(rec)
+	assert.Equal(objects.ErrorNotFound, p.Code)
+	assert.Empty(p.Detail)
+}
+
+func TestRequestID(t *testing.T) {
+	assert := assert.New(t)
+	do := func(cid string) (*httptest.ResponseRecorder, *objects.Problem) {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBufferString("invalid"))
+		req.Header.Set("X-Auth", "Bearer "+signedToken)
+		if cid != "" {
+			req.Header.Set(objects.CorrelationIDHeader, cid)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		var p objects.Problem
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &p))
+		return rec, &p
+	}
+
+	rec, p := do("client-trace-1")
+	assert.NotEmpty(p.RequestID)
+	assert.Equal(p.RequestID, rec.Header().Get(objects.RequestIDHeader))
+	assert.Equal("client-trace-1", p.CorrelationID)
+	assert.Equal("client-trace-1", rec.Header().Get(objects.CorrelationIDHeader))
+	assert.Equal(rec.Header().Get(echo.HeaderXRequestID), p.AuditID)
+	assert.NotEmpty(p.AuditID)
+
+	// Every request gets a new id
+	rec2, p2 := do("client-trace-1")
+	assert.NotEqual(p.RequestID, p2.RequestID)
+	assert.Equal(p.AuditID, p2.AuditID)
+	assert.Equal("client-trace-1", rec2.Header().Get(objects.CorrelationIDHeader))
+
+	// Missing and invalid correlation ids default to the request id
+	rec, p = do("")
+	assert.Equal(p.RequestID, p.CorrelationID)
+	assert.Equal(p.RequestID, rec.Header().Get(objects.CorrelationIDHeader))
+	rec, p = do("invalid id\x01")
+	assert.Equal(p.RequestID, p.CorrelationID)
+	assert.Equal(p.RequestID, rec.Header().Get(objects.CorrelationIDHeader))
+}
+
+func TestNegotiateToken(t *testing.T) {
+	token, err := negotiateToken("Negotiate dG9rZW4=")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "token", string(token))
+	}
+	_, err = negotiateToken("negotiate dG9rZW4=")
+	assert.NoError(t, err)
+	_, err = negotiateToken("Basic dXNlcjpwdw==")
+	assert.Error(t, err)
+	_, err = negotiateToken("Negotiate ")
+	assert.Error(t, err)
+	_, err = negotiateToken("Negotiate !!!")
+	assert.Error(t, err)
+}
+
+type enrollableMock struct {
+	*authmock.AuthMock
+	enrolled bool
+}
+
+func (em *enrollableMock) Enroll(actx *auth.AuthContext) (*auth.Enrollment, error) {
+	if em.enrolled {
+		return nil, auth.ErrAlreadyEnrolled
+	}
+	em.enrolled = true
+	return &auth.Enrollment{Secret: "SECRET", URI: "otpauth://totp/" + actx.GetSubjectName() + "?secret=SECRET"}, nil
+}
+
+func TestEnroll(t *testing.T) {
+	assert := assert.New(t)
+	em := &enrollableMock{AuthMock: &authmock.AuthMock{AuthName: "otp", AuthRealm: "testrealm"}}
+	sa := New([]AuthenticatorListEntry{{Authenticator: authenticator}, {Authenticator: em}}, signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	do := func(path, token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, path, nil)
+		if token != "" {
+			req.Header.Set("X-Auth", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(http.StatusBadRequest, do("/v1/auth/otp/enroll", "").Code)
+	assert.Equal(http.StatusNotFound, do("/v1/auth/testauth/enroll", signedToken).Code)
+
+	rec := do("/v1/auth/otp/enroll?format=png&scale=2", signedToken)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		assert.Equal("image/png", rec.Header().Get("Content-Type"))
+		assert.True(bytes.HasPrefix(rec.Body.Bytes(), []byte("\x89PNG")))
+	}
+	em.enrolled = false
+	rec = do("/v1/auth/otp/enroll", signedToken)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		var result objects.EnrollResult
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &result))
+		assert.Equal("SECRET", result.Secret)
+		assert.Equal("otpauth://totp/test?secret=SECRET", result.URI)
+	}
+	rec = do("/v1/auth/otp/enroll", signedToken)
+	assert.Equal(http.StatusConflict, rec.Code)
+	assert.Contains(rec.Body.String(), objects.ErrorAlreadyEnrolled)
+}
+
+type pageMock struct {
+	*authmock.AuthMock
+}
+
+func (pm *pageMock) FederationCallback(data interface{}) error {
+	return nil
+}
+
+func (pm *pageMock) Page(data interface{}) (string, error) {
+	if data.(url.Values).Get("state") != "ok" {
+		return "", errors.New("no matching state found")
+	}
+	return "<p>page</p>", nil
+}
+
+func TestAuthPage(t *testing.T) {
+	assert := assert.New(t)
+	pm := &pageMock{AuthMock: &authmock.AuthMock{AuthName: "webauthn", AuthRealm: "testrealm"}}
+	sa := New([]AuthenticatorListEntry{{Authenticator: authenticator}, {Authenticator: pm}}, signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	do := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.GET, path, nil)
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(http.StatusNotFound, do("/v1/auth/testauth/page").Code)
+	assert.Equal(http.StatusBadRequest, do("/v1/auth/webauthn/page?state=bad").Code)
+	rec := do("/v1/auth/webauthn/page?state=ok")
+	if assert.Equal(http.StatusOK, rec.Code) {
+		assert.Equal("<p>page</p>", rec.Body.String())
+		assert.Contains(rec.Header().Get("Content-Security-Policy"), "script-src 'unsafe-inline'")
+	}
+}
+
+type clientCertMock struct {
+	*authmock.AuthMock
+}
+
+func (cm *clientCertMock) CredentialType() string {
+	return auth.CredentialClientCert
+}
+
+func TestLoginClientCert(t *testing.T) {
+	assert := assert.New(t)
+	cm := &clientCertMock{AuthMock: &authmock.AuthMock{AuthName: "cert", AuthRealm: "testrealm", Secret: []byte("chaincert")}}
+	sa := New([]AuthenticatorListEntry{{Authenticator: authenticator}, {Authenticator: cm}}, signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	assert.True(sa.UsesCredentialType(auth.CredentialClientCert))
+	assert.False(signapi.UsesCredentialType(auth.CredentialClientCert))
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	do := func(state *tls.ConnectionState) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/cert", nil)
+		req.TLS = state
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(http.StatusUnauthorized, do(nil).Code)
+	assert.Equal(http.StatusUnauthorized, do(&tls.ConnectionState{}).Code)
+	rec := do(&tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: []byte("chain")}, {Raw: []byte("cert")}}})
+	assert.Equal(http.StatusOK, rec.Code)
+}
+
+func TestBearerToken(t *testing.T) {
+	token, err := bearerToken("Bearer abc.def.ghi")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abc.def.ghi"), token)
+	_, err = bearerToken("Basic dXNlcjpwYXNz")
+	assert.Error(t, err)
+	_, err = bearerToken("Bearer ")
+	assert.Error(t, err)
+}
+
+func TestAuthChains(t *testing.T) {
+	assert := assert.New(t)
+	otp := &authmock.AuthMock{User: "test", Secret: []byte("123456"), AuthName: "otp", AuthRealm: "testrealm", AuthContext: fakeAuthContext}
+	sso := &authmock.AuthMock{User: "test", Secret: []byte("sso"), AuthName: "sso", AuthRealm: "testrealm", AuthContext: fakeAuthContext}
+	sa := New([]AuthenticatorListEntry{{Authenticator: authenticator}, {Authenticator: otp}, {Authenticator: sso}},
+		signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	login := func(am *authmock.AuthMock, token string) string {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/"+am.Name(), nil)
+		req.SetBasicAuth(am.User, string(am.Secret))
+		if token != "" {
+			req.Header.Set("X-Auth", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+	sign := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Error(sa.SetAuthChains([][]string{{"testauth", "unknown"}}))
+	assert.Error(sa.SetAuthChains([][]string{{}}))
+	// (testauth and otp) or sso
+	assert.NoError(sa.SetAuthChains([][]string{{authenticator.Name(), "otp"}, {"sso"}}))
+
+	first := login(authenticator, "")
+	rec := sign(first)
+	if assert.Equal(http.StatusForbidden, rec.Code) {
+		assert.Contains(rec.Body.String(), objects.ErrorAuthChainIncomplete)
+		assert.Contains(rec.Body.String(), "log in also with otp, or with sso")
+	}
+	req, _ := http.NewRequest(echo.POST, "/v1/introspect", nil)
+	req.Header.Set("X-Auth", "Bearer "+first)
+	rec = httptest.NewRecorder()
+	ee.ServeHTTP(rec, req)
+	var r objects.IntrospectResponse
+	if assert.NoError(json.Unmarshal(rec.Body.Bytes(), &r)) {
+		assert.False(r.Complete)
+		assert.Equal([][]string{{"otp"}, {"sso"}}, r.MissingBackends)
+	}
+
+	assert.Equal(http.StatusOK, sign(login(otp, first)).Code)
+	assert.Equal(http.StatusOK, sign(login(sso, "")).Code)
+	assert.Equal(http.StatusForbidden, sign(login(otp, "")).Code)
+
+	// Host certificates need the complete chain too
+	assert.NoError(sa.EnableHostSigning(HostSignConfig{
+		RequesterPrincipals: []string{"fake*"},
+		Hostnames:           []string{"*.example.com"},
+		DefaultLifetime:     time.Hour,
+		MaxLifetime:         24 * time.Hour,
+	}))
+	hostSign := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/host/sign?hostnames=web1.example.com", bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+	rec = hostSign(first)
+	if assert.Equal(http.StatusForbidden, rec.Code) {
+		assert.Contains(rec.Body.String(), objects.ErrorAuthChainIncomplete)
+	}
+	assert.Equal(http.StatusOK, hostSign(login(otp, first)).Code)
+
+	assert.NoError(sa.SetAuthChains(nil))
+	assert.Equal(http.StatusOK, sign(first).Code)
+}
+
+type groupsMock struct {
+	*authmock.AuthMock
+	groups []string
+}
+
+func (gm *groupsMock) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	actx, ok := gm.AuthMock.Authenticate(pctx, creds)
+	if ok {
+		actx.AuthMeta = map[string]interface{}{auth.MetaGroups: gm.groups}
+	}
+	return actx, ok
+}
+
+func TestBackendPrincipals(t *testing.T) {
+	assert := assert.New(t)
+	dir := &groupsMock{
+		AuthMock: &authmock.AuthMock{User: "alice", Secret: []byte("pw"), AuthName: "dir", AuthRealm: "testrealm",
+			AuthContext: auth.AuthContext{Principals: []string{"alice", "admins", "ops"}}},
+		groups: []string{"admins", "ops"},
+	}
+	sso := &authmock.AuthMock{User: "bob", Secret: []byte("pw"), AuthName: "sso", AuthRealm: "testrealm",
+		AuthContext: auth.AuthContext{Principals: []string{"bob@example.com", "admins"}}}
+	sa := New([]AuthenticatorListEntry{{Authenticator: dir}, {Authenticator: sso}}, signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	login := func(am *authmock.AuthMock, token string) (string, []string) {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/"+am.Name(), nil)
+		req.SetBasicAuth(am.User, string(am.Secret))
+		if token != "" {
+			req.Header.Set("X-Auth", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		if !assert.Equal(http.StatusOK, rec.Code) {
+			return "", nil
+		}
+		parsed, err := jwt.ParseWithClaims(rec.Body.String(), &SignClaim{}, sa.tokenKeyFunc)
+		if !assert.NoError(err) {
+			return "", nil
+		}
+		return rec.Body.String(), parsed.Claims.(*SignClaim).AuthContext.GetPrincipals()
+	}
+
+	assert.Error(sa.SetBackendPrincipals(map[string]BackendPrincipals{"unknown": {Prefix: "x-"}}))
+	assert.Error(sa.SetBackendPrincipals(map[string]BackendPrincipals{"dir": {Template: "{{"}}))
+	assert.NoError(sa.SetBackendPrincipals(map[string]BackendPrincipals{
+		"dir": {Template: "{{if .IsGroup}}grp-{{end}}{{.Principal}}"},
+		"sso": {Template: `{{if contains "@" .Principal}}{{index (split "@" .Principal) 0}}{{end}}`, Prefix: "sso-"},
+	}))
+
+	token, principals := login(dir.AuthMock, "")
+	assert.Equal([]string{"alice", "grp-admins", "grp-ops"}, principals)
+	// The principals of the parent are kept as they are
+	_, principals = login(sso, token)
+	assert.Equal([]string{"alice", "grp-admins", "grp-ops", "sso-bob"}, principals)
+
+	assert.Error(sa.SetBackendPrincipals(map[string]BackendPrincipals{"dir": {Groups: []GroupPrincipals{{Match: "(", Principals: []string{"x"}}}}}))
+	assert.Error(sa.SetBackendPrincipals(map[string]BackendPrincipals{"dir": {Groups: []GroupPrincipals{{Match: "^(a)$", Principals: []string{"%{2}"}}}}}))
+	assert.Error(sa.SetBackendPrincipals(map[string]BackendPrincipals{"dir": {Groups: []GroupPrincipals{{Match: "^a$"}}}}))
+	dir.groups = []string{"admins", "ssh-prod-admin", "ssh-dev-user", "other"}
+	assert.NoError(sa.SetBackendPrincipals(map[string]BackendPrincipals{
+		"dir": {
+			Prefix: "dir-",
+			Groups: []GroupPrincipals{
+				{Match: `^ssh-(?P<env>\w+)-(?P<role>\w+)$`, Principals: []string{"%{role}@%{env}"}},
+				{Match: `^ssh-(\w+)-admin$`, Principals: []string{"root@%{1}"}},
+			},
+		},
+	}))
+	_, principals = login(dir.AuthMock, "")
+	assert.Equal([]string{"dir-alice", "dir-admins", "dir-ops", "admin@prod", "root@prod", "user@dev"}, principals)
+
+	assert.NoError(sa.SetBackendPrincipals(nil))
+	_, principals = login(sso, "")
+	assert.Equal([]string{"bob@example.com", "admins"}, principals)
+}
+
+type probeMock struct {
+	*authmock.AuthMock
+	err error
+}
+
+func (pm *probeMock) Probe() error {
+	return pm.err
+}
+
+func (pm *probeMock) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	if pm.err != nil {
+		return nil, false
+	}
+	return pm.AuthMock.Authenticate(pctx, creds)
+}
+
+func TestHealthChecks(t *testing.T) {
+	assert := assert.New(t)
+	dir := &probeMock{AuthMock: &authmock.AuthMock{User: "alice", Secret: []byte("pw"), AuthName: "dir", AuthRealm: "testrealm",
+		AuthContext: auth.AuthContext{Principals: []string{"alice"}}}}
+	local := &authmock.AuthMock{User: "bob", Secret: []byte("pw"), AuthName: "local", AuthRealm: "testrealm"}
+	sa := New([]AuthenticatorListEntry{{Authenticator: dir}, {Authenticator: local}}, signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	get := func(path string, v interface{}) {
+		req, _ := http.NewRequest(echo.GET, path, nil)
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		if assert.Equal(http.StatusOK, rec.Code) {
+			assert.NoError(json.Unmarshal(rec.Body.Bytes(), v))
+		}
+	}
+	login := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/dir", nil)
+		req.SetBasicAuth("alice", "pw")
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Error(sa.SetHealthChecks(time.Minute, 0))
+	assert.NoError(sa.SetHealthChecks(time.Minute, 50*time.Millisecond))
+	var health []objects.BackendHealth
+	get("/v1/health", &health)
+	assert.Empty(health)
+
+	sa.checkHealth()
+	get("/v1/health", &health)
+	if assert.Len(health, 1) {
+		assert.Equal("dir", health[0].Name)
+		assert.Equal(objects.HealthUp, health[0].Status)
+	}
+	up, _ := sa.backendHealth("dir")
+
+	time.Sleep(time.Millisecond)
+	dir.err = errors.New("connection refused")
+	sa.checkHealth()
+	get("/v1/health", &health)
+	if assert.Len(health, 1) {
+		assert.Equal(objects.HealthDown, health[0].Status)
+		// Left out of the public endpoint
+		assert.Empty(health[0].Error)
+		assert.True(health[0].Since.After(up.since))
+	}
+	var discovered []objects.DiscoverResult
+	get("/v1/auth", &discovered)
+	if assert.Len(discovered, 2) {
+		assert.Equal(objects.HealthDown, discovered[0].Health)
+		assert.Empty(discovered[1].Health)
+	}
+	rec := login()
+	if assert.Equal(http.StatusServiceUnavailable, rec.Code) {
+		assert.Contains(rec.Body.String(), objects.ErrorAuthBackendDown)
+	}
+	status := sa.backendStatus(sa.authList[0])
+	if assert.NotNil(status.Health) {
+		assert.Equal("connection refused", status.Health.Error)
+	}
+
+	// Stays down since the first failure
+	down, _ := sa.backendHealth("dir")
+	sa.checkHealth()
+	r, _ := sa.backendHealth("dir")
+	assert.Equal(down.since, r.since)
+
+	// Hanging probes time out
+	dir.err = nil
+	assert.Error(probeTimeout(probeFunc(func() error {
+		time.Sleep(time.Second)
+		return nil
+	}), 50*time.Millisecond))
+
+	sa.StartHealthChecks()
+	time.Sleep(20 * time.Millisecond)
+	sa.CloseAuthenticators()
+	r, _ = sa.backendHealth("dir")
+	assert.True(r.up)
+	assert.Equal(http.StatusOK, login().Code)
+}
+
+type probeFunc func() error
+
+func (f probeFunc) Probe() error {
+	return f()
+}
+
+func TestLockout(t *testing.T) {
+	assert := assert.New(t)
+	carol := &authmock.AuthMock{User: "carol", Secret: []byte("pw"), AuthName: "lockout", AuthRealm: "testrealm",
+		AuthContext: auth.AuthContext{Principals: []string{"carol"}}}
+	otp := &authmock.AuthMock{Secret: []byte("123456"), AuthName: "otp", AuthRealm: "testrealm",
+		AuthContext: auth.AuthContext{Principals: []string{"carol"}}}
+	sa := New([]AuthenticatorListEntry{{Authenticator: carol}, {Authenticator: otp}}, signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	login := func(user, pw, ip string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/lockout", nil)
+		req.SetBasicAuth(user, pw)
+		req.Header.Set(echo.HeaderXRealIP, ip)
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+	loginOTP := func(token, code, ip string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/otp", nil)
+		req.SetBasicAuth("", code)
+		req.Header.Set("X-Auth", "Bearer "+token)
+		req.Header.Set(echo.HeaderXRealIP, ip)
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+	unlock := func(query string) int {
+		req, _ := http.NewRequest(echo.POST, "/v1/admin/lockouts/unlock?"+query, nil)
+		rec := httptest.NewRecorder()
+		assert.NoError(sa.HandleAdminUnlock(ee.NewContext(req, rec)))
+		return rec.Code
+	}
+
+	assert.Error(sa.SetLockout(Lockout{MaxUserFailures: 3}))
+	assert.NoError(sa.SetLockout(Lockout{
+		MaxUserFailures: 3,
+		MaxIPFailures:   6,
+		Window:          time.Minute,
+		Duration:        time.Minute,
+		MaxDuration:     3 * time.Minute,
+		Delay:           time.Millisecond,
+		MaxDelay:        2 * time.Millisecond,
+	}))
+
+	// A successful login resets the failures of the user
+	ip := "198.51.100.7"
+	assert.Equal(http.StatusUnauthorized, login("carol", "bad", ip).Code)
+	assert.Equal(http.StatusUnauthorized, login("Carol", "bad", ip).Code)
+	assert.Equal(http.StatusOK, login("carol", "pw", ip).Code)
+	for i := 0; i < 3; i++ {
+		assert.Equal(http.StatusUnauthorized, login("carol", "bad", ip).Code)
+	}
+	rec := login("carol", "pw", ip)
+	if assert.Equal(http.StatusTooManyRequests, rec.Code) {
+		assert.Contains(rec.Body.String(), objects.ErrorLockedOut)
+		assert.Equal("60", rec.Header().Get("Retry-After"))
+	}
+
+	// Further lockouts last longer
+	sharedstate.Get().Delete(userLockoutKey("lock", "lockout", "carol"))
+	for i := 0; i < 3; i++ {
+		login("carol", "bad", "198.51.100.8")
+	}
+	assert.True(lockedOut(userLockoutKey("lock", "lockout", "carol")) > time.Minute)
+	for i := 0; i < 3; i++ {
+		sharedstate.Get().Delete(userLockoutKey("lock", "lockout", "carol"))
+		for j := 0; j < 3; j++ {
+			login("carol", "bad", fmt.Sprintf("198.51.100.%d", 10+i))
+		}
+	}
+	assert.True(lockedOut(userLockoutKey("lock", "lockout", "carol")) <= 3*time.Minute)
+	assert.Equal(http.StatusNoContent, unlock("user=CAROL"))
+	assert.Equal(http.StatusOK, login("carol", "pw", "198.51.100.8").Code)
+
+	// The address is locked out for all users
+	ip = "198.51.100.20"
+	for i := 0; i < 6; i++ {
+		assert.Equal(http.StatusUnauthorized, login(fmt.Sprintf("user%d", i), "bad", ip).Code)
+	}
+	assert.Equal(http.StatusTooManyRequests, login("carol", "pw", ip).Code)
+	assert.Equal(http.StatusNoContent, unlock("address="+ip))
+	assert.Equal(http.StatusOK, login("carol", "pw", ip).Code)
+
+	// Failures of the second factor count for the subject of the first
+	// login, and logging in again with the first factor does not reset them
+	ip = "198.51.100.30"
+	token := login("carol", "pw", ip).Body.String()
+	for i := 0; i < 2; i++ {
+		assert.Equal(http.StatusUnauthorized, loginOTP(token, "000000", ip).Code)
+	}
+	token = login("carol", "pw", ip).Body.String()
+	assert.Equal(http.StatusUnauthorized, loginOTP(token, "000000", ip).Code)
+	rec = loginOTP(token, "123456", ip)
+	if assert.Equal(http.StatusTooManyRequests, rec.Code) {
+		assert.Contains(rec.Body.String(), objects.ErrorLockedOut)
+	}
+	// The first factor has its own count
+	assert.Equal(http.StatusOK, login("carol", "pw", ip).Code)
+	assert.Equal(http.StatusNoContent, unlock("user=carol"))
+	assert.Equal(http.StatusOK, loginOTP(token, "123456", ip).Code)
+
+	req, _ := http.NewRequest(echo.POST, "/v1/admin/lockouts/unlock", nil)
+	assert.Error(sa.HandleAdminUnlock(ee.NewContext(req, httptest.NewRecorder())))
+}
+
+func TestBackendConditions(t *testing.T) {
+	assert := assert.New(t)
+	krb := &authmock.AuthMock{User: "test", Secret: []byte("krb"), AuthName: "krb", AuthRealm: "testrealm", AuthContext: fakeAuthContext}
+	sso := &authmock.AuthMock{User: "test", Secret: []byte("sso"), AuthName: "sso", AuthRealm: "testrealm",
+		AuthContext: auth.AuthContext{SubjectName: "test", Principals: []string{"deploy", "root"}}}
+	cert := &authmock.AuthMock{User: "test", Secret: []byte("cert"), AuthName: "cert", AuthRealm: "testrealm", AuthContext: fakeAuthContext}
+	sa := New([]AuthenticatorListEntry{{Authenticator: krb}, {Authenticator: sso}, {Authenticator: cert}},
+		signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	var state *tls.ConnectionState
+	do := func(method, path, ip, token string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderXRealIP, ip)
+		if token != "" {
+			req.Header.Set("X-Auth", "Bearer "+token)
+		}
+		req.TLS = state
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+	login := func(am *authmock.AuthMock, ip string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/"+am.Name(), nil)
+		req.SetBasicAuth(am.User, string(am.Secret))
+		req.Header.Set(echo.HeaderXRealIP, ip)
+		req.TLS = state
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+	discover := func(ip string) []string {
+		var r []objects.DiscoverResult
+		json.Unmarshal(do(echo.GET, "/v1/auth", ip, "", nil).Body.Bytes(), &r)
+		var names []string
+		for _, v := range r {
+			names = append(names, v.AuthenticatorName)
+		}
+		return names
+	}
+
+	caPub, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	caTpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, caTpl, caTpl, caPub, caKey)
+	caCert, _ := x509.ParseCertificate(der)
+	leafPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "laptop-1.corp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, caCert, leafPub, caKey)
+	leaf, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+
+	internal, _ := ParseNetworks([]string{"10.0.0.0/8"})
+	assert.Error(sa.SetBackendConditions(map[string]BackendConditions{"unknown": {}}))
+	assert.Error(sa.SetBackendConditions(map[string]BackendConditions{"cert": {ClientCertNames: []string{"*"}}}))
+	assert.NoError(sa.SetBackendConditions(map[string]BackendConditions{
+		"krb":  {Networks: NetworkFilter{Allow: internal}},
+		"sso":  {Principals: []string{"deploy*"}},
+		"cert": {ClientCAs: pool, ClientCertNames: []string{"*.corp"}},
+	}))
+	assert.True(sa.UsesClientCertConditions())
+
+	assert.Equal([]string{"krb", "sso"}, discover("10.1.2.3"))
+	assert.Equal([]string{"sso"}, discover("203.0.113.5"))
+	rec := login(krb, "203.0.113.5")
+	if assert.Equal(http.StatusForbidden, rec.Code) {
+		assert.Contains(rec.Body.String(), objects.ErrorAuthBackendNotAllowed)
+	}
+	// The token cannot be carried outside either
+	rec = login(krb, "10.1.2.3")
+	if assert.Equal(http.StatusOK, rec.Code) {
+		token := rec.Body.String()
+		assert.Equal(http.StatusOK, do(echo.POST, "/v1/sign", "10.1.2.3", token, testUserPublic).Code)
+		assert.Equal(http.StatusForbidden, do(echo.POST, "/v1/sign", "203.0.113.5", token, testUserPublic).Code)
+
+		// Nor used for host certificates
+		assert.NoError(sa.EnableHostSigning(HostSignConfig{
+			RequesterPrincipals: []string{"fake*"},
+			Hostnames:           []string{"*.example.com"},
+			DefaultLifetime:     time.Hour,
+			MaxLifetime:         24 * time.Hour,
+		}))
+		path := "/v1/host/sign?hostnames=web1.example.com"
+		assert.Equal(http.StatusOK, do(echo.POST, path, "10.1.2.3", token, testUserPublic).Code)
+		rec = do(echo.POST, path, "203.0.113.5", token, testUserPublic)
+		if assert.Equal(http.StatusForbidden, rec.Code) {
+			assert.Contains(rec.Body.String(), objects.ErrorAuthBackendNotAllowed)
+		}
+	}
+
+	// Principals other than the allowed ones are removed
+	rec = do(echo.POST, "/v1/sign", "203.0.113.5", login(sso, "203.0.113.5").Body.String(), testUserPublic)
+	if assert.Equal(http.StatusOK, rec.Code) {
+		raw, _, _, _, _ := ssh.ParseAuthorizedKey(rec.Body.Bytes())
+		assert.Equal([]string{"deploy"}, raw.(*ssh.Certificate).ValidPrincipals)
+	}
+
+	assert.Equal(http.StatusForbidden, login(cert, "10.1.2.3").Code)
+	state = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{caCert}}
+	assert.Equal(http.StatusForbidden, login(cert, "10.1.2.3").Code)
+	state = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}
+	assert.Equal([]string{"krb", "sso", "cert"}, discover("10.1.2.3"))
+	assert.Equal(http.StatusOK, login(cert, "10.1.2.3").Code)
+}
+
+func TestBackendAudiences(t *testing.T) {
+	assert := assert.New(t)
+	acme := &authmock.AuthMock{User: "test", Secret: []byte("acme"), AuthName: "acme-ldap", AuthRealm: "acme", AuthContext: fakeAuthContext}
+	initech := &authmock.AuthMock{User: "test", Secret: []byte("initech"), AuthName: "initech-ldap", AuthRealm: "initech", AuthContext: fakeAuthContext}
+	sa := New([]AuthenticatorListEntry{{Authenticator: authenticator}, {Authenticator: acme}, {Authenticator: initech}},
+		signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	do := func(req *http.Request, audience, realm string) *httptest.ResponseRecorder {
+		if audience != "" {
+			req.Header.Set(objects.AudienceHeader, audience)
+		}
+		if realm != "" {
+			req.Header.Set(objects.RealmHeader, realm)
+		}
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+	discover := func(audience, realm string) []string {
+		req, _ := http.NewRequest(echo.GET, "/v1/auth", nil)
+		var r []objects.DiscoverResult
+		json.Unmarshal(do(req, audience, realm).Body.Bytes(), &r)
+		var names []string
+		for _, v := range r {
+			names = append(names, v.AuthenticatorName)
+		}
+		return names
+	}
+	login := func(am *authmock.AuthMock, audience, realm string, token ...string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/"+am.Name(), nil)
+		req.SetBasicAuth(am.User, string(am.Secret))
+		if len(token) > 0 {
+			req.Header.Set("X-Auth", "Bearer "+token[0])
+		}
+		return do(req, audience, realm)
+	}
+	sign := func(token, audience string) int {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+token)
+		return do(req, audience, "").Code
+	}
+
+	assert.NoError(sa.SetBackendConditions(map[string]BackendConditions{
+		"acme-ldap":    {Audiences: []string{"acme", "acme-*"}},
+		"initech-ldap": {Audiences: []string{"initech"}, Realms: []string{"initech"}},
+	}))
+
+	// Shared backends are available to everyone, restricted ones are unknown
+	// to the other tenants
+	assert.Equal([]string{"testauth"}, discover("", ""))
+	assert.Equal([]string{"testauth", "acme-ldap"}, discover("acme-staging", ""))
+	assert.Equal([]string{"testauth"}, discover("initech", ""))
+	assert.Equal([]string{"testauth", "initech-ldap"}, discover("initech", "initech"))
+	assert.Equal(http.StatusNotFound, login(acme, "", "").Code)
+	assert.Equal(http.StatusNotFound, login(acme, "initech", "initech").Code)
+
+	rec := login(acme, "acme", "")
+	if assert.Equal(http.StatusOK, rec.Code) {
+		token := rec.Body.String()
+		claims := &SignClaim{}
+		new(jwt.Parser).ParseUnverified(token, claims)
+		assert.Equal("acme", claims.ClientAudience)
+		assert.Equal(http.StatusOK, sign(token, "acme"))
+		// The token keeps its audience
+		assert.Equal(http.StatusOK, sign(token, "initech"))
+		assert.Equal(http.StatusNotFound, login(initech, "initech", "initech", token).Code)
+	}
+
+	// Tokens without the audience cannot be carried to the backend
+	rec = login(authenticator, "", "")
+	if assert.Equal(http.StatusOK, rec.Code) {
+		assert.Equal(http.StatusNotFound, login(acme, "acme", "", rec.Body.String()).Code)
+	}
+	rec = login(acme, "acme", "")
+	if assert.Equal(http.StatusOK, rec.Code) {
+		assert.NoError(sa.SetBackendConditions(map[string]BackendConditions{
+			"acme-ldap": {Audiences: []string{"acme-prod"}},
+		}))
+		assert.Equal(http.StatusForbidden, sign(rec.Body.String(), "acme-prod"))
+	}
+}
+
+func TestBackendEndpoints(t *testing.T) {
+	assert := assert.New(t)
+	acme := &authmock.AuthMock{User: "test", Secret: []byte("acme"), AuthName: "acme-ldap", AuthRealm: "acme", AuthContext: fakeAuthContext}
+	initech := &authmock.AuthMock{User: "test", Secret: []byte("initech"), AuthName: "initech-ldap", AuthRealm: "initech", AuthContext: fakeAuthContext}
+	sa := New([]AuthenticatorListEntry{
+		{Authenticator: authenticator},
+		{Authenticator: acme, Endpoint: "ldap"},
+		{Authenticator: initech, Endpoint: "ldap"},
+	}, signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	do := func(req *http.Request, audience string) *httptest.ResponseRecorder {
+		if audience != "" {
+			req.Header.Set(objects.AudienceHeader, audience)
+		}
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+	discover := func(audience string) []string {
+		req, _ := http.NewRequest(echo.GET, "/v1/auth", nil)
+		var r []objects.DiscoverResult
+		json.Unmarshal(do(req, audience).Body.Bytes(), &r)
+		var names []string
+		for _, v := range r {
+			names = append(names, v.AuthenticatorName)
+		}
+		return names
+	}
+	login := func(name, secret, audience string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/"+name, nil)
+		req.SetBasicAuth("test", secret)
+		return do(req, audience)
+	}
+
+	// Backends sharing the endpoint need audiences or realms, and the
+	// endpoint cannot be the name of another backend
+	assert.Error(sa.SetBackendConditions(map[string]BackendConditions{
+		"acme-ldap": {Audiences: []string{"acme"}},
+	}))
+	assert.NoError(sa.SetBackendConditions(map[string]BackendConditions{
+		"acme-ldap":    {Audiences: []string{"acme"}},
+		"initech-ldap": {Audiences: []string{"initech"}},
+	}))
+
+	// Each tenant has its own ldap
+	assert.Equal([]string{"testauth"}, discover(""))
+	assert.Equal([]string{"testauth", "ldap"}, discover("acme"))
+	assert.Equal([]string{"testauth", "ldap"}, discover("initech"))
+	assert.Equal(http.StatusNotFound, login("ldap", "acme", "").Code)
+	assert.Equal(http.StatusUnauthorized, login("ldap", "acme", "initech").Code)
+	rec := login("ldap", "acme", "acme")
+	if assert.Equal(http.StatusOK, rec.Code) {
+		claims := &SignClaim{}
+		new(jwt.Parser).ParseUnverified(rec.Body.String(), claims)
+		assert.Equal([]string{"acme-ldap"}, claims.AuthContext.GetAuthenticators())
+	}
+	rec = login("ldap", "initech", "initech")
+	if assert.Equal(http.StatusOK, rec.Code) {
+		claims := &SignClaim{}
+		new(jwt.Parser).ParseUnverified(rec.Body.String(), claims)
+		assert.Equal([]string{"initech-ldap"}, claims.AuthContext.GetAuthenticators())
+	}
+	// The backend name still works within the tenant
+	assert.Equal(http.StatusOK, login("acme-ldap", "acme", "acme").Code)
+	assert.Equal(http.StatusNotFound, login("acme-ldap", "acme", "initech").Code)
+
+	// Missing logins are named by the endpoint
+	assert.NoError(sa.SetAuthChains([][]string{{"testauth", "acme-ldap"}}))
+	req, _ := http.NewRequest(echo.POST, "/v1/sign", bytes.NewBuffer(testUserPublic))
+	req.Header.Set("X-Auth", "Bearer "+login("testauth", "test", "acme").Body.String())
+	rec = do(req, "")
+	if assert.Equal(http.StatusForbidden, rec.Code) {
+		assert.Contains(rec.Body.String(), "log in also with ldap")
+		assert.NotContains(rec.Body.String(), "acme-ldap")
+	}
+
+	sa = New([]AuthenticatorListEntry{{Authenticator: authenticator}, {Authenticator: acme, Endpoint: "testauth"}},
+		signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	assert.Error(sa.SetBackendConditions(map[string]BackendConditions{
+		"acme-ldap": {Audiences: []string{"acme"}},
+	}))
+}
+
+func TestStepUp(t *testing.T) {
+	assert := assert.New(t)
+	otp := &authmock.AuthMock{User: "test", Secret: []byte("123456"), AuthName: "otp", AuthRealm: "testrealm", AuthContext: fakeAuthContext}
+	sa := New([]AuthenticatorListEntry{{Authenticator: authenticator}, {Authenticator: otp}},
+		signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	login := func(am *authmock.AuthMock, token string) string {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/"+am.Name(), nil)
+		req.SetBasicAuth(am.User, string(am.Secret))
+		if token != "" {
+			req.Header.Set("X-Auth", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		assert.Equal(http.StatusOK, rec.Code)
+		return rec.Body.String()
+	}
+	sign := func(token, query string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/sign?"+query, bytes.NewBuffer(testUserPublic))
+		req.Header.Set("X-Auth", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+	long := "exclude_principals=fake3&expires=" + url.QueryEscape(time.Now().Add(12*time.Hour).Format(time.RFC3339))
+
+	assert.Error(sa.SetStepUp([]StepUp{{Backends: []string{"otp"}}}))
+	assert.Error(sa.SetStepUp([]StepUp{{Lifetime: time.Hour}}))
+	assert.Error(sa.SetStepUp([]StepUp{{Lifetime: time.Hour, Backends: []string{"unknown"}}}))
+	assert.NoError(sa.SetStepUp([]StepUp{
+		{Lifetime: 8 * time.Hour, Backends: []string{"otp"}},
+		{Principals: []string{"fake3"}, Approval: true},
+	}))
+
+	first := login(authenticator, "")
+	assert.Equal(http.StatusOK, sign(first, "exclude_principals=fake3").Code)
+	rec := sign(first, long)
+	if assert.Equal(http.StatusForbidden, rec.Code) {
+		var p objects.Problem
+		assert.NoError(json.Unmarshal(rec.Body.Bytes(), &p))
+		assert.Equal(objects.ErrorStepUpRequired, p.Code)
+		assert.Equal([]string{"otp"}, p.StepUpBackends)
+	}
+	assert.Equal(http.StatusOK, sign(login(otp, first), long).Code)
+
+	// Approval is the only way to step up, refused without approvals
+	rec = sign(first, "")
+	if assert.Equal(http.StatusForbidden, rec.Code) {
+		assert.Contains(rec.Body.String(), objects.ErrorStepUpRequired)
+		assert.NotContains(rec.Body.String(), "stepUpBackends")
+	}
+	store, _ := approval.NewStore("", time.Hour)
+	assert.NoError(sa.EnableApprovals(ApprovalConfig{ApproverPrincipals: []string{"oncall"}}, store))
+	assert.Equal(http.StatusAccepted, sign(first, "").Code)
+}
+
+type passwordMock struct {
+	*authmock.AuthMock
+	failure string
+	expires string
+}
+
+func (pm *passwordMock) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	actx, ok := pm.AuthMock.Authenticate(pctx, creds)
+	if ok && pm.failure != "" {
+		creds.SetPasswordFailure(pm.failure)
+		return nil, false
+	}
+	if ok && pm.expires != "" {
+		actx.AuthMeta = map[string]interface{}{auth.MetaPasswordExpires: pm.expires}
+	}
+	return actx, ok
+}
+
+func TestPasswordFeedback(t *testing.T) {
+	assert := assert.New(t)
+	dir := &passwordMock{AuthMock: &authmock.AuthMock{User: "test", Secret: []byte("test"), AuthName: "dir", AuthRealm: "testrealm", AuthContext: fakeAuthContext}}
+	sa := New([]AuthenticatorListEntry{{Authenticator: dir}}, signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	login := func(password string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/dir", nil)
+		req.SetBasicAuth("test", password)
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := login("test")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Empty(rec.Header().Get(objects.PasswordExpiresHeader))
+
+	dir.expires = "2026-10-20T12:00:00Z"
+	rec = login("test")
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Equal(dir.expires, rec.Header().Get(objects.PasswordExpiresHeader))
+
+	dir.failure = auth.PasswordExpired
+	rec = login("test")
+	if assert.Equal(http.StatusForbidden, rec.Code) {
+		assert.Contains(rec.Body.String(), objects.ErrorPasswordExpired)
+	}
+	dir.failure = auth.PasswordMustChange
+	rec = login("test")
+	if assert.Equal(http.StatusForbidden, rec.Code) {
+		assert.Contains(rec.Body.String(), objects.ErrorPasswordMustChange)
+	}
+	dir.failure = auth.MFAEnrollRequired
+	rec = login("test")
+	if assert.Equal(http.StatusForbidden, rec.Code) {
+		assert.Contains(rec.Body.String(), objects.ErrorMFAEnrollRequired)
+	}
+	assert.Equal(http.StatusUnauthorized, login("wrong").Code)
+}
+
+type hangingMock struct {
+	*authmock.AuthMock
+	mu   sync.Mutex
+	hang chan struct{}
+	// Reported as the failure of the backend when set
+	err error
+}
+
+func (hm *hangingMock) failWith(err error) {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	hm.err = err
+}
+
+// Logins block until the returned channel is closed
+func (hm *hangingMock) hangUntil() chan struct{} {
+	hm.mu.Lock()
+	defer hm.mu.Unlock()
+	hm.hang = make(chan struct{})
+	return hm.hang
+}
+
+func (hm *hangingMock) Authenticate(pctx *auth.AuthContext, creds *auth.Credentials) (*auth.AuthContext, bool) {
+	hm.mu.Lock()
+	hang, err := hm.hang, hm.err
+	hm.mu.Unlock()
+	if hang != nil {
+		<-hang
+	}
+	if err != nil {
+		creds.SetBackendError(err)
+		return nil, false
+	}
+	return hm.AuthMock.Authenticate(pctx, creds)
+}
+
+func TestBackendLimits(t *testing.T) {
+	assert := assert.New(t)
+	dir := &hangingMock{AuthMock: &authmock.AuthMock{User: "alice", Secret: []byte("pw"), AuthName: "dir", AuthRealm: "testrealm", AuthContext: fakeAuthContext}}
+	local := &authmock.AuthMock{User: "bob", Secret: []byte("pw"), AuthName: "local", AuthRealm: "testrealm", AuthContext: fakeAuthContext}
+	sa := New([]AuthenticatorListEntry{{Authenticator: dir}, {Authenticator: local}}, signapi.signer, signingKey, time.Hour, 24*time.Hour)
+	ee := echo.New()
+	ee.HTTPErrorHandler = HTTPErrorHandler
+	sa.RegisterRoutes(ee.Group("/v1"))
+	login := func(am auth.Authenticator, user string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(echo.POST, "/v1/auth/"+am.Name(), nil)
+		req.SetBasicAuth(user, "pw")
+		rec := httptest.NewRecorder()
+		ee.ServeHTTP(rec, req)
+		return rec
+	}
+	assertProblem := func(rec *httptest.ResponseRecorder, code string) {
+		if assert.Equal(http.StatusServiceUnavailable, rec.Code) {
+			assert.Contains(rec.Body.String(), code)
+			assert.NotEmpty(rec.Header().Get("Retry-After"))
+		}
+	}
+
+	assert.Error(sa.SetBackendLimits(map[string]BackendLimits{"unknown": {MaxConcurrent: 1}}))
+	assert.Error(sa.SetBackendLimits(map[string]BackendLimits{"dir": {FailureThreshold: 1}}))
+	assert.NoError(sa.SetBackendLimits(map[string]BackendLimits{
+		"dir": {MaxConcurrent: 1, Timeout: 50 * time.Millisecond, FailureThreshold: 2, OpenTimeout: 100 * time.Millisecond},
+	}))
+	limiter := sa.backendLimits["dir"]
+	assert.Equal(http.StatusOK, login(dir, "alice").Code)
+
+	// A hung backend times out and keeps its slot without blocking the
+	// other backends
+	release := dir.hangUntil()
+	assertProblem(login(dir, "alice"), objects.ErrorAuthBackendDown)
+	assertProblem(login(dir, "alice"), objects.ErrorAuthBackendBusy)
+	assert.Equal(http.StatusOK, login(local, "bob").Code)
+	assert.Equal(circuitClosed, limiter.circuit())
+	close(release)
+	assert.Eventually(func() bool { return len(limiter.slots) == 0 }, time.Second, 5*time.Millisecond)
+
+	// Wrong passwords do not count as failures of the backend
+	assert.Equal(http.StatusUnauthorized, login(dir, "mallory").Code)
+	assert.Equal(circuitClosed, limiter.circuit())
+
+	// Two consecutive timeouts open the circuit and the backend is not
+	// called until the open timeout has passed
+	for i := 0; i < 2; i++ {
+		release = dir.hangUntil()
+		assertProblem(login(dir, "alice"), objects.ErrorAuthBackendDown)
+		close(release)
+		assert.Eventually(func() bool { return len(limiter.slots) == 0 }, time.Second, 5*time.Millisecond)
+	}
+	assert.Equal(circuitOpen, limiter.circuit())
+	dir.hangUntil()
+	assertProblem(login(dir, "alice"), objects.ErrorAuthBackendDown)
+	assert.Empty(limiter.slots)
+
+	// A failing trial login opens it again, a successful one closes it
+	time.Sleep(100 * time.Millisecond)
+	release = dir.hangUntil()
+	assertProblem(login(dir, "alice"), objects.ErrorAuthBackendDown)
+	assert.Equal(circuitOpen, limiter.circuit())
+	close(release)
+	assert.Eventually(func() bool { return len(limiter.slots) == 0 }, time.Second, 5*time.Millisecond)
+	close(dir.hangUntil())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(http.StatusOK, login(dir, "alice").Code)
+	assert.Equal(circuitClosed, limiter.circuit())
+	assert.Equal(objects.CircuitClosed, sa.backendStatus(AuthenticatorListEntry{Authenticator: dir}).Circuit)
+	assert.Empty(sa.backendStatus(AuthenticatorListEntry{Authenticator: local}).Circuit)
+
+	// Errors the backend reports open the circuit without health checks
+	dir.failWith(errors.New("connection refused"))
+	for i := 0; i < 2; i++ {
+		rec := login(dir, "alice")
+		if assert.Equal(http.StatusServiceUnavailable, rec.Code) {
+			assert.Contains(rec.Body.String(), objects.ErrorAuthBackendDown)
+		}
+	}
+	assert.Equal(circuitOpen, limiter.circuit())
+	dir.failWith(nil)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(http.StatusOK, login(dir, "alice").Code)
+	assert.Equal(circuitClosed, limiter.circuit())
+}
@@ -0,0 +1,134 @@
+package signapi
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi/objects"
+	"github.com/gobwas/glob"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// Set when a step-up is satisfied with an approval instead of a backend
+const ctxStepUpApproval = "step_up_approval"
+
+// Additional factor required for certificates beyond what the primary login
+// allows, e.g. TOTP for certificates valid for more than an hour. Both the
+// lifetime and the principals need to match when set
+type StepUp struct {
+	// Applies to certificates valid for longer than this
+	Lifetime time.Duration
+	// Applies to certificates with any principal matching the patterns
+	Principals []string
+	// Logging in also with any of these satisfies the step-up
+	Backends []string
+	// Send the request for approval instead of refusing it
+	Approval bool
+}
+
+type stepUp struct {
+	lifetime   time.Duration
+	principals []glob.Glob
+	backends   []string
+	approval   bool
+}
+
+func (sa *SignApi) SetStepUp(rules []StepUp) error {
+	var r []stepUp
+	for i, v := range rules {
+		if v.Lifetime <= 0 && len(v.Principals) == 0 {
+			return errors.Errorf("invalid step-up rule %d: lifetime or principals required", i)
+		}
+		if len(v.Backends) == 0 && !v.Approval {
+			return errors.Errorf("invalid step-up rule %d: backends or approval required", i)
+		}
+		for _, name := range v.Backends {
+			if _, ok := sa.auth[name]; !ok {
+				return errors.Errorf("invalid step-up rule %d: unknown auth backend %s", i, name)
+			}
+		}
+		principals, err := compileGlobs(v.Principals)
+		if err != nil {
+			return errors.Wrapf(err, "invalid step-up rule %d", i)
+		}
+		r = append(r, stepUp{
+			lifetime:   v.Lifetime,
+			principals: principals,
+			backends:   append([]string(nil), v.Backends...),
+			approval:   v.Approval,
+		})
+	}
+	sa.stepUps = r
+	return nil
+}
+
+func (s *stepUp) appliesTo(cert *ssh.Certificate) bool {
+	if s.lifetime > 0 && time.Until(time.Unix(int64(cert.ValidBefore), 0)) <= s.lifetime {
+		return false
+	}
+	if len(s.principals) == 0 {
+		return true
+	}
+	for _, p := range cert.ValidPrincipals {
+		if matchAny(s.principals, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stepUp) satisfiedBy(authenticators []string) bool {
+	for _, a := range authenticators {
+		for _, b := range s.backends {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Refuse the certificate if it needs a step-up the auth context does not
+// have. The backends the client can step up with are returned in the
+// problem. Rules satisfied only by an approval refuse the certificate when
+// approvals are not enabled
+func (sa *SignApi) checkStepUp(c echo.Context, actx *auth.AuthContext, cert *ssh.Certificate) error {
+	authenticators := actx.GetAuthenticators()
+	var backends []string
+	refused := false
+	seen := map[string]bool{}
+	for i := range sa.stepUps {
+		s := &sa.stepUps[i]
+		if !s.appliesTo(cert) || s.satisfiedBy(authenticators) {
+			continue
+		}
+		if s.approval && sa.approvals != nil {
+			c.Set(ctxStepUpApproval, true)
+			continue
+		}
+		refused = true
+		for _, b := range s.backends {
+			if !seen[b] {
+				seen[b] = true
+				backends = append(backends, sa.endpointName(b))
+			}
+		}
+	}
+	if !refused {
+		return nil
+	}
+	detail := "certificate requires step-up authentication"
+	if len(backends) > 0 {
+		detail += ", log in also with " + strings.Join(backends, " or ")
+	}
+	auditCertificateDenied(c, actx, cert, detail)
+	return echo.NewHTTPError(http.StatusForbidden, &objects.Problem{
+		Code:           objects.ErrorStepUpRequired,
+		Detail:         detail,
+		StepUpBackends: backends,
+	})
+}
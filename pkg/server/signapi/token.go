@@ -0,0 +1,120 @@
+package signapi
+
+import (
+	"strings"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/auth"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// Auth context values that can be copied into the token claims. Meta values
+// are selected with the meta. prefix, for example meta.email
+const (
+	TokenClaimSubject    = "subject"
+	TokenClaimPrincipals = "principals"
+	TokenClaimGroups     = "groups"
+	TokenClaimBackends   = "backends"
+	tokenClaimMetaPrefix = "meta."
+)
+
+type TokenPolicy struct {
+	// Defaults to TokenLifeSecs
+	Lifetime time.Duration
+	// Set into issued tokens and required from presented tokens if not empty
+	Audience string
+	Issuer   string
+	// Claim name to the auth context value copied into the token
+	Claims map[string]string
+	// Cap the token lifetime to the longest certificate lifetime the user
+	// is allowed
+	CapToCertLifetime bool
+}
+
+// Set the lifetime and claims of issued auth tokens
+func (sa *SignApi) SetTokenPolicy(p TokenPolicy) error {
+	if p.Lifetime < 0 {
+		return errors.New("token lifetime cannot be negative")
+	}
+	if p.Lifetime == 0 {
+		p.Lifetime = TokenLifeSecs * time.Second
+	}
+	if sa.tkeys != nil && sa.tkeys.interval != 0 && p.Lifetime >= sa.tkeys.interval {
+		return errors.New("token lifetime must be shorter than the token key rotation interval")
+	}
+	for name, src := range p.Claims {
+		switch {
+		case name == "":
+			return errors.New("token claim name cannot be empty")
+		case src == TokenClaimSubject, src == TokenClaimPrincipals,
+			src == TokenClaimGroups, src == TokenClaimBackends:
+		case strings.HasPrefix(src, tokenClaimMetaPrefix) && len(src) > len(tokenClaimMetaPrefix):
+		default:
+			return errors.Errorf("unknown source %q for token claim %s", src, name)
+		}
+	}
+	sa.tokenPolicy = &p
+	return nil
+}
+
+func (sa *SignApi) tokenLifetime(actx *auth.AuthContext) time.Duration {
+	if sa.tokenPolicy == nil {
+		return TokenLifeSecs * time.Second
+	}
+	life := sa.tokenPolicy.Lifetime
+	if sa.tokenPolicy.CapToCertLifetime {
+		if max := sa.lifetimeLimits.maxLifetime(actx, sa.maxCertLife); max < life {
+			life = max
+		}
+	}
+	return life
+}
+
+func (sa *SignApi) tokenClaims(actx *auth.AuthContext) map[string]interface{} {
+	if sa.tokenPolicy == nil || len(sa.tokenPolicy.Claims) == 0 {
+		return nil
+	}
+	r := map[string]interface{}{}
+	var meta map[string]interface{}
+	for name, src := range sa.tokenPolicy.Claims {
+		var v interface{}
+		switch src {
+		case TokenClaimSubject:
+			v = actx.GetSubjectName()
+		case TokenClaimPrincipals:
+			v = actx.GetPrincipals()
+		case TokenClaimGroups:
+			v = actx.GetGroups()
+		case TokenClaimBackends:
+			v = actx.GetAuthenticators()
+		default:
+			if meta == nil {
+				meta = actx.GetAuthMeta()
+			}
+			v = meta[strings.TrimPrefix(src, tokenClaimMetaPrefix)]
+		}
+		if v != nil {
+			r[name] = v
+		}
+	}
+	return r
+}
+
+// Check the audience and issuer of a presented token
+func (sa *SignApi) verifyTokenClaims(token *jwt.Token) error {
+	if sa.tokenPolicy == nil {
+		return nil
+	}
+	claims, ok := token.Claims.(*SignClaim)
+	if !ok {
+		return nil
+	}
+	if sa.tokenPolicy.Audience != "" && !claims.VerifyAudience(sa.tokenPolicy.Audience, true) {
+		return errors.New("invalid token audience")
+	}
+	if sa.tokenPolicy.Issuer != "" && !claims.VerifyIssuer(sa.tokenPolicy.Issuer, true) {
+		return errors.New("invalid token issuer")
+	}
+	return nil
+}
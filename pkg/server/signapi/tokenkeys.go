@@ -0,0 +1,133 @@
+package signapi
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// TokenKeys signs and validates the auth tokens. With a rotation interval
+// the signing key changes every interval. Keys are derived from the secret
+// and the interval number so replicas sharing the secret agree on them
+// without coordination. Tokens signed with the key of the previous interval
+// stay valid until they expire. Without rotation the secrets are used as is
+type TokenKeys struct {
+	secrets  []tokenSecret
+	interval time.Duration
+	now      func() time.Time
+}
+
+type tokenSecret struct {
+	id  string
+	key []byte
+}
+
+func newTokenSecret(key []byte) tokenSecret {
+	sum := sha256.Sum256(key)
+	return tokenSecret{id: hex.EncodeToString(sum[:4]), key: key}
+}
+
+// Signing key for the interval
+func (s tokenSecret) derive(n int64) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte("ssh-inscribe token key " + strconv.FormatInt(n, 10)))
+	return mac.Sum(nil)
+}
+
+// New token keys signing with the secret. Tokens signed with the previous
+// secrets are accepted to allow replacing the secret without invalidating
+// the tokens in flight. The interval must be longer than the token lifetime
+func NewTokenKeys(secret []byte, interval time.Duration, previous ...[]byte) (*TokenKeys, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("token signing secret is required")
+	}
+	if interval != 0 && interval <= TokenLifeSecs*time.Second {
+		return nil, errors.Errorf("token key rotation interval must be longer than %ds", TokenLifeSecs)
+	}
+	k := &TokenKeys{
+		secrets:  []tokenSecret{newTokenSecret(secret)},
+		interval: interval,
+		now:      time.Now,
+	}
+	for _, p := range previous {
+		k.secrets = append(k.secrets, newTokenSecret(p))
+	}
+	return k, nil
+}
+
+func (k *TokenKeys) period() int64 {
+	return k.now().UnixNano() / int64(k.interval)
+}
+
+// Sign the token with the current key, setting the key id header
+func (k *TokenKeys) sign(token *jwt.Token) (string, error) {
+	s := k.secrets[0]
+	if k.interval == 0 {
+		return token.SignedString(s.key)
+	}
+	n := k.period()
+	token.Header["kid"] = s.id + "." + strconv.FormatInt(n, 10)
+	return token.SignedString(s.derive(n))
+}
+
+// Validation key for the token
+func (k *TokenKeys) keyFunc(token *jwt.Token) (interface{}, error) {
+	if token.Method != jwt.SigningMethodHS256 {
+		return nil, errors.Errorf("unexpected signing method %v", token.Header["alg"])
+	}
+	kid, _ := token.Header["kid"].(string)
+	if k.interval == 0 {
+		if kid != "" {
+			return nil, errors.Errorf("unexpected key id %s", kid)
+		}
+		return k.staticKey(token), nil
+	}
+	parts := strings.SplitN(kid, ".", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("key id is missing")
+	}
+	n, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid key id %s", kid)
+	}
+	// Allow one interval of clock skew between replicas
+	if cur := k.period(); n < cur-1 || n > cur+1 {
+		return nil, errors.Errorf("key %s has been retired", kid)
+	}
+	for _, s := range k.secrets {
+		if s.id == parts[0] {
+			return s.derive(n), nil
+		}
+	}
+	return nil, errors.Errorf("unknown key id %s", kid)
+}
+
+// Secret the token was signed with without rotation. Tokens carry no key
+// id then so the signature is checked against each secret. Falls back to
+// the current secret for the validation to fail on
+func (k *TokenKeys) staticKey(token *jwt.Token) []byte {
+	if len(k.secrets) > 1 {
+		if i := strings.LastIndexByte(token.Raw, '.'); i > 0 {
+			for _, s := range k.secrets {
+				if token.Method.Verify(token.Raw[:i], token.Raw[i+1:], s.key) == nil {
+					return s.key
+				}
+			}
+		}
+	}
+	return k.secrets[0].key
+}
+
+// Current key id or empty without rotation
+func (k *TokenKeys) CurrentID() string {
+	if k.interval == 0 {
+		return ""
+	}
+	return k.secrets[0].id + "." + strconv.FormatInt(k.period(), 10)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"github.com/aakso/ssh-inscribe/pkg/certdb"
+	"github.com/aakso/ssh-inscribe/pkg/revocation"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/aakso/ssh-inscribe/pkg/storage"
+)
+
+// Open the stores for the server state. With the storage backend configured
+// all of them come from it, otherwise from the certdb, sharedstate and
+// server settings
+func (s *Server) openStores(conf *Config) error {
+	st, stConf, err := storage.Open()
+	if err != nil {
+		return err
+	}
+	if st != nil {
+		s.storage = st
+		sharedstate.Set(st.Sessions(), st.Shared())
+		if s.revocations, err = revocation.NewStoreWithBackend(st.Revocations()); err != nil {
+			return err
+		}
+		if st.Shared() {
+			s.revocations.SetShared(sharedstate.Get())
+		}
+		s.certs = st.Certificates()
+		s.storeCerts = stConf.StoreCertificate
+		s.serials = st.Serials()
+		return nil
+	}
+
+	if err := sharedstate.Setup(); err != nil {
+		return err
+	}
+	if conf.RevocationStore != "" {
+		store, err := revocation.NewStore(conf.RevocationStore)
+		if err != nil {
+			return err
+		}
+		if sharedstate.IsShared() {
+			store.SetShared(sharedstate.Get())
+		}
+		s.revocations = store
+	}
+	certs, certsConf, err := certdb.Open()
+	if err != nil {
+		return err
+	}
+	if certs != nil {
+		s.certs = certs
+		s.storeCerts = certsConf.StoreCertificate
+	}
+	s.serials, err = newSerialGenerator(conf.Serial, certs)
+	return err
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/systemd"
+)
+
+// Report the service state to systemd if run as a notify service
+func notify(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		Log.WithError(err).WithField("state", state).Warn("cannot notify systemd")
+	}
+}
+
+// Keep the systemd watchdog from restarting the service until shutdown
+func (s *Server) startWatchdog() {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		Log.WithError(err).Warn("systemd watchdog disabled")
+		return
+	}
+	if interval == 0 {
+		return
+	}
+	Log.WithField("interval", interval).Info("systemd watchdog enabled")
+	go func() {
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				notify(systemd.Watchdog)
+			case <-s.shutdownDone:
+				return
+			}
+		}
+	}()
+}
+
+// Serve on the listener passed by systemd or listen on the configured
+// address if nil
+func (s *Server) serveListener(name string, srv *http.Server, l net.Listener) error {
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", srv.Addr); err != nil {
+			return err
+		}
+	}
+	s.addListener(name, l)
+	return srv.Serve(l)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/aakso/ssh-inscribe/pkg/server/signapi"
+	"github.com/aakso/ssh-inscribe/pkg/tracing"
+	"github.com/labstack/echo/v4"
+)
+
+// Start a server span for each request continuing the trace of the caller
+func TraceRequests() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			name := req.Method
+			if c.Path() != "" {
+				name += " " + c.Path()
+			}
+			ctx, span := tracing.StartServer(req.Context(), name, req.Header.Get(tracing.TraceParentHeader))
+			if span == nil {
+				return next(c)
+			}
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+			span.SetAttribute("http.method", req.Method)
+			span.SetAttribute("http.route", c.Path())
+			span.SetAttribute("http.target", req.URL.RequestURI())
+			span.SetAttribute("net.peer.ip", c.RealIP())
+
+			err := next(c)
+			code := responseStatus(c, err)
+			span.SetAttribute("http.status_code", code)
+			if user, ok := signapi.LogFields(c)["user"].(string); ok {
+				span.SetAttribute("enduser.id", user)
+			}
+			if code >= http.StatusInternalServerError {
+				if err == nil {
+					err = echo.NewHTTPError(code)
+				}
+				span.SetError(err)
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Create the unix socket listener replacing a stale socket left behind by a
+// previous instance
+func newUnixListener(conf UnixSocketConfig) (net.Listener, error) {
+	if fi, err := os.Lstat(conf.Path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("%s exists and is not a socket", conf.Path)
+		}
+		if err := os.Remove(conf.Path); err != nil {
+			return nil, errors.Wrap(err, "cannot remove stale socket")
+		}
+	}
+	l, err := net.Listen("unix", conf.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPermissions(conf); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func setSocketPermissions(conf UnixSocketConfig) error {
+	if conf.Mode != "" {
+		mode, err := strconv.ParseUint(conf.Mode, 8, 32)
+		if err != nil {
+			return errors.Wrap(err, "invalid unix socket mode")
+		}
+		if err := os.Chmod(conf.Path, os.FileMode(mode)); err != nil {
+			return errors.Wrap(err, "cannot set unix socket mode")
+		}
+	}
+	uid, gid := -1, -1
+	if conf.Owner != "" {
+		u, err := user.Lookup(conf.Owner)
+		if err != nil {
+			return errors.Wrap(err, "invalid unix socket owner")
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if conf.Group != "" {
+		g, err := user.LookupGroup(conf.Group)
+		if err != nil {
+			return errors.Wrap(err, "invalid unix socket group")
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if uid != -1 || gid != -1 {
+		if err := os.Chown(conf.Path, uid, gid); err != nil {
+			return errors.Wrap(err, "cannot set unix socket owner")
+		}
+	}
+	return nil
+}
+
+// Peers on the unix socket are local. They are presented as loopback so
+// that the client address handling and trusted proxies work as with TCP
+const unixPeerAddr = "127.0.0.1:0"
+
+func isUnixConn(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && addr.Network() == "unix"
+}
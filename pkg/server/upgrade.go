@@ -0,0 +1,288 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/systemd"
+	"github.com/pkg/errors"
+)
+
+// Set for the process started by an upgrade. The listeners are passed like in
+// systemd socket activation and the process reports readiness on the
+// descriptor after them
+const (
+	upgradeEnv      = "SSH_INSCRIBE_UPGRADE"
+	upgradeReadyEnv = "SSH_INSCRIBE_UPGRADE_READY_FD"
+
+	listenerNameAPI = "api"
+)
+
+// Listeners handed over to the new process on upgrade
+type inheritedListener struct {
+	name string
+	l    net.Listener
+}
+
+// Remember the listener so it can be handed over on upgrade
+func (s *Server) addListener(name string, l net.Listener) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.listeners = append(s.listeners, inheritedListener{name: name, l: l})
+}
+
+// Stops accepting without closing the socket so that the pending connections
+// are accepted by the new process
+type pauseListener struct {
+	net.Listener
+	paused chan struct{}
+	// Closed once Accept has seen the pause
+	stopped   chan struct{}
+	closed    chan struct{}
+	pauseOnce sync.Once
+	stopOnce  sync.Once
+	closeOnce sync.Once
+}
+
+// Wrap the API listener so it can be paused on upgrade
+func (s *Server) pausable(l net.Listener) net.Listener {
+	pl := &pauseListener{
+		Listener: l,
+		paused:   make(chan struct{}),
+		stopped:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.pausables = append(s.pausables, pl)
+	return pl
+}
+
+// Accept blocks until closed once paused. An accept in progress is
+// interrupted with a deadline on the socket
+func (l *pauseListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.paused:
+		return nil, l.stop()
+	default:
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.paused:
+			return nil, l.stop()
+		default:
+		}
+	}
+	return c, err
+}
+
+func (l *pauseListener) stop() error {
+	l.stopOnce.Do(func() { close(l.stopped) })
+	<-l.closed
+	return errListenerClosed
+}
+
+func (l *pauseListener) pause() {
+	l.pauseOnce.Do(func() { close(l.paused) })
+}
+
+func (l *pauseListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// Track the connections without a request read yet. The HTTP server closes
+// them without a response on shutdown
+func (s *Server) trackConnState(c net.Conn, state http.ConnState) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if state == http.StateNew {
+		s.newConns[c] = struct{}{}
+	} else {
+		delete(s.newConns, c)
+	}
+}
+
+// Stop accepting on the API listeners and wait for the accepted connections
+// to send their first request
+func (s *Server) pauseAccepting(timeout time.Duration) {
+	s.listenersMu.Lock()
+	pausables := s.pausables
+	for _, pl := range pausables {
+		pl.pause()
+	}
+	for _, il := range s.listeners {
+		if dl, ok := il.l.(interface{ SetDeadline(time.Time) error }); ok && il.name == listenerNameAPI {
+			dl.SetDeadline(time.Now())
+		}
+	}
+	s.listenersMu.Unlock()
+	deadline := time.Now().Add(timeout)
+	// Connections accepted before the pause are tracked once Accept is
+	// called again
+	for _, pl := range pausables {
+		select {
+		case <-pl.stopped:
+		case <-time.After(time.Until(deadline)):
+			return
+		}
+	}
+	for time.Now().Before(deadline) {
+		s.connsMu.Lock()
+		n := len(s.newConns)
+		s.connsMu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Take the listeners of the previous process. systemd.Listeners requires
+// LISTEN_PID to match which the previous process cannot know in advance. The
+// watchdog is taken over as well as this process becomes the main process
+func inheritListeners() {
+	if os.Getenv(upgradeEnv) == "" {
+		return
+	}
+	os.Unsetenv(upgradeEnv)
+	pid := strconv.Itoa(os.Getpid())
+	os.Setenv("LISTEN_PID", pid)
+	if os.Getenv("WATCHDOG_PID") != "" {
+		os.Setenv("WATCHDOG_PID", pid)
+	}
+}
+
+// Tell the previous process that the listeners are being served
+func upgradeReady() {
+	v := os.Getenv(upgradeReadyEnv)
+	if v == "" {
+		return
+	}
+	os.Unsetenv(upgradeReadyEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		Log.WithError(err).Warn("invalid upgrade readiness descriptor")
+		return
+	}
+	f := os.NewFile(uintptr(fd), "upgrade")
+	defer f.Close()
+	if _, err := f.Write([]byte("ready\n")); err != nil {
+		Log.WithError(err).Warn("cannot report readiness to the previous process")
+		return
+	}
+	Log.Info("took over the listeners of the previous process")
+}
+
+// Start the current binary on the listeners of this process and shut down
+// once it is serving. This process keeps serving if the new one fails to
+// start within the upgrade timeout
+func (s *Server) Upgrade() error {
+	if !atomic.CompareAndSwapInt32(&s.upgrading, 0, 1) {
+		return errors.New("upgrade already in progress")
+	}
+	defer atomic.StoreInt32(&s.upgrading, 0)
+
+	s.mu.RLock()
+	conf := s.config
+	s.mu.RUnlock()
+	timeout, err := time.ParseDuration(conf.UpgradeTimeout)
+	if err != nil {
+		return errors.Wrap(err, "invalid upgradeTimeout")
+	}
+	if conf.TokenSigningKey == "" {
+		Log.Warn("tokenSigningKey is not set, tokens issued before the upgrade will not be accepted")
+	}
+
+	s.listenersMu.Lock()
+	listeners := append([]inheritedListener{}, s.listeners...)
+	s.listenersMu.Unlock()
+	var (
+		files []*os.File
+		names []string
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, il := range listeners {
+		fl, ok := il.l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return errors.Errorf("cannot hand over %s listener %s", il.name, il.l.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return errors.Wrapf(err, "cannot hand over %s listener %s", il.name, il.l.Addr())
+		}
+		files = append(files, f)
+		names = append(names, il.name)
+	}
+
+	ready, w, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "cannot create readiness pipe")
+	}
+	defer ready.Close()
+	cmd := exec.Command(s.executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+	cmd.Env = append(os.Environ(),
+		upgradeEnv+"=1",
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		upgradeReadyEnv+"="+strconv.Itoa(3+len(files)),
+	)
+	log := Log.WithField("executable", s.executable)
+	log.Info("starting the new server process")
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return errors.Wrap(err, "cannot start the new server process")
+	}
+	log = log.WithField("pid", cmd.Process.Pid)
+
+	// The pipe is closed without data if the new process exits early
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 6)
+		_, err := io.ReadFull(ready, buf)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return errors.Wrap(err, "new server process did not become ready")
+	}
+	log.Info("new server process is serving, shutting down")
+
+	// The socket files now belong to the new process
+	for _, il := range listeners {
+		if ul, ok := il.l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	atomic.StoreInt32(&s.handedOver, 1)
+	notify(systemd.MainPID(cmd.Process.Pid))
+	go func() {
+		s.pauseAccepting(timeout)
+		s.Shutdown()
+	}()
+	return nil
+}
@@ -0,0 +1,10 @@
+// +build !windows
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+var upgradeSignal os.Signal = syscall.SIGUSR2
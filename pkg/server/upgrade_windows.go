@@ -0,0 +1,6 @@
+package server
+
+import "os"
+
+// Upgrading in place is not supported
+var upgradeSignal os.Signal
@@ -0,0 +1,212 @@
+package webui
+
+const indexHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>ssh-inscribe</title>
+<style>
+body { font-family: sans-serif; max-width: 44em; margin: 2em auto; padding: 0 1em; color: #222; }
+fieldset { margin-bottom: 1em; border: 1px solid #ccc; }
+label { display: block; margin: .4em 0; }
+input[type=text], input[type=password], textarea { width: 100%; box-sizing: border-box; }
+textarea { height: 6em; font-family: monospace; }
+.error { color: #b00; }
+.hidden { display: none; }
+</style>
+</head>
+<body>
+<h1>ssh-inscribe</h1>
+
+<form id="login">
+<fieldset>
+<legend>1. Log in</legend>
+<div id="authenticators">Loading...</div>
+<button type="submit">Log in</button>
+<span id="login-status"></span>
+</fieldset>
+</form>
+
+<form id="sign" class="hidden">
+<fieldset>
+<legend>2. Sign your public key</legend>
+<label>Public key (e.g. id_ed25519.pub)
+<textarea id="pubkey" placeholder="ssh-ed25519 AAAA..."></textarea></label>
+<label>or upload <input type="file" id="pubkey-file"></label>
+<label>Lifetime
+<select id="lifetime">
+<option value="1">1 hour</option>
+<option value="8" selected>8 hours</option>
+<option value="24">24 hours</option>
+</select></label>
+<button type="submit">Sign</button>
+</fieldset>
+</form>
+
+<fieldset id="result" class="hidden">
+<legend>3. Download the certificate</legend>
+<p>Save the certificate next to your private key with a -cert.pub suffix,
+for example id_ed25519-cert.pub.</p>
+<textarea id="cert" readonly></textarea>
+<a id="download" download="id-cert.pub" href="#">Download certificate</a>
+</fieldset>
+
+<p id="error" class="error"></p>
+
+<script>
+(function() {
+  "use strict";
+  var api = "/v1/";
+  var token = null;
+  var authenticators = [];
+
+  function $(id) { return document.getElementById(id); }
+  function showError(msg) { $("error").textContent = msg || ""; }
+  function sleep(ms) { return new Promise(function(r) { setTimeout(r, ms); }); }
+
+  function errorText(res) {
+    return res.text().then(function(body) {
+      try { var p = JSON.parse(body); return p.detail || p.title || p.message || body; } catch (e) { return body || res.statusText; }
+    });
+  }
+
+  function authHeaders(extra) {
+    var h = extra || {};
+    if (token) { h["X-Auth"] = "Bearer " + token; }
+    return h;
+  }
+
+  function renderAuthenticators(list) {
+    var root = $("authenticators");
+    root.textContent = "";
+    list.forEach(function(a, i) {
+      var fs = document.createElement("fieldset");
+      var lg = document.createElement("legend");
+      var cb = document.createElement("input");
+      cb.type = "checkbox";
+      cb.id = "auth-" + i;
+      cb.checked = a.default || list.length === 1;
+      lg.appendChild(cb);
+      lg.appendChild(document.createTextNode(" " + a.authenticatorName + " (" + a.authenticatorRealm + ")"));
+      fs.appendChild(lg);
+      if (a.authenticatorCredentialType === "user_password") {
+        ["username", "password"].forEach(function(f) {
+          var l = document.createElement("label");
+          var inp = document.createElement("input");
+          inp.type = f === "password" ? "password" : "text";
+          inp.id = "auth-" + i + "-" + f;
+          inp.autocomplete = f === "password" ? "current-password" : "username";
+          l.appendChild(document.createTextNode(f === "password" ? "Password" : "Username"));
+          l.appendChild(inp);
+          fs.appendChild(l);
+        });
+      } else {
+        var p = document.createElement("p");
+        p.textContent = "You will be redirected to the identity provider in a new window.";
+        fs.appendChild(p);
+      }
+      root.appendChild(fs);
+    });
+  }
+
+  function loginPassword(a, i) {
+    var user = $("auth-" + i + "-username").value;
+    var pw = $("auth-" + i + "-password").value;
+    var headers = authHeaders({"Authorization": "Basic " + btoa(unescape(encodeURIComponent(user + ":" + pw)))});
+    return fetch(api + "auth/" + encodeURIComponent(a.authenticatorName), {method: "POST", headers: headers})
+      .then(function(res) {
+        if (res.status !== 200) {
+          return errorText(res).then(function(t) { throw new Error(a.authenticatorName + ": " + t); });
+        }
+        return res.text().then(function(t) { token = t; });
+      });
+  }
+
+  function loginFederated(a) {
+    var opened = false;
+    var url = api + "auth/" + encodeURIComponent(a.authenticatorName) + "?redirect=false";
+    function poll() {
+      return fetch(url, {method: "POST", headers: authHeaders()}).then(function(res) {
+        if (res.status === 202) {
+          var loc = res.headers.get("Location");
+          return res.text().then(function(t) {
+            token = t;
+            if (!opened && loc) {
+              opened = true;
+              window.open(loc, "_blank", "noopener");
+            }
+            $("login-status").textContent = "Waiting for " + a.authenticatorName + "...";
+            return sleep(3000).then(poll);
+          });
+        }
+        if (res.status !== 200) {
+          return errorText(res).then(function(t) { throw new Error(a.authenticatorName + ": " + t); });
+        }
+        return res.text().then(function(t) { token = t; });
+      });
+    }
+    return poll();
+  }
+
+  $("login").addEventListener("submit", function(ev) {
+    ev.preventDefault();
+    showError();
+    token = null;
+    var chain = Promise.resolve();
+    authenticators.forEach(function(a, i) {
+      if (!$("auth-" + i).checked) { return; }
+      chain = chain.then(function() {
+        return a.authenticatorCredentialType === "user_password" ? loginPassword(a, i) : loginFederated(a);
+      });
+    });
+    chain.then(function() {
+      if (!token) { throw new Error("select at least one authenticator"); }
+      $("login-status").textContent = "Logged in";
+      $("sign").classList.remove("hidden");
+    }).catch(function(e) {
+      $("login-status").textContent = "";
+      showError(e.message);
+    });
+  });
+
+  $("pubkey-file").addEventListener("change", function(ev) {
+    var f = ev.target.files[0];
+    if (!f) { return; }
+    var r = new FileReader();
+    r.onload = function() { $("pubkey").value = r.result.trim(); };
+    r.readAsText(f);
+  });
+
+  $("sign").addEventListener("submit", function(ev) {
+    ev.preventDefault();
+    showError();
+    var key = $("pubkey").value.trim();
+    var expires = new Date(Date.now() + parseInt($("lifetime").value, 10) * 3600 * 1000);
+    var url = api + "sign?expires=" + encodeURIComponent(expires.toISOString().replace(/\.\d+Z$/, "Z"));
+    fetch(url, {method: "POST", headers: authHeaders({"Content-Type": "text/plain"}), body: key})
+      .then(function(res) {
+        if (res.status !== 200) {
+          return errorText(res).then(function(t) { throw new Error(t); });
+        }
+        return res.text();
+      })
+      .then(function(cert) {
+        $("cert").value = cert;
+        var name = (key.split(" ")[0] || "id").replace(/^ssh-|-.*$/g, "");
+        $("download").download = "id_" + name + "-cert.pub";
+        $("download").href = URL.createObjectURL(new Blob([cert], {type: "text/plain"}));
+        $("result").classList.remove("hidden");
+      })
+      .catch(function(e) { showError(e.message); });
+  });
+
+  fetch(api + "auth").then(function(res) { return res.json(); }).then(function(list) {
+    authenticators = list || [];
+    renderAuthenticators(authenticators);
+  }).catch(function(e) { showError("cannot list authenticators: " + e.message); });
+})();
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,46 @@
+// Package webui serves a minimal single page UI for users who cannot run the
+// CLI. The page talks to the regular signing API from the browser.
+package webui
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const Path = "/ui/"
+
+// Only allow resources from our own origin
+const contentSecurityPolicy = "default-src 'none'; script-src 'self' 'unsafe-inline'; " +
+	"style-src 'unsafe-inline'; connect-src 'self'; form-action 'none'; frame-ancestors "
+
+// Register the UI. The page can be embedded into frames on the given origins,
+// for example an SSO portal
+func RegisterRoutes(e *echo.Echo, frameAncestors ...string) {
+	e.GET(Path, indexHandler(frameAncestors))
+	e.GET("/ui", redirectIndex)
+	e.GET("/", redirectIndex)
+}
+
+func redirectIndex(c echo.Context) error {
+	return c.Redirect(http.StatusFound, Path)
+}
+
+func indexHandler(frameAncestors []string) echo.HandlerFunc {
+	csp := contentSecurityPolicy + "'none'"
+	if len(frameAncestors) > 0 {
+		csp = contentSecurityPolicy + strings.Join(frameAncestors, " ")
+	}
+	return func(c echo.Context) error {
+		h := c.Response().Header()
+		h.Set("Content-Security-Policy", csp)
+		if len(frameAncestors) == 0 {
+			h.Set("X-Frame-Options", "DENY")
+		} else {
+			h.Del("X-Frame-Options")
+		}
+		h.Set("Cache-Control", "no-store")
+		return c.HTML(http.StatusOK, indexHTML)
+	}
+}
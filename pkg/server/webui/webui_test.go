@@ -0,0 +1,42 @@
+package webui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex(t *testing.T) {
+	assert := assert.New(t)
+	e := echo.New()
+	RegisterRoutes(e)
+
+	req, _ := http.NewRequest(echo.GET, "/", nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusFound, rec.Code)
+	assert.Equal(Path, rec.Header().Get(echo.HeaderLocation))
+
+	req, _ = http.NewRequest(echo.GET, Path, nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(http.StatusOK, rec.Code)
+	assert.Contains(rec.Header().Get(echo.HeaderContentType), "text/html")
+	assert.NotEmpty(rec.Header().Get("Content-Security-Policy"))
+	assert.Contains(rec.Body.String(), "ssh-inscribe")
+}
+
+func TestFrameAncestors(t *testing.T) {
+	assert := assert.New(t)
+	e := echo.New()
+	RegisterRoutes(e, "https://sso.example.com")
+
+	req, _ := http.NewRequest(echo.GET, Path, nil)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Contains(rec.Header().Get("Content-Security-Policy"), "frame-ancestors https://sso.example.com")
+	assert.Empty(rec.Header().Get("X-Frame-Options"))
+}
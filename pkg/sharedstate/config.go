@@ -0,0 +1,39 @@
+package sharedstate
+
+import "github.com/aakso/ssh-inscribe/pkg/storage/sqlutil"
+
+type Config struct {
+	// Store type: memory, redis or sql. Memory keeps the state in the
+	// process and is not shared between replicas
+	Type string `yaml:"type"`
+	// Prepended to all keys so instances can share a database
+	KeyPrefix string `yaml:"keyPrefix"`
+
+	Redis RedisConfig `yaml:"redis"`
+
+	// SQL store. The driver is sqlite or postgres
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+}
+
+type RedisConfig struct {
+	Address  string `yaml:"address"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	TLS      bool   `yaml:"tls"`
+	PoolSize int    `yaml:"poolSize"`
+	Timeout  string `yaml:"timeout"`
+}
+
+var Defaults = &Config{
+	Type:      TypeMemory,
+	KeyPrefix: "ssh-inscribe:",
+	Redis: RedisConfig{
+		Address:  "localhost:6379",
+		PoolSize: 8,
+		Timeout:  "5s",
+	},
+	Driver: sqlutil.DriverSQLite,
+	DSN:    "",
+}
@@ -0,0 +1,19 @@
+package sharedstate
+
+import (
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var Log *logrus.Entry = logging.GetLogger("sharedstate").WithField("pkg", "sharedstate")
+
+const (
+	TypeMemory = "memory"
+	TypeRedis  = "redis"
+	TypeSQL    = "sql"
+)
+
+func init() {
+	config.SetDefault("sharedstate", Defaults)
+}
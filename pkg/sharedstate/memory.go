@@ -0,0 +1,112 @@
+package sharedstate
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Expired keys are dropped at most this often
+const memoryPruneInterval = time.Minute
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// MemoryStore keeps the state in the process
+type MemoryStore struct {
+	sync.Mutex
+	entries   map[string]*memoryEntry
+	lastPrune time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*memoryEntry)}
+}
+
+// Return the live entry for the key. Must be called with the lock held
+func (m *MemoryStore) get(key string, now time.Time) *memoryEntry {
+	if now.Sub(m.lastPrune) >= memoryPruneInterval {
+		m.lastPrune = now
+		for k, e := range m.entries {
+			if e.expired(now) {
+				delete(m.entries, k)
+			}
+		}
+	}
+	e, ok := m.entries[key]
+	if !ok || e.expired(now) {
+		return nil
+	}
+	return e
+}
+
+func newMemoryEntry(value []byte, ttl time.Duration, now time.Time) *memoryEntry {
+	e := &memoryEntry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		e.expires = now.Add(ttl)
+	}
+	return e
+}
+
+func (m *MemoryStore) Get(key string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	e := m.get(key, time.Now())
+	if e == nil {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), e.value...), nil
+}
+
+func (m *MemoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	m.Lock()
+	defer m.Unlock()
+	m.entries[key] = newMemoryEntry(value, ttl, time.Now())
+	return nil
+}
+
+func (m *MemoryStore) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	if m.get(key, now) != nil {
+		return false, nil
+	}
+	m.entries[key] = newMemoryEntry(value, ttl, now)
+	return true, nil
+}
+
+func (m *MemoryStore) Delete(key string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *MemoryStore) Incr(key string, ttl time.Duration) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	e := m.get(key, now)
+	if e == nil {
+		e = newMemoryEntry([]byte("0"), ttl, now)
+		m.entries[key] = e
+	}
+	n, err := strconv.ParseInt(string(e.value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	n++
+	e.value = []byte(strconv.FormatInt(n, 10))
+	return n, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,114 @@
+package sharedstate
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+// RedisStore shares the state in Redis
+type RedisStore struct {
+	client  *redis.Client
+	timeout time.Duration
+}
+
+func NewRedisStore(conf RedisConfig) (*RedisStore, error) {
+	if conf.Address == "" {
+		return nil, errors.New("redis address is required")
+	}
+	timeout := 5 * time.Second
+	if conf.Timeout != "" {
+		d, err := time.ParseDuration(conf.Timeout)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid redis timeout")
+		}
+		timeout = d
+	}
+	size := conf.PoolSize
+	if size <= 0 {
+		size = 1
+	}
+	opts := &redis.Options{
+		Addr:         conf.Address,
+		Username:     conf.Username,
+		Password:     conf.Password,
+		DB:           conf.DB,
+		PoolSize:     size,
+		DialTimeout:  timeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		// Commands are not retried as SETNX and INCR are not idempotent
+		MaxRetries: -1,
+	}
+	if conf.TLS {
+		host, _, _ := net.SplitHostPort(conf.Address)
+		opts.TLSConfig = &tls.Config{ServerName: host}
+	}
+	s := &RedisStore{
+		client:  redis.NewClient(opts),
+		timeout: timeout,
+	}
+	// Fail early on unreachable server or bad credentials
+	ctx, cancel := s.context()
+	defer cancel()
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		s.client.Close()
+		return nil, errors.Wrap(err, "cannot connect to redis")
+	}
+	return s, nil
+}
+
+func (s *RedisStore) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+func (s *RedisStore) Get(key string) ([]byte, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	b, err := s.client.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+func (s *RedisStore) Set(key string, value []byte, ttl time.Duration) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.client.Set(ctx, key, value, ttl).Err()
+}
+
+func (s *RedisStore) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.client.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (s *RedisStore) Delete(key string) error {
+	ctx, cancel := s.context()
+	defer cancel()
+	return s.client.Del(ctx, key).Err()
+}
+
+func (s *RedisStore) Incr(key string, ttl time.Duration) (int64, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+	n, err := s.client.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	if n == 1 && ttl > 0 {
+		if err := s.client.PExpire(ctx, key, ttl).Err(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -0,0 +1,125 @@
+package sharedstate
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/pkg/errors"
+)
+
+var ErrNotFound = errors.New("key not found")
+
+// Store is a key value store with expiring keys. With the redis and sql
+// types the state is shared by the server replicas behind a load balancer.
+// A zero ttl never expires
+type Store interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	// Set the key only if it does not exist. Returns false if it did
+	SetNX(key string, value []byte, ttl time.Duration) (bool, error)
+	Delete(key string) error
+	// Increment the counter and return the new value. The ttl is set when
+	// the counter is created
+	Incr(key string, ttl time.Duration) (int64, error)
+	Close() error
+}
+
+var (
+	mu      sync.RWMutex
+	current Store = NewMemoryStore()
+	shared  bool
+)
+
+// Current store. A process local memory store unless a shared store has
+// been set up
+func Get() Store {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Whether the state is shared between replicas
+func IsShared() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return shared
+}
+
+// Replace the current store. The previous one is closed
+func Set(s Store, isShared bool) {
+	mu.Lock()
+	old := current
+	current, shared = s, isShared
+	mu.Unlock()
+	if old != nil && old != s {
+		old.Close()
+	}
+}
+
+// Open the configured store and make it current
+func Setup() error {
+	tmp, err := config.Get("sharedstate")
+	if err != nil {
+		return errors.Wrap(err, "cannot initialize shared state")
+	}
+	conf, _ := tmp.(*Config)
+	if conf == nil {
+		return errors.New("cannot initialize shared state. Invalid configuration")
+	}
+	var s Store
+	switch conf.Type {
+	case "", TypeMemory:
+		Set(NewMemoryStore(), false)
+		return nil
+	case TypeRedis:
+		s, err = NewRedisStore(conf.Redis)
+	case TypeSQL:
+		s, err = NewSQLStore(conf.Driver, conf.DSN)
+	default:
+		err = errors.Errorf("unknown shared state type: %s", conf.Type)
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot initialize shared state")
+	}
+	if conf.KeyPrefix != "" {
+		s = &prefixed{Store: s, prefix: conf.KeyPrefix}
+	}
+	Set(s, true)
+	Log.WithField("type", conf.Type).Info("shared state store opened")
+	return nil
+}
+
+type prefixed struct {
+	Store
+	prefix string
+}
+
+func (p *prefixed) Get(key string) ([]byte, error) {
+	return p.Store.Get(p.prefix + key)
+}
+
+func (p *prefixed) Set(key string, value []byte, ttl time.Duration) error {
+	return p.Store.Set(p.prefix+key, value, ttl)
+}
+
+func (p *prefixed) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	return p.Store.SetNX(p.prefix+key, value, ttl)
+}
+
+func (p *prefixed) Delete(key string) error {
+	return p.Store.Delete(p.prefix + key)
+}
+
+func (p *prefixed) Incr(key string, ttl time.Duration) (int64, error) {
+	return p.Store.Incr(p.prefix+key, ttl)
+}
+
+// Close the current store and fall back to a process local one
+func Close() error {
+	mu.Lock()
+	old := current
+	current, shared = NewMemoryStore(), false
+	mu.Unlock()
+	return old.Close()
+}
@@ -0,0 +1,114 @@
+package sharedstate
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func testStore(t *testing.T, s Store) {
+	assert := assert.New(t)
+
+	_, err := s.Get("missing")
+	assert.Equal(ErrNotFound, err)
+
+	assert.NoError(s.Set("a", []byte("one"), 0))
+	v, err := s.Get("a")
+	assert.NoError(err)
+	assert.Equal([]byte("one"), v)
+
+	ok, err := s.SetNX("a", []byte("two"), 0)
+	assert.NoError(err)
+	assert.False(ok)
+	ok, err = s.SetNX("b", []byte("two"), 20*time.Millisecond)
+	assert.NoError(err)
+	assert.True(ok)
+
+	n, err := s.Incr("c", 0)
+	assert.NoError(err)
+	assert.Equal(int64(1), n)
+	n, err = s.Incr("c", 0)
+	assert.NoError(err)
+	assert.Equal(int64(2), n)
+
+	assert.NoError(s.Delete("a"))
+	_, err = s.Get("a")
+	assert.Equal(ErrNotFound, err)
+}
+
+func TestMemoryStore(t *testing.T) {
+	assert := assert.New(t)
+	s := NewMemoryStore()
+	testStore(t, s)
+
+	// Expiry
+	time.Sleep(30 * time.Millisecond)
+	_, err := s.Get("b")
+	assert.Equal(ErrNotFound, err)
+	ok, _ := s.SetNX("b", []byte("x"), 0)
+	assert.True(ok)
+	n, _ := s.Incr("d", 10*time.Millisecond)
+	assert.Equal(int64(1), n)
+	time.Sleep(20 * time.Millisecond)
+	n, _ = s.Incr("d", 10*time.Millisecond)
+	assert.Equal(int64(1), n)
+}
+
+func TestPrefixed(t *testing.T) {
+	assert := assert.New(t)
+	m := NewMemoryStore()
+	s := &prefixed{Store: m, prefix: "p:"}
+	assert.NoError(s.Set("a", []byte("x"), 0))
+	v, err := m.Get("p:a")
+	assert.NoError(err)
+	assert.Equal([]byte("x"), v)
+}
+
+func TestSQLStore(t *testing.T) {
+	assert := assert.New(t)
+	s, err := NewSQLStore(Defaults.Driver, filepath.Join(t.TempDir(), "state.db"))
+	if !assert.NoError(err) {
+		return
+	}
+	defer s.Close()
+	testStore(t, s)
+
+	// Expiry
+	time.Sleep(30 * time.Millisecond)
+	_, err = s.Get("b")
+	assert.Equal(ErrNotFound, err)
+	ok, _ := s.SetNX("b", []byte("x"), 0)
+	assert.True(ok)
+}
+
+func TestRedisStore(t *testing.T) {
+	assert := assert.New(t)
+	mr, err := miniredis.Run()
+	if !assert.NoError(err) {
+		return
+	}
+	defer mr.Close()
+	mr.RequireAuth("secret")
+	addr := mr.Addr()
+
+	_, err = NewRedisStore(RedisConfig{Address: addr, Password: "wrong"})
+	assert.Error(err)
+
+	s, err := NewRedisStore(RedisConfig{Address: addr, Password: "secret", PoolSize: 2})
+	if !assert.NoError(err) {
+		return
+	}
+	defer s.Close()
+	testStore(t, s)
+
+	// Expiry
+	assert.Equal(20*time.Millisecond, mr.TTL("b"))
+	n, _ := s.Incr("d", time.Second)
+	assert.Equal(int64(1), n)
+	mr.FastForward(time.Second)
+	_, err = s.Get("d")
+	assert.Equal(ErrNotFound, err)
+}
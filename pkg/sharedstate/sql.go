@@ -0,0 +1,169 @@
+package sharedstate
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/storage/sqlutil"
+	"github.com/pkg/errors"
+)
+
+const sqlSchema = `CREATE TABLE IF NOT EXISTS shared_state (
+	skey TEXT PRIMARY KEY,
+	value TEXT NOT NULL,
+	counter BIGINT NOT NULL,
+	expires BIGINT NOT NULL
+)`
+
+// Expired rows are deleted this often
+const sqlCleanupInterval = time.Minute
+
+// SQLStore shares the state using database/sql with SQLite or PostgreSQL
+// dialect. Expiry is stored as unix nanoseconds, zero for no expiry
+type SQLStore struct {
+	db       *sql.DB
+	postgres bool
+	done     chan struct{}
+}
+
+func NewSQLStore(driver, dsn string) (*SQLStore, error) {
+	db, err := sqlutil.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqlSchema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "cannot create schema")
+	}
+	s := &SQLStore{
+		db:       db,
+		postgres: sqlutil.IsPostgres(driver),
+		done:     make(chan struct{}),
+	}
+	go s.cleanup()
+	return s, nil
+}
+
+func (s *SQLStore) query(q string) string {
+	return sqlutil.Rebind(s.postgres, q)
+}
+
+func (s *SQLStore) cleanup() {
+	ticker := time.NewTicker(sqlCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			_, err := s.db.Exec(s.query(`DELETE FROM shared_state WHERE expires > 0 AND expires <= ?`), time.Now().UnixNano())
+			if err != nil {
+				Log.WithError(err).Warn("cannot delete expired shared state")
+			}
+		}
+	}
+}
+
+func expiry(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *SQLStore) deleteExpired(db execer, key string) error {
+	_, err := db.Exec(s.query(`DELETE FROM shared_state WHERE skey = ? AND expires > 0 AND expires <= ?`),
+		key, time.Now().UnixNano())
+	return err
+}
+
+func (s *SQLStore) Get(key string) ([]byte, error) {
+	var value string
+	err := s.db.QueryRow(s.query(`SELECT value FROM shared_state WHERE skey = ? AND (expires = 0 OR expires > ?)`),
+		key, time.Now().UnixNano()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot get shared state")
+	}
+	raw, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode shared state")
+	}
+	return raw, nil
+}
+
+func (s *SQLStore) Set(key string, value []byte, ttl time.Duration) error {
+	_, err := s.db.Exec(s.query(`INSERT INTO shared_state (skey, value, counter, expires) VALUES (?, ?, 0, ?)
+		ON CONFLICT (skey) DO UPDATE SET value = excluded.value, counter = 0, expires = excluded.expires`),
+		key, base64.StdEncoding.EncodeToString(value), expiry(ttl))
+	if err != nil {
+		return errors.Wrap(err, "cannot set shared state")
+	}
+	return nil
+}
+
+func (s *SQLStore) SetNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	if err := s.deleteExpired(s.db, key); err != nil {
+		return false, errors.Wrap(err, "cannot set shared state")
+	}
+	res, err := s.db.Exec(s.query(`INSERT INTO shared_state (skey, value, counter, expires) VALUES (?, ?, 0, ?)
+		ON CONFLICT (skey) DO NOTHING`),
+		key, base64.StdEncoding.EncodeToString(value), expiry(ttl))
+	if err != nil {
+		return false, errors.Wrap(err, "cannot set shared state")
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "cannot set shared state")
+	}
+	return n == 1, nil
+}
+
+func (s *SQLStore) Delete(key string) error {
+	if _, err := s.db.Exec(s.query(`DELETE FROM shared_state WHERE skey = ?`), key); err != nil {
+		return errors.Wrap(err, "cannot delete shared state")
+	}
+	return nil
+}
+
+func (s *SQLStore) Incr(key string, ttl time.Duration) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot increment shared counter")
+	}
+	defer tx.Rollback()
+	if err := s.deleteExpired(tx, key); err != nil {
+		return 0, errors.Wrap(err, "cannot increment shared counter")
+	}
+	res, err := tx.Exec(s.query(`UPDATE shared_state SET counter = counter + 1 WHERE skey = ?`), key)
+	if err != nil {
+		return 0, errors.Wrap(err, "cannot increment shared counter")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		_, err := tx.Exec(s.query(`INSERT INTO shared_state (skey, value, counter, expires) VALUES (?, '', 1, ?)`),
+			key, expiry(ttl))
+		if err != nil {
+			return 0, errors.Wrap(err, "cannot increment shared counter")
+		}
+	}
+	var n int64
+	if err := tx.QueryRow(s.query(`SELECT counter FROM shared_state WHERE skey = ?`), key).Scan(&n); err != nil {
+		return 0, errors.Wrap(err, "cannot increment shared counter")
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "cannot increment shared counter")
+	}
+	return n, nil
+}
+
+func (s *SQLStore) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"path"
+
+	"github.com/aakso/ssh-inscribe/pkg/globals"
+)
+
+type Config struct {
+	// Backend for the revocations, serials, sessions and issued
+	// certificates: file, sqlite or postgres. Empty uses the certdb,
+	// sharedstate and server store settings instead
+	Type string `yaml:"type"`
+	// Store the full certificate in addition to the metadata
+	StoreCertificate bool `yaml:"storeCertificate"`
+
+	// File backend. Sessions are kept in memory and not shared between
+	// replicas
+	Dir string `yaml:"dir"`
+
+	// SQL backends. The driver defaults to sqlite or postgres by the type.
+	// SQLite uses a database in the directory without a DSN
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
+}
+
+var Defaults = &Config{
+	Type:             "",
+	StoreCertificate: false,
+	Dir:              path.Join(globals.VarDir(), "ssh_inscribe"),
+	Driver:           "",
+	DSN:              "",
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/aakso/ssh-inscribe/pkg/certdb"
+	"github.com/aakso/ssh-inscribe/pkg/revocation"
+	"github.com/aakso/ssh-inscribe/pkg/serial"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/pkg/errors"
+)
+
+// Files in a directory. Sessions are kept in memory
+func NewFileStorage(dir string) (Storage, error) {
+	if dir == "" {
+		return nil, errors.New("storage directory is not set")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "cannot create storage directory")
+	}
+	serials, err := serial.NewFileCounter(filepath.Join(dir, "serial"))
+	if err != nil {
+		return nil, err
+	}
+	certs, err := certdb.NewFileStore(filepath.Join(dir, "certs.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sessions := sharedstate.NewMemoryStore()
+	return &stores{
+		revocations: &revocation.FileBackend{Path: filepath.Join(dir, "revocations.json")},
+		serials:     serials,
+		sessions:    sessions,
+		certs:       certs,
+		closers:     []func() error{certs.Close, sessions.Close},
+	}, nil
+}
+
+func fileFactory(conf *Config) (Storage, error) {
+	return NewFileStorage(conf.Dir)
+}
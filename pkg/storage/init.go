@@ -0,0 +1,22 @@
+package storage
+
+import (
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var Log *logrus.Entry = logging.GetLogger("storage").WithField("pkg", "storage")
+
+const (
+	TypeFile     = "file"
+	TypeSQLite   = "sqlite"
+	TypePostgres = "postgres"
+)
+
+func init() {
+	config.SetDefault("storage", Defaults)
+	RegisterBackend(TypeFile, fileFactory)
+	RegisterBackend(TypeSQLite, sqlFactory)
+	RegisterBackend(TypePostgres, sqlFactory)
+}
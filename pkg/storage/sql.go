@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/aakso/ssh-inscribe/pkg/certdb"
+	"github.com/aakso/ssh-inscribe/pkg/revocation"
+	"github.com/aakso/ssh-inscribe/pkg/serial"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/aakso/ssh-inscribe/pkg/storage/sqlutil"
+	"github.com/pkg/errors"
+)
+
+// SQLite or PostgreSQL database. Sessions are shared between replicas using
+// the same database
+func NewSQLStorage(driver, dsn string) (Storage, error) {
+	certs, err := certdb.NewSQLStore(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	st := &stores{
+		serials: serial.GeneratorFunc(certs.NextSerial),
+		certs:   certs,
+		shared:  true,
+		closers: []func() error{certs.Close},
+	}
+	revocations, err := revocation.NewSQLBackend(driver, dsn)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	st.revocations = revocations
+	st.closers = append(st.closers, revocations.Close)
+	sessions, err := sharedstate.NewSQLStore(driver, dsn)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	st.sessions = sessions
+	st.closers = append(st.closers, sessions.Close)
+	return st, nil
+}
+
+func sqlFactory(conf *Config) (Storage, error) {
+	driver := conf.Driver
+	if driver == "" {
+		driver = sqlutil.DriverSQLite
+		if conf.Type == TypePostgres {
+			driver = sqlutil.DriverPostgres
+		}
+	}
+	dsn := conf.DSN
+	if dsn == "" && conf.Type == TypeSQLite {
+		if err := os.MkdirAll(conf.Dir, 0700); err != nil {
+			return nil, errors.Wrap(err, "cannot create storage directory")
+		}
+		dsn = filepath.Join(conf.Dir, "ssh_inscribe.db")
+	}
+	return NewSQLStorage(driver, dsn)
+}
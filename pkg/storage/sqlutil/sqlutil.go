@@ -0,0 +1,86 @@
+// Helpers for the database/sql stores supporting both SQLite and PostgreSQL.
+// Kept apart from the storage package, which depends on the stores
+package sqlutil
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+// Names of the drivers linked into the binary
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+)
+
+// Open the database, failing early if the driver is not compiled in.
+// sqlite3 is accepted as the name of the SQLite driver
+func Open(driver, dsn string) (*sql.DB, error) {
+	if driver == "sqlite3" {
+		driver = DriverSQLite
+	}
+	registered := false
+	for _, d := range sql.Drivers() {
+		if d == driver {
+			registered = true
+		}
+	}
+	if !registered {
+		return nil, errors.Errorf("sql driver %q is not available in this build", driver)
+	}
+	if driver == DriverSQLite {
+		if dsn == "" {
+			return nil, errors.New("sqlite database path is not set")
+		}
+		// Writers of the stores sharing the file wait for each other
+		// instead of failing with SQLITE_BUSY
+		dsn = withParam(dsn, "_pragma", "busy_timeout(5000)")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open database")
+	}
+	if driver == DriverSQLite {
+		// A single connection serializes the transactions of the store
+		// and keeps in-memory databases alive
+		db.SetMaxOpenConns(1)
+	}
+	return db, nil
+}
+
+func withParam(dsn, k, v string) string {
+	sep := "?"
+	if strings.Contains(dsn, "?") {
+		sep = "&"
+	}
+	return dsn + sep + k + "=" + v
+}
+
+// Whether the driver uses the PostgreSQL dialect
+func IsPostgres(driver string) bool {
+	return driver == "postgres" || driver == "pgx"
+}
+
+// Rewrite ? placeholders as $1, $2... for PostgreSQL. Queries are written
+// with ? placeholders and must not contain ? in literals
+func Rebind(postgres bool, q string) string {
+	if !postgres {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range q {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,36 @@
+package sqlutil
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebind(t *testing.T) {
+	assert := assert.New(t)
+	q := "SELECT a FROM t WHERE b = ? AND c IN (?, ?)"
+	assert.Equal(q, Rebind(false, q))
+	assert.Equal("SELECT a FROM t WHERE b = $1 AND c IN ($2, $3)", Rebind(true, q))
+	assert.True(IsPostgres("pgx"))
+	assert.False(IsPostgres("sqlite3"))
+}
+
+func TestOpen(t *testing.T) {
+	assert := assert.New(t)
+	_, err := Open("nonexistent", "")
+	assert.EqualError(err, `sql driver "nonexistent" is not available in this build`)
+	_, err = Open(DriverSQLite, "")
+	assert.Error(err)
+
+	// The name of the driver in other builds is accepted
+	db, err := Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if assert.NoError(err) {
+		defer db.Close()
+		var timeout int
+		assert.NoError(db.QueryRow("PRAGMA busy_timeout").Scan(&timeout))
+		assert.Equal(5000, timeout)
+	}
+	assert.Equal("test.db?_pragma=x", withParam("test.db", "_pragma", "x"))
+	assert.Equal("file:test.db?mode=ro&_pragma=x", withParam("file:test.db?mode=ro", "_pragma", "x"))
+}
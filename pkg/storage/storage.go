@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"github.com/aakso/ssh-inscribe/pkg/certdb"
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/aakso/ssh-inscribe/pkg/revocation"
+	"github.com/aakso/ssh-inscribe/pkg/serial"
+	"github.com/aakso/ssh-inscribe/pkg/sharedstate"
+	"github.com/pkg/errors"
+)
+
+// Storage holds the server state. Handlers only see the component
+// interfaces, so backends can be added without touching them
+type Storage interface {
+	Revocations() revocation.Backend
+	Serials() serial.Generator
+	// Sessions, nonces, used tokens and other short lived state
+	Sessions() sharedstate.Store
+	// Whether the sessions are shared between replicas
+	Shared() bool
+	Certificates() certdb.Store
+	// Close the backend including the component stores
+	Close() error
+}
+
+type Factory func(conf *Config) (Storage, error)
+
+var factories = make(map[string]Factory)
+
+func RegisterBackend(typ string, factory Factory) {
+	factories[typ] = factory
+}
+
+// Open the storage according to the configuration. Returns nil storage if
+// the type is not set
+func Open() (Storage, *Config, error) {
+	tmp, err := config.Get("storage")
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot initialize storage")
+	}
+	conf, _ := tmp.(*Config)
+	if conf == nil {
+		return nil, nil, errors.New("cannot initialize storage. Invalid configuration")
+	}
+	if conf.Type == "" {
+		return nil, conf, nil
+	}
+	factory, ok := factories[conf.Type]
+	if !ok {
+		return nil, nil, errors.Errorf("unknown storage type: %s", conf.Type)
+	}
+	st, err := factory(conf)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot initialize storage")
+	}
+	Log.WithField("type", conf.Type).Info("storage opened")
+	return st, conf, nil
+}
+
+// Storage made of independent component stores
+type stores struct {
+	revocations revocation.Backend
+	serials     serial.Generator
+	sessions    sharedstate.Store
+	shared      bool
+	certs       certdb.Store
+	closers     []func() error
+}
+
+func (s *stores) Revocations() revocation.Backend {
+	return s.revocations
+}
+
+func (s *stores) Serials() serial.Generator {
+	return s.serials
+}
+
+func (s *stores) Sessions() sharedstate.Store {
+	return s.sessions
+}
+
+func (s *stores) Shared() bool {
+	return s.shared
+}
+
+func (s *stores) Certificates() certdb.Store {
+	return s.certs
+}
+
+func (s *stores) Close() error {
+	var result error
+	for _, c := range s.closers {
+		if err := c(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/certdb"
+	"github.com/aakso/ssh-inscribe/pkg/revocation"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStorage(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "storagetest")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	dir = path.Join(dir, "state")
+
+	for i := 0; i < 2; i++ {
+		st, err := NewFileStorage(dir)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.False(st.Shared())
+		n, err := st.Serials().Next()
+		assert.NoError(err)
+		assert.Equal(uint64(i+1), n)
+
+		revocations, err := revocation.NewStoreWithBackend(st.Revocations())
+		if assert.NoError(err) {
+			assert.Len(revocations.Entries(), i)
+			assert.NoError(revocations.Revoke(revocation.Entry{KeyID: "test"}))
+		}
+		certs := st.Certificates()
+		assert.NoError(certs.Put(&certdb.Record{Serial: n, IssuedAt: time.Now()}))
+		records, err := certs.List(certdb.Filter{})
+		assert.NoError(err)
+		assert.Len(records, i+1)
+
+		assert.NoError(st.Sessions().Set("key", []byte("value"), 0))
+		assert.NoError(st.Close())
+	}
+}
+
+func TestSQLStorage(t *testing.T) {
+	assert := assert.New(t)
+	_, err := NewSQLStorage("nonexistent", "")
+	assert.Error(err)
+
+	dir, err := ioutil.TempDir("", "storagetest")
+	if !assert.NoError(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	conf := &Config{Type: TypeSQLite, Dir: path.Join(dir, "state")}
+
+	for i := 0; i < 2; i++ {
+		st, err := sqlFactory(conf)
+		if !assert.NoError(err) {
+			return
+		}
+		assert.True(st.Shared())
+		n, err := st.Serials().Next()
+		assert.NoError(err)
+		assert.Equal(uint64(i+1), n)
+
+		revocations, err := revocation.NewStoreWithBackend(st.Revocations())
+		if assert.NoError(err) {
+			assert.Len(revocations.Entries(), i)
+			assert.NoError(revocations.Revoke(revocation.Entry{KeyID: "test"}))
+		}
+		certs := st.Certificates()
+		assert.NoError(certs.Put(&certdb.Record{Serial: n, IssuedAt: time.Now()}))
+		records, err := certs.List(certdb.Filter{})
+		assert.NoError(err)
+		assert.Len(records, i+1)
+
+		assert.NoError(st.Sessions().Set("key", []byte("value"), 0))
+		assert.NoError(st.Close())
+	}
+	assert.FileExists(path.Join(dir, "state", "ssh_inscribe.db"))
+}
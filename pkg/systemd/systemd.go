@@ -0,0 +1,112 @@
+// Package systemd implements the parts of the systemd service protocol the
+// server uses: socket activation and sd_notify
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The first file descriptor passed by socket activation
+const listenFdsStart = 3
+
+const (
+	Ready     = "READY=1"
+	Reloading = "RELOADING=1"
+	Stopping  = "STOPPING=1"
+	Watchdog  = "WATCHDOG=1"
+)
+
+// Tell the service manager that the service continues in another process
+func MainPID(pid int) string {
+	return "MAINPID=" + strconv.Itoa(pid)
+}
+
+// Listener passed by socket activation
+type Listener struct {
+	net.Listener
+	// FileDescriptorName of the socket unit
+	Name string
+}
+
+// Return the listeners passed by systemd socket activation or nil if the
+// process was not socket activated. The environment is cleared so that the
+// sockets are not passed on to child processes
+func Listeners() ([]Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	var r []Listener
+	for i := 0; i < n; i++ {
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range r {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "invalid socket %d (%s) passed by systemd", listenFdsStart+i, name)
+		}
+		r = append(r, Listener{Listener: l, Name: name})
+	}
+	return r, nil
+}
+
+// Send a state notification to the service manager. Returns false if the
+// process is not run by systemd with notify support
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	// Abstract namespace socket
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, errors.Wrap(err, "cannot connect to the notify socket")
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, errors.Wrap(err, "cannot send notification")
+	}
+	return true, nil
+}
+
+// Return the interval the service manager expects watchdog notifications
+// in or zero if the watchdog is not enabled
+func WatchdogInterval() (time.Duration, error) {
+	s := os.Getenv("WATCHDOG_USEC")
+	if s == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	usec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, errors.Errorf("invalid WATCHDOG_USEC: %s", s)
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
@@ -0,0 +1,77 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotify(t *testing.T) {
+	assert := assert.New(t)
+	os.Unsetenv("NOTIFY_SOCKET")
+	sent, err := Notify(Ready)
+	assert.NoError(err)
+	assert.False(sent)
+
+	dir, _ := ioutil.TempDir("", "systemd")
+	defer os.RemoveAll(dir)
+	sock := path.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if !assert.NoError(err) {
+		return
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", sock)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	sent, err = Notify(Ready)
+	assert.NoError(err)
+	assert.True(sent)
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	assert.NoError(err)
+	assert.Equal(Ready, string(buf[:n]))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Unsetenv("WATCHDOG_USEC")
+	d, err := WatchdogInterval()
+	assert.NoError(err)
+	assert.Zero(d)
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	d, err = WatchdogInterval()
+	assert.NoError(err)
+	assert.Equal(30*time.Second, d)
+
+	// Meant for another process
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	d, _ = WatchdogInterval()
+	assert.Zero(d)
+
+	os.Unsetenv("WATCHDOG_PID")
+	os.Setenv("WATCHDOG_USEC", "bogus")
+	_, err = WatchdogInterval()
+	assert.Error(err)
+}
+
+func TestListenersNotActivated(t *testing.T) {
+	assert := assert.New(t)
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	l, err := Listeners()
+	assert.NoError(err)
+	assert.Nil(l)
+	assert.Empty(os.Getenv("LISTEN_FDS"))
+}
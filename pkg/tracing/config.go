@@ -0,0 +1,32 @@
+package tracing
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// Base URL of the OTLP/HTTP collector, spans are posted to <endpoint>/v1/traces
+	Endpoint string            `yaml:"endpoint"`
+	Headers  map[string]string `yaml:"headers"`
+	// Reported as the service.name resource attribute
+	ServiceName string `yaml:"serviceName"`
+	// Fraction of the traces to sample unless the caller has decided
+	SampleRatio float64 `yaml:"sampleRatio"`
+	Timeout     string  `yaml:"timeout"`
+	// Number of spans to buffer before dropping
+	QueueSize int `yaml:"queueSize"`
+	// Maximum number of spans in one export request
+	BatchSize     int    `yaml:"batchSize"`
+	FlushInterval string `yaml:"flushInterval"`
+	Insecure      bool   `yaml:"insecure"`
+}
+
+var Defaults = &Config{
+	Enabled:       false,
+	Endpoint:      "http://localhost:4318",
+	Headers:       map[string]string{},
+	ServiceName:   "ssh-inscribe",
+	SampleRatio:   1,
+	Timeout:       "10s",
+	QueueSize:     2048,
+	BatchSize:     256,
+	FlushInterval: "5s",
+	Insecure:      false,
+}
@@ -0,0 +1,13 @@
+package tracing
+
+import (
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/aakso/ssh-inscribe/pkg/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var Log *logrus.Entry = logging.GetLogger("tracing").WithField("pkg", "tracing")
+
+func init() {
+	config.SetDefault("tracing", Defaults)
+}
@@ -0,0 +1,11 @@
+package tracing
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var metricSpansDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "ssh_inscribe_tracing_spans_dropped_total",
+	Help: "Spans that could not be exported.",
+})
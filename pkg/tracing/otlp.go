@@ -0,0 +1,235 @@
+package tracing
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/globals"
+	"github.com/pkg/errors"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpTracesPath   = "/v1/traces"
+	otlpCloseTimeout = 10 * time.Second
+	scopeName        = "github.com/aakso/ssh-inscribe"
+)
+
+// Exports spans to an OpenTelemetry collector with OTLP/HTTP using the
+// protobuf encoding. Spans are queued and exported in batches in the background
+type OTLPExporter struct {
+	url           string
+	headers       map[string]string
+	client        *http.Client
+	resource      *resourcepb.Resource
+	batchSize     int
+	flushInterval time.Duration
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan *Span
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func NewOTLPExporter(conf *Config) (*OTLPExporter, error) {
+	if conf.Endpoint == "" {
+		return nil, errors.New("tracing endpoint is not set")
+	}
+	timeout, err := time.ParseDuration(conf.Timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid tracing timeout")
+	}
+	flushInterval, err := time.ParseDuration(conf.FlushInterval)
+	if err != nil || flushInterval <= 0 {
+		return nil, errors.New("invalid tracing flushInterval")
+	}
+	if conf.QueueSize < 1 || conf.BatchSize < 1 {
+		return nil, errors.New("tracing queueSize and batchSize must be positive")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	hostname, _ := os.Hostname()
+	e := &OTLPExporter{
+		url:     strings.TrimSuffix(conf.Endpoint, "/") + otlpTracesPath,
+		headers: conf.Headers,
+		client:  &http.Client{Timeout: timeout, Transport: transport},
+		resource: &resourcepb.Resource{Attributes: otlpAttributes(map[string]interface{}{
+			"service.name":    conf.ServiceName,
+			"service.version": globals.Version().String(),
+			"host.name":       hostname,
+		})},
+		batchSize:     conf.BatchSize,
+		flushInterval: flushInterval,
+		queue:         make(chan *Span, conf.QueueSize),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go e.worker()
+	return e, nil
+}
+
+func (e *OTLPExporter) Export(s *Span) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.closed {
+		return errors.New("exporter is closed")
+	}
+	select {
+	case e.queue <- s:
+		return nil
+	default:
+		metricSpansDropped.Inc()
+		return errors.New("span queue is full, dropping span")
+	}
+}
+
+// Close stops accepting new spans and exports the queued ones
+func (e *OTLPExporter) Close() error {
+	e.mu.Lock()
+	if e.closed {
+		e.mu.Unlock()
+		return nil
+	}
+	e.closed = true
+	close(e.queue)
+	e.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return nil
+	case <-time.After(otlpCloseTimeout):
+		close(e.stop)
+		<-e.done
+		return errors.New("timeout while exporting queued spans")
+	}
+}
+
+func (e *OTLPExporter) worker() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.post(batch); err != nil {
+			metricSpansDropped.Add(float64(len(batch)))
+			Log.WithError(err).WithField("spans", len(batch)).Error("cannot export spans")
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s, ok := <-e.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= e.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+func (e *OTLPExporter) post(spans []*Span) error {
+	data, err := proto.Marshal(e.encode(spans))
+	if err != nil {
+		return errors.Wrap(err, "cannot encode spans")
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) encode(spans []*Span) *coltracepb.ExportTraceServiceRequest {
+	ss := &tracepb.ScopeSpans{
+		Scope: &commonpb.InstrumentationScope{Name: scopeName, Version: globals.Version().String()},
+		Spans: make([]*tracepb.Span, 0, len(spans)),
+	}
+	for _, s := range spans {
+		o := &tracepb.Span{
+			TraceId:           append([]byte(nil), s.TraceID[:]...),
+			SpanId:            append([]byte(nil), s.SpanID[:]...),
+			Name:              s.Name,
+			Kind:              tracepb.Span_SpanKind(s.Kind),
+			StartTimeUnixNano: uint64(s.StartTime.UnixNano()),
+			EndTimeUnixNano:   uint64(s.EndTime.UnixNano()),
+			Attributes:        otlpAttributes(s.Attributes()),
+			Status:            &tracepb.Status{Code: tracepb.Status_StatusCode(s.Status), Message: s.StatusMessage},
+		}
+		if s.ParentID != (SpanID{}) {
+			o.ParentSpanId = append([]byte(nil), s.ParentID[:]...)
+		}
+		ss.Spans = append(ss.Spans, o)
+	}
+	return &coltracepb.ExportTraceServiceRequest{ResourceSpans: []*tracepb.ResourceSpans{{
+		Resource:   e.resource,
+		ScopeSpans: []*tracepb.ScopeSpans{ss},
+	}}}
+}
+
+func otlpAttributes(attrs map[string]interface{}) []*commonpb.KeyValue {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	r := make([]*commonpb.KeyValue, 0, len(keys))
+	for _, k := range keys {
+		v := &commonpb.AnyValue{}
+		switch t := attrs[k].(type) {
+		case string:
+			v.Value = &commonpb.AnyValue_StringValue{StringValue: t}
+		case bool:
+			v.Value = &commonpb.AnyValue_BoolValue{BoolValue: t}
+		case int:
+			v.Value = &commonpb.AnyValue_IntValue{IntValue: int64(t)}
+		case int64:
+			v.Value = &commonpb.AnyValue_IntValue{IntValue: t}
+		case float64:
+			v.Value = &commonpb.AnyValue_DoubleValue{DoubleValue: t}
+		default:
+			v.Value = &commonpb.AnyValue_StringValue{StringValue: fmt.Sprint(t)}
+		}
+		r = append(r, &commonpb.KeyValue{Key: k, Value: v})
+	}
+	return r
+}
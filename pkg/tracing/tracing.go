@@ -0,0 +1,274 @@
+// Package tracing records request spans and exports them to an
+// OpenTelemetry collector. Trace context is propagated with the W3C
+// traceparent header
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aakso/ssh-inscribe/pkg/config"
+	"github.com/pkg/errors"
+)
+
+const TraceParentHeader = "traceparent"
+
+// Span kinds as defined by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Span status codes as defined by OTLP
+const (
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// Span is a timed operation of a trace. Methods are safe to call on a nil
+// span so that callers need not check whether tracing is enabled
+type Span struct {
+	TraceID       TraceID
+	SpanID        SpanID
+	ParentID      SpanID
+	Name          string
+	Kind          int
+	StartTime     time.Time
+	EndTime       time.Time
+	Status        int
+	StatusMessage string
+	Sampled       bool
+
+	mu         sync.Mutex
+	attributes map[string]interface{}
+	ended      bool
+}
+
+// Attributes return a copy of the span attributes
+func (s *Span) Attributes() map[string]interface{} {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := make(map[string]interface{}, len(s.attributes))
+	for k, v := range s.attributes {
+		r[k] = v
+	}
+	return r
+}
+
+// Set an attribute. Values should be strings, booleans, integers or floats
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attributes[key] = value
+	s.mu.Unlock()
+}
+
+// Mark the span failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Status = StatusError
+	s.StatusMessage = err.Error()
+	s.mu.Unlock()
+}
+
+// End the span and queue it for export if sampled
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+	if !s.Sampled {
+		return
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if exporter != nil {
+		if err := exporter.Export(s); err != nil {
+			Log.WithError(err).WithField("span", s.Name).Debug("cannot export span")
+		}
+	}
+}
+
+// Return the W3C traceparent header value of the span
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", s.TraceID, s.SpanID, flags)
+}
+
+// Exporter delivers finished spans
+type Exporter interface {
+	Export(s *Span) error
+	Close() error
+}
+
+var (
+	mu          sync.RWMutex
+	exporter    Exporter
+	sampleRatio float64
+)
+
+type ctxKey struct{}
+
+// Return the current span of the context or nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(ctxKey{}).(*Span)
+	return s
+}
+
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	if s == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxKey{}, s)
+}
+
+// Start a span as a child of the current span of the context. Returns a nil
+// span if tracing is disabled
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	s := newSpan(name, KindInternal, parent)
+	return ContextWithSpan(ctx, s), s
+}
+
+// Start a server span continuing the trace of the traceparent header if it
+// is valid
+func StartServer(ctx context.Context, name string, traceParent string) (context.Context, *Span) {
+	parent, _ := ParseTraceParent(traceParent)
+	s := newSpan(name, KindServer, parent)
+	return ContextWithSpan(ctx, s), s
+}
+
+func newSpan(name string, kind int, parent *Span) *Span {
+	mu.RLock()
+	enabled, ratio := exporter != nil, sampleRatio
+	mu.RUnlock()
+	if !enabled {
+		return nil
+	}
+	s := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		attributes: make(map[string]interface{}),
+	}
+	rand.Read(s.SpanID[:])
+	if parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+		s.Sampled = parent.Sampled
+	} else {
+		rand.Read(s.TraceID[:])
+		s.Sampled = ratio >= 1 || mrand.Float64() < ratio
+	}
+	return s
+}
+
+// Parse the W3C traceparent header into a remote parent span
+func ParseTraceParent(v string) (*Span, error) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, errors.New("invalid traceparent")
+	}
+	// Version 00 has exactly four fields
+	if parts[0] == "00" && len(parts) != 4 {
+		return nil, errors.New("invalid traceparent")
+	}
+	s := &Span{}
+	if _, err := hex.Decode(s.TraceID[:], []byte(parts[1])); err != nil {
+		return nil, errors.New("invalid traceparent trace id")
+	}
+	if _, err := hex.Decode(s.SpanID[:], []byte(parts[2])); err != nil {
+		return nil, errors.New("invalid traceparent parent id")
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return nil, errors.New("invalid traceparent flags")
+	}
+	if s.TraceID == (TraceID{}) || s.SpanID == (SpanID{}) {
+		return nil, errors.New("invalid traceparent")
+	}
+	s.Sampled = flags[0]&1 == 1
+	return s, nil
+}
+
+// Initialize the exporter from the configuration
+func Setup() error {
+	tmp, err := config.Get("tracing")
+	if err != nil {
+		return errors.Wrap(err, "cannot initialize tracing")
+	}
+	conf, _ := tmp.(*Config)
+	if conf == nil {
+		return errors.New("cannot initialize tracing")
+	}
+	if !conf.Enabled {
+		SetExporter(nil, 0)
+		return nil
+	}
+	if conf.SampleRatio < 0 || conf.SampleRatio > 1 {
+		return errors.New("tracing sampleRatio must be between 0 and 1")
+	}
+	exp, err := NewOTLPExporter(conf)
+	if err != nil {
+		return errors.Wrap(err, "cannot initialize tracing")
+	}
+	SetExporter(exp, conf.SampleRatio)
+	Log.WithField("endpoint", conf.Endpoint).Info("tracing enabled")
+	return nil
+}
+
+// Replace the exporter, the previous one is closed. Tracing is disabled
+// with a nil exporter
+func SetExporter(e Exporter, ratio float64) {
+	mu.Lock()
+	old := exporter
+	exporter = e
+	sampleRatio = ratio
+	mu.Unlock()
+	if old != nil {
+		if err := old.Close(); err != nil {
+			Log.WithError(err).Error("cannot close span exporter")
+		}
+	}
+}
+
+// Flush and close the exporter
+func Close() {
+	SetExporter(nil, 0)
+}
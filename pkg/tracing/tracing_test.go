@@ -0,0 +1,154 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+type memExporter struct {
+	spans []*Span
+}
+
+func (m *memExporter) Export(s *Span) error {
+	m.spans = append(m.spans, s)
+	return nil
+}
+
+func (m *memExporter) Close() error { return nil }
+
+func TestDisabled(t *testing.T) {
+	assert := assert.New(t)
+	Close()
+	ctx, s := Start(context.Background(), "noop")
+	assert.Nil(s)
+	assert.Nil(FromContext(ctx))
+	// Safe on nil spans
+	s.SetAttribute("k", "v")
+	s.SetError(errors.New("fail"))
+	s.End()
+	assert.Empty(s.TraceParent())
+}
+
+func TestTraceParent(t *testing.T) {
+	assert := assert.New(t)
+	p, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if assert.NoError(err) {
+		assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", p.TraceID.String())
+		assert.Equal("00f067aa0ba902b7", p.SpanID.String())
+		assert.True(p.Sampled)
+	}
+	for _, v := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, err := ParseTraceParent(v)
+		assert.Error(err, v)
+	}
+}
+
+func TestSpans(t *testing.T) {
+	assert := assert.New(t)
+	exp := &memExporter{}
+	SetExporter(exp, 1)
+	defer Close()
+
+	ctx, root := StartServer(context.Background(), "GET /v1/ca",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, child := Start(ctx, "keysigner.sign")
+	child.SetAttribute("ca", "default")
+	child.SetError(errors.New("agent failure"))
+	child.End()
+	child.End()
+	root.End()
+
+	if assert.Len(exp.spans, 2) {
+		assert.Equal(child, exp.spans[0])
+		assert.Equal(root.TraceID, child.TraceID)
+		assert.Equal(root.SpanID, child.ParentID)
+		assert.Equal("00f067aa0ba902b7", root.ParentID.String())
+		assert.Equal(KindServer, root.Kind)
+		assert.Equal(StatusError, child.Status)
+		assert.Equal("default", child.Attributes()["ca"])
+	}
+
+	// Caller decided not to sample
+	exp.spans = nil
+	_, s := StartServer(context.Background(), "GET /v1/ca",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	s.End()
+	assert.Empty(exp.spans)
+
+	// Sample ratio applies to new traces
+	SetExporter(exp, 0)
+	_, s = Start(context.Background(), "sampled out")
+	assert.False(s.Sampled)
+	s.End()
+	assert.Empty(exp.spans)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	assert := assert.New(t)
+	received := make(chan *coltracepb.ExportTraceServiceRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(otlpTracesPath, r.URL.Path)
+		assert.Equal("application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal("secret", r.Header.Get("X-Api-Key"))
+		data, _ := ioutil.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		assert.NoError(proto.Unmarshal(data, req))
+		received <- req
+	}))
+	defer srv.Close()
+
+	conf := *Defaults
+	conf.Endpoint = srv.URL
+	conf.Headers = map[string]string{"X-Api-Key": "secret"}
+	exp, err := NewOTLPExporter(&conf)
+	if !assert.NoError(err) {
+		return
+	}
+	SetExporter(exp, 1)
+	_, s := Start(context.Background(), "auth")
+	s.SetAttribute("auth.backend", "ldap")
+	s.SetAttribute("auth.success", true)
+	s.End()
+	// Close exports the queued spans
+	Close()
+
+	select {
+	case req := <-received:
+		if assert.Len(req.ResourceSpans, 1) && assert.Len(req.ResourceSpans[0].ScopeSpans, 1) {
+			spans := req.ResourceSpans[0].ScopeSpans[0].Spans
+			if assert.Len(spans, 1) {
+				assert.Equal("auth", spans[0].Name)
+				assert.Equal(s.TraceID[:], spans[0].TraceId)
+				assert.Empty(spans[0].ParentSpanId)
+				assert.Len(spans[0].Attributes, 2)
+				assert.Equal("ldap", spans[0].Attributes[0].Value.GetStringValue())
+				assert.True(spans[0].Attributes[1].Value.GetBoolValue())
+			}
+		}
+		attrs := req.ResourceSpans[0].Resource.Attributes
+		var names []string
+		for _, a := range attrs {
+			names = append(names, a.Key)
+		}
+		assert.Contains(names, "service.name")
+	case <-time.After(5 * time.Second):
+		assert.Fail("spans were not exported")
+	}
+}
@@ -0,0 +1,28 @@
+package util
+
+import (
+	"strings"
+	"text/template"
+)
+
+// Functions for the user configurable templates
+var TemplateFuncs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+	"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+	"contains":   func(sub, s string) bool { return strings.Contains(s, sub) },
+	"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+	"join":       func(sep string, l []string) string { return strings.Join(l, sep) },
+	"has": func(l []string, s string) bool {
+		for _, v := range l {
+			if v == s {
+				return true
+			}
+		}
+		return false
+	},
+}